@@ -1,17 +1,24 @@
 package aof
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
-	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/rdb"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CmdLine is alias for [][]byte, represents a command line
@@ -19,99 +26,415 @@ type CmdLine = [][]byte
 
 const (
 	aofQueueSize = 1 << 16
+	// defaultAutoRewriteMinSize is the default of auto-aof-rewrite-min-size
+	defaultAutoRewriteMinSize = 64 << 20
+	defaultAofFilename        = "appendonly.aof"
+	// timestampAnnotation is the prefix of timestamp annotation in aof, such as #TS:1700000000
+	timestampAnnotation = "#TS:"
+	// rdbMagic is the header of rdb preamble
+	rdbMagic        = "REDIS"
+	rdbChecksumSize = 8
 )
 
+// policies of appendfsync
+const (
+	// FsyncAlways syncs aof before replying write commands, concurrent commands are synced together
+	FsyncAlways = "always"
+	// FsyncEverySec syncs aof every second
+	FsyncEverySec = "everysec"
+	// FsyncNo leaves syncing to operating system
+	FsyncNo = "no"
+)
+
+// ErrRewriteInProgress means another rewriting is running
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
 type payload struct {
 	cmdLine CmdLine
 	dbIndex int
+	// done is closed once command has been written and synced if appendfsync is always
+	done chan struct{}
 }
 
-// Handler receive msgs from channel and write to AOF file
+// Handler receive msgs from queue and write to AOF file
 type Handler struct {
-	db          database.EmbedDB
-	tmpDBMaker  func() database.EmbedDB
-	aofChan     chan *payload
-	aofFile     *os.File
-	aofFilename string
+	db database.EmbedDB
+	// queue buffers commands to be written by aof goroutine, queueMu protects queue and closed
+	queueMu   sync.Mutex
+	queueCond *sync.Cond
+	queue     []*payload
+	queueSize int
+	closed    bool
+	// writeToDisk means callers write commands into disk by themselves when queue is full, otherwise they block
+	writeToDisk bool
+	// writeMu keeps commands in order, since they may be written by callers when queue is full
+	writeMu sync.Mutex
+	// fsync is the policy of appendfsync: always, everysec or no, it could be changed by SetFsync.
+	// fsyncMu protects changing policy and stopFsync
+	fsync   atomic.Value
+	fsyncMu sync.Mutex
+	// commitWindow is how long aof goroutine waits for more commands before writing and syncing them together
+	commitWindow time.Duration
+	// stopFsync stops syncing aof file every second
+	stopFsync chan struct{}
+	// aofFile is the latest incr file, which new commands are appended to
+	aofFile *os.File
+	aofDir  string
+	// aofName is the prefix of aof files, such as appendonly.aof
+	aofName  string
+	manifest *manifest
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shutdown
 	aofFinished chan struct{}
 	// pause aof for start/finish aof rewrite progress
 	pausingAof sync.RWMutex
 	currentDB  int
+	// rewriting is 1 while aof is being rewritten, it prevents concurrent rewriting
+	rewriting int32
+	// currentSize is the total size of aof files, baseSize is the size after the latest rewrite or startup.
+	// They are used to trigger rewrite automatically
+	currentSize int64
+	baseSize    int64
+	// statusMu protects status of rewriting
+	statusMu     sync.Mutex
+	rewriteStart time.Time
+	// lastRewriteTime is the duration of the latest rewriting, -1 if never rewritten
+	lastRewriteTime   time.Duration
+	lastRewriteFailed bool
+	// rewrites is the number of rewriting since startup, rewriteFailures is the number of consecutive failed ones
+	rewrites        int64
+	rewriteFailures int64
+	// lastWriteFailed is 1 if the latest writing or fsync failed
+	lastWriteFailed int32
+	// lastTimestamp is the unix timestamp of the latest annotation written into incr file
+	lastTimestamp int64
+	// truncateTo is the unix timestamp at which loading stops, 0 means loading all.
+	// truncated is set if commands after it are discarded
+	truncateTo int64
+	truncated  bool
+	// rewritten is called with the new base file after rewriting finished, such as uploading it as backup
+	rewritten func(filename string)
 }
 
 // NewAOFHandler creates a new aof.Handler
-func NewAOFHandler(db database.EmbedDB, tmpDBMaker func() database.EmbedDB) (*Handler, error) {
+func NewAOFHandler(db database.EmbedDB) (*Handler, error) {
 	handler := &Handler{}
-	handler.aofFilename = config.Properties.AppendFilename
+	handler.lastRewriteTime = -1
+	switch strings.ToLower(config.Properties().AofBackpressure) {
+	case "", "block":
+	case "disk":
+		handler.writeToDisk = true
+	default:
+		return nil, errors.New("unknown aof backpressure policy: " + config.Properties().AofBackpressure)
+	}
+	fsync, err := parseFsync(config.Properties().AppendFsync)
+	if err != nil {
+		return nil, err
+	}
+	handler.fsync.Store(fsync)
+	handler.commitWindow = time.Duration(config.Properties().AofGroupCommitWindow) * time.Microsecond
+	handler.queueSize = config.Properties().AofQueueSize
+	if handler.queueSize <= 0 {
+		handler.queueSize = aofQueueSize
+	}
+	filename := config.Properties().AppendFilename
+	if filename == "" {
+		filename = defaultAofFilename
+	}
+	handler.aofName = filepath.Base(filename)
+	handler.aofDir = config.Properties().AppendDirname
+	if handler.aofDir == "" {
+		handler.aofDir = filepath.Dir(filename)
+	}
 	handler.db = db
-	handler.tmpDBMaker = tmpDBMaker
-	handler.LoadAof(0)
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	err = os.MkdirAll(handler.aofDir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	handler.aofFile = aofFile
-	handler.aofChan = make(chan *payload, aofQueueSize)
+	err = handler.initManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	err = handler.repairTruncated()
+	if err != nil {
+		return nil, err
+	}
+	handler.truncateTo = int64(config.Properties().AofTruncateToTimestamp)
+	handler.LoadAof()
+	if n := len(handler.manifest.incrs); n > 0 {
+		handler.aofFile, err = handler.openIncrFile(handler.manifest.incrs[n-1])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		incr := handler.newAofInfo(incrFileType)
+		handler.aofFile, err = handler.openIncrFile(incr)
+		if err != nil {
+			return nil, err
+		}
+		handler.manifest.incrs = append(handler.manifest.incrs, incr)
+		err = handler.manifest.save(handler.manifestFilename())
+		if err != nil {
+			_ = handler.aofFile.Close()
+			return nil, err
+		}
+	}
+	handler.currentSize = handler.filesSize()
+	handler.baseSize = handler.currentSize
+	if handler.truncated {
+		// rewrite discarding commands after the timestamp, otherwise they would be loaded at next startup
+		err = handler.Rewrite()
+		if err != nil {
+			_ = handler.aofFile.Close()
+			return nil, err
+		}
+	}
+	handler.truncateTo = 0
+	handler.queueCond = sync.NewCond(&handler.queueMu)
 	handler.aofFinished = make(chan struct{})
 	go func() {
 		handler.handleAof()
 	}()
+	if fsync == FsyncEverySec {
+		handler.stopFsync = make(chan struct{})
+		go handler.fsyncEverySec(handler.stopFsync)
+	}
 	return handler, nil
 }
 
-// AddAof send command to aof goroutine through channel
+func parseFsync(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		return FsyncEverySec, nil
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return strings.ToLower(policy), nil
+	}
+	return "", errors.New("unknown appendfsync policy: " + policy)
+}
+
+func (handler *Handler) fsyncPolicy() string {
+	return handler.fsync.Load().(string)
+}
+
+// SetFsync changes policy of appendfsync during runtime, syncing every second is started or stopped accordingly
+func (handler *Handler) SetFsync(policy string) error {
+	fsync, err := parseFsync(policy)
+	if err != nil {
+		return err
+	}
+	handler.fsyncMu.Lock()
+	defer handler.fsyncMu.Unlock()
+	if handler.fsyncPolicy() == fsync {
+		return nil
+	}
+	if handler.stopFsync != nil {
+		close(handler.stopFsync)
+		handler.stopFsync = nil
+	}
+	if fsync == FsyncEverySec {
+		handler.stopFsync = make(chan struct{})
+		go handler.fsyncEverySec(handler.stopFsync)
+	}
+	handler.fsync.Store(fsync)
+	logger.Info("appendfsync is changed to " + fsync)
+	return nil
+}
+
+// AddAof puts command into queue of aof goroutine. If the queue is full, it blocks until there is room,
+// or writes queued commands and itself into disk directly if aof-backpressure is disk.
+// If appendfsync is always, it returns after the command has been synced into disk
 func (handler *Handler) AddAof(dbIndex int, cmdLine CmdLine) {
-	if config.Properties.AppendOnly && handler.aofChan != nil {
-		handler.aofChan <- &payload{
-			cmdLine: cmdLine,
-			dbIndex: dbIndex,
-		}
+	if !config.Properties().AppendOnly || handler.queueCond == nil {
+		return // aof is loading
+	}
+	p := &payload{
+		cmdLine: cmdLine,
+		dbIndex: dbIndex,
+	}
+	if handler.fsyncPolicy() == FsyncAlways {
+		p.done = make(chan struct{})
+	}
+	if handler.enqueue(p) && p.done != nil {
+		<-p.done
 	}
 }
 
-// handleAof listen aof channel and write into file
+// enqueue puts payload into queue, it returns false if aof has been closed
+func (handler *Handler) enqueue(p *payload) bool {
+	handler.queueMu.Lock()
+	defer handler.queueMu.Unlock()
+	for !handler.closed && !handler.writeToDisk && len(handler.queue) >= handler.queueSize {
+		handler.queueCond.Wait()
+	}
+	if handler.closed {
+		return false
+	}
+	if len(handler.queue) >= handler.queueSize {
+		// no command could be queued while holding queueMu, so commands are written in order
+		queue := handler.queue
+		handler.queue = nil
+		handler.writeMu.Lock()
+		handler.writePayloads(append(queue, p))
+		handler.writeMu.Unlock()
+		return true
+	}
+	handler.queue = append(handler.queue, p)
+	handler.queueCond.Broadcast()
+	return true
+}
+
+// handleAof takes commands from queue and write into file
 func (handler *Handler) handleAof() {
-	// serialized execution
-	handler.currentDB = 0
-	for p := range handler.aofChan {
-		// 写AOF时，仅加读锁
-		handler.pausingAof.RLock() // prevent other goroutines from pausing aof
-
-		// 先选择操作的数据库，该命令也需要记录到aof文件中
-		if p.dbIndex != handler.currentDB {
-			// select db
-			data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
+	for {
+		handler.queueMu.Lock()
+		for !handler.closed && len(handler.queue) == 0 {
+			handler.queueCond.Wait()
+		}
+		if len(handler.queue) == 0 {
+			// closed and all commands have been written
+			handler.queueMu.Unlock()
+			break
+		}
+		if handler.commitWindow > 0 && !handler.closed {
+			// wait for more commands, so they could be written and synced together
+			handler.queueMu.Unlock()
+			time.Sleep(handler.commitWindow)
+			handler.queueMu.Lock()
+		}
+		queue := handler.queue
+		handler.queue = nil
+		// lock writeMu before releasing queueMu, so callers cannot write commands queued later first
+		handler.writeMu.Lock()
+		handler.queueCond.Broadcast() // wake up callers waiting for room
+		handler.queueMu.Unlock()
+		handler.writePayloads(queue)
+		handler.writeMu.Unlock()
+	}
+	handler.aofFinished <- struct{}{}
+}
+
+// writePayloads writes commands into file, invoker should hold writeMu.
+// If appendfsync is always, file is synced once for all of them, which is known as group commit
+func (handler *Handler) writePayloads(payloads []*payload) {
+	for _, p := range payloads {
+		handler.writePayload(p)
+	}
+	if handler.fsyncPolicy() == FsyncAlways {
+		handler.pausingAof.RLock()
+		err := handler.aofFile.Sync()
+		handler.pausingAof.RUnlock()
+		if err != nil {
+			logger.Warn("fsync failed: " + err.Error())
+			atomic.StoreInt32(&handler.lastWriteFailed, 1)
+		}
+	}
+	for _, p := range payloads {
+		if p.done != nil {
+			close(p.done)
+		}
+	}
+	if handler.needRewrite() {
+		go handler.autoRewrite()
+	}
+}
+
+func (handler *Handler) writePayload(p *payload) {
+	// 写AOF时，仅加读锁
+	handler.pausingAof.RLock() // prevent other goroutines from pausing aof
+	defer handler.pausingAof.RUnlock()
+
+	if config.Properties().AofTimestampEnabled {
+		if now := time.Now().Unix(); now != handler.lastTimestamp {
+			data := []byte(timestampAnnotation + strconv.FormatInt(now, 10) + "\r\n")
+			n, err := handler.aofFile.Write(data)
+			atomic.AddInt64(&handler.currentSize, int64(n))
 			if err != nil {
 				logger.Warn(err)
-				handler.pausingAof.RUnlock()
-				continue // skip this command
+				atomic.StoreInt32(&handler.lastWriteFailed, 1)
+			} else {
+				handler.lastTimestamp = now
 			}
-			handler.currentDB = p.dbIndex
 		}
+	}
 
-		// 然后再写命令到aof文件中
-		data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-		_, err := handler.aofFile.Write(data)
+	// 先选择操作的数据库，该命令也需要记录到aof文件中
+	if p.dbIndex != handler.currentDB {
+		// select db
+		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
+		n, err := handler.aofFile.Write(data)
+		atomic.AddInt64(&handler.currentSize, int64(n))
 		if err != nil {
 			logger.Warn(err)
+			atomic.StoreInt32(&handler.lastWriteFailed, 1)
+			return // skip this command
+		}
+		handler.currentDB = p.dbIndex
+	}
+
+	// 然后再写命令到aof文件中
+	data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
+	n, err := handler.aofFile.Write(data)
+	atomic.AddInt64(&handler.currentSize, int64(n))
+	if err != nil {
+		logger.Warn(err)
+		atomic.StoreInt32(&handler.lastWriteFailed, 1)
+		return
+	}
+	atomic.StoreInt32(&handler.lastWriteFailed, 0)
+}
+
+// fsyncEverySec syncs aof file every second until aof closed
+func (handler *Handler) fsyncEverySec(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			handler.pausingAof.RLock()
+			err := handler.aofFile.Sync()
+			handler.pausingAof.RUnlock()
+			if err != nil {
+				logger.Warn("fsync failed: " + err.Error())
+				atomic.StoreInt32(&handler.lastWriteFailed, 1)
+			}
+		case <-stop:
+			return
 		}
-		handler.pausingAof.RUnlock()
 	}
-	handler.aofFinished <- struct{}{}
 }
 
-// LoadAof read aof file
-func (handler *Handler) LoadAof(maxBytes int) {
-	// delete aofChan to prevent write again
-	aofChan := handler.aofChan
-	handler.aofChan = nil
-	defer func(aofChan chan *payload) {
-		handler.aofChan = aofChan
-	}(aofChan)
+// repairTruncated truncates incomplete command at the end of the latest aof file if aof-load-truncated is enabled,
+// since commands appended after it would be unreadable
+func (handler *Handler) repairTruncated() error {
+	files := handler.manifest.files()
+	if len(files) == 0 {
+		return nil
+	}
+	filename := handler.aofPath(files[len(files)-1])
+	valid, err := CheckFile(filename)
+	if err != ErrTruncated {
+		return nil // other errors are reported during loading
+	}
+	if !config.Properties().AofLoadTruncated {
+		return fmt.Errorf("%s is truncated, please repair it by check-aof -fix", filename)
+	}
+	logger.Warn(fmt.Sprintf("%s is truncated, discard incomplete command after offset %d", filename, valid))
+	return os.Truncate(filename, valid)
+}
 
-	file, err := os.Open(handler.aofFilename)
+// LoadAof reads aof files listed in manifest in order
+func (handler *Handler) LoadAof() {
+	for _, info := range handler.manifest.files() {
+		handler.loadFile(handler.aofPath(info))
+		if handler.truncated {
+			logger.Info("aof loading truncated to timestamp " + strconv.FormatInt(handler.truncateTo, 10))
+			break
+		}
+	}
+}
+
+// loadFile reads an aof file, every file starts with db 0 selected
+func (handler *Handler) loadFile(filename string) {
+	file, err := os.Open(filename)
 	if err != nil {
 		if _, ok := err.(*os.PathError); ok {
 			return
@@ -121,14 +444,15 @@ func (handler *Handler) LoadAof(maxBytes int) {
 	}
 	defer file.Close()
 
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
+	bufReader := bufio.NewReader(file)
+	err = handler.loadPreamble(bufReader)
+	if err != nil {
+		logger.Error("load rdb preamble failed: " + err.Error())
+		return
 	}
-	ch := parser.ParseStream(reader)
-	fakeConn := &connection.FakeConn{} // only used for save dbIndex
+	ch := parser.ParseStream(bufReader)
+	applier := newApplier(handler.db)
+	defer applier.close()
 	for p := range ch {
 		if p.Err != nil {
 			if p.Err == io.EOF {
@@ -146,18 +470,81 @@ func (handler *Handler) LoadAof(maxBytes int) {
 			logger.Error("require multi bulk protocol")
 			continue
 		}
-		ret := handler.db.Exec(fakeConn, r.Args)
-		if protocol.IsErrorReply(ret) {
-			logger.Error("exec err", ret.ToBytes())
+		if len(r.Args) == 1 && len(r.Args[0]) > 0 && r.Args[0][0] == '#' {
+			// annotation such as #TS:1700000000
+			if handler.exceedTruncateTimestamp(r.Args[0]) {
+				handler.truncated = true
+				break
+			}
+			continue
 		}
+		applier.apply(r.Args)
+	}
+	if handler.truncated {
+		// stop parsing goroutine which is blocked on sending
+		_ = file.Close()
+		for range ch {
+		}
+	}
+}
+
+// exceedTruncateTimestamp returns whether annotation is a timestamp later than truncateTo
+func (handler *Handler) exceedTruncateTimestamp(annotation []byte) bool {
+	if handler.truncateTo <= 0 || !strings.HasPrefix(string(annotation), timestampAnnotation) {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(string(annotation[len(timestampAnnotation):]), 10, 64)
+	return err == nil && timestamp > handler.truncateTo
+}
+
+// loadPreamble loads rdb preamble if aof file starts with rdb magic header,
+// after that reader is positioned at the first command following the preamble
+func (handler *Handler) loadPreamble(reader *bufio.Reader) error {
+	return readPreamble(reader, func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+		handler.db.LoadEntity(dbIndex, key, entity, expiration)
+		return true
+	})
+}
+
+// readPreamble reads rdb preamble and calls cb for each key if reader starts with rdb magic header
+func readPreamble(reader *bufio.Reader, cb func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool) error {
+	header, err := reader.Peek(len(rdbMagic))
+	if err != nil || string(header) != rdbMagic {
+		return nil // not a preamble, empty file is also fine
+	}
+	err = rdb.Load(reader, cb)
+	if err != nil {
+		return err
+	}
+	// decoder stops at EOF opcode, skip checksum and the line feed written after it
+	_, err = reader.Discard(rdbChecksumSize)
+	if err != nil {
+		return err
+	}
+	if next, err := reader.Peek(1); err == nil && next[0] == '\n' {
+		_, _ = reader.Discard(1)
 	}
+	return nil
 }
 
 // Close gracefully stops aof persistence procedure
 func (handler *Handler) Close() {
 	if handler.aofFile != nil {
-		close(handler.aofChan)
-		<-handler.aofFinished // wait for aof finished
+		handler.queueMu.Lock()
+		handler.closed = true
+		handler.queueCond.Broadcast()
+		handler.queueMu.Unlock()
+		<-handler.aofFinished
+		handler.fsyncMu.Lock()
+		if handler.stopFsync != nil {
+			close(handler.stopFsync)
+			handler.stopFsync = nil
+		}
+		handler.fsyncMu.Unlock()
+		// written commands may be still in page cache if appendfsync is everysec or no
+		if err := handler.aofFile.Sync(); err != nil {
+			logger.Warn(err)
+		}
 		err := handler.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
@@ -0,0 +1,153 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hdt3213/godis/interface/database"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTruncated means aof file ends with an incomplete command, which is usually left by crash during writing
+var ErrTruncated = errors.New("aof file is truncated")
+
+// countingReader counts bytes read from underlying reader
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// CheckFile validates aof file and returns the length of its valid content.
+// It returns ErrTruncated if the file ends with an incomplete command, and the file could be repaired by
+// truncating it to the valid length
+func CheckFile(filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return checkAof(file)
+}
+
+func checkAof(src io.Reader) (int64, error) {
+	counter := &countingReader{reader: src}
+	reader := bufio.NewReader(counter)
+	offset := func() int64 {
+		return counter.n - int64(reader.Buffered())
+	}
+	err := readPreamble(reader, func(int, string, *database.DataEntity, *time.Time) bool {
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bad rdb preamble: %v", err)
+	}
+	for {
+		valid := offset()
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, ErrTruncated
+		}
+		if len(line) < 3 || line[len(line)-2] != '\r' {
+			return valid, fmt.Errorf("bad format at offset %d: line should end with CRLF", valid)
+		}
+		if line[0] == '#' {
+			continue // annotation
+		}
+		if line[0] != '*' {
+			return valid, fmt.Errorf("bad format at offset %d: command should be a multi bulk", valid)
+		}
+		argc, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || argc <= 0 {
+			return valid, fmt.Errorf("bad format at offset %d: illegal argument count", valid)
+		}
+		for i := 0; i < argc; i++ {
+			line, err = reader.ReadBytes('\n')
+			if err != nil {
+				return valid, ErrTruncated
+			}
+			if len(line) < 4 || line[0] != '$' || line[len(line)-2] != '\r' {
+				return valid, fmt.Errorf("bad format at offset %d: illegal bulk string header", valid)
+			}
+			argLen, err := strconv.Atoi(string(line[1 : len(line)-2]))
+			if err != nil || argLen < 0 {
+				return valid, fmt.Errorf("bad format at offset %d: illegal bulk string length", valid)
+			}
+			body := make([]byte, argLen+2)
+			_, err = io.ReadFull(reader, body)
+			if err != nil {
+				return valid, ErrTruncated
+			}
+			if body[argLen] != '\r' || body[argLen+1] != '\n' {
+				return valid, fmt.Errorf("bad format at offset %d: bulk string should end with CRLF", valid)
+			}
+		}
+	}
+}
+
+// RunCheckCommand validates aof files, it returns exit code of the command.
+// usage: check-aof [-fix] <aof file or manifest file>
+// All files listed in manifest are checked, and -fix truncates incomplete command at the end of the last one
+func RunCheckCommand(args []string, out io.Writer) int {
+	flagSet := flag.NewFlagSet("check-aof", flag.ContinueOnError)
+	flagSet.SetOutput(out)
+	fix := flagSet.Bool("fix", false, "truncate incomplete command at the end of aof")
+	if err := flagSet.Parse(args); err != nil {
+		return 1
+	}
+	if flagSet.NArg() != 1 {
+		_, _ = fmt.Fprintln(out, "usage: check-aof [-fix] <aof file or manifest file>")
+		return 1
+	}
+	filename := flagSet.Arg(0)
+	filenames := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		m, err := parseManifest(filename)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "read manifest failed: %v\n", err)
+			return 1
+		}
+		filenames = nil
+		for _, info := range m.files() {
+			filenames = append(filenames, filepath.Join(filepath.Dir(filename), info.name))
+		}
+	}
+	code := 0
+	for i, name := range filenames {
+		valid, err := CheckFile(name)
+		switch {
+		case err == nil:
+			_, _ = fmt.Fprintf(out, "%s: ok\n", name)
+		case err == ErrTruncated && *fix && i == len(filenames)-1:
+			if err := os.Truncate(name, valid); err != nil {
+				_, _ = fmt.Fprintf(out, "%s: truncate failed: %v\n", name, err)
+				code = 1
+				continue
+			}
+			_, _ = fmt.Fprintf(out, "%s: fixed, truncated to %d bytes\n", name, valid)
+		case err == ErrTruncated:
+			_, _ = fmt.Fprintf(out, "%s: truncated, valid up to %d bytes\n", name, valid)
+			code = 1
+		default:
+			_, _ = fmt.Fprintf(out, "%s: %v\n", name, err)
+			code = 1
+		}
+	}
+	return code
+}
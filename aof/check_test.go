@@ -0,0 +1,51 @@
+package aof
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAof(t *testing.T) {
+	set := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()
+	valid := append([]byte("#TS:1700000000\r\n"), set...)
+	valid = append(valid, set...)
+	n, err := checkAof(bytes.NewReader(valid))
+	if err != nil || n != int64(len(valid)) {
+		t.Errorf("expected valid %d bytes, actually %d, %v", len(valid), n, err)
+	}
+	for i := len(valid) - len(set) + 1; i < len(valid); i++ {
+		n, err = checkAof(bytes.NewReader(valid[:i]))
+		if err != ErrTruncated || n != int64(len(valid)-len(set)) {
+			t.Errorf("expected truncated at %d, actually %d, %v", len(valid)-len(set), n, err)
+		}
+	}
+	_, err = checkAof(bytes.NewReader(append(append([]byte{}, set...), "SET a 1\r\n"...)))
+	if err == nil || err == ErrTruncated {
+		t.Errorf("expected bad format, actually %v", err)
+	}
+}
+
+func TestRunCheckCommand(t *testing.T) {
+	set := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "1")).ToBytes()
+	filename := filepath.Join(t.TempDir(), "a.aof")
+	err := ioutil.WriteFile(filename, append(append([]byte{}, set...), set[:5]...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &strings.Builder{}
+	if code := RunCheckCommand([]string{filename}, out); code != 1 {
+		t.Errorf("expected exit code 1, actually %d, %s", code, out)
+	}
+	if code := RunCheckCommand([]string{"-fix", filename}, out); code != 0 {
+		t.Errorf("expected exit code 0, actually %d, %s", code, out)
+	}
+	content, _ := ioutil.ReadFile(filename)
+	if !bytes.Equal(content, set) {
+		t.Errorf("expected fixed content %q, actually %q", set, content)
+	}
+}
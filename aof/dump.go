@@ -0,0 +1,100 @@
+package aof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/rdb"
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+	"github.com/hdt3213/rdb/parser"
+)
+
+// dumpRDBVersion is the rdb version written in the footer of DUMP payload.
+// Redis refuses payloads with a version higher than its own, so we use the lowest version covering all encodings we write.
+const dumpRDBVersion = 9
+
+// maxDumpRDBVersion is the highest rdb version the parser understands
+const maxDumpRDBVersion = 10
+
+var (
+	// ErrDumpPayload means the version or checksum of DUMP payload is wrong
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	// ErrBadDumpFormat means the DUMP payload cannot be parsed
+	ErrBadDumpFormat = errors.New("Bad data format")
+)
+
+// redis uses crc-64-jones (reflected, no initial value and no final xor) to checksum rdb and DUMP payload
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Jones(data []byte) uint64 {
+	var crc uint64
+	for _, b := range data {
+		crc = crc64JonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// DumpEntity serializes entity into the format of redis DUMP command:
+// type byte, value in rdb format, 2 bytes rdb version and 8 bytes crc64 checksum, both in little endian
+func DumpEntity(entity *database.DataEntity) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := encoder.NewEncoder(buf).EnableCompress()
+	err := enc.WriteHeader()
+	if err != nil {
+		return nil, err
+	}
+	err = enc.WriteDBHeader(0, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	objectBegin := buf.Len()
+	// encoder writes type byte, key and value. The key is empty, so it occupies only 1 byte of zero length.
+	err = rdb.WriteEntity(enc, "", entity)
+	if err != nil {
+		return nil, err
+	}
+	object := buf.Bytes()[objectBegin:]
+	payload := make([]byte, len(object)+9)
+	payload[0] = object[0]
+	n := copy(payload[1:], object[2:]) + 1
+	binary.LittleEndian.PutUint16(payload[n:], dumpRDBVersion)
+	binary.LittleEndian.PutUint64(payload[n+2:], crc64Jones(payload[:n+2]))
+	return payload, nil
+}
+
+// ParseDumpPayload verifies and parses payload generated by DUMP command
+func ParseDumpPayload(payload []byte) (model.RedisObject, error) {
+	if len(payload) < 11 {
+		return nil, ErrDumpPayload
+	}
+	footer := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[footer:])
+	checksum := binary.LittleEndian.Uint64(payload[footer+2:])
+	if version > maxDumpRDBVersion {
+		return nil, ErrDumpPayload
+	}
+	// redis skips verifying if the checksum is 0
+	if checksum != 0 && checksum != crc64Jones(payload[:footer+2]) {
+		return nil, ErrDumpPayload
+	}
+	// wrap payload into a rdb file containing a single object with empty key
+	buf := make([]byte, 0, footer+14)
+	buf = append(buf, "REDIS0009"...)
+	buf = append(buf, 0xfe, 0x00) // select db 0
+	buf = append(buf, payload[0], 0x00)
+	buf = append(buf, payload[1:footer]...)
+	buf = append(buf, 0xff) // EOF
+	var obj model.RedisObject
+	decoder := parser.NewDecoder(bytes.NewReader(buf))
+	err := decoder.Parse(func(o model.RedisObject) bool {
+		obj = o
+		return false
+	})
+	if err != nil || obj == nil {
+		return nil, ErrBadDumpFormat
+	}
+	return obj, nil
+}
@@ -0,0 +1,128 @@
+package aof
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"runtime"
+	"sync"
+)
+
+// loadQueueSize is the max number of commands waiting for each worker
+const loadQueueSize = 1024
+
+// applier executes commands read from aof with workers in parallel.
+// Keys are partitioned among workers by hash, so commands of the same key are executed by one worker in order.
+// Commands accessing keys of different workers or no key, such as SELECT and FLUSHALL,
+// are executed by loading goroutine after all commands before them have been executed.
+type applier struct {
+	db database.EmbedDB
+	// conn executes commands not dispatched to workers, and holds the selected db
+	conn    *connection.FakeConn
+	workers []chan *loadJob
+	pending sync.WaitGroup
+}
+
+type loadJob struct {
+	dbIndex int
+	cmdLine CmdLine
+}
+
+// loadWorkerNum returns number of workers which is power of 2, so keys of a lock shard belong to the same worker
+func loadWorkerNum() int {
+	n := config.Properties().AofLoadWorkers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	num := 1
+	for num*2 <= n {
+		num *= 2
+	}
+	return num
+}
+
+func newApplier(db database.EmbedDB) *applier {
+	a := &applier{
+		db:   db,
+		conn: &connection.FakeConn{},
+	}
+	workerNum := loadWorkerNum()
+	if workerNum == 1 {
+		return a // executes all commands by loading goroutine
+	}
+	a.workers = make([]chan *loadJob, workerNum)
+	for i := range a.workers {
+		jobs := make(chan *loadJob, loadQueueSize)
+		a.workers[i] = jobs
+		go a.work(jobs)
+	}
+	return a
+}
+
+func (a *applier) work(jobs <-chan *loadJob) {
+	conn := &connection.FakeConn{}
+	for job := range jobs {
+		conn.SelectDB(job.dbIndex)
+		a.exec(conn, job.cmdLine)
+		a.pending.Done()
+	}
+}
+
+func (a *applier) exec(conn *connection.FakeConn, cmdLine CmdLine) {
+	ret := a.db.Exec(conn, cmdLine)
+	if protocol.IsErrorReply(ret) {
+		logger.Error("exec err", ret.ToBytes())
+	}
+}
+
+// apply dispatches cmdLine to the worker its keys belong to, or executes it after all dispatched commands finished
+func (a *applier) apply(cmdLine CmdLine) {
+	if worker := a.route(cmdLine); worker >= 0 {
+		a.pending.Add(1)
+		a.workers[worker] <- &loadJob{
+			dbIndex: a.conn.GetDBIndex(),
+			cmdLine: cmdLine,
+		}
+		return
+	}
+	a.pending.Wait()
+	a.exec(a.conn, cmdLine)
+}
+
+// route returns the worker which all keys of cmdLine belong to, or -1 if there is no such worker
+func (a *applier) route(cmdLine CmdLine) int {
+	if len(a.workers) == 0 || a.conn.InMultiState() {
+		// commands within transaction are queued in conn
+		return -1
+	}
+	writeKeys, readKeys := a.db.GetRelatedKeys(cmdLine)
+	worker := -1
+	for _, key := range append(writeKeys, readKeys...) {
+		i := int(fnv32(key) & uint32(len(a.workers)-1))
+		if worker >= 0 && worker != i {
+			return -1
+		}
+		worker = i
+	}
+	return worker
+}
+
+// close waits for all dispatched commands finished and stops workers
+func (a *applier) close() {
+	a.pending.Wait()
+	for _, jobs := range a.workers {
+		close(jobs)
+	}
+}
+
+// fnv32 is the same hash as lock of keys, so workers don't contend for the same lock
+func fnv32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash *= 16777619
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
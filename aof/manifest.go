@@ -0,0 +1,252 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	baseFileType = "b"
+	incrFileType = "i"
+)
+
+// aofInfo describes a file of multi-part aof
+type aofInfo struct {
+	name     string
+	seq      int
+	fileType string
+}
+
+// manifest tracks files of multi-part aof. Base file holds the snapshot of the latest rewriting,
+// incr files hold commands written after it in order.
+// Each line of manifest file looks like: file appendonly.aof.1.base.aof seq 1 type b
+type manifest struct {
+	base  *aofInfo
+	incrs []*aofInfo
+}
+
+// files returns all aof files in loading order
+func (m *manifest) files() []*aofInfo {
+	var files []*aofInfo
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// copy returns a manifest holding files of m, so later changes on m doesn't affect it
+func (m *manifest) copy() *manifest {
+	return &manifest{
+		base:  m.base,
+		incrs: append([]*aofInfo(nil), m.incrs...),
+	}
+}
+
+func (m *manifest) nextSeq(fileType string) int {
+	if fileType == baseFileType {
+		if m.base == nil {
+			return 1
+		}
+		return m.base.seq + 1
+	}
+	if len(m.incrs) == 0 {
+		return 1
+	}
+	return m.incrs[len(m.incrs)-1].seq + 1
+}
+
+func parseManifest(filename string) (*manifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	m := &manifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		info, err := parseAofInfo(line)
+		if err != nil {
+			return nil, err
+		}
+		if info.fileType == baseFileType {
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file in manifest: " + line)
+			}
+			m.base = info
+		} else {
+			m.incrs = append(m.incrs, info)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseAofInfo(line string) (*aofInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("invalid manifest line: " + line)
+	}
+	info := &aofInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			info.name = fields[i+1]
+		case "seq":
+			seq, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return nil, errors.New("invalid seq in manifest line: " + line)
+			}
+			info.seq = seq
+		case "type":
+			info.fileType = fields[i+1]
+		}
+	}
+	if info.name == "" || (info.fileType != baseFileType && info.fileType != incrFileType) {
+		return nil, errors.New("invalid manifest line: " + line)
+	}
+	return info, nil
+}
+
+// save writes manifest into a temporary file and renames it to filename,
+// so switching to new files is atomic
+func (m *manifest) save(filename string) error {
+	var builder strings.Builder
+	for _, info := range m.files() {
+		builder.WriteString(fmt.Sprintf("file %s seq %d type %s\n", info.name, info.seq, info.fileType))
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "temp-*.manifest")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name()) // no effect after renamed
+	}()
+	_, err = tmpFile.WriteString(builder.String())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+func (handler *Handler) manifestFilename() string {
+	return filepath.Join(handler.aofDir, handler.aofName+".manifest")
+}
+
+func (handler *Handler) aofPath(info *aofInfo) string {
+	return filepath.Join(handler.aofDir, info.name)
+}
+
+// newAofInfo names the next file of given type, such as appendonly.aof.2.incr.aof
+func (handler *Handler) newAofInfo(fileType string) *aofInfo {
+	seq := handler.manifest.nextSeq(fileType)
+	suffix := "incr"
+	if fileType == baseFileType {
+		suffix = "base"
+	}
+	return &aofInfo{
+		name:     fmt.Sprintf("%s.%d.%s.aof", handler.aofName, seq, suffix),
+		seq:      seq,
+		fileType: fileType,
+	}
+}
+
+// initManifest reads manifest file. If it doesn't exist, aof file written by older version is used as base file
+// RestoreFilename returns where a backup should be downloaded before aof loaded, the file is loaded as base
+// like aof of older versions. It returns false if there are aof files already, which shouldn't be overwritten
+func RestoreFilename() (string, bool) {
+	filename := config.Properties().AppendFilename
+	if filename == "" {
+		filename = defaultAofFilename
+	}
+	aofDir := config.Properties().AppendDirname
+	if aofDir == "" {
+		aofDir = filepath.Dir(filename)
+	}
+	for _, existing := range []string{filepath.Join(aofDir, filepath.Base(filename)+".manifest"), filename} {
+		if _, err := os.Stat(existing); !os.IsNotExist(err) {
+			return "", false
+		}
+	}
+	return filename, true
+}
+
+func (handler *Handler) initManifest(legacyFilename string) error {
+	m, err := parseManifest(handler.manifestFilename())
+	if err == nil {
+		handler.manifest = m
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	handler.manifest = &manifest{}
+	fileInfo, err := os.Stat(legacyFilename)
+	if err != nil || fileInfo.IsDir() {
+		return nil
+	}
+	base := &aofInfo{
+		name:     filepath.Base(legacyFilename),
+		seq:      1,
+		fileType: baseFileType,
+	}
+	if filepath.Dir(legacyFilename) != filepath.Clean(handler.aofDir) {
+		err = os.Rename(legacyFilename, handler.aofPath(base))
+		if err != nil {
+			return err
+		}
+	}
+	handler.manifest.base = base
+	return nil
+}
+
+// openIncrFile opens incr file for appending and selects current db, since every file is loaded from db 0
+func (handler *Handler) openIncrFile(info *aofInfo) (*os.File, error) {
+	file, err := os.OpenFile(handler.aofPath(info), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(handler.currentDB))).ToBytes()
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	handler.lastTimestamp = 0
+	return file, nil
+}
+
+// filesSize returns the total size of aof files
+func (handler *Handler) filesSize() int64 {
+	var size int64
+	for _, info := range handler.manifest.files() {
+		if fileInfo, err := os.Stat(handler.aofPath(info)); err == nil {
+			size += fileInfo.Size()
+		}
+	}
+	return size
+}
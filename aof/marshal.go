@@ -5,14 +5,16 @@ import (
 	List "github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/datastruct/set"
 	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/datastruct/stream"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
 	"time"
 )
 
-// EntityToCmd serialize data entity to redis command
-func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkReply {
+// EntityToCmds serialize data entity to redis commands. Most types are created by one command,
+// while stream needs a command for each entry and commands to restore its consumer groups
+func EntityToCmds(key string, entity *database.DataEntity) []*protocol.MultiBulkReply {
 	if entity == nil {
 		return nil
 	}
@@ -28,8 +30,13 @@ func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkRep
 		cmd = hashToCmd(key, val)
 	case *SortedSet.SortedSet:
 		cmd = zSetToCmd(key, val)
+	case *stream.Stream:
+		return streamToCmds(key, val)
 	}
-	return cmd
+	if cmd == nil {
+		return nil
+	}
+	return []*protocol.MultiBulkReply{cmd}
 }
 
 var setCmd = []byte("SET")
@@ -105,6 +112,58 @@ func zSetToCmd(key string, zset *SortedSet.SortedSet) *protocol.MultiBulkReply {
 	return protocol.MakeMultiBulkReply(args)
 }
 
+var (
+	xAddCmd   = []byte("XADD")
+	xSetIDCmd = []byte("XSETID")
+	xGroupCmd = []byte("XGROUP")
+)
+
+// streamToCmds serializes stream like redis: XADD for each entry with explicit id, XSETID to restore last id,
+// then XGROUP CREATE and CREATECONSUMER for each group and XCLAIM for each pending entry.
+// Empty stream is created by XADD with MAXLEN 0.
+func streamToCmds(key string, s *stream.Stream) []*protocol.MultiBulkReply {
+	cmds := make([]*protocol.MultiBulkReply, 0, s.Len()+1)
+	s.ForEach(func(entry *stream.Entry) bool {
+		args := make([][]byte, 0, 3+len(entry.Fields))
+		args = append(args, xAddCmd, []byte(key), []byte(entry.ID.String()))
+		args = append(args, entry.Fields...)
+		cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+		return true
+	})
+	if s.Len() == 0 {
+		cmds = append(cmds, protocol.MakeMultiBulkReply([][]byte{
+			xAddCmd, []byte(key), []byte("MAXLEN"), []byte("0"), []byte("0-1"), []byte("x"), []byte("y"),
+		}))
+	}
+	cmds = append(cmds, protocol.MakeMultiBulkReply([][]byte{xSetIDCmd, []byte(key), []byte(s.LastID().String())}))
+	for _, group := range s.Groups() {
+		cmds = append(cmds, protocol.MakeMultiBulkReply([][]byte{
+			xGroupCmd, []byte("CREATE"), []byte(key), []byte(group.Name), []byte(group.LastDeliveredID.String()),
+		}))
+		for _, consumer := range group.Consumers() {
+			cmds = append(cmds, protocol.MakeMultiBulkReply([][]byte{
+				xGroupCmd, []byte("CREATECONSUMER"), []byte(key), []byte(group.Name), []byte(consumer.Name),
+			}))
+		}
+		for _, pending := range group.PendingRange(stream.MinID, stream.MaxID, "", 0) {
+			cmds = append(cmds, MakeStreamClaimCmd(key, group.Name, pending))
+		}
+	}
+	return cmds
+}
+
+var xClaimCmd = []byte("XCLAIM")
+
+// MakeStreamClaimCmd generates command to reproduce the state of pending entry of consumer group
+func MakeStreamClaimCmd(key string, group string, pending *stream.PendingEntry) *protocol.MultiBulkReply {
+	return protocol.MakeMultiBulkReply([][]byte{
+		xClaimCmd, []byte(key), []byte(group), []byte(pending.Consumer), []byte("0"), []byte(pending.ID.String()),
+		[]byte("TIME"), []byte(strconv.FormatInt(pending.DeliveryTime, 10)),
+		[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(pending.DeliveryCount, 10)),
+		[]byte("FORCE"), []byte("JUSTID"),
+	})
+}
+
 var pExpireAtBytes = []byte("PEXPIREAT")
 
 // MakeExpireCmd generates command line to set expiration for the given key
@@ -115,3 +174,38 @@ func MakeExpireCmd(key string, expireAt time.Time) *protocol.MultiBulkReply {
 	args[2] = []byte(strconv.FormatInt(expireAt.UnixNano()/1e6, 10))
 	return protocol.MakeMultiBulkReply(args)
 }
+
+var hPExpireAtBytes = []byte("HPEXPIREAT")
+
+// MakeHashFieldExpireCmds generates command lines to set expiration for fields of hash,
+// fields sharing the same expiration time are put into one command
+func MakeHashFieldExpireCmds(key string, entity *database.DataEntity) []*protocol.MultiBulkReply {
+	hash, ok := entity.Data.(*dict.TTLDict)
+	if !ok {
+		return nil
+	}
+	var cmds []*protocol.MultiBulkReply
+	var expireAt time.Time
+	var fields [][]byte
+	flush := func() {
+		if len(fields) == 0 {
+			return
+		}
+		args := make([][]byte, 0, 5+len(fields))
+		args = append(args, hPExpireAtBytes, []byte(key), []byte(strconv.FormatInt(expireAt.UnixMilli(), 10)),
+			[]byte("FIELDS"), []byte(strconv.Itoa(len(fields))))
+		args = append(args, fields...)
+		cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+		fields = nil
+	}
+	hash.ForEachTTL(func(field string, fieldExpireAt time.Time) bool {
+		if !fieldExpireAt.Equal(expireAt) {
+			flush()
+			expireAt = fieldExpireAt
+		}
+		fields = append(fields, []byte(field))
+		return true
+	})
+	flush()
+	return cmds
+}
@@ -1,58 +1,216 @@
 package aof
 
 import (
+	"bytes"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/rdb"
 	"github.com/hdt3213/godis/redis/protocol"
-	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-func (handler *Handler) newRewriteHandler() *Handler {
-	h := &Handler{}
-	h.aofFilename = handler.aofFilename
-	h.db = handler.tmpDBMaker()
-	return h
-}
-
 // RewriteCtx holds context of an AOF rewriting procedure
 type RewriteCtx struct {
-	tmpFile  *os.File
-	fileSize int64
-	dbIdx    int // selected db index when startRewrite
+	tmpFile *os.File
+	// manifest holds files to be rewritten, commands after StartRewrite are written into a new incr file
+	manifest *manifest
+	// snapshot is the view of databases when StartRewrite, which equals to loading files to be rewritten
+	snapshot database.Snapshot
 }
 
-// Rewrite carries out AOF rewrite
+// Rewrite carries out AOF rewrite, it returns ErrRewriteInProgress if another rewriting is running
 func (handler *Handler) Rewrite() error {
+	if !handler.beginRewrite() {
+		return ErrRewriteInProgress
+	}
+	return handler.rewrite()
+}
+
+// BGRewrite starts AOF rewrite in background, it returns ErrRewriteInProgress if another rewriting is running
+func (handler *Handler) BGRewrite() error {
+	if !handler.beginRewrite() {
+		return ErrRewriteInProgress
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		err := handler.rewrite()
+		if err != nil {
+			logger.Error("background aof rewrite failed: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+func (handler *Handler) beginRewrite() bool {
+	if !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		return false
+	}
+	handler.statusMu.Lock()
+	handler.rewriteStart = time.Now()
+	handler.statusMu.Unlock()
+	return true
+}
+
+// rewrite does rewriting after beginRewrite succeeded and records its result
+func (handler *Handler) rewrite() (err error) {
+	defer func() {
+		handler.statusMu.Lock()
+		handler.lastRewriteTime = time.Since(handler.rewriteStart)
+		handler.lastRewriteFailed = err != nil
+		handler.rewrites++
+		if err != nil {
+			handler.rewriteFailures++
+		} else {
+			handler.rewriteFailures = 0
+		}
+		handler.statusMu.Unlock()
+		atomic.StoreInt32(&handler.rewriting, 0)
+	}()
 	ctx, err := handler.StartRewrite()
 	if err != nil {
 		return err
 	}
 	err = handler.DoRewrite(ctx)
 	if err != nil {
+		ctx.snapshot.Release()
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
 		return err
 	}
-
-	handler.FinishRewrite(ctx)
+	err = handler.FinishRewrite(ctx)
+	if err != nil {
+		return err
+	}
+	if handler.rewritten != nil {
+		// base file is kept until the next rewriting, which is prevented by rewriting flag
+		handler.rewritten(handler.aofPath(handler.manifest.base))
+	}
 	return nil
 }
 
+// OnRewritten sets callback of finished rewriting, it should be set before any rewriting starts
+func (handler *Handler) OnRewritten(cb func(filename string)) {
+	handler.rewritten = cb
+}
+
+// Status describes the state of aof writing and rewriting, which is reported by INFO persistence
+type Status struct {
+	InProgress bool
+	// CurrentRewriteTime is the duration of running rewriting, -1 if not rewriting
+	CurrentRewriteTime time.Duration
+	// LastRewriteTime is the duration of the latest rewriting, -1 if never rewritten
+	LastRewriteTime   time.Duration
+	LastRewriteFailed bool
+	// Rewrites is the number of rewriting since startup, RewriteFailures is the number of consecutive failed ones
+	Rewrites        int64
+	RewriteFailures int64
+	// LastWriteFailed is whether the latest writing or fsync of aof file failed
+	LastWriteFailed bool
+	// BufferLength is the number of commands waiting in queue to be written
+	BufferLength int
+	CurrentSize  int64
+	BaseSize     int64
+}
+
+// GetStatus returns the state of aof writing and rewriting
+func (handler *Handler) GetStatus() *Status {
+	handler.queueMu.Lock()
+	bufferLength := len(handler.queue)
+	handler.queueMu.Unlock()
+	handler.statusMu.Lock()
+	defer handler.statusMu.Unlock()
+	status := &Status{
+		InProgress:         handler.IsRewriting(),
+		CurrentRewriteTime: -1,
+		LastRewriteTime:    handler.lastRewriteTime,
+		LastRewriteFailed:  handler.lastRewriteFailed,
+		Rewrites:           handler.rewrites,
+		RewriteFailures:    handler.rewriteFailures,
+		LastWriteFailed:    atomic.LoadInt32(&handler.lastWriteFailed) == 1,
+		BufferLength:       bufferLength,
+		CurrentSize:        atomic.LoadInt64(&handler.currentSize),
+		BaseSize:           atomic.LoadInt64(&handler.baseSize),
+	}
+	if status.InProgress {
+		status.CurrentRewriteTime = time.Since(handler.rewriteStart)
+	}
+	return status
+}
+
+// IsRewriting returns whether aof is being rewritten
+func (handler *Handler) IsRewriting() bool {
+	return atomic.LoadInt32(&handler.rewriting) == 1
+}
+
+// needRewrite returns whether aof has grown enough to be rewritten automatically
+func (handler *Handler) needRewrite() bool {
+	percentage := int64(config.Properties().AutoAofRewritePercentage)
+	if percentage <= 0 || handler.IsRewriting() {
+		return false
+	}
+	minSize := int64(config.Properties().AutoAofRewriteMinSize)
+	if minSize <= 0 {
+		minSize = defaultAutoRewriteMinSize
+	}
+	currentSize := atomic.LoadInt64(&handler.currentSize)
+	if currentSize < minSize {
+		return false
+	}
+	baseSize := atomic.LoadInt64(&handler.baseSize)
+	if baseSize == 0 {
+		baseSize = 1
+	}
+	return (currentSize-baseSize)*100/baseSize >= percentage
+}
+
+// autoRewrite rewrites aof until it doesn't need rewriting, since writes during rewriting don't trigger another one
+func (handler *Handler) autoRewrite() {
+	for handler.needRewrite() {
+		err := handler.Rewrite()
+		if err == ErrRewriteInProgress {
+			return
+		}
+		if err != nil {
+			logger.Error("auto aof rewrite failed: " + err.Error())
+			return
+		}
+		logger.Info("auto aof rewrite finished")
+	}
+}
+
 // DoRewrite actually rewrite aof file
 // makes DoRewrite public for testing only, please use Rewrite instead
 func (handler *Handler) DoRewrite(ctx *RewriteCtx) error {
 	tmpFile := ctx.tmpFile
+	snapshot := ctx.snapshot
 
-	// load aof tmpFile
-	tmpAof := handler.newRewriteHandler()
-	tmpAof.LoadAof(int(ctx.fileSize))
-
+	preamble := config.Properties().AofUseRdbPreamble
+	if preamble {
+		err := rdb.WritePreamble(tmpFile, snapshot, config.Properties().Databases)
+		if err != nil {
+			return err
+		}
+	}
+	// function libraries are shared by all databases
+	for _, code := range snapshot.GetFunctionLibraries() {
+		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("FUNCTION", "LOAD", "REPLACE", code)).ToBytes()
+		_, err := tmpFile.Write(data)
+		if err != nil {
+			return err
+		}
+	}
 	// rewrite aof tmpFile
-	for i := 0; i < config.Properties.Databases; i++ {
+	for i := 0; i < config.Properties().Databases; i++ {
 		// select db
 		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
 		_, err := tmpFile.Write(data)
@@ -60,26 +218,93 @@ func (handler *Handler) DoRewrite(ctx *RewriteCtx) error {
 			return err
 		}
 		// dump db, 从Redis数据库里读key-value进行重写
-		tmpAof.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
-			cmd := EntityToCmd(key, entity)
-			if cmd != nil {
-				_, _ = tmpFile.Write(cmd.ToBytes())
-			}
-			// 超时时间不与SET KEY VALUE一起，而是单独用一条语句记录
-			if expiration != nil {
-				cmd := MakeExpireCmd(key, *expiration)
-				if cmd != nil {
-					_, _ = tmpFile.Write(cmd.ToBytes())
+		snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			// entities in rdb preamble only need their hash field ttl
+			dumped := preamble && rdb.Supports(entity)
+			if dumped {
+				for _, cmd := range MakeHashFieldExpireCmds(key, entity) {
+					_, err = tmpFile.Write(cmd.ToBytes())
 				}
+			} else {
+				_, err = tmpFile.Write(EncodeEntity(key, entity, expiration))
 			}
-			return true
+			return err == nil
 		})
+		if err != nil {
+			return err
+		}
+	}
+	// keys accessed during rewriting are written with their original values saved before accessed
+	for i, data := range snapshot.Release() {
+		if len(data) == 0 {
+			continue
+		}
+		selectCmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
+		_, err := tmpFile.Write(append(selectCmd, data...))
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// StartRewrite prepares rewrite procedure
+// EncodeEntity converts entity into commands, it is used to save original values of keys accessed during snapshot
+func EncodeEntity(key string, entity *database.DataEntity, expiration *time.Time) []byte {
+	var buf bytes.Buffer
+	for _, cmd := range EntityToCmds(key, entity) {
+		buf.Write(cmd.ToBytes())
+	}
+	for _, cmd := range MakeHashFieldExpireCmds(key, entity) {
+		buf.Write(cmd.ToBytes())
+	}
+	// 超时时间不与SET KEY VALUE一起，而是单独用一条语句记录
+	if expiration != nil {
+		if cmd := MakeExpireCmd(key, *expiration); cmd != nil {
+			buf.Write(cmd.ToBytes())
+		}
+	}
+	return buf.Bytes()
+}
+
+// StartRewrite prepares rewrite procedure, it takes snapshot of databases and switches aof to a new incr file
+// at the same time, so the snapshot could be written as the new base file without pausing aof
 func (handler *Handler) StartRewrite() (*RewriteCtx, error) {
+	ctx := &RewriteCtx{}
+	snapshot, err := handler.db.TakeSnapshot(EncodeEntity, func() error {
+		rewriting, err := handler.switchIncrFile()
+		ctx.manifest = rewriting
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx.snapshot = snapshot
+
+	// create tmp file
+	file, err := ioutil.TempFile(handler.aofDir, "temp-rewrite-*.aof")
+	if err != nil {
+		logger.Warn("tmp file create failed")
+		snapshot.Release()
+		return nil, err
+	}
+	ctx.tmpFile = file
+	return ctx, nil
+}
+
+// switchIncrFile writes queued commands into the current incr file, then switches aof to a new incr file.
+// It returns manifest of files before switching, which are replaced by the new base file after rewriting
+func (handler *Handler) switchIncrFile() (*manifest, error) {
+	handler.queueMu.Lock()
+	queue := handler.queue
+	handler.queue = nil
+	handler.writeMu.Lock()
+	defer handler.writeMu.Unlock()
+	if handler.queueCond != nil {
+		handler.queueCond.Broadcast() // wake up callers waiting for room
+	}
+	handler.queueMu.Unlock()
+	handler.writePayloads(queue)
+
 	handler.pausingAof.Lock() // pausing aof
 	defer handler.pausingAof.Unlock()
 
@@ -90,77 +315,71 @@ func (handler *Handler) StartRewrite() (*RewriteCtx, error) {
 		return nil, err
 	}
 
-	// get current aof file size
-	// 获得当前当前当前 aof 文件大小，用于判断哪些数据是 aof 重写过程中产生的
-	// handleAof 会保证每次写入完整的一条指令
-	fileInfo, _ := os.Stat(handler.aofFilename)
-	filesize := fileInfo.Size()
-
-	// create tmp file
-	file, err := ioutil.TempFile("", "*.aof")
+	// 重写开始前的文件交给重写过程, 之后的命令写入新的 incr 文件
+	rewriting := handler.manifest.copy()
+	incr := handler.newAofInfo(incrFileType)
+	aofFile, err := handler.openIncrFile(incr)
 	if err != nil {
-		logger.Warn("tmp file create failed")
 		return nil, err
 	}
-	return &RewriteCtx{
-		tmpFile:  file,
-		fileSize: filesize,
-		// 记录开始重写时，使用的数据库
-		dbIdx: handler.currentDB,
-	}, nil
+	handler.manifest.incrs = append(handler.manifest.incrs, incr)
+	err = handler.manifest.save(handler.manifestFilename())
+	if err != nil {
+		handler.manifest.incrs = handler.manifest.incrs[:len(handler.manifest.incrs)-1]
+		_ = aofFile.Close()
+		_ = os.Remove(handler.aofPath(incr))
+		return nil, err
+	}
+	_ = handler.aofFile.Close()
+	handler.aofFile = aofFile
+	return rewriting, nil
 }
 
-// FinishRewrite finish rewrite procedure
-func (handler *Handler) FinishRewrite(ctx *RewriteCtx) {
+// FinishRewrite makes rewritten file the new base file, and deletes files which have been rewritten
+func (handler *Handler) FinishRewrite(ctx *RewriteCtx) error {
 	handler.pausingAof.Lock() // pausing aof
 	defer handler.pausingAof.Unlock()
 
 	tmpFile := ctx.tmpFile
-	// 打开线上 aof 文件并 seek 到重写开始的位置
-	src, err := os.Open(handler.aofFilename)
-	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
-		return
-	}
 	defer func() {
-		_ = src.Close()
+		_ = os.Remove(tmpFile.Name()) // no effect after renamed
 	}()
-	// Seek之后的数据就是重写过程中的数据
-	_, err = src.Seek(ctx.fileSize, 0)
+	err := tmpFile.Sync()
 	if err != nil {
-		logger.Error("seek failed: " + err.Error())
-		return
+		_ = tmpFile.Close()
+		return err
 	}
-
-	// 写入一条 Select 命令，使 tmpAof 选中重写开始时刻线上 aof 文件选中的数据库
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
-	_, err = tmpFile.Write(data)
+	err = tmpFile.Close()
 	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return
+		return err
 	}
-	// 对齐数据库后就可以把重写过程中产生的数据复制到 tmpAof 文件了
-	_, err = io.Copy(tmpFile, src)
+	base := handler.newAofInfo(baseFileType)
+	err = os.Rename(tmpFile.Name(), handler.aofPath(base))
 	if err != nil {
-		logger.Error("copy aof filed failed: " + err.Error())
-		return
+		return err
 	}
 
-	// 使用 mv 命令用 tmpAof 代替线上 aof 文件  os.Rename移动文件
-	_ = handler.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), handler.aofFilename)
-
-	// 重新打开线上 aof
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
+	// incr files created after StartRewrite are kept, switching to new manifest is atomic
+	m := &manifest{
+		base:  base,
+		incrs: append([]*aofInfo(nil), handler.manifest.incrs[len(ctx.manifest.incrs):]...),
 	}
-	handler.aofFile = aofFile
-
-	// 重新写入一次 select 指令保证 aof 中的数据库与 handler.currentDB 一致
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(handler.currentDB))).ToBytes()
-	_, err = handler.aofFile.Write(data)
+	err = m.save(handler.manifestFilename())
 	if err != nil {
-		panic(err)
+		_ = os.Remove(handler.aofPath(base))
+		return err
+	}
+	handler.manifest = m
+	for _, info := range ctx.manifest.files() {
+		err := os.Remove(handler.aofPath(info))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove rewritten aof file failed: " + err.Error())
+		}
+	}
+	// commands written during rewriting are not counted in base size, so they could trigger rewriting again
+	atomic.StoreInt64(&handler.currentSize, handler.filesSize())
+	if fileInfo, err := os.Stat(handler.aofPath(base)); err == nil {
+		atomic.StoreInt64(&handler.baseSize, fileInfo.Size())
 	}
+	return nil
 }
@@ -0,0 +1,224 @@
+// Package backup uploads snapshots to backup targets such as object storage, and restores the latest one
+package backup
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kinds of backup, which are also the extension of backup name
+const (
+	KindRDB = "rdb"
+	KindAOF = "aof"
+)
+
+const (
+	queueSize = 16
+	// timeLayout makes names of the same kind sorted by time
+	timeLayout = "20060102T150405.000Z"
+)
+
+// Target stores backups, such as a directory or a bucket of object storage.
+// It is only called by the goroutine of Manager and startup, so implementations don't need to be concurrent safe
+type Target interface {
+	// Put uploads size bytes read from r as object name
+	Put(name string, r io.Reader, size int64) error
+	// Get downloads object name into w
+	Get(name string, w io.Writer) error
+	// List returns names of objects starting with prefix
+	List(prefix string) ([]string, error)
+	Delete(name string) error
+}
+
+// Manager uploads snapshots in another goroutine, and removes the oldest backups beyond retention
+type Manager struct {
+	target Target
+	// prefix is prepended to names of backups, such as "godis/"
+	prefix string
+	// retention is the number of backups kept for each kind, 0 means keeping all
+	retention int
+	jobs      chan *job
+	finished  chan struct{}
+}
+
+type job struct {
+	file *os.File
+	kind string
+	time time.Time
+}
+
+// MakeManager creates a Manager and starts uploading
+func MakeManager(target Target, prefix string, retention int) *Manager {
+	m := &Manager{
+		target:    target,
+		prefix:    prefix,
+		retention: retention,
+		jobs:      make(chan *job, queueSize),
+		finished:  make(chan struct{}),
+	}
+	go m.handle()
+	return m
+}
+
+// NewManager creates Manager from config properties with prefix backup-, it returns nil if backup-target is not set
+func NewManager() (*Manager, error) {
+	var target Target
+	switch strings.ToLower(config.Properties().BackupTarget) {
+	case "":
+		return nil, nil
+	case "dir":
+		if config.Properties().BackupDir == "" {
+			return nil, errors.New("backup-dir is required by dir backup target")
+		}
+		target = MakeDirTarget(config.Properties().BackupDir)
+	case "s3", "gcs":
+		endpoint := config.Properties().BackupEndpoint
+		region := config.Properties().BackupRegion
+		if strings.ToLower(config.Properties().BackupTarget) == "gcs" {
+			// cloud storage is accessed by its s3 compatible api with hmac keys
+			if endpoint == "" {
+				endpoint = "https://storage.googleapis.com"
+			}
+			if region == "" {
+				region = "auto"
+			}
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		if config.Properties().BackupBucket == "" {
+			return nil, errors.New("backup-bucket is required by " + config.Properties().BackupTarget + " backup target")
+		}
+		target = MakeS3Target(endpoint, region, config.Properties().BackupBucket,
+			config.Properties().BackupAccessKey, config.Properties().BackupSecretKey)
+	default:
+		return nil, errors.New("unsupported backup target: " + config.Properties().BackupTarget)
+	}
+	return MakeManager(target, config.Properties().BackupPrefix, config.Properties().BackupRetention), nil
+}
+
+// Backup uploads snapshot file in background. The file is opened before returning,
+// so it could be replaced or removed by the next saving or rewriting during uploading
+func (m *Manager) Backup(filename string, kind string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	select {
+	case m.jobs <- &job{file: file, kind: kind, time: time.Now()}:
+		return nil
+	default:
+		_ = file.Close()
+		return errors.New("too many backups waiting for uploading")
+	}
+}
+
+func (m *Manager) handle() {
+	defer close(m.finished)
+	for j := range m.jobs {
+		name, err := m.upload(j)
+		if err != nil {
+			logger.Error("upload backup failed: " + err.Error())
+			continue
+		}
+		logger.Info("uploaded backup " + name)
+		err = m.expire(j.kind)
+		if err != nil {
+			logger.Warn("remove expired backups failed: " + err.Error())
+		}
+	}
+}
+
+func (m *Manager) upload(j *job) (string, error) {
+	defer func() {
+		_ = j.file.Close()
+	}()
+	info, err := j.file.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := m.prefix + j.kind + "-" + j.time.UTC().Format(timeLayout) + "." + j.kind
+	return name, m.target.Put(name, j.file, info.Size())
+}
+
+// expire removes the oldest backups of kind beyond retention
+func (m *Manager) expire(kind string) error {
+	if m.retention <= 0 {
+		return nil
+	}
+	names, err := m.target.List(m.prefix + kind + "-")
+	if err != nil {
+		return err
+	}
+	if len(names) <= m.retention {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-m.retention] {
+		err = m.target.Delete(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Latest returns name of the latest backup among given kinds, it returns empty string if there is no backup
+func (m *Manager) Latest(kinds ...string) (string, error) {
+	latest, latestTime := "", ""
+	for _, kind := range kinds {
+		names, err := m.target.List(m.prefix + kind + "-")
+		if err != nil {
+			return "", err
+		}
+		for _, name := range names {
+			t := strings.TrimPrefix(name, m.prefix+kind+"-")
+			if t > latestTime {
+				latest, latestTime = name, t
+			}
+		}
+	}
+	return latest, nil
+}
+
+// Restore downloads backup name into filename, filename is not created if downloading failed
+func (m *Manager) Restore(name string, filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "temp-restore-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name()) // no effect after renamed
+	}()
+	err = m.target.Get(name, tmpFile)
+	if err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// Close waits for queued backups uploaded
+func (m *Manager) Close() {
+	close(m.jobs)
+	<-m.finished
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	target := MakeDirTarget(filepath.Join(dir, "backup"))
+	m := MakeManager(target, "godis/", 2)
+	src := filepath.Join(dir, "dump.rdb")
+	for i := 0; i < 3; i++ {
+		err := os.WriteFile(src, []byte("rdb"+string(rune('0'+i))), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = m.Backup(src, KindRDB)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		time.Sleep(2 * time.Millisecond) // names have milliseconds
+	}
+	err := os.WriteFile(src, []byte("aof"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = m.Backup(src, KindAOF)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	m.Close()
+
+	names, err := target.List("godis/rdb-")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(names) != 2 {
+		t.Errorf("expected 2 rdb backups kept, actually %v", names)
+	}
+	latest, err := m.Latest(KindRDB)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(latest, "godis/rdb-") || !strings.HasSuffix(latest, ".rdb") {
+		t.Errorf("wrong name of backup: %s", latest)
+	}
+	restored := filepath.Join(dir, "restore", "dump.rdb")
+	err = m.Restore(latest, restored)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, _ := os.ReadFile(restored)
+	if string(data) != "rdb2" {
+		t.Errorf("expected the latest rdb restored, actually %s", data)
+	}
+
+	latest, err = m.Latest(KindRDB, KindAOF)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buf := &bytes.Buffer{}
+	err = target.Get(latest, buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != "aof" {
+		t.Errorf("expected the latest aof, actually %s", buf.String())
+	}
+
+	err = m.Restore("godis/rdb-missing.rdb", filepath.Join(dir, "missing.rdb"))
+	if err == nil {
+		t.Error("expected error of missing backup")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.rdb")); !os.IsNotExist(err) {
+		t.Error("file should not be created if restoring failed")
+	}
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirTarget stores backups in a local directory, such as a mounted network file system
+type DirTarget struct {
+	dir string
+}
+
+// MakeDirTarget creates DirTarget, dir is created when the first backup is uploaded
+func MakeDirTarget(dir string) *DirTarget {
+	return &DirTarget{dir: dir}
+}
+
+func (t *DirTarget) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+// Put writes into a temp file which is renamed after completed, so an incomplete backup is never listed
+func (t *DirTarget) Put(name string, r io.Reader, size int64) error {
+	filename := t.path(name)
+	err := os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, r, size)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// Get copies backup name into w
+func (t *DirTarget) Get(name string, w io.Writer) error {
+	file, err := os.Open(t.path(name))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// List returns names of backups starting with prefix, a missing dir has no backups
+func (t *DirTarget) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(t.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Delete removes backup name
+func (t *DirTarget) Delete(name string) error {
+	return os.Remove(t.path(name))
+}
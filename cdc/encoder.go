@@ -0,0 +1,67 @@
+package cdc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a write command applied to database
+type Event struct {
+	DBIndex int
+	CmdLine [][]byte
+	Time    time.Time
+}
+
+// Encoder serializes event into message sent to broker
+type Encoder interface {
+	Encode(event *Event) ([]byte, error)
+}
+
+// RESPEncoder encodes event as `SELECT index` followed by the command in RESP, like aof file.
+// It is binary safe and consumers could replay messages on another redis directly
+type RESPEncoder struct{}
+
+// Encode implements Encoder
+func (RESPEncoder) Encode(event *Event) ([]byte, error) {
+	selectCmd := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(event.DBIndex))).ToBytes()
+	return append(selectCmd, protocol.MakeMultiBulkReply(event.CmdLine).ToBytes()...), nil
+}
+
+type jsonEvent struct {
+	DB      int      `json:"db"`
+	Time    int64    `json:"time"`
+	Command []string `json:"command"`
+}
+
+// JSONEncoder encodes event as json object like {"db":0,"time":1700000000000,"command":["SET","k","v"]},
+// time is unix timestamp in milliseconds. Arguments which are not valid utf-8 are not kept as is
+type JSONEncoder struct{}
+
+// Encode implements Encoder
+func (JSONEncoder) Encode(event *Event) ([]byte, error) {
+	command := make([]string, len(event.CmdLine))
+	for i, arg := range event.CmdLine {
+		command[i] = string(arg)
+	}
+	return json.Marshal(&jsonEvent{
+		DB:      event.DBIndex,
+		Time:    event.Time.UnixNano() / int64(time.Millisecond),
+		Command: command,
+	})
+}
+
+// GetEncoder returns encoder by its name: resp or json, empty name means resp
+func GetEncoder(name string) (Encoder, error) {
+	switch strings.ToLower(name) {
+	case "", "resp":
+		return RESPEncoder{}, nil
+	case "json":
+		return JSONEncoder{}, nil
+	}
+	return nil, errors.New("unknown cdc encoder: " + name)
+}
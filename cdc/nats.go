@@ -0,0 +1,118 @@
+package cdc
+
+import (
+	"bufio"
+	"errors"
+	"github.com/hdt3213/godis/lib/logger"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// NATSPublisher publishes messages to NATS server using its text protocol
+type NATSPublisher struct {
+	addr string
+	// mu protects writing to conn, since PONG is sent by reading goroutine
+	mu     sync.Mutex
+	conn   net.Conn
+	writer *bufio.Writer
+}
+
+// MakeNATSPublisher creates a NATSPublisher, it connects to server on first publishing
+func MakeNATSPublisher(addr string) *NATSPublisher {
+	return &NATSPublisher{
+		addr: addr,
+	}
+}
+
+// connect dials server and sends CONNECT, invoker should hold the lock
+func (p *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO") {
+		_ = conn.Close()
+		return errors.New("unexpected nats greeting: " + strings.TrimSpace(line))
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	writer := bufio.NewWriter(conn)
+	_, _ = writer.WriteString("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"godis-cdc\"}\r\n")
+	if err := writer.Flush(); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn = conn
+	p.writer = writer
+	go p.receive(conn, reader)
+	return nil
+}
+
+// receive replies PING from server and logs errors until connection closed
+func (p *NATSPublisher) receive(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			p.mu.Lock()
+			if p.conn == conn {
+				_, _ = p.writer.WriteString("PONG\r\n")
+				_ = p.writer.Flush()
+			}
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logger.Warn("nats error: " + line)
+		}
+	}
+}
+
+// Publish implements Publisher
+func (p *NATSPublisher) Publish(subject string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	_, _ = p.writer.WriteString("PUB " + subject + " " + strconv.Itoa(len(data)) + "\r\n")
+	_, _ = p.writer.Write(data)
+	_, _ = p.writer.WriteString("\r\n")
+	if err := p.writer.Flush(); err != nil {
+		p.closeConn()
+		return err
+	}
+	return nil
+}
+
+// closeConn closes current connection, invoker should hold the lock
+func (p *NATSPublisher) closeConn() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+		p.writer = nil
+	}
+}
+
+// Close implements Publisher
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConn()
+	return nil
+}
@@ -0,0 +1,176 @@
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultQueueSize = 1 << 16
+	defaultSubject   = "godis.cdc"
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 5 * time.Second
+)
+
+// Publisher sends messages to message broker, such as NATS or Kafka.
+// It is only called by the goroutine of Sink, so implementations don't need to be concurrent safe
+type Publisher interface {
+	// Publish sends data to subject(topic in Kafka), publisher should reconnect itself after failure
+	Publish(subject string, data []byte) error
+	Close() error
+}
+
+// Sink receives write commands and publishes them to broker in another goroutine.
+// Events are buffered in a bounded queue, once the queue is full Send blocks writers
+// or drops the event according to backpressure policy
+type Sink struct {
+	publisher Publisher
+	encoder   Encoder
+	subject   string
+	queue     chan *Event
+	// drop means dropping events when queue is full instead of blocking writers
+	drop    bool
+	dropped int64
+	// done is closed when sink is closing, finished is closed after all events are handled
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// MakeSink creates a Sink and starts publishing, queueSize less than 1 means the default size
+func MakeSink(publisher Publisher, encoder Encoder, subject string, queueSize int, drop bool) *Sink {
+	if queueSize < 1 {
+		queueSize = defaultQueueSize
+	}
+	if subject == "" {
+		subject = defaultSubject
+	}
+	sink := &Sink{
+		publisher: publisher,
+		encoder:   encoder,
+		subject:   subject,
+		queue:     make(chan *Event, queueSize),
+		drop:      drop,
+		done:      make(chan struct{}),
+		finished:  make(chan struct{}),
+	}
+	go sink.handle()
+	return sink
+}
+
+// NewSink creates Sink from config properties with prefix cdc-
+func NewSink() (*Sink, error) {
+	encoder, err := GetEncoder(config.Properties().CDCEncoder)
+	if err != nil {
+		return nil, err
+	}
+	drop := false
+	switch strings.ToLower(config.Properties().CDCBackpressure) {
+	case "", "block":
+	case "drop":
+		drop = true
+	default:
+		return nil, errors.New("unknown cdc backpressure policy: " + config.Properties().CDCBackpressure)
+	}
+	var publisher Publisher
+	switch strings.ToLower(config.Properties().CDCBroker) {
+	case "", "nats":
+		publisher = MakeNATSPublisher(config.Properties().CDCAddress)
+	default:
+		// other brokers could be supported by embedding godis and providing a Publisher
+		return nil, errors.New("unsupported cdc broker: " + config.Properties().CDCBroker)
+	}
+	return MakeSink(publisher, encoder, config.Properties().CDCSubject, config.Properties().CDCQueueSize, drop), nil
+}
+
+// Send puts write command into queue
+func (sink *Sink) Send(dbIndex int, cmdLine [][]byte) {
+	event := &Event{
+		DBIndex: dbIndex,
+		CmdLine: cmdLine,
+		Time:    time.Now(),
+	}
+	if sink.drop {
+		select {
+		case sink.queue <- event:
+		default:
+			n := atomic.AddInt64(&sink.dropped, 1)
+			if n&(n-1) == 0 { // avoid flooding log
+				logger.Warn(fmt.Sprintf("cdc queue is full, %d events dropped", n))
+			}
+		}
+		return
+	}
+	select {
+	case sink.queue <- event:
+	case <-sink.done:
+	}
+}
+
+// Dropped returns count of events dropped since queue is full
+func (sink *Sink) Dropped() int64 {
+	return atomic.LoadInt64(&sink.dropped)
+}
+
+func (sink *Sink) handle() {
+	for {
+		select {
+		case event := <-sink.queue:
+			sink.publish(event, true)
+		case <-sink.done:
+			// publish events remained in queue without retrying
+			for {
+				select {
+				case event := <-sink.queue:
+					sink.publish(event, false)
+				default:
+					if err := sink.publisher.Close(); err != nil {
+						logger.Warn("close cdc publisher failed: " + err.Error())
+					}
+					close(sink.finished)
+					return
+				}
+			}
+		}
+	}
+}
+
+// publish sends event to broker, retry means retrying until success or sink closed
+func (sink *Sink) publish(event *Event, retry bool) {
+	data, err := sink.encoder.Encode(event)
+	if err != nil {
+		logger.Warn("encode cdc event failed: " + err.Error())
+		return
+	}
+	interval := minRetryInterval
+	for {
+		err = sink.publisher.Publish(sink.subject, data)
+		if err == nil {
+			return
+		}
+		logger.Warn("publish cdc event failed: " + err.Error())
+		if !retry {
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-sink.done:
+			// try again for the last time
+			retry = false
+		}
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// Close stops sink after events in queue are published
+func (sink *Sink) Close() {
+	close(sink.done)
+	<-sink.finished
+}
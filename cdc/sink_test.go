@@ -0,0 +1,163 @@
+package cdc
+
+import (
+	"bufio"
+	"errors"
+	"github.com/hdt3213/godis/lib/utils"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockPublisher struct {
+	mu       sync.Mutex
+	messages []string
+	// fails is count of failures before success
+	fails int
+	// blocking blocks Publish until it is closed
+	blocking chan struct{}
+}
+
+func (p *mockPublisher) Publish(subject string, data []byte) error {
+	if p.blocking != nil {
+		<-p.blocking
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fails > 0 {
+		p.fails--
+		return errors.New("mock failure")
+	}
+	p.messages = append(p.messages, subject+" "+string(data))
+	return nil
+}
+
+func (p *mockPublisher) Close() error {
+	return nil
+}
+
+func (p *mockPublisher) getMessages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.messages...)
+}
+
+func TestEncoder(t *testing.T) {
+	event := &Event{
+		DBIndex: 1,
+		CmdLine: utils.ToCmdLine("set", "k", "v"),
+		Time:    time.Unix(1700000000, 0),
+	}
+	data, _ := RESPEncoder{}.Encode(event)
+	expected := "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, actually %q", expected, data)
+	}
+	data, _ = JSONEncoder{}.Encode(event)
+	expected = `{"db":1,"time":1700000000000,"command":["set","k","v"]}`
+	if string(data) != expected {
+		t.Errorf("expected %s, actually %s", expected, data)
+	}
+	if _, err := GetEncoder("xml"); err == nil {
+		t.Error("expected error for unknown encoder")
+	}
+}
+
+func TestSink(t *testing.T) {
+	publisher := &mockPublisher{fails: 1}
+	sink := MakeSink(publisher, JSONEncoder{}, "", 0, false)
+	for i := 0; i < 3; i++ {
+		sink.Send(i, utils.ToCmdLine("incr", "a"))
+	}
+	// wait for retrying the failed one
+	deadline := time.Now().Add(5 * time.Second)
+	for len(publisher.getMessages()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.Close()
+	messages := publisher.getMessages()
+	if len(messages) != 3 {
+		t.Errorf("expected 3 messages, actually %d", len(messages))
+		return
+	}
+	for i, msg := range messages {
+		if !strings.HasPrefix(msg, defaultSubject+` {"db":`+strconv.Itoa(i)) {
+			t.Errorf("unexpected message: %s", msg)
+		}
+	}
+}
+
+func TestSinkDrop(t *testing.T) {
+	publisher := &mockPublisher{blocking: make(chan struct{})}
+	sink := MakeSink(publisher, RESPEncoder{}, "test", 1, true)
+	// the first event is taken by publishing goroutine and the second one fills the queue
+	for i := 0; i < 10; i++ {
+		sink.Send(0, utils.ToCmdLine("incr", "a"))
+	}
+	if sink.Dropped() < 8 {
+		t.Errorf("expected at least 8 dropped events, actually %d", sink.Dropped())
+	}
+	close(publisher.blocking)
+	sink.Close()
+	if n := int64(len(publisher.getMessages())); n+sink.Dropped() != 10 {
+		t.Errorf("expected 10 events, actually %d published and %d dropped", n, sink.Dropped())
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("INFO {}\r\nPING\r\n"))
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PUB") {
+				fields := strings.Fields(line)
+				size, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, size+2)
+				_, _ = io.ReadFull(reader, payload)
+				line = fields[1] + " " + string(payload[:size])
+			}
+			lines = append(lines, strings.TrimSpace(line))
+			if len(lines) == 3 {
+				received <- strings.Join(lines, "|")
+				return
+			}
+		}
+	}()
+	publisher := MakeNATSPublisher(listener.Addr().String())
+	defer publisher.Close()
+	err = publisher.Publish("test", []byte("hello\r\nworld"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case result := <-received:
+		expected := `CONNECT {"verbose":false,"pedantic":false,"name":"godis-cdc"}|PONG|test hello` + "\r\nworld"
+		if result != expected && result != strings.Replace(expected, "|PONG|test hello\r\nworld", "|test hello\r\nworld|PONG", 1) {
+			t.Errorf("unexpected received: %q", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout")
+	}
+}
@@ -0,0 +1,321 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster bus carries traffic among nodes, such as gossip and failover votes, on port+10000 like redis cluster,
+// so it doesn't compete with clients. A frame is:
+//
+//	length uint32 | type uint8 | argc uint16 | (len uint32 | arg) * argc
+//
+// length counts bytes after itself, integers are big endian.
+// Request carries a command line, and its response is one of the reply types.
+const (
+	busRequest byte = iota + 1
+	// busArgs replies a list of arguments
+	busArgs
+	// busInt replies an int64 in 8 bytes
+	busInt
+	// busErr replies an error message
+	busErr
+)
+
+// maxBusFrame limits size of a frame, so a broken peer can't make node allocate huge memory
+const maxBusFrame = 64 * 1024 * 1024
+
+// busTimeout is the max time to connect a peer or to wait for a reply, it is a variable so that tests could shorten it
+var busTimeout = 2 * time.Second
+
+// busRouter is command name -> handler of requests received from cluster bus, they are not served on client port
+var busRouter = map[string]CmdFunc{
+	relayGossip: execGossip,
+	relayVote:   execVote,
+	relayRaft:   execRaft,
+}
+
+// busAddr returns address of cluster bus of node
+func busAddr(node string) string {
+	host, port := splitAddr(node)
+	return net.JoinHostPort(host, strconv.Itoa(port+clusterBusPortOffset))
+}
+
+func writeFrame(w io.Writer, msgType byte, args [][]byte) error {
+	size := 1 + 2
+	for _, arg := range args {
+		size += 4 + len(arg)
+	}
+	buf := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf[4] = msgType
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(args)))
+	offset := 7
+	for _, arg := range args {
+		binary.BigEndian.PutUint32(buf[offset:], uint32(len(arg)))
+		offset += 4
+		offset += copy(buf[offset:], arg)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, [][]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < 3 || size > maxBusFrame {
+		return 0, nil, errors.New("illegal frame size " + strconv.FormatUint(uint64(size), 10))
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	msgType := body[0]
+	argc := int(binary.BigEndian.Uint16(body[1:]))
+	args := make([][]byte, 0, argc)
+	offset := 3
+	for i := 0; i < argc; i++ {
+		if offset+4 > len(body) {
+			return 0, nil, errors.New("truncated frame")
+		}
+		n := int(binary.BigEndian.Uint32(body[offset:]))
+		offset += 4
+		if n > len(body)-offset {
+			return 0, nil, errors.New("truncated frame")
+		}
+		args = append(args, body[offset:offset+n])
+		offset += n
+	}
+	return msgType, args, nil
+}
+
+// writeReply encodes reply of request, replies other than list, integer and error are not used on bus
+func writeReply(w io.Writer, reply redis.Reply) error {
+	switch r := reply.(type) {
+	case *protocol.MultiBulkReply:
+		return writeFrame(w, busArgs, r.Args)
+	case *protocol.IntReply:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(r.Code))
+		return writeFrame(w, busInt, [][]byte{buf})
+	case protocol.ErrorReply:
+		return writeFrame(w, busErr, [][]byte{[]byte(r.Error())})
+	}
+	return writeFrame(w, busErr, [][]byte{[]byte("ERR unsupported reply on cluster bus")})
+}
+
+func readReply(r io.Reader) (redis.Reply, error) {
+	msgType, args, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case busArgs:
+		return protocol.MakeMultiBulkReply(args), nil
+	case busInt:
+		if len(args) != 1 || len(args[0]) != 8 {
+			return nil, errors.New("illegal integer reply")
+		}
+		return protocol.MakeIntReply(int64(binary.BigEndian.Uint64(args[0]))), nil
+	case busErr:
+		if len(args) != 1 {
+			return nil, errors.New("illegal error reply")
+		}
+		return protocol.MakeErrReply(string(args[0])), nil
+	}
+	return nil, errors.New("unknown reply type " + strconv.Itoa(int(msgType)))
+}
+
+// bus listens cluster bus of self, and keeps links to bus of peers
+type bus struct {
+	cluster  *Cluster
+	listener net.Listener
+	mu       sync.Mutex
+	links    map[string]*busLink
+	// conns are accepted connections, they are closed with bus
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// busLink is a connection to bus of peer, requests are sent one by one
+// and it reconnects on the next request once connection is broken
+type busLink struct {
+	mu     sync.Mutex
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func listenBus(cluster *Cluster) (*bus, error) {
+	// self may be an announced address which is not local
+	listener, err := net.Listen("tcp", busAddr(config.Properties().Self))
+	if err != nil {
+		return nil, err
+	}
+	b := &bus{
+		cluster:  cluster,
+		listener: listener,
+		links:    make(map[string]*busLink),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go b.serve()
+	return b, nil
+}
+
+func (b *bus) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		b.conns[conn] = struct{}{}
+		b.mu.Unlock()
+		go b.handle(conn)
+	}
+}
+
+func (b *bus) handle(conn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(fmt.Sprintf("cluster bus error: %v\n%s", err, string(debug.Stack())))
+		}
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		msgType, args, err := readFrame(reader)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				logger.Warn("cluster bus from " + conn.RemoteAddr().String() + ": " + err.Error())
+			}
+			return
+		}
+		var reply redis.Reply
+		if msgType != busRequest || len(args) == 0 {
+			reply = protocol.MakeErrReply("ERR illegal request on cluster bus")
+		} else {
+			reply = b.cluster.execBus(args)
+		}
+		if err := writeReply(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// send sends request to bus of node and waits for its reply
+func (b *bus) send(node string, cmdLine CmdLine) redis.Reply {
+	b.mu.Lock()
+	link, ok := b.links[node]
+	if !ok {
+		link = &busLink{addr: busAddr(node)}
+		b.links[node] = link
+	}
+	b.mu.Unlock()
+	reply, err := link.send(cmdLine)
+	if err != nil {
+		return protocol.MakeErrReply("ERR cluster bus: " + err.Error())
+	}
+	return reply
+}
+
+func (b *bus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	_ = b.listener.Close()
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+	for _, link := range b.links {
+		link.close()
+	}
+}
+
+func (l *busLink) send(cmdLine CmdLine) (redis.Reply, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.addr, busTimeout)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+		l.reader = bufio.NewReader(conn)
+	}
+	_ = l.conn.SetDeadline(time.Now().Add(busTimeout))
+	if err := writeFrame(l.conn, busRequest, cmdLine); err != nil {
+		l.closeWithMutex()
+		return nil, err
+	}
+	reply, err := readReply(l.reader)
+	if err != nil {
+		// late reply would be taken as reply of the next request, so the connection is dropped
+		l.closeWithMutex()
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (l *busLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeWithMutex()
+}
+
+func (l *busLink) closeWithMutex() {
+	if l.conn == nil {
+		return
+	}
+	_ = l.conn.Close()
+	l.conn = nil
+	l.reader = nil
+}
+
+// sendBus sends request to node through cluster bus
+func (cluster *Cluster) sendBus(node string, cmdLine CmdLine) redis.Reply {
+	if cluster.bus == nil {
+		return protocol.MakeErrReply("ERR cluster bus is not listening")
+	}
+	return cluster.bus.send(node, cmdLine)
+}
+
+// execBus executes request received from cluster bus
+func (cluster *Cluster) execBus(cmdLine CmdLine) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmdFunc, ok := busRouter[cmdName]
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "' on cluster bus")
+	}
+	return cmdFunc(cluster, nil, cmdLine)
+}
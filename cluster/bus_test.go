@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestBusFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	args := toArgs(relayVote, "127.0.0.1:6399", "", "1")
+	if err := writeFrame(buf, busRequest, args); err != nil {
+		t.Fatal(err)
+	}
+	msgType, decoded, err := readFrame(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != busRequest || len(decoded) != len(args) {
+		t.Fatalf("wrong frame: type %d, args %q", msgType, decoded)
+	}
+	for i := range args {
+		if !bytes.Equal(args[i], decoded[i]) {
+			t.Errorf("expected arg %q, actually %q", args[i], decoded[i])
+		}
+	}
+
+	replies := []redis.Reply{
+		protocol.MakeIntReply(-42),
+		protocol.MakeMultiBulkReply(toArgs("a", "b")),
+		protocol.MakeErrReply("ERR gossip is disabled"),
+	}
+	for _, reply := range replies {
+		buf.Reset()
+		if err := writeReply(buf, reply); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := readReply(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply.ToBytes(), decoded.ToBytes()) {
+			t.Errorf("expected reply %q, actually %q", reply.ToBytes(), decoded.ToBytes())
+		}
+	}
+
+	// frame claiming more bytes than it has is rejected
+	buf.Reset()
+	_ = writeFrame(buf, busRequest, toArgs("ping"))
+	raw := buf.Bytes()
+	raw[len(raw)-5] = 0xff
+	if _, _, err := readFrame(bytes.NewReader(raw)); err == nil {
+		t.Error("expect error reading truncated frame")
+	}
+}
+
+func TestBusLink(t *testing.T) {
+	addrA, addrB := "127.0.0.1:6531", "127.0.0.1:6532"
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = "127.0.0.1:6399"
+			p.Peers = nil
+		})
+	}()
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = addrB
+		p.Peers = nil
+	})
+	nodeB := MakeCluster()
+	defer nodeB.Close()
+	busB, err := listenBus(nodeB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB.bus = busB
+	nodeB.gossip = makeGossip(nodeB)
+
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = addrA
+		p.Peers = []string{addrB}
+	})
+	nodeA := MakeCluster()
+	defer nodeA.Close()
+	busA, err := listenBus(nodeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA.bus = busA
+	nodeA.gossip = makeGossip(nodeA)
+
+	nodeA.gossip.ping(addrB)
+	if nodes := nodeB.getNodes(); len(nodes) != 2 {
+		t.Errorf("%s should be discovered by gossip through cluster bus, actually %v", addrA, nodes)
+	}
+	result := nodeA.sendBus(addrB, toArgs(relayVote, addrA, "1", "127.0.0.1:6533"))
+	asserts.AssertIntReply(t, result, 0)
+	result = nodeA.sendBus(addrB, toArgs("get", "a"))
+	asserts.AssertErrReply(t, result, "ERR unknown command 'get' on cluster bus")
+	result = nodeA.sendBus("127.0.0.1:6534", toArgs(relayGossip, addrA, "0"))
+	if !protocol.IsErrorReply(result) {
+		t.Error("expect error connecting to node not listening")
+	}
+}
@@ -14,16 +14,17 @@ import (
 	"github.com/hdt3213/godis/lib/consistenthash"
 	"github.com/hdt3213/godis/lib/idgenerator"
 	"github.com/hdt3213/godis/lib/logger"
-	"github.com/hdt3213/godis/lib/pool"
-	"github.com/hdt3213/godis/lib/utils"
-	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/lib/slotmap"
 	"github.com/hdt3213/godis/redis/protocol"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type PeerPicker interface {
 	AddNode(keys ...string)     // 添加集群结点至哈希环
+	RemoveNode(keys ...string)  // 从哈希环移除集群结点
 	PickNode(key string) string // 选择 key 所落在的节点（顺时针第一个结点）
 }
 
@@ -32,12 +33,28 @@ type PeerPicker interface {
 type Cluster struct {
 	self string
 
+	// mu guards nodes and nodeConnections, which grow when nodes are discovered by gossip
+	mu              sync.RWMutex
 	nodes           []string
 	peerPicker      PeerPicker            // 哈希环
-	nodeConnections map[string]*pool.Pool // Redis链接
+	nodeConnections map[string]*peerConns // Redis链接
+	// gossip exchanges states of nodes, it is nil unless cluster-gossip is enabled
+	gossip *gossip
+	// bus serves gossip and votes of peers on port+10000, it is nil unless cluster-gossip or cluster-raft is enabled
+	bus *bus
+	// meta replicates changes of cluster metadata by raft, it is nil unless cluster-raft is enabled
+	meta *metadata
+	// journal records tcc transactions prepared by this node, it is nil unless cluster-tx-journal is set
+	journal *journal
 
-	db           database.EmbedDB // 多个分段map
-	transactions *dict.SimpleDict // id -> Transaction
+	db           database.EmbedDB     // 多个分段map
+	transactions *dict.ConcurrentDict // id -> Transaction
+	// decisions is id -> status of transactions coordinated by self recently, participants ask them when reaping
+	decisions *dict.ConcurrentDict
+	// reapedCommitted and reapedRolledBack count orphan transactions finished by reaper
+	reapedCommitted  int64
+	reapedRolledBack int64
+	stopReaper       chan struct{}
 
 	idGenerator *idgenerator.IDGenerator // 使用 snowflake 算法决定事务 ID
 	// use a variable to allow injecting stub for testing
@@ -46,6 +63,8 @@ type Cluster struct {
 
 const (
 	replicas = 4
+	// slotMode maps keys to hash slots of redis cluster instead of consistent hash ring
+	slotMode = "slots"
 )
 
 // if only one node involved in a transaction, just execute the command don't apply tcc procedure
@@ -55,81 +74,222 @@ var allowFastTransaction = true
 func MakeCluster() *Cluster {
 	// 集群主节点
 	cluster := &Cluster{
-		self:            config.Properties.Self,
+		self:            announceAddr(config.Properties().Self),
 		db:              database2.NewStandaloneServer(),
-		transactions:    dict.MakeSimple(),
+		transactions:    dict.MakeConcurrent(16),
+		decisions:       dict.MakeConcurrent(16),
+		stopReaper:      make(chan struct{}),
 		peerPicker:      consistenthash.New(replicas, nil),
-		nodeConnections: make(map[string]*pool.Pool),
+		nodeConnections: make(map[string]*peerConns),
 
-		idGenerator: idgenerator.MakeGenerator(config.Properties.Self),
+		idGenerator: idgenerator.MakeGenerator(announceAddr(config.Properties().Self)),
 		relayImpl:   defaultRelayImpl,
 	}
 	contains := make(map[string]struct{})
 	// 集群数量 + self
-	nodes := make([]string, 0, len(config.Properties.Peers)+1)
+	nodes := make([]string, 0, len(config.Properties().Peers)+1)
 	// Peers  eg. ["127.0.0.1:6379", "127.0.0.1:6380"]
-	for _, peer := range config.Properties.Peers {
+	for _, peer := range config.Properties().Peers {
 		if _, ok := contains[peer]; ok {
 			continue
 		}
 		contains[peer] = struct{}{}
 		nodes = append(nodes, peer)
 	}
-	nodes = append(nodes, config.Properties.Self)
-
-	// cluster.peerPicker相当于就是哈希环，哈希环上服务器结点
-	cluster.peerPicker.AddNode(nodes...)
-	connectionPoolConfig := pool.Config{
-		MaxIdle:   1,
-		MaxActive: 16,
-	}
-	for _, p := range config.Properties.Peers {
-		peer := p
-		factory := func() (interface{}, error) {
-			c, err := client.MakeClient(peer)
-			if err != nil {
-				return nil, err
-			}
-			c.Start()
-			// all peers of cluster should use the same password
-			if config.Properties.RequirePass != "" {
-				c.Send(utils.ToCmdLine("AUTH", config.Properties.RequirePass))
-			}
-			return c, nil
-		}
-		finalizer := func(x interface{}) {
-			cli, ok := x.(client.Client)
-			if !ok {
-				return
-			}
-			cli.Close()
-		}
-		cluster.nodeConnections[peer] = pool.New(factory, finalizer, connectionPoolConfig)
+	nodes = append(nodes, cluster.self)
+
+	if config.Properties().ClusterHashMode == slotMode {
+		cluster.peerPicker = makeSlotMap(nodes)
+	} else {
+		// cluster.peerPicker相当于就是哈希环，哈希环上服务器结点
+		cluster.addToPicker(nodes...)
+	}
+	for _, peer := range config.Properties().Peers {
+		cluster.nodeConnections[peer] = makePeerConns(peer)
 	}
 	cluster.nodes = nodes
+	if config.Properties().ClusterTxJournal != "" {
+		j, err := openJournal(config.Properties().ClusterTxJournal)
+		if err != nil {
+			logger.Error("open tx journal failed: " + err.Error())
+		} else {
+			cluster.journal = j
+			cluster.recoverTransactions()
+		}
+	}
+	if config.Properties().ClusterGossip || config.Properties().ClusterRaft {
+		bus, err := listenBus(cluster)
+		if err != nil {
+			logger.Error("listen cluster bus failed: " + err.Error())
+		}
+		cluster.bus = bus
+	}
+	if config.Properties().ClusterGossip {
+		cluster.gossip = makeGossip(cluster)
+	}
+	if config.Properties().ClusterRaft {
+		meta, err := cluster.makeMetadata(cluster.sendBus)
+		if err != nil {
+			logger.Error("restore cluster metadata failed: " + err.Error())
+		} else {
+			cluster.meta = meta
+			cluster.meta.raft.Start()
+		}
+	}
+	if cluster.gossip != nil {
+		cluster.gossip.start()
+	}
+	go cluster.reaper()
 	return cluster
 }
 
+// addNode adds node discovered at runtime, it returns false if the node is known already
+func (cluster *Cluster) addNode(node string) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if node == cluster.self {
+		return false
+	}
+	if _, ok := cluster.nodeConnections[node]; ok {
+		return false
+	}
+	cluster.nodeConnections[node] = makePeerConns(node)
+	cluster.nodes = append(cluster.nodes, node)
+	cluster.updatePicker(func() {
+		cluster.addToPicker(node)
+	})
+	return true
+}
+
+// removeNode removes node at runtime, it returns false if the node is unknown.
+// Connections to the node are closed after requests in flight finished
+func (cluster *Cluster) removeNode(node string) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	peerConns, ok := cluster.nodeConnections[node]
+	if !ok {
+		return false
+	}
+	delete(cluster.nodeConnections, node)
+	for i, n := range cluster.nodes {
+		if n == node {
+			cluster.nodes = append(cluster.nodes[:i], cluster.nodes[i+1:]...)
+			break
+		}
+	}
+	cluster.updatePicker(func() {
+		cluster.peerPicker.RemoveNode(node)
+	})
+	peerConns.close()
+	return true
+}
+
+// addToPicker adds nodes to peerPicker, nodes get virtual nodes on consistent hash ring in proportion to their weights
+// given by cluster-node-weights
+func (cluster *Cluster) addToPicker(nodes ...string) {
+	ring, ok := cluster.peerPicker.(*consistenthash.Map)
+	if !ok {
+		cluster.peerPicker.AddNode(nodes...)
+		return
+	}
+	weights := nodeWeights()
+	for _, node := range nodes {
+		ring.AddNodeWithWeight(node, weights[node])
+	}
+}
+
+// nodeWeights parses cluster-node-weights, nodes not configured are not in the result
+func nodeWeights() map[string]int {
+	weights := make(map[string]int)
+	for _, entry := range config.Properties().ClusterNodeWeights {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			logger.Error("illegal cluster-node-weights " + entry)
+			continue
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight < 1 {
+			logger.Error("illegal weight in cluster-node-weights " + entry)
+			continue
+		}
+		weights[fields[0]] = weight
+	}
+	return weights
+}
+
+// updatePicker applies update to peerPicker, and reports hash ranges moved from or to self if keys are distributed
+// by consistent hash, since keys in them are not reachable until migrated to the new owner
+func (cluster *Cluster) updatePicker(update func()) {
+	ring, ok := cluster.peerPicker.(*consistenthash.Map)
+	if !ok {
+		update()
+		return
+	}
+	before := ring.Clone()
+	update()
+	moved := make(map[string]int)
+	for _, change := range before.Diff(ring) {
+		if change.From == cluster.self || change.To == cluster.self {
+			moved[change.From+" to "+change.To]++
+		}
+	}
+	for direction, n := range moved {
+		logger.Warn(fmt.Sprintf("%d hash ranges are moved from %s, keys in them should be migrated", n, direction))
+	}
+}
+
+// getNodes returns all nodes of cluster including self
+func (cluster *Cluster) getNodes() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	nodes := make([]string, len(cluster.nodes))
+	copy(nodes, cluster.nodes)
+	return nodes
+}
+
+// makeSlotMap assigns slots by config or divides them evenly among nodes
+func makeSlotMap(nodes []string) *slotmap.Map {
+	slots := slotmap.New()
+	for _, entry := range config.Properties().ClusterSlots {
+		if err := slots.ParseAssignment(entry); err != nil {
+			logger.Error("illegal cluster-slots " + entry + ": " + err.Error())
+		}
+	}
+	slots.AddNode(nodes...)
+	if n := slots.Unassigned(); n > 0 {
+		logger.Warn(fmt.Sprintf("%d slots are not assigned to any node", n))
+	}
+	return slots
+}
+
 // CmdFunc represents the handler of a redis command
 type CmdFunc func(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply
 
 // Close stops current node of cluster
 func (cluster *Cluster) Close() {
+	close(cluster.stopReaper)
+	if cluster.gossip != nil {
+		cluster.gossip.stop()
+	}
+	if cluster.meta != nil {
+		cluster.meta.raft.Close()
+	}
+	if cluster.bus != nil {
+		cluster.bus.close()
+	}
 	cluster.db.Close()
-	for _, pool := range cluster.nodeConnections {
-		pool.Close()
+	if cluster.journal != nil {
+		cluster.journal.close()
+	}
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	for _, peerConns := range cluster.nodeConnections {
+		peerConns.close()
 	}
 }
 
 var router = makeRouter()
 
-func isAuthenticated(c redis.Connection) bool {
-	if config.Properties.RequirePass == "" {
-		return true
-	}
-	return c.GetPassword() == config.Properties.RequirePass
-}
-
 // Exec executes command on cluster
 func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
 	defer func() {
@@ -142,7 +302,7 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 	if cmdName == "auth" {
 		return database2.Auth(c, cmdLine[1:])
 	}
-	if !isAuthenticated(c) {
+	if !database2.IsAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
 
@@ -155,7 +315,12 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 		if len(cmdLine) != 1 {
 			return protocol.MakeArgNumErrReply(cmdName)
 		}
-		return database2.DiscardMulti(c)
+		watching := c.GetWatching()
+		reply := database2.DiscardMulti(c)
+		if !protocol.IsErrorReply(reply) {
+			cluster.unwatchRemote(c, watching)
+		}
+		return reply
 	} else if cmdName == "exec" {
 		if len(cmdLine) != 1 {
 			return protocol.MakeArgNumErrReply(cmdName)
@@ -168,12 +333,22 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 		return execSelect(c, cmdLine)
 	}
 	if c != nil && c.InMultiState() {
+		if errReply := cluster.checkCrossSlot(cmdLine); errReply != nil {
+			c.AddTxError(errReply)
+			return errReply
+		}
 		return database2.EnqueueCmd(c, cmdLine)
 	}
 	cmdFunc, ok := router[cmdName]
 	if !ok {
 		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in cluster mode")
 	}
+	if errReply := cluster.checkCrossSlot(cmdLine); errReply != nil {
+		return errReply
+	}
+	if errReply := cluster.redirect(c, cmdLine); errReply != nil {
+		return errReply
+	}
 
 	result = cmdFunc(cluster, c, cmdLine)
 	return result
@@ -181,5 +356,6 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 
 // AfterClientClose does some clean after client close connection
 func (cluster *Cluster) AfterClientClose(c redis.Connection) {
+	cluster.unwatchRemote(c, c.GetWatching())
 	cluster.db.AfterClientClose(c)
 }
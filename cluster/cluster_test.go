@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/consistenthash"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestSlotMode(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+		})
+	}()
+	// slots are divided evenly among sorted nodes, "foo" is in slot 12182
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400", "127.0.0.1:6398"})
+	defer cluster.Close()
+	if node := cluster.peerPicker.PickNode("foo"); node != "127.0.0.1:6400" {
+		t.Errorf("foo should be on 127.0.0.1:6400, actually %s", node)
+	}
+	if node := cluster.peerPicker.PickNode("{foo}.bar"); node != "127.0.0.1:6400" {
+		t.Errorf("keys with the same hash tag should be on the same node, actually %s", node)
+	}
+
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterSlots = []string{"127.0.0.1:6399 12182", "127.0.0.1:6400 0-100"}
+	})
+	cluster2 := MakeTestCluster([]string{"127.0.0.1:6400"})
+	defer cluster2.Close()
+	slots := cluster2.peerPicker.(*slotmap.Map)
+	if slots.Unassigned() != slotmap.SlotCount-102 {
+		t.Errorf("only configured slots should be assigned")
+	}
+	conn := &connection.FakeConn{}
+	asserts.AssertStatusReply(t, cluster2.Exec(conn, toArgs("SET", "foo", "bar")), "OK")
+	asserts.AssertBulkReply(t, cluster2.Exec(conn, toArgs("GET", "foo")), "bar")
+	asserts.AssertErrReply(t, cluster2.Exec(conn, toArgs("GET", "a")), "CLUSTERDOWN Hash slot not served")
+}
+
+func TestRedirect(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterRedirect = true
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterRedirect = false
+		})
+	}()
+	// 127.0.0.1:6399 serves slots 0-8191, "a" is in slot 15495 and "b" is in slot 3300
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400"})
+	defer cluster.Close()
+	conn := &connection.FakeConn{}
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("SET", "a", "1")), "MOVED 15495 127.0.0.1:6400")
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("GET", "{a}b")), "MOVED 15495 127.0.0.1:6400")
+	asserts.AssertStatusReply(t, cluster.Exec(conn, toArgs("SET", "b", "1")), "OK")
+	asserts.AssertStatusReply(t, cluster.Exec(conn, toArgs("PING")), "PONG")
+
+	// keys not found during migration are served by the target node
+	slot := slotmap.HashSlot("b")
+	cluster.peerPicker.(*slotmap.Map).SetMigrating(slot, "127.0.0.1:6400")
+	asserts.AssertBulkReply(t, cluster.Exec(conn, toArgs("GET", "b")), "1")
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("GET", "{b}c")), "ASK 3300 127.0.0.1:6400")
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("MGET", "b", "{b}c")),
+		"TRYAGAIN Multiple keys request during rehashing of slot")
+	cluster.peerPicker.(*slotmap.Map).SetMigrating(slot, "")
+	asserts.AssertNullBulk(t, cluster.Exec(conn, toArgs("GET", "{b}c")))
+}
+
+func TestNodeWeights(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterNodeWeights = []string{"127.0.0.1:6400 3", "127.0.0.1:6401 x"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterNodeWeights = nil
+		})
+	}()
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400"})
+	defer cluster.Close()
+	expected := consistenthash.New(replicas, nil)
+	expected.AddNode(cluster.self)
+	expected.AddNodeWithWeight("127.0.0.1:6400", 3)
+	if changes := expected.Diff(cluster.peerPicker.(*consistenthash.Map)); len(changes) != 0 {
+		t.Errorf("127.0.0.1:6400 should have weight 3, %d hash ranges differ", len(changes))
+	}
+	// weight is kept when node is added at runtime
+	cluster.removeNode("127.0.0.1:6400")
+	cluster.addNode("127.0.0.1:6400")
+	if changes := expected.Diff(cluster.peerPicker.(*consistenthash.Map)); len(changes) != 0 {
+		t.Errorf("127.0.0.1:6400 should have weight 3 after added again, %d hash ranges differ", len(changes))
+	}
+}
+
+func TestStrictHashTag(t *testing.T) {
+	conn := &connection.FakeConn{}
+	// keys of commands relayed to a single node must be located on it
+	result := testNodeA.Exec(conn, toArgs("SINTERSTORE", "dest", "set", testNodeB.self+"set"))
+	asserts.AssertErrReply(t, result, crossSlotErr)
+
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterStrictHashTag = true
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterStrictHashTag = false
+		})
+	}()
+	result = testNodeA.Exec(conn, toArgs("MSET", "a", "1", "b", "2"))
+	asserts.AssertErrReply(t, result, crossSlotErr)
+	result = testNodeA.Exec(conn, toArgs("MSET", "{tag}a", "1", "{tag}b", "2"))
+	asserts.AssertStatusReply(t, result, "OK")
+
+	// keys of all commands in transaction must be in the same slot
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	asserts.AssertStatusReply(t, testNodeA.Exec(conn, toArgs("SET", "a", "1")), "QUEUED")
+	asserts.AssertStatusReply(t, testNodeA.Exec(conn, toArgs("SET", "b", "1")), "QUEUED")
+	asserts.AssertErrReply(t, testNodeA.Exec(conn, toArgs("EXEC")), crossSlotErr)
+
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	asserts.AssertErrReply(t, testNodeA.Exec(conn, toArgs("MSET", "a", "1", "b", "2")), crossSlotErr)
+	asserts.AssertErrReply(t, testNodeA.Exec(conn, toArgs("EXEC")), "EXECABORT Transaction discarded because of previous errors.")
+	result = testNodeA.Exec(conn, toArgs("GET", "a"))
+	asserts.AssertNullBulk(t, result)
+}
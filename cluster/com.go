@@ -1,37 +1,16 @@
 package cluster
 
 import (
-	"errors"
 	"github.com/hdt3213/godis/interface/redis"
-	"github.com/hdt3213/godis/lib/utils"
-	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/lib/consistenthash"
 	"github.com/hdt3213/godis/redis/protocol"
-	"strconv"
 )
 
-func (cluster *Cluster) getPeerClient(peer string) (*client.Client, error) {
-	pool, ok := cluster.nodeConnections[peer]
-	if !ok {
-		return nil, errors.New("connection pool not found")
-	}
-	raw, err := pool.Get()
-	if err != nil {
-		return nil, err
-	}
-	conn, ok := raw.(*client.Client)
-	if !ok {
-		return nil, errors.New("connection pool make wrong type")
-	}
-	return conn, nil
-}
-
-func (cluster *Cluster) returnPeerClient(peer string, peerClient *client.Client) error {
-	pool, ok := cluster.nodeConnections[peer]
-	if !ok {
-		return errors.New("connection pool not found")
-	}
-	pool.Put(peerClient)
-	return nil
+func (cluster *Cluster) getPeerConns(peer string) (*peerConns, bool) {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	p, ok := cluster.nodeConnections[peer]
+	return p, ok
 }
 
 var defaultRelayImpl = func(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
@@ -40,24 +19,33 @@ var defaultRelayImpl = func(cluster *Cluster, node string, c redis.Connection, c
 		// to self db
 		return cluster.db.Exec(c, cmdLine)
 	}
-	// 从连接池取一个与目标节点的连接
-	// 连接池使用 github.com/jolestar/go-commons-pool/v2 实现
-	peerClient, err := cluster.getPeerClient(node)
-	if err != nil {
-		return protocol.MakeErrReply(err.Error())
+	// 取与目标节点的共享连接, 并发转发的命令在连接上以 pipeline 方式发送
+	peerConns, ok := cluster.getPeerConns(node)
+	if !ok {
+		return protocol.MakeErrReply("connection pool not found")
 	}
-	defer func() {
-		// 处理完成后将连接放回连接池
-		_ = cluster.returnPeerClient(node, peerClient)
-	}()
-	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex())))
-	return peerClient.Send(cmdLine)
+	return peerConns.send(c.GetDBIndex(), cmdLine)
 }
 
 // relay function relays command to peer
 // select db by c.GetDBIndex()
 // cannot call Prepare, Commit, execRollback of self node
 func (cluster *Cluster) relay(peer string, c redis.Connection, args [][]byte) redis.Reply {
+	if peer == "" {
+		// slot of key is not assigned to any node
+		return protocol.MakeErrReply("CLUSTERDOWN Hash slot not served")
+	}
+	if cluster.staleReadable(peer, c, args) {
+		peer = cluster.self
+	}
+	if cluster.nodeState(peer) == nodeFail {
+		return protocol.MakeErrReply("CLUSTERDOWN The cluster is down")
+	}
+	// requests in flight are counted as load of node, so that PickNodeBounded spreads requests to idle nodes
+	if ring, ok := cluster.peerPicker.(*consistenthash.Map); ok {
+		ring.Acquire(peer)
+		defer ring.Release(peer)
+	}
 	// use a variable to allow injecting stub for testing
 	return cluster.relayImpl(cluster, peer, c, args)
 }
@@ -65,7 +53,7 @@ func (cluster *Cluster) relay(peer string, c redis.Connection, args [][]byte) re
 // broadcast function broadcasts command to all node in cluster
 func (cluster *Cluster) broadcast(c redis.Connection, args [][]byte) map[string]redis.Reply {
 	result := make(map[string]redis.Reply)
-	for _, node := range cluster.nodes {
+	for _, node := range cluster.getNodes() {
 		reply := cluster.relay(node, c, args)
 		result[node] = reply
 	}
@@ -2,8 +2,11 @@ package cluster
 
 import (
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/consistenthash"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"testing"
 )
@@ -22,9 +25,13 @@ func TestExec(t *testing.T) {
 
 func TestAuth(t *testing.T) {
 	passwd := utils.RandString(10)
-	config.Properties.RequirePass = passwd
+	config.Update(func(p *config.ServerProperties) {
+		p.RequirePass = passwd
+	})
 	defer func() {
-		config.Properties.RequirePass = ""
+		config.Update(func(p *config.ServerProperties) {
+			p.RequirePass = ""
+		})
 	}()
 	conn := &connection.FakeConn{}
 	ret := testNodeA.Exec(conn, toArgs("GET", "a"))
@@ -46,6 +53,24 @@ func TestRelay(t *testing.T) {
 	asserts.AssertBulkReply(t, ret, value)
 }
 
+func TestRelayLoad(t *testing.T) {
+	peer := "127.0.0.1:6400"
+	cluster := MakeTestCluster([]string{peer})
+	defer cluster.Close()
+	ring := cluster.peerPicker.(*consistenthash.Map)
+	cluster.relayImpl = func(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+		if ring.Load(node) != 1 {
+			t.Errorf("request to %s should be counted as its load", node)
+		}
+		return protocol.MakeOkReply()
+	}
+	ret := cluster.relay(peer, &connection.FakeConn{}, toArgs("SET", "a", "1"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	if ring.Load(peer) != 0 {
+		t.Error("load should be released after relayed")
+	}
+}
+
 func TestBroadcast(t *testing.T) {
 	testCluster2 := MakeTestCluster([]string{"127.0.0.1:6379"})
 	key := RandString(4)
@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+)
+
+// configReloader is implemented by database which applies properties of reloaded config
+type configReloader interface {
+	ReloadConfig() (*config.ReloadResult, error)
+}
+
+// ReloadConfig reads config file again and applies hot reloadable properties to local database and cluster
+func (cluster *Cluster) ReloadConfig() (*config.ReloadResult, error) {
+	var result *config.ReloadResult
+	var err error
+	if reloader, ok := cluster.db.(configReloader); ok {
+		result, err = reloader.ReloadConfig()
+	} else {
+		result, err = config.Reload()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range result.Applied {
+		if key == "peers" {
+			cluster.ReloadPeers(config.Properties().Peers)
+		}
+	}
+	return result, nil
+}
+
+// execConfig manages config of this node, peers changed by CONFIG SET or CONFIG RELOAD are applied to cluster
+func execConfig(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	switch strings.ToLower(string(args[1])) {
+	case "set":
+		reply := cluster.db.Exec(c, args)
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		for i := 2; i < len(args); i += 2 {
+			if strings.ToLower(string(args[i])) == "peers" {
+				cluster.ReloadPeers(config.Properties().Peers)
+			}
+		}
+		return reply
+	case "reload":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("config|reload")
+		}
+		result, err := cluster.ReloadConfig()
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		restartRequired := make([][]byte, len(result.RestartRequired))
+		for i, key := range result.RestartRequired {
+			restartRequired[i] = []byte(key)
+		}
+		return protocol.MakeMultiBulkReply(restartRequired)
+	}
+	return cluster.db.Exec(c, args)
+}
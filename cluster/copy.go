@@ -13,7 +13,7 @@ const noReplace = "NoReplace"
 const useReplace = "UseReplace"
 
 // Copy copies the value stored at the source key to the destination key.
-// the origin and the destination must within the same node.
+// If they are located on different nodes, the source is dumped and restored on the other node within a tcc transaction
 func Copy(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	if len(args) < 3 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'copy' command")
@@ -46,8 +46,9 @@ func Copy(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
+	timeout := txTimeout(len(groupMap))
 	// prepare Copy from
-	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "CopyFrom", srcKey))
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makePrepareArgs(txIDStr, timeout, "CopyFrom", srcKey))
 	if protocol.IsErrorReply(srcPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
@@ -59,7 +60,7 @@ func Copy(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR invalid prepare response")
 	}
 	// prepare Copy to
-	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+	destPrepareResp := cluster.relayPrepare(destNode, c, append(makePrepareArgs(txIDStr, timeout),
 		[]byte("CopyTo"), []byte(destKey), srcPrepareMBR.Args[0], srcPrepareMBR.Args[1], []byte(replaceFlag)))
 	if protocol.IsErrorReply(destPrepareResp) {
 		// rollback src node
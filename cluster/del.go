@@ -27,22 +27,17 @@ func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for peer, peerKeys := range groupMap {
-		peerArgs := []string{txIDStr, "DEL"}
+	timeout := txTimeout(len(groupMap))
+	replies := fanOut(groupMap, func(peer string, peerKeys []string) redis.Reply {
+		peerArgs := []string{"DEL"}
 		peerArgs = append(peerArgs, peerKeys...)
-		var resp redis.Reply
-		if peer == cluster.self {
-			resp = execPrepare(cluster, c, makeArgs("Prepare", peerArgs...))
-		} else {
-			resp = cluster.relay(peer, c, makeArgs("Prepare", peerArgs...))
-		}
-		if protocol.IsErrorReply(resp) {
-			errReply = resp
-			rollback = true
-			break
-		}
+		return cluster.relayPrepare(peer, c, makePrepareArgs(txIDStr, timeout, peerArgs...))
+	})
+	if _, resp := firstError(replies); resp != nil {
+		errReply = resp
+		rollback = true
 	}
-	var respList []redis.Reply
+	var respList map[string]redis.Reply
 	if rollback {
 		// rollback
 		requestRollback(cluster, c, txID, groupMap)
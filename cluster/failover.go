@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// relayVote asks a master to vote for the replica taking over slots of its failed master.
+// format: _vote candidate epoch failed-master, reply 1 if the vote is granted, otherwise 0
+const relayVote = "_vote"
+
+// failoverDelay is the max random delay of starting election after master failed,
+// so that replicas of the same master are unlikely to start together. It is a variable so that tests could shorten it
+var failoverDelay = 500 * time.Millisecond
+
+// replicate makes self a replica of the node, and peers learn it by gossip.
+// usage: CLUSTER REPLICATE node-id
+func (cluster *Cluster) replicate(slots *slotmap.Map, id string) redis.Reply {
+	node := nodeByID(slots, id)
+	if node == "" {
+		return protocol.MakeErrReply("ERR Unknown node " + id)
+	}
+	if node == cluster.self {
+		return protocol.MakeErrReply("ERR Can't replicate myself")
+	}
+	if len(slots.GetNodeSlots(cluster.self)) > 0 {
+		return protocol.MakeErrReply("ERR To set a master the node must be empty and without assigned slots.")
+	}
+	if cluster.replicaOf(node) != "" {
+		return protocol.MakeErrReply("ERR I can only replicate a master, not a replica.")
+	}
+	if cluster.meta != nil {
+		return cluster.proposeMeta(&metaChange{Kind: metaReplicate, Node: cluster.self, Target: node})
+	}
+	host, port := splitAddr(node)
+	if reply := cluster.execInternal(utils.ToCmdLine("replicaof", host, strconv.Itoa(port))); protocol.IsErrorReply(reply) {
+		return reply
+	}
+	if cluster.gossip != nil {
+		cluster.gossip.mu.Lock()
+		cluster.gossip.master = node
+		cluster.gossip.mu.Unlock()
+	}
+	return protocol.MakeOkReply()
+}
+
+// execInternal executes command issued by cluster itself instead of a client
+func (cluster *Cluster) execInternal(cmdLine CmdLine) redis.Reply {
+	conn := &connection.FakeConn{}
+	conn.SetPassword(config.Properties().RequirePass)
+	return cluster.db.Exec(conn, cmdLine)
+}
+
+// checkFailover starts election after a random delay once master of self failed, and retries if it isn't elected
+func (g *gossip) checkFailover() {
+	g.mu.Lock()
+	master := g.master
+	m, ok := g.members[master]
+	if master == "" || !ok || !m.fail {
+		g.failoverAt = time.Time{}
+		g.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if g.failoverAt.IsZero() {
+		g.failoverAt = now.Add(time.Duration(rand.Int63n(int64(failoverDelay) + 1)))
+		g.mu.Unlock()
+		return
+	}
+	if now.Before(g.failoverAt) {
+		g.mu.Unlock()
+		return
+	}
+	// election is retried later if this one fails
+	g.failoverAt = now.Add(2 * g.nodeTimeout)
+	g.mu.Unlock()
+	if !atomic.CompareAndSwapInt32(&g.electing, 0, 1) {
+		return
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("election failed", err)
+			}
+			atomic.StoreInt32(&g.electing, 0)
+		}()
+		g.elect(master)
+	}()
+}
+
+// elect asks masters for votes in a new epoch, and takes over slots of the failed master if a majority of masters
+// vote for self. It returns whether self is promoted.
+func (g *gossip) elect(master string) bool {
+	slots, ok := g.cluster.peerPicker.(*slotmap.Map)
+	if !ok {
+		return false
+	}
+	var masters []string
+	for _, node := range slots.Nodes() {
+		if len(slots.GetNodeSlots(node)) > 0 {
+			masters = append(masters, node)
+		}
+	}
+	g.mu.Lock()
+	g.currentEpoch++
+	epoch := g.currentEpoch
+	g.mu.Unlock()
+
+	votes := 0
+	voteCmd := utils.ToCmdLine(relayVote, g.cluster.self, strconv.FormatInt(epoch, 10), master)
+	for _, node := range masters {
+		if node == master || node == g.cluster.self {
+			continue
+		}
+		if reply, ok := g.send(node, voteCmd).(*protocol.IntReply); ok && reply.Code == 1 {
+			votes++
+		}
+	}
+	quorum := len(masters)/2 + 1
+	if votes < quorum {
+		logger.Warn("failover of " + master + " failed, got " + strconv.Itoa(votes) + " votes in epoch " +
+			strconv.FormatInt(epoch, 10) + ", needs " + strconv.Itoa(quorum))
+		return false
+	}
+
+	if g.cluster.meta != nil {
+		// takeover is applied by every node once it is committed, g.mu mustn't be held since applying takes it
+		g.mu.Lock()
+		current := g.master
+		g.mu.Unlock()
+		if current != master {
+			return false
+		}
+		change := &metaChange{Kind: metaTakeover, Node: g.cluster.self, Target: master, Epoch: epoch}
+		if reply := g.cluster.proposeMeta(change); protocol.IsErrorReply(reply) {
+			logger.Warn("failover of " + master + " failed: " + string(reply.ToBytes()))
+			return false
+		}
+		logger.Info("took over slots of " + master + " in epoch " + strconv.FormatInt(epoch, 10))
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.master != master {
+		return false
+	}
+	g.epoch = epoch
+	g.takeover(g.cluster.self, master)
+	logger.Info("took over slots of " + master + " in epoch " + strconv.FormatInt(epoch, 10))
+	return true
+}
+
+// vote grants the vote of this epoch to candidate if self is a master agreeing that the master of candidate failed,
+// and it hasn't voted for replicas of the failed master recently
+func (g *gossip) vote(candidate string, epoch int64, master string) bool {
+	slots, ok := g.cluster.peerPicker.(*slotmap.Map)
+	if !ok || len(slots.GetNodeSlots(g.cluster.self)) == 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if epoch > g.currentEpoch {
+		g.currentEpoch = epoch
+	}
+	if epoch < g.currentEpoch || g.lastVoteEpoch >= epoch {
+		return false
+	}
+	m, ok := g.members[master]
+	if !ok || !m.fail {
+		return false
+	}
+	c, ok := g.members[candidate]
+	if !ok || c.master != master {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(m.lastVoted) < 2*g.nodeTimeout {
+		return false
+	}
+	g.lastVoteEpoch = epoch
+	m.lastVoted = now
+	return true
+}
+
+// takeover assigns slots of the former master to the promoted node, and the former master and its other replicas
+// replicate the promoted node, invoker should hold g.mu
+func (g *gossip) takeover(node string, former string) {
+	slots, ok := g.cluster.peerPicker.(*slotmap.Map)
+	if !ok {
+		return
+	}
+	for _, r := range slots.GetNodeSlots(former) {
+		_ = slots.Assign(node, r[0], r[1])
+	}
+	self := g.cluster.self
+	if m, ok := g.members[former]; ok {
+		m.master = node
+	}
+	for addr, m := range g.members {
+		if addr != node && m.master == former {
+			m.master = node
+		}
+	}
+	if node == self {
+		g.master = ""
+		g.cluster.execInternal(utils.ToCmdLine("replicaof", "no", "one"))
+		return
+	}
+	if m, ok := g.members[node]; ok {
+		m.master = ""
+	}
+	if former == self || g.master == former {
+		g.master = node
+		host, port := splitAddr(node)
+		g.cluster.execInternal(utils.ToCmdLine("replicaof", host, strconv.Itoa(port)))
+		logger.Info("replicate " + node + " which took over slots of " + former)
+	}
+}
+
+// execVote handles vote request from replica of failed master received by cluster bus
+func execVote(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if cluster.gossip == nil {
+		return protocol.MakeErrReply("ERR gossip is disabled")
+	}
+	if len(args) != 4 {
+		return protocol.MakeArgNumErrReply(relayVote)
+	}
+	epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if cluster.gossip.vote(string(args[1]), epoch, string(args[3])) {
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeIntReply(0)
+}
@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	addrA, addrB, addrC, addrR := "127.0.0.1:6511", "127.0.0.1:6512", "127.0.0.1:6513", "127.0.0.1:6514"
+	all := []string{addrA, addrB, addrC, addrR}
+	clusters := make(map[string]*Cluster)
+	down := make(map[string]bool)
+	send := func(node string, cmdLine CmdLine) redis.Reply {
+		if down[node] {
+			return protocol.MakeErrReply("connection refused")
+		}
+		return clusters[node].execBus(cmdLine)
+	}
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{addrA + " 0-5460", addrB + " 5461-10922", addrC + " 10923-16383"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+			p.Self = "127.0.0.1:6399"
+			p.Peers = nil
+		})
+	}()
+	for _, addr := range all {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = addr
+			p.Peers = nil
+			for _, peer := range all {
+				if peer != addr {
+					p.Peers = append(p.Peers, peer)
+				}
+			}
+		})
+		cluster := MakeCluster()
+		defer cluster.Close()
+		cluster.gossip = makeGossip(cluster)
+		cluster.gossip.nodeTimeout = 50 * time.Millisecond
+		cluster.gossip.send = send
+		clusters[addr] = cluster
+	}
+	a, b, c, r := clusters[addrA].gossip, clusters[addrB].gossip, clusters[addrC].gossip, clusters[addrR].gossip
+	conn := &connection.FakeConn{}
+	result := clusters[addrA].Exec(conn, toArgs("CLUSTER", "REPLICATE", nodeID(addrB)))
+	asserts.AssertErrReply(t, result, "ERR To set a master the node must be empty and without assigned slots.")
+	result = clusters[addrR].Exec(conn, toArgs("CLUSTER", "REPLICATE", nodeID(addrA)))
+	asserts.AssertStatusReply(t, result, "OK")
+	for _, addr := range []string{addrA, addrB, addrC} {
+		r.ping(addr)
+	}
+	if master := clusters[addrB].replicaOf(addrR); master != addrA {
+		t.Errorf("%s should replicate %s, actually %s", addrR, addrA, master)
+	}
+	slots := clusters[addrB].peerPicker.(*slotmap.Map)
+	if nodes := clusters[addrB].shardNodes(addrA); len(nodes) != 2 || nodes[1] != addrR {
+		t.Errorf("shard of %s should be %s and %s, actually %v", addrA, addrA, addrR, nodes)
+	}
+
+	// master A fails, and B, C, R agree on it
+	down[addrA] = true
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		b.ping(addrC)
+		r.ping(addrB)
+		r.ping(addrC)
+		for _, g := range []*gossip{b, c, r} {
+			g.checkFailures()
+		}
+	}
+	for _, g := range []*gossip{b, c, r} {
+		if state := g.state(addrA); state != nodeFail {
+			t.Fatalf("%s should be fail, actually %s", addrA, state)
+		}
+	}
+	if !r.elect(addrA) {
+		t.Fatal("replica should be elected")
+	}
+	if c.vote(addrR, 1, addrA) {
+		t.Error("vote should be granted only once in an epoch")
+	}
+	if owner := clusters[addrR].peerPicker.(*slotmap.Map).GetSlotNode(0); owner != addrR {
+		t.Errorf("slot 0 should be served by %s, actually %s", addrR, owner)
+	}
+	r.ping(addrB)
+	if owner := slots.GetSlotNode(0); owner != addrR {
+		t.Errorf("slot 0 should be served by %s, actually %s", addrR, owner)
+	}
+
+	// former master becomes replica of the promoted node once it returns
+	down[addrA] = false
+	a.ping(addrB)
+	if owner := clusters[addrA].peerPicker.(*slotmap.Map).GetSlotNode(0); owner != addrR {
+		t.Errorf("slot 0 should be served by %s, actually %s", addrR, owner)
+	}
+	if master := clusters[addrA].replicaOf(addrA); master != addrR {
+		t.Errorf("%s should replicate %s, actually %s", addrA, addrR, master)
+	}
+}
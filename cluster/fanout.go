@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// fanOutWorkers is the max count of goroutines sending sub-commands of a command to nodes concurrently
+const fanOutWorkers = 16
+
+// fanOut calls fn for every node in groupMap concurrently, and returns node -> reply of fn
+// groupMap: node -> keys
+func fanOut(groupMap map[string][]string, fn func(node string, keys []string) redis.Reply) map[string]redis.Reply {
+	result := make(map[string]redis.Reply, len(groupMap))
+	if len(groupMap) == 1 {
+		// no need to start goroutine
+		for node, keys := range groupMap {
+			result[node] = fn(node, keys)
+		}
+		return result
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, fanOutWorkers)
+	for node, keys := range groupMap {
+		node, keys := node, keys
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			var reply redis.Reply
+			defer func() {
+				// panic in goroutine can't be recovered by Exec
+				if err := recover(); err != nil {
+					logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+					reply = &protocol.UnknownErrReply{}
+				}
+				mu.Lock()
+				result[node] = reply
+				mu.Unlock()
+				<-workers
+				wg.Done()
+			}()
+			reply = fn(node, keys)
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// firstError returns the error replied by the first node in alphabetical order, so that the error replied to client
+// is stable. It returns empty node if no node failed
+func firstError(replies map[string]redis.Reply) (string, redis.Reply) {
+	nodes := make([]string, 0, len(replies))
+	for node := range replies {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		if protocol.IsErrorReply(replies[node]) {
+			return node, replies[node]
+		}
+	}
+	return "", nil
+}
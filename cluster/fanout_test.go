@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	groupMap := make(map[string][]string)
+	for i := 0; i < fanOutWorkers*2; i++ {
+		groupMap["node"+strconv.Itoa(i)] = []string{strconv.Itoa(i)}
+	}
+	var running, maxRunning int32
+	replies := fanOut(groupMap, func(node string, keys []string) redis.Reply {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if node == "node3" {
+			panic("mock panic")
+		}
+		return protocol.MakeBulkReply([]byte(keys[0]))
+	})
+	if len(replies) != len(groupMap) {
+		t.Fatalf("expect %d replies, actually %d", len(groupMap), len(replies))
+	}
+	if maxRunning > fanOutWorkers {
+		t.Errorf("at most %d nodes should be requested concurrently, actually %d", fanOutWorkers, maxRunning)
+	}
+	node, reply := firstError(replies)
+	if node != "node3" || !protocol.IsErrorReply(reply) {
+		t.Errorf("panic should be replied as error")
+	}
+}
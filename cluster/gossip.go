@@ -0,0 +1,425 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayGossip is sent to a peer with states of nodes known by sender, and the peer replies its known states.
+// format: _gossip sender current-epoch node state master epoch [node state master epoch ...],
+// reply: [current-epoch, node, state, master, epoch, ...]. master is "-" if node is a master itself
+const relayGossip = "_gossip"
+
+// gossipEntryLen is number of fields describing a node in gossip
+const gossipEntryLen = 4
+
+// states of node in gossip messages
+const (
+	nodeOk = "ok"
+	// nodePFail means node didn't reply in node timeout, it is possibly failed
+	nodePFail = "pfail"
+	// nodeFail means a majority of nodes agree that node is failed
+	nodeFail = "fail"
+)
+
+// gossipPeriod is the interval of gossip cron, it is a variable so that tests could shorten it
+var gossipPeriod = 100 * time.Millisecond
+
+const defaultNodeTimeout = 15 * time.Second
+
+// forgetTTL is how long a node removed by CLUSTER FORGET is not discovered again by gossip like redis cluster,
+// so it should be forgotten by all nodes within it
+const forgetTTL = 60 * time.Second
+
+// member is a peer known by gossip, its fields except pinging are guarded by gossip.mu
+type member struct {
+	addr string
+	// lastPing is when the latest gossip was sent to node
+	lastPing time.Time
+	// lastPong is when node replied or sent gossip, it is the creation time before the first one
+	lastPong time.Time
+	pfail    bool
+	fail     bool
+	// failReports is peer -> when it reported node as possibly failed or failed
+	failReports map[string]time.Time
+	// master is the node replicated by this node, it is empty if this node is a master
+	master string
+	// epoch is the config epoch of node, it increases when node is promoted by failover
+	epoch int64
+	// lastVoted is when this node voted for a replica of it to take over its slots
+	lastVoted time.Time
+	// pinging is 1 while gossip is being sent to node
+	pinging int32
+}
+
+// gossip exchanges states of nodes with a random peer periodically, so nodes are discovered from seeds in peers,
+// and a node not replying is marked as pfail then promoted to fail once a majority of nodes report it.
+type gossip struct {
+	mu          sync.Mutex
+	cluster     *Cluster
+	nodeTimeout time.Duration
+	members     map[string]*member
+	// forgotten is addr -> when node removed by CLUSTER FORGET could be discovered again
+	forgotten map[string]time.Time
+	// master is the node replicated by self, it is empty if self is a master
+	master string
+	// epoch is the config epoch of self, currentEpoch is the greatest epoch known in cluster
+	epoch        int64
+	currentEpoch int64
+	// lastVoteEpoch is the epoch in which self voted for a failover
+	lastVoteEpoch int64
+	// failoverAt is when self starts election after its master failed, zero if master is ok
+	failoverAt time.Time
+	// electing is 1 while self is asking for votes
+	electing int32
+	// send sends gossip to node and returns its reply, use a variable to allow injecting stub for testing
+	send   func(node string, cmdLine CmdLine) redis.Reply
+	closed chan struct{}
+}
+
+func makeGossip(cluster *Cluster) *gossip {
+	nodeTimeout := defaultNodeTimeout
+	if config.Properties().ClusterNodeTimeout > 0 {
+		nodeTimeout = time.Duration(config.Properties().ClusterNodeTimeout) * time.Millisecond
+	}
+	g := &gossip{
+		cluster:     cluster,
+		nodeTimeout: nodeTimeout,
+		members:     make(map[string]*member),
+		forgotten:   make(map[string]time.Time),
+		send:        cluster.sendBus,
+		closed:      make(chan struct{}),
+	}
+	for _, node := range cluster.getNodes() {
+		if node != cluster.self {
+			g.members[node] = makeMember(node)
+		}
+	}
+	return g
+}
+
+func makeMember(addr string) *member {
+	return &member{
+		addr:        addr,
+		lastPong:    time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func (g *gossip) start() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("panic", err)
+			}
+		}()
+		ticker := time.NewTicker(gossipPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.cron()
+			case <-g.closed:
+				return
+			}
+		}
+	}()
+}
+
+func (g *gossip) stop() {
+	close(g.closed)
+}
+
+func (g *gossip) cron() {
+	g.mu.Lock()
+	now := time.Now()
+	var targets []*member
+	// a random node is pinged every period, and nodes not pinged in half of node timeout are pinged
+	// so that failures are found in time
+	random := rand.Intn(len(g.members) + 1)
+	i := 0
+	for _, m := range g.members {
+		if i == random || now.Sub(m.lastPing) > g.nodeTimeout/2 {
+			targets = append(targets, m)
+		}
+		i++
+	}
+	g.mu.Unlock()
+	for _, m := range targets {
+		if !atomic.CompareAndSwapInt32(&m.pinging, 0, 1) {
+			continue
+		}
+		go func(m *member) {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Error(fmt.Sprintf("gossip with %s failed: %v\n%s", m.addr, err, string(debug.Stack())))
+				}
+				atomic.StoreInt32(&m.pinging, 0)
+			}()
+			g.ping(m.addr)
+		}(m)
+	}
+	g.checkFailures()
+	g.checkFailover()
+}
+
+// ping sends known states to node and merges states it replied
+func (g *gossip) ping(addr string) {
+	g.mu.Lock()
+	m, ok := g.members[addr]
+	if !ok {
+		g.mu.Unlock()
+		return
+	}
+	m.lastPing = time.Now()
+	cmdLine := [][]byte{[]byte(relayGossip), []byte(g.cluster.self), []byte(strconv.FormatInt(g.currentEpoch, 10))}
+	cmdLine = append(cmdLine, g.states()...)
+	g.mu.Unlock()
+
+	reply, ok := g.send(addr, cmdLine).(*protocol.MultiBulkReply)
+	if !ok || len(reply.Args) == 0 {
+		// node not replying is found by checkFailures
+		return
+	}
+	epoch, err := strconv.ParseInt(string(reply.Args[0]), 10, 64)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.alive(m)
+	g.merge(addr, epoch, reply.Args[1:])
+}
+
+// receive handles gossip from sender, and replies known states
+func (g *gossip) receive(sender string, epoch int64, states [][]byte) redis.Reply {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.members[sender]
+	if !ok {
+		if g.isForgotten(sender) {
+			return protocol.MakeErrReply("ERR node " + sender + " has been forgotten")
+		}
+		m = g.addMember(sender)
+	}
+	g.alive(m)
+	g.merge(sender, epoch, states)
+	result := append([][]byte{[]byte(strconv.FormatInt(g.currentEpoch, 10))}, g.states()...)
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// states returns entries of self and known nodes, invoker should hold g.mu
+func (g *gossip) states() [][]byte {
+	result := make([][]byte, 0, gossipEntryLen*(len(g.members)+1))
+	result = appendEntry(result, g.cluster.self, nodeOk, g.master, g.epoch)
+	for addr, m := range g.members {
+		result = appendEntry(result, addr, m.state(), m.master, m.epoch)
+	}
+	return result
+}
+
+func appendEntry(entries [][]byte, addr string, state string, master string, epoch int64) [][]byte {
+	if master == "" {
+		master = "-"
+	}
+	return append(entries, []byte(addr), []byte(state), []byte(master), []byte(strconv.FormatInt(epoch, 10)))
+}
+
+// merge records states reported by sender, unknown nodes are added to cluster, invoker should hold g.mu
+func (g *gossip) merge(sender string, currentEpoch int64, states [][]byte) {
+	if currentEpoch > g.currentEpoch {
+		g.currentEpoch = currentEpoch
+	}
+	now := time.Now()
+	for i := 0; i+gossipEntryLen <= len(states); i += gossipEntryLen {
+		addr, state, master := string(states[i]), string(states[i+1]), string(states[i+2])
+		epoch, err := strconv.ParseInt(string(states[i+3]), 10, 64)
+		if err != nil || addr == g.cluster.self || g.isForgotten(addr) {
+			continue
+		}
+		if master == "-" {
+			master = ""
+		}
+		m, known := g.members[addr]
+		if !known {
+			m = g.addMember(addr)
+		}
+		if epoch > g.currentEpoch {
+			g.currentEpoch = epoch
+		}
+		// sender knows itself best, states of other known nodes are accepted only if they are newer
+		if addr == sender || !known || epoch > m.epoch {
+			if master == "" && m.master != "" && epoch > g.epochOf(m.master) && g.cluster.meta == nil {
+				// replica has been promoted by failover, it is applied by raft log instead if raft is enabled
+				g.takeover(addr, m.master)
+			}
+			m.master = master
+			m.epoch = epoch
+		}
+		if addr == sender {
+			continue
+		}
+		if state == nodePFail || state == nodeFail {
+			m.failReports[sender] = now
+		} else {
+			delete(m.failReports, sender)
+		}
+	}
+}
+
+// epochOf returns config epoch of node, invoker should hold g.mu
+func (g *gossip) epochOf(node string) int64 {
+	if node == g.cluster.self {
+		return g.epoch
+	}
+	if m, ok := g.members[node]; ok {
+		return m.epoch
+	}
+	return 0
+}
+
+// masterOf returns the node replicated by node, it is empty if node is a master
+func (g *gossip) masterOf(node string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if node == g.cluster.self {
+		return g.master
+	}
+	if m, ok := g.members[node]; ok {
+		return m.master
+	}
+	return ""
+}
+
+// addMember adds node discovered by gossip, invoker should hold g.mu
+func (g *gossip) addMember(addr string) *member {
+	m := makeMember(addr)
+	g.members[addr] = m
+	if g.cluster.addNode(addr) {
+		logger.Info("discovered node " + addr)
+	}
+	return m
+}
+
+// isForgotten returns whether node has been forgotten recently, invoker should hold g.mu
+func (g *gossip) isForgotten(addr string) bool {
+	until, ok := g.forgotten[addr]
+	if ok && time.Now().After(until) {
+		delete(g.forgotten, addr)
+		return false
+	}
+	return ok
+}
+
+// meet adds node to members, it could be met again even if it has been forgotten
+func (g *gossip) meet(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.forgotten, addr)
+	if _, ok := g.members[addr]; !ok {
+		g.addMember(addr)
+	}
+}
+
+// forget removes node from members, and it is not discovered again by gossip in forgetTTL
+func (g *gossip) forget(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.members, addr)
+	for _, m := range g.members {
+		delete(m.failReports, addr)
+	}
+	g.forgotten[addr] = time.Now().Add(forgetTTL)
+}
+
+// alive marks node as reachable, invoker should hold g.mu
+func (g *gossip) alive(m *member) {
+	m.lastPong = time.Now()
+	if m.pfail || m.fail {
+		logger.Info("node " + m.addr + " is reachable again")
+	}
+	m.pfail = false
+	m.fail = false
+}
+
+// checkFailures marks nodes not replying in node timeout as pfail,
+// and promotes pfail to fail if a majority of nodes report it in twice node timeout
+func (g *gossip) checkFailures() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	quorum := (len(g.members)+1)/2 + 1
+	for addr, m := range g.members {
+		if !m.pfail && now.Sub(m.lastPong) > g.nodeTimeout {
+			m.pfail = true
+			logger.Warn("node " + addr + " is possibly failed")
+		}
+		if !m.pfail || m.fail {
+			continue
+		}
+		reports := 1 // self
+		for reporter, reportTime := range m.failReports {
+			if now.Sub(reportTime) > 2*g.nodeTimeout {
+				delete(m.failReports, reporter)
+				continue
+			}
+			reports++
+		}
+		if reports >= quorum {
+			m.fail = true
+			logger.Warn(fmt.Sprintf("node %s is failed, reported by %d nodes", addr, reports))
+		}
+	}
+}
+
+// state returns state of node, self and unknown nodes are ok
+func (g *gossip) state(node string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.members[node]
+	if !ok {
+		return nodeOk
+	}
+	return m.state()
+}
+
+func (m *member) state() string {
+	if m.fail {
+		return nodeFail
+	} else if m.pfail {
+		return nodePFail
+	}
+	return nodeOk
+}
+
+// nodeState returns state of node found by gossip, it is always ok if gossip is disabled
+func (cluster *Cluster) nodeState(node string) string {
+	if cluster.gossip == nil {
+		return nodeOk
+	}
+	return cluster.gossip.state(node)
+}
+
+// execGossip handles gossip from peer received by cluster bus
+func execGossip(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if cluster.gossip == nil {
+		return protocol.MakeErrReply("ERR gossip is disabled")
+	}
+	if len(args) < 3 || (len(args)-3)%gossipEntryLen != 0 {
+		return protocol.MakeArgNumErrReply(relayGossip)
+	}
+	epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return cluster.gossip.receive(string(args[1]), epoch, args[3:])
+}
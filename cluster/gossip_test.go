@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+func TestGossip(t *testing.T) {
+	addrA, addrB, addrC := "127.0.0.1:6501", "127.0.0.1:6502", "127.0.0.1:6503"
+	clusters := make(map[string]*Cluster)
+	down := make(map[string]bool)
+	send := func(node string, cmdLine CmdLine) redis.Reply {
+		if down[node] {
+			return protocol.MakeErrReply("connection refused")
+		}
+		return clusters[node].execBus(cmdLine)
+	}
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = "127.0.0.1:6399"
+			p.Peers = nil
+		})
+	}()
+	// A only knows B, and B only knows C
+	peers := map[string][]string{addrA: {addrB}, addrB: {addrC}, addrC: nil}
+	for _, addr := range []string{addrA, addrB, addrC} {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = addr
+			p.Peers = peers[addr]
+		})
+		cluster := MakeCluster()
+		defer cluster.Close()
+		cluster.gossip = makeGossip(cluster)
+		cluster.gossip.nodeTimeout = 50 * time.Millisecond
+		cluster.gossip.send = send
+		clusters[addr] = cluster
+	}
+	a, b, c := clusters[addrA].gossip, clusters[addrB].gossip, clusters[addrC].gossip
+
+	a.ping(addrB)
+	b.ping(addrC)
+	for addr, cluster := range clusters {
+		if n := len(cluster.getNodes()); n != 3 {
+			t.Errorf("%s should know 3 nodes, actually %d", addr, n)
+		}
+	}
+
+	down[addrC] = true
+	time.Sleep(100 * time.Millisecond)
+	a.ping(addrB)
+	a.checkFailures()
+	b.checkFailures()
+	if state := a.state(addrC); state != nodePFail {
+		t.Errorf("%s should be pfail, actually %s", addrC, state)
+	}
+	// failure reports are exchanged, and a majority of nodes agree
+	a.ping(addrB)
+	a.checkFailures()
+	b.checkFailures()
+	for _, g := range []*gossip{a, b} {
+		if state := g.state(addrC); state != nodeFail {
+			t.Errorf("%s should be fail, actually %s", addrC, state)
+		}
+	}
+	if state := a.state(addrB); state != nodeOk {
+		t.Errorf("%s should be ok, actually %s", addrB, state)
+	}
+	conn := &connection.FakeConn{}
+	result := clusters[addrA].relay(addrC, conn, toArgs("GET", "a"))
+	asserts.AssertErrReply(t, result, "CLUSTERDOWN The cluster is down")
+
+	down[addrC] = false
+	a.ping(addrC)
+	if state := a.state(addrC); state != nodeOk {
+		t.Errorf("%s should be ok after replying, actually %s", addrC, state)
+	}
+	if state := c.state(addrA); state != nodeOk {
+		t.Errorf("%s should be ok, actually %s", addrA, state)
+	}
+
+	result = testNodeA.execBus(toArgs(relayGossip, addrA, "0"))
+	asserts.AssertErrReply(t, result, "ERR gossip is disabled")
+	// inter-node commands are not served on client port
+	result = testNodeA.Exec(conn, toArgs(relayGossip, addrA, "0"))
+	asserts.AssertErrReply(t, result, "ERR unknown command '_gossip', or not supported in cluster mode")
+}
@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"bufio"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journal records tcc transactions of this node, so that transactions prepared but not finished before restart
+// are recovered instead of leaking. Records are multi bulk like aof:
+//
+//	prepare txID dbIndex cmd args...
+//	commit txID
+//	rollback txID
+//
+// Only prepare records are synced before replying, since a finished transaction recovered by a lost commit or
+// rollback record is rolled back by an undo log taken after restart, which changes nothing.
+type journal struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+	// pending is txID -> prepare record of transactions neither committed nor rolled back
+	pending map[string]CmdLine
+	// finished counts transactions finished since journal was truncated
+	finished int
+}
+
+const (
+	journalPrepare  = "prepare"
+	journalCommit   = "commit"
+	journalRollback = "rollback"
+	// journalTruncateThreshold is the count of finished transactions to truncate journal once none is pending
+	journalTruncateThreshold = 1024
+)
+
+// openJournal reads transactions pending in journal, and rewrites journal with them only
+func openJournal(filename string) (*journal, error) {
+	j := &journal{
+		filename: filename,
+		pending:  make(map[string]CmdLine),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) load() error {
+	file, err := os.Open(j.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for p := range parser.ParseStream(bufio.NewReader(file)) {
+		if p.Err != nil {
+			if p.Err == io.EOF {
+				break
+			}
+			// the last record may be truncated by crash, it hasn't been replied
+			logger.Warn("read tx journal " + j.filename + ": " + p.Err.Error())
+			continue
+		}
+		r, ok := p.Data.(*protocol.MultiBulkReply)
+		if !ok || len(r.Args) < 2 {
+			logger.Warn("illegal record in tx journal " + j.filename)
+			continue
+		}
+		txID := string(r.Args[1])
+		switch strings.ToLower(string(r.Args[0])) {
+		case journalPrepare:
+			if len(r.Args) < 4 {
+				logger.Warn("illegal record in tx journal " + j.filename)
+				continue
+			}
+			j.pending[txID] = r.Args
+		case journalCommit, journalRollback:
+			delete(j.pending, txID)
+		}
+	}
+	return nil
+}
+
+// rewrite replaces journal by prepare records of pending transactions, invoker should hold j.mu
+func (j *journal) rewrite() error {
+	tmpFile := j.filename + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	for _, record := range j.pending {
+		if _, err := file.Write(protocol.MakeMultiBulkReply(record).ToBytes()); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	_ = file.Close()
+	if err := os.Rename(tmpFile, j.filename); err != nil {
+		return err
+	}
+	appendFile, err := os.OpenFile(j.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+	}
+	j.file = appendFile
+	j.finished = 0
+	return nil
+}
+
+// prepare records transaction before it is replied as prepared
+func (j *journal) prepare(tx *Transaction) error {
+	record := make(CmdLine, 0, len(tx.cmdLine)+3)
+	record = append(record, []byte(journalPrepare), []byte(tx.id), []byte(strconv.Itoa(tx.dbIndex)))
+	record = append(record, tx.cmdLine...)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(protocol.MakeMultiBulkReply(record).ToBytes()); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.pending[tx.id] = record
+	return nil
+}
+
+// finish records transaction committed or rolled back, and truncates journal once no transaction is pending
+func (j *journal) finish(action string, txID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.pending[txID]; !ok {
+		return
+	}
+	delete(j.pending, txID)
+	j.finished++
+	if len(j.pending) == 0 && j.finished >= journalTruncateThreshold {
+		err := j.rewrite()
+		if err == nil {
+			return
+		}
+		logger.Warn("truncate tx journal failed: " + err.Error())
+	}
+	record := protocol.MakeMultiBulkReply(makeArgs(action, txID)).ToBytes()
+	if _, err := j.file.Write(record); err != nil {
+		logger.Warn("write tx journal failed: " + err.Error())
+	}
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_ = j.file.Close()
+}
+
+// recoverTransactions prepares transactions pending in journal again, so their keys are locked until coordinator
+// commits or rolls back them, or they are reaped after lockTime()
+func (cluster *Cluster) recoverTransactions() {
+	cluster.journal.mu.Lock()
+	records := make([]CmdLine, 0, len(cluster.journal.pending))
+	for _, record := range cluster.journal.pending {
+		records = append(records, record)
+	}
+	cluster.journal.mu.Unlock()
+	for _, record := range records {
+		dbIndex, err := strconv.Atoi(string(record[2]))
+		if err != nil {
+			logger.Warn("illegal db index in tx journal: " + string(record[2]))
+			continue
+		}
+		// recovered transaction is executed by cluster itself, it is authenticated like clients
+		conn := &connection.FakeConn{}
+		conn.SetPassword(config.Properties().RequirePass)
+		conn.SelectDB(dbIndex)
+		tx := NewTransaction(cluster, conn, string(record[1]), record[3:])
+		cluster.transactions.Put(tx.id, tx)
+		_ = tx.prepare()
+		logger.Info("recover transaction " + tx.id + " from journal")
+	}
+}
@@ -3,25 +3,77 @@ package cluster
 import (
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
 )
 
-// FlushDB removes all data in current database
+// FlushDB removes all data in current database of every master node. Flush is prepared on all nodes by tcc before
+// any node flushes, so it is aborted without data lost if any node is unavailable when it starts
 func FlushDB(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
-	replies := cluster.broadcast(c, args)
-	var errReply protocol.ErrorReply
-	for _, v := range replies {
-		if protocol.IsErrorReply(v) {
-			errReply = v.(protocol.ErrorReply)
-			break
+	if len(args) > 2 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	if len(args) == 2 {
+		mode := strings.ToUpper(string(args[1]))
+		if mode != "ASYNC" && mode != "SYNC" {
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	nodes := cluster.masterNodes()
+	groupMap := make(map[string][]string, len(nodes))
+	for _, node := range nodes {
+		groupMap[node] = nil
+	}
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	timeout := txTimeout(len(nodes))
+	cmdArgs := make([]string, len(args))
+	for i, arg := range args {
+		cmdArgs[i] = string(arg)
+	}
+	prepared := make(map[string]redis.Reply, len(nodes))
+	for _, node := range nodes {
+		resp := cluster.relayPrepare(node, c, makePrepareArgs(txIDStr, timeout, cmdArgs...))
+		prepared[node] = resp
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, c, txID, groupMap)
+			return protocol.MakeErrReply("ERR flush is aborted, " + formatNodeReplies(nodes, prepared))
 		}
 	}
-	if errReply == nil {
-		return &protocol.OkReply{}
+	// flush can't be undone, so commit is sent to every node even if some of them failed, nodes missed commit
+	// flush once their reaper learns the transaction is committed
+	cluster.decide(txIDStr, committedStatus)
+	committed := make(map[string]redis.Reply, len(nodes))
+	failed := false
+	for _, node := range nodes {
+		resp := cluster.sendTxPhase(node, c, makeArgs("commit", txIDStr))
+		committed[node] = resp
+		failed = failed || protocol.IsErrorReply(resp)
+	}
+	if failed {
+		return protocol.MakeErrReply("ERR flush is partially committed, " + formatNodeReplies(nodes, committed))
 	}
-	return protocol.MakeErrReply("error occurs: " + errReply.Error())
+	return &protocol.OkReply{}
 }
 
 // FlushAll removes all data in cluster
 func FlushAll(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	return FlushDB(cluster, c, args)
 }
+
+// formatNodeReplies describes reply of each node, nodes not requested yet are skipped
+func formatNodeReplies(nodes []string, replies map[string]redis.Reply) string {
+	results := make([]string, 0, len(replies))
+	for _, node := range nodes {
+		reply, ok := replies[node]
+		if !ok {
+			continue
+		}
+		result := "OK"
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			result = errReply.Error()
+		}
+		results = append(results, node+": "+result)
+	}
+	return strings.Join(results, ", ")
+}
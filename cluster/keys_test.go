@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestFlushDB(t *testing.T) {
+	conn := new(connection.FakeConn)
+	keyA, keyB := "flush", "flush"+testNodeB.self
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "b"))
+
+	// flush is aborted if any node is unavailable
+	*simulateBTimout = true
+	result := FlushDB(testNodeA, conn, utils.ToCmdLine("FLUSHDB"))
+	*simulateBTimout = false
+	asserts.AssertErrReply(t, result, "ERR flush is aborted, "+testNodeA.self+": OK, "+testNodeB.self+": ERR timeout")
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("GET", keyA))
+	asserts.AssertBulkReply(t, result, "a")
+
+	result = FlushDB(testNodeA, conn, utils.ToCmdLine("FLUSHDB", "FOO"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+
+	result = FlushDB(testNodeA, conn, utils.ToCmdLine("FLUSHDB", "SYNC"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("GET", keyA))
+	asserts.AssertNullBulk(t, result)
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("GET", keyB))
+	asserts.AssertNullBulk(t, result)
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"strconv"
+)
+
+// execMeet adds a node to cluster at runtime, the node is known by others through gossip if it is enabled,
+// otherwise it should be sent to every node.
+// usage: CLUSTER MEET ip port
+func execMeet(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 4 {
+		return protocol.MakeArgNumErrReply("cluster|meet")
+	}
+	port, err := strconv.Atoi(string(args[3]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.MakeErrReply("ERR Invalid node address specified: " + string(args[2]) + ":" + string(args[3]))
+	}
+	cluster.meet(net.JoinHostPort(string(args[2]), strconv.Itoa(port)))
+	return protocol.MakeOkReply()
+}
+
+// execForget removes a node from cluster at runtime, node is given by its id or address since ids are only shown
+// in slots mode. It should be sent to every node, otherwise the node is discovered again by gossip after a minute.
+// usage: CLUSTER FORGET node-id
+func execForget(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply("cluster|forget")
+	}
+	id := string(args[2])
+	node := ""
+	for _, n := range cluster.getNodes() {
+		if n == id || nodeID(n) == id {
+			node = n
+			break
+		}
+	}
+	if node == "" {
+		return protocol.MakeErrReply("ERR Unknown node " + id)
+	}
+	if node == cluster.self {
+		return protocol.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	if cluster.replicaOf(cluster.self) == node {
+		return protocol.MakeErrReply("ERR Can't forget my master!")
+	}
+	// slots assigned explicitly would be unassigned, while slots divided evenly are divided again among the others
+	if slots, ok := cluster.peerPicker.(*slotmap.Map); ok && slots.Assigned() && len(slots.GetNodeSlots(node)) > 0 {
+		return protocol.MakeErrReply("ERR Can't forget node " + id + " which still serves slots")
+	}
+	cluster.forget(node)
+	return protocol.MakeOkReply()
+}
+
+// meet adds node to routing and gossip
+func (cluster *Cluster) meet(node string) {
+	if node == cluster.self {
+		return
+	}
+	if cluster.gossip != nil {
+		cluster.gossip.meet(node)
+	} else if cluster.addNode(node) {
+		logger.Info("met node " + node)
+	}
+}
+
+// forget removes node from routing and gossip, relays in flight to it are finished before connections are closed
+func (cluster *Cluster) forget(node string) {
+	if cluster.gossip != nil {
+		cluster.gossip.forget(node)
+	}
+	if cluster.removeNode(node) {
+		logger.Info("forgot node " + node)
+	}
+}
+
+// ReloadPeers applies peers of reloaded config without restart, new peers are added and nodes not in peers are
+// removed. Nodes are not removed if gossip is enabled, since peers are only seeds of nodes discovered by gossip
+func (cluster *Cluster) ReloadPeers(peers []string) {
+	expected := map[string]struct{}{cluster.self: {}}
+	for _, peer := range peers {
+		expected[peer] = struct{}{}
+		cluster.meet(peer)
+	}
+	if cluster.gossip != nil {
+		return
+	}
+	for _, node := range cluster.getNodes() {
+		if _, ok := expected[node]; !ok {
+			cluster.forget(node)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMeetForget(t *testing.T) {
+	addrB, addrC := "127.0.0.1:6542", "127.0.0.1:6543"
+	cluster := MakeTestCluster(nil)
+	defer cluster.Close()
+	conn := &connection.FakeConn{}
+	result := cluster.Exec(conn, toArgs("CLUSTER", "MEET", "127.0.0.1", "6542"))
+	asserts.AssertStatusReply(t, result, "OK")
+	if nodes := cluster.getNodes(); len(nodes) != 2 {
+		t.Fatalf("expect 2 nodes after meet, actually %v", nodes)
+	}
+	if _, ok := cluster.getPeerConns(addrB); !ok {
+		t.Errorf("connections to %s should be created", addrB)
+	}
+	result = cluster.Exec(conn, toArgs("CLUSTER", "MEET", "127.0.0.1", "abc"))
+	asserts.AssertErrReply(t, result, "ERR Invalid node address specified: 127.0.0.1:abc")
+
+	result = cluster.Exec(conn, toArgs("CLUSTER", "FORGET", nodeID(addrB)))
+	asserts.AssertStatusReply(t, result, "OK")
+	if nodes := cluster.getNodes(); len(nodes) != 1 || nodes[0] != cluster.self {
+		t.Fatalf("expect only self after forget, actually %v", nodes)
+	}
+	if node := cluster.peerPicker.PickNode("foo"); node != cluster.self {
+		t.Errorf("keys should be served by self after forget, actually %s", node)
+	}
+	result = cluster.Exec(conn, toArgs("CLUSTER", "FORGET", addrB))
+	asserts.AssertErrReply(t, result, "ERR Unknown node "+addrB)
+	result = cluster.Exec(conn, toArgs("CLUSTER", "FORGET", cluster.self))
+	asserts.AssertErrReply(t, result, "ERR I tried hard but I can't forget myself...")
+
+	cluster.ReloadPeers([]string{addrB, addrC})
+	cluster.ReloadPeers([]string{addrC})
+	nodes := cluster.getNodes()
+	sort.Strings(nodes)
+	if strings.Join(nodes, ",") != strings.Join([]string{cluster.self, addrC}, ",") {
+		t.Errorf("expect nodes %s %s after reload, actually %v", cluster.self, addrC, nodes)
+	}
+}
+
+func TestForgetSlotOwner(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{"127.0.0.1:6399 0-8191", "127.0.0.1:6400 8192-16383"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+		})
+	}()
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400", "127.0.0.1:6401"})
+	defer cluster.Close()
+	conn := &connection.FakeConn{}
+	// slots must be reassigned before their owner is forgotten
+	result := cluster.Exec(conn, toArgs("CLUSTER", "FORGET", nodeID("127.0.0.1:6400")))
+	asserts.AssertErrReply(t, result, "ERR Can't forget node "+nodeID("127.0.0.1:6400")+" which still serves slots")
+	result = cluster.Exec(conn, toArgs("CLUSTER", "FORGET", nodeID("127.0.0.1:6401")))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = cluster.Exec(conn, toArgs("CLUSTER", "NODES"))
+	if strings.Contains(string(result.ToBytes()), "127.0.0.1:6401") {
+		t.Errorf("forgotten node should not be listed, actually %s", result.ToBytes())
+	}
+}
+
+func TestForgetWithGossip(t *testing.T) {
+	addrA, addrB, addrC := "127.0.0.1:6551", "127.0.0.1:6552", "127.0.0.1:6553"
+	clusters := make(map[string]*Cluster)
+	send := func(node string, cmdLine CmdLine) redis.Reply {
+		return clusters[node].execBus(cmdLine)
+	}
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = "127.0.0.1:6399"
+			p.Peers = nil
+		})
+	}()
+	peers := map[string][]string{addrA: {addrB, addrC}, addrB: {addrA, addrC}, addrC: {addrA, addrB}}
+	for _, addr := range []string{addrA, addrB, addrC} {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = addr
+			p.Peers = peers[addr]
+		})
+		cluster := MakeCluster()
+		defer cluster.Close()
+		cluster.gossip = makeGossip(cluster)
+		cluster.gossip.send = send
+		clusters[addr] = cluster
+	}
+	a := clusters[addrA]
+	conn := &connection.FakeConn{}
+	result := a.Exec(conn, toArgs("CLUSTER", "FORGET", addrC))
+	asserts.AssertStatusReply(t, result, "OK")
+	// forgotten node is not discovered again from peers which still know it
+	a.gossip.ping(addrB)
+	if nodes := a.getNodes(); len(nodes) != 2 {
+		t.Errorf("forgotten node should not be discovered by gossip, actually %v", nodes)
+	}
+	clusters[addrC].gossip.ping(addrA)
+	if nodes := a.getNodes(); len(nodes) != 2 {
+		t.Errorf("gossip from forgotten node should be refused, actually %v", nodes)
+	}
+
+	// forgotten node could be met again
+	result = a.Exec(conn, toArgs("CLUSTER", "MEET", "127.0.0.1", "6553"))
+	asserts.AssertStatusReply(t, result, "OK")
+	if nodes := a.getNodes(); len(nodes) != 3 {
+		t.Errorf("expect 3 nodes after meet, actually %v", nodes)
+	}
+}
@@ -0,0 +1,241 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/raft"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relayRaft carries raft requests among nodes through cluster bus.
+// format: _raft vote|append|propose payload, vote and append reply [json response], propose replies [index]
+const relayRaft = "_raft"
+
+// proposeTimeout is the max time waiting for a metadata change to be committed
+const proposeTimeout = 5 * time.Second
+
+// kinds of metadata change
+const (
+	// metaAssign assigns slots in [Begin, End] to Node
+	metaAssign = "assign"
+	// metaReplicate makes Node a replica of Target
+	metaReplicate = "replicate"
+	// metaTakeover makes Node take over slots of its failed master Target in Epoch
+	metaTakeover = "takeover"
+)
+
+// metaChange is a change of cluster metadata replicated by raft, every node applies them in the same order
+type metaChange struct {
+	Kind   string `json:"kind"`
+	Node   string `json:"node"`
+	Target string `json:"target,omitempty"`
+	Begin  int    `json:"begin,omitempty"`
+	End    int    `json:"end,omitempty"`
+	Epoch  int64  `json:"epoch,omitempty"`
+}
+
+// metadata replicates changes of cluster metadata by raft, raft requests are sent through cluster bus
+type metadata struct {
+	raft *raft.Node
+	// send sends request to bus of node, use a variable to allow injecting stub for testing
+	send func(node string, cmdLine CmdLine) redis.Reply
+}
+
+func (meta *metadata) call(peer string, kind string, req interface{}, resp interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	reply := meta.send(peer, [][]byte{[]byte(relayRaft), []byte(kind), payload})
+	if errReply, ok := reply.(protocol.ErrorReply); ok {
+		return errors.New(errReply.Error())
+	}
+	result, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(result.Args) != 1 {
+		return errors.New("illegal raft reply")
+	}
+	return json.Unmarshal(result.Args[0], resp)
+}
+
+// RequestVote implements raft.Transport
+func (meta *metadata) RequestVote(peer string, req *raft.VoteRequest) (*raft.VoteResponse, error) {
+	resp := &raft.VoteResponse{}
+	if err := meta.call(peer, "vote", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// AppendEntries implements raft.Transport
+func (meta *metadata) AppendEntries(peer string, req *raft.AppendRequest) (*raft.AppendResponse, error) {
+	resp := &raft.AppendResponse{}
+	if err := meta.call(peer, "append", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// makeMetadata restores raft log of metadata, voters are nodes in config, nodes discovered later are not voters
+func (cluster *Cluster) makeMetadata(send func(node string, cmdLine CmdLine) redis.Reply) (*metadata, error) {
+	var peers []string
+	for _, node := range cluster.getNodes() {
+		if node != cluster.self {
+			peers = append(peers, node)
+		}
+	}
+	file := config.Properties().ClusterRaftFile
+	if file == "" {
+		_, port := splitAddr(cluster.self)
+		file = "cluster-raft-" + strconv.Itoa(port) + ".json"
+	}
+	meta := &metadata{send: send}
+	node, err := raft.Make(&raft.Config{
+		ID:        cluster.self,
+		Peers:     peers,
+		File:      file,
+		Transport: meta,
+		Apply:     cluster.applyMeta,
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta.raft = node
+	return meta, nil
+}
+
+// proposeMeta commits change by raft, change is forwarded to leader if self is a follower.
+// It replies OK after change is applied on this node
+func (cluster *Cluster) proposeMeta(change *metaChange) redis.Reply {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	node := cluster.meta.raft
+	_, err = node.Propose(data, proposeTimeout)
+	if err == nil {
+		return protocol.MakeOkReply()
+	}
+	if err != raft.ErrNotLeader {
+		return protocol.MakeErrReply("ERR propose failed: " + err.Error())
+	}
+	leader := node.Leader()
+	if leader == "" {
+		return protocol.MakeErrReply("CLUSTERDOWN cluster metadata is unavailable, no raft leader")
+	}
+	reply := cluster.meta.send(leader, [][]byte{[]byte(relayRaft), []byte("propose"), data})
+	if protocol.IsErrorReply(reply) {
+		return reply
+	}
+	result, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(result.Args) != 1 {
+		return protocol.MakeErrReply("ERR illegal reply of raft leader")
+	}
+	index, err := strconv.ParseUint(string(result.Args[0]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal reply of raft leader")
+	}
+	if err := node.WaitApplied(index, proposeTimeout); err != nil {
+		return protocol.MakeErrReply("ERR propose failed: " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// applyMeta applies committed change of metadata
+func (cluster *Cluster) applyMeta(entry *raft.Entry) {
+	change := &metaChange{}
+	if err := json.Unmarshal(entry.Data, change); err != nil {
+		logger.Error("illegal metadata change " + string(entry.Data) + ": " + err.Error())
+		return
+	}
+	slots, ok := cluster.peerPicker.(*slotmap.Map)
+	if !ok {
+		return
+	}
+	switch change.Kind {
+	case metaAssign:
+		if err := slots.Assign(change.Node, change.Begin, change.End); err != nil {
+			logger.Error("apply metadata change failed: " + err.Error())
+		}
+	case metaReplicate:
+		cluster.applyReplicate(change.Node, change.Target)
+	case metaTakeover:
+		g := cluster.gossip
+		if g == nil {
+			return
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if change.Node == cluster.self {
+			g.epoch = change.Epoch
+		} else if m, ok := g.members[change.Node]; ok {
+			m.epoch = change.Epoch
+		}
+		if change.Epoch > g.currentEpoch {
+			g.currentEpoch = change.Epoch
+		}
+		g.takeover(change.Node, change.Target)
+	}
+}
+
+// applyReplicate records replication of node, and self starts replicating if it is the node
+func (cluster *Cluster) applyReplicate(node string, master string) {
+	if g := cluster.gossip; g != nil {
+		g.mu.Lock()
+		if node == cluster.self {
+			g.master = master
+		} else if m, ok := g.members[node]; ok {
+			m.master = master
+		}
+		g.mu.Unlock()
+	}
+	if node == cluster.self {
+		host, port := splitAddr(master)
+		cluster.execInternal(utils.ToCmdLine("replicaof", host, strconv.Itoa(port)))
+	}
+}
+
+// execRaft handles raft requests received by cluster bus
+func execRaft(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if cluster.meta == nil {
+		return protocol.MakeErrReply("ERR raft is disabled")
+	}
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply(relayRaft)
+	}
+	var resp interface{}
+	switch strings.ToLower(string(args[1])) {
+	case "vote":
+		req := &raft.VoteRequest{}
+		if err := json.Unmarshal(args[2], req); err != nil {
+			return protocol.MakeErrReply("ERR illegal raft request: " + err.Error())
+		}
+		resp = cluster.meta.raft.HandleRequestVote(req)
+	case "append":
+		req := &raft.AppendRequest{}
+		if err := json.Unmarshal(args[2], req); err != nil {
+			return protocol.MakeErrReply("ERR illegal raft request: " + err.Error())
+		}
+		resp = cluster.meta.raft.HandleAppendEntries(req)
+	case "propose":
+		index, err := cluster.meta.raft.Propose(args[2], proposeTimeout)
+		if err != nil {
+			return protocol.MakeErrReply("ERR propose failed: " + err.Error())
+		}
+		return protocol.MakeMultiBulkReply([][]byte{[]byte(strconv.FormatUint(index, 10))})
+	default:
+		return protocol.MakeErrReply("ERR unknown raft request " + string(args[1]))
+	}
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeMultiBulkReply([][]byte{payload})
+}
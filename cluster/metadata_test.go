@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	addrA, addrB, addrC := "127.0.0.1:6541", "127.0.0.1:6542", "127.0.0.1:6543"
+	all := []string{addrA, addrB, addrC}
+	dir := t.TempDir()
+	clusters := make(map[string]*Cluster)
+	var mu sync.Mutex
+	down := make(map[string]bool)
+	send := func(node string, cmdLine CmdLine) redis.Reply {
+		mu.Lock()
+		cluster, isDown := clusters[node], down[node]
+		mu.Unlock()
+		if isDown || cluster.meta == nil {
+			return protocol.MakeErrReply("connection refused")
+		}
+		return cluster.execBus(cmdLine)
+	}
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{addrA + " 0-5460", addrB + " 5461-10922", addrC + " 10923-16383"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+			p.ClusterRaftFile = ""
+			p.Self = "127.0.0.1:6399"
+			p.Peers = nil
+		})
+	}()
+	for _, addr := range all {
+		config.Update(func(p *config.ServerProperties) {
+			p.Self = addr
+			p.Peers = nil
+			for _, peer := range all {
+				if peer != addr {
+					p.Peers = append(p.Peers, peer)
+				}
+			}
+		})
+		cluster := MakeCluster()
+		defer cluster.Close()
+		clusters[addr] = cluster
+	}
+	start := func(addr string) {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterRaftFile = filepath.Join(dir, addr+".json")
+		})
+		meta, err := clusters[addr].makeMetadata(send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		clusters[addr].meta = meta
+		mu.Unlock()
+		meta.raft.Start()
+	}
+	for _, addr := range all {
+		start(addr)
+	}
+	var leader string
+	for i := 0; i < 200 && leader == ""; i++ {
+		for _, addr := range all {
+			if clusters[addr].meta.raft.IsLeader() {
+				leader = addr
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if leader == "" {
+		t.Fatal("no raft leader elected")
+	}
+	var follower string
+	for _, addr := range all {
+		if addr != leader {
+			follower = addr
+			break
+		}
+	}
+
+	// change proposed by follower is forwarded to leader, and applied by all nodes
+	conn := &connection.FakeConn{}
+	result := clusters[follower].Exec(conn, toArgs("CLUSTER", "SETSLOT", "0", "NODE", nodeID(addrB)))
+	asserts.AssertStatusReply(t, result, "OK")
+	if owner := clusters[follower].peerPicker.(*slotmap.Map).GetSlotNode(0); owner != addrB {
+		t.Errorf("slot 0 should be served by %s once SETSLOT returns, actually %s", addrB, owner)
+	}
+	waitOwner := func(addr string, slot int, expected string) {
+		slots := clusters[addr].peerPicker.(*slotmap.Map)
+		for i := 0; i < 200 && slots.GetSlotNode(slot) != expected; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if owner := slots.GetSlotNode(slot); owner != expected {
+			t.Errorf("slot %d should be served by %s on %s, actually %s", slot, expected, addr, owner)
+		}
+	}
+	for _, addr := range all {
+		waitOwner(addr, 0, addrB)
+	}
+
+	// restarted node restores its view of metadata from raft log
+	clusters[follower].meta.raft.Close()
+	clusters[follower].peerPicker = makeSlotMap(clusters[follower].getNodes())
+	start(follower)
+	waitOwner(follower, 0, addrB)
+
+	// change isn't accepted without a majority
+	mu.Lock()
+	for _, addr := range all {
+		down[addr] = addr != follower
+	}
+	mu.Unlock()
+	result = clusters[follower].Exec(conn, toArgs("CLUSTER", "SETSLOT", "1", "NODE", nodeID(addrB)))
+	if !protocol.IsErrorReply(result) {
+		t.Errorf("expect error without raft majority, actually %s", result.ToBytes())
+	}
+	if owner := clusters[follower].peerPicker.(*slotmap.Map).GetSlotNode(1); owner != addrA {
+		t.Errorf("slot 1 should still be served by %s, actually %s", addrA, owner)
+	}
+}
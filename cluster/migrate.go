@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// execMigrate moves keys to another node by DUMP and RESTORE-ASKING, keys are removed locally unless COPY is given.
+// Keys of a migrating slot are moved one by one, and the importing node accepts them before it owns the slot.
+// usage: MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [KEYS key [key ...]]
+func execMigrate(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 6 {
+		return protocol.MakeArgNumErrReply("migrate")
+	}
+	addr := net.JoinHostPort(string(args[1]), string(args[2]))
+	dbIndex, err := strconv.Atoi(string(args[4]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if _, err := strconv.ParseInt(string(args[5]), 10, 64); err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	var keys []string
+	if len(args[3]) > 0 {
+		keys = append(keys, string(args[3]))
+	}
+	copyKeys, replace := false, false
+	password := peerPassword()
+	for i := 6; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			password = string(args[i+1])
+			i++
+		case "KEYS":
+			if len(keys) > 0 {
+				return protocol.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(args)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if len(keys) == 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+
+	// dump keys before connecting, missing keys are skipped
+	var restoreCmds [][][]byte
+	var migrated []string
+	for _, key := range keys {
+		payload, ok := cluster.db.Exec(c, utils.ToCmdLine("DUMP", key)).(*protocol.BulkReply)
+		if !ok || payload.Arg == nil {
+			continue
+		}
+		ttl := int64(0)
+		if pttl, ok := cluster.db.Exec(c, utils.ToCmdLine("PTTL", key)).(*protocol.IntReply); ok && pttl.Code > 0 {
+			ttl = pttl.Code
+		}
+		cmdLine := utils.ToCmdLine("RESTORE-ASKING", key, strconv.FormatInt(ttl, 10))
+		cmdLine = append(cmdLine, payload.Arg)
+		if replace {
+			cmdLine = append(cmdLine, []byte("REPLACE"))
+		}
+		restoreCmds = append(restoreCmds, cmdLine)
+		migrated = append(migrated, key)
+	}
+	if len(migrated) == 0 {
+		return protocol.MakeStatusReply("NOKEY")
+	}
+
+	target, err := client.MakeClient(addr)
+	if err != nil {
+		return protocol.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	target.Start()
+	defer target.Close()
+	if password != "" {
+		if reply := target.Send(utils.ToCmdLine("AUTH", password)); protocol.IsErrorReply(reply) {
+			return protocol.MakeErrReply("ERR Target instance replied with error: " + reply.(protocol.ErrorReply).Error())
+		}
+	}
+	if reply := target.Send(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))); protocol.IsErrorReply(reply) {
+		return protocol.MakeErrReply("ERR Target instance replied with error: " + reply.(protocol.ErrorReply).Error())
+	}
+	for i, cmdLine := range restoreCmds {
+		reply := target.Send(cmdLine)
+		if protocol.IsErrorReply(reply) {
+			// keys restored before the error are removed, so they are served by the target node
+			cluster.removeMigrated(c, migrated[:i], copyKeys)
+			return protocol.MakeErrReply("ERR Target instance replied with error: " + reply.(protocol.ErrorReply).Error())
+		}
+	}
+	cluster.removeMigrated(c, migrated, copyKeys)
+	return protocol.MakeOkReply()
+}
+
+func (cluster *Cluster) removeMigrated(c redis.Connection, keys []string, copyKeys bool) {
+	if copyKeys || len(keys) == 0 {
+		return
+	}
+	cluster.db.Exec(c, utils.ToCmdLine2("DEL", keys...))
+}
+
+// execRestoreAsking is RESTORE sent by MIGRATE, it is accepted by the node importing the slot of key
+func execRestoreAsking(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdLine := append([][]byte{[]byte(relayAsking), []byte("RESTORE")}, args[1:]...)
+	return execRelayedAsking(cluster, c, cmdLine)
+}
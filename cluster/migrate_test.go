@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestMigrateSlot(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addrA, addrB := "127.0.0.1:6399", listener.Addr().String()
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{addrA + " 0-16383"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+			p.ClusterRedirect = false
+		})
+	}()
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = addrB
+		p.Peers = []string{addrA}
+	})
+	nodeB := MakeCluster()
+	defer nodeB.Close()
+	nodeA := MakeTestCluster([]string{addrB})
+	defer nodeA.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				client := connection.NewConn(conn)
+				for payload := range parser.ParseStream(conn) {
+					if r, ok := payload.Data.(*protocol.MultiBulkReply); ok {
+						_ = client.Write(nodeB.Exec(client, r.Args).ToBytes())
+					}
+				}
+				nodeB.AfterClientClose(client)
+			}()
+		}
+	}()
+
+	conn := &connection.FakeConn{}
+	nodeA.Exec(conn, utils.ToCmdLine("set", "{s}1", "v1"))
+	nodeA.Exec(conn, utils.ToCmdLine("set", "{s}2", "v2"))
+	slot := strconv.Itoa(slotmap.HashSlot("s"))
+	hostB, portB, _ := net.SplitHostPort(addrB)
+	result := nodeA.Exec(conn, utils.ToCmdLine("cluster", "setslot", slot, "importing", nodeID(addrB)))
+	asserts.AssertErrReply(t, result, "ERR I'm already the owner of hash slot "+slot)
+	result = nodeB.Exec(conn, utils.ToCmdLine("cluster", "setslot", slot, "importing", nodeID(addrA)))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = nodeA.Exec(conn, utils.ToCmdLine("cluster", "setslot", slot, "migrating", nodeID(addrB)))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = nodeA.Exec(conn, utils.ToCmdLine("migrate", hostB, portB, "", "0", "1000", "keys", "{s}1", "{s}3"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = nodeA.Exec(conn, utils.ToCmdLine("migrate", hostB, portB, "{s}3", "0", "1000"))
+	asserts.AssertStatusReply(t, result, "NOKEY")
+
+	// migrated keys are still accessible while migrating
+	asserts.AssertBulkReply(t, nodeA.Exec(conn, utils.ToCmdLine("get", "{s}1")), "v1")
+	asserts.AssertBulkReply(t, nodeA.Exec(conn, utils.ToCmdLine("get", "{s}2")), "v2")
+	result = nodeA.Exec(conn, utils.ToCmdLine("mget", "{s}1", "{s}2"))
+	asserts.AssertErrReply(t, result, "TRYAGAIN Multiple keys request during rehashing of slot")
+
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterRedirect = true
+	})
+	result = nodeA.Exec(conn, utils.ToCmdLine("get", "{s}1"))
+	asserts.AssertErrReply(t, result, "ASK "+slot+" "+addrB)
+	result = nodeB.Exec(conn, utils.ToCmdLine("get", "{s}1"))
+	asserts.AssertErrReply(t, result, "MOVED "+slot+" "+addrA)
+	asserts.AssertStatusReply(t, nodeB.Exec(conn, utils.ToCmdLine("asking")), "OK")
+	asserts.AssertBulkReply(t, nodeB.Exec(conn, utils.ToCmdLine("get", "{s}1")), "v1")
+	// ASKING only affects the next command
+	result = nodeB.Exec(conn, utils.ToCmdLine("get", "{s}1"))
+	asserts.AssertErrReply(t, result, "MOVED "+slot+" "+addrA)
+
+	result = nodeA.Exec(conn, utils.ToCmdLine("migrate", hostB, portB, "{s}2", "0", "1000"))
+	asserts.AssertStatusReply(t, result, "OK")
+	for _, node := range []*Cluster{nodeA, nodeB} {
+		result = node.Exec(conn, utils.ToCmdLine("cluster", "setslot", slot, "node", nodeID(addrB)))
+		asserts.AssertStatusReply(t, result, "OK")
+	}
+	result = nodeA.Exec(conn, utils.ToCmdLine("get", "{s}2"))
+	asserts.AssertErrReply(t, result, "MOVED "+slot+" "+addrB)
+	asserts.AssertBulkReply(t, nodeB.Exec(conn, utils.ToCmdLine("get", "{s}2")), "v2")
+	if nodeB.peerPicker.(*slotmap.Map).GetImporting(slotmap.HashSlot("s")) != "" {
+		t.Error("slot should be stable after assigned")
+	}
+}
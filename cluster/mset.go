@@ -25,13 +25,16 @@ func MGet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	// 计算每个 key 所在的节点，并按照节点分组  map[peer] []keys
 	groupMap := cluster.groupBy(keys)
 
-	for peer, group := range groupMap {
-		resp := cluster.relay(peer, c, makeArgs("MGET", group...))
-		if protocol.IsErrorReply(resp) {
-			// 若某个节点出错，则直接 return ，退出整个 MGET 操作，可以保证原子性
-			errReply := resp.(protocol.ErrorReply)
-			return protocol.MakeErrReply(fmt.Sprintf("ERR during get %s occurs: %v", group[0], errReply.Error()))
-		}
+	replies := fanOut(groupMap, func(peer string, group []string) redis.Reply {
+		return cluster.relay(peer, c, makeArgs("MGET", group...))
+	})
+	if peer, resp := firstError(replies); resp != nil {
+		// 若某个节点出错，则直接 return ，退出整个 MGET 操作，可以保证原子性
+		errReply := resp.(protocol.ErrorReply)
+		return protocol.MakeErrReply(fmt.Sprintf("ERR during get %s occurs: %v", groupMap[peer][0], errReply.Error()))
+	}
+	for peer, resp := range replies {
+		group := groupMap[peer]
 		arrReply, _ := resp.(*protocol.MultiBulkReply)
 		for i, v := range arrReply.Args {
 			key := group[i]
@@ -74,25 +77,19 @@ func MSet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for peer, group := range groupMap {
-		peerArgs := []string{txIDStr, "MSET"}
+	timeout := txTimeout(len(groupMap))
+	replies := fanOut(groupMap, func(peer string, group []string) redis.Reply {
+		peerArgs := []string{"MSET"}
 		for _, k := range group {
 			peerArgs = append(peerArgs, k, valueMap[k])
 		}
-		// peerArgs: [事务id, MSET, key1, value1, key2, value2]
-		var resp redis.Reply
-		if peer == cluster.self {
-			// 在本节点上的key， 进行prepare（注意，并不是commit）
-			resp = execPrepare(cluster, c, makeArgs("Prepare", peerArgs...))
-		} else {
-			// 在集群结点上的key
-			resp = cluster.relay(peer, c, makeArgs("Prepare", peerArgs...))
-		}
-		if protocol.IsErrorReply(resp) {
-			errReply = resp
-			rollback = true
-			break
-		}
+		// peerArgs: [MSET, key1, value1, key2, value2]
+		// 在本节点上的key， 进行prepare（注意，并不是commit）
+		return cluster.relayPrepare(peer, c, makePrepareArgs(txIDStr, timeout, peerArgs...))
+	})
+	if _, resp := firstError(replies); resp != nil {
+		errReply = resp
+		rollback = true
 	}
 	if rollback {
 		// 若 prepare 过程出错则执行回滚
@@ -138,23 +135,25 @@ func MSetNX(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for node, group := range groupMap {
-		nodeArgs := []string{txIDStr, "MSETNX"}
+	timeout := txTimeout(len(groupMap))
+	replies := fanOut(groupMap, func(node string, group []string) redis.Reply {
+		nodeArgs := []string{"MSETNX"}
 		for _, k := range group {
 			nodeArgs = append(nodeArgs, k, valueMap[k])
 		}
-		resp := cluster.relayPrepare(node, c, makeArgs("Prepare", nodeArgs...))
-		if protocol.IsErrorReply(resp) {
-			re := resp.(protocol.ErrorReply)
-			if re.Error() == keyExistsErr {
-				errReply = protocol.MakeIntReply(0)
-			} else {
-				errReply = resp
-			}
+		return cluster.relayPrepare(node, c, makePrepareArgs(txIDStr, timeout, nodeArgs...))
+	})
+	for _, resp := range replies {
+		if re, ok := resp.(protocol.ErrorReply); ok && re.Error() == keyExistsErr {
+			errReply = protocol.MakeIntReply(0)
 			rollback = true
 			break
 		}
 	}
+	if _, resp := firstError(replies); resp != nil && !rollback {
+		errReply = resp
+		rollback = true
+	}
 	if rollback {
 		// rollback
 		requestRollback(cluster, c, txID, groupMap)
@@ -194,3 +193,30 @@ func prepareMSetNx(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) red
 func init() {
 	registerPrepareFunc("MSetNx", prepareMSetNx)
 }
+
+// Exists returns count of given keys existing in cluster, keys could be distributed on any node
+func Exists(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply(string(cmdLine[0]))
+	}
+	keys := make([]string, len(cmdLine)-1)
+	for i := 1; i < len(cmdLine); i++ {
+		keys[i-1] = string(cmdLine[i])
+	}
+	groupMap := cluster.groupBy(keys)
+	replies := fanOut(groupMap, func(peer string, group []string) redis.Reply {
+		return cluster.relay(peer, c, makeArgs("EXISTS", group...))
+	})
+	if _, resp := firstError(replies); resp != nil {
+		return resp
+	}
+	var count int64
+	for _, resp := range replies {
+		intReply, ok := resp.(*protocol.IntReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR illegal reply of EXISTS")
+		}
+		count += intReply.Code
+	}
+	return protocol.MakeIntReply(count)
+}
@@ -26,3 +26,23 @@ func TestMSetNx(t *testing.T) {
 	ret = testNodeA.Exec(conn, toArgs("MGET", "a", "b", "c"))
 	asserts.AssertMultiBulkReply(t, ret, []string{"a", "b", ""})
 }
+
+func TestMultiKeysAcrossNodes(t *testing.T) {
+	conn := &connection.FakeConn{}
+	keyA, keyB := "multi-keys", "multi-keys"+testNodeB.self
+	ret := MSet(testNodeA, conn, toArgs("MSET", keyA, "a", keyB, "b"))
+	asserts.AssertNotError(t, ret)
+	ret = MGet(testNodeA, conn, toArgs("MGET", keyB, "none", keyA))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b", "", "a"})
+	ret = Exists(testNodeA, conn, toArgs("EXISTS", keyA, keyB, keyB, "none"))
+	asserts.AssertIntReply(t, ret, 3)
+	ret = Del(testNodeA, conn, toArgs("DEL", keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = Exists(testNodeA, conn, toArgs("EXISTS", keyA, keyB))
+	asserts.AssertIntReply(t, ret, 0)
+
+	*simulateBTimout = true
+	ret = Exists(testNodeA, conn, toArgs("EXISTS", keyA, keyB))
+	*simulateBTimout = false
+	asserts.AssertErrReply(t, ret, "ERR timeout")
+}
@@ -1,11 +1,13 @@
 package cluster
 
 import (
+	"errors"
 	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 const relayMulti = "_multi"
@@ -18,8 +20,18 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	if !conn.InMultiState() {
 		return protocol.MakeErrReply("ERR EXEC without MULTI")
 	}
-	defer conn.SetMultiState(false)
 	cmdLines := conn.GetQueuedCmdLine()
+	watching := conn.GetWatching()
+	// quit multi state before relaying commands, the captured queue and watching are not affected
+	conn.SetMultiState(false)
+	if len(conn.GetTxErrors()) > 0 {
+		conn.ClearQueuedCmds()
+		return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if errReply := cluster.checkCrossSlot(cmdLines...); errReply != nil {
+		conn.ClearQueuedCmds()
+		return errReply
+	}
 
 	// analysis related keys
 	keys := make([]string, 0) // may contains duplicate
@@ -28,31 +40,133 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 		keys = append(keys, wKeys...)
 		keys = append(keys, rKeys...)
 	}
-	watching := conn.GetWatching()
-	watchingKeys := make([]string, 0, len(watching))
-	for key := range watching {
-		watchingKeys = append(watchingKeys, key)
-	}
-	keys = append(keys, watchingKeys...)
-	if len(keys) == 0 {
-		// empty transaction or only `PING`s
-		return cluster.db.ExecMulti(conn, watching, cmdLines)
-	}
 	groupMap := cluster.groupBy(keys)
 	if len(groupMap) > 1 {
-		return protocol.MakeErrReply("ERR MULTI commands transaction must within one slot in cluster mode")
+		return execMultiAcrossNodes(cluster, conn, watching, cmdLines)
 	}
-	var peer string
-	// assert len(groupMap) == 1
+	// empty transaction or only `PING`s will be executed by self
+	peer := cluster.self
+	// assert len(groupMap) <= 1
 	for p := range groupMap {
 		peer = p
 	}
 
+	// watching keys of executing node are checked atomically with the transaction by their version,
+	// and keys of other nodes are checked by remote watchers before executing
+	changed, errReply := cluster.checkRemoteWatching(conn, watching)
+	if errReply != nil {
+		return errReply
+	}
+	if changed {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	peerWatching := make(map[string]uint32)
+	for key, ver := range watching {
+		if cluster.peerPicker.PickNode(key) == peer {
+			peerWatching[key] = ver
+		}
+	}
+
 	// out parser not support protocol.MultiRawReply, so we have to encode it
 	if peer == cluster.self {
-		return cluster.db.ExecMulti(conn, watching, cmdLines)
+		return cluster.db.ExecMulti(conn, peerWatching, cmdLines)
+	}
+	return execMultiOnOtherNode(cluster, conn, peer, peerWatching, cmdLines)
+}
+
+// execMultiAcrossNodes executes transaction whose keys are located on several nodes by tcc, commands of each node
+// are prepared and committed together, and their replies are merged in order of commands
+func execMultiAcrossNodes(cluster *Cluster, conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
+	defer conn.ClearQueuedCmds()
+	// commands without keys are executed by self
+	nodeOf := make([]string, len(cmdLines))
+	nodeCmdLines := make(map[string][]CmdLine)
+	for i, cmdLine := range cmdLines {
+		writeKeys, readKeys := database.GetRelatedKeys(cmdLine)
+		node := cluster.self
+		groupMap := cluster.groupBy(append(writeKeys, readKeys...))
+		if len(groupMap) > 1 {
+			cluster.unwatchRemote(conn, watching)
+			return protocol.MakeErrReply(crossSlotErr)
+		}
+		for n := range groupMap {
+			node = n
+		}
+		nodeOf[i] = node
+		nodeCmdLines[node] = append(nodeCmdLines[node], cmdLine)
+	}
+
+	changed, errReply := cluster.checkRemoteWatching(conn, watching)
+	if errReply != nil {
+		return errReply
+	}
+	for key, ver := range watching {
+		if changed || cluster.peerPicker.PickNode(key) != cluster.self {
+			continue
+		}
+		result, ok := cluster.db.Exec(conn, utils.ToCmdLine("GetVer", key)).(*protocol.IntReply)
+		changed = !ok || uint32(result.Code) != ver
+	}
+	if changed {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	timeout := txTimeout(len(nodeCmdLines))
+	groupMap := make(map[string][]string, len(nodeCmdLines))
+	for node, lines := range nodeCmdLines {
+		groupMap[node] = nil
+		prepareArgs := makePrepareArgs(txIDStr, timeout, relayMulti)
+		prepareArgs = append(prepareArgs, encodeCmdLine(lines)...)
+		resp := cluster.relayPrepare(node, conn, prepareArgs)
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, conn, txID, groupMap)
+			return resp
+		}
+	}
+	respList, errReply := requestCommit(cluster, conn, txID, groupMap)
+	if errReply != nil {
+		return errReply
+	}
+	nodeReplies := make(map[string][]redis.Reply, len(respList))
+	for node, resp := range respList {
+		encoded, ok := resp.(*protocol.MultiBulkReply)
+		if !ok {
+			return protocol.MakeErrReply("exec failed")
+		}
+		replies, err := parseEncodedMultiRawReply(encoded.Args)
+		if err != nil || len(replies.Replies) != len(nodeCmdLines[node]) {
+			return protocol.MakeErrReply("exec failed")
+		}
+		nodeReplies[node] = replies.Replies
+	}
+	replies := make([]redis.Reply, len(cmdLines))
+	for i, node := range nodeOf {
+		replies[i] = nodeReplies[node][0]
+		nodeReplies[node] = nodeReplies[node][1:]
 	}
-	return execMultiOnOtherNode(cluster, conn, peer, watching, cmdLines)
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// txCmdLines returns commands of tcc transaction, cmdLine of MULTI across nodes is: _multi base64ed-cmdLine...
+func txCmdLines(cmdLine CmdLine) ([]CmdLine, error) {
+	if len(cmdLine) == 0 || strings.ToLower(string(cmdLine[0])) != relayMulti {
+		return []CmdLine{cmdLine}, nil
+	}
+	decoded, err := parseEncodedMultiRawReply(cmdLine[1:])
+	if err != nil {
+		return nil, err
+	}
+	cmdLines := make([]CmdLine, 0, len(decoded.Replies))
+	for _, rep := range decoded.Replies {
+		mbr, ok := rep.(*protocol.MultiBulkReply)
+		if !ok {
+			return nil, errors.New("illegal commands of multi")
+		}
+		cmdLines = append(cmdLines, mbr.Args)
+	}
+	return cmdLines, nil
 }
 
 func execMultiOnOtherNode(cluster *Cluster, conn redis.Connection, peer string, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
@@ -143,9 +257,23 @@ func execWatch(cluster *Cluster, conn redis.Connection, args [][]byte) redis.Rep
 		return protocol.MakeArgNumErrReply("watch")
 	}
 	args = args[1:]
+	keys := make([]string, len(args))
+	for i, bkey := range args {
+		keys[i] = string(bkey)
+	}
+	// register watchers before getting versions, so modifications after GetVer won't be missed
+	watcher := getWatcherID(cluster, conn)
+	for peer, group := range cluster.groupBy(keys) {
+		if peer == cluster.self {
+			continue
+		}
+		result := cluster.relay(peer, conn, utils.ToCmdLine2("WatchKeys", append([]string{watcher}, group...)...))
+		if protocol.IsErrorReply(result) {
+			return result
+		}
+	}
 	watching := conn.GetWatching()
-	for _, bkey := range args {
-		key := string(bkey)
+	for _, key := range keys {
 		peer := cluster.peerPicker.PickNode(key)
 		result := cluster.relay(peer, conn, utils.ToCmdLine("GetVer", key))
 		if protocol.IsErrorReply(result) {
@@ -159,3 +287,51 @@ func execWatch(cluster *Cluster, conn redis.Connection, args [][]byte) redis.Rep
 	}
 	return protocol.MakeOkReply()
 }
+
+// getWatcherID returns id of watchers registered on other nodes by the given connection
+func getWatcherID(cluster *Cluster, conn redis.Connection) string {
+	return cluster.self + "#" + strconv.FormatUint(conn.GetID(), 10)
+}
+
+// groupRemoteWatching returns watching keys which are located on other nodes, grouped by node
+func (cluster *Cluster) groupRemoteWatching(watching map[string]uint32) map[string][]string {
+	keys := make([]string, 0, len(watching))
+	for key := range watching {
+		keys = append(keys, key)
+	}
+	groupMap := cluster.groupBy(keys)
+	delete(groupMap, cluster.self)
+	return groupMap
+}
+
+// checkRemoteWatching unregisters watchers on other nodes and returns whether any watching key has been modified
+func (cluster *Cluster) checkRemoteWatching(conn redis.Connection, watching map[string]uint32) (bool, redis.Reply) {
+	watcher := getWatcherID(cluster, conn)
+	changed := false
+	var errReply redis.Reply
+	// check all nodes even if a modification was found, to make sure all watchers are unregistered
+	for peer := range cluster.groupRemoteWatching(watching) {
+		result := cluster.relay(peer, conn, utils.ToCmdLine("CheckWatch", watcher))
+		if protocol.IsErrorReply(result) {
+			errReply = result
+			continue
+		}
+		intResult, ok := result.(*protocol.IntReply)
+		if !ok {
+			errReply = protocol.MakeErrReply("check watching failed")
+			continue
+		}
+		if intResult.Code != 0 {
+			changed = true
+		}
+	}
+	return changed, errReply
+}
+
+// unwatchRemote unregisters watchers on other nodes, it is used by DISCARD and disconnecting
+func (cluster *Cluster) unwatchRemote(conn redis.Connection, watching map[string]uint32) {
+	watcher := getWatcherID(cluster, conn)
+	for peer := range cluster.groupRemoteWatching(watching) {
+		cluster.relay(peer, conn, utils.ToCmdLine("UnWatchKeys", watcher))
+	}
+}
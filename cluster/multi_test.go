@@ -110,3 +110,94 @@ func TestWatch2(t *testing.T) {
 	result = testNodeA.Exec(conn, utils.ToCmdLine("get", key2))
 	asserts.AssertBulkReply(t, result, value2)
 }
+
+func TestWatchRemoteKey(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	remoteKey := testNodeB.self + utils.RandString(10)
+	key := utils.RandString(10)
+	value := utils.RandString(10)
+
+	// remote key modified, abort
+	result := testNodeA.Exec(conn, utils.ToCmdLine("watch", remoteKey))
+	asserts.AssertNotError(t, result)
+	testNodeB.db.Exec(new(connection.FakeConn), utils.ToCmdLine("set", remoteKey, value))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", key, value))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	if _, ok := result.(*protocol.EmptyMultiBulkReply); !ok {
+		t.Errorf("expect transaction aborted, actual %s", result.ToBytes())
+	}
+	result = testNodeA.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertNullBulk(t, result)
+
+	// remote key not modified, execute
+	testNodeA.Exec(conn, utils.ToCmdLine("watch", remoteKey))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", key, value))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertNotError(t, result)
+	result = testNodeA.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertBulkReply(t, result, value)
+
+	// remote key flushed, abort
+	testNodeA.Exec(conn, utils.ToCmdLine("watch", remoteKey))
+	testNodeB.db.Exec(new(connection.FakeConn), utils.ToCmdLine("FLUSHDB"))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("del", key))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	if _, ok := result.(*protocol.EmptyMultiBulkReply); !ok {
+		t.Errorf("expect transaction aborted, actual %s", result.ToBytes())
+	}
+}
+
+func TestWatchRemoteKeyDiscard(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	remoteKey := testNodeB.self + utils.RandString(10)
+	testNodeA.Exec(conn, utils.ToCmdLine("watch", remoteKey))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	result := testNodeA.Exec(conn, toArgs("DISCARD"))
+	asserts.AssertNotError(t, result)
+	// watcher has been removed, so it is regarded as dirty
+	result = testNodeB.db.Exec(new(connection.FakeConn), utils.ToCmdLine("CheckWatch", getWatcherID(testNodeA, conn)))
+	asserts.AssertIntReply(t, result, 1)
+}
+
+func TestMultiExecAcrossNodes(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	keyA := utils.RandString(10)
+	keyB := utils.RandString(10) + testNodeB.self
+	result := testNodeA.Exec(conn, toArgs("MULTI"))
+	asserts.AssertNotError(t, result)
+	testNodeA.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+	testNodeA.Exec(conn, utils.ToCmdLine("RPUSH", keyB, "b"))
+	testNodeA.Exec(conn, utils.ToCmdLine("GET", keyA))
+	testNodeA.Exec(conn, utils.ToCmdLine("INCR", keyB))
+	testNodeA.Exec(conn, utils.ToCmdLine("PING"))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("EXEC"))
+	rep, ok := result.(*protocol.MultiRawReply)
+	if !ok || len(rep.Replies) != 5 {
+		t.Fatalf("expect 5 replies, actually %s", result.ToBytes())
+	}
+	asserts.AssertStatusReply(t, rep.Replies[0], "OK")
+	asserts.AssertIntReply(t, rep.Replies[1], 1)
+	asserts.AssertBulkReply(t, rep.Replies[2], "a")
+	asserts.AssertErrReply(t, rep.Replies[3], "WRONGTYPE Operation against a key holding the wrong kind of value")
+	asserts.AssertStatusReply(t, rep.Replies[4], "PONG")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("LRANGE", keyB, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b"})
+
+	// a command can't touch keys on different nodes
+	result = testNodeA.Exec(conn, toArgs("MULTI"))
+	asserts.AssertNotError(t, result)
+	testNodeA.Exec(conn, utils.ToCmdLine("SET", keyA, "a2"))
+	testNodeA.Exec(conn, utils.ToCmdLine("RENAME", keyA, keyB))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("EXEC"))
+	asserts.AssertErrReply(t, result, crossSlotErr)
+	result = testNodeA.Exec(conn, utils.ToCmdLine("GET", keyA))
+	asserts.AssertBulkReply(t, result, "a")
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultPeerConns is count of connections to each peer if cluster-peer-conns is not set
+	defaultPeerConns = 2
+	// peerFailThreshold is count of consecutive failures to take peer as down, requests to a down peer fail fast
+	// until next reconnect attempt
+	peerFailThreshold = 3
+	peerMaxBackoff    = 10 * time.Second
+	// peerPingInterval is the interval to check connections by PING, and peerBackoff is the wait before the first
+	// reconnect attempt to a down peer which doubles on each failed attempt
+	peerPingInterval = time.Second
+	peerBackoff      = 100 * time.Millisecond
+)
+
+// peerConns holds a few connections to a peer shared by all relayed commands, commands sent concurrently are
+// pipelined on them instead of taking a connection exclusively for each command
+type peerConns struct {
+	addr string
+	next uint32
+
+	mu      sync.Mutex
+	clients []*client.Client
+	closed  bool
+	// failures counts consecutive failures of connecting or sending, peer is down once it reaches peerFailThreshold
+	failures int
+	// backoff is the wait before retryAt, retryAt is when to try reconnecting to down peer
+	backoff time.Duration
+	retryAt time.Time
+	stop    chan struct{}
+	// pingInterval and minBackoff are peerPingInterval and peerBackoff, tests could shorten them
+	pingInterval time.Duration
+	minBackoff   time.Duration
+}
+
+func makePeerConns(addr string) *peerConns {
+	return makePeerConnsWithTiming(addr, peerPingInterval, peerBackoff)
+}
+
+// makePeerConnsWithTiming makes peerConns which pings connections every pingInterval and waits minBackoff before
+// the first reconnect attempt to down peer
+func makePeerConnsWithTiming(addr string, pingInterval time.Duration, minBackoff time.Duration) *peerConns {
+	n := defaultPeerConns
+	if config.Properties().ClusterPeerConns > 0 {
+		n = config.Properties().ClusterPeerConns
+	}
+	p := &peerConns{
+		addr:         addr,
+		clients:      make([]*client.Client, n),
+		stop:         make(chan struct{}),
+		pingInterval: pingInterval,
+		minBackoff:   minBackoff,
+	}
+	go p.checkHealth()
+	return p
+}
+
+// fail records a failure of peer, invoker should hold p.mu
+func (p *peerConns) fail() {
+	p.failures++
+	if p.failures < peerFailThreshold {
+		return
+	}
+	if p.backoff == 0 {
+		p.backoff = p.minBackoff
+	} else if p.backoff < peerMaxBackoff {
+		p.backoff *= 2
+	}
+	// jitter avoids nodes reconnecting to a recovered peer at the same time
+	jitter := time.Duration(rand.Int63n(int64(p.backoff)/2 + 1))
+	p.retryAt = time.Now().Add(p.backoff/2 + jitter)
+}
+
+// succeed records peer is reachable, invoker should hold p.mu
+func (p *peerConns) succeed() {
+	p.failures = 0
+	p.backoff = 0
+	p.retryAt = time.Time{}
+}
+
+// down returns whether requests to peer should fail fast, invoker should hold p.mu
+func (p *peerConns) down() bool {
+	return p.failures >= peerFailThreshold && time.Now().Before(p.retryAt)
+}
+
+// evict closes broken connection, invoker should hold p.mu
+func (p *peerConns) evict(c *client.Client) {
+	for i, cli := range p.clients {
+		if cli == c {
+			p.clients[i] = nil
+		}
+	}
+	// closing waits for requests in flight, so it mustn't block others holding p.mu
+	go c.Close()
+}
+
+// get returns connections in turn, connection is created when it is used for the first time or it has been closed
+// after failed to reconnect
+func (p *peerConns) get() (*client.Client, error) {
+	i := int(atomic.AddUint32(&p.next, 1) % uint32(len(p.clients)))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errors.New("connection pool closed")
+	}
+	if p.down() {
+		return nil, errors.New("peer " + p.addr + " is unreachable")
+	}
+	if c := p.clients[i]; c != nil && !c.Closed() {
+		return c, nil
+	}
+	return p.connect(i)
+}
+
+// connect creates connection in place of the i-th one, invoker should hold p.mu
+func (p *peerConns) connect(i int) (*client.Client, error) {
+	c, err := client.MakeClient(p.addr)
+	if err != nil {
+		p.fail()
+		return nil, err
+	}
+	c.Start()
+	p.clients[i] = c
+	return c, nil
+}
+
+// checkHealth pings connections periodically, broken connections are evicted and down peer is reconnected after
+// backoff, so that requests don't wait for broken connections or dead peer
+func (p *peerConns) checkHealth() {
+	ticker := time.NewTicker(p.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		clients := make([]*client.Client, 0, len(p.clients))
+		for _, c := range p.clients {
+			if c != nil {
+				clients = append(clients, c)
+			}
+		}
+		if len(clients) == 0 && p.failures >= peerFailThreshold && !p.down() {
+			if c, err := p.connect(0); err == nil {
+				clients = append(clients, c)
+			}
+		}
+		p.mu.Unlock()
+		for _, c := range clients {
+			p.record(c, c.Send(makeArgs("PING")))
+		}
+	}
+}
+
+// record updates health of peer by reply of c
+func (p *peerConns) record(c *client.Client, reply redis.Reply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	if client.IsClientErr(reply) || c.Closed() {
+		p.evict(c)
+		p.fail()
+		return
+	}
+	p.succeed()
+}
+
+// send sends command to db of peer, AUTH and SELECT are pipelined with the command since connection is shared by
+// all databases and it may be reconnected
+func (p *peerConns) send(dbIndex int, cmdLine CmdLine) redis.Reply {
+	c, err := p.get()
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	cmdLines := make([][][]byte, 0, 3)
+	if password := peerPassword(); password != "" {
+		cmdLines = append(cmdLines, makeArgs("AUTH", password))
+	}
+	cmdLines = append(cmdLines, makeArgs("SELECT", strconv.Itoa(dbIndex)), cmdLine)
+	replies := c.Pipeline(cmdLines)
+	p.record(c, replies[0])
+	for _, reply := range replies[:len(replies)-1] {
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+	}
+	return replies[len(replies)-1]
+}
+
+// peerPassword returns password to authenticate to peers, it is masterauth if set like replicas authenticating to
+// master, otherwise peers are supposed to share requirepass of self
+func peerPassword() string {
+	if config.Properties().MasterAuth != "" {
+		return config.Properties().MasterAuth
+	}
+	return config.Properties().RequirePass
+}
+
+func (p *peerConns) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	for _, c := range p.clients {
+		if c != nil {
+			go c.Close()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve serves standalone database on listener, it returns count of accepted connections
+func serve(t *testing.T, listener net.Listener) *int32 {
+	db := database2.NewStandaloneServer()
+	t.Cleanup(db.Close)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				client := connection.NewConn(conn)
+				for payload := range parser.ParseStream(conn) {
+					if r, ok := payload.Data.(*protocol.MultiBulkReply); ok {
+						_ = client.Write(db.Exec(client, r.Args).ToBytes())
+					}
+				}
+			}()
+		}
+	}()
+	return &accepted
+}
+
+func TestPeerConns(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := serve(t, listener)
+	peer := makePeerConns(listener.Addr().String())
+	defer peer.close()
+	// commands of different databases sent concurrently are pipelined on shared connections
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := "peer" + strconv.Itoa(i)
+			result := peer.send(i%2, toArgs("SET", key, strconv.Itoa(i%2)))
+			asserts.AssertStatusReply(t, result, "OK")
+			result = peer.send(i%2, toArgs("GET", key))
+			asserts.AssertBulkReply(t, result, strconv.Itoa(i%2))
+			result = peer.send((i+1)%2, toArgs("GET", key))
+			asserts.AssertNullBulk(t, result)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(accepted); n > defaultPeerConns {
+		t.Errorf("expect at most %d connections to peer, actually %d", defaultPeerConns, n)
+	}
+	result := peer.send(0, toArgs("SELECT", "100"))
+	asserts.AssertErrReply(t, result, "ERR DB index is out of range")
+}
+
+func TestPeerHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	peer := makePeerConnsWithTiming(addr, 20*time.Millisecond, 50*time.Millisecond)
+	defer peer.close()
+	for i := 0; i < peerFailThreshold; i++ {
+		result := peer.send(0, toArgs("PING"))
+		if !protocol.IsErrorReply(result) {
+			t.Fatalf("expect error of dead peer, actually %s", result.ToBytes())
+		}
+	}
+	// requests to down peer fail fast
+	result := peer.send(0, toArgs("PING"))
+	asserts.AssertErrReply(t, result, "peer "+addr+" is unreachable")
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("address is taken: " + err.Error())
+	}
+	defer listener.Close()
+	serve(t, listener)
+	// recovered peer is reconnected by health check
+	for i := 0; i < 100; i++ {
+		peer.mu.Lock()
+		recovered := peer.failures == 0
+		peer.mu.Unlock()
+		if recovered {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	result = peer.send(0, toArgs("PING"))
+	asserts.AssertStatusReply(t, result, "PONG")
+}
+
+func TestPeerAuth(t *testing.T) {
+	requirePass, masterAuth := config.Properties().RequirePass, config.Properties().MasterAuth
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.RequirePass, p.MasterAuth = requirePass, masterAuth
+		})
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serve(t, listener)
+	peer := makePeerConns(listener.Addr().String())
+	defer peer.close()
+
+	// peers share requirepass of self
+	config.Update(func(p *config.ServerProperties) {
+		p.RequirePass, p.MasterAuth = "secret", ""
+	})
+	result := peer.send(0, toArgs("SET", "auth", "1"))
+	asserts.AssertStatusReply(t, result, "OK")
+	// masterauth is preferred
+	config.Update(func(p *config.ServerProperties) {
+		p.MasterAuth = "wrong"
+	})
+	result = peer.send(0, toArgs("GET", "auth"))
+	asserts.AssertErrReply(t, result, "ERR invalid password")
+	config.Update(func(p *config.ServerProperties) {
+		p.MasterAuth = "secret"
+	})
+	result = peer.send(0, toArgs("GET", "auth"))
+	asserts.AssertBulkReply(t, result, "1")
+}
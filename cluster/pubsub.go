@@ -45,3 +45,38 @@ func Subscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply
 func UnSubscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	return cluster.db.Exec(c, args) // let local db.hub handle subscribe
 }
+
+// PSubscribe puts the given connection into subscribers of the given patterns
+func PSubscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, args) // let local db.hub handle psubscribe
+}
+
+// PUnSubscribe removes the given connection from subscribers of the given patterns
+func PUnSubscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, args) // let local db.hub handle punsubscribe
+}
+
+// PubSub inspects subscriptions on local node, since publish is broadcast to every node
+func PubSub(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, args)
+}
+
+// SSubscribe puts the given connection into subscribers of shard channels owned by current node.
+// SPUBLISH is only relayed to the owner node of channel, so subscribing a channel owned by another node is rejected.
+func SSubscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("ssubscribe")
+	}
+	for _, channel := range args[1:] {
+		peer := cluster.peerPicker.PickNode(string(channel))
+		if peer != cluster.self {
+			return protocol.MakeErrReply("ERR shard channel '" + string(channel) + "' is located on node " + peer)
+		}
+	}
+	return cluster.db.Exec(c, args)
+}
+
+// SUnSubscribe removes the given connection from the given shard channels
+func SUnSubscribe(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, args) // let local db.hub handle sunsubscribe
+}
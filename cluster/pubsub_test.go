@@ -46,3 +46,69 @@ func TestPublish(t *testing.T) {
 		t.Error("expect no msg")
 	}
 }
+
+func TestSPublish(t *testing.T) {
+	channel := utils.RandString(5) + testNodeB.self
+	msg := utils.RandString(5)
+	conn := &connection.FakeConn{}
+	reply := SSubscribe(testNodeA, conn, utils.ToCmdLine("SSUBSCRIBE", channel))
+	asserts.AssertErrReply(t, reply, "ERR shard channel '"+channel+"' is located on node "+testNodeB.self)
+
+	SSubscribe(testNodeB, conn, utils.ToCmdLine("SSUBSCRIBE", channel))
+	conn.Clean()
+	// published on node A and relayed to node B which owns the channel
+	reply = defaultFunc(testNodeA, &connection.FakeConn{}, utils.ToCmdLine("SPUBLISH", channel, msg))
+	asserts.AssertIntReply(t, reply, 1)
+	ret, err := parser.ParseOne(conn.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	asserts.AssertMultiBulkReply(t, ret, []string{"smessage", channel, msg})
+
+	SUnSubscribe(testNodeB, conn, utils.ToCmdLine("SUNSUBSCRIBE"))
+	conn.Clean()
+	reply = defaultFunc(testNodeA, &connection.FakeConn{}, utils.ToCmdLine("SPUBLISH", channel, msg))
+	asserts.AssertIntReply(t, reply, 0)
+	if len(conn.Bytes()) > 0 {
+		t.Error("expect no msg")
+	}
+}
+
+func TestPublishResp3(t *testing.T) {
+	channel := utils.RandString(5)
+	msg := utils.RandString(5)
+	conn := &connection.FakeConn{}
+	conn.SetProtocol(3)
+	resp2Conn := &connection.FakeConn{}
+	Subscribe(testNodeA, conn, utils.ToCmdLine("SUBSCRIBE", channel))
+	Subscribe(testNodeA, resp2Conn, utils.ToCmdLine("SUBSCRIBE", channel))
+	expected := ">3\r\n$9\r\nsubscribe\r\n$5\r\n" + channel + "\r\n:1\r\n"
+	if string(conn.Bytes()) != expected {
+		t.Errorf("expect %q, actually %q", expected, string(conn.Bytes()))
+	}
+	conn.Clean()
+	resp2Conn.Clean()
+
+	Publish(testNodeA, conn, utils.ToCmdLine("PUBLISH", channel, msg))
+	expected = ">3\r\n$7\r\nmessage\r\n$5\r\n" + channel + "\r\n$5\r\n" + msg + "\r\n"
+	if string(conn.Bytes()) != expected {
+		t.Errorf("expect %q, actually %q", expected, string(conn.Bytes()))
+	}
+	// the same message is still a multi bulk reply for RESP2 subscriber
+	ret, err := parser.ParseOne(resp2Conn.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	asserts.AssertMultiBulkReply(t, ret, []string{"message", channel, msg})
+
+	UnSubscribe(testNodeA, conn, utils.ToCmdLine("UNSUBSCRIBE"))
+	UnSubscribe(testNodeA, resp2Conn, utils.ToCmdLine("UNSUBSCRIBE"))
+	conn.Clean()
+	UnSubscribe(testNodeA, conn, utils.ToCmdLine("UNSUBSCRIBE"))
+	expected = ">3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"
+	if string(conn.Bytes()) != expected {
+		t.Errorf("expect %q, actually %q", expected, string(conn.Bytes()))
+	}
+}
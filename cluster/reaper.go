@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/timewheel"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// relayTxStatus asks node for outcome of transaction it knows as participant or coordinator.
+// format: _txstatus txID, reply one of prepared, committed, rolledback and unknown
+const relayTxStatus = "_txstatus"
+
+// names of transaction status replied by _txstatus
+var txStatusNames = map[int8]string{
+	createdStatus:    "prepared",
+	preparedStatus:   "prepared",
+	committedStatus:  "committed",
+	rolledBackStatus: "rolledback",
+}
+
+// txStatus returns status of transaction known by self, decision of coordinator is preferred to local status
+func (cluster *Cluster) txStatus(txID string) string {
+	if raw, ok := cluster.decisions.Get(txID); ok {
+		return txStatusNames[raw.(int8)]
+	}
+	raw, ok := cluster.transactions.Get(txID)
+	if !ok {
+		return "unknown"
+	}
+	tx := raw.(*Transaction)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return txStatusNames[tx.status]
+}
+
+// execTxStatus replies outcome of transaction for participants reaping orphan transactions
+func execTxStatus(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply(relayTxStatus)
+	}
+	return protocol.MakeBulkReply([]byte(cluster.txStatus(string(args[1]))))
+}
+
+// decide records decision of transaction coordinated by self, so participants could learn it if they missed
+// commit or rollback
+func (cluster *Cluster) decide(txID string, status int8) {
+	cluster.decisions.Put(txID, status)
+	timewheel.Delay(retainTime(), "", func() {
+		cluster.decisions.Remove(txID)
+	})
+}
+
+// reaper looks for transactions still prepared after their deadline periodically, they are orphans whose
+// coordinator probably crashed before commit or rollback
+func (cluster *Cluster) reaper() {
+	ticker := time.NewTicker(lockTime())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cluster.stopReaper:
+			return
+		case <-ticker.C:
+			cluster.reapOrphans()
+		}
+	}
+}
+
+func (cluster *Cluster) reapOrphans() {
+	var orphans []*Transaction
+	now := time.Now()
+	cluster.transactions.ForEach(func(key string, val interface{}) bool {
+		orphans = append(orphans, val.(*Transaction))
+		return true
+	})
+	for _, tx := range orphans {
+		tx.mu.Lock()
+		orphan := tx.status == preparedStatus && !now.Before(tx.deadline)
+		tx.mu.Unlock()
+		if orphan {
+			cluster.reap(tx)
+		}
+	}
+}
+
+// reap asks other nodes for outcome of the transaction, it commits if any node committed, otherwise rolls back
+func (cluster *Cluster) reap(tx *Transaction) {
+	conn := &connection.FakeConn{}
+	conn.SetPassword(config.Properties().RequirePass)
+	conn.SelectDB(tx.dbIndex)
+	committed := cluster.txStatus(tx.id) == "committed"
+	if !committed {
+		for _, node := range cluster.getNodes() {
+			if node == cluster.self {
+				continue
+			}
+			reply, ok := cluster.relay(node, conn, makeArgs(relayTxStatus, tx.id)).(*protocol.BulkReply)
+			if ok && string(reply.Arg) == "committed" {
+				committed = true
+				break
+			}
+		}
+	}
+	if committed {
+		reply := execCommit(cluster, conn, makeArgs("commit", tx.id))
+		if protocol.IsErrorReply(reply) {
+			logger.Warn("reap transaction " + tx.id + " failed: " + string(reply.ToBytes()))
+			return
+		}
+		atomic.AddInt64(&cluster.reapedCommitted, 1)
+		logger.Info("commit orphan transaction " + tx.id + " committed by other participants")
+		return
+	}
+	execRollback(cluster, conn, makeArgs("rollback", tx.id))
+	atomic.AddInt64(&cluster.reapedRolledBack, 1)
+	logger.Info("rollback orphan transaction " + tx.id)
+}
+
+// txInfo returns metrics of reaped transactions in CLUSTER INFO
+func (cluster *Cluster) txInfo() []string {
+	return []string{
+		"cluster_tx_reaped_committed:" + strconv.FormatInt(atomic.LoadInt64(&cluster.reapedCommitted), 10),
+		"cluster_tx_reaped_rolledback:" + strconv.FormatInt(atomic.LoadInt64(&cluster.reapedRolledBack), 10),
+	}
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+)
+
+// relayAsking executes the relayed command like it follows ASKING, it is used to access keys migrated to the peer
+// on behalf of clients not aware of cluster
+const relayAsking = "_asking"
+
+// redirect tells cluster-aware clients which node serves keys of the command by MOVED or ASK instead of relaying it,
+// and handles commands of slots being migrated. It returns nil if the command should be executed or relayed as usual,
+// which includes the case that its keys are located on several nodes.
+func (cluster *Cluster) redirect(c redis.Connection, cmdLine CmdLine) redis.Reply {
+	slots, ok := cluster.peerPicker.(*slotmap.Map)
+	if !ok || c == nil {
+		return nil
+	}
+	// ASKING only affects the next command
+	asking := c.IsAsking()
+	c.SetAsking(false)
+	writeKeys, readKeys := database2.GetRelatedKeys(cmdLine)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 || len(cluster.groupBy(keys)) > 1 {
+		return nil
+	}
+	slot := slotmap.HashSlot(keys[0])
+	peer := slots.GetSlotNode(slot)
+	if peer == "" || cluster.staleReadable(peer, c, cmdLine) {
+		return nil
+	}
+	if peer != cluster.self {
+		if asking && slots.GetImporting(slot) != "" {
+			return cluster.db.Exec(c, cmdLine)
+		}
+		if config.Properties().ClusterRedirect {
+			return protocol.MakeErrReply("MOVED " + strconv.Itoa(slot) + " " + peer)
+		}
+		return nil
+	}
+	target := slots.GetMigrating(slot)
+	if target == "" {
+		return nil
+	}
+	distinct := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if slotmap.HashSlot(key) != slot {
+			return nil
+		}
+		distinct[key] = struct{}{}
+	}
+	existArgs := make([]string, 0, len(distinct))
+	for key := range distinct {
+		existArgs = append(existArgs, key)
+	}
+	exists, ok := cluster.db.Exec(c, makeArgs("EXISTS", existArgs...)).(*protocol.IntReply)
+	if !ok {
+		return nil
+	}
+	if exists.Code == int64(len(distinct)) {
+		return nil
+	} else if exists.Code > 0 {
+		return protocol.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+	}
+	// keys not found have been migrated, or would be created on the target node
+	if config.Properties().ClusterRedirect {
+		return protocol.MakeErrReply("ASK " + strconv.Itoa(slot) + " " + target)
+	}
+	return cluster.relay(target, c, append([][]byte{[]byte(relayAsking)}, cmdLine...))
+}
+
+// execAsking allows the next command to access slot being imported by this node
+func execAsking(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	if _, ok := cluster.peerPicker.(*slotmap.Map); !ok {
+		return protocol.MakeErrReply("ERR This instance has cluster support disabled")
+	}
+	c.SetAsking(true)
+	return protocol.MakeOkReply()
+}
+
+// execRelayedAsking executes command relayed by the node migrating its slot to this node
+func execRelayedAsking(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(relayAsking)
+	}
+	c.SetAsking(true)
+	if reply := cluster.redirect(c, args[1:]); reply != nil {
+		return reply
+	}
+	return cluster.db.Exec(c, args[1:])
+}
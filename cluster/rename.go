@@ -7,7 +7,8 @@ import (
 	"strconv"
 )
 
-// Rename renames a key, the origin and the destination must within the same node
+// Rename renames a key, if the origin and the destination are located on different nodes, the origin is dumped and
+// removed on its node and restored on the other node within a tcc transaction
 func Rename(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	if len(args) != 3 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'rename' command")
@@ -25,8 +26,9 @@ func Rename(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	}
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
+	timeout := txTimeout(len(groupMap))
 	// prepare rename from
-	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makePrepareArgs(txIDStr, timeout, "RenameFrom", srcKey))
 	if protocol.IsErrorReply(srcPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
@@ -38,7 +40,7 @@ func Rename(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR invalid prepare response")
 	}
 	// prepare rename to
-	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+	destPrepareResp := cluster.relayPrepare(destNode, c, append(makePrepareArgs(txIDStr, timeout),
 		[]byte("RenameTo"), []byte(destKey), srcPrepareMBR.Args[0], srcPrepareMBR.Args[1]))
 	if protocol.IsErrorReply(destPrepareResp) {
 		// rollback src node
@@ -91,7 +93,7 @@ func init() {
 }
 
 // RenameNx renames a key, only if the new key does not exist.
-// The origin and the destination must within the same node
+// The origin and the destination could be located on different nodes, see Rename
 func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	if len(args) != 3 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'renamenx' command")
@@ -109,8 +111,9 @@ func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	}
 	txID := cluster.idGenerator.NextID()
 	txIDStr := strconv.FormatInt(txID, 10)
+	timeout := txTimeout(len(groupMap))
 	// prepare rename from
-	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makePrepareArgs(txIDStr, timeout, "RenameFrom", srcKey))
 	if protocol.IsErrorReply(srcPrepareResp) {
 		// rollback src node
 		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
@@ -122,7 +125,7 @@ func RenameNx(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR invalid prepare response")
 	}
 	// prepare rename to
-	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+	destPrepareResp := cluster.relayPrepare(destNode, c, append(makePrepareArgs(txIDStr, timeout),
 		[]byte("RenameNxTo"), []byte(destKey), srcPrepareMBR.Args[0], srcPrepareMBR.Args[1]))
 	if protocol.IsErrorReply(destPrepareResp) {
 		// rollback src node
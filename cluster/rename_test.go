@@ -25,6 +25,28 @@ func TestRename(t *testing.T) {
 	result = testNodeB.db.Exec(conn, utils.ToCmdLine("TTL", newKey))
 	asserts.AssertIntReplyGreaterThan(t, result, 0)
 
+	// value of any type is moved by DUMP and RESTORE
+	key = testNodeA.self + utils.RandString(10)
+	newKey = testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("HSET", key, "field", "value"))
+	result = Rename(testNodeA, conn, utils.ToCmdLine("RENAME", key, newKey))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("HLEN", newKey))
+	asserts.AssertIntReply(t, result, 1)
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("TTL", newKey))
+	asserts.AssertIntReply(t, result, -1)
+	// stream can't be dumped by rdb encoder
+	key = testNodeA.self + utils.RandString(10)
+	newKey = testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("XADD", key, "1-1", "field", "value"))
+	testNodeA.db.Exec(conn, utils.ToCmdLine("EXPIRE", key, "1000"))
+	result = Rename(testNodeA, conn, utils.ToCmdLine("RENAME", key, newKey))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("XLEN", newKey))
+	asserts.AssertIntReply(t, result, 1)
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("TTL", newKey))
+	asserts.AssertIntReplyGreaterThan(t, result, 0)
+
 	// same node rename
 	key = testNodeA.self + utils.RandString(10)
 	value = utils.RandString(10)
@@ -0,0 +1,39 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+)
+
+// execReadOnly allows the connection to read stale data from this node if it is a replica of the peer owning keys
+func execReadOnly(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	c.SetReadOnly(true)
+	return protocol.MakeOkReply()
+}
+
+// execReadWrite stops stale reads of the connection started by READONLY
+func execReadWrite(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	c.SetReadOnly(false)
+	return protocol.MakeOkReply()
+}
+
+// execReplicaOf makes this node a replica of another node, it isn't relayed to peers
+func execReplicaOf(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, args)
+}
+
+// staleReadable returns whether read only command of a READONLY connection could be executed by this node
+// instead of relaying to peer, since this node replicates peer
+func (cluster *Cluster) staleReadable(peer string, c redis.Connection, args [][]byte) bool {
+	if peer == cluster.self || c == nil || !c.IsReadOnly() || !database.IsReadOnlyCommand(string(args[0])) {
+		return false
+	}
+	return cluster.db.MasterAddr() == peer
+}
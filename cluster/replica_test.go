@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	database2 "github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStaleRead(t *testing.T) {
+	// master is a standalone server serving on a random port
+	master := database2.NewStandaloneServer()
+	defer master.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				client := connection.NewConn(conn)
+				for payload := range parser.ParseStream(conn) {
+					if r, ok := payload.Data.(*protocol.MultiBulkReply); ok {
+						_ = client.Write(master.Exec(client, r.Args).ToBytes())
+					}
+				}
+				master.AfterClientClose(client)
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	conn := &connection.FakeConn{}
+	master.Exec(conn, utils.ToCmdLine("set", "k", "v"))
+
+	readOnly := config.Properties().ReplicaReadOnly
+	config.Update(func(p *config.ServerProperties) {
+		p.ReplicaReadOnly = false
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ReplicaReadOnly = readOnly
+		})
+	}()
+	node := MakeTestCluster([]string{addr})
+	defer node.Close()
+	node.peerPicker = &mockPicker{}
+	node.peerPicker.AddNode(addr)
+	host, port, _ := net.SplitHostPort(addr)
+	result := node.Exec(conn, utils.ToCmdLine("replicaof", host, port))
+	asserts.AssertStatusReply(t, result, "OK")
+	synced := false
+	for i := 0; i < 100 && !synced; i++ {
+		reply, ok := node.db.Exec(conn, utils.ToCmdLine("get", "k")).(*protocol.BulkReply)
+		synced = ok && string(reply.Arg) == "v"
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !synced {
+		t.Error("sync failed")
+		return
+	}
+	// make local data differ from master, since the replica is writable
+	node.db.Exec(conn, utils.ToCmdLine("set", "k", "local"))
+
+	result = node.Exec(conn, utils.ToCmdLine("get", "k"))
+	asserts.AssertBulkReply(t, result, "v")
+	result = node.Exec(conn, utils.ToCmdLine("readonly"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = node.Exec(conn, utils.ToCmdLine("get", "k"))
+	asserts.AssertBulkReply(t, result, "local")
+	// writes are still relayed to the owner
+	result = node.Exec(conn, utils.ToCmdLine("set", "k2", "v2"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = master.Exec(conn, utils.ToCmdLine("get", "k2"))
+	asserts.AssertBulkReply(t, result, "v2")
+	result = node.Exec(conn, utils.ToCmdLine("readwrite"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = node.Exec(conn, utils.ToCmdLine("get", "k"))
+	asserts.AssertBulkReply(t, result, "v")
+}
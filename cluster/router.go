@@ -1,6 +1,10 @@
 package cluster
 
-import "github.com/hdt3213/godis/interface/redis"
+import (
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+)
 
 // CmdLine is alias for [][]byte, represents a command line
 type CmdLine = [][]byte
@@ -12,7 +16,9 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["prepare"] = execPrepare
 	routerMap["commit"] = execCommit
 	routerMap["rollback"] = execRollback
+	routerMap[relayTxStatus] = execTxStatus
 	routerMap["del"] = Del
+	routerMap["unlink"] = Del
 
 	routerMap["expire"] = defaultFunc
 	routerMap["expireat"] = defaultFunc
@@ -20,9 +26,15 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["pexpireat"] = defaultFunc
 	routerMap["ttl"] = defaultFunc
 	routerMap["pttl"] = defaultFunc
+	routerMap["expiretime"] = defaultFunc
+	routerMap["pexpiretime"] = defaultFunc
 	routerMap["persist"] = defaultFunc
-	routerMap["exists"] = defaultFunc
+	routerMap["exists"] = Exists
 	routerMap["type"] = defaultFunc
+	routerMap["object"] = relatedKeysFunc
+	routerMap["sort"] = relatedKeysFunc
+	routerMap["dump"] = defaultFunc
+	routerMap["restore"] = defaultFunc
 	routerMap["rename"] = Rename
 	routerMap["renamenx"] = RenameNx
 	routerMap["copy"] = Copy
@@ -38,11 +50,15 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["getex"] = defaultFunc
 	routerMap["getset"] = defaultFunc
 	routerMap["getdel"] = defaultFunc
+	routerMap["lcs"] = relatedKeysFunc
 	routerMap["incr"] = defaultFunc
 	routerMap["incrby"] = defaultFunc
 	routerMap["incrbyfloat"] = defaultFunc
 	routerMap["decr"] = defaultFunc
 	routerMap["decrby"] = defaultFunc
+	routerMap["bitfield"] = defaultFunc
+	routerMap["bitfield_ro"] = defaultFunc
+	routerMap["bitop"] = relatedKeysFunc
 
 	routerMap["lpush"] = defaultFunc
 	routerMap["lpushx"] = defaultFunc
@@ -50,12 +66,19 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["rpushx"] = defaultFunc
 	routerMap["lpop"] = defaultFunc
 	routerMap["rpop"] = defaultFunc
-	//routerMap["rpoplpush"] = RPopLPush
+	routerMap["rpoplpush"] = relatedKeysFunc
 	routerMap["lrem"] = defaultFunc
 	routerMap["llen"] = defaultFunc
 	routerMap["lindex"] = defaultFunc
 	routerMap["lset"] = defaultFunc
 	routerMap["lrange"] = defaultFunc
+	routerMap["lpos"] = defaultFunc
+	routerMap["lmove"] = relatedKeysFunc
+	routerMap["blpop"] = relatedKeysFunc
+	routerMap["brpop"] = relatedKeysFunc
+	routerMap["blmove"] = relatedKeysFunc
+	routerMap["lmpop"] = relatedKeysFunc
+	routerMap["blmpop"] = relatedKeysFunc
 
 	routerMap["hset"] = defaultFunc
 	routerMap["hsetnx"] = defaultFunc
@@ -72,19 +95,30 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["hincrby"] = defaultFunc
 	routerMap["hincrbyfloat"] = defaultFunc
 	routerMap["hrandfield"] = defaultFunc
+	routerMap["hexpire"] = defaultFunc
+	routerMap["hpexpire"] = defaultFunc
+	routerMap["hexpireat"] = defaultFunc
+	routerMap["hpexpireat"] = defaultFunc
+	routerMap["hpersist"] = defaultFunc
+	routerMap["httl"] = defaultFunc
+	routerMap["hpttl"] = defaultFunc
+	routerMap["hexpiretime"] = defaultFunc
+	routerMap["hpexpiretime"] = defaultFunc
 
 	routerMap["sadd"] = defaultFunc
 	routerMap["sismember"] = defaultFunc
+	routerMap["smismember"] = defaultFunc
 	routerMap["srem"] = defaultFunc
 	routerMap["spop"] = defaultFunc
 	routerMap["scard"] = defaultFunc
 	routerMap["smembers"] = defaultFunc
-	routerMap["sinter"] = defaultFunc
-	routerMap["sinterstore"] = defaultFunc
-	routerMap["sunion"] = defaultFunc
-	routerMap["sunionstore"] = defaultFunc
-	routerMap["sdiff"] = defaultFunc
-	routerMap["sdiffstore"] = defaultFunc
+	routerMap["sinter"] = relatedKeysFunc
+	routerMap["sintercard"] = relatedKeysFunc
+	routerMap["sinterstore"] = relatedKeysFunc
+	routerMap["sunion"] = relatedKeysFunc
+	routerMap["sunionstore"] = relatedKeysFunc
+	routerMap["sdiff"] = relatedKeysFunc
+	routerMap["sdiffstore"] = relatedKeysFunc
 	routerMap["srandmember"] = defaultFunc
 
 	routerMap["zadd"] = defaultFunc
@@ -94,13 +128,28 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["zcount"] = defaultFunc
 	routerMap["zrevrank"] = defaultFunc
 	routerMap["zcard"] = defaultFunc
+	routerMap["zrandmember"] = defaultFunc
 	routerMap["zrange"] = defaultFunc
+	routerMap["zrangestore"] = relatedKeysFunc
 	routerMap["zrevrange"] = defaultFunc
 	routerMap["zrangebyscore"] = defaultFunc
+	routerMap["zrangebylex"] = defaultFunc
+	routerMap["zrevrangebylex"] = defaultFunc
+	routerMap["zlexcount"] = defaultFunc
+	routerMap["zremrangebylex"] = defaultFunc
 	routerMap["zrevrangebyscore"] = defaultFunc
 	routerMap["zrem"] = defaultFunc
 	routerMap["zremrangebyscore"] = defaultFunc
 	routerMap["zremrangebyrank"] = defaultFunc
+	routerMap["bzpopmin"] = relatedKeysFunc
+	routerMap["zmpop"] = relatedKeysFunc
+	routerMap["bzmpop"] = relatedKeysFunc
+	routerMap["zunion"] = relatedKeysFunc
+	routerMap["zinter"] = relatedKeysFunc
+	routerMap["zdiff"] = relatedKeysFunc
+	routerMap["zunionstore"] = relatedKeysFunc
+	routerMap["zinterstore"] = relatedKeysFunc
+	routerMap["zdiffstore"] = relatedKeysFunc
 
 	routerMap["geoadd"] = defaultFunc
 	routerMap["geopos"] = defaultFunc
@@ -108,11 +157,48 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["geohash"] = defaultFunc
 	routerMap["georadius"] = defaultFunc
 	routerMap["georadiusbymember"] = defaultFunc
+	routerMap["geosearch"] = defaultFunc
+	routerMap["geosearchstore"] = relatedKeysFunc
+
+	routerMap["xadd"] = defaultFunc
+	routerMap["xsetid"] = defaultFunc
+	routerMap["xlen"] = defaultFunc
+	routerMap["xrange"] = defaultFunc
+	routerMap["xrevrange"] = defaultFunc
+	routerMap["xread"] = relatedKeysFunc
+	routerMap["xgroup"] = relatedKeysFunc
+	routerMap["xreadgroup"] = relatedKeysFunc
+	routerMap["xack"] = defaultFunc
+	routerMap["xclaim"] = defaultFunc
+	routerMap["xautoclaim"] = defaultFunc
+	routerMap["xpending"] = defaultFunc
+
+	routerMap["pfadd"] = defaultFunc
+	routerMap["pfcount"] = relatedKeysFunc
+	routerMap["pfmerge"] = relatedKeysFunc
 
 	routerMap["publish"] = Publish
 	routerMap[relayPublish] = onRelayedPublish
 	routerMap["subscribe"] = Subscribe
 	routerMap["unsubscribe"] = UnSubscribe
+	routerMap["psubscribe"] = PSubscribe
+	routerMap["punsubscribe"] = PUnSubscribe
+	routerMap["pubsub"] = PubSub
+	routerMap["ssubscribe"] = SSubscribe
+	routerMap["sunsubscribe"] = SUnSubscribe
+	routerMap["spublish"] = defaultFunc // relay to the node owning the shard channel
+
+	routerMap["eval"] = Eval
+	routerMap["evalsha"] = Eval
+	routerMap["eval_ro"] = Eval
+	routerMap["evalsha_ro"] = Eval
+	routerMap["script"] = Script
+	routerMap["fcall"] = Eval
+	routerMap["fcall_ro"] = Eval
+	routerMap["function"] = Function
+
+	routerMap["keys"] = Keys
+	routerMap["scan"] = Scan
 
 	routerMap["flushdb"] = FlushDB
 	routerMap["flushall"] = FlushAll
@@ -120,6 +206,17 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["getver"] = defaultFunc
 	routerMap["watch"] = execWatch
 
+	routerMap["cluster"] = execCluster
+	routerMap["asking"] = execAsking
+	routerMap[relayAsking] = execRelayedAsking
+	routerMap["migrate"] = execMigrate
+	routerMap["restore-asking"] = execRestoreAsking
+	routerMap["readonly"] = execReadOnly
+	routerMap["readwrite"] = execReadWrite
+	routerMap["replicaof"] = execReplicaOf
+	routerMap["slaveof"] = execReplicaOf
+	routerMap["config"] = execConfig
+
 	return routerMap
 }
 
@@ -130,3 +227,18 @@ func defaultFunc(cluster *Cluster, c redis.Connection, args [][]byte) redis.Repl
 	peer := cluster.peerPicker.PickNode(key)
 	return cluster.relay(peer, c, args)
 }
+
+// relatedKeysFunc relays command whose keys are not the first argument, all keys must be located on the same peer
+func relatedKeysFunc(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	writeKeys, readKeys := database.GetRelatedKeys(args)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for '" + string(args[0]) + "' command")
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) > 1 {
+		return protocol.MakeErrReply(crossSlotErr)
+	}
+	peer := cluster.peerPicker.PickNode(keys[0])
+	return cluster.relay(peer, c, args)
+}
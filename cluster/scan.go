@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scanNodeBits is the count of low bits in composite cursor of SCAN storing index of the node being scanned,
+// the other bits store cursor of that node
+const scanNodeBits = 10
+
+// masterNodes returns masters of cluster in a stable order, replicas are skipped since they hold the same keys
+func (cluster *Cluster) masterNodes() []string {
+	var nodes []string
+	for _, node := range cluster.getNodes() {
+		if cluster.replicaOf(node) == "" {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Keys returns keys matching pattern on all nodes
+func Keys(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	result := make([][]byte, 0)
+	for _, node := range cluster.masterNodes() {
+		reply := cluster.relay(node, c, args)
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		keys, ok := reply.(*protocol.MultiBulkReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR illegal reply of KEYS from " + node)
+		}
+		result = append(result, keys.Args...)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// Scan iterates keys of all nodes one by one, cursor replied is composed of index of the node being scanned and
+// cursor of that node, so that iteration could be continued on any node.
+// usage: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func Scan(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	for i := 2; i+1 < len(args); i += 2 {
+		if strings.ToUpper(string(args[i])) == "COUNT" {
+			// illegal options are replied by nodes
+			count, _ = strconv.Atoi(string(args[i+1]))
+		}
+	}
+	nodes := cluster.masterNodes()
+	index := int(cursor & (1<<scanNodeBits - 1))
+	nodeCursor := cursor >> scanNodeBits
+	if index >= len(nodes) {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	nodeArgs := make([][]byte, len(args))
+	copy(nodeArgs, args)
+	result := make([][]byte, 0)
+	// continue with the next node until enough keys are found, so that caller won't get too many empty pages
+	for {
+		nodeArgs[1] = []byte(strconv.FormatUint(nodeCursor, 10))
+		reply := cluster.relay(nodes[index], c, nodeArgs)
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		next, keys, ok := parseScanReply(reply)
+		if !ok {
+			return protocol.MakeErrReply("ERR illegal reply of SCAN from " + nodes[index])
+		}
+		result = append(result, keys...)
+		nodeCursor = next
+		if nodeCursor == 0 {
+			index++
+		}
+		if index == len(nodes) || len(result) >= count {
+			break
+		}
+	}
+	next := uint64(0)
+	if index < len(nodes) {
+		next = nodeCursor<<scanNodeBits | uint64(index)
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.FormatUint(next, 10))),
+		protocol.MakeMultiBulkReply(result),
+	})
+}
+
+// parseScanReply returns cursor and keys in reply of SCAN, keys replied by self are a multi bulk reply,
+// while keys relayed by peer client are parsed as nested array of bulk replies
+func parseScanReply(reply redis.Reply) (uint64, [][]byte, bool) {
+	raw, ok := reply.(*protocol.MultiRawReply)
+	if !ok || len(raw.Replies) != 2 {
+		return 0, nil, false
+	}
+	cursor, ok := raw.Replies[0].(*protocol.BulkReply)
+	if !ok {
+		return 0, nil, false
+	}
+	next, err := strconv.ParseUint(string(cursor.Arg), 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	switch keys := raw.Replies[1].(type) {
+	case *protocol.MultiBulkReply:
+		return next, keys.Args, true
+	case *protocol.MultiRawReply:
+		result := make([][]byte, 0, len(keys.Replies))
+		for _, key := range keys.Replies {
+			bulk, ok := key.(*protocol.BulkReply)
+			if !ok {
+				return 0, nil, false
+			}
+			result = append(result, bulk.Arg)
+		}
+		return next, result, true
+	}
+	return 0, nil, false
+}
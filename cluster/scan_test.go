@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	conn := new(connection.FakeConn)
+	expected := make(map[string]struct{})
+	for i := 0; i < 30; i++ {
+		keyA := "scan:" + strconv.Itoa(i)
+		keyB := "scan:" + testNodeB.self + ":" + strconv.Itoa(i)
+		testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+		testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "b"))
+		expected[keyA] = struct{}{}
+		expected[keyB] = struct{}{}
+	}
+
+	result := Keys(testNodeA, conn, utils.ToCmdLine("KEYS", "scan:*"))
+	keys, ok := result.(*protocol.MultiBulkReply)
+	if !ok || len(keys.Args) != len(expected) {
+		t.Fatalf("KEYS should return keys of all nodes, actually %s", result.ToBytes())
+	}
+
+	// iteration started on a node could be continued on another node
+	found := make(map[string]struct{})
+	cursor := "0"
+	nodes := []*Cluster{testNodeA, testNodeB}
+	for i := 0; ; i++ {
+		result = Scan(nodes[i%2], conn, utils.ToCmdLine("SCAN", cursor, "MATCH", "scan:*", "COUNT", "5"))
+		next, keys, ok := parseScanReply(result)
+		if !ok {
+			t.Fatalf("illegal reply of SCAN %s", result.ToBytes())
+		}
+		for _, key := range keys {
+			found[string(key)] = struct{}{}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = strconv.FormatUint(next, 10)
+	}
+	if len(found) != len(expected) {
+		t.Errorf("SCAN should iterate keys of all nodes, expect %d keys, actually %d", len(expected), len(found))
+	}
+
+	result = Scan(testNodeA, conn, utils.ToCmdLine("SCAN", strconv.Itoa(1<<scanNodeBits-1)))
+	asserts.AssertErrReply(t, result, "ERR invalid cursor")
+	result = Scan(testNodeA, conn, utils.ToCmdLine("SCAN", "0", "COUNT", "abc"))
+	asserts.AssertErrReply(t, result, "ERR value is not an integer or out of range")
+}
+
+func TestParseScanReply(t *testing.T) {
+	// reply of SCAN relayed by peer client
+	reply, err := parser.ParseOne([]byte("*2\r\n$4\r\n1025\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, keys, ok := parseScanReply(reply)
+	if !ok || next != 1025 {
+		t.Fatalf("illegal reply of SCAN %s", reply.ToBytes())
+	}
+	actual := make([]string, 0, len(keys))
+	for _, key := range keys {
+		actual = append(actual, string(key))
+	}
+	sort.Strings(actual)
+	if len(actual) != 2 || actual[0] != "a" || actual[1] != "b" {
+		t.Errorf("expect keys a b, actually %v", actual)
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+)
+
+// Eval relays EVAL, EVALSHA, FCALL and their read only variants to the node of declared keys, all keys must be located on the same node.
+// Scripts without keys are executed by self
+func Eval(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	keys, _ := database.GetRelatedKeys(args)
+	if len(keys) == 0 {
+		return cluster.db.Exec(c, args)
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) > 1 {
+		return protocol.MakeErrReply(crossSlotErr)
+	}
+	peer := cluster.peerPicker.PickNode(keys[0])
+	return cluster.relay(peer, c, args)
+}
+
+// Script broadcasts SCRIPT LOAD and SCRIPT FLUSH to all nodes, so EVALSHA works on any node
+func Script(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return broadcastSubCommand(cluster, c, args, "load", "flush")
+}
+
+// Function broadcasts modifications of function libraries to all nodes, so FCALL works on any node
+func Function(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return broadcastSubCommand(cluster, c, args, "load", "delete", "flush")
+}
+
+// broadcastSubCommand broadcasts the command if its sub command is one of the given ones, otherwise executes it locally
+func broadcastSubCommand(cluster *Cluster, c redis.Connection, args [][]byte, subCmds ...string) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply(string(args[0]))
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	broadcast := false
+	for _, name := range subCmds {
+		if subCmd == name {
+			broadcast = true
+		}
+	}
+	if !broadcast {
+		return cluster.db.Exec(c, args)
+	}
+	replies := cluster.broadcast(c, args)
+	for _, reply := range replies {
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+	}
+	return replies[cluster.self]
+}
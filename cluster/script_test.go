@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"github.com/hdt3213/godis/script"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	conn := new(connection.FakeConn)
+	key := testNodeB.self + utils.RandString(10)
+	result := testNodeA.Exec(conn, utils.ToCmdLine("eval", "return redis.call('set', KEYS[1], ARGV[1])", "1", key, "a"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertBulkReply(t, result, "a")
+
+	result = testNodeA.Exec(conn, utils.ToCmdLine("eval", "return 1", "0"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testNodeA.Exec(conn, utils.ToCmdLine("eval", "return 1", "2", key, utils.RandString(10)))
+	asserts.AssertErrReply(t, result, crossSlotErr)
+}
+
+func TestScriptLoad(t *testing.T) {
+	conn := new(connection.FakeConn)
+	src := "return redis.call('get', KEYS[1])"
+	result := testNodeA.Exec(conn, utils.ToCmdLine("script", "load", src))
+	sha := script.Sha1Hex(src)
+	asserts.AssertBulkReply(t, result, sha)
+	key := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("set", key, "b"))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("evalsha", sha, "1", key))
+	asserts.AssertBulkReply(t, result, "b")
+
+	result = testNodeA.Exec(conn, utils.ToCmdLine("script", "flush"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeA.Exec(conn, utils.ToCmdLine("evalsha", sha, "1", key))
+	asserts.AssertErrReply(t, result, "NOSCRIPT No matching script. Please use EVAL.")
+}
+
+func TestFunction(t *testing.T) {
+	conn := new(connection.FakeConn)
+	src := "#!lua name=clusterlib\nredis.register_function('cluster_set', function(keys, args) return redis.call('set', keys[1], args[1]) end)"
+	result := testNodeA.Exec(conn, utils.ToCmdLine("function", "load", "replace", src))
+	asserts.AssertBulkReply(t, result, "clusterlib")
+	key := testNodeB.self + utils.RandString(10)
+	result = testNodeA.Exec(conn, utils.ToCmdLine("fcall", "cluster_set", "1", key, "a"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("get", key))
+	asserts.AssertBulkReply(t, result, "a")
+
+	result = testNodeA.Exec(conn, utils.ToCmdLine("function", "delete", "clusterlib"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("fcall", "cluster_set", "1", key, "b"))
+	asserts.AssertErrReply(t, result, "ERR Function not found")
+}
@@ -2,11 +2,12 @@ package cluster
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/redis"
-	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/timewheel"
 	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,18 +30,43 @@ type Transaction struct {
 	conn    redis.Connection
 	dbIndex int
 
+	// cmdLines are commands executed by commit, it contains cmdLine only unless cmdLine is a relayed MULTI
+	cmdLines []CmdLine
+	// committed is reply of commit, it is replied again if commit is re-delivered
+	committed redis.Reply
+
 	writeKeys  []string
 	readKeys   []string
 	keysLocked bool
 	undoLog    []CmdLine
 
 	status int8
-	mu     *sync.Mutex
+	// timeout is how long keys are held after prepared, it is lockTime() unless coordinator gives one
+	timeout time.Duration
+	// deadline is when transaction still prepared is reaped as orphan
+	deadline time.Time
+	mu       *sync.Mutex
+}
+
+// txAborted is the prefix of errors replied by participant which rolled back the transaction itself,
+// coordinator doesn't retry sending commit on them
+const txAborted = "TXABORTED"
+
+// txRetries is the max attempts of sending commit or rollback to a participant, and txRetryBackoff is the wait before
+// the first retry which doubles on each retry. It is a variable so that tests could shorten it
+var (
+	txRetries      = 3
+	txRetryBackoff = 50 * time.Millisecond
+)
+
+// flushCommands are committed by database engine directly since they lock no keys
+var flushCommands = map[string]bool{
+	"flushdb":  true,
+	"flushall": true,
 }
 
 const (
-	maxLockTime       = 3 * time.Second
-	waitBeforeCleanTx = 2 * maxLockTime
+	defaultLockTime = 3 * time.Second
 
 	createdStatus    = 0
 	preparedStatus   = 1
@@ -48,21 +74,48 @@ const (
 	rolledBackStatus = 3
 )
 
-func genTaskKey(txID string) string {
-	return "tx:" + txID
+// lockTime returns how long participant holds keys of prepared transaction if coordinator doesn't give a timeout
+func lockTime() time.Duration {
+	if config.Properties().ClusterTxLockTimeout > 0 {
+		return time.Duration(config.Properties().ClusterTxLockTimeout) * time.Millisecond
+	}
+	return defaultLockTime
+}
+
+// retainTime returns how long finished transaction is kept, so that coordinator could still rollback it
+func retainTime() time.Duration {
+	if config.Properties().ClusterTxRetainTime > 0 {
+		return time.Duration(config.Properties().ClusterTxRetainTime) * time.Millisecond
+	}
+	return 2 * lockTime()
+}
+
+// txTimeout returns timeout of transaction among nodes, coordinator waits for replies of all nodes in each phase
+// so every node adds a lockTime
+func txTimeout(nodes int) time.Duration {
+	return time.Duration(nodes) * lockTime()
+}
+
+// makePrepareArgs makes PREPARE command of the transaction which holds keys for timeout
+func makePrepareArgs(txID string, timeout time.Duration, args ...string) CmdLine {
+	prepareArgs := []string{txID, "TIMEOUT", strconv.FormatInt(int64(timeout/time.Millisecond), 10)}
+	return makeArgs("Prepare", append(prepareArgs, args...)...)
 }
 
 // NewTransaction creates a try-commit-catch distributed transaction
 func NewTransaction(cluster *Cluster, c redis.Connection, id string, cmdLine [][]byte) *Transaction {
-	return &Transaction{
+	tx := &Transaction{
 		id:      id,
 		cmdLine: cmdLine,
 		cluster: cluster,
 		conn:    c,
 		dbIndex: c.GetDBIndex(),
 		status:  createdStatus,
+		timeout: lockTime(),
 		mu:      new(sync.Mutex),
 	}
+	tx.cmdLines, _ = txCmdLines(cmdLine)
+	return tx
 }
 
 // Reentrant
@@ -87,22 +140,24 @@ func (tx *Transaction) prepare() error {
 	defer tx.mu.Unlock()
 
 	// 锁定相关 key 避免并发问题
-	tx.writeKeys, tx.readKeys = database.GetRelatedKeys(tx.cmdLine)
+	tx.writeKeys, tx.readKeys = nil, nil
+	for _, cmdLine := range tx.cmdLines {
+		writeKeys, readKeys := database.GetRelatedKeys(cmdLine)
+		tx.writeKeys = append(tx.writeKeys, writeKeys...)
+		tx.readKeys = append(tx.readKeys, readKeys...)
+	}
 	// lock writeKeys
 	tx.lockKeys()
 
 	// build undoLog
-	tx.undoLog = tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.cmdLine)
+	// undo logs of all commands are taken before any of them executed, so each of them restores the original value
+	tx.undoLog = nil
+	for _, cmdLine := range tx.cmdLines {
+		tx.undoLog = append(tx.undoLog, tx.cluster.db.GetUndoLogs(tx.dbIndex, cmdLine)...)
+	}
 	tx.status = preparedStatus
-	taskKey := genTaskKey(tx.id)
-	timewheel.Delay(maxLockTime, taskKey, func() {
-		if tx.status == preparedStatus { // rollback transaction uncommitted until expire
-			logger.Info("abort transaction: " + tx.id)
-			tx.mu.Lock()
-			defer tx.mu.Unlock()
-			_ = tx.rollbackWithLock()
-		}
-	})
+	// transaction uncommitted until expire is reaped by reaper of cluster
+	tx.deadline = time.Now().Add(tx.timeout)
 	return nil
 }
 
@@ -121,27 +176,56 @@ func (tx *Transaction) rollbackWithLock() error {
 	}
 	tx.unLockKeys()
 	tx.status = rolledBackStatus
+	if tx.cluster.journal != nil {
+		tx.cluster.journal.finish(journalRollback, tx.id)
+	}
 	return nil
 }
 
 // prepare 命令的格式是: Prepare txID, command, key1, key2 ...
 // TxID 是事务 ID, 由协调者决定. command 是 tcc 要执行的命令， 比如这里的 MSet
-// cmdLine: Prepare id cmdName args...
+// cmdLine: Prepare id [TIMEOUT milliseconds] cmdName args...
+// keys are held for TIMEOUT, or lockTime() if it is absent
 func execPrepare(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	if len(cmdLine) < 3 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'prepare' command")
 	}
 	txID := string(cmdLine[1])
+	timeout := lockTime()
+	if strings.ToLower(string(cmdLine[2])) == "timeout" {
+		if len(cmdLine) < 5 {
+			return protocol.MakeErrReply("ERR wrong number of arguments for 'prepare' command")
+		}
+		ms, err := strconv.ParseInt(string(cmdLine[3]), 10, 64)
+		if err != nil || ms <= 0 {
+			return protocol.MakeErrReply("ERR invalid timeout")
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		cmdLine = cmdLine[2:]
+	}
 	// MSET
 	cmdName := strings.ToLower(string(cmdLine[2]))
+	if _, err := txCmdLines(cmdLine[2:]); err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
 	// 创建新的事务
 	tx := NewTransaction(cluster, c, txID, cmdLine[2:])
+	tx.timeout = timeout
 	// 在节点上记录该事务
 	cluster.transactions.Put(txID, tx)
 	err := tx.prepare()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
+	if cluster.journal != nil {
+		// transaction must be durable before coordinator takes it as prepared
+		if err := cluster.journal.prepare(tx); err != nil {
+			tx.mu.Lock()
+			_ = tx.rollbackWithLock()
+			tx.mu.Unlock()
+			return protocol.MakeErrReply("ERR write tx journal failed: " + err.Error())
+		}
+	}
 	prepareFunc, ok := prepareFuncMap[cmdName]
 	if ok {
 		return prepareFunc(cluster, c, cmdLine[2:])
@@ -163,12 +247,16 @@ func execRollback(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.R
 
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
+	if tx.status == rolledBackStatus {
+		// rollback is re-delivered by coordinator retrying
+		return protocol.MakeIntReply(1)
+	}
 	err := tx.rollbackWithLock()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
 	// clean transaction
-	timewheel.Delay(waitBeforeCleanTx, "", func() {
+	timewheel.Delay(retainTime(), "", func() {
 		cluster.transactions.Remove(tx.id)
 	})
 	return protocol.MakeIntReply(1)
@@ -190,68 +278,148 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 	// 执行者在 commit 阶段可能收到协调者发来的回滚命令，需要避免一个协程在提交另一个协程在回滚造成异常
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
+	if tx.status == rolledBackStatus {
+		// transaction has been reaped, coordinator should rollback the others
+		return protocol.MakeErrReply(txAborted + " transaction " + txID + " has been rolled back")
+	}
+	if tx.status == committedStatus {
+		// commit is re-delivered by coordinator retrying, the commands mustn't be executed again
+		return tx.committed
+	}
 
 	// ExecWithLock 自己不会锁定相关 key, 需要调用方提供锁
 	// 由于在 prepare 阶段相关 key 已经被锁定，所以使用 ExecWithLock 即可
-	result := cluster.db.ExecWithLock(c, tx.cmdLine)
+	var result redis.Reply
+	cmdName := strings.ToLower(string(tx.cmdLine[0]))
+	if flushCommands[cmdName] {
+		// flush replaces whole databases instead of writing keys, it can't be undone once committed
+		result = cluster.db.Exec(c, tx.cmdLine)
+	} else if cmdName == relayMulti {
+		// errors of commands in MULTI are replied to client instead of failing the transaction
+		replies := make([]redis.Reply, len(tx.cmdLines))
+		for i, line := range tx.cmdLines {
+			replies[i] = cluster.db.ExecWithLock(c, line)
+		}
+		result = encodeMultiRawReply(protocol.MakeMultiRawReply(replies))
+	} else {
+		result = cluster.db.ExecWithLock(c, tx.cmdLine)
+	}
 
 	if protocol.IsErrorReply(result) {
 		// failed
 		// 提交失败本地回滚并向协调者返回错误
 		err2 := tx.rollbackWithLock()
-		return protocol.MakeErrReply(fmt.Sprintf("err occurs when rollback: %v, origin err: %s", err2, result))
+		return protocol.MakeErrReply(fmt.Sprintf(txAborted+" err occurs when rollback: %v, origin err: %s", err2, result))
 	}
 	// after committed
 	// 提交完成，解锁相关key
 	tx.unLockKeys()
 	tx.status = committedStatus
+	tx.committed = result
+	if cluster.journal != nil {
+		cluster.journal.finish(journalCommit, tx.id)
+	}
 
 	// clean finished transaction
 	// do not clean immediately, in case rollback
 	// 通过时间轮延时清理事务上下文
 	// 由于协调者可能在提交完成后要求回滚事务，所以不能立即进行清理
-	timewheel.Delay(waitBeforeCleanTx, "", func() {
+	timewheel.Delay(retainTime(), "", func() {
 		cluster.transactions.Remove(tx.id)
 	})
 	return result
 }
 
-// requestCommit commands all node to commit transaction as coordinator
-func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) ([]redis.Reply, protocol.ErrorReply) {
-	var errReply protocol.ErrorReply
-	txIDStr := strconv.FormatInt(txID, 10)
-	respList := make([]redis.Reply, 0, len(groupMap))
-	for node := range groupMap {
-		var resp redis.Reply
-		if node == cluster.self {
-			resp = execCommit(cluster, c, makeArgs("commit", txIDStr))
-		} else {
-			resp = cluster.relay(node, c, makeArgs("commit", txIDStr))
+// sendTxPhase sends commit or rollback to participant, participants handle re-delivered commit and rollback
+// idempotently, so it is retried with exponential backoff unless participant aborted the transaction
+func (cluster *Cluster) sendTxPhase(node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if node == cluster.self {
+		if strings.ToLower(string(cmdLine[0])) == "commit" {
+			return execCommit(cluster, c, cmdLine)
 		}
-		if protocol.IsErrorReply(resp) {
-			errReply = resp.(protocol.ErrorReply)
-			break
+		return execRollback(cluster, c, cmdLine)
+	}
+	var resp redis.Reply
+	backoff := txRetryBackoff
+	for i := 0; i < txRetries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		resp = cluster.relay(node, c, cmdLine)
+		if errReply, ok := resp.(protocol.ErrorReply); !ok || strings.HasPrefix(errReply.Error(), txAborted) {
+			return resp
+		}
+	}
+	return resp
+}
+
+// requestCommit commands all node to commit transaction concurrently as coordinator, it returns node -> reply of
+// commit. If any node failed to commit, committed nodes are rolled back and the error describes which nodes are involved
+func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) (map[string]redis.Reply, protocol.ErrorReply) {
+	txIDStr := strconv.FormatInt(txID, 10)
+	cluster.decide(txIDStr, committedStatus)
+	respList := fanOut(groupMap, func(node string, keys []string) redis.Reply {
+		return cluster.sendTxPhase(node, c, makeArgs("commit", txIDStr))
+	})
+	failed, resp := firstError(respList)
+	if resp == nil {
+		return respList, nil
+	}
+	committed := make(map[string]redis.Reply, len(respList))
+	for node, reply := range respList {
+		if !protocol.IsErrorReply(reply) {
+			committed[node] = reply
 		}
-		respList = append(respList, resp)
 	}
-	if errReply != nil {
-		requestRollback(cluster, c, txID, groupMap)
+	failures := requestRollback(cluster, c, txID, groupMap)
+	errReply := resp.(protocol.ErrorReply)
+	if len(committed) == 0 && len(failures) == 0 {
 		return nil, errReply
 	}
-	return respList, nil
+	return nil, makePartialCommitErr(txIDStr, failed, errReply, committed, failures)
+}
+
+// makePartialCommitErr describes transaction failed to commit after some nodes committed
+func makePartialCommitErr(txID string, failed string, cause protocol.ErrorReply,
+	committed map[string]redis.Reply, rollbackFailures map[string]redis.Reply) protocol.ErrorReply {
+	var builder strings.Builder
+	builder.WriteString("ERR transaction " + txID + " failed to commit on " + failed + ": " + cause.Error())
+	if len(committed) > 0 {
+		nodes := make([]string, 0, len(committed))
+		for node := range committed {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		builder.WriteString(", rolled back " + strings.Join(nodes, " "))
+	}
+	if len(rollbackFailures) > 0 {
+		nodes := make([]string, 0, len(rollbackFailures))
+		for node := range rollbackFailures {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		builder.WriteString(", failed to rollback " + strings.Join(nodes, " "))
+	}
+	return protocol.MakeErrReply(builder.String())
 }
 
-// requestRollback requests all node rollback transaction as coordinator
+// requestRollback requests all node rollback transaction concurrently as coordinator, it returns node -> error of nodes failed
+// to rollback, transactions on them are finished by their reaper later
 // groupMap: node -> keys
-func requestRollback(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) {
+func requestRollback(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) map[string]redis.Reply {
 	txIDStr := strconv.FormatInt(txID, 10)
-	for node := range groupMap {
-		if node == cluster.self {
-			execRollback(cluster, c, makeArgs("rollback", txIDStr))
-		} else {
-			cluster.relay(node, c, makeArgs("rollback", txIDStr))
+	cluster.decide(txIDStr, rolledBackStatus)
+	replies := fanOut(groupMap, func(node string, keys []string) redis.Reply {
+		return cluster.sendTxPhase(node, c, makeArgs("rollback", txIDStr))
+	})
+	failures := make(map[string]redis.Reply)
+	for node, resp := range replies {
+		if protocol.IsErrorReply(resp) {
+			failures[node] = resp
 		}
 	}
+	return failures
 }
 
 func (cluster *Cluster) relayPrepare(node string, c redis.Connection, cmdLine CmdLine) redis.Reply {
@@ -1,11 +1,16 @@
 package cluster
 
 import (
+	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"math/rand"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRollback(t *testing.T) {
@@ -45,3 +50,199 @@ func TestRollback(t *testing.T) {
 	ret = testNodeA.Exec(conn, toArgs("GET", "a"))
 	asserts.AssertBulkReply(t, ret, "a")
 }
+
+func TestJournal(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterTxJournal = filepath.Join(t.TempDir(), "tx.journal")
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterTxJournal = ""
+		})
+	}()
+	node := MakeTestCluster(nil)
+	conn := new(connection.FakeConn)
+	node.Exec(conn, toArgs("SET", "a", "a"))
+	ret := execPrepare(node, conn, toArgs("Prepare", "1", "DEL", "a"))
+	asserts.AssertNotError(t, ret)
+	ret = execPrepare(node, conn, toArgs("Prepare", "2", "SET", "b", "b"))
+	asserts.AssertNotError(t, ret)
+	ret = execCommit(node, conn, toArgs("commit", "2"))
+	asserts.AssertNotError(t, ret)
+	ret = execPrepare(node, conn, toArgs("Prepare", "3", "SET", "c", "c"))
+	asserts.AssertNotError(t, ret)
+	ret = execRollback(node, conn, toArgs("rollback", "3"))
+	asserts.AssertIntReply(t, ret, 1)
+	node.Close()
+
+	// transaction prepared before restart is held again, and could be committed by coordinator
+	node = MakeTestCluster(nil)
+	defer node.Close()
+	for _, txID := range []string{"2", "3"} {
+		if _, ok := node.transactions.Get(txID); ok {
+			t.Errorf("finished transaction %s should not be recovered", txID)
+		}
+	}
+	raw, ok := node.transactions.Get("1")
+	if !ok {
+		t.Fatal("prepared transaction should be recovered")
+	}
+	if tx := raw.(*Transaction); tx.status != preparedStatus || !tx.keysLocked {
+		t.Errorf("recovered transaction should be prepared and hold its keys")
+	}
+	ret = execCommit(node, conn, toArgs("commit", "1"))
+	asserts.AssertNotError(t, ret)
+	ret = node.Exec(conn, toArgs("SET", "a", "a2"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	if len(node.journal.pending) != 0 {
+		t.Errorf("no transaction should be pending, actually %d", len(node.journal.pending))
+	}
+}
+
+func TestReap(t *testing.T) {
+	conn := new(connection.FakeConn)
+	expire := func(node *Cluster, txID string) *Transaction {
+		raw, ok := node.transactions.Get(txID)
+		if !ok {
+			t.Fatalf("transaction %s not found", txID)
+		}
+		tx := raw.(*Transaction)
+		tx.mu.Lock()
+		tx.deadline = time.Now()
+		tx.mu.Unlock()
+		return tx
+	}
+
+	// orphan is rolled back if no participant committed it, and coordinator can't commit it later
+	testNodeA.db.Exec(conn, toArgs("SET", "reap1", "a"))
+	txID := strconv.FormatInt(rand.Int63(), 10)
+	ret := execPrepare(testNodeA, conn, toArgs("Prepare", txID, "DEL", "reap1"))
+	asserts.AssertNotError(t, ret)
+	rolledBack := atomic.LoadInt64(&testNodeA.reapedRolledBack)
+	testNodeA.reapOrphans()
+	if tx := expire(testNodeA, txID); tx.status != preparedStatus {
+		t.Error("transaction prepared recently should not be reaped")
+	}
+	testNodeA.reapOrphans()
+	if atomic.LoadInt64(&testNodeA.reapedRolledBack) != rolledBack+1 {
+		t.Error("orphan transaction should be rolled back")
+	}
+	ret = execCommit(testNodeA, conn, toArgs("commit", txID))
+	asserts.AssertErrReply(t, ret, txAborted+" transaction "+txID+" has been rolled back")
+	ret = testNodeA.db.Exec(conn, toArgs("GET", "reap1"))
+	asserts.AssertBulkReply(t, ret, "a")
+
+	// orphan is committed if another participant committed it
+	txID = strconv.FormatInt(rand.Int63(), 10)
+	ret = execPrepare(testNodeA, conn, toArgs("Prepare", txID, "SET", "reap2", "a"))
+	asserts.AssertNotError(t, ret)
+	ret = execPrepare(testNodeB, conn, toArgs("Prepare", txID, "SET", "reap3", "b"))
+	asserts.AssertNotError(t, ret)
+	ret = execCommit(testNodeB, conn, toArgs("commit", txID))
+	asserts.AssertNotError(t, ret)
+	committed := atomic.LoadInt64(&testNodeA.reapedCommitted)
+	expire(testNodeA, txID)
+	testNodeA.reapOrphans()
+	if atomic.LoadInt64(&testNodeA.reapedCommitted) != committed+1 {
+		t.Error("orphan transaction should be committed")
+	}
+	ret = testNodeA.db.Exec(conn, toArgs("GET", "reap2"))
+	asserts.AssertBulkReply(t, ret, "a")
+	ret = execTxStatus(testNodeA, conn, toArgs(relayTxStatus, txID))
+	asserts.AssertBulkReply(t, ret, "committed")
+}
+
+func TestPrepareTimeout(t *testing.T) {
+	conn := new(connection.FakeConn)
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterTxLockTimeout = 500
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterTxLockTimeout = 0
+		})
+	}()
+	if lockTime() != 500*time.Millisecond || retainTime() != time.Second {
+		t.Errorf("lock time and retain time should follow config, actually %v and %v", lockTime(), retainTime())
+	}
+	txID := strconv.FormatInt(rand.Int63(), 10)
+	ret := execPrepare(testNodeA, conn, toArgs("Prepare", txID, "TIMEOUT", "abc", "SET", "timeout1", "a"))
+	asserts.AssertErrReply(t, ret, "ERR invalid timeout")
+	ret = execPrepare(testNodeA, conn, makePrepareArgs(txID, txTimeout(3), "SET", "timeout1", "a"))
+	asserts.AssertNotError(t, ret)
+	raw, _ := testNodeA.transactions.Get(txID)
+	tx := raw.(*Transaction)
+	tx.mu.Lock()
+	if tx.timeout != 1500*time.Millisecond || time.Until(tx.deadline) <= lockTime() {
+		t.Errorf("transaction should be held for timeout given by coordinator, actually %v", tx.timeout)
+	}
+	tx.mu.Unlock()
+	ret = execCommit(testNodeA, conn, toArgs("commit", txID))
+	asserts.AssertNotError(t, ret)
+	ret = testNodeA.db.Exec(conn, toArgs("GET", "timeout1"))
+	asserts.AssertBulkReply(t, ret, "a")
+}
+
+func TestCommitRedelivery(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeA.db.Exec(conn, toArgs("SET", "redeliver", "1"))
+	txID := strconv.FormatInt(rand.Int63(), 10)
+	ret := execPrepare(testNodeA, conn, toArgs("Prepare", txID, "INCR", "redeliver"))
+	asserts.AssertNotError(t, ret)
+	ret = execCommit(testNodeA, conn, toArgs("commit", txID))
+	asserts.AssertIntReply(t, ret, 2)
+	// re-delivered commit replies the same result without executing again
+	ret = execCommit(testNodeA, conn, toArgs("commit", txID))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeA.db.Exec(conn, toArgs("GET", "redeliver"))
+	asserts.AssertBulkReply(t, ret, "2")
+
+	// re-delivered rollback restores nothing twice
+	txID = strconv.FormatInt(rand.Int63(), 10)
+	ret = execPrepare(testNodeA, conn, toArgs("Prepare", txID, "DEL", "redeliver"))
+	asserts.AssertNotError(t, ret)
+	ret = execRollback(testNodeA, conn, toArgs("rollback", txID))
+	asserts.AssertIntReply(t, ret, 1)
+	testNodeA.db.Exec(conn, toArgs("SET", "redeliver", "3"))
+	ret = execRollback(testNodeA, conn, toArgs("rollback", txID))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeA.db.Exec(conn, toArgs("GET", "redeliver"))
+	asserts.AssertBulkReply(t, ret, "3")
+}
+
+func TestPartialCommit(t *testing.T) {
+	backoff := txRetryBackoff
+	txRetryBackoff = time.Millisecond
+	defer func() {
+		txRetryBackoff = backoff
+	}()
+	conn := new(connection.FakeConn)
+	addrB := testNodeB.self
+	keyA, keyB := "partial", "partial"+addrB
+	testNodeA.db.Exec(conn, toArgs("SET", keyA, "a"))
+	txID := rand.Int63()
+	txIDStr := strconv.FormatInt(txID, 10)
+	groupMap := testNodeA.groupBy([]string{keyA, keyB})
+	ret := execPrepare(testNodeA, conn, toArgs("Prepare", txIDStr, "SET", keyA, "b"))
+	asserts.AssertNotError(t, ret)
+	ret = execPrepare(testNodeB, conn, toArgs("Prepare", txIDStr, "SET", keyB, "b"))
+	asserts.AssertNotError(t, ret)
+
+	*simulateBTimout = true
+	_, errReply := requestCommit(testNodeA, conn, txID, groupMap)
+	*simulateBTimout = false
+	if errReply == nil {
+		t.Fatal("commit should fail if a participant is unreachable")
+	}
+	msg := errReply.Error()
+	if !strings.HasPrefix(msg, "ERR transaction "+txIDStr+" failed to commit on "+addrB+": ERR timeout") ||
+		!strings.HasSuffix(msg, "failed to rollback "+addrB) {
+		t.Errorf("error should describe nodes failed, actually %s", msg)
+	}
+	ret = testNodeA.db.Exec(conn, toArgs("GET", keyA))
+	asserts.AssertBulkReply(t, ret, "a")
+	// participant missed rollback learns outcome from coordinator
+	ret = execTxStatus(testNodeA, conn, toArgs(relayTxStatus, txIDStr))
+	asserts.AssertBulkReply(t, ret, "rolledback")
+	execRollback(testNodeB, conn, toArgs("rollback", txIDStr))
+}
@@ -0,0 +1,359 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// clusterBusPortOffset is the offset of cluster bus port reported by CLUSTER NODES, like redis cluster
+const clusterBusPortOffset = 10000
+
+// execCluster handles CLUSTER subcommands about slots of cluster, which are required by cluster-aware clients
+// and resharding tools
+func execCluster(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	// membership could be changed in both modes
+	switch subCmd {
+	case "meet":
+		return execMeet(cluster, args)
+	case "forget":
+		return execForget(cluster, args)
+	}
+	slots, ok := cluster.peerPicker.(*slotmap.Map)
+	if !ok {
+		return protocol.MakeErrReply("ERR CLUSTER commands are only supported in slots mode")
+	}
+	switch subCmd {
+	case "setslot":
+		return cluster.setSlot(c, slots, args[2:])
+	case "keyslot":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return protocol.MakeIntReply(int64(slotmap.HashSlot(string(args[2]))))
+	case "countkeysinslot":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|countkeysinslot")
+		}
+		return cluster.db.Exec(c, makeArgs("CountKeysInSlot", string(args[2])))
+	case "getkeysinslot":
+		if len(args) != 4 {
+			return protocol.MakeArgNumErrReply("cluster|getkeysinslot")
+		}
+		return cluster.db.Exec(c, makeArgs("GetKeysInSlot", string(args[2]), string(args[3])))
+	case "replicate":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|replicate")
+		}
+		return cluster.replicate(slots, string(args[2]))
+	}
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("cluster|" + subCmd)
+	}
+	switch subCmd {
+	case "myid":
+		return protocol.MakeBulkReply([]byte(nodeID(cluster.self)))
+	case "info":
+		return cluster.clusterInfo(slots)
+	case "nodes":
+		return cluster.clusterNodes(slots)
+	case "slots":
+		return cluster.clusterSlots(slots)
+	case "shards":
+		return cluster.clusterShards(c, slots)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[1]) + "'. Try CLUSTER HELP.")
+}
+
+// setSlot changes state of slot for migration, it should be sent to nodes involved.
+// usage: CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE node-id, or CLUSTER SETSLOT slot STABLE
+func (cluster *Cluster) setSlot(c redis.Connection, slots *slotmap.Map, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster|setslot")
+	}
+	slot, err := strconv.Atoi(string(args[0]))
+	if err != nil || slot < 0 || slot >= slotmap.SlotCount {
+		return protocol.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		if len(args) != 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		slots.SetMigrating(slot, "")
+		slots.SetImporting(slot, "")
+		return protocol.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	node := nodeByID(slots, string(args[2]))
+	if node == "" {
+		return protocol.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	owner := slots.GetSlotNode(slot)
+	switch action {
+	case "migrating":
+		if owner != cluster.self {
+			return protocol.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(slot))
+		}
+		if node == cluster.self {
+			return protocol.MakeErrReply("ERR I can't migrate slot " + strconv.Itoa(slot) + " to myself")
+		}
+		slots.SetMigrating(slot, node)
+	case "importing":
+		if owner == cluster.self {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(slot))
+		}
+		if node == cluster.self {
+			return protocol.MakeErrReply("ERR I can't import slot " + strconv.Itoa(slot) + " from myself")
+		}
+		slots.SetImporting(slot, node)
+	case "node":
+		// keys must be migrated before the slot is handed over, otherwise they are unreachable
+		if owner == cluster.self && node != cluster.self {
+			if n, ok := cluster.db.Exec(c, makeArgs("CountKeysInSlot", strconv.Itoa(slot))).(*protocol.IntReply); ok && n.Code > 0 {
+				return protocol.MakeErrReply("ERR Can't assign hashslot " + strconv.Itoa(slot) +
+					" to a different node while I still hold keys for this hash slot.")
+			}
+		}
+		if cluster.meta != nil {
+			return cluster.proposeMeta(&metaChange{Kind: metaAssign, Node: node, Begin: slot, End: slot})
+		}
+		_ = slots.Assign(node, slot, slot)
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	return protocol.MakeOkReply()
+}
+
+// nodeByID returns address of node with the id, it returns empty string if the node is unknown
+func nodeByID(slots *slotmap.Map, id string) string {
+	for _, node := range slots.Nodes() {
+		if nodeID(node) == id {
+			return node
+		}
+	}
+	return ""
+}
+
+// nodeID returns id of node derived from its address, so every node finds the same id without exchanging them
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// announceAddr returns address of self known by other nodes, host and port of local address are replaced by
+// cluster-announce-ip and cluster-announce-port if set
+func announceAddr(local string) string {
+	if config.Properties().ClusterAnnounceIP == "" && config.Properties().ClusterAnnouncePort <= 0 {
+		return local
+	}
+	host, port := splitAddr(local)
+	if config.Properties().ClusterAnnounceIP != "" {
+		host = config.Properties().ClusterAnnounceIP
+	}
+	if config.Properties().ClusterAnnouncePort > 0 {
+		port = config.Properties().ClusterAnnouncePort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// replicaOf returns master of node if it is a replica, otherwise empty string.
+// Replicas of peers are known by gossip, only self is known if gossip is disabled
+func (cluster *Cluster) replicaOf(node string) string {
+	if cluster.gossip != nil {
+		return cluster.gossip.masterOf(node)
+	}
+	if node != cluster.self {
+		return ""
+	}
+	return cluster.db.MasterAddr()
+}
+
+func (cluster *Cluster) clusterInfo(slots *slotmap.Map) redis.Reply {
+	unassigned := slots.Unassigned()
+	size, pfailSlots, failSlots := 0, 0, 0
+	nodes := slots.Nodes()
+	for _, node := range nodes {
+		ranges := slots.GetNodeSlots(node)
+		if len(ranges) > 0 {
+			size++
+		}
+		count := 0
+		for _, r := range ranges {
+			count += r[1] - r[0] + 1
+		}
+		switch cluster.nodeState(node) {
+		case nodePFail:
+			pfailSlots += count
+		case nodeFail:
+			failSlots += count
+		}
+	}
+	state := "ok"
+	if unassigned > 0 || failSlots > 0 {
+		state = "fail"
+	}
+	assigned := slotmap.SlotCount - unassigned
+	lines := []string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		"cluster_slots_assigned:" + strconv.Itoa(assigned),
+		"cluster_slots_ok:" + strconv.Itoa(assigned-pfailSlots-failSlots),
+		"cluster_slots_pfail:" + strconv.Itoa(pfailSlots),
+		"cluster_slots_fail:" + strconv.Itoa(failSlots),
+		"cluster_known_nodes:" + strconv.Itoa(len(nodes)),
+		"cluster_size:" + strconv.Itoa(size),
+		"cluster_current_epoch:0",
+		"cluster_my_epoch:0",
+	}
+	lines = append(lines, cluster.txInfo()...)
+	return protocol.MakeBulkReply([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+// clusterNodes describes nodes in the format of redis cluster:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func (cluster *Cluster) clusterNodes(slots *slotmap.Map) redis.Reply {
+	var builder strings.Builder
+	for _, node := range slots.Nodes() {
+		host, port := splitAddr(node)
+		flags, master := "master", "-"
+		if masterAddr := cluster.replicaOf(node); masterAddr != "" {
+			flags, master = "slave", nodeID(masterAddr)
+		}
+		if node == cluster.self {
+			flags = "myself," + flags
+		}
+		linkState := "connected"
+		switch cluster.nodeState(node) {
+		case nodePFail:
+			flags, linkState = flags+",fail?", "disconnected"
+		case nodeFail:
+			flags, linkState = flags+",fail", "disconnected"
+		}
+		builder.WriteString(nodeID(node) + " " + host + ":" + strconv.Itoa(port) + "@" +
+			strconv.Itoa(port+clusterBusPortOffset) + " " + flags + " " + master + " 0 0 0 " + linkState)
+		for _, r := range slots.GetNodeSlots(node) {
+			builder.WriteString(" " + formatSlotRange(r))
+		}
+		// only nodes involved report slots being migrated
+		if node == cluster.self {
+			for slot := 0; slot < slotmap.SlotCount; slot++ {
+				if target := slots.GetMigrating(slot); target != "" {
+					builder.WriteString(" [" + strconv.Itoa(slot) + "->-" + nodeID(target) + "]")
+				}
+				if source := slots.GetImporting(slot); source != "" {
+					builder.WriteString(" [" + strconv.Itoa(slot) + "-<-" + nodeID(source) + "]")
+				}
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+func formatSlotRange(r [2]int) string {
+	if r[0] == r[1] {
+		return strconv.Itoa(r[0])
+	}
+	return strconv.Itoa(r[0]) + "-" + strconv.Itoa(r[1])
+}
+
+// shardNodes returns the node owning slots, followed by its replicas
+func (cluster *Cluster) shardNodes(node string) []string {
+	nodes := []string{node}
+	for _, n := range cluster.getNodes() {
+		if n != node && cluster.replicaOf(n) == node {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// clusterSlots replies [begin, end, [ip, port, id], replicas...] for each slot range
+func (cluster *Cluster) clusterSlots(slots *slotmap.Map) redis.Reply {
+	var replies []redis.Reply
+	for _, node := range slots.Nodes() {
+		for _, r := range slots.GetNodeSlots(node) {
+			entry := []redis.Reply{protocol.MakeIntReply(int64(r[0])), protocol.MakeIntReply(int64(r[1]))}
+			for _, n := range cluster.shardNodes(node) {
+				host, port := splitAddr(n)
+				entry = append(entry, protocol.MakeMultiRawReply([]redis.Reply{
+					protocol.MakeBulkReply([]byte(host)),
+					protocol.MakeIntReply(int64(port)),
+					protocol.MakeBulkReply([]byte(nodeID(n))),
+				}))
+			}
+			replies = append(replies, protocol.MakeMultiRawReply(entry))
+		}
+	}
+	if len(replies) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// clusterShards replies slot ranges and nodes of each shard
+func (cluster *Cluster) clusterShards(c redis.Connection, slots *slotmap.Map) redis.Reply {
+	resp3 := c != nil && c.GetProtocol() == 3
+	var replies []redis.Reply
+	for _, node := range slots.Nodes() {
+		ranges := slots.GetNodeSlots(node)
+		if len(ranges) == 0 {
+			continue
+		}
+		slotReplies := make([]redis.Reply, 0, 2*len(ranges))
+		for _, r := range ranges {
+			slotReplies = append(slotReplies, protocol.MakeIntReply(int64(r[0])), protocol.MakeIntReply(int64(r[1])))
+		}
+		var nodeReplies []redis.Reply
+		for _, n := range cluster.shardNodes(node) {
+			host, port := splitAddr(n)
+			role := "master"
+			if n != node {
+				role = "replica"
+			}
+			health := "online"
+			if cluster.nodeState(n) != nodeOk {
+				health = "failed"
+			}
+			nodeReplies = append(nodeReplies, protocol.MakeMapReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("id")), protocol.MakeBulkReply([]byte(nodeID(n))),
+				protocol.MakeBulkReply([]byte("port")), protocol.MakeIntReply(int64(port)),
+				protocol.MakeBulkReply([]byte("ip")), protocol.MakeBulkReply([]byte(host)),
+				protocol.MakeBulkReply([]byte("endpoint")), protocol.MakeBulkReply([]byte(host)),
+				protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte(role)),
+				protocol.MakeBulkReply([]byte("replication-offset")), protocol.MakeIntReply(0),
+				protocol.MakeBulkReply([]byte("health")), protocol.MakeBulkReply([]byte(health)),
+			}, resp3))
+		}
+		replies = append(replies, protocol.MakeMapReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slots")), protocol.MakeMultiRawReply(slotReplies),
+			protocol.MakeBulkReply([]byte("nodes")), protocol.MakeMultiRawReply(nodeReplies),
+		}, resp3))
+	}
+	if len(replies) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strings"
+	"testing"
+)
+
+func TestClusterCommand(t *testing.T) {
+	conn := &connection.FakeConn{}
+	result := testNodeA.Exec(conn, toArgs("CLUSTER", "SLOTS"))
+	asserts.AssertErrReply(t, result, "ERR CLUSTER commands are only supported in slots mode")
+
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{"127.0.0.1:6399 0-8191", "127.0.0.1:6400 8192-16000"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+		})
+	}()
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400"})
+	defer cluster.Close()
+	selfID, peerID := nodeID("127.0.0.1:6399"), nodeID("127.0.0.1:6400")
+	asserts.AssertBulkReply(t, cluster.Exec(conn, toArgs("CLUSTER", "MYID")), selfID)
+
+	info := string(cluster.Exec(conn, toArgs("CLUSTER", "INFO")).(*protocol.BulkReply).Arg)
+	for _, line := range []string{"cluster_state:fail", "cluster_slots_assigned:16001", "cluster_known_nodes:2"} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Errorf("CLUSTER INFO should contain %s, actually %s", line, info)
+		}
+	}
+
+	nodes := string(cluster.Exec(conn, toArgs("CLUSTER", "NODES")).(*protocol.BulkReply).Arg)
+	expected := selfID + " 127.0.0.1:6399@16399 myself,master - 0 0 0 connected 0-8191\n" +
+		peerID + " 127.0.0.1:6400@16400 master - 0 0 0 connected 8192-16000\n"
+	if nodes != expected {
+		t.Errorf("expected CLUSTER NODES %q, actually %q", expected, nodes)
+	}
+
+	slotEntry := func(begin, end int64, port int64, id string) redis.Reply {
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeIntReply(begin), protocol.MakeIntReply(end),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("127.0.0.1")), protocol.MakeIntReply(port), protocol.MakeBulkReply([]byte(id)),
+			}),
+		})
+	}
+	expectedSlots := protocol.MakeMultiRawReply([]redis.Reply{
+		slotEntry(0, 8191, 6399, selfID),
+		slotEntry(8192, 16000, 6400, peerID),
+	})
+	slots := cluster.Exec(conn, toArgs("CLUSTER", "SLOTS"))
+	if string(slots.ToBytes()) != string(expectedSlots.ToBytes()) {
+		t.Errorf("expected CLUSTER SLOTS %q, actually %q", expectedSlots.ToBytes(), slots.ToBytes())
+	}
+
+	shards, ok := cluster.Exec(conn, toArgs("CLUSTER", "SHARDS")).(*protocol.MultiRawReply)
+	if !ok || len(shards.Replies) != 2 {
+		t.Fatalf("there should be 2 shards")
+	}
+	shard := shards.Replies[1].(*protocol.MapReply)
+	asserts.AssertBulkReply(t, shard.Pairs[0], "slots")
+	if string(shard.Pairs[1].ToBytes()) != "*2\r\n:8192\r\n:16000\r\n" {
+		t.Errorf("wrong slots of shard: %q", shard.Pairs[1].ToBytes())
+	}
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("CLUSTER", "FOO")), "ERR unknown subcommand 'FOO'. Try CLUSTER HELP.")
+}
+
+func TestKeysInSlot(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterHashMode = slotMode
+		p.ClusterSlots = []string{"127.0.0.1:6399 0-8191", "127.0.0.1:6400 8192-16383"}
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterHashMode = ""
+			p.ClusterSlots = nil
+		})
+	}()
+	cluster := MakeTestCluster([]string{"127.0.0.1:6400"})
+	defer cluster.Close()
+	conn := &connection.FakeConn{}
+	asserts.AssertIntReply(t, cluster.Exec(conn, toArgs("CLUSTER", "KEYSLOT", "{user1}:name")), 8106)
+	for _, key := range []string{"{user1}:name", "{user1}:age"} {
+		asserts.AssertStatusReply(t, cluster.Exec(conn, toArgs("SET", key, "1")), "OK")
+	}
+	asserts.AssertIntReply(t, cluster.Exec(conn, toArgs("CLUSTER", "COUNTKEYSINSLOT", "8106")), 2)
+	asserts.AssertMultiBulkReplySize(t, cluster.Exec(conn, toArgs("CLUSTER", "GETKEYSINSLOT", "8106", "1")), 1)
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("CLUSTER", "COUNTKEYSINSLOT", "abc")), "ERR Invalid slot")
+
+	peerID := nodeID("127.0.0.1:6400")
+	asserts.AssertErrReply(t, cluster.Exec(conn, toArgs("CLUSTER", "SETSLOT", "8106", "NODE", peerID)),
+		"ERR Can't assign hashslot 8106 to a different node while I still hold keys for this hash slot.")
+	cluster.Exec(conn, toArgs("DEL", "{user1}:name", "{user1}:age"))
+	asserts.AssertIntReply(t, cluster.Exec(conn, toArgs("CLUSTER", "COUNTKEYSINSLOT", "8106")), 0)
+	asserts.AssertStatusReply(t, cluster.Exec(conn, toArgs("CLUSTER", "SETSLOT", "8106", "NODE", peerID)), "OK")
+}
+
+func TestAnnounceAddr(t *testing.T) {
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ClusterAnnounceIP, p.ClusterAnnouncePort = "", 0
+		})
+	}()
+	if addr := announceAddr("127.0.0.1:6399"); addr != "127.0.0.1:6399" {
+		t.Errorf("expect local address if announce is not set, actually %s", addr)
+	}
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterAnnounceIP = "10.0.0.1"
+	})
+	if addr := announceAddr("0.0.0.0:6399"); addr != "10.0.0.1:6399" {
+		t.Errorf("expect 10.0.0.1:6399, actually %s", addr)
+	}
+	config.Update(func(p *config.ServerProperties) {
+		p.ClusterAnnouncePort = 30001
+	})
+	if addr := announceAddr("0.0.0.0:6399"); addr != "10.0.0.1:30001" {
+		t.Errorf("expect 10.0.0.1:30001, actually %s", addr)
+	}
+}
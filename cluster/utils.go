@@ -2,11 +2,17 @@ package cluster
 
 import (
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/consistenthash"
+	"github.com/hdt3213/godis/lib/slotmap"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
 )
 
+// crossSlotErr is replied if keys of a command can't be served together
+const crossSlotErr = "CROSSSLOT Keys in request don't hash to the same slot"
+
 func ping(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	return cluster.db.Exec(c, cmdLine)
 }
@@ -37,12 +43,43 @@ func (cluster *Cluster) groupBy(keys []string) map[string][]string {
 	return result
 }
 
+// sameSlot returns whether keys are in the same slot, or have the same partition key in consistent hash mode
+func (cluster *Cluster) sameSlot(keys []string) bool {
+	_, slotMode := cluster.peerPicker.(*slotmap.Map)
+	for _, key := range keys[1:] {
+		if slotMode && slotmap.HashSlot(key) != slotmap.HashSlot(keys[0]) {
+			return false
+		}
+		if !slotMode && consistenthash.PartitionKey(key) != consistenthash.PartitionKey(keys[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCrossSlot replies CROSSSLOT if cluster-strict-hash-tag is enabled and keys of commands are not in the same slot
+func (cluster *Cluster) checkCrossSlot(cmdLines ...CmdLine) protocol.ErrorReply {
+	if !config.Properties().ClusterStrictHashTag {
+		return nil
+	}
+	var keys []string
+	for _, cmdLine := range cmdLines {
+		writeKeys, readKeys := database.GetRelatedKeys(cmdLine)
+		keys = append(keys, writeKeys...)
+		keys = append(keys, readKeys...)
+	}
+	if len(keys) > 1 && !cluster.sameSlot(keys) {
+		return protocol.MakeErrReply(crossSlotErr)
+	}
+	return nil
+}
+
 func execSelect(c redis.Connection, args [][]byte) redis.Reply {
 	dbIndex, err := strconv.Atoi(string(args[1]))
 	if err != nil {
 		return protocol.MakeErrReply("ERR invalid DB index")
 	}
-	if dbIndex >= config.Properties.Databases || dbIndex < 0 {
+	if dbIndex >= config.Properties().Databases || dbIndex < 0 {
 		return protocol.MakeErrReply("ERR DB index is out of range")
 	}
 	c.SelectDB(dbIndex)
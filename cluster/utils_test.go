@@ -19,6 +19,17 @@ func (picker *mockPicker) AddNode(keys ...string) {
 	picker.nodes = append(picker.nodes, keys...)
 }
 
+func (picker *mockPicker) RemoveNode(keys ...string) {
+	for _, key := range keys {
+		for i, n := range picker.nodes {
+			if n == key {
+				picker.nodes = append(picker.nodes[:i], picker.nodes[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
 func (picker *mockPicker) PickNode(key string) string {
 	for _, n := range picker.nodes {
 		if strings.Contains(key, n) {
@@ -57,22 +68,28 @@ func makeMockRelay(peer *Cluster) (*bool, func(cluster *Cluster, node string, c
 			return execCommit(peer, c, cmdLine)
 		} else if cmdName == "rollback" {
 			return execRollback(peer, c, cmdLine)
+		} else if cmdName == relayTxStatus {
+			return execTxStatus(peer, c, cmdLine)
 		}
 		return peer.db.Exec(c, cmdLine)
 	}
 }
 
 func init() {
-	if config.Properties == nil {
-		config.Properties = &config.ServerProperties{}
+	if config.Properties() == nil {
+		config.SetProperties(&config.ServerProperties{})
 	}
 	addrA := "127.0.0.1:6399"
 	addrB := "127.0.0.1:7379"
-	config.Properties.Self = addrA
-	config.Properties.Peers = []string{addrB}
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = addrA
+		p.Peers = []string{addrB}
+	})
 	testNodeA = MakeCluster()
-	config.Properties.Self = addrB
-	config.Properties.Peers = []string{addrA}
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = addrB
+		p.Peers = []string{addrA}
+	})
 	testNodeB = MakeCluster()
 
 	simulateBTimout, testNodeA.relayImpl = makeMockRelay(testNodeB)
@@ -84,11 +101,13 @@ func init() {
 }
 
 func MakeTestCluster(peers []string) *Cluster {
-	if config.Properties == nil {
-		config.Properties = &config.ServerProperties{}
+	if config.Properties() == nil {
+		config.SetProperties(&config.ServerProperties{})
 	}
-	config.Properties.Self = "127.0.0.1:6399"
-	config.Properties.Peers = peers
+	config.Update(func(p *config.ServerProperties) {
+		p.Self = "127.0.0.1:6399"
+		p.Peers = peers
+	})
 	return MakeCluster()
 }
 
@@ -7,17 +7,23 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/hdt3213/godis/lib/logger"
 )
 
 // ServerProperties defines global config properties
 type ServerProperties struct {
-	Bind              string `cfg:"bind"`
-	Port              int    `cfg:"port"`
-	AppendOnly        bool   `cfg:"appendonly"`
-	AppendFilename    string `cfg:"appendfilename"`
-	MaxClients        int    `cfg:"maxclients"`
+	// Bind contains hosts separated by spaces, such as "127.0.0.1 ::1", server listens on port of all of them,
+	// or all interfaces if not set. If port is 0, a free port is chosen when server starts and Port is set to it
+	Bind           string `cfg:"bind"`
+	Port           int    `cfg:"port"`
+	AppendOnly     bool   `cfg:"appendonly"`
+	AppendFilename string `cfg:"appendfilename"`
+	// directory of multi-part aof files, use directory of appendfilename if not set
+	AppendDirname     string `cfg:"appenddirname"`
+	MaxClients        int    `cfg:"maxclients"` // clients beyond it are refused, use 10000 if not set
 	RequirePass       string `cfg:"requirepass"`
 	Databases         int    `cfg:"databases"`
 	RDBFilename       string `cfg:"dbfilename"`
@@ -25,25 +31,222 @@ type ServerProperties struct {
 	SlaveAnnouncePort int    `cfg:"slave-announce-port"`
 	SlaveAnnounceIP   string `cfg:"slave-announce-ip"`
 	ReplTimeout       int    `cfg:"repl-timeout"`
+	// rdb of full sync is streamed to slaves supporting it without being saved into disk if enabled
+	ReplDisklessSync bool `cfg:"repl-diskless-sync"`
+	// master pings slaves in this interval in seconds, so they won't time out when there is no write, use 10 if not set
+	ReplPingReplicaPeriod int `cfg:"repl-ping-replica-period"`
+	// size in bytes of backlog keeping recent commands for partial resync of reconnecting slaves, use 1mb if not set
+	ReplBacklogSize int `cfg:"repl-backlog-size"`
+	// replica rejects write commands from clients if enabled, it is enabled by default
+	ReplicaReadOnly bool `cfg:"replica-read-only"`
+	// master refuses write commands if there are fewer than min-replicas-to-write slaves
+	// whose latest ack is within min-replicas-max-lag seconds, 0 means no limit, and max lag is 10 if not set
+	MinReplicasToWrite int `cfg:"min-replicas-to-write"`
+	MinReplicasMaxLag  int `cfg:"min-replicas-max-lag"`
+
+	// aof is rewritten automatically once it grows by the percentage since the latest rewrite
+	// and is larger than min size in bytes, auto rewrite is disabled if percentage is 0
+	AutoAofRewritePercentage int `cfg:"auto-aof-rewrite-percentage"`
+	AutoAofRewriteMinSize    int `cfg:"auto-aof-rewrite-min-size"`
+	// rewritten aof starts with a rdb snapshot followed by commands if enabled
+	AofUseRdbPreamble bool `cfg:"aof-use-rdb-preamble"`
+	// incr files of aof contain annotations like #TS:1700000000 if enabled
+	AofTimestampEnabled bool `cfg:"aof-timestamp-enabled"`
+	// loading aof stops at the first timestamp annotation later than the unix timestamp, 0 means loading all.
+	// It is used for point-in-time recovery, such as recovering from an accidental FLUSHALL
+	AofTruncateToTimestamp int `cfg:"aof-truncate-to-timestamp"`
+	// incomplete command at the end of aof is discarded when loading if enabled, otherwise server refuses to start.
+	// It is enabled by default
+	AofLoadTruncated bool `cfg:"aof-load-truncated"`
+	// commands of different keys are applied by workers in parallel when loading aof,
+	// use number of cpu if not set, and 1 means loading serially
+	AofLoadWorkers int `cfg:"aof-load-workers"`
+	// commands are buffered in a queue before written by aof goroutine, use 65536 if queue size is not set.
+	// When queue is full, write commands block if backpressure is block (default),
+	// or are written into disk by themselves if backpressure is disk
+	AofQueueSize    int    `cfg:"aof-queue-size"`
+	AofBackpressure string `cfg:"aof-backpressure"`
+	// appendfsync is always, everysec (default) or no. If it is always, write commands reply after synced,
+	// and commands within the group commit window in microseconds are synced together
+	AppendFsync          string `cfg:"appendfsync"`
+	AofGroupCommitWindow int    `cfg:"aof-group-commit-window"`
+
+	// clients connecting tls-port are served over tls with certificate in tls-cert-file and tls-key-file.
+	// If tls-ca-cert-file is set, tls-auth-clients decides whether clients must present certificates signed by it,
+	// it is yes (default), optional or no. Plain tcp port is not listened if port is 0 and tls-port is set
+	TLSPort        int    `cfg:"tls-port"`
+	TLSCertFile    string `cfg:"tls-cert-file"`
+	TLSKeyFile     string `cfg:"tls-key-file"`
+	TLSCACertFile  string `cfg:"tls-ca-cert-file"`
+	TLSAuthClients string `cfg:"tls-auth-clients"`
+
+	// clients idle for more than timeout seconds are closed, 0 (default) means never.
+	// Subscribers and clients blocked by commands like BLPOP are not closed
+	Timeout int `cfg:"timeout"`
+
+	// on SHUTDOWN or SIGTERM, server waits up to shutdown-timeout seconds (10 if not set) for in-flight commands
+	// to finish and for slaves to acknowledge the latest writes
+	ShutdownTimeout int `cfg:"shutdown-timeout"`
+
+	// LogLevel is debug (default), verbose, notice or warning
+	LogLevel string `cfg:"loglevel"`
+
+	// ProtectedMode refuses clients not from loopback interface if neither bind nor requirepass is set, it is
+	// enabled if not set
+	ProtectedMode bool `cfg:"protected-mode"`
+
+	// requests exceeding these limits are refused and their connections are closed. proto-max-bulk-len is max size
+	// in bytes of a bulk string (512mb if not set), proto-max-multibulk-len is max count of arguments of a command
+	// (1048576 if not set), and proto-max-inline-len is max size in bytes of an inline command (64kb if not set)
+	ProtoMaxBulkLen      int `cfg:"proto-max-bulk-len"`
+	ProtoMaxMultiBulkLen int `cfg:"proto-max-multibulk-len"`
+	ProtoMaxInlineLen    int `cfg:"proto-max-inline-len"`
+
+	// rdb ends with crc64 checksum which is verified when loading if enabled (default). Otherwise, checksum is
+	// written as zero and is not verified
+	RDBChecksum bool `cfg:"rdbchecksum"`
+
+	// FLUSHDB and FLUSHALL without ASYNC or SYNC release data in background if enabled
+	LazyfreeLazyUserFlush bool `cfg:"lazyfree-lazy-user-flush"`
+
+	// max execution time of lua script in milliseconds, use 5000 if not set
+	LuaTimeLimit int `cfg:"lua-time-limit"`
+
+	// change data capture, write commands are published to message broker if cdc-address is set
+	CDCBroker       string `cfg:"cdc-broker"`
+	CDCAddress      string `cfg:"cdc-address"`
+	CDCSubject      string `cfg:"cdc-subject"`
+	CDCEncoder      string `cfg:"cdc-encoder"`
+	CDCQueueSize    int    `cfg:"cdc-queue-size"`
+	CDCBackpressure string `cfg:"cdc-backpressure"`
+
+	// rdb saved by SAVE/BGSAVE and base of rewritten aof are uploaded to backup target if it is set.
+	// backup-target is dir, s3 or gcs, gcs is accessed by its s3 compatible api with hmac keys.
+	// Backups beyond backup-retention of each kind are removed, 0 means keeping all.
+	// If backup-restore is enabled, the latest backup is downloaded on startup when there is no local data
+	BackupTarget    string `cfg:"backup-target"`
+	BackupDir       string `cfg:"backup-dir"`
+	BackupEndpoint  string `cfg:"backup-endpoint"`
+	BackupRegion    string `cfg:"backup-region"`
+	BackupBucket    string `cfg:"backup-bucket"`
+	BackupAccessKey string `cfg:"backup-access-key"`
+	BackupSecretKey string `cfg:"backup-secret-key"`
+	BackupPrefix    string `cfg:"backup-prefix"`
+	BackupRetention int    `cfg:"backup-retention"`
+	BackupRestore   bool   `cfg:"backup-restore"`
+
+	// thresholds of compact encodings, use default value of redis if not set
+	HashMaxListpackEntries int `cfg:"hash-max-listpack-entries"`
+	HashMaxListpackValue   int `cfg:"hash-max-listpack-value"`
+	SetMaxIntsetEntries    int `cfg:"set-max-intset-entries"`
+	SetMaxListpackEntries  int `cfg:"set-max-listpack-entries"`
+	SetMaxListpackValue    int `cfg:"set-max-listpack-value"`
+	ZSetMaxListpackEntries int `cfg:"zset-max-listpack-entries"`
+	ZSetMaxListpackValue   int `cfg:"zset-max-listpack-value"`
+	ListMaxListpackSize    int `cfg:"list-max-listpack-size"`
+
+	// server runs as sentinel monitoring masters given by sentinel-monitor instead of serving data if enabled.
+	// Each monitored master is "<name> <ip> <port> <quorum>", and masters are separated by comma.
+	// Master is subjectively down if it doesn't reply PING in sentinel-down-after-milliseconds, use 30000 if not set.
+	// Failover is aborted if not finished in sentinel-failover-timeout milliseconds, use 180000 if not set.
+	// Sentinel announces its address to other sentinels by sentinel-announce-ip or its local ip, and port
+	Sentinel                      bool     `cfg:"sentinel"`
+	SentinelMonitor               []string `cfg:"sentinel-monitor"`
+	SentinelDownAfterMilliseconds int      `cfg:"sentinel-down-after-milliseconds"`
+	SentinelFailoverTimeout       int      `cfg:"sentinel-failover-timeout"`
+	SentinelAnnounceIP            string   `cfg:"sentinel-announce-ip"`
 
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
+	// ClusterHashMode decides how keys are distributed among nodes, "consistent-hash" (default) or "slots".
+	// In slots mode keys are mapped to 16384 CRC16 slots like redis cluster, slots are divided evenly among nodes
+	// unless cluster-slots is set. Each entry of cluster-slots is a node followed by its slot ranges,
+	// such as "127.0.0.1:6379 0-8191,127.0.0.1:6380 8192-16383"
+	ClusterHashMode string   `cfg:"cluster-hash-mode"`
+	ClusterSlots    []string `cfg:"cluster-slots"`
+	// ClusterNodeWeights gives nodes more virtual nodes on consistent hash ring, so they own proportionally more keys.
+	// Each entry is a node followed by its weight, such as "127.0.0.1:6379 2", weight of other nodes is 1
+	ClusterNodeWeights []string `cfg:"cluster-node-weights"`
+	// ClusterRedirect makes node in slots mode reply MOVED or ASK to commands of keys served by other nodes,
+	// so that cluster-aware clients send commands to the right node, instead of relaying them
+	ClusterRedirect bool `cfg:"cluster-redirect"`
+	// ClusterStrictHashTag requires keys of a command or a transaction to be in the same slot, or to have the same
+	// hash tag in consistent hash mode, otherwise CROSSSLOT is replied instead of executing it across nodes by tcc.
+	// So keys accessed together stay together whatever nodes are added or removed
+	ClusterStrictHashTag bool `cfg:"cluster-strict-hash-tag"`
+	// ClusterGossip makes nodes exchange states of known nodes periodically, so that peers only need to contain
+	// some seed nodes and the others are discovered. A node is possibly failed if it doesn't reply in
+	// cluster-node-timeout milliseconds (15000 if not set), and failed once a majority of nodes agree on it.
+	ClusterGossip      bool `cfg:"cluster-gossip"`
+	ClusterNodeTimeout int  `cfg:"cluster-node-timeout"`
+	// ClusterRaft replicates changes of slot ownership, replication and failover among nodes in peers by raft,
+	// so every node applies them in the same order and they survive crashes. Raft log is saved in
+	// cluster-raft-file (cluster-raft-<port>.json if not set)
+	ClusterRaft     bool   `cfg:"cluster-raft"`
+	ClusterRaftFile string `cfg:"cluster-raft-file"`
+	// ClusterTxJournal is the file recording tcc transactions prepared by this node, transactions neither committed
+	// nor rolled back before restart are prepared again, so they are finished by coordinator or rolled back on timeout.
+	// Journal is disabled if it is empty
+	ClusterTxJournal string `cfg:"cluster-tx-journal"`
+	// ClusterTxLockTimeout is milliseconds a participant holds keys of prepared tcc transaction (3000 if not set),
+	// coordinator of transaction among many nodes gives a longer timeout. Transaction still prepared after timeout
+	// is finished by asking other participants. ClusterTxRetainTime is milliseconds a finished transaction is kept for
+	// rollback requests of coordinator, twice of lock timeout if not set
+	ClusterTxLockTimeout int `cfg:"cluster-tx-lock-timeout"`
+	ClusterTxRetainTime  int `cfg:"cluster-tx-retain-time"`
+	// ClusterPeerConns is count of connections to each peer (2 if not set), commands relayed to the peer concurrently
+	// are pipelined on them
+	ClusterPeerConns int `cfg:"cluster-peer-conns"`
+	// ClusterAnnounceIP and ClusterAnnouncePort replace host and port of self in the address known by other nodes and
+	// clients, for NAT or containers where self is not reachable by its local address. Cluster bus is reached on
+	// announced port+10000, and replicas in cluster announce them to master unless slave-announce-* is set
+	ClusterAnnounceIP   string `cfg:"cluster-announce-ip"`
+	ClusterAnnouncePort int    `cfg:"cluster-announce-port"`
 }
 
-// Properties holds global config properties
-var Properties *ServerProperties
+// properties holds *ServerProperties in effect. Reload and Set replace it with an updated copy instead of
+// modifying it, so readers always see consistent properties
+var properties atomic.Value
+
+// Properties returns global config properties in effect, they should not be modified while server is running
+func Properties() *ServerProperties {
+	return properties.Load().(*ServerProperties)
+}
+
+// SetProperties replaces global config properties
+func SetProperties(p *ServerProperties) {
+	properties.Store(p)
+}
+
+// Update modifies a copy of properties in effect by update, and then replaces them with the copy
+func Update(update func(p *ServerProperties)) {
+	mu.Lock()
+	defer mu.Unlock()
+	updated := *Properties()
+	update(&updated)
+	SetProperties(&updated)
+}
 
 func init() {
 	// default config
-	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
-	}
+	SetProperties(&ServerProperties{
+		Bind:             "127.0.0.1",
+		Port:             6379,
+		AppendOnly:       false,
+		AofLoadTruncated: true,
+		ReplicaReadOnly:  true,
+		ProtectedMode:    true,
+		RDBChecksum:      true,
+	})
 }
 
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := &ServerProperties{
+		AofLoadTruncated: true,
+		ReplicaReadOnly:  true,
+		ProtectedMode:    true,
+		RDBChecksum:      true,
+	}
 
 	// read config file
 	rawMap := make(map[string]string)
@@ -107,5 +310,24 @@ func SetupConfig(configFilename string) {
 		panic(err)
 	}
 	defer file.Close()
-	Properties = parse(file)
+	parsed := parse(file)
+	SetProperties(parsed)
+	configFile = configFilename
+	// keep a copy, since Properties may be changed during runtime
+	snapshot := *parsed
+	fileProperties = &snapshot
+	if parsed.LogLevel != "" {
+		if err := logger.SetLevel(parsed.LogLevel); err != nil {
+			logger.Warn(err)
+		}
+	}
+}
+
+// ShutdownTimeout returns the max time waiting for in-flight commands and slaves when shutting down,
+// use 10 seconds if shutdown-timeout is not set
+func ShutdownTimeout() time.Duration {
+	if timeout := Properties().ShutdownTimeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return 10 * time.Second
 }
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/hdt3213/godis/lib/logger"
+)
+
+// hotReloadable are properties read whenever they are used, so they take effect once config is reloaded.
+// Changes of other properties take effect after restart
+var hotReloadable = map[string]bool{
+	"loglevel":                    true,
+	"maxclients":                  true,
+	"timeout":                     true,
+	"appendfsync":                 true,
+	"requirepass":                 true,
+	"protected-mode":              true,
+	"masterauth":                  true,
+	"proto-max-bulk-len":          true,
+	"proto-max-multibulk-len":     true,
+	"proto-max-inline-len":        true,
+	"shutdown-timeout":            true,
+	"lua-time-limit":              true,
+	"rdbchecksum":                 true,
+	"min-replicas-to-write":       true,
+	"min-replicas-max-lag":        true,
+	"replica-read-only":           true,
+	"repl-ping-replica-period":    true,
+	"lazyfree-lazy-user-flush":    true,
+	"auto-aof-rewrite-percentage": true,
+	"auto-aof-rewrite-min-size":   true,
+	"hash-max-listpack-entries":   true,
+	"hash-max-listpack-value":     true,
+	"set-max-intset-entries":      true,
+	"set-max-listpack-entries":    true,
+	"set-max-listpack-value":      true,
+	"zset-max-listpack-entries":   true,
+	"zset-max-listpack-value":     true,
+	"list-max-listpack-size":      true,
+	"cluster-strict-hash-tag":     true,
+	"peers":                       true,
+}
+
+var (
+	// mu serializes changes of Properties by Reload, Set, Update and Rewrite
+	mu sync.Mutex
+	// configFile is the file read by SetupConfig, it is empty if server runs with default config
+	configFile string
+	// fileProperties is parsed from config file by the latest SetupConfig or Reload, changes of config file are
+	// found by comparing with it, so properties changed during runtime such as chosen port are not taken as changes
+	fileProperties *ServerProperties
+)
+
+// ReloadResult tells which properties are changed by Reload
+type ReloadResult struct {
+	// Applied are changed properties which have taken effect
+	Applied []string
+	// RestartRequired are changed properties which take effect after restart
+	RestartRequired []string
+}
+
+// Reload reads config file again and applies changed hot reloadable properties to Properties
+func Reload() (*ReloadResult, error) {
+	if configFile == "" {
+		return nil, errors.New("server is running without config file")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reloaded := parse(file)
+	level := reloaded.LogLevel
+	if level == "" {
+		level = "debug"
+	}
+	if err := logger.SetLevel(level); err != nil {
+		return nil, err
+	}
+
+	// modify a copy and then replace Properties, so readers always see consistent properties
+	updated := *Properties()
+	result := &ReloadResult{}
+	t := reflect.TypeOf(updated)
+	before := reflect.ValueOf(fileProperties).Elem()
+	after := reflect.ValueOf(reloaded).Elem()
+	target := reflect.ValueOf(&updated).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			continue
+		}
+		key := propertyKey(t.Field(i))
+		if !hotReloadable[key] {
+			result.RestartRequired = append(result.RestartRequired, key)
+			continue
+		}
+		target.Field(i).Set(after.Field(i))
+		result.Applied = append(result.Applied, key)
+	}
+	SetProperties(&updated)
+	fileProperties = reloaded
+	if len(result.Applied) > 0 {
+		logger.Info("config reloaded, applied: " + strings.Join(result.Applied, ", "))
+	}
+	if len(result.RestartRequired) > 0 {
+		logger.Warn("config reloaded, changes take effect after restart: " + strings.Join(result.RestartRequired, ", "))
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hdt3213/godis/lib/logger"
+)
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "redis.conf")
+	write := func(content string) {
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defaultProperties := Properties()
+	defer func() {
+		SetProperties(defaultProperties)
+		configFile = ""
+		fileProperties = nil
+		_ = logger.SetLevel("debug")
+	}()
+	write("port 6399\nmaxclients 100\nappendfsync always\n")
+	SetupConfig(filename)
+	// properties changed during runtime are kept
+	Properties().Databases = 16
+
+	write("port 6400\nmaxclients 200\nappendfsync always\nloglevel notice\n")
+	result, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Properties().MaxClients != 200 {
+		t.Errorf("expect maxclients 200, actually %d", Properties().MaxClients)
+	}
+	if Properties().Port != 6399 {
+		t.Errorf("expect port unchanged before restart, actually %d", Properties().Port)
+	}
+	if Properties().Databases != 16 {
+		t.Errorf("expect databases kept, actually %d", Properties().Databases)
+	}
+	if len(result.Applied) != 2 || result.Applied[0] != "maxclients" || result.Applied[1] != "loglevel" {
+		t.Errorf("expect maxclients and loglevel applied, actually %v", result.Applied)
+	}
+	if len(result.RestartRequired) != 1 || result.RestartRequired[0] != "port" {
+		t.Errorf("expect port requires restart, actually %v", result.RestartRequired)
+	}
+
+	// nothing changed
+	result, err = Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("expect nothing changed, actually %v", result)
+	}
+
+	write("loglevel loud\n")
+	if _, err = Reload(); err == nil {
+		t.Error("expect error for unknown log level")
+	}
+	configFile = ""
+	if _, err = Reload(); err == nil {
+		t.Error("expect error without config file")
+	}
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/wildcard"
+)
+
+// nonNegative are int properties which could not be negative
+var nonNegative = map[string]bool{
+	"maxclients":               true,
+	"timeout":                  true,
+	"shutdown-timeout":         true,
+	"proto-max-bulk-len":       true,
+	"proto-max-multibulk-len":  true,
+	"proto-max-inline-len":     true,
+	"lua-time-limit":           true,
+	"min-replicas-to-write":    true,
+	"min-replicas-max-lag":     true,
+	"repl-ping-replica-period": true,
+}
+
+// choices are string properties which accept limited values
+var choices = map[string][]string{
+	"loglevel":    {"debug", "verbose", "notice", "warning"},
+	"appendfsync": {"always", "everysec", "no"},
+}
+
+// propertyKey returns name of the property in config file
+func propertyKey(field reflect.StructField) string {
+	key, ok := field.Tag.Lookup("cfg")
+	if !ok || strings.TrimLeft(key, " ") == "" {
+		key = field.Name
+	}
+	return strings.ToLower(key)
+}
+
+// formatValue formats property the same way as it is written in config file
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Bool:
+		if v.Bool() {
+			return "yes"
+		}
+		return "no"
+	case reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return v.String()
+}
+
+// parseValue parses value of the property, unlike parse it reports illegal values
+func parseValue(key string, typ reflect.Type, value string) (reflect.Value, error) {
+	switch typ.Kind() {
+	case reflect.Int:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return reflect.Value{}, errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < 0 && nonNegative[key] {
+			return reflect.Value{}, errors.New("argument must be greater than or equal to 0")
+		}
+		return reflect.ValueOf(int(n)), nil
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "yes":
+			return reflect.ValueOf(true), nil
+		case "no":
+			return reflect.ValueOf(false), nil
+		}
+		return reflect.Value{}, errors.New("argument must be 'yes' or 'no'")
+	case reflect.Slice:
+		if value == "" {
+			return reflect.ValueOf([]string(nil)), nil
+		}
+		return reflect.ValueOf(strings.Split(value, ",")), nil
+	}
+	if options, ok := choices[key]; ok {
+		value = strings.ToLower(value)
+		for _, option := range options {
+			if value == option {
+				return reflect.ValueOf(value), nil
+			}
+		}
+		return reflect.Value{}, errors.New("argument(s) must be one of the following: " + strings.Join(options, ", "))
+	}
+	return reflect.ValueOf(value), nil
+}
+
+// Get returns names and values of properties matching the glob pattern alternately
+func Get(pattern string) ([]string, error) {
+	p, err := wildcard.CompilePattern(strings.ToLower(pattern))
+	if err != nil {
+		return nil, err
+	}
+	current := Properties()
+	t := reflect.TypeOf(*current)
+	v := reflect.ValueOf(current).Elem()
+	var result []string
+	for i := 0; i < t.NumField(); i++ {
+		key := propertyKey(t.Field(i))
+		if p.IsMatch(key) {
+			result = append(result, key, formatValue(v.Field(i)))
+		}
+	}
+	return result, nil
+}
+
+// Set changes hot reloadable properties during runtime, keyValues contains names and values alternately.
+// Either all properties are changed or none of them if any is illegal
+func Set(keyValues ...string) error {
+	if len(keyValues) == 0 || len(keyValues)%2 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	updated := *Properties()
+	t := reflect.TypeOf(updated)
+	target := reflect.ValueOf(&updated).Elem()
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[propertyKey(t.Field(i))] = i
+	}
+	set := make(map[string]bool)
+	for i := 0; i < len(keyValues); i += 2 {
+		key := strings.ToLower(keyValues[i])
+		index, ok := fields[key]
+		if !ok {
+			return errors.New("Unknown option or number of arguments for CONFIG SET - '" + keyValues[i] + "'")
+		}
+		if set[key] {
+			return errors.New("CONFIG SET failed (possibly related to argument '" + key + "') - duplicate parameter")
+		}
+		set[key] = true
+		if !hotReloadable[key] {
+			return errors.New("CONFIG SET failed (possibly related to argument '" + key + "') - can't set immutable config")
+		}
+		value, err := parseValue(key, t.Field(index).Type, keyValues[i+1])
+		if err != nil {
+			return errors.New("CONFIG SET failed (possibly related to argument '" + key + "') - " + err.Error())
+		}
+		target.Field(index).Set(value)
+	}
+	if set["loglevel"] {
+		if err := logger.SetLevel(updated.LogLevel); err != nil {
+			return err
+		}
+	}
+	SetProperties(&updated)
+	return nil
+}
+
+// Rewrite writes properties changed during runtime back into config file. Lines of unchanged properties and
+// comments are kept as they are, changed properties replace their lines or are appended if absent.
+// Only hot reloadable properties are written, since other properties changed during runtime, such as port chosen
+// by system, are not set by users
+func Rewrite() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if configFile == "" {
+		return errors.New("The server is running without a config file")
+	}
+
+	// changed are formatted values of changed properties, empty value means that the line should be removed
+	changed := make(map[string]string)
+	var changedKeys []string
+	inEffect := Properties()
+	t := reflect.TypeOf(*inEffect)
+	current := reflect.ValueOf(inEffect).Elem()
+	saved := reflect.ValueOf(fileProperties).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		key := propertyKey(t.Field(i))
+		if !hotReloadable[key] || reflect.DeepEqual(current.Field(i).Interface(), saved.Field(i).Interface()) {
+			continue
+		}
+		changed[key] = formatValue(current.Field(i))
+		changedKeys = append(changedKeys, key)
+	}
+
+	file, err := os.Open(configFile)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	written := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key := strings.ToLower(strings.SplitN(strings.TrimLeft(line, " "), " ", 2)[0])
+		value, ok := changed[key]
+		if !ok {
+			lines = append(lines, line)
+			continue
+		}
+		// the first line of property is replaced, following duplicated lines are removed
+		if !written[key] && value != "" {
+			lines = append(lines, key+" "+value)
+		}
+		written[key] = true
+	}
+	err = scanner.Err()
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	for _, key := range changedKeys {
+		if !written[key] && changed[key] != "" {
+			lines = append(lines, key+" "+changed[key])
+		}
+	}
+	content := strings.Join(lines, "\n") + "\n"
+
+	// write a temporary file and then rename it, so config file is never left half written
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), filepath.Base(configFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.WriteString(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), configFile); err != nil {
+		return err
+	}
+	fileProperties = parse(strings.NewReader(content))
+	logger.Info("config file rewritten: " + configFile)
+	return nil
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hdt3213/godis/lib/logger"
+)
+
+func TestGetSet(t *testing.T) {
+	defaultProperties := Properties()
+	defer func() {
+		SetProperties(defaultProperties)
+		_ = logger.SetLevel("debug")
+	}()
+	SetProperties(&ServerProperties{Port: 6399, MaxClients: 100, ReplicaReadOnly: true})
+
+	result, err := Get("max*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0] != "maxclients" || result[1] != "100" {
+		t.Errorf("expect maxclients 100, actually %v", result)
+	}
+	result, _ = Get("replica-read-only")
+	if len(result) != 2 || result[1] != "yes" {
+		t.Errorf("expect replica-read-only yes, actually %v", result)
+	}
+
+	err = Set("maxclients", "200", "LOGLEVEL", "Warning", "replica-read-only", "no", "peers", "a:1,b:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Properties().MaxClients != 200 || Properties().LogLevel != "warning" || Properties().ReplicaReadOnly ||
+		len(Properties().Peers) != 2 {
+		t.Errorf("expect properties set, actually %+v", Properties())
+	}
+
+	// nothing is changed if any parameter is illegal
+	illegal := [][]string{
+		{"maxclients", "300", "port", "6400"},
+		{"maxclients", "-1"},
+		{"maxclients", "many"},
+		{"appendfsync", "sometimes"},
+		{"replica-read-only", "maybe"},
+		{"maxclients", "300", "maxclients", "400"},
+		{"unknown", "1"},
+		{"maxclients"},
+	}
+	for _, keyValues := range illegal {
+		if err := Set(keyValues...); err == nil {
+			t.Errorf("expect error for %v", keyValues)
+		}
+	}
+	if Properties().MaxClients != 200 || Properties().Port != 6399 {
+		t.Errorf("expect properties unchanged, actually %+v", Properties())
+	}
+}
+
+func TestSetConcurrently(t *testing.T) {
+	defaultProperties := Properties()
+	defer SetProperties(defaultProperties)
+	SetProperties(&ServerProperties{MaxClients: 100})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := Set("maxclients", strconv.Itoa(200+i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// readers always see properties set completely
+			if Properties().MaxClients < 100 {
+				t.Errorf("unexpected maxclients %d", Properties().MaxClients)
+			}
+		}()
+	}
+	wg.Wait()
+	if Properties().MaxClients < 200 {
+		t.Errorf("expect maxclients set, actually %d", Properties().MaxClients)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	defaultProperties := Properties()
+	defer func() {
+		SetProperties(defaultProperties)
+		configFile = ""
+		fileProperties = nil
+	}()
+	filename := filepath.Join(t.TempDir(), "redis.conf")
+	src := "# server\n" +
+		"port 6399\n" +
+		"maxclients 100\n" +
+		"#timeout 300\n" +
+		"\n" +
+		"requirepass secret\n" +
+		"maxclients 150\n"
+	if err := os.WriteFile(filename, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	SetupConfig(filename)
+	// port chosen during runtime is not written
+	Properties().Port = 6400
+	if err := Set("maxclients", "200", "timeout", "60", "requirepass", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# server\n" +
+		"port 6399\n" +
+		"maxclients 200\n" +
+		"#timeout 300\n" +
+		"\n" +
+		"timeout 60\n"
+	if string(content) != expected {
+		t.Errorf("expect config file:\n%s\nactually:\n%s", expected, content)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expect mode kept, actually %s", info.Mode())
+	}
+
+	// reloading rewritten file changes nothing
+	result, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("expect nothing changed, actually %+v", result)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(filename)); len(entries) != 1 {
+		t.Errorf("expect temporary file removed, actually %d files", len(entries))
+	}
+
+	configFile = ""
+	if err := Rewrite(); err == nil {
+		t.Error("expect error without config file")
+	}
+}
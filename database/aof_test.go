@@ -1,6 +1,7 @@
 package database
 
 import (
+	"bytes"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
@@ -11,7 +12,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -94,6 +98,29 @@ func validateTestData(t *testing.T, db database.DB, dbIndex int, prefix string,
 	}
 }
 
+// baseAofFilename returns base file of multi-part aof named by aofFilename
+func baseAofFilename(t *testing.T, aofFilename string) string {
+	matches, _ := filepath.Glob(aofFilename + ".*.base.aof")
+	if len(matches) != 1 {
+		t.Fatalf("expected one base aof file, actually %v", matches)
+	}
+	return matches[0]
+}
+
+// aofSize returns total size of multi-part aof files named by aofFilename
+func aofSize(t *testing.T, aofFilename string) int64 {
+	matches, _ := filepath.Glob(aofFilename + ".*.aof")
+	var size int64
+	for _, filename := range matches {
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += fileInfo.Size()
+	}
+	return size
+}
+
 func TestAof(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "godis")
 	if err != nil {
@@ -104,10 +131,10 @@ func TestAof(t *testing.T) {
 	defer func() {
 		_ = os.Remove(aofFilename)
 	}()
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:     true,
 		AppendFilename: aofFilename,
-	}
+	})
 	dbNum := 4
 	size := 10
 	var prefixes []string
@@ -138,11 +165,11 @@ func TestRDB(t *testing.T) {
 		_ = os.Remove(aofFilename)
 		_ = os.Remove(rdbFilename)
 	}()
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:     true,
 		AppendFilename: aofFilename,
 		RDBFilename:    rdbFilename,
-	}
+	})
 	dbNum := 4
 	size := 10
 	var prefixes []string
@@ -174,10 +201,10 @@ func TestRewriteAOF(t *testing.T) {
 	defer func() {
 		_ = os.Remove(aofFilename)
 	}()
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:     true,
 		AppendFilename: aofFilename,
-	}
+	})
 	aofWriteDB := NewStandaloneServer()
 	size := 1
 	dbNum := 4
@@ -188,7 +215,8 @@ func TestRewriteAOF(t *testing.T) {
 		makeTestData(aofWriteDB, i, prefix, size)
 	}
 	//time.Sleep(2 * time.Second)
-	aofWriteDB.Exec(nil, utils.ToCmdLine("rewriteaof"))
+	ret := aofWriteDB.Exec(nil, utils.ToCmdLine("rewriteaof"))
+	asserts.AssertStatusReply(t, ret, "OK")
 	time.Sleep(2 * time.Second)        // wait for async goroutine finish its job
 	aofWriteDB.Close()                 // wait for aof finished
 	aofReadDB := NewStandaloneServer() // start new db and read aof file
@@ -210,10 +238,10 @@ func TestRewriteAOF2(t *testing.T) {
 	defer func() {
 		_ = os.Remove(aofFilename)
 	}()
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:     true,
 		AppendFilename: aofFilename,
-	}
+	})
 	aofWriteDB := NewStandaloneServer()
 	dbNum := 4
 	conn := &connection.FakeConn{}
@@ -251,3 +279,657 @@ func TestRewriteAOF2(t *testing.T) {
 	}
 	aofReadDB.Close()
 }
+
+// TestRewriteAOFHashFieldTTL tests ttl of hash fields survives aof rewrite
+func TestRewriteAOFHashFieldTTL(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "*.aof")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofFilename := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(aofFilename)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+	})
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HMSET", "h", "a", "1", "b", "2", "c", "3"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HPEXPIREAT", "h", "32503651200000", "FIELDS", "2", "a", "b"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HEXPIRE", "h", "0", "FIELDS", "1", "c"))
+
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofWriteDB.aofHandler.DoRewrite(ctx)
+	aofWriteDB.aofHandler.FinishRewrite(ctx)
+	aofWriteDB.Close()
+
+	content, err := ioutil.ReadFile(baseAofFilename(t, aofFilename))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := string(protocol.MakeMultiBulkReply(utils.ToCmdLine("HPEXPIREAT", "h", "32503651200000", "FIELDS", "2", "a", "b")).ToBytes())
+	if !strings.Contains(string(content), expected) {
+		t.Errorf("rewritten aof should contain %q", expected)
+	}
+
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("HPEXPIRETIME", "h", "FIELDS", "3", "a", "b", "c"))
+	assertIntArrayReply(t, ret, 32503651200000, 32503651200000, -2)
+	aofReadDB.Close()
+}
+
+func TestRewriteAOFFunction(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "*.aof")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofFilename := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(aofFilename)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+	})
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FUNCTION", "LOAD", "#!lua name=lib2\nredis.register_function('f', function() end)"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FUNCTION", "DELETE", "lib2"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FCALL", "test_incrby", "1", "a", "2"))
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofWriteDB.aofHandler.DoRewrite(ctx)
+	aofWriteDB.aofHandler.FinishRewrite(ctx)
+	aofWriteDB.Close()
+
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("FCALL", "test_incrby", "1", "a", "3"))
+	asserts.AssertIntReply(t, ret, 5)
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("FCALL", "f", "0"))
+	asserts.AssertErrReply(t, ret, "ERR Function not found")
+	aofReadDB.Close()
+}
+
+func TestRewriteAOFPreamble(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:        true,
+		AppendFilename:    aofFilename,
+		AofUseRdbPreamble: true,
+	})
+	aofWriteDB := NewStandaloneServer()
+	size := 10
+	dbNum := 4
+	for i := 0; i < dbNum; i++ {
+		makeTestData(aofWriteDB, i, "db"+strconv.Itoa(i), size)
+	}
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FUNCTION", "LOAD", testLibrary))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HMSET", "h", "a", "1", "b", "2"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HPEXPIREAT", "h", "32503651200000", "FIELDS", "1", "a"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("XADD", "s", "1-1", "f", "v"))
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = aofWriteDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// commands during rewriting are appended after preamble
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "after", "1"))
+	aofWriteDB.aofHandler.FinishRewrite(ctx)
+	aofWriteDB.Close()
+
+	content, err := ioutil.ReadFile(baseAofFilename(t, aofFilename))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(content), "REDIS") {
+		t.Error("rewritten aof should start with rdb preamble")
+	}
+
+	aofReadDB := NewStandaloneServer()
+	for i := 0; i < dbNum; i++ {
+		validateTestData(t, aofReadDB, i, "db"+strconv.Itoa(i), size)
+	}
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("FCALL", "test_incrby", "1", "a", "3"))
+	asserts.AssertIntReply(t, ret, 3)
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("HPEXPIRETIME", "h", "FIELDS", "2", "a", "b"))
+	assertIntArrayReply(t, ret, 32503651200000, -1)
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("XLEN", "s"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "after"))
+	asserts.AssertBulkReply(t, ret, "1")
+	aofReadDB.Close()
+}
+
+func TestMultiPartAOF(t *testing.T) {
+	tmpDir := t.TempDir()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	aofDir := path.Join(tmpDir, "appendonlydir")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+		AppendDirname:  aofDir,
+	})
+	// aof file written by older version becomes base file
+	legacy := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "legacy", "1")).ToBytes()
+	err := ioutil.WriteFile(aofFilename, legacy, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	ret := aofWriteDB.Exec(conn, utils.ToCmdLine("GET", "legacy"))
+	asserts.AssertBulkReply(t, ret, "1")
+	manifestFilename := path.Join(aofDir, "a.aof.manifest")
+	content, err := ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file a.aof seq 1 type b\nfile a.aof.1.incr.aof seq 1 type i\n"
+	if string(content) != expected {
+		t.Errorf("expected manifest %q, actually %q", expected, content)
+	}
+
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	conn.SelectDB(1)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "b", "1"))
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// commands during rewriting are written into new incr file
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "c", "1"))
+	err = aofWriteDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = aofWriteDB.aofHandler.FinishRewrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aofWriteDB.Close()
+
+	content, err = ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "file a.aof.2.base.aof seq 2 type b\nfile a.aof.2.incr.aof seq 2 type i\n"
+	if string(content) != expected {
+		t.Errorf("expected manifest %q, actually %q", expected, content)
+	}
+	for _, name := range []string{"a.aof", "a.aof.1.incr.aof"} {
+		if _, err := os.Stat(path.Join(aofDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should be deleted after rewriting", name)
+		}
+	}
+
+	aofReadDB := NewStandaloneServer()
+	conn = &connection.FakeConn{}
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("MGET", "legacy", "a"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1", "1"})
+	conn.SelectDB(1)
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("MGET", "b", "c"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1", "1"})
+	aofReadDB.Close()
+}
+
+// TestRewriteAOFSnapshot tests rewriting live databases while commands modifying them concurrently
+func TestRewriteAOFSnapshot(t *testing.T) {
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	for _, preamble := range []bool{false, true} {
+		aofFilename := path.Join(t.TempDir(), "a.aof")
+		config.SetProperties(&config.ServerProperties{
+			AppendOnly:        true,
+			AppendFilename:    aofFilename,
+			AofUseRdbPreamble: preamble,
+		})
+		aofWriteDB := NewStandaloneServer()
+		conn := &connection.FakeConn{}
+		keyNum := 2000
+		for i := 0; i < keyNum; i++ {
+			aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), "v"))
+		}
+		aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "counter", "10"))
+		aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", "a"))
+		aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "expiring", "v", "EX", "100"))
+
+		ctx, err := aofWriteDB.aofHandler.StartRewrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// modifications after StartRewrite are written into new incr file, rewriting should not include them
+		aofWriteDB.Exec(conn, utils.ToCmdLine("INCR", "counter"))
+		aofWriteDB.Exec(conn, utils.ToCmdLine("DEL", "k1"))
+		aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "created", "v"))
+		aofWriteDB.Exec(conn, utils.ToCmdLine("PERSIST", "expiring"))
+		incrNum := 100
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &connection.FakeConn{}
+			for i := 0; i < incrNum; i++ {
+				aofWriteDB.Exec(c, utils.ToCmdLine("INCR", "counter"))
+				aofWriteDB.Exec(c, utils.ToCmdLine("RPUSH", "list", "b"))
+				aofWriteDB.Exec(c, utils.ToCmdLine("APPEND", "k"+strconv.Itoa(keyNum-1-i), "v"))
+			}
+		}()
+		err = aofWriteDB.aofHandler.DoRewrite(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		err = aofWriteDB.aofHandler.FinishRewrite(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// modifications after rewriting
+		aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", "c"))
+		aofWriteDB.Close()
+
+		aofReadDB := NewStandaloneServer()
+		ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "counter"))
+		asserts.AssertBulkReply(t, ret, strconv.Itoa(10+1+incrNum))
+		ret = aofReadDB.Exec(conn, utils.ToCmdLine("LLEN", "list"))
+		asserts.AssertIntReply(t, ret, 1+incrNum+1)
+		ret = aofReadDB.Exec(conn, utils.ToCmdLine("EXISTS", "k1", "created"))
+		asserts.AssertIntReply(t, ret, 1)
+		ret = aofReadDB.Exec(conn, utils.ToCmdLine("TTL", "expiring"))
+		asserts.AssertIntReply(t, ret, -1)
+		if size, _ := aofReadDB.GetDBSize(0); size != keyNum-1+4 {
+			t.Errorf("expected %d keys, actually %d", keyNum-1+4, size)
+		}
+		for i := 0; i < keyNum; i++ {
+			if i == 1 {
+				continue
+			}
+			expected := "v"
+			if i >= keyNum-incrNum {
+				expected = "vv"
+			}
+			ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "k"+strconv.Itoa(i)))
+			asserts.AssertBulkReply(t, ret, expected)
+		}
+		aofReadDB.Close()
+	}
+}
+
+func TestAofTruncateToTimestamp(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:          true,
+		AppendFilename:      aofFilename,
+		AofTimestampEnabled: true,
+	})
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	time.Sleep(1100 * time.Millisecond)
+	// SET has been annotated with timestamp no later than recoverTo, and FLUSHALL later than it
+	recoverTo := time.Now().Unix()
+	time.Sleep(1100 * time.Millisecond)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	aofWriteDB.Close()
+	content, err := ioutil.ReadFile(aofFilename + ".1.incr.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(content), "#TS:") != 2 {
+		t.Errorf("aof should contain 2 timestamp annotations, actually %q", content)
+	}
+
+	config.Update(func(p *config.ServerProperties) {
+		p.AofTruncateToTimestamp = int(recoverTo)
+	})
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "1")
+	aofReadDB.Exec(conn, utils.ToCmdLine("SET", "b", "1"))
+	aofReadDB.Close()
+
+	// discarded commands are removed from aof
+	config.Update(func(p *config.ServerProperties) {
+		p.AofTruncateToTimestamp = 0
+	})
+	aofReadDB = NewStandaloneServer()
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("MGET", "a", "b"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1", "1"})
+	aofReadDB.Close()
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+	})
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	aofWriteDB.Close()
+	// crashed during writing
+	incrFilename := aofFilename + ".1.incr.aof"
+	file, err := os.OpenFile(incrFilename, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString("*3\r\n$3\r\nSET\r\n$1\r\nb")
+	_ = file.Close()
+
+	func() {
+		defer func() {
+			if err := recover(); err == nil {
+				t.Error("server should refuse to start with truncated aof")
+			}
+		}()
+		NewStandaloneServer()
+	}()
+
+	config.Update(func(p *config.ServerProperties) {
+		p.AofLoadTruncated = true
+	})
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "1")
+	aofReadDB.Exec(conn, utils.ToCmdLine("SET", "c", "1"))
+	aofReadDB.Close()
+
+	// commands appended after truncating are readable
+	aofReadDB = NewStandaloneServer()
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("MGET", "a", "c"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1", "1"})
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "b"))
+	asserts.AssertNullBulk(t, ret)
+	aofReadDB.Close()
+}
+
+func TestAofBackpressure(t *testing.T) {
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	for _, policy := range []string{"block", "disk"} {
+		aofFilename := path.Join(t.TempDir(), "a.aof")
+		config.SetProperties(&config.ServerProperties{
+			AppendOnly:      true,
+			AppendFilename:  aofFilename,
+			AofQueueSize:    1,
+			AofBackpressure: policy,
+		})
+		aofWriteDB := NewStandaloneServer()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn := &connection.FakeConn{}
+				conn.SelectDB(i)
+				for j := 0; j < 100; j++ {
+					aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", strconv.Itoa(j)))
+				}
+			}(i)
+		}
+		wg.Wait()
+		aofWriteDB.Close()
+
+		aofReadDB := NewStandaloneServer()
+		for i := 0; i < 4; i++ {
+			conn := &connection.FakeConn{}
+			conn.SelectDB(i)
+			ret := aofReadDB.Exec(conn, utils.ToCmdLine("LRANGE", "list", "0", "-1"))
+			expected := make([]string, 100)
+			for j := range expected {
+				expected[j] = strconv.Itoa(j)
+			}
+			asserts.AssertMultiBulkReply(t, ret, expected)
+		}
+		aofReadDB.Close()
+	}
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:      true,
+		AppendFilename:  path.Join(t.TempDir(), "a.aof"),
+		AofBackpressure: "drop",
+	})
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("unknown backpressure policy should be rejected")
+		}
+	}()
+	NewStandaloneServer()
+}
+
+func TestAofFsyncAlways(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:           true,
+		AppendFilename:       aofFilename,
+		AppendFsync:          "always",
+		AofGroupCommitWindow: 100,
+	})
+	aofWriteDB := NewStandaloneServer()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := &connection.FakeConn{}
+			for j := 0; j < 100; j++ {
+				aofWriteDB.Exec(conn, utils.ToCmdLine("INCR", "a"))
+			}
+		}()
+	}
+	wg.Wait()
+	// commands have been written before replying
+	content, err := ioutil.ReadFile(aofFilename + ".1.incr.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "incr"); n != 400 {
+		t.Errorf("expected 400 commands in aof, actually %d", n)
+	}
+	aofWriteDB.Close()
+
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(&connection.FakeConn{}, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "400")
+	aofReadDB.Close()
+
+	config.Update(func(p *config.ServerProperties) {
+		p.AppendFsync = "sometimes"
+	})
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("unknown appendfsync policy should be rejected")
+		}
+	}()
+	NewStandaloneServer()
+}
+
+func TestAutoRewriteAOF(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:               true,
+		AppendFilename:           aofFilename,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    4096,
+	})
+	aofWriteDB := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	var written int64
+	for i := 0; i < 1000; i++ {
+		cmdLine := utils.ToCmdLine("SET", "a", strconv.Itoa(i))
+		aofWriteDB.Exec(conn, cmdLine)
+		written += int64(len(protocol.MakeMultiBulkReply(cmdLine).ToBytes()))
+	}
+	// wait for aof finished and rewriting triggered by the latest writes
+	time.Sleep(time.Second)
+	for i := 0; i < 100 && aofWriteDB.aofHandler.IsRewriting(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// commands written during the latest rewriting are kept, so files may be larger than min size
+	if size := aofSize(t, aofFilename); size >= written/2 {
+		t.Errorf("aof should be rewritten, written %d bytes, actual size %d", written, size)
+	}
+	aofWriteDB.Close()
+
+	aofReadDB := NewStandaloneServer()
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "a"))
+	asserts.AssertBulkReply(t, ret, "999")
+	aofReadDB.Close()
+}
+
+func TestBGRewriteAOF(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+	})
+	aofWriteDB := NewStandaloneServer()
+	defer aofWriteDB.Close()
+	conn := &connection.FakeConn{}
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	ret := aofWriteDB.Exec(conn, utils.ToCmdLine("INFO", "persistence"))
+	info := string(ret.(*protocol.BulkReply).Arg)
+	for _, field := range []string{"aof_enabled:1", "aof_rewrite_in_progress:0", "aof_last_rewrite_time_sec:-1",
+		"aof_last_bgrewrite_status:ok", "aof_rewrites:0", "aof_last_write_status:ok", "rdb_changes_since_last_save:1"} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Errorf("info should contain %s, actually %s", field, info)
+		}
+	}
+
+	// rewriting 1000 keys takes a while, so the second one is rejected
+	for i := 0; i < 1000; i++ {
+		aofWriteDB.Exec(conn, utils.ToCmdLine("SET", strconv.Itoa(i), "1"))
+	}
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("BGREWRITEAOF"))
+	asserts.AssertStatusReply(t, ret, "Background append only file rewriting started")
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("BGREWRITEAOF"))
+	asserts.AssertErrReply(t, ret, "ERR Background append only file rewriting already in progress")
+	for i := 0; i < 100 && aofWriteDB.aofHandler.IsRewriting(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("INFO", "all"))
+	info = string(ret.(*protocol.BulkReply).Arg)
+	for _, field := range []string{"aof_rewrite_in_progress:0", "aof_last_rewrite_time_sec:0", "aof_last_bgrewrite_status:ok",
+		"aof_rewrites:1", "aof_rewrites_consecutive_failures:0"} {
+		if !strings.Contains(info, field+"\r\n") {
+			t.Errorf("info should contain %s, actually %s", field, info)
+		}
+	}
+	ret = aofWriteDB.Exec(conn, utils.ToCmdLine("INFO", "foo"))
+	asserts.AssertBulkReply(t, ret, "")
+}
+
+func TestAofLoadParallel(t *testing.T) {
+	aofFilename := path.Join(t.TempDir(), "a.aof")
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: aofFilename,
+		AofLoadWorkers: 8,
+	})
+	var buf bytes.Buffer
+	write := func(args ...string) {
+		buf.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	}
+	keyNum := 100
+	write("SELECT", "1")
+	for i := 0; i < 10; i++ {
+		for j := 0; j < keyNum; j++ {
+			write("RPUSH", "list"+strconv.Itoa(j), strconv.Itoa(i))
+			write("INCR", "counter"+strconv.Itoa(j))
+		}
+	}
+	// commands of keys belonging to different workers
+	for j := 0; j < keyNum; j += 2 {
+		write("RENAME", "counter"+strconv.Itoa(j), "renamed"+strconv.Itoa(j))
+		write("INCR", "renamed"+strconv.Itoa(j))
+	}
+	write("MULTI")
+	write("INCR", "counter1")
+	write("INCR", "counter3")
+	write("EXEC")
+	write("SELECT", "2")
+	write("SET", "counter1", "1")
+	write("FLUSHDB")
+	write("SET", "counter3", "1")
+	err := ioutil.WriteFile(aofFilename, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	conn := &connection.FakeConn{}
+	conn.SelectDB(1)
+	for j := 0; j < keyNum; j++ {
+		ret := aofReadDB.Exec(conn, utils.ToCmdLine("LRANGE", "list"+strconv.Itoa(j), "0", "-1"))
+		asserts.AssertMultiBulkReply(t, ret, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"})
+		if j%2 == 0 {
+			ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "renamed"+strconv.Itoa(j)))
+			asserts.AssertBulkReply(t, ret, "11")
+		} else if j == 1 || j == 3 {
+			ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "counter"+strconv.Itoa(j)))
+			asserts.AssertBulkReply(t, ret, "11")
+		} else {
+			ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "counter"+strconv.Itoa(j)))
+			asserts.AssertBulkReply(t, ret, "10")
+		}
+	}
+	conn.SelectDB(2)
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("MGET", "counter1", "counter3"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"", "1"})
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/backup"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
+	"os"
+)
+
+// uploadBackup uploads a saved snapshot, failure of backup doesn't fail saving
+func (mdb *MultiDB) uploadBackup(filename string, kind string) {
+	err := mdb.backup.Backup(filename, kind)
+	if err != nil {
+		logger.Warn("backup " + filename + " failed: " + err.Error())
+	}
+}
+
+// restoreBackup downloads the latest backup as local data before loading, if there is no local data.
+// Rdb is also a valid aof base file with preamble, but aof can't be loaded as rdb
+func restoreBackup(manager *backup.Manager) {
+	var filename string
+	kinds := []string{backup.KindRDB}
+	if config.Properties().AppendOnly {
+		var ok bool
+		filename, ok = aof.RestoreFilename()
+		if !ok {
+			return
+		}
+		kinds = append(kinds, backup.KindAOF)
+	} else {
+		filename = rdbFilename()
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			return
+		}
+	}
+	name, err := manager.Latest(kinds...)
+	if err != nil {
+		panic("list backups failed: " + err.Error())
+	}
+	if name == "" {
+		logger.Info("no backup to restore")
+		return
+	}
+	err = manager.Restore(name, filename)
+	if err != nil {
+		panic("restore backup " + name + " failed: " + err.Error())
+	}
+	logger.Info("restored backup " + name + " into " + filename)
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/backup"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backup")
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename:  filepath.Join(dir, "dump.rdb"),
+		BackupTarget: "dir",
+		BackupDir:    backupDir,
+	})
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	writeDB.Exec(conn, utils.ToCmdLine("set", "str", "a"))
+	result := writeDB.Exec(conn, utils.ToCmdLine("save"))
+	asserts.AssertStatusReply(t, result, "OK")
+	writeDB.Close() // waits for uploading
+
+	// restore rdb on another node without local data
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename:   filepath.Join(dir, "restore", "dump.rdb"),
+		BackupTarget:  "dir",
+		BackupDir:     backupDir,
+		BackupRestore: true,
+	})
+	readDB := NewStandaloneServer()
+	result = readDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "a")
+	readDB.Close()
+
+	// rdb backup is loaded as base of aof, and base of rewritten aof is uploaded
+	aofDir := filepath.Join(dir, "aof")
+	config.SetProperties(&config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: filepath.Join(aofDir, "appendonly.aof"),
+		AppendDirname:  aofDir,
+		BackupTarget:   "dir",
+		BackupDir:      backupDir,
+		BackupRestore:  true,
+	})
+	aofDB := NewStandaloneServer()
+	result = aofDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "a")
+	aofDB.Exec(conn, utils.ToCmdLine("set", "str", "b"))
+	err := aofDB.aofHandler.Rewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofDB.Exec(conn, utils.ToCmdLine("set", "str", "c"))
+	aofDB.Close()
+	names, err := backup.MakeDirTarget(backupDir).List(backup.KindAOF + "-")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(names) != 1 {
+		t.Errorf("expected 1 aof backup, actually %v", names)
+		return
+	}
+
+	// local aof is not overwritten by backup
+	aofDB = NewStandaloneServer()
+	result = aofDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "c")
+	aofDB.Close()
+
+	// the latest backup is the rewritten aof, which doesn't contain commands after rewriting
+	config.Update(func(p *config.ServerProperties) {
+		p.AppendFilename = filepath.Join(dir, "aof2", "appendonly.aof")
+		p.AppendDirname = filepath.Join(dir, "aof2")
+	})
+	aofDB = NewStandaloneServer()
+	result = aofDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "b")
+	aofDB.Close()
+}
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/timewheel"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waiter is a client blocked by BLPOP and other blocking commands
+type waiter struct {
+	wake    chan struct{}
+	timeout chan struct{}
+}
+
+func makeWaiter() *waiter {
+	return &waiter{
+		wake:    make(chan struct{}, 1),
+		timeout: make(chan struct{}, 1),
+	}
+}
+
+// blockingRegistry records clients waiting on each key
+type blockingRegistry struct {
+	mu sync.Mutex
+	// key -> set of waiters
+	waiters map[string]map[*waiter]struct{}
+}
+
+func makeBlockingRegistry() *blockingRegistry {
+	return &blockingRegistry{
+		waiters: make(map[string]map[*waiter]struct{}),
+	}
+}
+
+func (r *blockingRegistry) add(keys []string, w *waiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		set, ok := r.waiters[key]
+		if !ok {
+			set = make(map[*waiter]struct{})
+			r.waiters[key] = set
+		}
+		set[w] = struct{}{}
+	}
+}
+
+func (r *blockingRegistry) remove(keys []string, w *waiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		set, ok := r.waiters[key]
+		if !ok {
+			continue
+		}
+		delete(set, w)
+		if len(set) == 0 {
+			delete(r.waiters, key)
+		}
+	}
+}
+
+// notify wakes up all clients waiting on the given key, they will compete for the new element
+func (r *blockingRegistry) notify(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for w := range r.waiters[key] {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *blockingRegistry) waitingCount(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.waiters[key])
+}
+
+// notifyWaiters should be called after elements were pushed into key
+func (db *DB) notifyWaiters(key string) {
+	db.blocking.notify(key)
+}
+
+// parseBlockingTimeout parses timeout in seconds, 0 means blocking indefinitely
+func parseBlockingTimeout(arg []byte) (time.Duration, protocol.ErrorReply) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, protocol.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, protocol.MakeErrReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseBlockOptionTimeout parses timeout of BLOCK option in milliseconds, 0 means blocking indefinitely
+func parseBlockOptionTimeout(arg []byte) (time.Duration, protocol.ErrorReply) {
+	ms, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if ms < 0 {
+		return 0, protocol.MakeErrReply("ERR timeout is negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// findBlockOption returns timeout of BLOCK option preceding STREAMS, or nil if there is no BLOCK option
+func findBlockOption(args [][]byte) []byte {
+	for i := 0; i+1 < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "STREAMS" {
+			return nil
+		}
+		if arg == "BLOCK" {
+			return args[i+1]
+		}
+	}
+	return nil
+}
+
+// isNullReply returns true if blocking command has nothing to serve
+func isNullReply(result redis.Reply) bool {
+	switch result.(type) {
+	case *protocol.NullBulkReply, *protocol.NullMultiBulkReply:
+		return true
+	}
+	return false
+}
+
+// execBlockingCommand executes blocking command like BLPOP.
+// The executor of a blocking command never blocks, it returns NullBulkReply or NullMultiBulkReply if nothing
+// is available. Then the client waits until another client writes into one of the keys, the timeout expires
+// or the client disconnects. Commands from master never block, since they must not stall the replication stream.
+func (db *DB) execBlockingCommand(c redis.Connection, cmd *command, cmdLine [][]byte) redis.Reply {
+	args := cmdLine[1:]
+	var timeout time.Duration
+	var errReply protocol.ErrorReply
+	if cmd.flags&flagBlockOption > 0 {
+		timeout, errReply = parseBlockOptionTimeout(findBlockOption(args))
+	} else if cmd.flags&flagTimeoutFirst > 0 {
+		timeout, errReply = parseBlockingTimeout(args[0])
+	} else {
+		timeout, errReply = parseBlockingTimeout(args[len(args)-1])
+	}
+	if errReply != nil {
+		return errReply
+	}
+	write, read := cmd.prepare(args)
+	keys := append(append([]string{}, write...), read...)
+	var closed <-chan struct{}
+	if c != nil {
+		closed = c.Done()
+	}
+	fromMaster := isFromMaster(c)
+	w := makeWaiter()
+	defer db.blocking.remove(keys, w)
+	if timeout > 0 {
+		taskKey := fmt.Sprintf("blocking:%p", w)
+		timewheel.Delay(timeout, taskKey, func() {
+			w.timeout <- struct{}{}
+		})
+		defer timewheel.Cancel(taskKey)
+	}
+	for {
+		db.RWLocks(write, read)
+		if fromMaster {
+			db.markMasterKeys(write, read)
+		}
+		result := cmd.executor(db, args)
+		if fromMaster {
+			db.unmarkMasterKeys(write, read)
+		}
+		if !isNullReply(result) || fromMaster {
+			db.addVersion(write...)
+			db.updateEncodings(write...)
+			if len(write) > 0 {
+				db.tracking.Invalidate(c, write)
+			} else if cmd.flags&flagReadOnly > 0 {
+				db.tracking.Remember(c, read)
+			}
+			db.RWUnLocks(write, read)
+			return result
+		}
+		// register before unlock, so writes after this attempt won't be missed
+		db.blocking.add(keys, w)
+		db.RWUnLocks(write, read)
+		select {
+		case <-w.wake:
+		case <-w.timeout:
+			return result
+		case <-closed:
+		}
+		select {
+		case <-closed:
+			// unregister at once, so following writes are not handed to the disconnected client,
+			// and it must not take elements even if it was woken up at the same time
+			db.blocking.remove(keys, w)
+			return result
+		default:
+		}
+	}
+}
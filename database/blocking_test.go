@@ -0,0 +1,164 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+// execAsync executes command in another goroutine, returns after the client starts blocking on key
+func execAsync(t *testing.T, key string, cmdLine [][]byte) chan redis.Reply {
+	ch := make(chan redis.Reply, 1)
+	waiting := testDB.blocking.waitingCount(key)
+	go func() {
+		ch <- testDB.Exec(nil, cmdLine)
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for testDB.blocking.waitingCount(key) == waiting {
+		if time.Now().After(deadline) {
+			t.Fatal("client is not blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ch
+}
+
+func receiveReply(t *testing.T, ch chan redis.Reply) redis.Reply {
+	select {
+	case result := <-ch:
+		return result
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is not woken up")
+	}
+	return nil
+}
+
+func TestBLPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b"))
+	result := testDB.Exec(nil, utils.ToCmdLine("blpop", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("brpop", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+
+	// wake up by push
+	ch := execAsync(t, key2, utils.ToCmdLine("blpop", key1, key2, "0"))
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "c"))
+	asserts.AssertMultiBulkReply(t, receiveReply(t, ch), []string{key2, "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+	if testDB.blocking.waitingCount(key1) != 0 || testDB.blocking.waitingCount(key2) != 0 {
+		t.Error("waiter should be removed")
+	}
+
+	// only one of blocked clients gets the element
+	ch1 := execAsync(t, key1, utils.ToCmdLine("brpop", key1, "0"))
+	ch2 := execAsync(t, key1, utils.ToCmdLine("brpop", key1, "0"))
+	testDB.Exec(nil, utils.ToCmdLine("lpush", key1, "d"))
+	var blocked chan redis.Reply
+	select {
+	case result = <-ch1:
+		blocked = ch2
+	case result = <-ch2:
+		blocked = ch1
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is not woken up")
+	}
+	asserts.AssertMultiBulkReply(t, result, []string{key1, "d"})
+	testDB.Exec(nil, utils.ToCmdLine("lpush", key1, "e"))
+	asserts.AssertMultiBulkReply(t, receiveReply(t, blocked), []string{key1, "e"})
+
+	result = testDB.Exec(nil, utils.ToCmdLine("blpop", key1, "-1"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("blpop", key1, "a"))
+	asserts.AssertErrReply(t, result, "ERR timeout is not a float or out of range")
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("blpop", key2, "0"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	// timeout is replied with null array like redis
+	for _, cmd := range []string{"blpop", "brpop", "bzpopmin"} {
+		result := testDB.Exec(nil, utils.ToCmdLine(cmd, key, "0.1"))
+		if string(result.ToBytes()) != "*-1\r\n" {
+			t.Errorf("%s: expect null array, actually %q", cmd, result.ToBytes())
+		}
+		if testDB.blocking.waitingCount(key) != 0 {
+			t.Errorf("%s: waiter should be removed", cmd)
+		}
+	}
+
+	// blocking commands do not block within transaction
+	conn := new(connection.FakeConn)
+	testDB.Exec(conn, utils.ToCmdLine("multi"))
+	testDB.Exec(conn, utils.ToCmdLine("blpop", key, "0"))
+	result := testDB.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertMultiBulkReplySize(t, result, 1)
+	asserts.AssertNullMultiBulk(t, result.(*protocol.MultiRawReply).Replies[0])
+}
+
+func TestBlockingDisconnect(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	conn := new(connection.FakeConn)
+	ch := make(chan redis.Reply, 1)
+	go func() {
+		ch <- testDB.Exec(conn, utils.ToCmdLine("blpop", key, "0"))
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for testDB.blocking.waitingCount(key) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client is not blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_ = conn.Close()
+	asserts.AssertNullMultiBulk(t, receiveReply(t, ch))
+	if testDB.blocking.waitingCount(key) != 0 {
+		t.Error("waiter should be removed")
+	}
+	// element pushed later is not taken by the disconnected client
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a"))
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("llen", key)), 1)
+}
+
+func TestBLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	ch := execAsync(t, key1, utils.ToCmdLine("blmove", key1, key2, "RIGHT", "LEFT", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b"))
+	asserts.AssertBulkReply(t, receiveReply(t, ch), "b")
+	result := testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("blmove", key1, key2, "LEFT", "LEFT", "-1"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+}
+
+func TestBLMoveWokenByLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	key3 := utils.RandString(10)
+	ch := execAsync(t, key2, utils.ToCmdLine("blmove", key2, key3, "LEFT", "RIGHT", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a"))
+	// moving an element into key2 wakes up the client blocked on it
+	result := testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "LEFT"))
+	asserts.AssertBulkReply(t, result, "a")
+	asserts.AssertBulkReply(t, receiveReply(t, ch), "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key3, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key1, key2))
+	asserts.AssertIntReply(t, result, 0)
+}
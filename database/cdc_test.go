@@ -0,0 +1,49 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type mockSink struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (sink *mockSink) Send(dbIndex int, cmdLine [][]byte) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.events = append(sink.events, string(rune('0'+dbIndex))+" "+string(cmdLine[0]))
+}
+
+func (sink *mockSink) Close() {}
+
+func TestWriteSink(t *testing.T) {
+	properties := config.Properties()
+	config.SetProperties(&config.ServerProperties{
+		CDCAddress: "127.0.0.1:4222", // connects on first publishing
+	})
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	server := NewStandaloneServer()
+	server.sink.Close()
+	sink := &mockSink{}
+	server.sink = sink
+	defer server.Close()
+
+	conn := new(connection.FakeConn)
+	server.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	server.Exec(conn, utils.ToCmdLine("get", "a"))
+	server.Exec(conn, utils.ToCmdLine("select", "1"))
+	server.Exec(conn, utils.ToCmdLine("incr", "a"))
+	server.Exec(conn, utils.ToCmdLine("flushall"))
+	expected := "0 set|1 incr|0 FlushAll"
+	if actual := strings.Join(sink.events, "|"); actual != expected {
+		t.Errorf("expected %s, actually %s", expected, actual)
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/tracking"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// execClient handles CLIENT subcommands about the current connection
+func execClient(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "id":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|id")
+		}
+		return protocol.MakeIntReply(int64(c.GetID()))
+	case "tracking":
+		if len(args) < 2 {
+			return protocol.MakeArgNumErrReply("client|tracking")
+		}
+		return execClientTracking(mdb, c, args[1:])
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CLIENT HELP.")
+}
+
+// execClientTracking turns on or off client side caching, invalidation messages are sent as RESP3 push
+// usage: CLIENT TRACKING ON|OFF [PREFIX prefix [PREFIX prefix ...]] [BCAST] [NOLOOP]
+func execClientTracking(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	var on bool
+	switch strings.ToUpper(string(args[0])) {
+	case "ON":
+		on = true
+	case "OFF":
+		on = false
+	default:
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	opts := tracking.Options{}
+	for i := 1; i < len(args); i++ {
+		switch arg := strings.ToUpper(string(args[i])); arg {
+		case "BCAST":
+			opts.BCast = true
+		case "NOLOOP":
+			opts.NoLoop = true
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return protocol.MakeErrReply("ERR syntax error")
+			}
+			opts.Prefixes = append(opts.Prefixes, string(args[i+1]))
+			i++
+		case "REDIRECT", "OPTIN", "OPTOUT":
+			return protocol.MakeErrReply("ERR " + arg + " option is not supported")
+		default:
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	if !on {
+		mdb.tracking.Disable(c)
+		return protocol.MakeOkReply()
+	}
+	if len(opts.Prefixes) > 0 && !opts.BCast {
+		return protocol.MakeErrReply("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if c.GetProtocol() != 3 {
+		return protocol.MakeErrReply("ERR client tracking requires RESP3, switch protocol by HELLO 3 first")
+	}
+	if errReply := mdb.tracking.Enable(c, opts); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+// execHello switches protocol version and returns information of server
+// usage: HELLO [protover [AUTH username password]]
+func execHello(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 0 && len(args) != 1 && len(args) != 4 {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	version := 0
+	if len(args) > 0 {
+		var err error
+		version, err = strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+	}
+	if len(args) == 4 {
+		if strings.ToUpper(string(args[1])) != "AUTH" {
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+		if reply := Auth(c, args[2:]); protocol.IsErrorReply(reply) {
+			return reply
+		}
+	}
+	if !IsAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time")
+	}
+	if version != 0 {
+		c.SetProtocol(version)
+	}
+	role := "master"
+	if atomic.LoadInt32(&mdb.role) == slaveRole {
+		role = "slave"
+	}
+	return protocol.MakeMapReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("server")), protocol.MakeBulkReply([]byte("godis")),
+		protocol.MakeBulkReply([]byte("proto")), protocol.MakeIntReply(int64(c.GetProtocol())),
+		protocol.MakeBulkReply([]byte("id")), protocol.MakeIntReply(int64(c.GetID())),
+		protocol.MakeBulkReply([]byte("mode")), protocol.MakeBulkReply([]byte("standalone")),
+		protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte(role)),
+		protocol.MakeBulkReply([]byte("modules")), protocol.MakeEmptyMultiBulkReply(),
+	}, c.GetProtocol() == 3)
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	c := &connection.FakeConn{}
+	ret := testServer.Exec(c, utils.ToCmdLine("HELLO"))
+	if string(ret.ToBytes()[:4]) != "*12\r" {
+		t.Errorf("expect array reply in RESP2, actual %q", ret.ToBytes())
+	}
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3"))
+	if string(ret.ToBytes()[:4]) != "%6\r\n" {
+		t.Errorf("expect map reply in RESP3, actual %q", ret.ToBytes())
+	}
+	if c.GetProtocol() != 3 {
+		t.Error("protocol should be switched to RESP3")
+	}
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "4"))
+	asserts.AssertErrReply(t, ret, "NOPROTO unsupported protocol version")
+	ret = testServer.Exec(c, utils.ToCmdLine("CLIENT", "ID"))
+	asserts.AssertIntReply(t, ret, int(c.GetID()))
+}
+
+func TestClientTracking(t *testing.T) {
+	key := utils.RandString(10)
+	c := &connection.FakeConn{}
+	writer := &connection.FakeConn{}
+	ret := testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "ON"))
+	asserts.AssertErrReply(t, ret, "ERR client tracking requires RESP3, switch protocol by HELLO 3 first")
+	testServer.Exec(c, utils.ToCmdLine("HELLO", "3"))
+	ret = testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "ON"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	defer testServer.AfterClientClose(c)
+
+	// keys are invalidated only after being read
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("SET", key, "1"))
+	if len(c.Bytes()) > 0 {
+		t.Errorf("unexpected invalidation %q", c.Bytes())
+	}
+	testServer.Exec(c, utils.ToCmdLine("GET", key))
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("SET", key, "2"))
+	expected := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$10\r\n" + key + "\r\n"
+	if string(c.Bytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, c.Bytes())
+	}
+	// invalidation is sent once until key is read again
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("SET", key, "3"))
+	if len(c.Bytes()) > 0 {
+		t.Errorf("unexpected invalidation %q", c.Bytes())
+	}
+
+	// flush invalidates all keys
+	testServer.Exec(c, utils.ToCmdLine("GET", key))
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("FLUSHDB"))
+	expected = ">2\r\n$10\r\ninvalidate\r\n_\r\n"
+	if string(c.Bytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, c.Bytes())
+	}
+
+	ret = testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "ON", "BCAST"))
+	asserts.AssertErrReply(t, ret, "ERR You can't switch BCAST mode on/off before disabling tracking "+
+		"for this client, and then re-enabling it with a different mode.")
+	ret = testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "OFF"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	testServer.Exec(c, utils.ToCmdLine("GET", key))
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("SET", key, "4"))
+	if len(c.Bytes()) > 0 {
+		t.Errorf("unexpected invalidation %q", c.Bytes())
+	}
+}
+
+func TestClientTrackingBCast(t *testing.T) {
+	c := &connection.FakeConn{}
+	testServer.Exec(c, utils.ToCmdLine("HELLO", "3"))
+	ret := testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "ON", "PREFIX", "user:"))
+	asserts.AssertErrReply(t, ret, "ERR PREFIX option requires BCAST mode to be enabled")
+	ret = testServer.Exec(c, utils.ToCmdLine("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "NOLOOP"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	defer testServer.AfterClientClose(c)
+
+	writer := &connection.FakeConn{}
+	c.Clean()
+	testServer.Exec(writer, utils.ToCmdLine("MSET", "user:1", "a", "order:1", "b"))
+	expected := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n"
+	if string(c.Bytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, c.Bytes())
+	}
+	// NOLOOP skips keys modified by the client itself
+	c.Clean()
+	testServer.Exec(c, utils.ToCmdLine("SET", "user:2", "a"))
+	if len(c.Bytes()) > 0 {
+		t.Errorf("unexpected invalidation %q", c.Bytes())
+	}
+}
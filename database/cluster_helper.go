@@ -3,8 +3,12 @@ package database
 import (
 	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/slotmap"
+	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"time"
 )
 
 // execExistIn returns existing key in given keys
@@ -25,64 +29,100 @@ func execExistIn(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
-// execDumpKey returns redis serialization protocol data of given key (see aof.EntityToCmd)
+// execDumpKey returns serialized value of given key in format of DUMP, and its expire time in unix milliseconds
+// which is -1 if the key has no TTL. It is used to move keys among nodes, see execRenameTo
 func execDumpKey(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	entity, ok := db.GetEntity(key)
 	if !ok {
 		return protocol.MakeEmptyMultiBulkReply()
 	}
-	dumpCmd := aof.EntityToCmd(key, entity)
-	ttlCmd := toTTLCmd(db, key)
-	resp := protocol.MakeMultiBulkReply([][]byte{
-		dumpCmd.ToBytes(),
-		ttlCmd.ToBytes(),
+	payload, err := aof.DumpEntity(entity)
+	if err != nil {
+		// types not supported by rdb encoder such as stream are dumped as commands creating the key, see aof.EntityToCmds
+		payload = nil
+		for _, cmd := range aof.EntityToCmds(key, entity) {
+			payload = append(payload, cmd.ToBytes()...)
+		}
+	}
+	expireAt := int64(-1)
+	if expireTime, hasTTL := db.GetExpiration(key); hasTTL {
+		expireAt = expireTime.UnixNano() / int64(time.Millisecond)
+	}
+	return protocol.MakeMultiBulkReply([][]byte{
+		payload,
+		[]byte(strconv.FormatInt(expireAt, 10)),
 	})
-	return resp
 }
 
-// execRenameFrom is exactly same as execDel, used for cluster.Rename
-func execRenameFrom(db *DB, args [][]byte) redis.Reply {
-	key := string(args[0])
-	db.Remove(key)
-	return protocol.MakeOkReply()
-}
-
-// execRenameTo accepts result of execDumpKey and load the dumped key
-// args format: key dumpCmd ttlCmd
-// execRenameTo may be partially successful, do not use it without transaction
-func execRenameTo(db *DB, args [][]byte) redis.Reply {
-	key := args[0]
-	dumpRawCmd, err := parser.ParseOne(args[1])
+// restoreDumped restores result of execDumpKey as key by RESTORE, existing key is replaced
+func restoreDumped(db *DB, key []byte, payload []byte, expireAt []byte) redis.Reply {
+	ms, err := strconv.ParseInt(string(expireAt), 10, 64)
 	if err != nil {
-		return protocol.MakeErrReply("illegal dump cmd: " + err.Error())
+		return protocol.MakeErrReply("ERR illegal expire time of dumped key")
 	}
-	dumpCmd, ok := dumpRawCmd.(*protocol.MultiBulkReply)
-	if !ok {
-		return protocol.MakeErrReply("dump cmd is not multi bulk reply")
+	if len(payload) > 0 && payload[0] == '*' {
+		// payload of DUMP starts with rdb type instead of '*'
+		return restoreCmd(db, key, payload, ms)
+	}
+	ttl := []byte("0")
+	if ms >= 0 {
+		ttl = expireAt
 	}
-	dumpCmd.Args[1] = key // change key
-	ttlRawCmd, err := parser.ParseOne(args[2])
+	return execRestore(db, [][]byte{key, ttl, payload, []byte("REPLACE"), []byte("ABSTTL")})
+}
+
+// restoreCmd restores key dumped as commands by execDumpKey. The commands name the source key,
+// so they are executed on a temporary database and the entity created by them is put as key
+func restoreCmd(db *DB, key []byte, payload []byte, expireAt int64) redis.Reply {
+	replies, err := parser.ParseBytes(payload)
 	if err != nil {
-		return protocol.MakeErrReply("illegal ttl cmd: " + err.Error())
+		return protocol.MakeErrReply("ERR illegal dump cmd: " + err.Error())
+	}
+	tmpDB := makeBasicDB()
+	srcKey := ""
+	for _, raw := range replies {
+		cmd, ok := raw.(*protocol.MultiBulkReply)
+		if !ok || len(cmd.Args) < 2 {
+			return protocol.MakeErrReply("ERR dump cmd is not multi bulk reply")
+		}
+		if srcKey == "" {
+			srcKey = string(cmd.Args[1])
+		}
+		result := tmpDB.execWithLock(cmd.Args)
+		if protocol.IsErrorReply(result) {
+			return result
+		}
 	}
-	ttlCmd, ok := ttlRawCmd.(*protocol.MultiBulkReply)
+	entity, ok := tmpDB.GetEntity(srcKey)
 	if !ok {
-		return protocol.MakeErrReply("ttl cmd is not multi bulk reply")
+		return protocol.MakeErrReply("ERR dump cmd creates nothing")
 	}
-	ttlCmd.Args[1] = key
 	db.Remove(string(key))
-	dumpResult := db.execWithLock(dumpCmd.Args)
-	if protocol.IsErrorReply(dumpResult) {
-		return dumpResult
+	db.addAof(utils.ToCmdLine("del", string(key)))
+	db.PutEntity(string(key), entity)
+	for _, cmd := range aof.EntityToCmds(string(key), entity) {
+		db.addAof(cmd.Args)
 	}
-	ttlResult := db.execWithLock(ttlCmd.Args)
-	if protocol.IsErrorReply(ttlResult) {
-		return ttlResult
+	if expireAt >= 0 {
+		return db.execWithLock(utils.ToCmdLine("PEXPIREAT", string(key), strconv.FormatInt(expireAt, 10)))
 	}
 	return protocol.MakeOkReply()
 }
 
+// execRenameFrom is exactly same as execDel, used for cluster.Rename
+func execRenameFrom(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	db.Remove(key)
+	return protocol.MakeOkReply()
+}
+
+// execRenameTo accepts result of execDumpKey and load the dumped key
+// args format: key payload expireAt
+func execRenameTo(db *DB, args [][]byte) redis.Reply {
+	return restoreDumped(db, args[0], args[1], args[2])
+}
+
 // execRenameNxTo is exactly same as execRenameTo, used for cluster.RenameNx, not exists check in cluster.prepareRenameNxTo
 func execRenameNxTo(db *DB, args [][]byte) redis.Reply {
 	return execRenameTo(db, args)
@@ -94,38 +134,56 @@ func execCopyFrom(db *DB, args [][]byte) redis.Reply {
 }
 
 // execCopyTo accepts result of execDumpKey and load the dumped key
-// args format: key dumpCmd ttlCmd
-// execCopyTo may be partially successful, do not use it without transaction
+// args format: key payload expireAt replaceFlag, replaceFlag has been checked in cluster.prepareCopyTo
 func execCopyTo(db *DB, args [][]byte) redis.Reply {
-	key := args[0]
-	dumpRawCmd, err := parser.ParseOne(args[1])
-	if err != nil {
-		return protocol.MakeErrReply("illegal dump cmd: " + err.Error())
+	return restoreDumped(db, args[0], args[1], args[2])
+}
+
+// parseSlot returns -1 if arg is not a valid hash slot
+func parseSlot(arg []byte) int {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= slotmap.SlotCount {
+		return -1
 	}
-	dumpCmd, ok := dumpRawCmd.(*protocol.MultiBulkReply)
-	if !ok {
-		return protocol.MakeErrReply("dump cmd is not multi bulk reply")
+	return slot
+}
+
+// execCountKeysInSlot returns number of keys in given hash slot, used for cluster.CountKeysInSlot
+// example: CountKeysInSlot slot
+func execCountKeysInSlot(db *DB, args [][]byte) redis.Reply {
+	slot := parseSlot(args[0])
+	if slot < 0 {
+		return protocol.MakeErrReply("ERR Invalid slot")
 	}
-	dumpCmd.Args[1] = key // change key
-	ttlRawCmd, err := parser.ParseOne(args[2])
-	if err != nil {
-		return protocol.MakeErrReply("illegal ttl cmd: " + err.Error())
+	if db.slots == nil {
+		return protocol.MakeIntReply(0)
 	}
-	ttlCmd, ok := ttlRawCmd.(*protocol.MultiBulkReply)
-	if !ok {
-		return protocol.MakeErrReply("ttl cmd is not multi bulk reply")
+	return protocol.MakeIntReply(int64(db.slots.count(slot)))
+}
+
+// execGetKeysInSlot returns at most count keys in given hash slot, used for cluster.GetKeysInSlot
+// example: GetKeysInSlot slot count
+func execGetKeysInSlot(db *DB, args [][]byte) redis.Reply {
+	slot := parseSlot(args[0])
+	if slot < 0 {
+		return protocol.MakeErrReply("ERR Invalid slot")
 	}
-	ttlCmd.Args[1] = key
-	db.Remove(string(key))
-	dumpResult := db.execWithLock(dumpCmd.Args)
-	if protocol.IsErrorReply(dumpResult) {
-		return dumpResult
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return protocol.MakeErrReply("ERR Invalid number of keys")
 	}
-	ttlResult := db.execWithLock(ttlCmd.Args)
-	if protocol.IsErrorReply(ttlResult) {
-		return ttlResult
+	if db.slots == nil {
+		return protocol.MakeEmptyMultiBulkReply()
 	}
-	return protocol.MakeOkReply()
+	keys := db.slots.keys(slot, count)
+	if len(keys) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return protocol.MakeMultiBulkReply(result)
 }
 
 func init() {
@@ -136,4 +194,6 @@ func init() {
 	RegisterCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	RegisterCommand("CopyFrom", execCopyFrom, readFirstKey, nil, 2, flagReadOnly)
 	RegisterCommand("CopyTo", execCopyTo, writeFirstKey, rollbackFirstKey, 5, flagWrite)
+	RegisterCommand("CountKeysInSlot", execCountKeysInSlot, noPrepare, nil, 2, flagReadOnly)
+	RegisterCommand("GetKeysInSlot", execGetKeysInSlot, noPrepare, nil, 3, flagReadOnly)
 }
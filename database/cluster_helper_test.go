@@ -2,9 +2,11 @@ package database
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/lib/slotmap"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
 	"testing"
 )
 
@@ -56,3 +58,49 @@ func TestDumpKeyAndRenameTo(t *testing.T) {
 		return
 	}
 }
+
+func TestDumpStreamAndRenameTo(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	newKey := key + utils.RandString(2)
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1", "f", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "2", "f", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "COUNT", "1", "STREAMS", key, ">"))
+
+	// stream is dumped as commands
+	result := testDB.Exec(nil, utils.ToCmdLine("DumpKey", key))
+	dumpResult := result.(*protocol.MultiBulkReply)
+	result = testDB.Exec(nil, utils.ToCmdLine("RenameTo", newKey,
+		string(dumpResult.Args[0]), string(dumpResult.Args[1])))
+	asserts.AssertNotError(t, result)
+	testDB.Exec(nil, utils.ToCmdLine("RenameFrom", key))
+
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("exists", key)), 0)
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("XLen", newKey)), 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", newKey, "g", "-", "+", "10", "c1"))
+	asserts.AssertMultiBulkReplySize(t, result, 1)
+}
+
+func TestKeysInSlot(t *testing.T) {
+	db := makeTestDB()
+	db.slots = makeSlotIndex()
+	keys := []string{"{user1}:name", "{user1}:age", "{user1}:email"}
+	for _, key := range keys {
+		db.Exec(nil, utils.ToCmdLine("set", key, "1"))
+	}
+	db.Exec(nil, utils.ToCmdLine("set", "user2", "1"))
+	slot := strconv.Itoa(slotmap.HashSlot("user1"))
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("CountKeysInSlot", slot)), 3)
+	asserts.AssertMultiBulkReplySize(t, db.Exec(nil, utils.ToCmdLine("GetKeysInSlot", slot, "2")), 2)
+	asserts.AssertMultiBulkReplySize(t, db.Exec(nil, utils.ToCmdLine("GetKeysInSlot", slot, "10")), 3)
+
+	db.Exec(nil, utils.ToCmdLine("del", keys[0]))
+	db.Exec(nil, utils.ToCmdLine("rename", keys[1], "user3"))
+	asserts.AssertMultiBulkReply(t, db.Exec(nil, utils.ToCmdLine("GetKeysInSlot", slot, "10")), []string{keys[2]})
+	db.Flush()
+	asserts.AssertIntReply(t, db.Exec(nil, utils.ToCmdLine("CountKeysInSlot", slot)), 0)
+
+	asserts.AssertErrReply(t, db.Exec(nil, utils.ToCmdLine("CountKeysInSlot", "16384")), "ERR Invalid slot")
+	asserts.AssertErrReply(t, db.Exec(nil, utils.ToCmdLine("GetKeysInSlot", slot, "-1")), "ERR Invalid number of keys")
+}
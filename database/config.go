@@ -0,0 +1,109 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+)
+
+// ReloadConfig reads config file again and applies hot reloadable properties
+func (mdb *MultiDB) ReloadConfig() (*config.ReloadResult, error) {
+	result, err := config.Reload()
+	if err != nil {
+		return nil, err
+	}
+	mdb.applyConfig(result.Applied)
+	return result, nil
+}
+
+// applyConfig applies changed properties which are not read on each use, such as appendfsync
+func (mdb *MultiDB) applyConfig(keys []string) {
+	for _, key := range keys {
+		if key == "appendfsync" && mdb.aofHandler != nil {
+			if err := mdb.aofHandler.SetFsync(config.Properties().AppendFsync); err != nil {
+				logger.Error("apply appendfsync failed: " + err.Error())
+			}
+		}
+	}
+}
+
+// execConfig manages server config
+// usage: CONFIG GET pattern [pattern ...] | CONFIG SET parameter value [parameter value ...] | CONFIG REWRITE |
+// CONFIG RELOAD
+func execConfig(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "get":
+		if len(args) < 2 {
+			return protocol.MakeArgNumErrReply("config|get")
+		}
+		return execConfigGet(c, args[1:])
+	case "set":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return protocol.MakeArgNumErrReply("config|set")
+		}
+		keyValues := make([]string, len(args)-1)
+		keys := make([]string, 0, len(keyValues)/2)
+		for i, arg := range args[1:] {
+			keyValues[i] = string(arg)
+			if i%2 == 0 {
+				keys = append(keys, strings.ToLower(string(arg)))
+			}
+		}
+		if err := config.Set(keyValues...); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		mdb.applyConfig(keys)
+		return protocol.MakeOkReply()
+	case "rewrite":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("config|rewrite")
+		}
+		if err := config.Rewrite(); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "reload":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("config|reload")
+		}
+		result, err := mdb.ReloadConfig()
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return makeReloadReply(result)
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CONFIG HELP.")
+}
+
+// execConfigGet returns parameters matching any of the patterns and their values, each parameter is returned once
+func execConfigGet(c redis.Connection, patterns [][]byte) redis.Reply {
+	var pairs []redis.Reply
+	found := make(map[string]bool)
+	for _, pattern := range patterns {
+		keyValues, err := config.Get(string(pattern))
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		for i := 0; i < len(keyValues); i += 2 {
+			if found[keyValues[i]] {
+				continue
+			}
+			found[keyValues[i]] = true
+			pairs = append(pairs, protocol.MakeBulkReply([]byte(keyValues[i])), protocol.MakeBulkReply([]byte(keyValues[i+1])))
+		}
+	}
+	return protocol.MakeMapReply(pairs, c != nil && c.GetProtocol() == 3)
+}
+
+// makeReloadReply returns changed properties which require restart, it is empty if all changes have taken effect
+func makeReloadReply(result *config.ReloadResult) redis.Reply {
+	restartRequired := make([][]byte, len(result.RestartRequired))
+	for i, key := range result.RestartRequired {
+		restartRequired[i] = []byte(key)
+	}
+	return protocol.MakeMultiBulkReply(restartRequired)
+}
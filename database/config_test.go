@@ -0,0 +1,88 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+)
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "redis.conf")
+	write := func(content string) {
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	base := "appendonly yes\nappendfilename " + filepath.Join(dir, "a.aof") + "\n"
+	write(base + "appendfsync always\n")
+	config.SetupConfig(filename)
+	db := NewStandaloneServer()
+	defer db.Close()
+	conn := &connection.FakeConn{}
+
+	write(base + "appendfsync no\nmaxclients 5\n")
+	ret := db.Exec(conn, utils.ToCmdLine("CONFIG", "RELOAD"))
+	asserts.AssertMultiBulkReplySize(t, ret, 0)
+	if config.Properties().AppendFsync != "no" || config.Properties().MaxClients != 5 {
+		t.Errorf("expect appendfsync and maxclients applied, actually %s %d",
+			config.Properties().AppendFsync, config.Properties().MaxClients)
+	}
+	ret = db.Exec(conn, utils.ToCmdLine("SET", "a", "1"))
+	asserts.AssertNotError(t, ret)
+
+	write(base + "appendfsync no\nmaxclients 5\ndatabases 4\n")
+	ret = db.Exec(conn, utils.ToCmdLine("CONFIG", "RELOAD"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"databases"})
+
+	ret = db.Exec(conn, utils.ToCmdLine("CONFIG", "RELOAD", "now"))
+	asserts.AssertErrReply(t, ret, "ERR wrong number of arguments for 'config|reload' command")
+	ret = db.Exec(conn, utils.ToCmdLine("CONFIG", "NONE"))
+	asserts.AssertErrReply(t, ret, "ERR unknown subcommand 'NONE'. Try CONFIG HELP.")
+}
+
+func TestConfigGetSet(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "redis.conf")
+	if err := os.WriteFile(filename, []byte("# limits\nmaxclients 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetupConfig(filename)
+	conn := &connection.FakeConn{}
+
+	ret := testServer.Exec(conn, utils.ToCmdLine("CONFIG", "SET", "maxclients", "200", "timeout", "30"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = testServer.Exec(conn, utils.ToCmdLine("CONFIG", "GET", "maxclients", "max*", "timeout"))
+	expected := protocol.MakeMultiBulkReply(utils.ToCmdLine("maxclients", "200", "timeout", "30"))
+	if string(ret.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expect maxclients and timeout, actually %s", ret.ToBytes())
+	}
+	ret = testServer.Exec(conn, utils.ToCmdLine("CONFIG", "SET", "port", "6400"))
+	asserts.AssertErrReply(t, ret, "ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config")
+	ret = testServer.Exec(conn, utils.ToCmdLine("CONFIG", "SET", "maxclients"))
+	asserts.AssertErrReply(t, ret, "ERR wrong number of arguments for 'config|set' command")
+
+	ret = testServer.Exec(conn, utils.ToCmdLine("CONFIG", "REWRITE"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "# limits\nmaxclients 200\ntimeout 30\n" {
+		t.Errorf("unexpected config file: %s", content)
+	}
+}
@@ -3,6 +3,8 @@ package database
 import (
 	"fmt"
 	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/backup"
+	"github.com/hdt3213/godis/cdc"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
@@ -11,9 +13,13 @@ import (
 	"github.com/hdt3213/godis/pubsub"
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/script"
+	"github.com/hdt3213/godis/tracking"
+	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -24,62 +30,139 @@ type MultiDB struct {
 
 	// handle publish/subscribe
 	hub *pubsub.Hub
+	// handle client side caching
+	tracking *tracking.Table
+	// lua scripts loaded by SCRIPT LOAD and EVAL
+	scripts       *script.Cache
+	scriptMonitor *script.Monitor
+	functions     *script.Functions
+	// snapshotGate is held by commands while modifying data, and is locked exclusively while snapshot being taken
+	snapshotGate sync.RWMutex
 	// handle aof persistence
 	aofHandler *aof.Handler
+	// receive write commands after aof, nil if change data capture is disabled
+	sink database.WriteSink
+	// upload snapshots to backup target, nil if backup is disabled
+	backup *backup.Manager
 
+	// remove expired keys in background
+	expire *expireCron
+
+	// master holds replication stream sent to slaves
+	master *masterStatus
 	// store master node address
 	slaveOf     string
 	role        int32
 	replication *slaveStatus
+	// failover holds coordinated failover started by FAILOVER
+	failover *failoverStatus
+
+	// saving is 1 while rdb is being saved by SAVE or BGSAVE
+	saving int32
+	// lastSaveTime is the unix timestamp of the latest successful saving or startup
+	lastSaveTime   int64
+	lastSaveFailed int32
+	// dirty is the number of changes since the latest successful saving
+	dirty int64
+	// saves is the number of saving since startup, saveStart is the unix nano of the running saving.
+	// lastSaveDuration is the duration of the latest saving, -1 if never saved
+	saves            int64
+	saveStart        int64
+	lastSaveDuration int64
+
+	// shutdownFunc is set by server, SHUTDOWN asks it to stop serving clients and close database gracefully.
+	// Without it, SHUTDOWN closes database and exits immediately
+	shutdownFunc func()
+	// saveOnClose is 1 if SHUTDOWN SAVE is requested, rdb is saved once database is closed
+	saveOnClose int32
 }
 
 // NewStandaloneServer creates a standalone redis server, with multi database and all other funtions
 func NewStandaloneServer() *MultiDB {
 	mdb := &MultiDB{}
-	if config.Properties.Databases == 0 {
-		config.Properties.Databases = 16
+	if config.Properties().Databases == 0 {
+		config.Update(func(p *config.ServerProperties) {
+			p.Databases = 16
+		})
 	}
 	// 创建数据库集合，即MultiDB的dbSet熟悉
-	mdb.dbSet = make([]*atomic.Value, config.Properties.Databases)
+	mdb.dbSet = make([]*atomic.Value, config.Properties().Databases)
+	mdb.tracking = tracking.MakeTable()
+	// writes are checked against failover while loading aof
+	mdb.failover = &failoverStatus{}
+	mdb.scripts = script.MakeCache()
+	mdb.scriptMonitor = script.MakeMonitor()
+	mdb.functions = script.MakeFunctions()
 	for i := range mdb.dbSet {
 		singleDB := makeDB()
 		singleDB.index = i
+		singleDB.tracking = mdb.tracking
+		singleDB.scripts = mdb.scripts
+		singleDB.scriptMonitor = mdb.scriptMonitor
+		singleDB.functions = mdb.functions
+		singleDB.snapshotGate = &mdb.snapshotGate
 		holder := &atomic.Value{}
 		holder.Store(singleDB)
 		mdb.dbSet[i] = holder
 	}
 	mdb.hub = pubsub.MakeHub()
+	backupManager, err := backup.NewManager()
+	if err != nil {
+		panic(err)
+	}
+	mdb.backup = backupManager
+	if mdb.backup != nil && config.Properties().BackupRestore {
+		restoreBackup(mdb.backup)
+	}
 	validAof := false
-	if config.Properties.AppendOnly {
-		aofHandler, err := aof.NewAOFHandler(mdb, func() database.EmbedDB {
-			return MakeBasicMultiDB()
-		})
+	if config.Properties().AppendOnly {
+		aofHandler, err := aof.NewAOFHandler(mdb)
 		if err != nil {
 			panic(err)
 		}
 		mdb.aofHandler = aofHandler
-		for _, db := range mdb.dbSet {
-			singleDB := db.Load().(*DB)
-			singleDB.addAof = func(line CmdLine) {
-				mdb.aofHandler.AddAof(singleDB.index, line)
-			}
+		if mdb.backup != nil {
+			aofHandler.OnRewritten(func(filename string) {
+				mdb.uploadBackup(filename, backup.KindAOF)
+			})
 		}
 		validAof = true
 	}
-	if config.Properties.RDBFilename != "" && !validAof {
+	if !validAof {
 		// load rdb
 		loadRdbFile(mdb)
 	}
+	if config.Properties().CDCAddress != "" {
+		sink, err := cdc.NewSink()
+		if err != nil {
+			panic(err)
+		}
+		mdb.sink = sink
+	}
+	// changes are counted even if neither aof nor sink is enabled
+	for _, db := range mdb.dbSet {
+		singleDB := db.Load().(*DB)
+		singleDB.addAof = func(line CmdLine) {
+			mdb.addAof(singleDB.index, line)
+		}
+		singleDB.isReplica = mdb.isReplica
+	}
+	mdb.lastSaveTime = time.Now().Unix()
+	mdb.lastSaveDuration = -1
 	mdb.replication = initReplStatus()
+	mdb.master = initMasterStatus()
 	mdb.startReplCron()
 	mdb.role = masterRole // The initialization process does not require atomicity
+	mdb.startExpireCron()
 	return mdb
 }
 
-// MakeBasicMultiDB create a MultiDB only with basic abilities for aof rewrite and other usages
+// MakeBasicMultiDB create a MultiDB only with basic abilities for loading rdb and other usages
 func MakeBasicMultiDB() *MultiDB {
 	mdb := &MultiDB{}
-	mdb.dbSet = make([]*atomic.Value, config.Properties.Databases)
+	mdb.functions = script.MakeFunctions()
+	mdb.failover = &failoverStatus{}
+	mdb.dbSet = make([]*atomic.Value, config.Properties().Databases)
 	for i := range mdb.dbSet {
 		holder := &atomic.Value{}
 		holder.Store(makeBasicDB())
@@ -88,6 +171,42 @@ func MakeBasicMultiDB() *MultiDB {
 	return mdb
 }
 
+// specialWriteCommands are special commands which modify data like normal write commands
+var specialWriteCommands = map[string]bool{
+	"flushall": true,
+	"flushdb":  true,
+	"copy":     true,
+}
+
+func isWriteCommand(name string) bool {
+	if specialWriteCommands[name] {
+		return true
+	}
+	_, ok := cmdTable[name]
+	return ok && !IsReadOnlyCommand(name)
+}
+
+// slaveSpecialCommands are special commands which don't write, so they are allowed on read only slave
+var slaveSpecialCommands = map[string]bool{
+	"info":      true,
+	"select":    true,
+	"wait":      true,
+	"readonly":  true,
+	"readwrite": true,
+	"failover":  true,
+	"role":      true,
+	// sentinels exchange hello messages through replicas
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"publish":      true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+	"spublish":     true,
+	"pubsub":       true,
+}
+
 // Exec executes command
 // parameter `cmdLine` contains command and its arguments, for example: "set key value"
 func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
@@ -103,28 +222,61 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 	if cmdName == "auth" {
 		return Auth(c, cmdLine[1:])
 	}
-	if !isAuthenticated(c) {
+	// HELLO could authenticate the client by AUTH option, it is allowed while script is busy like AUTH
+	if cmdName == "hello" {
+		return execHello(mdb, c, cmdLine[1:])
+	}
+	if !IsAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
-	if cmdName == "slaveof" {
+	if mdb.scriptMonitor.Busy(luaTimeLimit()) && !isAllowedWhenBusy(cmdLine) {
+		return protocol.MakeErrReply("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+	}
+	if cmdName == "slaveof" || cmdName == "replicaof" {
 		if c != nil && c.InMultiState() {
 			return protocol.MakeErrReply("cannot use slave of database within multi")
 		}
 		if len(cmdLine) != 3 {
-			return protocol.MakeArgNumErrReply("SLAVEOF")
+			return protocol.MakeArgNumErrReply(cmdName)
 		}
 		return mdb.execSlaveOf(c, cmdLine[1:])
 	}
+	// commands from slaves are allowed on read only slave, which could be master of other slaves
+	if cmdName == "replconf" || cmdName == "psync" || cmdName == "sync" {
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR Command not allowed inside a transaction")
+		}
+		if cmdName == "replconf" {
+			return mdb.execReplConf(c, cmdLine[1:])
+		}
+		if (cmdName == "psync" && len(cmdLine) != 3 && len(cmdLine) != 4) || (cmdName == "sync" && len(cmdLine) != 1) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return mdb.execPSync(c, cmdName == "psync", cmdLine[1:])
+	}
 
+	// writes paused by failover are executed after it finished, they are refused if this node has been demoted
+	if c != nil && c.GetRole() != connection.ReplicationRecvCli && isWriteCommand(cmdName) {
+		mdb.failover.waitWrites()
+	}
 	// read only slave
 	role := atomic.LoadInt32(&mdb.role)
-	if role == slaveRole &&
-		c.GetRole() != connection.ReplicationRecvCli {
-		// only allow read only command, forbid all special commands except `auth` and `slaveof`
-		if !isReadOnlyCommand(cmdName) {
+	if role == slaveRole && config.Properties().ReplicaReadOnly &&
+		c != nil && c.GetRole() != connection.ReplicationRecvCli {
+		// only allow read only command, forbid all special commands except `auth`, `slaveof` and those not writing
+		if !IsReadOnlyCommand(cmdName) && !slaveSpecialCommands[cmdName] {
 			return protocol.MakeErrReply("READONLY You can't write against a read only slave.")
 		}
 	}
+	// master without enough good slaves
+	if role == masterRole && c != nil && c.GetRole() != connection.ReplicationRecvCli && isWriteCommand(cmdName) {
+		if errReply := mdb.checkGoodReplicas(); errReply != nil {
+			if c != nil && c.InMultiState() {
+				c.AddTxError(errReply)
+			}
+			return errReply
+		}
+	}
 
 	// special commands which cannot execute within transaction
 	if cmdName == "subscribe" {
@@ -136,21 +288,63 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 		return pubsub.Publish(mdb.hub, cmdLine[1:])
 	} else if cmdName == "unsubscribe" {
 		return pubsub.UnSubscribe(mdb.hub, c, cmdLine[1:])
+	} else if cmdName == "psubscribe" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("psubscribe")
+		}
+		return pubsub.PSubscribe(mdb.hub, c, cmdLine[1:])
+	} else if cmdName == "punsubscribe" {
+		return pubsub.PUnSubscribe(mdb.hub, c, cmdLine[1:])
+	} else if cmdName == "ssubscribe" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("ssubscribe")
+		}
+		return pubsub.SSubscribe(mdb.hub, c, cmdLine[1:])
+	} else if cmdName == "sunsubscribe" {
+		return pubsub.SUnSubscribe(mdb.hub, c, cmdLine[1:])
+	} else if cmdName == "spublish" {
+		return pubsub.SPublish(mdb.hub, cmdLine[1:])
+	} else if cmdName == "pubsub" {
+		return pubsub.PubSub(mdb.hub, cmdLine[1:])
+	} else if cmdName == "client" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execClient(mdb, c, cmdLine[1:])
+	} else if cmdName == "function" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execFunction(mdb, c, cmdLine)
+	} else if cmdName == "config" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return execConfig(mdb, c, cmdLine[1:])
+	} else if cmdName == "shutdown" {
+		return execShutdown(mdb, cmdLine[1:])
 	} else if cmdName == "bgrewriteaof" {
 		// aof.go imports router.go, router.go cannot import BGRewriteAOF from aof.go
 		return BGRewriteAOF(mdb, cmdLine[1:])
 	} else if cmdName == "rewriteaof" {
 		return RewriteAOF(mdb, cmdLine[1:])
 	} else if cmdName == "flushall" {
-		return mdb.flushAll()
+		async, errReply := parseFlushMode(cmdName, cmdLine[1:])
+		if errReply != nil {
+			return errReply
+		}
+		return mdb.flushAll(async)
 	} else if cmdName == "flushdb" {
-		if !validateArity(1, cmdLine) {
-			return protocol.MakeArgNumErrReply(cmdName)
+		async, errReply := parseFlushMode(cmdName, cmdLine[1:])
+		if errReply != nil {
+			return errReply
 		}
 		if c.InMultiState() {
 			return protocol.MakeErrReply("ERR command 'FlushDB' cannot be used in MULTI")
 		}
-		return mdb.flushDB(c.GetDBIndex())
+		return mdb.flushDB(c.GetDBIndex(), async)
+	} else if cmdName == "info" {
+		return execInfo(mdb, cmdLine[1:])
 	} else if cmdName == "save" {
 		return SaveRDB(mdb, cmdLine[1:])
 	} else if cmdName == "bgsave" {
@@ -163,6 +357,27 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 			return protocol.MakeArgNumErrReply("select")
 		}
 		return execSelect(c, mdb, cmdLine[1:])
+	} else if cmdName == "wait" {
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR Command not allowed inside a transaction")
+		}
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return mdb.execWait(cmdLine[1:])
+	} else if cmdName == "role" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return mdb.execRole()
+	} else if cmdName == "failover" {
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR Command not allowed inside a transaction")
+		}
+		return mdb.execFailover(cmdLine[1:])
+	} else if cmdName == "readonly" || cmdName == "readwrite" {
+		// there is no stale read from replica without cluster
+		return protocol.MakeErrReply("ERR This instance has cluster support disabled")
 	} else if cmdName == "copy" {
 		if len(cmdLine) < 3 {
 			return protocol.MakeArgNumErrReply("copy")
@@ -184,15 +399,97 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 // AfterClientClose does some clean after client close connection
 func (mdb *MultiDB) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(mdb.hub, c)
+	mdb.tracking.Disable(c)
+	mdb.master.removeReplica(c)
+}
+
+// exitProcess terminates the server after SHUTDOWN, it is replaced in tests
+var exitProcess = func() {
+	os.Exit(0)
+}
+
+// execShutdown stops the server, running scripts are killed
+// usage: SHUTDOWN [NOSAVE|SAVE]
+func execShutdown(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	save := false
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0])) {
+		case "NOSAVE":
+		case "SAVE":
+			save = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	mdb.scriptMonitor.KillAll()
+	if mdb.shutdownFunc != nil {
+		if save {
+			atomic.StoreInt32(&mdb.saveOnClose, 1)
+		}
+		// server waits for in-flight commands and then closes database, which saves rdb if requested
+		logger.Info("SHUTDOWN requested, shutting down...")
+		mdb.shutdownFunc()
+		return &protocol.NoReply{}
+	}
+	if save {
+		if reply := SaveRDB(mdb, nil); protocol.IsErrorReply(reply) {
+			logger.Error("save before shutdown failed: " + string(reply.ToBytes()))
+			return protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+	}
+	mdb.Close()
+	exitProcess()
+	return &protocol.NoReply{}
+}
+
+// SetShutdownFunc sets the function stopping server by SHUTDOWN, it should close database after in-flight
+// commands finished. It must not block, since SHUTDOWN is in flight itself
+func (mdb *MultiDB) SetShutdownFunc(shutdown func()) {
+	mdb.shutdownFunc = shutdown
 }
 
 // Close graceful shutdown database
 func (mdb *MultiDB) Close() {
+	if atomic.CompareAndSwapInt32(&mdb.saveOnClose, 1, 0) {
+		if reply := SaveRDB(mdb, nil); protocol.IsErrorReply(reply) {
+			logger.Error("save before shutdown failed: " + string(reply.ToBytes()))
+		}
+	}
 	// stop replication first
 	mdb.replication.close()
+	// slaves are disconnected once they have received all writes, or after shutdown timeout
+	mdb.master.waitAllAcked(config.ShutdownTimeout())
+	mdb.master.dropReplicas()
+	if mdb.expire != nil {
+		mdb.expire.close()
+	}
 	if mdb.aofHandler != nil {
 		mdb.aofHandler.Close()
 	}
+	if mdb.sink != nil {
+		mdb.sink.Close()
+	}
+	if mdb.backup != nil {
+		mdb.backup.Close()
+	}
+}
+
+// addAof persists write command and sends it to sink, and counts it as a change since the latest saving
+func (mdb *MultiDB) addAof(dbIndex int, cmdLine CmdLine) {
+	atomic.AddInt64(&mdb.dirty, 1)
+	if mdb.aofHandler != nil {
+		mdb.aofHandler.AddAof(dbIndex, cmdLine)
+	}
+	if mdb.sink != nil {
+		mdb.sink.Send(dbIndex, cmdLine)
+	}
+	// slave forwards stream from its master instead, writes of a writable slave are not propagated
+	if mdb.master != nil && atomic.LoadInt32(&mdb.role) == masterRole {
+		mdb.master.propagate(dbIndex, cmdLine)
+	}
 }
 
 func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
@@ -207,12 +504,19 @@ func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
 	return protocol.MakeOkReply()
 }
 
-func (mdb *MultiDB) flushDB(dbIndex int) redis.Reply {
+// flushDB replaces the database with an empty one, data of the old one is released in background if async
+func (mdb *MultiDB) flushDB(dbIndex int, async bool) redis.Reply {
 	if dbIndex >= len(mdb.dbSet) || dbIndex < 0 {
 		return protocol.MakeErrReply("ERR DB index is out of range")
 	}
+	mdb.snapshotGate.RLock()
+	defer mdb.snapshotGate.RUnlock()
+	oldDB := mdb.mustSelectDB(dbIndex)
 	newDB := makeDB()
 	mdb.loadDB(dbIndex, newDB)
+	freeDB(oldDB, async)
+	mdb.tracking.InvalidateAll()
+	mdb.addAof(dbIndex, utils.ToCmdLine("FlushDB"))
 	return &protocol.OkReply{}
 }
 
@@ -223,17 +527,27 @@ func (mdb *MultiDB) loadDB(dbIndex int, newDB *DB) redis.Reply {
 	oldDB := mdb.mustSelectDB(dbIndex)
 	newDB.index = dbIndex
 	newDB.addAof = oldDB.addAof // inherit oldDB
+	newDB.isReplica = oldDB.isReplica
+	newDB.tracking = oldDB.tracking
+	newDB.scripts = oldDB.scripts
+	newDB.scriptMonitor = oldDB.scriptMonitor
+	newDB.functions = oldDB.functions
+	newDB.snapshotGate = oldDB.snapshotGate
 	mdb.dbSet[dbIndex].Store(newDB)
 	return &protocol.OkReply{}
 }
 
-func (mdb *MultiDB) flushAll() redis.Reply {
+// flushAll replaces all databases with empty ones, data of the old ones is released in background if async
+func (mdb *MultiDB) flushAll(async bool) redis.Reply {
+	mdb.snapshotGate.RLock()
+	defer mdb.snapshotGate.RUnlock()
 	for i := range mdb.dbSet {
-		mdb.flushDB(i)
-	}
-	if mdb.aofHandler != nil {
-		mdb.aofHandler.AddAof(0, utils.ToCmdLine("FlushAll"))
+		oldDB := mdb.mustSelectDB(i)
+		mdb.loadDB(i, makeDB())
+		freeDB(oldDB, async)
 	}
+	mdb.tracking.InvalidateAll()
+	mdb.addAof(0, utils.ToCmdLine("FlushAll"))
 	return &protocol.OkReply{}
 }
 
@@ -281,61 +595,54 @@ func (mdb *MultiDB) GetUndoLogs(dbIndex int, cmdLine [][]byte) []CmdLine {
 	return mdb.mustSelectDB(dbIndex).GetUndoLogs(cmdLine)
 }
 
+// GetRelatedKeys returns keys written and read by cmdLine, both are empty if it is not a normal command
+func (mdb *MultiDB) GetRelatedKeys(cmdLine [][]byte) ([]string, []string) {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok || cmd.prepare == nil || !validateArity(cmd.arity, cmdLine) {
+		return nil, nil
+	}
+	return cmd.prepare(cmdLine[1:])
+}
+
 // ExecWithLock executes normal commands, invoker should provide locks
 func (mdb *MultiDB) ExecWithLock(conn redis.Connection, cmdLine [][]byte) redis.Reply {
 	db, errReply := mdb.selectDB(conn.GetDBIndex())
 	if errReply != nil {
 		return errReply
 	}
+	// cluster transactions write keys through here, so versions must be updated for WATCH
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if ok && cmd.flags&flagWrite > 0 {
+		write, _ := cmd.prepare(cmdLine[1:])
+		db.addVersion(write...)
+	}
 	return db.execWithLock(cmdLine)
 }
 
-// BGRewriteAOF asynchronously rewrites Append-Only-File
+// BGRewriteAOF asynchronously rewrites Append-Only-File, its status is reported by INFO persistence
 func BGRewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
-	go db.aofHandler.Rewrite()
-	return protocol.MakeStatusReply("Background append only file rewriting started")
-}
-
-// RewriteAOF start Append-Only-File rewriting and blocked until it finished
-func RewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
-	err := db.aofHandler.Rewrite()
+	if db.aofHandler == nil {
+		return protocol.MakeErrReply("ERR please enable aof before using bgrewriteaof")
+	}
+	err := db.aofHandler.BGRewrite()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	return protocol.MakeOkReply()
+	return protocol.MakeStatusReply("Background append only file rewriting started")
 }
 
-// SaveRDB start RDB writing and blocked until it finished
-func SaveRDB(db *MultiDB, args [][]byte) redis.Reply {
+// RewriteAOF start Append-Only-File rewriting and blocked until it finished
+func RewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
 	if db.aofHandler == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
+		return protocol.MakeErrReply("ERR please enable aof before using rewriteaof")
 	}
-	err := db.aofHandler.Rewrite2RDB()
+	err := db.aofHandler.Rewrite()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
 	return protocol.MakeOkReply()
 }
 
-// BGSaveRDB asynchronously save RDB
-func BGSaveRDB(db *MultiDB, args [][]byte) redis.Reply {
-	if db.aofHandler == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
-	}
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Error(err)
-			}
-		}()
-		err := db.aofHandler.Rewrite2RDB()
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
-	return protocol.MakeStatusReply("Background saving started")
-}
-
 // GetDBSize returns keys count and ttl key count
 func (mdb *MultiDB) GetDBSize(dbIndex int) (int, int) {
 	db := mdb.mustSelectDB(dbIndex)
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/utils"
+	"time"
+)
+
+const (
+	// activeExpireCycleInterval is the period of active expire cycle, the same as default hz of redis
+	activeExpireCycleInterval = 100 * time.Millisecond
+	// activeExpireCycleTimeLimit is the max duration of a cycle, so commands are not delayed too much
+	activeExpireCycleTimeLimit = activeExpireCycleInterval / 4
+	// activeExpireCycleKeys is the number of keys with ttl sampled at a time
+	activeExpireCycleKeys = 20
+	// activeExpireCycleAcceptable is the percentage of expired keys in samples,
+	// cycle keeps sampling a database until expired keys are no more than it
+	activeExpireCycleAcceptable = 10
+)
+
+// expireCron holds state of active expire cycle
+type expireCron struct {
+	// nextDB is the database which next cycle starts from, in case of databases at the end never being sampled
+	nextDB int
+	// closed is closed when database is closing, it stops cron
+	closed chan struct{}
+}
+
+func (mdb *MultiDB) startExpireCron() {
+	mdb.expire = &expireCron{
+		closed: make(chan struct{}),
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("panic", err)
+			}
+		}()
+		ticker := time.NewTicker(activeExpireCycleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mdb.activeExpireCycle()
+			case <-mdb.expire.closed:
+				return
+			}
+		}
+	}()
+}
+
+func (cron *expireCron) close() {
+	select {
+	case <-cron.closed:
+	default:
+		close(cron.closed)
+	}
+}
+
+// activeExpireCycle removes expired keys which are never accessed, like active expire cycle of redis.
+// Keys with ttl are sampled randomly, and a database is sampled again while many of its samples have expired.
+func (mdb *MultiDB) activeExpireCycle() {
+	if mdb.isReplica() {
+		// keys of slave are removed by DEL from master, so that slave is consistent with master
+		return
+	}
+	deadline := time.Now().Add(activeExpireCycleTimeLimit)
+	for i := 0; i < len(mdb.dbSet) && time.Now().Before(deadline); i++ {
+		dbIndex := mdb.expire.nextDB
+		mdb.expire.nextDB = (dbIndex + 1) % len(mdb.dbSet)
+		db := mdb.mustSelectDB(dbIndex)
+		for time.Now().Before(deadline) {
+			sampled, expired := db.sampleExpired(activeExpireCycleKeys)
+			if expired*100 <= sampled*activeExpireCycleAcceptable {
+				break
+			}
+		}
+	}
+}
+
+// sampleExpired removes expired keys among random keys with ttl, it returns the number of sampled and expired keys
+func (db *DB) sampleExpired(count int) (int, int) {
+	keys := db.ttlMap.RandomDistinctKeys(count)
+	expired := 0
+	for _, key := range keys {
+		if db.activeExpire(key) {
+			expired++
+		}
+	}
+	return len(keys), expired
+}
+
+// activeExpire removes key if it has expired, and writes DEL into aof so that slaves remove it too
+func (db *DB) activeExpire(key string) bool {
+	keys := []string{key}
+	db.RWLocks(keys, nil)
+	defer db.RWUnLocks(keys, nil)
+	// check-lock-check, ttl may be updated during waiting lock
+	rawExpireTime, ok := db.ttlMap.Get(key)
+	if !ok {
+		return false
+	}
+	expireTime, _ := rawExpireTime.(time.Time)
+	if !time.Now().After(expireTime) {
+		return false
+	}
+	db.Remove(key)
+	db.tracking.Invalidate(nil, keys)
+	db.addAof(utils.ToCmdLine("DEL", key))
+	return true
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActiveExpire(t *testing.T) {
+	properties := config.Properties()
+	config.SetProperties(&config.ServerProperties{
+		CDCAddress: "127.0.0.1:4222", // connects on first publishing
+	})
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	server := NewStandaloneServer()
+	server.sink.Close()
+	sink := &mockSink{}
+	server.sink = sink
+	defer server.Close()
+
+	conn := new(connection.FakeConn)
+	conn.SelectDB(3)
+	keyNum := 100
+	for i := 0; i < keyNum; i++ {
+		server.Exec(conn, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), "v", "PX", "10"))
+	}
+	server.Exec(conn, utils.ToCmdLine("SET", "persistent", "v"))
+	server.Exec(conn, utils.ToCmdLine("SET", "living", "v", "EX", "1000"))
+
+	// expired keys are removed without being accessed
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if size, _ := server.GetDBSize(3); size == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size, ttlSize := server.GetDBSize(3); size != 2 || ttlSize != 1 {
+		t.Errorf("expected 2 keys and 1 ttl key, actually %d keys and %d ttl keys", size, ttlSize)
+	}
+	// removing is written into aof and sent to slaves
+	sink.mu.Lock()
+	deleted := 0
+	for _, event := range sink.events {
+		if event == "3 DEL" {
+			deleted++
+		}
+	}
+	sink.mu.Unlock()
+	if deleted != keyNum {
+		t.Errorf("expected %d DEL, actually %d", keyNum, deleted)
+	}
+}
+
+func TestReplicaExpire(t *testing.T) {
+	properties := config.Properties()
+	config.SetProperties(&config.ServerProperties{
+		CDCAddress: "127.0.0.1:4222", // connects on first publishing
+	})
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	server := NewStandaloneServer()
+	server.sink.Close()
+	sink := &mockSink{}
+	server.sink = sink
+	defer server.Close()
+
+	// master removes expired key on access and sends DEL to slaves
+	conn := new(connection.FakeConn)
+	server.Exec(conn, utils.ToCmdLine("SET", "k", "v", "PX", "10"))
+	time.Sleep(20 * time.Millisecond)
+	asserts.AssertNullBulk(t, server.Exec(conn, utils.ToCmdLine("GET", "k")))
+	sink.mu.Lock()
+	deleted := 0
+	for _, event := range sink.events {
+		if event == "0 DEL" {
+			deleted++
+		}
+	}
+	sink.mu.Unlock()
+	if deleted != 1 {
+		t.Errorf("expected 1 DEL, actually %d", deleted)
+	}
+
+	atomic.StoreInt32(&server.role, slaveRole)
+	masterConn := new(connection.FakeConn)
+	masterConn.SetRole(connection.ReplicationRecvCli)
+	server.Exec(masterConn, utils.ToCmdLine("SET", "k", "v", "PX", "10"))
+	time.Sleep(20 * time.Millisecond)
+	// expired key is invisible to clients, but kept until DEL from master
+	asserts.AssertNullBulk(t, server.Exec(conn, utils.ToCmdLine("GET", "k")))
+	asserts.AssertIntReply(t, server.Exec(conn, utils.ToCmdLine("EXISTS", "k")), 0)
+	asserts.AssertIntReply(t, server.Exec(conn, utils.ToCmdLine("TTL", "k")), -2)
+	if size, _ := server.GetDBSize(0); size != 1 {
+		t.Errorf("expired key should be kept by replica, actually %d keys", size)
+	}
+	// commands from master see the expired key, so replica won't diverge from master
+	server.Exec(masterConn, utils.ToCmdLine("APPEND", "k", "x"))
+	if size, _ := server.GetDBSize(0); size != 1 {
+		t.Errorf("expired key should be kept by replica, actually %d keys", size)
+	}
+	asserts.AssertBulkReply(t, server.Exec(masterConn, utils.ToCmdLine("GET", "k")), "vx")
+	server.Exec(masterConn, utils.ToCmdLine("MULTI"))
+	server.Exec(masterConn, utils.ToCmdLine("APPEND", "k", "y"))
+	server.Exec(masterConn, utils.ToCmdLine("EXEC"))
+	asserts.AssertBulkReply(t, server.Exec(masterConn, utils.ToCmdLine("GET", "k")), "vxy")
+	asserts.AssertNullBulk(t, server.Exec(conn, utils.ToCmdLine("GET", "k")))
+	server.Exec(masterConn, utils.ToCmdLine("DEL", "k"))
+	if size, _ := server.GetDBSize(0); size != 0 {
+		t.Errorf("expected key removed by DEL from master, actually %d keys", size)
+	}
+
+	// blocking pops from master see the expired key and never block
+	server.Exec(masterConn, utils.ToCmdLine("RPUSH", "l", "a"))
+	server.Exec(masterConn, utils.ToCmdLine("PEXPIRE", "l", "10"))
+	time.Sleep(20 * time.Millisecond)
+	asserts.AssertMultiBulkReply(t, server.Exec(masterConn, utils.ToCmdLine("BLPOP", "l", "0")), []string{"l", "a"})
+	asserts.AssertNullMultiBulk(t, server.Exec(masterConn, utils.ToCmdLine("BLPOP", "l", "0")))
+}
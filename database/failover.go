@@ -0,0 +1,260 @@
+package database
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// states of failover
+const (
+	failoverNone = iota
+	// failoverWaitForSync means writes are paused until the target slave has acknowledged the whole stream
+	failoverWaitForSync
+	// failoverInProgress means master has been demoted and is asking the target to be promoted by PSYNC FAILOVER
+	failoverInProgress
+)
+
+var failoverStateNames = []string{"no-failover", "waiting-for-sync", "failover-in-progress"}
+
+var failoverAbortedErr = errors.New("failover aborted")
+
+// failoverStatus holds the coordinated failover started by FAILOVER, a nil *failoverStatus means no failover
+type failoverStatus struct {
+	mu    sync.Mutex
+	state int32
+	// targetHost and targetPort are the slave to be promoted, targetPort is 0 if any slave could be the target
+	targetHost string
+	targetPort int
+	// resumed is closed when paused writes are resumed, it is nil if writes are not paused
+	resumed chan struct{}
+	// aborted is closed by FAILOVER ABORT
+	aborted chan struct{}
+	// result receives error of PSYNC FAILOVER, or nil if the target has accepted it
+	result chan error
+}
+
+func (fs *failoverStatus) getState() int32 {
+	if fs == nil {
+		return failoverNone
+	}
+	return atomic.LoadInt32(&fs.state)
+}
+
+// waitWrites blocks write commands while writes are paused by failover
+func (fs *failoverStatus) waitWrites() {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	resumed := fs.resumed
+	fs.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// finish reports result of PSYNC FAILOVER sent to the target
+func (fs *failoverStatus) finish(err error) {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.getState() != failoverInProgress {
+		return
+	}
+	select {
+	case fs.result <- err:
+	default:
+	}
+}
+
+// abort stops the failover in progress, it returns false if there is none
+func (fs *failoverStatus) abort() bool {
+	if fs == nil {
+		return false
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.getState() == failoverNone {
+		return false
+	}
+	select {
+	case <-fs.aborted:
+	default:
+		close(fs.aborted)
+	}
+	return true
+}
+
+// end resumes paused writes, paused clients execute their writes with the new role of this node
+func (fs *failoverStatus) end() {
+	if fs == nil {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	atomic.StoreInt32(&fs.state, failoverNone)
+	fs.targetHost = ""
+	fs.targetPort = 0
+	if fs.resumed != nil {
+		close(fs.resumed)
+		fs.resumed = nil
+	}
+}
+
+// execFailover pauses writes until a slave catches up with this master, then demotes this master to be a slave of it
+// and promotes it. The slave is chosen from online slaves if TO is not given. Failover is aborted if the slave doesn't
+// catch up within timeout in milliseconds, unless FORCE is given. It replies OK once failover started.
+// usage: FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]
+func (mdb *MultiDB) execFailover(args [][]byte) redis.Reply {
+	var host string
+	var port int
+	var timeout int64
+	force := false
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "to":
+			if i+2 >= len(args) || port != 0 {
+				return protocol.MakeSyntaxErrReply()
+			}
+			host = string(args[i+1])
+			p, err := strconv.Atoi(string(args[i+2]))
+			if err != nil || p <= 0 {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			port = p
+			i += 2
+			if i+1 < len(args) && strings.ToLower(string(args[i+1])) == "force" {
+				force = true
+				i++
+			}
+		case "abort":
+			abort = true
+		case "timeout":
+			if i+1 >= len(args) || timeout != 0 {
+				return protocol.MakeSyntaxErrReply()
+			}
+			t, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || t <= 0 {
+				return protocol.MakeErrReply("ERR FAILOVER timeout must be greater than 0")
+			}
+			timeout = t
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if abort {
+		if port != 0 || timeout != 0 {
+			return protocol.MakeErrReply("ERR FAILOVER ABORT can't be used with other options")
+		}
+		if !mdb.failover.abort() {
+			return protocol.MakeErrReply("ERR No failover in progress.")
+		}
+		return protocol.MakeOkReply()
+	}
+	if force && timeout == 0 {
+		return protocol.MakeErrReply("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if atomic.LoadInt32(&mdb.role) == slaveRole {
+		return protocol.MakeErrReply("ERR FAILOVER is not valid when server is a replica.")
+	}
+	if !mdb.master.hasReplica("", 0) {
+		return protocol.MakeErrReply("ERR FAILOVER requires connected replicas.")
+	}
+	if port != 0 && !mdb.master.hasReplica(host, port) {
+		return protocol.MakeErrReply("ERR FAILOVER target HOST and PORT is not a replica.")
+	}
+
+	fs := mdb.failover
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.getState() != failoverNone {
+		return protocol.MakeErrReply("ERR FAILOVER already in progress.")
+	}
+	atomic.StoreInt32(&fs.state, failoverWaitForSync)
+	fs.targetHost = host
+	fs.targetPort = port
+	fs.resumed = make(chan struct{})
+	fs.aborted = make(chan struct{})
+	fs.result = make(chan error, 1)
+	go mdb.doFailover(time.Duration(timeout)*time.Millisecond, force)
+	return protocol.MakeOkReply()
+}
+
+func (mdb *MultiDB) doFailover(timeout time.Duration, force bool) {
+	fs := mdb.failover
+	defer fs.end()
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	host, port, err := mdb.waitFailoverTarget(timeoutCh, force)
+	if err != nil {
+		logger.Warn("failover aborted: " + err.Error())
+		return
+	}
+
+	logger.Info("failover to " + net.JoinHostPort(host, strconv.Itoa(port)))
+	atomic.StoreInt32(&fs.state, failoverInProgress)
+	mdb.replicaOf(host, port, true)
+	select {
+	case err = <-fs.result:
+	case <-fs.aborted:
+		err = failoverAbortedErr
+	case <-timeoutCh:
+		err = errors.New("timeout")
+	case <-mdb.replication.closed:
+		return
+	}
+	if err != nil {
+		// target hasn't been promoted, so this node continues to be master with the same stream
+		logger.Warn("failover failed: " + err.Error())
+		mdb.slaveOfNone()
+		atomic.CompareAndSwapInt32(&mdb.role, slaveRole, masterRole)
+		return
+	}
+	logger.Info("failover finished")
+}
+
+// waitFailoverTarget waits until target has acknowledged the whole stream, it returns the target even if it hasn't
+// caught up when timeout if force is true
+func (mdb *MultiDB) waitFailoverTarget(timeoutCh <-chan time.Time, force bool) (string, int, error) {
+	fs := mdb.failover
+	master := mdb.master
+	// acks wake up failover like WAIT
+	w := makeWaiter()
+	master.addWaiter(w)
+	defer master.removeWaiter(w)
+	// ask slaves to ack immediately instead of waiting for their cron
+	master.getAck()
+	for {
+		if host, port, ok := master.caughtUpReplica(fs.targetHost, fs.targetPort); ok {
+			return host, port, nil
+		}
+		select {
+		case <-w.wake:
+		case <-fs.aborted:
+			return "", 0, failoverAbortedErr
+		case <-mdb.replication.closed:
+			return "", 0, failoverAbortedErr
+		case <-timeoutCh:
+			if force {
+				return fs.targetHost, fs.targetPort, nil
+			}
+			return "", 0, errors.New("target didn't catch up before timeout")
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/lib/wildcard"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/script"
+	"strings"
+)
+
+// execFunction manages function libraries, modifications are persisted by aof
+// usage: FUNCTION LOAD [REPLACE] code | FUNCTION DELETE library | FUNCTION FLUSH [ASYNC|SYNC] |
+// FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE] | FUNCTION KILL
+func execFunction(mdb *MultiDB, c redis.Connection, cmdLine [][]byte) redis.Reply {
+	args := cmdLine[1:]
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		if len(args) != 2 && len(args) != 3 {
+			return protocol.MakeArgNumErrReply("function|load")
+		}
+		replace := false
+		if len(args) == 3 {
+			if strings.ToUpper(string(args[1])) != "REPLACE" {
+				return protocol.MakeErrReply("ERR Unknown option given: " + string(args[1]))
+			}
+			replace = true
+		}
+		mdb.snapshotGate.RLock()
+		defer mdb.snapshotGate.RUnlock()
+		name, err := mdb.functions.Load(string(args[len(args)-1]), replace)
+		if err != nil {
+			return protocol.MakeErrReply(err.Error())
+		}
+		mdb.addAof(0, cmdLine)
+		return protocol.MakeBulkReply([]byte(name))
+	case "delete":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("function|delete")
+		}
+		mdb.snapshotGate.RLock()
+		defer mdb.snapshotGate.RUnlock()
+		if !mdb.functions.Delete(string(args[1])) {
+			return protocol.MakeErrReply("ERR Library not found")
+		}
+		mdb.addAof(0, cmdLine)
+		return protocol.MakeOkReply()
+	case "flush":
+		if len(args) > 2 {
+			return protocol.MakeArgNumErrReply("function|flush")
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(string(args[1]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				return protocol.MakeSyntaxErrReply()
+			}
+		}
+		mdb.snapshotGate.RLock()
+		defer mdb.snapshotGate.RUnlock()
+		mdb.functions.Flush()
+		mdb.addAof(0, utils.ToCmdLine("FUNCTION", "FLUSH"))
+		return protocol.MakeOkReply()
+	case "list":
+		return execFunctionList(mdb, c, args[1:])
+	case "kill":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("function|kill")
+		}
+		return mdb.scriptMonitor.Kill(luaTimeLimit())
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try FUNCTION HELP.")
+}
+
+// execFunctionList returns libraries and their functions
+// usage: FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func execFunctionList(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	var pattern *wildcard.Pattern
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "LIBRARYNAME":
+			if i+1 >= len(args) || pattern != nil {
+				return protocol.MakeSyntaxErrReply()
+			}
+			var err error
+			pattern, err = wildcard.CompilePattern(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR illegal wildcard")
+			}
+			i++
+		case "WITHCODE":
+			withCode = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	resp3 := c.GetProtocol() == 3
+	var result []redis.Reply
+	for _, lib := range mdb.functions.Libraries() {
+		if pattern != nil && !pattern.IsMatch(lib.Name) {
+			continue
+		}
+		functions := make([]redis.Reply, len(lib.Functions))
+		for i, fn := range lib.Functions {
+			functions[i] = protocol.MakeMapReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("name")), protocol.MakeBulkReply([]byte(fn.Name)),
+				protocol.MakeBulkReply([]byte("description")), protocol.MakeNullBulkReply(),
+				protocol.MakeBulkReply([]byte("flags")), protocol.MakeMultiBulkReply(utils.ToCmdLine(fn.Flags...)),
+			}, resp3)
+		}
+		pairs := []redis.Reply{
+			protocol.MakeBulkReply([]byte("library_name")), protocol.MakeBulkReply([]byte(lib.Name)),
+			protocol.MakeBulkReply([]byte("engine")), protocol.MakeBulkReply([]byte("LUA")),
+			protocol.MakeBulkReply([]byte("functions")), protocol.MakeMultiRawReply(functions),
+		}
+		if withCode {
+			pairs = append(pairs, protocol.MakeBulkReply([]byte("library_code")), protocol.MakeBulkReply([]byte(lib.Code)))
+		}
+		result = append(result, protocol.MakeMapReply(pairs, resp3))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// GetFunctionLibraries returns code of all function libraries, it is used to rewrite aof
+func (mdb *MultiDB) GetFunctionLibraries() []string {
+	libraries := mdb.functions.Libraries()
+	result := make([]string, len(libraries))
+	for i, lib := range libraries {
+		result[i] = lib.Code
+	}
+	return result
+}
+
+func (db *DB) callFunction(args [][]byte, readOnly bool) redis.Reply {
+	fn, ok := db.functions.Get(string(args[0]))
+	if !ok {
+		return protocol.MakeErrReply("ERR Function not found")
+	}
+	if readOnly && !fn.NoWrites() {
+		return protocol.MakeErrReply("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	keys, argv, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	execution := db.scriptMonitor.Start()
+	defer db.scriptMonitor.Finish(execution)
+	caller := db.scriptCaller(execution, keys, readOnly || fn.NoWrites())
+	return script.RunFunction(execution, fn, keys, argv, caller)
+}
+
+// execFCall calls function registered by FUNCTION LOAD
+// usage: FCALL function numkeys key [key ...] arg [arg ...]
+func execFCall(db *DB, args [][]byte) redis.Reply {
+	return db.callFunction(args, false)
+}
+
+// execFCallRO calls function with no-writes flag
+// usage: FCALL_RO function numkeys key [key ...] arg [arg ...]
+func execFCallRO(db *DB, args [][]byte) redis.Reply {
+	return db.callFunction(args, true)
+}
+
+func init() {
+	RegisterCommand("FCall", execFCall, prepareScript, undoScript, -3, flagWrite|flagNoScript)
+	RegisterCommand("FCall_RO", execFCallRO, prepareReadOnlyScript, nil, -3, flagReadOnly|flagNoScript)
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+const testLibrary = `#!lua name=testlib
+local function incr_by(keys, args)
+	return redis.call('incrby', keys[1], args[1])
+end
+local function get(keys, args)
+	return redis.call('get', keys[1])
+end
+local function set_anyway(keys, args)
+	return redis.call('set', keys[1], args[1])
+end
+redis.register_function('test_incrby', incr_by)
+redis.register_function{function_name='test_get', callback=get, flags={'no-writes'}}
+redis.register_function{function_name='test_set', callback=set_anyway, flags={'no-writes'}}
+`
+
+func TestFunctionCall(t *testing.T) {
+	c := new(connection.FakeConn)
+	testServer.Exec(c, utils.ToCmdLine("function", "flush"))
+	result := testServer.Exec(c, utils.ToCmdLine("function", "load", testLibrary))
+	asserts.AssertBulkReply(t, result, "testlib")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", testLibrary))
+	asserts.AssertErrReply(t, result, "ERR Library 'testlib' already exists")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", "REPLACE", testLibrary))
+	asserts.AssertBulkReply(t, result, "testlib")
+
+	key := utils.RandString(10)
+	result = testServer.Exec(c, utils.ToCmdLine("fcall", "test_incrby", "1", key, "3"))
+	asserts.AssertIntReply(t, result, 3)
+	result = testServer.Exec(c, utils.ToCmdLine("fcall_ro", "test_get", "1", key))
+	asserts.AssertBulkReply(t, result, "3")
+	result = testServer.Exec(c, utils.ToCmdLine("fcall_ro", "test_incrby", "1", key, "3"))
+	asserts.AssertErrReply(t, result, "ERR Can not execute a script with write flag using *_ro command.")
+	// function declared with no-writes cannot write even if called by FCALL
+	result = testServer.Exec(c, utils.ToCmdLine("fcall", "test_set", "1", key, "a"))
+	asserts.AssertErrReply(t, result, "ERR Write commands are not allowed from read-only scripts.")
+	result = testServer.Exec(c, utils.ToCmdLine("fcall", "nofunc", "0"))
+	asserts.AssertErrReply(t, result, "ERR Function not found")
+
+	result = testServer.Exec(c, utils.ToCmdLine("function", "delete", "testlib"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "delete", "testlib"))
+	asserts.AssertErrReply(t, result, "ERR Library not found")
+	result = testServer.Exec(c, utils.ToCmdLine("fcall", "test_incrby", "1", key, "3"))
+	asserts.AssertErrReply(t, result, "ERR Function not found")
+}
+
+func TestFunctionLoadError(t *testing.T) {
+	c := new(connection.FakeConn)
+	testServer.Exec(c, utils.ToCmdLine("function", "flush"))
+	result := testServer.Exec(c, utils.ToCmdLine("function", "load", "return 1"))
+	asserts.AssertErrReply(t, result, "ERR Missing library metadata")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", "#!js name=lib\nreturn 1"))
+	asserts.AssertErrReply(t, result, "ERR Engine not found")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", "#!lua name=lib\nreturn 1"))
+	asserts.AssertErrReply(t, result, "ERR No functions registered")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", "#!lua name=lib\nredis.call('ping')"))
+	assertErrReplyPrefix(t, result, "ERR Error registering functions")
+	src := "#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'foo'}}"
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", src))
+	assertErrReplyPrefix(t, result, "ERR Error registering functions")
+
+	testServer.Exec(c, utils.ToCmdLine("function", "load", testLibrary))
+	src = "#!lua name=lib2\nredis.register_function('test_get', function() end)"
+	result = testServer.Exec(c, utils.ToCmdLine("function", "load", src))
+	asserts.AssertErrReply(t, result, "ERR Function test_get already exists")
+	result = testServer.Exec(c, utils.ToCmdLine("function", "foo"))
+	asserts.AssertErrReply(t, result, "ERR unknown subcommand 'foo'. Try FUNCTION HELP.")
+}
+
+func TestFunctionList(t *testing.T) {
+	c := new(connection.FakeConn)
+	testServer.Exec(c, utils.ToCmdLine("function", "flush"))
+	src := "#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'no-writes'}}"
+	testServer.Exec(c, utils.ToCmdLine("function", "load", src))
+	result := testServer.Exec(c, utils.ToCmdLine("function", "list", "withcode"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeMapReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("library_name")), protocol.MakeBulkReply([]byte("lib")),
+			protocol.MakeBulkReply([]byte("engine")), protocol.MakeBulkReply([]byte("LUA")),
+			protocol.MakeBulkReply([]byte("functions")), protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeMapReply([]redis.Reply{
+					protocol.MakeBulkReply([]byte("name")), protocol.MakeBulkReply([]byte("f")),
+					protocol.MakeBulkReply([]byte("description")), protocol.MakeNullBulkReply(),
+					protocol.MakeBulkReply([]byte("flags")), protocol.MakeMultiBulkReply(utils.ToCmdLine("no-writes")),
+				}, false),
+			}),
+			protocol.MakeBulkReply([]byte("library_code")), protocol.MakeBulkReply([]byte(src)),
+		}, false),
+	})
+	if string(result.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expected %q, actually %q", expected.ToBytes(), result.ToBytes())
+	}
+	result = testServer.Exec(c, utils.ToCmdLine("function", "list", "libraryname", "foo*"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+}
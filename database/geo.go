@@ -3,10 +3,13 @@ package database
 import (
 	"fmt"
 	"github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/geohash"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -253,7 +256,7 @@ func geoRadius0(sortedSet *sortedset.SortedSet, lat float64, lng float64, radius
 	for _, area := range areas {
 		lower := &sortedset.ScoreBorder{Value: float64(area[0])}
 		upper := &sortedset.ScoreBorder{Value: float64(area[1])}
-		elements := sortedSet.RangeByScore(lower, upper, 0, -1, true)
+		elements := sortedSet.RangeByBorder(lower, upper, 0, -1, true)
 		for _, elem := range elements {
 			members = append(members, []byte(elem.Member))
 		}
@@ -261,6 +264,354 @@ func geoRadius0(sortedSet *sortedset.SortedSet, lat float64, lng float64, radius
 	return protocol.MakeMultiBulkReply(members)
 }
 
+// geoUnitFactor returns meters of given unit
+func geoUnitFactor(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// geoSearchOption is parsed from arguments of GEOSEARCH and GEOSEARCHSTORE
+type geoSearchOption struct {
+	fromMember string
+	lng, lat   float64
+	hasCenter  bool
+	// radius, width and height are in meters
+	radius    float64
+	width     float64
+	height    float64
+	byBox     bool
+	hasShape  bool
+	unit      float64
+	desc      bool
+	sorted    bool
+	count     int
+	any       bool
+	withCoord bool
+	withDist  bool
+	withHash  bool
+	storeDist bool
+}
+
+type geoSearchResult struct {
+	member string
+	score  float64
+	dist   float64 // in meters
+	lat    float64
+	lng    float64
+}
+
+func parseFloatArg(arg []byte) (float64, protocol.ErrorReply) {
+	v, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR value is not a valid float")
+	}
+	return v, nil
+}
+
+// parseGeoSearchOption parses FROMMEMBER|FROMLONLAT BYRADIUS|BYBOX [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func parseGeoSearchOption(args [][]byte, isStore bool) (*geoSearchOption, protocol.ErrorReply) {
+	opt := &geoSearchOption{}
+	var errReply protocol.ErrorReply
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "FROMMEMBER":
+			if opt.hasCenter || i+1 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opt.fromMember = string(args[i+1])
+			opt.hasCenter = true
+			i++
+		case "FROMLONLAT":
+			if opt.hasCenter || i+2 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			if opt.lng, errReply = parseFloatArg(args[i+1]); errReply != nil {
+				return nil, errReply
+			}
+			if opt.lat, errReply = parseFloatArg(args[i+2]); errReply != nil {
+				return nil, errReply
+			}
+			if opt.lat < -90 || opt.lat > 90 || opt.lng < -180 || opt.lng > 180 {
+				return nil, protocol.MakeErrReply(fmt.Sprintf("ERR invalid longitude,latitude pair %s,%s", args[i+1], args[i+2]))
+			}
+			opt.hasCenter = true
+			i += 2
+		case "BYRADIUS":
+			if opt.hasShape || i+2 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			if opt.radius, errReply = parseFloatArg(args[i+1]); errReply != nil {
+				return nil, errReply
+			}
+			unit, ok := geoUnitFactor(string(args[i+2]))
+			if !ok {
+				return nil, protocol.MakeErrReply("ERR unsupported unit provided. please use M, KM, FT, MI")
+			}
+			if opt.radius < 0 {
+				return nil, protocol.MakeErrReply("ERR radius cannot be negative")
+			}
+			opt.radius *= unit
+			opt.unit = unit
+			opt.hasShape = true
+			i += 2
+		case "BYBOX":
+			if opt.hasShape || i+3 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			if opt.width, errReply = parseFloatArg(args[i+1]); errReply != nil {
+				return nil, errReply
+			}
+			if opt.height, errReply = parseFloatArg(args[i+2]); errReply != nil {
+				return nil, errReply
+			}
+			unit, ok := geoUnitFactor(string(args[i+3]))
+			if !ok {
+				return nil, protocol.MakeErrReply("ERR unsupported unit provided. please use M, KM, FT, MI")
+			}
+			if opt.width < 0 || opt.height < 0 {
+				return nil, protocol.MakeErrReply("ERR height or width cannot be negative")
+			}
+			opt.width *= unit
+			opt.height *= unit
+			opt.unit = unit
+			opt.byBox = true
+			opt.hasShape = true
+			i += 3
+		case "ASC", "DESC":
+			opt.sorted = true
+			opt.desc = arg == "DESC"
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			count, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				return nil, protocol.MakeErrReply("ERR COUNT must be > 0")
+			}
+			opt.count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(string(args[i+1])) == "ANY" {
+				opt.any = true
+				i++
+			}
+		case "WITHCOORD", "WITHDIST", "WITHHASH":
+			if isStore {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opt.withCoord = opt.withCoord || arg == "WITHCOORD"
+			opt.withDist = opt.withDist || arg == "WITHDIST"
+			opt.withHash = opt.withHash || arg == "WITHHASH"
+		case "STOREDIST":
+			if !isStore {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opt.storeDist = true
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	if !opt.hasCenter {
+		return nil, protocol.MakeErrReply("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	}
+	if !opt.hasShape {
+		return nil, protocol.MakeErrReply("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	}
+	if opt.any && opt.count == 0 {
+		return nil, protocol.MakeErrReply("ERR the ANY argument requires COUNT argument")
+	}
+	// like redis, sort by distance if COUNT is given without ANY
+	if opt.count > 0 && !opt.any && !opt.sorted {
+		opt.sorted = true
+	}
+	return opt, nil
+}
+
+// inShape returns distance to center and whether the point is within search shape
+func (opt *geoSearchOption) inShape(lat float64, lng float64) (float64, bool) {
+	if opt.byBox {
+		// distance along latitude and longitude direction respectively
+		latDist := geohash.Distance(lat, lng, opt.lat, lng)
+		if latDist > opt.height/2 {
+			return 0, false
+		}
+		lngDist := geohash.Distance(lat, lng, lat, opt.lng)
+		if lngDist > opt.width/2 {
+			return 0, false
+		}
+		return geohash.Distance(opt.lat, opt.lng, lat, lng), true
+	}
+	dist := geohash.Distance(opt.lat, opt.lng, lat, lng)
+	return dist, dist <= opt.radius
+}
+
+// geoSearch returns members within the shape described by opt
+func geoSearch(sortedSet *sortedset.SortedSet, opt *geoSearchOption) ([]*geoSearchResult, protocol.ErrorReply) {
+	if opt.fromMember != "" {
+		elem, ok := sortedSet.Get(opt.fromMember)
+		if !ok {
+			return nil, protocol.MakeErrReply("ERR could not decode requested zset member")
+		}
+		opt.lat, opt.lng = geohash.Decode(uint64(elem.Score))
+	}
+	searchRadius := opt.radius
+	if opt.byBox {
+		searchRadius = math.Sqrt(opt.width*opt.width+opt.height*opt.height) / 2
+	}
+	areas := geohash.GetNeighbours(opt.lat, opt.lng, searchRadius)
+	seen := make(map[string]struct{})
+	results := make([]*geoSearchResult, 0)
+	for _, area := range areas {
+		lower := &sortedset.ScoreBorder{Value: float64(area[0])}
+		upper := &sortedset.ScoreBorder{Value: float64(area[1])}
+		elements := sortedSet.RangeByBorder(lower, upper, 0, -1, false)
+		for _, elem := range elements {
+			if _, ok := seen[elem.Member]; ok {
+				continue
+			}
+			seen[elem.Member] = struct{}{}
+			lat, lng := geohash.Decode(uint64(elem.Score))
+			dist, ok := opt.inShape(lat, lng)
+			if !ok {
+				continue
+			}
+			results = append(results, &geoSearchResult{
+				member: elem.Member,
+				score:  elem.Score,
+				dist:   dist,
+				lat:    lat,
+				lng:    lng,
+			})
+			if opt.any && len(results) >= opt.count {
+				break
+			}
+		}
+		if opt.any && len(results) >= opt.count {
+			break
+		}
+	}
+	if opt.sorted {
+		sort.SliceStable(results, func(i, j int) bool {
+			if opt.desc {
+				return results[i].dist > results[j].dist
+			}
+			return results[i].dist < results[j].dist
+		})
+	}
+	if opt.count > 0 && len(results) > opt.count {
+		results = results[:opt.count]
+	}
+	return results, nil
+}
+
+func makeGeoSearchReply(results []*geoSearchResult, opt *geoSearchOption) redis.Reply {
+	if !opt.withCoord && !opt.withDist && !opt.withHash {
+		members := make([][]byte, len(results))
+		for i, result := range results {
+			members[i] = []byte(result.member)
+		}
+		return protocol.MakeMultiBulkReply(members)
+	}
+	replies := make([]redis.Reply, len(results))
+	for i, result := range results {
+		item := []redis.Reply{protocol.MakeBulkReply([]byte(result.member))}
+		if opt.withDist {
+			item = append(item, protocol.MakeBulkReply([]byte(strconv.FormatFloat(result.dist/opt.unit, 'f', 4, 64))))
+		}
+		if opt.withHash {
+			item = append(item, protocol.MakeIntReply(int64(result.score)))
+		}
+		if opt.withCoord {
+			item = append(item, protocol.MakeMultiBulkReply([][]byte{
+				[]byte(strconv.FormatFloat(result.lng, 'f', -1, 64)),
+				[]byte(strconv.FormatFloat(result.lat, 'f', -1, 64)),
+			}))
+		}
+		replies[i] = protocol.MakeMultiRawReply(item)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// execGeoSearch returns members within the given shape
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius unit|BYBOX width height unit
+// [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func execGeoSearch(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	opt, errReply := parseGeoSearchOption(args[1:], false)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	results, errReply := geoSearch(sortedSet, opt)
+	if errReply != nil {
+		return errReply
+	}
+	return makeGeoSearchReply(results, opt)
+}
+
+func prepareGeoSearchStore(args [][]byte) ([]string, []string) {
+	dest := string(args[0])
+	src := string(args[1])
+	return []string{dest}, []string{src}
+}
+
+// execGeoSearchStore stores members within the given shape into dest
+// GEOSEARCHSTORE destination source FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius unit|BYBOX width height unit
+// [ASC|DESC] [COUNT count [ANY]] [STOREDIST]
+func execGeoSearchStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	src := string(args[1])
+	opt, errReply := parseGeoSearchOption(args[2:], true)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	var results []*geoSearchResult
+	if sortedSet != nil {
+		results, errReply = geoSearch(sortedSet, opt)
+		if errReply != nil {
+			return errReply
+		}
+	}
+	if len(results) == 0 {
+		db.Remove(dest)
+		db.addAof(utils.ToCmdLine3("geosearchstore", args...))
+		return protocol.MakeIntReply(0)
+	}
+	destSet := sortedset.Make()
+	for _, result := range results {
+		score := result.score
+		if opt.storeDist {
+			score = result.dist / opt.unit
+		}
+		destSet.Add(result.member, score)
+	}
+	db.Remove(dest)
+	db.PutEntity(dest, &database.DataEntity{
+		Data: destSet,
+	})
+	db.addAof(utils.ToCmdLine3("geosearchstore", args...))
+	return protocol.MakeIntReply(int64(len(results)))
+}
+
 func init() {
 	RegisterCommand("GeoAdd", execGeoAdd, writeFirstKey, undoGeoAdd, -5, flagWrite)
 	RegisterCommand("GeoPos", execGeoPos, readFirstKey, nil, -2, flagReadOnly)
@@ -268,4 +619,6 @@ func init() {
 	RegisterCommand("GeoHash", execGeoHash, readFirstKey, nil, -2, flagReadOnly)
 	RegisterCommand("GeoRadius", execGeoRadius, readFirstKey, nil, -6, flagReadOnly)
 	RegisterCommand("GeoRadiusByMember", execGeoRadiusByMember, readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand("GeoSearch", execGeoSearch, readFirstKey, nil, -7, flagReadOnly)
+	RegisterCommand("GeoSearchStore", execGeoSearchStore, prepareGeoSearchStore, rollbackFirstKey, -8, flagWrite)
 }
@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
@@ -101,3 +102,57 @@ func TestGeoDist(t *testing.T) {
 		t.Errorf("expected 166274, actual: %f", dist)
 	}
 }
+
+func TestGeoSearch(t *testing.T) {
+	execFlushDB(testDB, utils.ToCmdLine())
+	key := utils.RandString(10)
+	execGeoAdd(testDB, utils.ToCmdLine(key,
+		"13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania",
+		"12.758489", "38.788135", "edge1",
+		"17.241510", "38.788135", "edge2",
+	))
+	result := testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"))
+	asserts.AssertMultiBulkReply(t, result, []string{"Catania", "Palermo"})
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "DESC"))
+	asserts.AssertMultiBulkReply(t, result, []string{"edge1", "edge2", "Palermo", "Catania"})
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "FROMMEMBER", "Palermo", "BYRADIUS", "100", "km", "ASC"))
+	asserts.AssertMultiBulkReply(t, result, []string{"Palermo", "edge1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "COUNT", "1", "WITHDIST"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("Catania")),
+			protocol.MakeBulkReply([]byte("56.4412")),
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong geosearch result: %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "FROMMEMBER", "none", "BYRADIUS", "100", "km"))
+	asserts.AssertErrReply(t, result, "ERR could not decode requested zset member")
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearch", key, "BYRADIUS", "100", "km", "ASC", "WITHDIST"))
+	asserts.AssertErrReply(t, result, "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+}
+
+func TestGeoSearchStore(t *testing.T) {
+	execFlushDB(testDB, utils.ToCmdLine())
+	key := utils.RandString(10)
+	dest := utils.RandString(10)
+	execGeoAdd(testDB, utils.ToCmdLine(key,
+		"13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania",
+		"12.758489", "38.788135", "edge1",
+	))
+	result := testDB.Exec(nil, utils.ToCmdLine("GeoSearchStore", dest, key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoPos", dest, "Catania"))
+	asserts.AssertNotError(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearchStore", dest, key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "STOREDIST"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("ZRange", dest, "0", "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{"Catania"})
+	result = testDB.Exec(nil, utils.ToCmdLine("GeoSearchStore", dest, key, "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+}
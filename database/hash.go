@@ -20,6 +20,10 @@ func (db *DB) getAsDict(key string) (Dict.Dict, protocol.ErrorReply) {
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
+	if dict.Len() == 0 {
+		// all fields have expired but not removed yet
+		return nil, nil
+	}
 	return dict, nil
 }
 
@@ -53,6 +57,7 @@ func execHSet(db *DB, args [][]byte) redis.Reply {
 	}
 
 	result := dict.Put(field, value)
+	persistHashField(dict, field)
 	db.addAof(utils.ToCmdLine3("hset", args...))
 	return protocol.MakeIntReply(int64(result))
 }
@@ -234,6 +239,7 @@ func execHMSet(db *DB, args [][]byte) redis.Reply {
 	for i, field := range fields {
 		value := values[i]
 		dict.Put(field, value)
+		persistHashField(dict, field)
 	}
 	db.addAof(utils.ToCmdLine3("hmset", args...))
 	return &protocol.OkReply{}
@@ -422,10 +428,10 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 }
 
 // execHRandField return a random field(or field-value) from the hash value stored at key.
+// Positive count returns distinct fields, negative count allows the same field to be returned multiple times.
 func execHRandField(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	count := 1
-	withvalues := 0
+	withValues := false
 
 	if len(args) > 3 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'hrandfield' command")
@@ -433,12 +439,13 @@ func execHRandField(db *DB, args [][]byte) redis.Reply {
 
 	if len(args) == 3 {
 		if strings.ToLower(string(args[2])) == "withvalues" {
-			withvalues = 1
+			withValues = true
 		} else {
 			return protocol.MakeSyntaxErrReply()
 		}
 	}
 
+	count := 0
 	if len(args) >= 2 {
 		count64, err := strconv.ParseInt(string(args[1]), 10, 64)
 		if err != nil {
@@ -451,50 +458,37 @@ func execHRandField(db *DB, args [][]byte) redis.Reply {
 	if errReply != nil {
 		return errReply
 	}
-	if dict == nil {
+	if len(args) == 1 {
+		// without count, returns a single field as bulk string
+		if dict == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(dict.RandomKeys(1)[0]))
+	}
+	if dict == nil || count == 0 {
 		return &protocol.EmptyMultiBulkReply{}
 	}
 
+	var fields []string
 	if count > 0 {
-		fields := dict.RandomDistinctKeys(count)
-		Numfield := len(fields)
-		if withvalues == 0 {
-			result := make([][]byte, Numfield)
-			for i, v := range fields {
-				result[i] = []byte(v)
-			}
-			return protocol.MakeMultiBulkReply(result)
-		} else {
-			result := make([][]byte, 2*Numfield)
-			for i, v := range fields {
-				result[2*i] = []byte(v)
-				raw, _ := dict.Get(v)
-				result[2*i+1] = raw.([]byte)
-			}
-			return protocol.MakeMultiBulkReply(result)
-		}
-	} else if count < 0 {
-		fields := dict.RandomKeys(-count)
-		Numfield := len(fields)
-		if withvalues == 0 {
-			result := make([][]byte, Numfield)
-			for i, v := range fields {
-				result[i] = []byte(v)
-			}
-			return protocol.MakeMultiBulkReply(result)
-		} else {
-			result := make([][]byte, 2*Numfield)
-			for i, v := range fields {
-				result[2*i] = []byte(v)
-				raw, _ := dict.Get(v)
-				result[2*i+1] = raw.([]byte)
-			}
-			return protocol.MakeMultiBulkReply(result)
+		fields = dict.RandomDistinctKeys(count)
+	} else {
+		fields = dict.RandomKeys(-count)
+	}
+	if !withValues {
+		result := make([][]byte, len(fields))
+		for i, v := range fields {
+			result[i] = []byte(v)
 		}
+		return protocol.MakeMultiBulkReply(result)
 	}
-
-	// 'count' is 0 will reach.
-	return &protocol.EmptyMultiBulkReply{}
+	result := make([][]byte, 2*len(fields))
+	for i, v := range fields {
+		result[2*i] = []byte(v)
+		raw, _ := dict.Get(v)
+		result[2*i+1] = raw.([]byte)
+	}
+	return protocol.MakeMultiBulkReply(result)
 }
 
 func init() {
@@ -340,3 +340,17 @@ func TestUndoHIncr(t *testing.T) {
 	result := testDB.Exec(nil, utils.ToCmdLine("hget", key, field))
 	asserts.AssertBulkReply(t, result, "1")
 }
+
+func TestHRandFieldWithoutCount(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("hrandfield", key))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("hrandfield", key, "-3"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "f", "v"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hrandfield", key))
+	asserts.AssertBulkReply(t, result, "f")
+	result = testDB.Exec(nil, utils.ToCmdLine("hrandfield", key, "-3", "withvalues"))
+	asserts.AssertMultiBulkReply(t, result, []string{"f", "v", "f", "v", "f", "v"})
+}
@@ -0,0 +1,353 @@
+package database
+
+import (
+	Dict "github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/timewheel"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHashFieldExpireMs is the max expiration time of hash field in unix milliseconds, the same as redis
+const maxHashFieldExpireMs = (int64(1) << 48) - 1
+
+// result codes of HEXPIRE and HPERSIST for each field
+const (
+	hashFieldNotExists  = -2
+	hashFieldNoTTL      = -1
+	hashFieldNotUpdated = 0
+	hashFieldUpdated    = 1
+	hashFieldDeletedNow = 2
+)
+
+func getHashFieldExpireTime(dict Dict.Dict, field string) (time.Time, bool) {
+	ttlDict, ok := dict.(*Dict.TTLDict)
+	if !ok {
+		return time.Time{}, false
+	}
+	return ttlDict.ExpireTime(field)
+}
+
+// persistHashField removes ttl of field, HSET should call it since overwriting a field discards its ttl
+func persistHashField(dict Dict.Dict, field string) {
+	if ttlDict, ok := dict.(*Dict.TTLDict); ok {
+		ttlDict.Persist(field)
+	}
+}
+
+func makeHashFieldExpireCmd(key string, expireAt time.Time, fields ...string) CmdLine {
+	args := make([]string, 0, 5+len(fields))
+	args = append(args, "HPEXPIREAT", key, strconv.FormatInt(expireAt.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(fields)))
+	args = append(args, fields...)
+	return utils.ToCmdLine(args...)
+}
+
+// toTTLDict converts the hash of key into TTLDict, so that its fields can have ttl
+func (db *DB) toTTLDict(key string, dict Dict.Dict) *Dict.TTLDict {
+	if ttlDict, ok := dict.(*Dict.TTLDict); ok {
+		return ttlDict
+	}
+	ttlDict := Dict.MakeTTL(dict)
+	entity, _ := db.GetEntity(key)
+	entity.Data = ttlDict
+	return ttlDict
+}
+
+func genHashFieldExpireTask(key string) string {
+	return "hexpire:" + key
+}
+
+// scheduleHashFieldExpire registers a background task to remove expired fields at the nearest expiration time.
+// Expired fields are invisible before removed, so the task only reclaims memory and deletes emptied hash.
+func (db *DB) scheduleHashFieldExpire(key string, ttlDict *Dict.TTLDict) {
+	taskKey := genHashFieldExpireTask(key)
+	expireAt, ok := ttlDict.NextExpiration()
+	if !ok {
+		timewheel.Cancel(taskKey)
+		return
+	}
+	timewheel.At(expireAt, taskKey, func() {
+		keys := []string{key}
+		db.RWLocks(keys, nil)
+		defer db.RWUnLocks(keys, nil)
+		db.preserve(key)
+		raw, exists := db.data.Get(key)
+		if !exists {
+			return
+		}
+		entity, _ := raw.(*database.DataEntity)
+		current, ok := entity.Data.(*Dict.TTLDict)
+		if !ok {
+			return
+		}
+		if current.RemoveExpired() > 0 {
+			db.tracking.Invalidate(nil, keys)
+		}
+		if current.Len() == 0 {
+			db.Remove(key)
+			return
+		}
+		db.scheduleHashFieldExpire(key, current)
+	})
+}
+
+// parseHashFields parses "FIELDS numfields field [field ...]"
+func parseHashFields(args [][]byte) ([]string, protocol.ErrorReply) {
+	if len(args) < 2 || strings.ToUpper(string(args[0])) != "FIELDS" {
+		return nil, protocol.MakeErrReply("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.Atoi(string(args[1]))
+	if err != nil || numFields <= 0 {
+		return nil, protocol.MakeErrReply("ERR Parameter `numFields` should be greater than 0")
+	}
+	if numFields != len(args)-2 {
+		return nil, protocol.MakeErrReply("ERR The `numfields` parameter must match the number of arguments")
+	}
+	fields := make([]string, numFields)
+	for i, arg := range args[2:] {
+		fields[i] = string(arg)
+	}
+	return fields, nil
+}
+
+func makeIntArrayReply(values []int64) redis.Reply {
+	replies := make([]redis.Reply, len(values))
+	for i, v := range values {
+		replies[i] = protocol.MakeIntReply(v)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// hashFieldExpireAllowed checks NX|XX|GT|LT condition, field without ttl is regarded as never expire
+func hashFieldExpireAllowed(condition string, expireAt time.Time, current time.Time, hasTTL bool) bool {
+	switch condition {
+	case "NX":
+		return !hasTTL
+	case "XX":
+		return hasTTL
+	case "GT":
+		return hasTTL && expireAt.After(current)
+	case "LT":
+		return !hasTTL || expireAt.Before(current)
+	}
+	return true
+}
+
+// hashFieldExpire0 implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT
+// usage: HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func hashFieldExpire0(db *DB, args [][]byte, cmdName string, unit time.Duration, absolute bool) redis.Reply {
+	key := string(args[0])
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if raw < 0 {
+		return protocol.MakeErrReply("ERR invalid expire time, must be >= 0")
+	}
+	invalidErr := protocol.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	unitMs := int64(unit / time.Millisecond)
+	if raw > maxHashFieldExpireMs/unitMs {
+		return invalidErr
+	}
+	expireMs := raw * unitMs
+	if !absolute {
+		expireMs += time.Now().UnixMilli()
+	}
+	if expireMs > maxHashFieldExpireMs {
+		return invalidErr
+	}
+	expireAt := time.UnixMilli(expireMs)
+
+	rest := args[2:]
+	condition := ""
+	if len(rest) > 0 {
+		switch arg := strings.ToUpper(string(rest[0])); arg {
+		case "NX", "XX", "GT", "LT":
+			condition = arg
+			rest = rest[1:]
+		}
+	}
+	fields, errReply := parseHashFields(rest)
+	if errReply != nil {
+		return errReply
+	}
+
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]int64, len(fields))
+	var changed []string
+	if dict == nil {
+		for i := range results {
+			results[i] = hashFieldNotExists
+		}
+		return makeIntArrayReply(results)
+	}
+	expired := !expireAt.After(time.Now())
+	for i, field := range fields {
+		if _, exists := dict.Get(field); !exists {
+			results[i] = hashFieldNotExists
+			continue
+		}
+		current, hasTTL := getHashFieldExpireTime(dict, field)
+		if !hashFieldExpireAllowed(condition, expireAt, current, hasTTL) {
+			results[i] = hashFieldNotUpdated
+			continue
+		}
+		if expired {
+			dict.Remove(field)
+			results[i] = hashFieldDeletedNow
+		} else {
+			ttlDict := db.toTTLDict(key, dict)
+			ttlDict.Expire(field, expireAt)
+			dict = ttlDict
+			results[i] = hashFieldUpdated
+		}
+		changed = append(changed, field)
+	}
+	if len(changed) == 0 {
+		return makeIntArrayReply(results)
+	}
+	if dict.Len() == 0 {
+		db.Remove(key)
+	} else if ttlDict, ok := dict.(*Dict.TTLDict); ok {
+		db.scheduleHashFieldExpire(key, ttlDict)
+	}
+	db.addAof(makeHashFieldExpireCmd(key, expireAt, changed...))
+	return makeIntArrayReply(results)
+}
+
+// execHExpire sets ttl of hash fields in seconds
+func execHExpire(db *DB, args [][]byte) redis.Reply {
+	return hashFieldExpire0(db, args, "hexpire", time.Second, false)
+}
+
+// execHPExpire sets ttl of hash fields in milliseconds
+func execHPExpire(db *DB, args [][]byte) redis.Reply {
+	return hashFieldExpire0(db, args, "hpexpire", time.Millisecond, false)
+}
+
+// execHExpireAt sets expiration time of hash fields in unix seconds
+func execHExpireAt(db *DB, args [][]byte) redis.Reply {
+	return hashFieldExpire0(db, args, "hexpireat", time.Second, true)
+}
+
+// execHPExpireAt sets expiration time of hash fields in unix milliseconds
+func execHPExpireAt(db *DB, args [][]byte) redis.Reply {
+	return hashFieldExpire0(db, args, "hpexpireat", time.Millisecond, true)
+}
+
+// execHPersist removes ttl of hash fields
+// usage: HPERSIST key FIELDS numfields field [field ...]
+func execHPersist(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]int64, len(fields))
+	persisted := 0
+	for i, field := range fields {
+		if dict == nil {
+			results[i] = hashFieldNotExists
+			continue
+		}
+		if _, exists := dict.Get(field); !exists {
+			results[i] = hashFieldNotExists
+			continue
+		}
+		ttlDict, ok := dict.(*Dict.TTLDict)
+		if !ok || !ttlDict.Persist(field) {
+			results[i] = hashFieldNoTTL
+			continue
+		}
+		results[i] = hashFieldUpdated
+		persisted++
+	}
+	if persisted > 0 {
+		db.scheduleHashFieldExpire(key, dict.(*Dict.TTLDict))
+		db.addAof(utils.ToCmdLine3("hpersist", args...))
+	}
+	return makeIntArrayReply(results)
+}
+
+// hashFieldTTL0 returns ttl information of hash fields converted by the given function
+// usage: HTTL key FIELDS numfields field [field ...]
+func hashFieldTTL0(db *DB, args [][]byte, convert func(expireAt time.Time) int64) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		if dict == nil {
+			results[i] = hashFieldNotExists
+			continue
+		}
+		if _, exists := dict.Get(field); !exists {
+			results[i] = hashFieldNotExists
+			continue
+		}
+		expireAt, ok := getHashFieldExpireTime(dict, field)
+		if !ok {
+			results[i] = hashFieldNoTTL
+			continue
+		}
+		results[i] = convert(expireAt)
+	}
+	return makeIntArrayReply(results)
+}
+
+// execHTTL returns the remaining ttl of hash fields in seconds
+func execHTTL(db *DB, args [][]byte) redis.Reply {
+	return hashFieldTTL0(db, args, func(expireAt time.Time) int64 {
+		return int64(time.Until(expireAt) / time.Second)
+	})
+}
+
+// execHPTTL returns the remaining ttl of hash fields in milliseconds
+func execHPTTL(db *DB, args [][]byte) redis.Reply {
+	return hashFieldTTL0(db, args, func(expireAt time.Time) int64 {
+		return int64(time.Until(expireAt) / time.Millisecond)
+	})
+}
+
+// execHExpireTime returns the expiration time of hash fields in unix seconds
+func execHExpireTime(db *DB, args [][]byte) redis.Reply {
+	return hashFieldTTL0(db, args, func(expireAt time.Time) int64 {
+		return expireAt.Unix()
+	})
+}
+
+// execHPExpireTime returns the expiration time of hash fields in unix milliseconds
+func execHPExpireTime(db *DB, args [][]byte) redis.Reply {
+	return hashFieldTTL0(db, args, func(expireAt time.Time) int64 {
+		return expireAt.UnixMilli()
+	})
+}
+
+func init() {
+	RegisterCommand("HExpire", execHExpire, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("HPExpire", execHPExpire, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("HExpireAt", execHExpireAt, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("HPExpireAt", execHPExpireAt, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("HPersist", execHPersist, writeFirstKey, rollbackFirstKey, -5, flagWrite)
+	RegisterCommand("HTTL", execHTTL, readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand("HPTTL", execHPTTL, readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand("HExpireTime", execHExpireTime, readFirstKey, nil, -5, flagReadOnly)
+	RegisterCommand("HPExpireTime", execHPExpireTime, readFirstKey, nil, -5, flagReadOnly)
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func assertIntArrayReply(t *testing.T, actual redis.Reply, expected ...int64) {
+	t.Helper()
+	expectedBytes := makeIntArrayReply(expected).ToBytes()
+	if string(actual.ToBytes()) != string(expectedBytes) {
+		t.Errorf("expected %q, actually %q", expectedBytes, actual.ToBytes())
+	}
+}
+
+func TestHExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, -2)
+
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2", "c", "3"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "2", "a", "x"))
+	assertIntArrayReply(t, result, 1, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "3", "a", "b", "x"))
+	ttl := string(result.ToBytes())
+	if ttl != "*3\r\n:99\r\n:-1\r\n:-2\r\n" && ttl != "*3\r\n:100\r\n:-1\r\n:-2\r\n" {
+		t.Errorf("unexpected ttl %q", ttl)
+	}
+
+	// conditions
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "200", "NX", "FIELDS", "2", "a", "b"))
+	assertIntArrayReply(t, result, 0, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "300", "XX", "FIELDS", "2", "a", "c"))
+	assertIntArrayReply(t, result, 1, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "250", "GT", "FIELDS", "3", "a", "b", "c"))
+	assertIntArrayReply(t, result, 0, 1, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "LT", "FIELDS", "2", "a", "c"))
+	assertIntArrayReply(t, result, 1, 1)
+
+	expireAt := time.Now().Add(time.Hour).Unix()
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpireat", key, strconv.FormatInt(expireAt, 10), "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpiretime", key, "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, expireAt)
+	result = testDB.Exec(nil, utils.ToCmdLine("hpexpiretime", key, "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, expireAt*1000)
+
+	// time in the past deletes fields
+	result = testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "0", "FIELDS", "1", "c"))
+	assertIntArrayReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("hlen", key))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpireat", key, "1", "FIELDS", "2", "a", "b"))
+	assertIntArrayReply(t, result, 2, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+
+	// errors
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "a", "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "-1", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR invalid expire time, must be >= 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "x", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR value is not an integer or out of range")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "9223372036854775807", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR invalid expire time in 'hexpire' command")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "NX", "XX", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR Mandatory argument FIELDS is missing or not at the right position")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "0", "a"))
+	asserts.AssertErrReply(t, result, "ERR Parameter `numFields` should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "2", "a"))
+	asserts.AssertErrReply(t, result, "ERR The `numfields` parameter must match the number of arguments")
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestHPersist(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2"))
+	result := testDB.Exec(nil, utils.ToCmdLine("hpersist", key, "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, -1)
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100000", "FIELDS", "2", "a", "b"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hpersist", key, "FIELDS", "3", "a", "x", "a"))
+	assertIntArrayReply(t, result, 1, -2, -1)
+	result = testDB.Exec(nil, utils.ToCmdLine("hpttl", key, "FIELDS", "2", "a", "b"))
+	ttl := result.ToBytes()
+	if string(ttl[:9]) != "*2\r\n:-1\r\n" {
+		t.Errorf("unexpected ttl %q", ttl)
+	}
+
+	// HSET discards ttl while HINCRBY keeps it
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100000", "FIELDS", "2", "a", "b"))
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "a", "3"))
+	testDB.Exec(nil, utils.ToCmdLine("hincrby", key, "b", "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hpersist", key, "FIELDS", "2", "a", "b"))
+	assertIntArrayReply(t, result, -1, 1)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("hpersist", utils.RandString(10), "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, -2)
+}
+
+func TestHashFieldLazyExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "1", "FIELDS", "1", "a"))
+	time.Sleep(5 * time.Millisecond)
+	result := testDB.Exec(nil, utils.ToCmdLine("hget", key, "a"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("hgetall", key))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("hlen", key))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "a"))
+	assertIntArrayReply(t, result, -2)
+	// expired field is regarded as new field
+	result = testDB.Exec(nil, utils.ToCmdLine("hsetnx", key, "a", "3"))
+	asserts.AssertIntReply(t, result, 1)
+
+	// hash is deleted when all fields expired
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "1", "FIELDS", "2", "a", "b"))
+	time.Sleep(5 * time.Millisecond)
+	result = testDB.Exec(nil, utils.ToCmdLine("hgetall", key))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexists", key, "b"))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestHashFieldActiveExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100", "FIELDS", "2", "a", "b"))
+	time.Sleep(2 * time.Second)
+	// background task removes the emptied hash
+	result := testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestUndoHExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hpexpireat", key, "32503651200000", "FIELDS", "1", "b"))
+	cmdLine := utils.ToCmdLine("hexpire", key, "0", "FIELDS", "2", "a", "b")
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("hpexpiretime", key, "FIELDS", "2", "a", "b"))
+	assertIntArrayReply(t, result, -1, 32503651200000)
+
+	// undo HSET restores ttl of overwritten field
+	cmdLine = utils.ToCmdLine("hset", key, "b", "3")
+	undoCmdLines = undoHSet(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("hget", key, "b"))
+	asserts.AssertBulkReply(t, result, "2")
+	result = testDB.Exec(nil, utils.ToCmdLine("hpexpiretime", key, "FIELDS", "1", "b"))
+	assertIntArrayReply(t, result, 32503651200000)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/datastruct/hyperloglog"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+)
+
+// getAsHyperLogLog returns HyperLogLog stored in string value, returns nil if key not exists
+func (db *DB) getAsHyperLogLog(key string) (*hyperloglog.HyperLogLog, protocol.ErrorReply) {
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+	hll, err := hyperloglog.FromBytes(bytes)
+	if err != nil {
+		return nil, protocol.MakeErrReply(err.Error())
+	}
+	return hll, nil
+}
+
+// execPFAdd adds elements into HyperLogLog
+func execPFAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	hll, errReply := db.getAsHyperLogLog(key)
+	if errReply != nil {
+		return errReply
+	}
+	updated := false
+	if hll == nil {
+		hll = hyperloglog.New()
+		updated = true
+	}
+	for _, element := range args[1:] {
+		if hll.Add(element) {
+			updated = true
+		}
+	}
+	if !updated {
+		return protocol.MakeIntReply(0)
+	}
+	db.PutEntity(key, &database.DataEntity{
+		Data: hll.ToBytes(),
+	})
+	db.addAof(utils.ToCmdLine3("pfadd", args...))
+	return protocol.MakeIntReply(1)
+}
+
+// execPFCount returns the approximated cardinality of the union of HyperLogLogs
+func execPFCount(db *DB, args [][]byte) redis.Reply {
+	union := hyperloglog.New()
+	for _, arg := range args {
+		hll, errReply := db.getAsHyperLogLog(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		if hll == nil {
+			continue
+		}
+		union.Merge(hll)
+	}
+	return protocol.MakeIntReply(int64(union.Count()))
+}
+
+// execPFMerge merges source HyperLogLogs into dest
+func execPFMerge(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	merged, errReply := db.getAsHyperLogLog(dest)
+	if errReply != nil {
+		return errReply
+	}
+	if merged == nil {
+		merged = hyperloglog.New()
+	}
+	for _, arg := range args[1:] {
+		hll, errReply := db.getAsHyperLogLog(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		if hll == nil {
+			continue
+		}
+		merged.Merge(hll)
+	}
+	db.PutEntity(dest, &database.DataEntity{
+		Data: merged.ToBytes(),
+	})
+	db.addAof(utils.ToCmdLine3("pfmerge", args...))
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("PFAdd", execPFAdd, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand("PFCount", execPFCount, readAllKeys, nil, -2, flagReadOnly)
+	RegisterCommand("PFMerge", execPFMerge, prepareSetCalculateStore, rollbackFirstKey, -2, flagWrite)
+}
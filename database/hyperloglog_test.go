@@ -0,0 +1,62 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+)
+
+func TestPFAdd(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("PFAdd", key))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("PFAdd", key, "a", "b", "c"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("PFAdd", key, "a"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("PFCount", key))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("type", key))
+	asserts.AssertStatusReply(t, result, "string")
+
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "abc"))
+	result = testDB.Exec(nil, utils.ToCmdLine("PFAdd", key2, "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Key is not a valid HyperLogLog string value.")
+	result = testDB.Exec(nil, utils.ToCmdLine("PFCount", key2))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Key is not a valid HyperLogLog string value.")
+}
+
+func TestPFMerge(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	dest := utils.RandString(10)
+	for i := 0; i < 100; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("PFAdd", key1, strconv.Itoa(i)))
+		testDB.Exec(nil, utils.ToCmdLine("PFAdd", key2, strconv.Itoa(i+50)))
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("PFCount", key1, key2))
+	count1 := result.(*protocol.IntReply).Code
+	result = testDB.Exec(nil, utils.ToCmdLine("PFMerge", dest, key1, key2))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("PFCount", dest))
+	asserts.AssertIntReply(t, result, int(count1))
+	if count1 < 145 || count1 > 155 {
+		t.Errorf("expected about 150, actual %d", count1)
+	}
+
+	// round trip through aof
+	entity, _ := testDB.GetEntity(dest)
+	cmds := aof.EntityToCmds(dest, entity)
+	testDB.Remove(dest)
+	for _, cmd := range cmds {
+		testDB.Exec(nil, cmd.Args)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("PFCount", dest))
+	asserts.AssertIntReply(t, result, int(count1))
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSection generates fields of a section in INFO
+type infoSection struct {
+	name   string
+	title  string
+	fields func(mdb *MultiDB) [][2]string
+}
+
+// infoSections are sections of INFO in order
+var infoSections = []*infoSection{
+	{name: "persistence", title: "Persistence", fields: persistenceInfo},
+	{name: "stats", title: "Stats", fields: statsInfo},
+	{name: "replication", title: "Replication", fields: replicationInfo},
+}
+
+func boolInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func statusInfo(failed bool) string {
+	if failed {
+		return "err"
+	}
+	return "ok"
+}
+
+// durationInfo returns seconds of duration, negative duration means -1
+func durationInfo(d time.Duration) string {
+	if d < 0 {
+		return "-1"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+func persistenceInfo(mdb *MultiDB) [][2]string {
+	saving := atomic.LoadInt32(&mdb.saving) == 1
+	currentSaveTime := time.Duration(-1)
+	if saving {
+		currentSaveTime = time.Since(time.Unix(0, atomic.LoadInt64(&mdb.saveStart)))
+	}
+	fields := [][2]string{
+		{"loading", "0"},
+		{"rdb_changes_since_last_save", strconv.FormatInt(atomic.LoadInt64(&mdb.dirty), 10)},
+		{"rdb_bgsave_in_progress", boolInfo(saving)},
+		{"rdb_last_save_time", strconv.FormatInt(atomic.LoadInt64(&mdb.lastSaveTime), 10)},
+		{"rdb_last_bgsave_status", statusInfo(atomic.LoadInt32(&mdb.lastSaveFailed) == 1)},
+		{"rdb_last_bgsave_time_sec", durationInfo(time.Duration(atomic.LoadInt64(&mdb.lastSaveDuration)))},
+		{"rdb_current_bgsave_time_sec", durationInfo(currentSaveTime)},
+		{"rdb_saves", strconv.FormatInt(atomic.LoadInt64(&mdb.saves), 10)},
+		{"aof_enabled", boolInfo(mdb.aofHandler != nil)},
+	}
+	if mdb.aofHandler == nil {
+		return append(fields,
+			[2]string{"aof_rewrite_in_progress", "0"},
+			[2]string{"aof_last_rewrite_time_sec", "-1"},
+			[2]string{"aof_current_rewrite_time_sec", "-1"},
+			[2]string{"aof_last_bgrewrite_status", "ok"},
+			[2]string{"aof_rewrites", "0"},
+			[2]string{"aof_rewrites_consecutive_failures", "0"},
+			[2]string{"aof_last_write_status", "ok"},
+		)
+	}
+	// sizes and buffer are only reported if aof is enabled, the same as redis
+	status := mdb.aofHandler.GetStatus()
+	return append(fields,
+		[2]string{"aof_rewrite_in_progress", boolInfo(status.InProgress)},
+		[2]string{"aof_last_rewrite_time_sec", durationInfo(status.LastRewriteTime)},
+		[2]string{"aof_current_rewrite_time_sec", durationInfo(status.CurrentRewriteTime)},
+		[2]string{"aof_last_bgrewrite_status", statusInfo(status.LastRewriteFailed)},
+		[2]string{"aof_rewrites", strconv.FormatInt(status.Rewrites, 10)},
+		[2]string{"aof_rewrites_consecutive_failures", strconv.FormatInt(status.RewriteFailures, 10)},
+		[2]string{"aof_last_write_status", statusInfo(status.LastWriteFailed)},
+		[2]string{"aof_current_size", strconv.FormatInt(status.CurrentSize, 10)},
+		[2]string{"aof_base_size", strconv.FormatInt(status.BaseSize, 10)},
+		[2]string{"aof_buffer_length", strconv.Itoa(status.BufferLength)},
+	)
+}
+
+// execInfo returns information about server, unknown sections are ignored
+// usage: INFO [section [section ...]]
+func execInfo(mdb *MultiDB, args [][]byte) redis.Reply {
+	all := len(args) == 0
+	selected := make(map[string]bool)
+	for _, arg := range args {
+		name := strings.ToLower(string(arg))
+		if name == "all" || name == "default" || name == "everything" {
+			all = true
+		}
+		selected[name] = true
+	}
+	var sections []string
+	for _, section := range infoSections {
+		if !all && !selected[section.name] {
+			continue
+		}
+		var builder strings.Builder
+		builder.WriteString("# " + section.title + "\r\n")
+		for _, field := range section.fields(mdb) {
+			builder.WriteString(field[0] + ":" + field[1] + "\r\n")
+		}
+		sections = append(sections, builder.String())
+	}
+	return protocol.MakeBulkReply([]byte(strings.Join(sections, "\r\n")))
+}
@@ -6,9 +6,12 @@ import (
 	"github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/datastruct/set"
 	"github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/datastruct/stream"
+	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/lib/wildcard"
+	"github.com/hdt3213/godis/rdb"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
 	"strings"
@@ -29,6 +32,21 @@ func execDel(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(deleted))
 }
 
+// execUnlink removes keys like DEL. Removing a key only drops its reference,
+// and the value is reclaimed by garbage collector off the command path, so it never blocks on huge values
+func execUnlink(db *DB, args [][]byte) redis.Reply {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+
+	deleted := db.Removes(keys...)
+	if deleted > 0 {
+		db.addAof(utils.ToCmdLine3("unlink", args...))
+	}
+	return protocol.MakeIntReply(int64(deleted))
+}
+
 func undoDel(db *DB, args [][]byte) []CmdLine {
 	keys := make([]string, len(args))
 	for i, v := range args {
@@ -58,26 +76,46 @@ func execFlushDB(db *DB, args [][]byte) redis.Reply {
 	return &protocol.OkReply{}
 }
 
-// execType returns the type of entity, including: string, list, hash, set and zset
+// execType returns the type of entity, including: string, list, hash, set, zset and stream
 func execType(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	entity, exists := db.GetEntity(key)
 	if !exists {
 		return protocol.MakeStatusReply("none")
 	}
-	switch entity.Data.(type) {
+	typeName := getTypeName(entity.Data)
+	if typeName == "" {
+		return &protocol.UnknownErrReply{}
+	}
+	return protocol.MakeStatusReply(typeName)
+}
+
+// getTypeName returns the type name of data used by TYPE and SCAN, returns empty string for unknown type
+func getTypeName(data interface{}) string {
+	switch data.(type) {
 	case []byte:
-		return protocol.MakeStatusReply("string")
+		return "string"
 	case list.List:
-		return protocol.MakeStatusReply("list")
+		return "list"
 	case dict.Dict:
-		return protocol.MakeStatusReply("hash")
+		return "hash"
 	case *set.Set:
-		return protocol.MakeStatusReply("set")
+		return "set"
 	case *sortedset.SortedSet:
-		return protocol.MakeStatusReply("zset")
+		return "zset"
+	case *stream.Stream:
+		return "stream"
 	}
-	return &protocol.UnknownErrReply{}
+	return ""
+}
+
+var scanTypeNames = map[string]struct{}{
+	"string": {},
+	"list":   {},
+	"hash":   {},
+	"set":    {},
+	"zset":   {},
+	"stream": {},
 }
 
 func prepareRename(args [][]byte) ([]string, []string) {
@@ -144,6 +182,49 @@ func execRenameNx(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(1)
 }
 
+// expireWithCondition sets expiration of key if the NX/XX/GT/LT condition in options is satisfied.
+// A key without ttl is regarded as having an infinite ttl when comparing with GT or LT.
+func (db *DB) expireWithCondition(key string, expireAt time.Time, options [][]byte) redis.Reply {
+	var nx, xx, gt, lt bool
+	for _, arg := range options {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return protocol.MakeErrReply("ERR Unsupported option " + string(arg))
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return protocol.MakeErrReply("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return protocol.MakeErrReply("ERR GT and LT options at the same time are not compatible")
+	}
+
+	_, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeIntReply(0)
+	}
+	current, hasTTL := db.GetExpiration(key)
+	if hasTTL {
+		if nx || (gt && !expireAt.After(current)) || (lt && !expireAt.Before(current)) {
+			return protocol.MakeIntReply(0)
+		}
+	} else if xx || gt {
+		return protocol.MakeIntReply(0)
+	}
+
+	db.Expire(key, expireAt)
+	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
+	return protocol.MakeIntReply(1)
+}
+
 // execExpire sets a key's time to live in seconds
 func execExpire(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -154,15 +235,8 @@ func execExpire(db *DB, args [][]byte) redis.Reply {
 	}
 	ttl := time.Duration(ttlArg) * time.Second
 
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
-	}
-
 	expireAt := time.Now().Add(ttl)
-	db.Expire(key, expireAt)
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return db.expireWithCondition(key, expireAt, args[2:])
 }
 
 // execExpireAt sets a key's expiration in unix timestamp
@@ -175,14 +249,7 @@ func execExpireAt(db *DB, args [][]byte) redis.Reply {
 	}
 	expireAt := time.Unix(raw, 0)
 
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
-	}
-
-	db.Expire(key, expireAt)
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return db.expireWithCondition(key, expireAt, args[2:])
 }
 
 // execPExpire sets a key's time to live in milliseconds
@@ -195,15 +262,8 @@ func execPExpire(db *DB, args [][]byte) redis.Reply {
 	}
 	ttl := time.Duration(ttlArg) * time.Millisecond
 
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
-	}
-
 	expireAt := time.Now().Add(ttl)
-	db.Expire(key, expireAt)
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return db.expireWithCondition(key, expireAt, args[2:])
 }
 
 // execPExpireAt sets a key's expiration in unix timestamp specified in milliseconds
@@ -216,15 +276,7 @@ func execPExpireAt(db *DB, args [][]byte) redis.Reply {
 	}
 	expireAt := time.Unix(0, raw*int64(time.Millisecond))
 
-	_, exists := db.GetEntity(key)
-	if !exists {
-		return protocol.MakeIntReply(0)
-	}
-
-	db.Expire(key, expireAt)
-
-	db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
-	return protocol.MakeIntReply(1)
+	return db.expireWithCondition(key, expireAt, args[2:])
 }
 
 // execTTL returns a key's time to live in seconds
@@ -261,6 +313,34 @@ func execPTTL(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(ttl / time.Millisecond))
 }
 
+// execExpireTime returns the absolute unix timestamp in seconds at which the key will expire
+func execExpireTime(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	_, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeIntReply(-2)
+	}
+	expireTime, hasTTL := db.GetExpiration(key)
+	if !hasTTL {
+		return protocol.MakeIntReply(-1)
+	}
+	return protocol.MakeIntReply(expireTime.Unix())
+}
+
+// execPExpireTime returns the absolute unix timestamp in milliseconds at which the key will expire
+func execPExpireTime(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	_, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeIntReply(-2)
+	}
+	expireTime, hasTTL := db.GetExpiration(key)
+	if !hasTTL {
+		return protocol.MakeIntReply(-1)
+	}
+	return protocol.MakeIntReply(expireTime.UnixNano() / int64(time.Millisecond))
+}
+
 // execPersist removes expiration from a key
 func execPersist(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -295,6 +375,83 @@ func execKeys(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execScan iterates keys incrementally, the cursor is the index of the next shard to visit
+// usage: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func execScan(db *DB, args [][]byte) redis.Reply {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	typeName := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+		value := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern, err = wildcard.CompilePattern(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR illegal wildcard")
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return protocol.MakeErrReply("ERR syntax error")
+			}
+		case "TYPE":
+			typeName = strings.ToLower(value)
+			if _, ok := scanTypeNames[typeName]; !ok {
+				return protocol.MakeErrReply("ERR unknown type name '" + value + "'")
+			}
+		default:
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	var candidates []string
+	next := db.data.Scan(int(cursor), count, func(key string, raw interface{}) bool {
+		if pattern != nil && !pattern.IsMatch(key) {
+			return true
+		}
+		entity, _ := raw.(*database.DataEntity)
+		if typeName != "" && getTypeName(entity.Data) != typeName {
+			return true
+		}
+		candidates = append(candidates, key)
+		return true
+	})
+	// expired keys are removed after scanning, since removing needs the shard lock held by Scan
+	result := make([][]byte, 0, len(candidates))
+	for _, key := range candidates {
+		if !db.IsExpired(key) {
+			result = append(result, []byte(key))
+		}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.Itoa(next))),
+		protocol.MakeMultiBulkReply(result),
+	})
+}
+
+// execRandomKey returns a random key, expired keys are removed when sampled
+func execRandomKey(db *DB, args [][]byte) redis.Reply {
+	for db.data.Len() > 0 {
+		keys := db.data.RandomKeys(1)
+		if len(keys) == 0 {
+			break
+		}
+		if _, exists := db.GetEntity(keys[0]); exists {
+			return protocol.MakeBulkReply([]byte(keys[0]))
+		}
+	}
+	return &protocol.NullBulkReply{}
+}
+
 func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
 	if !exists {
@@ -351,6 +508,8 @@ func execCopy(mdb *MultiDB, conn redis.Connection, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR source and destination objects are the same")
 	}
 
+	mdb.snapshotGate.RLock()
+	defer mdb.snapshotGate.RUnlock()
 	// source key does not exist
 	src, exists := db.GetEntity(srcKey)
 	if !exists {
@@ -371,22 +530,131 @@ func execCopy(mdb *MultiDB, conn redis.Connection, args [][]byte) redis.Reply {
 		expire := raw.(time.Time)
 		destDB.Expire(destKey, expire)
 	}
-	mdb.aofHandler.AddAof(conn.GetDBIndex(), utils.ToCmdLine3("copy", args...))
+	mdb.addAof(conn.GetDBIndex(), utils.ToCmdLine3("copy", args...))
 	return protocol.MakeIntReply(1)
 }
 
+// execDump serializes the value stored at key in a redis compatible format
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	payload, err := aof.DumpEntity(entity)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeBulkReply(payload)
+}
+
+// execRestore usage: RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+// It creates a key associated with a value obtained by DUMP
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace := false
+	absTTL := false
+	idleTime := int64(-1)
+	freq := int64(-1)
+	for i := 3; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "REPLACE":
+			replace = true
+		case arg == "ABSTTL":
+			absTTL = true
+		case arg == "IDLETIME" && i+1 < len(args) && freq == -1:
+			idleTime, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idleTime < 0 {
+				return protocol.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+		case arg == "FREQ" && i+1 < len(args) && idleTime == -1:
+			freq, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return protocol.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+		default:
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+
+	_, exists := db.GetEntity(key)
+	if exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	obj, err := aof.ParseDumpPayload(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	entity := rdb.ToEntity(obj)
+	if entity == nil {
+		return protocol.MakeErrReply("ERR " + aof.ErrBadDumpFormat.Error())
+	}
+
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+	if exists {
+		db.Remove(key)
+		db.addAof(utils.ToCmdLine("del", key))
+	}
+	if ttl > 0 && expireAt.Before(time.Now()) {
+		// the key has already expired, there is nothing to restore
+		return protocol.MakeOkReply()
+	}
+	db.PutEntity(key, entity)
+	if idleTime > 0 {
+		entity.SetIdleTime(time.Duration(idleTime) * time.Second)
+	}
+	for _, cmd := range aof.EntityToCmds(key, entity) {
+		db.addAof(cmd.Args)
+	}
+	if ttl > 0 {
+		db.Expire(key, expireAt)
+		db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
+	}
+	return protocol.MakeOkReply()
+}
+
 func init() {
 	RegisterCommand("Del", execDel, writeAllKeys, undoDel, -2, flagWrite)
-	RegisterCommand("Expire", execExpire, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("PExpire", execPExpire, writeFirstKey, undoExpire, 3, flagWrite)
-	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, 3, flagWrite)
+	RegisterCommand("Unlink", execUnlink, writeAllKeys, undoDel, -2, flagWrite)
+	RegisterCommand("Expire", execExpire, writeFirstKey, undoExpire, -3, flagWrite)
+	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, -3, flagWrite)
+	RegisterCommand("PExpire", execPExpire, writeFirstKey, undoExpire, -3, flagWrite)
+	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, -3, flagWrite)
 	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2, flagReadOnly)
 	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("ExpireTime", execExpireTime, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("PExpireTime", execPExpireTime, readFirstKey, nil, 2, flagReadOnly)
 	RegisterCommand("Persist", execPersist, writeFirstKey, undoExpire, 2, flagWrite)
 	RegisterCommand("Exists", execExists, readAllKeys, nil, -2, flagReadOnly)
 	RegisterCommand("Type", execType, readFirstKey, nil, 2, flagReadOnly)
 	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3, flagReadOnly)
 	RegisterCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3, flagReadOnly)
 	RegisterCommand("Keys", execKeys, noPrepare, nil, 2, flagReadOnly)
+	RegisterCommand("Scan", execScan, noPrepare, nil, -2, flagReadOnly)
+	RegisterCommand("RandomKey", execRandomKey, noPrepare, nil, 1, flagReadOnly)
+	RegisterCommand("Dump", execDump, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("Restore", execRestore, writeFirstKey, rollbackFirstKey, -4, flagWrite)
 }
@@ -191,6 +191,102 @@ func TestExpireAt(t *testing.T) {
 	}
 }
 
+func TestExpireOptions(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a"))
+
+	// key has no ttl
+	result := testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "xx"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "gt"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "nx"))
+	asserts.AssertIntReply(t, result, 1)
+
+	// key has ttl of 100s
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "200", "nx"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "50", "gt"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("pexpire", key, "200000", "GT"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("ttl", key))
+	asserts.AssertIntReplyGreaterThan(t, result, 100)
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "300", "lt"))
+	asserts.AssertIntReply(t, result, 0)
+	expireAt := time.Now().Add(time.Minute).Unix()
+	result = testDB.Exec(nil, utils.ToCmdLine("expireat", key, strconv.FormatInt(expireAt, 10), "xx", "lt"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("ttl", key))
+	asserts.AssertIntReplyGreaterThan(t, result, 50)
+	result = testDB.Exec(nil, utils.ToCmdLine("pexpireat", key, strconv.FormatInt(expireAt*1000+1000, 10), "lt"))
+	asserts.AssertIntReply(t, result, 0)
+
+	// LT succeeds on key without ttl
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key2, "100", "lt"))
+	asserts.AssertIntReply(t, result, 1)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "nx", "xx"))
+	asserts.AssertErrReply(t, result, "ERR NX and XX, GT or LT options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "gt", "lt"))
+	asserts.AssertErrReply(t, result, "ERR GT and LT options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("expire", key, "100", "foo"))
+	asserts.AssertErrReply(t, result, "ERR Unsupported option foo")
+}
+
+func TestUndoExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a", "ex", "100"))
+	cmdLine := utils.ToCmdLine("expire", key, "1000", "gt")
+	undoCmdLines := undoExpire(testDB, cmdLine[1:])
+	result := testDB.Exec(nil, cmdLine)
+	asserts.AssertIntReply(t, result, 1)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("ttl", key))
+	if code := result.(*protocol.IntReply).Code; code <= 0 || code > 100 {
+		t.Errorf("expected ttl restored to 100, actually %d", code)
+	}
+
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "a"))
+	cmdLine = utils.ToCmdLine("expire", key2, "1000", "lt")
+	undoCmdLines = undoExpire(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("ttl", key2))
+	asserts.AssertIntReply(t, result, -1)
+}
+
+func TestExpireTime(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("expiretime", key))
+	asserts.AssertIntReply(t, result, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("pexpiretime", key))
+	asserts.AssertIntReply(t, result, -2)
+
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("expiretime", key))
+	asserts.AssertIntReply(t, result, -1)
+	result = testDB.Exec(nil, utils.ToCmdLine("pexpiretime", key))
+	asserts.AssertIntReply(t, result, -1)
+
+	expireAt := time.Now().Add(time.Minute).Unix()*1000 + 123
+	testDB.Exec(nil, utils.ToCmdLine("pexpireat", key, strconv.FormatInt(expireAt, 10)))
+	result = testDB.Exec(nil, utils.ToCmdLine("expiretime", key))
+	asserts.AssertIntReply(t, result, int(expireAt/1000))
+	result = testDB.Exec(nil, utils.ToCmdLine("pexpiretime", key))
+	asserts.AssertIntReply(t, result, int(expireAt))
+}
+
 func TestKeys(t *testing.T) {
 	testDB.Flush()
 	key := utils.RandString(10)
@@ -207,6 +303,100 @@ func TestKeys(t *testing.T) {
 	asserts.AssertMultiBulkReplySize(t, result, 2)
 }
 
+// scanAll calls SCAN until the cursor returns to 0 and collects all keys
+func scanAll(t *testing.T, options ...string) map[string]int {
+	t.Helper()
+	keys := make(map[string]int)
+	cursor := "0"
+	for {
+		result := testDB.Exec(nil, utils.ToCmdLine(append([]string{"scan", cursor}, options...)...))
+		reply, ok := result.(*protocol.MultiRawReply)
+		if !ok || len(reply.Replies) != 2 {
+			t.Fatalf("unexpected scan reply %q", result.ToBytes())
+		}
+		cursor = string(reply.Replies[0].(*protocol.BulkReply).Arg)
+		for _, key := range reply.Replies[1].(*protocol.MultiBulkReply).Args {
+			keys[string(key)]++
+		}
+		if cursor == "0" {
+			return keys
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	testDB.Flush()
+	for i := 0; i < 100; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("set", "s:"+strconv.Itoa(i), "1"))
+		testDB.Exec(nil, utils.ToCmdLine("rpush", "l:"+strconv.Itoa(i), "1"))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("hset", "h", "a", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("set", "expired", "1", "px", "1"))
+	time.Sleep(5 * time.Millisecond)
+
+	keys := scanAll(t)
+	if len(keys) != 201 {
+		t.Errorf("expect 201 keys, actual %d", len(keys))
+	}
+	for key, times := range keys {
+		if times != 1 {
+			t.Errorf("key %s is returned %d times", key, times)
+		}
+	}
+	if _, ok := keys["expired"]; ok {
+		t.Error("expired key should not be returned")
+	}
+	keys = scanAll(t, "COUNT", "1000", "MATCH", "s:1*")
+	if len(keys) != 11 {
+		t.Errorf("expect 11 keys, actual %d", len(keys))
+	}
+	keys = scanAll(t, "TYPE", "list")
+	if len(keys) != 100 {
+		t.Errorf("expect 100 lists, actual %d", len(keys))
+	}
+	keys = scanAll(t, "TYPE", "HASH", "MATCH", "h*")
+	if len(keys) != 1 {
+		t.Errorf("expect 1 hash, actual %d", len(keys))
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("scan", "abc"))
+	asserts.AssertErrReply(t, result, "ERR invalid cursor")
+	result = testDB.Exec(nil, utils.ToCmdLine("scan", "0", "COUNT", "0"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("scan", "0", "MATCH"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("scan", "0", "TYPE", "foo"))
+	asserts.AssertErrReply(t, result, "ERR unknown type name 'foo'")
+}
+
+func TestRandomKey(t *testing.T) {
+	testDB.Flush()
+	result := testDB.Exec(nil, utils.ToCmdLine("randomkey"))
+	asserts.AssertNullBulk(t, result)
+
+	testDB.Exec(nil, utils.ToCmdLine("set", "expired", "1", "px", "1"))
+	time.Sleep(5 * time.Millisecond)
+	result = testDB.Exec(nil, utils.ToCmdLine("randomkey"))
+	asserts.AssertNullBulk(t, result)
+
+	keys := make(map[string]struct{})
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		keys[key] = struct{}{}
+		testDB.Exec(nil, utils.ToCmdLine("set", key, "1"))
+	}
+	for i := 0; i < 100; i++ {
+		result = testDB.Exec(nil, utils.ToCmdLine("randomkey"))
+		bulk, ok := result.(*protocol.BulkReply)
+		if !ok {
+			t.Fatalf("expect bulk reply, actual %q", result.ToBytes())
+		}
+		if _, exists := keys[string(bulk.Arg)]; !exists {
+			t.Errorf("unexpected key %s", bulk.Arg)
+		}
+	}
+}
+
 func TestCopy(t *testing.T) {
 	testDB.Flush()
 	testMDB := NewStandaloneServer()
@@ -251,3 +441,111 @@ func TestCopy(t *testing.T) {
 	result = testMDB.Exec(conn, utils.ToCmdLine("ttl", destKey))
 	asserts.AssertIntReplyGreaterThan(t, result, 0)
 }
+
+func TestDumpRestore(t *testing.T) {
+	testDB.Flush()
+	// payload generated by redis: SET mykey 10; DUMP mykey
+	redisPayload := "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "10"))
+	result := testDB.Exec(nil, utils.ToCmdLine("dump", key))
+	asserts.AssertBulkReply(t, result, redisPayload)
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key, "0", redisPayload))
+	asserts.AssertErrReply(t, result, "BUSYKEY Target key name already exists.")
+	key2 := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "0", redisPayload))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("get", key2))
+	asserts.AssertBulkReply(t, result, "10")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("dump", utils.RandString(10)))
+	asserts.AssertNullBulk(t, result)
+
+	// round trip of every type
+	cmds := [][]string{
+		{"set", "str", utils.RandString(100)},
+		{"rpush", "list", "a", "1", utils.RandString(30)},
+		{"sadd", "set", "a", "b", "c"},
+		{"sadd", "intset", "1", "2", "3"},
+		{"hmset", "hash", "a", "1", "b", "2"},
+		{"zadd", "zset", "1", "a", "2.5", "b"},
+	}
+	checks := [][]string{
+		{"get", "str"},
+		{"lrange", "list", "0", "-1"},
+		{"smembers", "set"},
+		{"smembers", "intset"},
+		{"hgetall", "hash"},
+		{"zrange", "zset", "0", "-1", "withscores"},
+	}
+	for i, cmd := range cmds {
+		testDB.Exec(nil, utils.ToCmdLine(cmd...))
+		expected := testDB.Exec(nil, utils.ToCmdLine(checks[i]...))
+		result = testDB.Exec(nil, utils.ToCmdLine("dump", cmd[1]))
+		payload, ok := result.(*protocol.BulkReply)
+		if !ok {
+			t.Errorf("dump %s failed: %s", cmd[1], result.ToBytes())
+			continue
+		}
+		result = testDB.Exec(nil, utils.ToCmdLine("restore", cmd[1], "100000", string(payload.Arg), "replace"))
+		asserts.AssertStatusReply(t, result, "OK")
+		actual := testDB.Exec(nil, utils.ToCmdLine(checks[i]...))
+		if checks[i][0] == "smembers" || checks[i][0] == "hgetall" {
+			asserts.AssertMultiBulkReplySize(t, actual, len(expected.(*protocol.MultiBulkReply).Args))
+		} else if string(actual.ToBytes()) != string(expected.ToBytes()) {
+			t.Errorf("restore %s: expected %s, actually %s", cmd[1], expected.ToBytes(), actual.ToBytes())
+		}
+		result = testDB.Exec(nil, utils.ToCmdLine("pttl", cmd[1]))
+		asserts.AssertIntReplyGreaterThan(t, result, 0)
+	}
+
+	// options
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "-1", redisPayload, "replace"))
+	asserts.AssertErrReply(t, result, "ERR Invalid TTL value, must be >= 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "0", redisPayload, "replace", "idletime", "1000"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "idletime", key2))
+	asserts.AssertIntReplyGreaterThan(t, result, 999)
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "1000", redisPayload, "replace", "absttl"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "0", redisPayload, "foo"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+
+	// corrupted payload
+	corrupted := []byte(redisPayload)
+	corrupted[1] = 'x'
+	result = testDB.Exec(nil, utils.ToCmdLine("restore", key2, "0", string(corrupted)))
+	asserts.AssertErrReply(t, result, "ERR DUMP payload version or checksum are wrong")
+}
+
+func TestUndoRestore(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b"))
+	payload := testDB.Exec(nil, utils.ToCmdLine("dump", key)).(*protocol.BulkReply).Arg
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "c"))
+	cmdLine := utils.ToCmdLine("restore", key, "0", string(payload), "replace")
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	result := testDB.Exec(nil, utils.ToCmdLine("llen", key))
+	asserts.AssertIntReply(t, result, 2)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("llen", key))
+	asserts.AssertIntReply(t, result, 3)
+}
+
+func TestUnlink(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key1, "v"))
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("unlink", key1, key2, utils.RandString(10)))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key1, key2))
+	asserts.AssertIntReply(t, result, 0)
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/lazyfree"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+)
+
+// parseFlushMode parses [ASYNC|SYNC] of FLUSHDB and FLUSHALL, lazyfree-lazy-user-flush decides mode if not given
+func parseFlushMode(cmdName string, args [][]byte) (bool, protocol.ErrorReply) {
+	if len(args) > 1 {
+		return false, protocol.MakeArgNumErrReply(cmdName)
+	}
+	if len(args) == 0 {
+		return config.Properties().LazyfreeLazyUserFlush, nil
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ASYNC":
+		return true, nil
+	case "SYNC":
+		return false, nil
+	}
+	return false, protocol.MakeSyntaxErrReply()
+}
+
+// freeDB releases data of a DB which has been replaced, in background goroutine if async
+func freeDB(db *DB, async bool) {
+	if async {
+		lazyfree.Free(func() {
+			releaseDB(db)
+		})
+		return
+	}
+	releaseDB(db)
+}
+
+// releaseDB removes all keys of a replaced DB. Expiration tasks of hash fields keep referring to the DB
+// until they are triggered, so its data can't be reclaimed by garbage collector before removed.
+// Commands which selected the DB before replaced may still be running, so keys are removed one by one.
+func releaseDB(db *DB) {
+	if s, _ := db.snapshot.Load().(*dbSnapshot); s != nil {
+		// aof rewriting is still reading the DB, leave it to garbage collector
+		return
+	}
+	for _, key := range db.data.Keys() {
+		db.data.Remove(key)
+	}
+	for _, key := range db.ttlMap.Keys() {
+		db.ttlMap.Remove(key)
+	}
+	for _, key := range db.versionMap.Keys() {
+		db.versionMap.Remove(key)
+	}
+}
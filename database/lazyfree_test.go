@@ -0,0 +1,49 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/lazyfree"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFlushMode(t *testing.T) {
+	server := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	for _, mode := range []string{"", "ASYNC", "SYNC", "async"} {
+		for i := 0; i < 100; i++ {
+			server.Exec(conn, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), "v", "EX", "1000"))
+		}
+		oldDB := server.mustSelectDB(0)
+		cmdLine := utils.ToCmdLine("FLUSHDB")
+		if mode != "" {
+			cmdLine = append(cmdLine, []byte(mode))
+		}
+		ret := server.Exec(conn, cmdLine)
+		asserts.AssertStatusReply(t, ret, "OK")
+		ret = server.Exec(conn, utils.ToCmdLine("EXISTS", "k0"))
+		asserts.AssertIntReply(t, ret, 0)
+		// data of the replaced db is released, though its expiration tasks are pending
+		deadline := time.Now().Add(time.Second)
+		for lazyfree.Pending() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if oldDB.data.Len() != 0 || oldDB.ttlMap.Len() != 0 {
+			t.Errorf("replaced db is not released by FLUSHDB %s", mode)
+		}
+	}
+
+	server.Exec(conn, utils.ToCmdLine("SET", "k", "v"))
+	ret := server.Exec(conn, utils.ToCmdLine("FLUSHALL", "ASYNC"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = server.Exec(conn, utils.ToCmdLine("EXISTS", "k"))
+	asserts.AssertIntReply(t, ret, 0)
+
+	ret = server.Exec(conn, utils.ToCmdLine("FLUSHALL", "LAZY"))
+	asserts.AssertErrReply(t, ret, "Err syntax error")
+	ret = server.Exec(conn, utils.ToCmdLine("FLUSHDB", "ASYNC", "SYNC"))
+	asserts.AssertErrReply(t, ret, "ERR wrong number of arguments for 'flushdb' command")
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsList(key string) (List.List, protocol.ErrorReply) {
@@ -145,6 +146,7 @@ func execLPush(db *DB, args [][]byte) redis.Reply {
 		list.Insert(0, value)
 	}
 
+	db.notifyWaiters(key)
 	db.addAof(utils.ToCmdLine3("lpush", args...))
 	return protocol.MakeIntReply(int64(list.Len()))
 }
@@ -177,6 +179,7 @@ func execLPushX(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Insert(0, value)
 	}
+	db.notifyWaiters(key)
 	db.addAof(utils.ToCmdLine3("lpushx", args...))
 	return protocol.MakeIntReply(int64(list.Len()))
 }
@@ -401,32 +404,13 @@ func prepareRPopLPush(args [][]byte) ([]string, []string) {
 
 // execRPopLPush pops last element of list-A then insert it to the head of list-B
 func execRPopLPush(db *DB, args [][]byte) redis.Reply {
-	sourceKey := string(args[0])
-	destKey := string(args[1])
-
-	// get source entity
-	sourceList, errReply := db.getAsList(sourceKey)
+	val, errReply := db.moveListElement(string(args[0]), string(args[1]), false, true)
 	if errReply != nil {
 		return errReply
 	}
-	if sourceList == nil {
+	if val == nil {
 		return &protocol.NullBulkReply{}
 	}
-
-	// get dest entity
-	destList, _, errReply := db.getOrInitList(destKey)
-	if errReply != nil {
-		return errReply
-	}
-
-	// pop and push
-	val, _ := sourceList.RemoveLast().([]byte)
-	destList.Insert(0, val)
-
-	if sourceList.Len() == 0 {
-		db.Remove(sourceKey)
-	}
-
 	db.addAof(utils.ToCmdLine3("rpoplpush", args...))
 	return protocol.MakeBulkReply(val)
 }
@@ -470,6 +454,7 @@ func execRPush(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Add(value)
 	}
+	db.notifyWaiters(key)
 	db.addAof(utils.ToCmdLine3("rpush", args...))
 	return protocol.MakeIntReply(int64(list.Len()))
 }
@@ -505,11 +490,233 @@ func execRPushX(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Add(value)
 	}
+	db.notifyWaiters(key)
 	db.addAof(utils.ToCmdLine3("rpushx", args...))
 
 	return protocol.MakeIntReply(int64(list.Len()))
 }
 
+// execLMove pops an element from source then pushes it into destination, the ends are given by LEFT|RIGHT
+func execLMove(db *DB, args [][]byte) redis.Reply {
+	fromLeft, errReply := parseListDirection(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	toLeft, errReply := parseListDirection(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	val, errReply := db.moveListElement(string(args[0]), string(args[1]), fromLeft, toLeft)
+	if errReply != nil {
+		return errReply
+	}
+	if val == nil {
+		return &protocol.NullBulkReply{}
+	}
+	db.addAof(utils.ToCmdLine3("lmove", args[:4]...))
+	return protocol.MakeBulkReply(val)
+}
+
+// moveListElement pops an element from source and pushes it into destination, returns nil if source is empty.
+// Source and destination may be the same list, in which case the element is rotated.
+func (db *DB) moveListElement(sourceKey string, destKey string, fromLeft bool, toLeft bool) ([]byte, protocol.ErrorReply) {
+	sourceList, errReply := db.getAsList(sourceKey)
+	if errReply != nil {
+		return nil, errReply
+	}
+	if sourceList == nil {
+		return nil, nil
+	}
+	// check type of dest before modifying source
+	if _, errReply = db.getAsList(destKey); errReply != nil {
+		return nil, errReply
+	}
+
+	var val []byte
+	if fromLeft {
+		val, _ = sourceList.Remove(0).([]byte)
+	} else {
+		val, _ = sourceList.RemoveLast().([]byte)
+	}
+	if sourceList.Len() == 0 {
+		db.Remove(sourceKey)
+	}
+	// getOrInitList recreates the list if it was the source and has just been emptied
+	destList, _, _ := db.getOrInitList(destKey)
+	if toLeft {
+		destList.Insert(0, val)
+	} else {
+		destList.Add(val)
+	}
+	db.notifyWaiters(destKey)
+	return val, nil
+}
+
+// execLPos returns the indexes of matching elements inside a list
+// usage: LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func execLPos(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	element := args[1]
+	var rank int64 = 1
+	var count int64 = -1 // -1 means COUNT is not given
+	var maxLen int64
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+		val, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if val == 0 {
+				return protocol.MakeErrReply("ERR RANK can't be zero: use 1 to start from the first match, " +
+					"2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = val
+		case "COUNT":
+			if val < 0 {
+				return protocol.MakeErrReply("ERR COUNT can't be negative")
+			}
+			count = val
+		case "MAXLEN":
+			if val < 0 {
+				return protocol.MakeErrReply("ERR MAXLEN can't be negative")
+			}
+			maxLen = val
+		default:
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	limit := count
+	if limit < 0 {
+		limit = 1
+	}
+	// skip is the number of matches before the first one to return
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	var positions []int64
+	var compared int64
+	consumer := func(i int, v interface{}) bool {
+		if maxLen > 0 && compared >= maxLen {
+			return false
+		}
+		compared++
+		if val, _ := v.([]byte); !utils.BytesEquals(val, element) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		positions = append(positions, int64(i))
+		return limit == 0 || int64(len(positions)) < limit
+	}
+	if list != nil {
+		if rank > 0 {
+			list.ForEach(consumer)
+		} else {
+			list.ReverseForEach(consumer)
+		}
+	}
+
+	if count < 0 {
+		if len(positions) == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeIntReply(positions[0])
+	}
+	replies := make([]redis.Reply, len(positions))
+	for i, position := range positions {
+		replies[i] = protocol.MakeIntReply(position)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func parseListDirection(arg []byte) (bool, protocol.ErrorReply) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return true, nil
+	case "right":
+		return false, nil
+	}
+	return false, protocol.MakeErrReply("ERR syntax error")
+}
+
+func undoLMove(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[0]), string(args[1]))
+}
+
+// prepareBlockingPop returns all keys of BLPOP or BRPOP, the last arg is timeout
+func prepareBlockingPop(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[:len(args)-1] {
+		keys[i] = string(arg)
+	}
+	return keys, nil
+}
+
+func undoBlockingPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareBlockingPop(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// blockingPop0 pops an element from the first non-empty list, returns NullMultiBulkReply if all lists are empty
+func blockingPop0(db *DB, args [][]byte, left bool) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[len(args)-1]); errReply != nil {
+		return errReply
+	}
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			continue
+		}
+		var val []byte
+		if left {
+			val, _ = list.Remove(0).([]byte)
+			db.addAof(utils.ToCmdLine3("lpop", arg))
+		} else {
+			val, _ = list.RemoveLast().([]byte)
+			db.addAof(utils.ToCmdLine3("rpop", arg))
+		}
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		return protocol.MakeMultiBulkReply([][]byte{arg, val})
+	}
+	return &protocol.NullMultiBulkReply{}
+}
+
+// execBLPop removes the first element of the first non-empty list, blocks if all lists are empty
+func execBLPop(db *DB, args [][]byte) redis.Reply {
+	return blockingPop0(db, args, true)
+}
+
+// execBRPop removes the last element of the first non-empty list, blocks if all lists are empty
+func execBRPop(db *DB, args [][]byte) redis.Reply {
+	return blockingPop0(db, args, false)
+}
+
+// execBLMove is the blocking version of LMOVE
+func execBLMove(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[4]); errReply != nil {
+		return errReply
+	}
+	return execLMove(db, args[:4])
+}
+
 func init() {
 	RegisterCommand("LPush", execLPush, writeFirstKey, undoLPush, -3, flagWrite)
 	RegisterCommand("LPushX", execLPushX, writeFirstKey, undoLPush, -3, flagWrite)
@@ -523,4 +730,9 @@ func init() {
 	RegisterCommand("LIndex", execLIndex, readFirstKey, nil, 3, flagReadOnly)
 	RegisterCommand("LSet", execLSet, writeFirstKey, undoLSet, 4, flagWrite)
 	RegisterCommand("LRange", execLRange, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand("LPos", execLPos, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand("LMove", execLMove, prepareRPopLPush, undoLMove, 5, flagWrite)
+	RegisterCommand("BLPop", execBLPop, prepareBlockingPop, undoBlockingPop, -3, flagWrite|flagBlocking)
+	RegisterCommand("BRPop", execBRPop, prepareBlockingPop, undoBlockingPop, -3, flagWrite|flagBlocking)
+	RegisterCommand("BLMove", execBLMove, prepareRPopLPush, undoLMove, 6, flagWrite|flagBlocking)
 }
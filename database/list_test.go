@@ -465,3 +465,130 @@ func TestUndoRPopLPush(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("llen", key2))
 	asserts.AssertIntReply(t, result, 0)
 }
+
+func TestLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b", "c"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "right", "left"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "a"})
+
+	// rotate
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key2, key2, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "c"})
+
+	// source becomes empty
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "LEFT"))
+	asserts.AssertBulkReply(t, result, "b")
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key1))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "LEFT"))
+	asserts.AssertNullBulk(t, result)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key2, key1, "UP", "LEFT"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	key3 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key3, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key2, key3, "LEFT", "LEFT"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testDB.Exec(nil, utils.ToCmdLine("llen", key2))
+	asserts.AssertIntReply(t, result, 3)
+}
+
+func TestUndoLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b"))
+
+	cmdLine := utils.ToCmdLine("lmove", key1, key2, "LEFT", "RIGHT")
+	undoCmdLines := undoLMove(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("lrange", key1, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestListRotation(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a"))
+	result := testDB.Exec(nil, utils.ToCmdLine("rpoplpush", key, key))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a"})
+
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "b", "c"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key, key, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "a"})
+
+	// source is unchanged if destination has wrong type
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "v"))
+	result = testDB.Exec(nil, utils.ToCmdLine("rpoplpush", key, dest))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testDB.Exec(nil, utils.ToCmdLine("llen", key))
+	asserts.AssertIntReply(t, result, 3)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("rpoplpush", utils.RandString(10), key))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestLPos(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "1", "2", "3", "c", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "2"))
+	asserts.AssertIntReply(t, result, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "-1"))
+	asserts.AssertIntReply(t, result, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "2"))
+	asserts.AssertMultiBulkReplySize(t, result, 2)
+	if string(result.ToBytes()) != "*2\r\n:2\r\n:6\r\n" {
+		t.Errorf("unexpected reply %q", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "-1", "COUNT", "0"))
+	if string(result.ToBytes()) != "*3\r\n:7\r\n:6\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "0", "MAXLEN", "3"))
+	if string(result.ToBytes()) != "*1\r\n:2\r\n" {
+		t.Errorf("unexpected reply %q", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "-1", "MAXLEN", "1"))
+	asserts.AssertIntReply(t, result, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "x"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "x", "COUNT", "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", utils.RandString(10), "x", "COUNT", "1"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "0"))
+	asserts.AssertErrReply(t, result, "ERR RANK can't be zero: use 1 to start from the first match, "+
+		"2 from the second ... or use negative to start from the end of the list")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "-1"))
+	asserts.AssertErrReply(t, result, "ERR COUNT can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "MAXLEN", "-1"))
+	asserts.AssertErrReply(t, result, "ERR MAXLEN can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "FOO", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// mPopOption is the parsed arguments of LMPOP and ZMPOP: numkeys key [key ...] LEFT|RIGHT [COUNT count]
+type mPopOption struct {
+	keys []string
+	// first means LEFT of LMPOP or MIN of ZMPOP
+	first bool
+	count int
+}
+
+// parseMPopOption parses arguments begin with numkeys, firstWord and lastWord are the names of the two ends
+func parseMPopOption(args [][]byte, firstWord string, lastWord string) (*mPopOption, protocol.ErrorReply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys <= 0 {
+		return nil, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys >= len(args)-1 {
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	option := &mPopOption{
+		keys:  make([]string, numKeys),
+		count: 1,
+	}
+	for i := 0; i < numKeys; i++ {
+		option.keys[i] = string(args[i+1])
+	}
+	switch strings.ToUpper(string(args[numKeys+1])) {
+	case firstWord:
+		option.first = true
+	case lastWord:
+		option.first = false
+	default:
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	rest := args[numKeys+2:]
+	if len(rest) == 0 {
+		return option, nil
+	}
+	if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "COUNT" {
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	option.count, err = strconv.Atoi(string(rest[1]))
+	if err != nil || option.count <= 0 {
+		return nil, protocol.MakeErrReply("ERR count should be greater than 0")
+	}
+	return option, nil
+}
+
+// prepareMPop returns all candidate keys as write keys, invalid arguments will be rejected by executor
+func prepareMPop(args [][]byte) ([]string, []string) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys <= 0 || numKeys >= len(args) {
+		return nil, nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	return keys, nil
+}
+
+// prepareBlockingMPop skips the timeout which is the first argument
+func prepareBlockingMPop(args [][]byte) ([]string, []string) {
+	return prepareMPop(args[1:])
+}
+
+func undoMPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareMPop(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+func undoBlockingMPop(db *DB, args [][]byte) []CmdLine {
+	return undoMPop(db, args[1:])
+}
+
+// execLMPop pops elements from the first non-empty list
+// usage: LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func execLMPop(db *DB, args [][]byte) redis.Reply {
+	option, errReply := parseMPopOption(args, "LEFT", "RIGHT")
+	if errReply != nil {
+		return errReply
+	}
+	for _, key := range option.keys {
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			continue
+		}
+		count := option.count
+		if count > list.Len() {
+			count = list.Len()
+		}
+		elements := make([][]byte, count)
+		for i := range elements {
+			if option.first {
+				elements[i], _ = list.Remove(0).([]byte)
+			} else {
+				elements[i], _ = list.RemoveLast().([]byte)
+			}
+		}
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		direction := "LEFT"
+		if !option.first {
+			direction = "RIGHT"
+		}
+		db.addAof(utils.ToCmdLine("lmpop", "1", key, direction, "COUNT", strconv.Itoa(count)))
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			protocol.MakeMultiBulkReply(elements),
+		})
+	}
+	return &protocol.NullMultiBulkReply{}
+}
+
+// execBLMPop is the blocking version of LMPOP
+// usage: BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func execBLMPop(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[0]); errReply != nil {
+		return errReply
+	}
+	return execLMPop(db, args[1:])
+}
+
+// execZMPop pops members with the lowest or highest scores from the first non-empty sorted set
+// usage: ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+func execZMPop(db *DB, args [][]byte) redis.Reply {
+	option, errReply := parseMPopOption(args, "MIN", "MAX")
+	if errReply != nil {
+		return errReply
+	}
+	for _, key := range option.keys {
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			continue
+		}
+		var removed []*SortedSet.Element
+		direction := "MIN"
+		if option.first {
+			removed = sortedSet.PopMin(option.count)
+		} else {
+			removed = sortedSet.PopMax(option.count)
+			direction = "MAX"
+		}
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
+		db.addAof(utils.ToCmdLine("zmpop", "1", key, direction, "COUNT", strconv.Itoa(len(removed))))
+		elements := make([]redis.Reply, len(removed))
+		for i, element := range removed {
+			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
+			elements[i] = protocol.MakeMultiBulkReply([][]byte{[]byte(element.Member), []byte(scoreStr)})
+		}
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			protocol.MakeMultiRawReply(elements),
+		})
+	}
+	return &protocol.NullMultiBulkReply{}
+}
+
+// execBZMPop is the blocking version of ZMPOP
+// usage: BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+func execBZMPop(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[0]); errReply != nil {
+		return errReply
+	}
+	return execZMPop(db, args[1:])
+}
+
+func init() {
+	RegisterCommand("LMPop", execLMPop, prepareMPop, undoMPop, -4, flagWrite)
+	RegisterCommand("BLMPop", execBLMPop, prepareBlockingMPop, undoBlockingMPop, -5, flagWrite|flagBlocking|flagTimeoutFirst)
+	RegisterCommand("ZMPop", execZMPop, prepareMPop, undoMPop, -4, flagWrite)
+	RegisterCommand("BZMPop", execBZMPop, prepareBlockingMPop, undoBlockingMPop, -5, flagWrite|flagBlocking|flagTimeoutFirst)
+}
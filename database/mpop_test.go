@@ -0,0 +1,115 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func assertMPopReply(t *testing.T, actual redis.Reply, key string, items redis.Reply) {
+	t.Helper()
+	expected := protocol.MakeMultiRawReply([]redis.Reply{protocol.MakeBulkReply([]byte(key)), items})
+	if string(actual.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expected %q, actually %q", expected.ToBytes(), actual.ToBytes())
+	}
+}
+
+func listItems(elements ...string) redis.Reply {
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(elements...))
+}
+
+// zSetItems makes reply of ZMPOP from member-score pairs
+func zSetItems(pairs ...string) redis.Reply {
+	replies := make([]redis.Reply, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		replies = append(replies, protocol.MakeMultiBulkReply(utils.ToCmdLine(pairs[i], pairs[i+1])))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func TestLMPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "LEFT"))
+	assertMPopReply(t, result, key2, listItems("a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "right", "COUNT", "5"))
+	assertMPopReply(t, result, key2, listItems("c", "b"))
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "LEFT"))
+	asserts.AssertNullMultiBulk(t, result)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "0", key1, "LEFT"))
+	asserts.AssertErrReply(t, result, "ERR numkeys should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, "LEFT"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "1", key1, "MIN"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "1", key1, "LEFT", "COUNT", "0"))
+	asserts.AssertErrReply(t, result, "ERR count should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "1", key1, "LEFT", "COUNT"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	testDB.Exec(nil, utils.ToCmdLine("set", key1, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "1", key1, "LEFT"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestZMPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "1", "a", "2", "b", "3", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("zmpop", "2", key1, key2, "MIN"))
+	assertMPopReply(t, result, key2, zSetItems("a", "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "2", key1, key2, "max", "COUNT", "5"))
+	assertMPopReply(t, result, key2, zSetItems("c", "3", "b", "2"))
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "1", key2, "MIN"))
+	asserts.AssertNullMultiBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "1", key2, "LEFT"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+}
+
+func TestBLMPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	ch := execAsync(t, key2, utils.ToCmdLine("blmpop", "0", "2", key1, key2, "RIGHT", "COUNT", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b", "c"))
+	assertMPopReply(t, receiveReply(t, ch), key2, listItems("c", "b"))
+	if testDB.blocking.waitingCount(key1) != 0 || testDB.blocking.waitingCount(key2) != 0 {
+		t.Error("waiter should be removed")
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("blmpop", "0.1", "1", key1, "LEFT"))
+	asserts.AssertNullMultiBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("blmpop", "-1", "1", key1, "LEFT"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+}
+
+func TestBZMPop(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	ch := execAsync(t, key, utils.ToCmdLine("bzmpop", "0", "1", key, "MAX"))
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b"))
+	assertMPopReply(t, receiveReply(t, ch), key, zSetItems("b", "2"))
+}
+
+func TestUndoLMPop(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b"))
+	cmdLine := utils.ToCmdLine("lmpop", "1", key, "LEFT", "COUNT", "2")
+	undoCmdLines := undoMPop(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+}
@@ -0,0 +1,265 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/set"
+	"github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/datastruct/stream"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingInt       = "int"
+	encodingEmbStr    = "embstr"
+	encodingRaw       = "raw"
+	encodingIntSet    = "intset"
+	encodingListPack  = "listpack"
+	encodingQuickList = "quicklist"
+	encodingHashTable = "hashtable"
+	encodingSkipList  = "skiplist"
+	encodingStream    = "stream"
+
+	// strings longer than embStrSizeLimit use raw encoding
+	embStrSizeLimit = 44
+)
+
+// encodingRank orders encodings of collections, a value only converts to an encoding with higher rank
+var encodingRank = map[string]int{
+	encodingIntSet:    1,
+	encodingListPack:  2,
+	encodingQuickList: 3,
+	encodingHashTable: 3,
+	encodingSkipList:  3,
+}
+
+func orDefault(val int, defaultVal int) int {
+	if val == 0 {
+		return defaultVal
+	}
+	return val
+}
+
+// listListPackFits checks whether list is within the limit of list-max-listpack-size.
+// Positive limit means max number of elements, negative limit -n means max size of 4kb * 2^(n-1)
+func listListPackFits(l list.List) bool {
+	limit := orDefault(config.Properties().ListMaxListpackSize, -2)
+	if limit > 0 {
+		return l.Len() <= limit
+	}
+	if limit < -5 {
+		limit = -5
+	}
+	maxBytes := 4096 << (-limit - 1)
+	if l.Len() > maxBytes {
+		return false
+	}
+	size := 0
+	l.ForEach(func(i int, v interface{}) bool {
+		val, _ := v.([]byte)
+		size += len(val)
+		return size <= maxBytes
+	})
+	return size <= maxBytes
+}
+
+func hashEncoding(d dict.Dict) string {
+	if d.Len() > orDefault(config.Properties().HashMaxListpackEntries, 128) {
+		return encodingHashTable
+	}
+	maxValue := orDefault(config.Properties().HashMaxListpackValue, 64)
+	fits := true
+	d.ForEach(func(key string, val interface{}) bool {
+		bytes, _ := val.([]byte)
+		fits = len(key) <= maxValue && len(bytes) <= maxValue
+		return fits
+	})
+	if !fits {
+		return encodingHashTable
+	}
+	return encodingListPack
+}
+
+func setEncoding(s *set.Set) string {
+	maxIntSetEntries := orDefault(config.Properties().SetMaxIntsetEntries, 512)
+	maxListPackEntries := orDefault(config.Properties().SetMaxListpackEntries, 128)
+	if s.Len() > maxIntSetEntries && s.Len() > maxListPackEntries {
+		return encodingHashTable
+	}
+	allInt := true
+	fits := true
+	maxValue := orDefault(config.Properties().SetMaxListpackValue, 64)
+	s.ForEach(func(member string) bool {
+		if allInt {
+			_, err := strconv.ParseInt(member, 10, 64)
+			allInt = err == nil
+		}
+		if len(member) > maxValue {
+			fits = false
+		}
+		return allInt || fits
+	})
+	if allInt && s.Len() <= maxIntSetEntries {
+		return encodingIntSet
+	}
+	if fits && s.Len() <= maxListPackEntries {
+		return encodingListPack
+	}
+	return encodingHashTable
+}
+
+func sortedSetEncoding(s *sortedset.SortedSet) string {
+	if s.Len() > int64(orDefault(config.Properties().ZSetMaxListpackEntries, 128)) {
+		return encodingSkipList
+	}
+	if s.Len() == 0 {
+		return encodingListPack
+	}
+	maxValue := orDefault(config.Properties().ZSetMaxListpackValue, 64)
+	fits := true
+	s.ForEach(0, s.Len(), false, func(element *sortedset.Element) bool {
+		fits = len(element.Member) <= maxValue
+		return fits
+	})
+	if !fits {
+		return encodingSkipList
+	}
+	return encodingListPack
+}
+
+func stringEncoding(bytes []byte) string {
+	if len(bytes) <= 20 {
+		if val, err := strconv.ParseInt(string(bytes), 10, 64); err == nil && strconv.FormatInt(val, 10) == string(bytes) {
+			return encodingInt
+		}
+	}
+	if len(bytes) <= embStrSizeLimit {
+		return encodingEmbStr
+	}
+	return encodingRaw
+}
+
+// getEncoding returns the internal encoding of entity considering its current content and config thresholds
+func getEncoding(entity *database.DataEntity) string {
+	var current string
+	switch val := entity.Data.(type) {
+	case []byte:
+		return stringEncoding(val)
+	case *stream.Stream:
+		return encodingStream
+	case list.List:
+		if entity.Encoding == encodingQuickList {
+			return encodingQuickList
+		}
+		current = encodingQuickList
+		if listListPackFits(val) {
+			current = encodingListPack
+		}
+	case dict.Dict:
+		if entity.Encoding == encodingHashTable {
+			return encodingHashTable
+		}
+		current = hashEncoding(val)
+	case *set.Set:
+		if entity.Encoding == encodingHashTable {
+			return encodingHashTable
+		}
+		current = setEncoding(val)
+	case *sortedset.SortedSet:
+		if entity.Encoding == encodingSkipList {
+			return encodingSkipList
+		}
+		current = sortedSetEncoding(val)
+	default:
+		return ""
+	}
+	if encodingRank[entity.Encoding] > encodingRank[current] {
+		return entity.Encoding
+	}
+	return current
+}
+
+// updateEncodings converts values of the given keys into larger encodings if they exceed the thresholds.
+// It should be invoked after write commands, a value never converts back to compact encoding like redis.
+func (db *DB) updateEncodings(keys ...string) {
+	for _, key := range keys {
+		raw, ok := db.data.Get(key)
+		if !ok {
+			continue
+		}
+		entity, _ := raw.(*database.DataEntity)
+		if _, isString := entity.Data.([]byte); isString {
+			continue
+		}
+		entity.Encoding = getEncoding(entity)
+	}
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+// execObject inspects the internals of value, it does not update the access time of key
+func execObject(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	if subCmd == "help" {
+		lines := make([][]byte, len(objectHelp))
+		for i, line := range objectHelp {
+			lines[i] = []byte(line)
+		}
+		return protocol.MakeMultiBulkReply(lines)
+	}
+	switch subCmd {
+	case "encoding", "refcount", "idletime", "freq":
+	default:
+		return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try OBJECT HELP.")
+	}
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("object|" + subCmd)
+	}
+	key := string(args[1])
+	raw, ok := db.data.Get(key)
+	if !ok || db.IsExpired(key) {
+		return protocol.MakeNullBulkReply()
+	}
+	entity, _ := raw.(*database.DataEntity)
+	switch subCmd {
+	case "encoding":
+		return protocol.MakeBulkReply([]byte(getEncoding(entity)))
+	case "refcount":
+		return protocol.MakeIntReply(1)
+	case "idletime":
+		return protocol.MakeIntReply(int64(entity.IdleTime().Seconds()))
+	}
+	return protocol.MakeErrReply("ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+}
+
+func prepareObject(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return nil, []string{string(args[1])}
+}
+
+func init() {
+	RegisterCommand("Object", execObject, prepareObject, nil, -2, flagReadOnly)
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObjectEncoding(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "12345"))
+	result := testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "int")
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "abc"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "embstr")
+	testDB.Exec(nil, utils.ToCmdLine("set", key, strings.Repeat("a", 45)))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "raw")
+
+	// set converts from intset to listpack then hashtable, and never converts back
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "1", "2", "3"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "intset")
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "listpack")
+	testDB.Exec(nil, utils.ToCmdLine("srem", key, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "listpack")
+	for i := 0; i < 128; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("sadd", key, "m"+strconv.Itoa(i)))
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "hashtable")
+	testDB.Exec(nil, utils.ToCmdLine("spop", key, "100"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "hashtable")
+
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "f", "v"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "listpack")
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "f", strings.Repeat("v", 65)))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "hashtable")
+
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "listpack")
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "2", strings.Repeat("b", 65)))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "skiplist")
+
+	key = utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "listpack")
+
+	// thresholds from config
+	config.Update(func(p *config.ServerProperties) {
+		p.ListMaxListpackSize = 2
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.ListMaxListpackSize = 0
+		})
+	}()
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "b", "c"))
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key))
+	asserts.AssertBulkReply(t, result, "quicklist")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding", key+"a"))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestObject(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a"))
+	result := testDB.Exec(nil, utils.ToCmdLine("object", "refcount", key))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "idletime", key))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "freq", key))
+	asserts.AssertErrReply(t, result, "ERR An LFU maxmemory policy is not selected, access frequency not tracked. "+
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "help"))
+	asserts.AssertNotError(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "foo", key))
+	asserts.AssertErrReply(t, result, "ERR unknown subcommand 'foo'. Try OBJECT HELP.")
+	result = testDB.Exec(nil, utils.ToCmdLine("object", "encoding"))
+	asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'object|encoding' command")
+}
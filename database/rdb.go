@@ -1,74 +1,119 @@
 package database
 
 import (
+	"github.com/hdt3213/godis/backup"
 	"github.com/hdt3213/godis/config"
-	"github.com/hdt3213/godis/datastruct/dict"
-	List "github.com/hdt3213/godis/datastruct/list"
-	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
 	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
-	"github.com/hdt3213/rdb/core"
-	rdb "github.com/hdt3213/rdb/parser"
+	"github.com/hdt3213/godis/rdb"
+	"github.com/hdt3213/godis/redis/protocol"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
+// rdbFilename returns the file to save snapshot, use dump.rdb if not set
+func rdbFilename() string {
+	if config.Properties().RDBFilename == "" {
+		return "dump.rdb"
+	}
+	return config.Properties().RDBFilename
+}
+
 func loadRdbFile(mdb *MultiDB) {
-	rdbFile, err := os.Open(config.Properties.RDBFilename)
-	if err != nil {
-		logger.Error("open rdb file failed " + err.Error())
+	err := rdb.LoadFile(rdbFilename(), mdb.putRDBEntity)
+	if os.IsNotExist(err) && config.Properties().RDBFilename == "" {
+		// it's normal that default rdb file doesn't exist
 		return
 	}
-	defer func() {
-		_ = rdbFile.Close()
-	}()
-	decoder := rdb.NewDecoder(rdbFile)
-	err = importRDB(decoder, mdb)
 	if err != nil {
-		logger.Error("dump rdb file failed " + err.Error())
+		logger.Error("load rdb file failed " + err.Error())
 		return
 	}
 }
 
-func importRDB(dec *core.Decoder, mdb *MultiDB) error {
-	return dec.Parse(func(o rdb.RedisObject) bool {
-		db := mdb.mustSelectDB(o.GetDBIndex())
-		switch o.GetType() {
-		case rdb.StringType:
-			str := o.(*rdb.StringObject)
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: str.Value,
-			})
-		case rdb.ListType:
-			listObj := o.(*rdb.ListObject)
-			list := List.NewQuickList()
-			for _, v := range listObj.Values {
-				list.Add(v)
-			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: list,
-			})
-		case rdb.HashType:
-			hashObj := o.(*rdb.HashObject)
-			hash := dict.MakeSimple()
-			for k, v := range hashObj.Hash {
-				hash.Put(k, v)
-			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: hash,
-			})
-		case rdb.ZSetType:
-			zsetObj := o.(*rdb.ZSetObject)
-			zSet := SortedSet.Make()
-			for _, e := range zsetObj.Entries {
-				zSet.Add(e.Member, e.Score)
-			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: zSet,
-			})
-		}
-		if o.GetExpiration() != nil {
-			db.Expire(o.GetKey(), *o.GetExpiration())
+func (mdb *MultiDB) putRDBEntity(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+	mdb.LoadEntity(dbIndex, key, entity, expiration)
+	return true
+}
+
+// LoadEntity puts entity parsed from rdb into database
+func (mdb *MultiDB) LoadEntity(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) {
+	db := mdb.mustSelectDB(dbIndex)
+	db.PutEntity(key, entity)
+	if expiration != nil {
+		db.Expire(key, *expiration)
+	}
+}
+
+// rdbSource is the databases to be saved into rdb file, it reads keys under their read locks,
+// so keys aren't modified by commands while being encoded
+type rdbSource struct {
+	mdb *MultiDB
+}
+
+func (src *rdbSource) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	src.mdb.mustSelectDB(dbIndex).ForEachLocked(cb)
+}
+
+func (src *rdbSource) GetDBSize(dbIndex int) (int, int) {
+	return src.mdb.GetDBSize(dbIndex)
+}
+
+// saveRDB dumps all databases into rdb file, only one saving is allowed at the same time
+func (mdb *MultiDB) saveRDB() error {
+	defer atomic.StoreInt32(&mdb.saving, 0)
+	start := time.Now()
+	atomic.StoreInt64(&mdb.saveStart, start.UnixNano())
+	// changes during saving may not be included in snapshot, so they are still counted after saving
+	dirty := atomic.LoadInt64(&mdb.dirty)
+	err := rdb.SaveFile(rdbFilename(), &rdbSource{mdb: mdb}, len(mdb.dbSet))
+	atomic.StoreInt64(&mdb.lastSaveDuration, int64(time.Since(start)))
+	atomic.AddInt64(&mdb.saves, 1)
+	if err != nil {
+		atomic.StoreInt32(&mdb.lastSaveFailed, 1)
+		return err
+	}
+	atomic.StoreInt32(&mdb.lastSaveFailed, 0)
+	atomic.AddInt64(&mdb.dirty, -dirty)
+	atomic.StoreInt64(&mdb.lastSaveTime, time.Now().Unix())
+	if mdb.backup != nil {
+		mdb.uploadBackup(rdbFilename(), backup.KindRDB)
+	}
+	return nil
+}
+
+// SaveRDB synchronously saves snapshot of all databases into rdb file
+func SaveRDB(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("save")
+	}
+	if !atomic.CompareAndSwapInt32(&mdb.saving, 0, 1) {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	err := mdb.saveRDB()
+	if err != nil {
+		logger.Error("save rdb failed " + err.Error())
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// BGSaveRDB asynchronously saves snapshot of all databases into rdb file.
+// Keys are locked one by one while being saved, so writers are not blocked during the whole saving
+func BGSaveRDB(mdb *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("bgsave")
+	}
+	if !atomic.CompareAndSwapInt32(&mdb.saving, 0, 1) {
+		return protocol.MakeErrReply("ERR Background save already in progress")
+	}
+	go func() {
+		err := mdb.saveRDB()
+		if err != nil {
+			logger.Error("background save rdb failed " + err.Error())
 		}
-		return true
-	})
+	}()
+	return protocol.MakeStatusReply("Background saving started")
 }
@@ -4,19 +4,23 @@ import (
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLoadRDB(t *testing.T) {
 	_, b, _, _ := runtime.Caller(0)
 	projectRoot := filepath.Dir(filepath.Dir(b))
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:  false,
 		RDBFilename: filepath.Join(projectRoot, "test.rdb"), // set working directory to project root
-	}
+	})
 	conn := &connection.FakeConn{}
 	rdbDB := NewStandaloneServer()
 	result := rdbDB.Exec(conn, utils.ToCmdLine("Get", "str"))
@@ -30,11 +34,133 @@ func TestLoadRDB(t *testing.T) {
 	result = rdbDB.Exec(conn, utils.ToCmdLine("ZRange", "zset", "0", "1", "WITHSCORES"))
 	asserts.AssertMultiBulkReply(t, result, []string{"1", "1"})
 
-	config.Properties = &config.ServerProperties{
+	config.SetProperties(&config.ServerProperties{
 		AppendOnly:  false,
 		RDBFilename: filepath.Join(projectRoot, "none", "test.rdb"), // set working directory to project root
-	}
+	})
 	rdbDB = NewStandaloneServer()
 	result = rdbDB.Exec(conn, utils.ToCmdLine("Get", "str"))
 	asserts.AssertNullBulk(t, result)
 }
+
+func TestSaveRDB(t *testing.T) {
+	rdbFilename := filepath.Join(t.TempDir(), "dump.rdb")
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: rdbFilename,
+	})
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	writeDB.Exec(conn, utils.ToCmdLine("set", "str", "a", "ex", "1000"))
+	writeDB.Exec(conn, utils.ToCmdLine("rpush", "list", "1", "2"))
+	writeDB.Exec(conn, utils.ToCmdLine("select", "1"))
+	writeDB.Exec(conn, utils.ToCmdLine("hset", "hash", "f", "v"))
+	result := writeDB.Exec(conn, utils.ToCmdLine("save"))
+	asserts.AssertStatusReply(t, result, "OK")
+
+	writeDB.saving = 1
+	result = writeDB.Exec(conn, utils.ToCmdLine("bgsave"))
+	asserts.AssertErrReply(t, result, "ERR Background save already in progress")
+	writeDB.saving = 0
+	writeDB.Close()
+
+	readDB := NewStandaloneServer()
+	conn = &connection.FakeConn{}
+	result = readDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = readDB.Exec(conn, utils.ToCmdLine("ttl", "str"))
+	asserts.AssertIntReplyGreaterThan(t, result, 900)
+	result = readDB.Exec(conn, utils.ToCmdLine("lrange", "list", "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "2"})
+	readDB.Exec(conn, utils.ToCmdLine("select", "1"))
+	result = readDB.Exec(conn, utils.ToCmdLine("hget", "hash", "f"))
+	asserts.AssertBulkReply(t, result, "v")
+
+	readDB.Exec(conn, utils.ToCmdLine("set", "str", "b"))
+	result = readDB.Exec(conn, utils.ToCmdLine("bgsave"))
+	asserts.AssertStatusReply(t, result, "Background saving started")
+	for i := 0; i < 100 && atomic.LoadInt32(&readDB.saving) == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	readDB.Close()
+	bgReadDB := NewStandaloneServer()
+	conn = &connection.FakeConn{}
+	bgReadDB.Exec(conn, utils.ToCmdLine("select", "1"))
+	result = bgReadDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "b")
+	bgReadDB.Close()
+}
+
+func TestSaveStream(t *testing.T) {
+	rdbFilename := filepath.Join(t.TempDir(), "dump.rdb")
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: rdbFilename,
+	})
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	defer db.Close()
+	db.Exec(conn, utils.ToCmdLine("set", "str", "a"))
+	db.Exec(conn, utils.ToCmdLine("xadd", "stream", "1-1", "f", "v"))
+	// stream can't be encoded into rdb, saving fails rather than losing it
+	result := db.Exec(conn, utils.ToCmdLine("save"))
+	if !strings.Contains(string(result.ToBytes()), "stream") {
+		t.Errorf("expected error of key stream, actually %s", string(result.ToBytes()))
+	}
+	if atomic.LoadInt32(&db.lastSaveFailed) != 1 {
+		t.Errorf("saving should be marked failed")
+	}
+}
+
+func TestShutdownSave(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: filepath.Join(t.TempDir(), "dump.rdb"),
+	})
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	requested := false
+	writeDB.SetShutdownFunc(func() {
+		requested = true
+	})
+	writeDB.Exec(conn, utils.ToCmdLine("set", "str", "a"))
+	result := writeDB.Exec(conn, utils.ToCmdLine("shutdown", "save"))
+	if _, ok := result.(*protocol.NoReply); !ok || !requested {
+		t.Fatal("expect shutdown requested")
+	}
+	// commands before server closes database are saved
+	writeDB.Exec(conn, utils.ToCmdLine("set", "str", "b"))
+	writeDB.Close()
+
+	readDB := NewStandaloneServer()
+	result = readDB.Exec(conn, utils.ToCmdLine("get", "str"))
+	asserts.AssertBulkReply(t, result, "b")
+	readDB.Close()
+}
+
+func TestSaveInfo(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: filepath.Join(t.TempDir(), "dump.rdb"),
+	})
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	defer db.Close()
+	assertInfo := func(fields ...string) {
+		t.Helper()
+		result := db.Exec(conn, utils.ToCmdLine("info", "persistence"))
+		info := string(result.(*protocol.BulkReply).Arg)
+		for _, field := range fields {
+			if !strings.Contains(info, field+"\r\n") {
+				t.Errorf("info should contain %s, actually %s", field, info)
+			}
+		}
+	}
+	assertInfo("rdb_changes_since_last_save:0", "rdb_saves:0", "rdb_last_bgsave_time_sec:-1",
+		"rdb_current_bgsave_time_sec:-1", "aof_enabled:0", "aof_rewrites:0")
+	db.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	db.Exec(conn, utils.ToCmdLine("set", "b", "1"))
+	db.Exec(conn, utils.ToCmdLine("get", "a"))
+	db.Exec(conn, utils.ToCmdLine("del", "c"))
+	assertInfo("rdb_changes_since_last_save:2")
+	result := db.Exec(conn, utils.ToCmdLine("save"))
+	asserts.AssertStatusReply(t, result, "OK")
+	assertInfo("rdb_changes_since_last_save:0", "rdb_saves:1", "rdb_last_bgsave_time_sec:0",
+		"rdb_last_bgsave_status:ok")
+}
@@ -6,13 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/rdb"
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
-	rdb "github.com/hdt3213/rdb/parser"
 	"net"
 	"strconv"
 	"strings"
@@ -44,13 +45,35 @@ type slaveStatus struct {
 	replId       string
 	replOffset   int64
 	lastRecvTime time.Time
-	running      sync.WaitGroup
+	// closed is closed when database is closing, it stops cron
+	closed chan struct{}
+	// dbIndex is the selected db of replication stream, it is kept for partial resync after reconnection
+	dbIndex int
+	// failover means the next PSYNC is sent with FAILOVER, so that master promotes itself and this node replaces it
+	failover bool
+	// linkState is the state of connection with master, see replLinkStateNames
+	linkState int
+	// linkDownTime is when connection with master was lost, it is zero if link is up
+	linkDownTime time.Time
 }
 
+// states of connection with master
+const (
+	replLinkConnect = iota
+	replLinkConnecting
+	replLinkSync
+	replLinkConnected
+)
+
+// replLinkStateNames are states in ROLE reply
+var replLinkStateNames = []string{"connect", "connecting", "sync", "connected"}
+
 var configChangedErr = errors.New("replication config changed")
 
 func initReplStatus() *slaveStatus {
-	repl := &slaveStatus{}
+	repl := &slaveStatus{
+		closed: make(chan struct{}),
+	}
 	// start cron
 	return repl
 }
@@ -62,9 +85,16 @@ func (mdb *MultiDB) startReplCron() {
 				logger.Error("panic", err)
 			}
 		}()
-		ticker := time.Tick(time.Second)
-		for range ticker {
-			mdb.slaveCron()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mdb.slaveCron()
+				mdb.masterCron()
+			case <-mdb.replication.closed:
+				return
+			}
 		}
 	}()
 }
@@ -72,7 +102,7 @@ func (mdb *MultiDB) startReplCron() {
 func (mdb *MultiDB) execSlaveOf(c redis.Connection, args [][]byte) redis.Reply {
 	if strings.ToLower(string(args[0])) == "no" &&
 		strings.ToLower(string(args[1])) == "one" {
-		mdb.slaveOfNone()
+		mdb.promote(nil)
 		return protocol.MakeOkReply()
 	}
 	host := string(args[0])
@@ -80,15 +110,45 @@ func (mdb *MultiDB) execSlaveOf(c redis.Connection, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
+	mdb.replicaOf(host, port, false)
+	return protocol.MakeOkReply()
+}
+
+// replicaOf starts replicating from master at host:port, PSYNC is sent with FAILOVER if failover is true
+func (mdb *MultiDB) replicaOf(host string, port int, failover bool) {
 	mdb.replication.mutex.Lock()
 	atomic.StoreInt32(&mdb.role, slaveRole)
 	mdb.replication.masterHost = host
 	mdb.replication.masterPort = port
+	mdb.replication.failover = failover
 	// use buffered channel in case receiver goroutine exited before controller send stop signal
 	atomic.AddInt32(&mdb.replication.configVersion, 1)
 	mdb.replication.mutex.Unlock()
 	go mdb.setupMaster()
-	return protocol.MakeOkReply()
+}
+
+// promote stops replicating and turns slave into master, slaves except keep reconnect to continue with it
+func (mdb *MultiDB) promote(keep redis.Connection) {
+	mdb.slaveOfNone()
+	if atomic.CompareAndSwapInt32(&mdb.role, slaveRole, masterRole) {
+		// stream of this node diverges from former master since now
+		mdb.master.switchReplId(genReplId(), keep)
+	}
+}
+
+// isReplica returns whether it is replicating from a master
+func (mdb *MultiDB) isReplica() bool {
+	return atomic.LoadInt32(&mdb.role) == slaveRole
+}
+
+// MasterAddr returns address of master if it is a replica, otherwise empty string
+func (mdb *MultiDB) MasterAddr() string {
+	if atomic.LoadInt32(&mdb.role) != slaveRole {
+		return ""
+	}
+	mdb.replication.mutex.Lock()
+	defer mdb.replication.mutex.Unlock()
+	return net.JoinHostPort(mdb.replication.masterHost, strconv.Itoa(mdb.replication.masterPort))
 }
 
 func (mdb *MultiDB) slaveOfNone() {
@@ -98,6 +158,7 @@ func (mdb *MultiDB) slaveOfNone() {
 	mdb.replication.masterPort = 0
 	mdb.replication.replId = ""
 	mdb.replication.replOffset = -1
+	mdb.replication.failover = false
 	mdb.replication.stopSlaveWithMutex()
 }
 
@@ -106,10 +167,10 @@ func (mdb *MultiDB) slaveOfNone() {
 func (repl *slaveStatus) stopSlaveWithMutex() {
 	// update configVersion to stop connectWithMaster and fullSync
 	atomic.AddInt32(&repl.configVersion, 1)
-	// send cancel to receiveAOF
+	// send cancel to receiveAOF, it doesn't wait for receiveAOF which may be waiting for the mutex,
+	// receiveAOF quits without applying commands once it finds configVersion changed
 	if repl.cancel != nil {
 		repl.cancel()
-		repl.running.Wait()
 	}
 	repl.ctx = context.Background()
 	repl.cancel = nil
@@ -118,12 +179,21 @@ func (repl *slaveStatus) stopSlaveWithMutex() {
 	}
 	repl.masterConn = nil
 	repl.masterChan = nil
+	if repl.linkState == replLinkConnected || repl.linkDownTime.IsZero() {
+		repl.linkDownTime = time.Now()
+	}
+	repl.linkState = replLinkConnect
 }
 
 func (repl *slaveStatus) close() error {
 	repl.mutex.Lock()
 	defer repl.mutex.Unlock()
 	repl.stopSlaveWithMutex()
+	select {
+	case <-repl.closed:
+	default:
+		close(repl.closed)
+	}
 	return nil
 }
 
@@ -141,6 +211,7 @@ func (mdb *MultiDB) setupMaster() {
 	configVersion = mdb.replication.configVersion
 	mdb.replication.mutex.Unlock()
 	isFullReSync, err := mdb.connectWithMaster(configVersion)
+	mdb.failover.finish(err)
 	if err != nil {
 		// connect failed, abort master
 		logger.Error(err)
@@ -158,8 +229,11 @@ func (mdb *MultiDB) setupMaster() {
 	}
 	err = mdb.receiveAOF(ctx, configVersion)
 	if err != nil {
-		// full sync failed, abort
 		logger.Error(err)
+		if err != configChangedErr && ctx.Err() == nil {
+			// connection broken, try to continue replication by partial resync
+			_ = mdb.reconnectWithMaster()
+		}
 		return
 	}
 }
@@ -218,20 +292,22 @@ func (mdb *MultiDB) connectWithMaster(configVersion int32) (bool, error) {
 	}
 
 	// auth
-	if config.Properties.MasterAuth != "" {
-		authCmdLine := utils.ToCmdLine("auth", config.Properties.MasterAuth)
+	if config.Properties().MasterAuth != "" {
+		authCmdLine := utils.ToCmdLine("auth", config.Properties().MasterAuth)
 		err = sendCmdToMaster(conn, authCmdLine, masterChan)
 		if err != nil {
 			return false, err
 		}
 	}
 
-	// announce port
+	// announce port, replica in cluster announces the address known by other nodes
 	var port int
-	if config.Properties.SlaveAnnouncePort != 0 {
-		port = config.Properties.SlaveAnnouncePort
+	if config.Properties().SlaveAnnouncePort != 0 {
+		port = config.Properties().SlaveAnnouncePort
+	} else if config.Properties().ClusterAnnouncePort > 0 {
+		port = config.Properties().ClusterAnnouncePort
 	} else {
-		port = config.Properties.Port
+		port = config.Properties().Port
 	}
 	portCmdLine := utils.ToCmdLine("REPLCONF", "listening-port", strconv.Itoa(port))
 	err = sendCmdToMaster(conn, portCmdLine, masterChan)
@@ -240,8 +316,12 @@ func (mdb *MultiDB) connectWithMaster(configVersion int32) (bool, error) {
 	}
 
 	// announce ip
-	if config.Properties.SlaveAnnounceIP != "" {
-		ipCmdLine := utils.ToCmdLine("REPLCONF", "ip-address", config.Properties.SlaveAnnounceIP)
+	ip := config.Properties().SlaveAnnounceIP
+	if ip == "" {
+		ip = config.Properties().ClusterAnnounceIP
+	}
+	if ip != "" {
+		ipCmdLine := utils.ToCmdLine("REPLCONF", "ip-address", ip)
 		err = sendCmdToMaster(conn, ipCmdLine, masterChan)
 		if err != nil {
 			return false, err
@@ -249,7 +329,7 @@ func (mdb *MultiDB) connectWithMaster(configVersion int32) (bool, error) {
 	}
 
 	// announce capacity
-	capaCmdLine := utils.ToCmdLine("REPLCONF", "capa", "psync2")
+	capaCmdLine := utils.ToCmdLine("REPLCONF", "capa", "eof", "capa", "psync2")
 	err = sendCmdToMaster(conn, capaCmdLine, masterChan)
 	if err != nil {
 		return false, err
@@ -265,19 +345,28 @@ func (mdb *MultiDB) connectWithMaster(configVersion int32) (bool, error) {
 	mdb.replication.masterConn = conn
 	mdb.replication.masterChan = masterChan
 	mdb.replication.lastRecvTime = time.Now()
+	mdb.replication.linkState = replLinkConnecting
 	return mdb.psyncHandshake()
 }
 
 // psyncHandshake send `psync` to master and sync repl-id/offset with master
 // invoker should provide with replication.mutex
 func (mdb *MultiDB) psyncHandshake() (bool, error) {
+	// continue with stream of this node, which is the same as stream of former master if this node was a slave
 	replId := "?"
 	var replOffset int64 = -1
-	if mdb.replication.replId != "" {
-		replId = mdb.replication.replId
-		replOffset = mdb.replication.replOffset
+	streamId, streamOffset, ok := mdb.master.streamPosition()
+	if ok {
+		// like redis, request the offset of the next byte wanted
+		replId = streamId
+		replOffset = streamOffset + 1
 	}
 	psyncCmdLine := utils.ToCmdLine("psync", replId, strconv.FormatInt(replOffset, 10))
+	if mdb.replication.failover {
+		// only the first PSYNC asks master to be demoted
+		psyncCmdLine = append(psyncCmdLine, []byte("FAILOVER"))
+		mdb.replication.failover = false
+	}
 	psyncReq := protocol.MakeMultiBulkReply(psyncCmdLine)
 	_, err := mdb.replication.masterConn.Write(psyncReq.ToBytes())
 	if err != nil {
@@ -292,20 +381,27 @@ func (mdb *MultiDB) psyncHandshake() (bool, error) {
 		return false, errors.New("illegal payload header not a status reply: " + string(psyncPayload.Data.ToBytes()))
 	}
 	headers := strings.Split(psyncHeader.Status, " ")
-	if len(headers) != 3 && len(headers) != 2 {
+	if len(headers) > 3 {
 		return false, errors.New("illegal payload header: " + psyncHeader.Status)
 	}
 
 	logger.Info("receive psync header from master")
 	var isFullReSync bool
-	if headers[0] == "FULLRESYNC" {
+	if headers[0] == "FULLRESYNC" && len(headers) == 3 {
 		logger.Info("full re-sync with master")
 		mdb.replication.replId = headers[1]
 		mdb.replication.replOffset, err = strconv.ParseInt(headers[2], 10, 64)
 		isFullReSync = true
+		mdb.replication.linkState = replLinkSync
 	} else if headers[0] == "CONTINUE" {
 		logger.Info("continue partial sync")
-		mdb.replication.replId = headers[1]
+		mdb.replication.replId = streamId
+		mdb.replication.replOffset = streamOffset
+		if len(headers) > 1 && headers[1] != streamId {
+			// master has been promoted from slave
+			mdb.replication.replId = headers[1]
+			mdb.master.switchReplId(headers[1], nil)
+		}
 		isFullReSync = false
 	} else {
 		return false, errors.New("illegal psync resp: " + psyncHeader.Status)
@@ -320,7 +416,14 @@ func (mdb *MultiDB) psyncHandshake() (bool, error) {
 
 // loadMasterRDB downloads rdb after handshake has been done
 func (mdb *MultiDB) loadMasterRDB(configVersion int32) error {
-	rdbPayload := <-mdb.replication.masterChan
+	mdb.replication.mutex.Lock()
+	masterChan := mdb.replication.masterChan
+	mdb.replication.mutex.Unlock()
+	if masterChan == nil {
+		// stopped during handshake
+		return configChangedErr
+	}
+	rdbPayload := <-masterChan
 	if rdbPayload.Err != nil {
 		return errors.New("read response failed: " + rdbPayload.Err.Error())
 	}
@@ -330,9 +433,30 @@ func (mdb *MultiDB) loadMasterRDB(configVersion int32) error {
 	}
 
 	logger.Info(fmt.Sprintf("receive %d bytes of rdb from master", len(rdbReply.Arg)))
-	rdbDec := rdb.NewDecoder(bytes.NewReader(rdbReply.Arg))
-	rdbHolder := MakeBasicMultiDB()
-	err := importRDB(rdbDec, rdbHolder)
+	if err := rdb.VerifyChecksum(bytes.NewReader(rdbReply.Arg), int64(len(rdbReply.Arg)), config.Properties().RDBChecksum); err != nil {
+		return errors.New("illegal rdb from master: " + err.Error())
+	}
+	// loaded databases serve clients of replica, so they must be concurrent safe rather than basic ones.
+	// They are created only for databases having keys, since a concurrent database is expensive to make
+	loaded := make([]*DB, len(mdb.dbSet))
+	streamDB := 0
+	err := rdb.LoadWithAux(bytes.NewReader(rdbReply.Arg), func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+		if dbIndex < 0 || dbIndex >= len(loaded) {
+			return true
+		}
+		if loaded[dbIndex] == nil {
+			loaded[dbIndex] = makeDB()
+		}
+		loaded[dbIndex].PutEntity(key, entity)
+		if expiration != nil {
+			loaded[dbIndex].Expire(key, *expiration)
+		}
+		return true
+	}, func(key, value string) {
+		if key == auxReplStreamDB {
+			streamDB, _ = strconv.Atoi(value)
+		}
+	})
 	if err != nil {
 		return errors.New("dump rdb failed: " + err.Error())
 	}
@@ -343,23 +467,41 @@ func (mdb *MultiDB) loadMasterRDB(configVersion int32) error {
 		// replication conf changed during connecting and waiting mutex
 		return configChangedErr
 	}
-	for i, h := range rdbHolder.dbSet {
-		newDB := h.Load().(*DB)
+	for i, newDB := range loaded {
+		oldDB := mdb.mustSelectDB(i)
+		if newDB == nil {
+			if oldDB.data.Len() == 0 {
+				continue
+			}
+			newDB = makeDB()
+		}
 		mdb.loadDB(i, newDB)
+		freeDB(oldDB, true)
 	}
+	mdb.replication.dbIndex = streamDB
+	mdb.master.resetStream(mdb.replication.replId, mdb.replication.replOffset)
 
 	// fixme: update aof file
 	return nil
 }
 
 func (mdb *MultiDB) receiveAOF(ctx context.Context, configVersion int32) error {
+	mdb.replication.mutex.Lock()
+	if mdb.replication.configVersion != configVersion {
+		mdb.replication.mutex.Unlock()
+		return configChangedErr
+	}
+	// connection may be reset by stopSlaveWithMutex while receiving
+	masterChan := mdb.replication.masterChan
 	conn := connection.NewConn(mdb.replication.masterConn)
 	conn.SetRole(connection.ReplicationRecvCli)
-	mdb.replication.running.Add(1)
-	defer mdb.replication.running.Done()
+	conn.SelectDB(mdb.replication.dbIndex)
+	mdb.replication.linkState = replLinkConnected
+	mdb.replication.linkDownTime = time.Time{}
+	mdb.replication.mutex.Unlock()
 	for {
 		select {
-		case payload, open := <-mdb.replication.masterChan:
+		case payload, open := <-masterChan:
 			if !open {
 				return errors.New("master channel unexpected close")
 			}
@@ -373,11 +515,25 @@ func (mdb *MultiDB) receiveAOF(ctx context.Context, configVersion int32) error {
 			mdb.replication.mutex.Lock()
 			if mdb.replication.configVersion != configVersion {
 				// replication conf changed during connecting and waiting mutex
+				mdb.replication.mutex.Unlock()
 				return configChangedErr
 			}
-			mdb.Exec(conn, cmdLine.Args)
-			n := len(cmdLine.ToBytes()) // todo: directly get size from socket
+			getAck := isGetAck(cmdLine.Args)
+			if !getAck {
+				mdb.Exec(conn, cmdLine.Args)
+				mdb.replication.dbIndex = conn.GetDBIndex()
+			}
+			raw := cmdLine.ToBytes() // todo: directly get raw bytes from socket
+			n := len(raw)
 			mdb.replication.replOffset += int64(n)
+			mdb.master.forward(raw)
+			if getAck {
+				// like redis, offset in ack includes the GETACK command
+				err := mdb.replication.sendAck2Master()
+				if err != nil {
+					logger.Error("send failed " + err.Error())
+				}
+			}
 			mdb.replication.lastRecvTime = time.Now()
 			logger.Info(fmt.Sprintf("receive %d bytes from master, current offset %d, %s",
 				n, mdb.replication.replOffset, strconv.Quote(string(cmdLine.ToBytes()))))
@@ -390,16 +546,20 @@ func (mdb *MultiDB) receiveAOF(ctx context.Context, configVersion int32) error {
 
 func (mdb *MultiDB) slaveCron() {
 	repl := mdb.replication
+	// connection and receiving time are updated by replication goroutine
+	repl.mutex.Lock()
 	if repl.masterConn == nil {
+		repl.mutex.Unlock()
 		return
 	}
 
 	replTimeout := 60 * time.Second
-	if config.Properties.ReplTimeout != 0 {
-		replTimeout = time.Duration(config.Properties.ReplTimeout) * time.Second
+	if config.Properties().ReplTimeout != 0 {
+		replTimeout = time.Duration(config.Properties().ReplTimeout) * time.Second
 	}
 	minLastRecvTime := time.Now().Add(-replTimeout)
 	if repl.lastRecvTime.Before(minLastRecvTime) {
+		repl.mutex.Unlock()
 		// reconnect with master
 		err := mdb.reconnectWithMaster()
 		if err != nil {
@@ -409,11 +569,19 @@ func (mdb *MultiDB) slaveCron() {
 	}
 	// send ack to master
 	err := repl.sendAck2Master()
+	repl.mutex.Unlock()
 	if err != nil {
 		logger.Error("send failed " + err.Error())
 	}
 }
 
+// isGetAck returns whether the command is REPLCONF GETACK sent by master to request ack
+func isGetAck(cmdLine CmdLine) bool {
+	return len(cmdLine) >= 2 &&
+		strings.ToLower(string(cmdLine[0])) == "replconf" &&
+		strings.ToLower(string(cmdLine[1])) == "getack"
+}
+
 // Send a REPLCONF ACK command to the master to inform it about the current processed offset
 func (repl *slaveStatus) sendAck2Master() error {
 	psyncCmdLine := utils.ToCmdLine("REPLCONF", "ACK",
@@ -428,6 +596,12 @@ func (mdb *MultiDB) reconnectWithMaster() error {
 	logger.Info("reconnecting with master")
 	mdb.replication.mutex.Lock()
 	defer mdb.replication.mutex.Unlock()
+	select {
+	case <-mdb.replication.closed:
+		// server is closing, don't reconnect
+		return nil
+	default:
+	}
 	mdb.replication.stopSlaveWithMutex()
 	go mdb.setupMaster()
 	return nil
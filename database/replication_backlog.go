@@ -0,0 +1,51 @@
+package database
+
+// replBacklog keeps the latest bytes of replication stream in a circular buffer,
+// so slaves reconnecting within it could continue replication without full sync
+type replBacklog struct {
+	buf []byte
+	// idx is the position in buf where the next byte will be written
+	idx int
+	// histLen is the number of valid bytes in buf, it never exceeds len(buf)
+	histLen int
+}
+
+func makeReplBacklog(size int) *replBacklog {
+	return &replBacklog{
+		buf: make([]byte, size),
+	}
+}
+
+// write appends data to backlog, the oldest bytes are overwritten once it is full
+func (b *replBacklog) write(data []byte) {
+	size := len(b.buf)
+	if len(data) >= size {
+		// only the tail of data remains
+		copy(b.buf, data[len(data)-size:])
+		b.idx = 0
+		b.histLen = size
+		return
+	}
+	n := copy(b.buf[b.idx:], data)
+	copy(b.buf, data[n:])
+	b.idx = (b.idx + len(data)) % size
+	b.histLen += len(data)
+	if b.histLen > size {
+		b.histLen = size
+	}
+}
+
+// tail returns a copy of the latest n bytes, n should not be greater than histLen
+func (b *replBacklog) tail(n int) []byte {
+	result := make([]byte, n)
+	start := b.idx - n
+	if start < 0 {
+		// the beginning wraps around to the end of buf
+		start += len(b.buf)
+		m := copy(result, b.buf[start:])
+		copy(result[m:], b.buf[:b.idx])
+		return result
+	}
+	copy(result, b.buf[start:b.idx])
+	return result
+}
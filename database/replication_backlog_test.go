@@ -0,0 +1,31 @@
+package database
+
+import "testing"
+
+func TestReplBacklog(t *testing.T) {
+	backlog := makeReplBacklog(8)
+	backlog.write([]byte("abc"))
+	if string(backlog.tail(3)) != "abc" || backlog.histLen != 3 {
+		t.Errorf("wrong backlog: %s", backlog.tail(backlog.histLen))
+	}
+	// wraps around
+	backlog.write([]byte("defghij"))
+	if backlog.histLen != 8 {
+		t.Errorf("expected histLen 8, actually %d", backlog.histLen)
+	}
+	if tail := string(backlog.tail(8)); tail != "cdefghij" {
+		t.Errorf("expected cdefghij, actually %s", tail)
+	}
+	if tail := string(backlog.tail(2)); tail != "ij" {
+		t.Errorf("expected ij, actually %s", tail)
+	}
+	// data larger than backlog
+	backlog.write([]byte("0123456789"))
+	if tail := string(backlog.tail(8)); tail != "23456789" {
+		t.Errorf("expected 23456789, actually %s", tail)
+	}
+	backlog.write([]byte("x"))
+	if tail := string(backlog.tail(8)); tail != "3456789x" {
+		t.Errorf("expected 3456789x, actually %s", tail)
+	}
+}
@@ -0,0 +1,913 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/rdb"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaBufferLimit is the max size of commands waiting to be sent to a slave, slave exceeding it is disconnected
+	replicaBufferLimit = 256 << 20
+	// replIdLen is the length of replication id, the same as redis
+	replIdLen = 40
+	// defaultBacklogSize is used if repl-backlog-size is not set
+	defaultBacklogSize = 1 << 20
+	// auxReplStreamDB is the aux field of rdb sent by full sync, it is the selected db of the following stream
+	auxReplStreamDB = "repl-stream-db"
+)
+
+// states of replica
+const (
+	// replicaStateHandshake means the slave has sent REPLCONF but not PSYNC
+	replicaStateHandshake = iota
+	// replicaStateSync means rdb is being transferred, and commands are buffered until it finished
+	replicaStateSync
+	replicaStateOnline
+)
+
+var replicaStateNames = []string{"handshake", "wait_bgsave", "online"}
+
+// replica is a slave connected to this master
+type replica struct {
+	conn redis.Connection
+	// listeningPort and ipAddress are announced by slave with REPLCONF, ipAddress is empty if not announced
+	listeningPort int
+	ipAddress     string
+	// capaEOF means slave could receive rdb delimited by EOF mark, which is required by diskless sync
+	capaEOF bool
+	state   int32
+	// ackOffset and ackTime are updated by REPLCONF ACK, ackTime is unix nano
+	ackOffset int64
+	ackTime   int64
+
+	// mu protects buffer, commands are buffered until sent by sending goroutine
+	mu        sync.Mutex
+	buffer    []byte
+	notify    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// masterStatus holds replication stream sent to slaves
+type masterStatus struct {
+	// mu keeps commands in the same order for all slaves
+	mu     sync.Mutex
+	replId string
+	// offset is the number of bytes of replication stream since replId generated
+	offset int64
+	// replId2 is the replication id before this node was promoted from slave, slaves of the former master
+	// could continue with it until secondOffset, which starts from 1 like offset requested by PSYNC
+	replId2      string
+	secondOffset int64
+	// dbIndex is the selected db of replication stream, -1 forces SELECT before the next command
+	dbIndex int
+	// replicas contains connections which have sent REPLCONF or PSYNC
+	replicas map[redis.Connection]*replica
+	// syncing is the number of replicas receiving commands
+	syncing int32
+	// backlog keeps recent replication stream for partial resync, it is created when the first slave syncs.
+	// backlogActive is 1 once backlog created, propagation skips locking if it is 0
+	backlog       *replBacklog
+	backlogActive int32
+	lastPing      time.Time
+	// waiters are clients blocked by WAIT, they are woken up by REPLCONF ACK
+	waiters map[*waiter]struct{}
+
+	// counters of full sync and partial resync for INFO stats
+	syncFull       int64
+	syncPartialOk  int64
+	syncPartialErr int64
+}
+
+func initMasterStatus() *masterStatus {
+	return &masterStatus{
+		replId:       genReplId(),
+		secondOffset: -1,
+		dbIndex:      -1,
+		replicas:     make(map[redis.Connection]*replica),
+		lastPing:     time.Now(),
+		waiters:      make(map[*waiter]struct{}),
+	}
+}
+
+func genReplId() string {
+	raw := make([]byte, replIdLen/2)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// getReplica returns replica of connection, it creates one if not exist
+func (master *masterStatus) getReplica(c redis.Connection) *replica {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	r, ok := master.replicas[c]
+	if !ok {
+		r = &replica{
+			conn:    c,
+			state:   replicaStateHandshake,
+			ackTime: time.Now().UnixNano(),
+			notify:  make(chan struct{}, 1),
+			closed:  make(chan struct{}),
+		}
+		master.replicas[c] = r
+	}
+	return r
+}
+
+// removeReplica stops sending commands to a disconnected slave
+func (master *masterStatus) removeReplica(c redis.Connection) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	r, ok := master.replicas[c]
+	if !ok {
+		return
+	}
+	delete(master.replicas, c)
+	if atomic.LoadInt32(&r.state) != replicaStateHandshake {
+		atomic.AddInt32(&master.syncing, -1)
+	}
+	r.close()
+}
+
+// dropReplicas disconnects all slaves and starts a new replication stream
+func (master *masterStatus) dropReplicas() {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.dropReplicasWithMutex()
+	master.replId = genReplId()
+	master.offset = 0
+	master.backlog = nil
+	atomic.StoreInt32(&master.backlogActive, 0)
+}
+
+// dropReplicasWithMutex disconnects all slaves, invoker should hold mu
+func (master *masterStatus) dropReplicasWithMutex() {
+	for c, r := range master.replicas {
+		delete(master.replicas, c)
+		r.close()
+	}
+	atomic.StoreInt32(&master.syncing, 0)
+	master.dbIndex = -1
+	master.replId2 = ""
+	master.secondOffset = -1
+}
+
+// resetStream follows the replication stream of master after full sync, so sub-slaves receive the same stream
+// and could continue with any node of the chain. Sub-slaves are disconnected since dataset has been replaced
+func (master *masterStatus) resetStream(replId string, offset int64) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.dropReplicasWithMutex()
+	master.replId = replId
+	master.offset = offset
+	master.backlog = nil
+	master.createBacklog()
+}
+
+// switchReplId starts a new replication id while keeping backlog, slaves could continue with the former id
+// until the current offset. It is invoked after promoted, or master of this node has been promoted.
+// Slaves except keep are disconnected, keep is the slave in handshake which requested promotion by PSYNC FAILOVER
+func (master *masterStatus) switchReplId(replId string, keep redis.Connection) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.replId2 = master.replId
+	master.secondOffset = master.offset + 1
+	master.replId = replId
+	// sub-slaves reconnect with the new id
+	for c, r := range master.replicas {
+		if c == keep {
+			continue
+		}
+		if atomic.LoadInt32(&r.state) != replicaStateHandshake {
+			atomic.AddInt32(&master.syncing, -1)
+		}
+		delete(master.replicas, c)
+		r.close()
+	}
+}
+
+// streamPosition returns replication id and offset of stream, ok is false if there is no backlog to continue from
+func (master *masterStatus) streamPosition() (replId string, offset int64, ok bool) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.replId, master.offset, master.backlog != nil
+}
+
+// forward appends replication stream received from master, so sub-slaves receive exactly the same stream
+func (master *masterStatus) forward(data []byte) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.feed(data)
+}
+
+// createBacklog starts recording replication stream if it hasn't, invoker should hold mu
+func (master *masterStatus) createBacklog() {
+	if master.backlog != nil {
+		return
+	}
+	size := defaultBacklogSize
+	if config.Properties().ReplBacklogSize > 0 {
+		size = config.Properties().ReplBacklogSize
+	}
+	master.backlog = makeReplBacklog(size)
+	atomic.StoreInt32(&master.backlogActive, 1)
+}
+
+// propagate sends write command to slaves, invoker should hold snapshotGate,
+// so commands before and after full sync snapshot are divided by its cut
+func (master *masterStatus) propagate(dbIndex int, cmdLine CmdLine) {
+	if atomic.LoadInt32(&master.backlogActive) == 0 {
+		return
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	var data []byte
+	if dbIndex != master.dbIndex {
+		data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes()
+		master.dbIndex = dbIndex
+	}
+	data = append(data, protocol.MakeMultiBulkReply(cmdLine).ToBytes()...)
+	master.feed(data)
+}
+
+// feed appends data to replication stream, invoker should hold mu
+func (master *masterStatus) feed(data []byte) {
+	master.offset += int64(len(data))
+	if master.backlog != nil {
+		master.backlog.write(data)
+	}
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) != replicaStateHandshake {
+			r.append(data)
+		}
+	}
+}
+
+func (r *replica) append(data []byte) {
+	r.mu.Lock()
+	if len(r.buffer)+len(data) > replicaBufferLimit {
+		r.mu.Unlock()
+		logger.Warn("replica buffer exceeds limit, disconnect slave")
+		r.close()
+		return
+	}
+	r.buffer = append(r.buffer, data...)
+	r.mu.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// send writes buffered commands to slave until disconnected
+func (r *replica) send() {
+	for {
+		select {
+		case <-r.notify:
+		case <-r.closed:
+			return
+		}
+		r.mu.Lock()
+		data := r.buffer
+		r.buffer = nil
+		r.mu.Unlock()
+		err := r.conn.Write(data)
+		if err != nil {
+			logger.Warn("send to slave failed: " + err.Error())
+			r.close()
+			return
+		}
+	}
+}
+
+func (r *replica) close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		if closer, ok := r.conn.(io.Closer); ok {
+			// closing waits for replies being sent, it shouldn't block propagation
+			go func() {
+				_ = closer.Close()
+			}()
+		}
+	})
+}
+
+// addr returns announced address of slave
+func (r *replica) addr() (string, int) {
+	ip := r.ipAddress
+	if ip == "" {
+		if conn, ok := r.conn.(interface{ RemoteAddr() net.Addr }); ok {
+			ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		}
+	}
+	return ip, r.listeningPort
+}
+
+// execReplConf handles REPLCONF sent by slaves
+// usage: REPLCONF [listening-port <port>] [ip-address <ip>] [capa <capability>] [ack <offset>]
+func (mdb *MultiDB) execReplConf(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	r := mdb.master.getReplica(c)
+	for i := 0; i < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			mdb.master.mu.Lock() // announced address is read by INFO
+			r.listeningPort = port
+			mdb.master.mu.Unlock()
+		case "ip-address":
+			mdb.master.mu.Lock()
+			r.ipAddress = value
+			mdb.master.mu.Unlock()
+		case "capa":
+			if strings.ToLower(value) == "eof" {
+				r.capaEOF = true
+			}
+		case "ack":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return &protocol.NoReply{}
+			}
+			atomic.StoreInt64(&r.ackOffset, offset)
+			atomic.StoreInt64(&r.ackTime, time.Now().UnixNano())
+			mdb.master.notifyWaiters()
+			// slave doesn't read reply of ACK
+			return &protocol.NoReply{}
+		default:
+			return protocol.MakeErrReply("ERR Unrecognized REPLCONF option: " + string(args[i]))
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+// execWait blocks until all write commands before it are acknowledged by numreplicas slaves or timeout in milliseconds,
+// 0 timeout means blocking forever. It returns the number of slaves acknowledged.
+// usage: WAIT numreplicas timeout
+func (mdb *MultiDB) execWait(args [][]byte) redis.Reply {
+	if atomic.LoadInt32(&mdb.role) == slaveRole {
+		return protocol.MakeErrReply("ERR WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return protocol.MakeErrReply("ERR timeout is negative")
+	}
+	master := mdb.master
+	w := makeWaiter()
+	// register before counting, so acks after counting won't be missed
+	offset := master.addWaiter(w)
+	defer master.removeWaiter(w)
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		// timewheel ticks every second, which is too coarse for timeout in milliseconds
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	getAckSent := false
+	for {
+		acked := master.countAcked(offset)
+		if acked >= numReplicas {
+			return protocol.MakeIntReply(int64(acked))
+		}
+		if !getAckSent {
+			// ask slaves to ack immediately instead of waiting for their cron
+			master.getAck()
+			getAckSent = true
+		}
+		select {
+		case <-w.wake:
+		case <-timeoutCh:
+			return protocol.MakeIntReply(int64(master.countAcked(offset)))
+		}
+	}
+}
+
+// addWaiter registers client blocked by WAIT, and returns offset of replication stream it waits for
+func (master *masterStatus) addWaiter(w *waiter) int64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.waiters[w] = struct{}{}
+	return master.offset
+}
+
+func (master *masterStatus) removeWaiter(w *waiter) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	delete(master.waiters, w)
+}
+
+func (master *masterStatus) notifyWaiters() {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	for w := range master.waiters {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitAllAcked blocks until all online slaves acknowledged the current offset or timeout,
+// it returns false on timeout
+func (master *masterStatus) waitAllAcked(timeout time.Duration) bool {
+	if atomic.LoadInt32(&master.syncing) == 0 {
+		return true
+	}
+	w := makeWaiter()
+	offset := master.addWaiter(w)
+	defer master.removeWaiter(w)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	master.getAck()
+	for {
+		if master.countAcked(offset) >= master.countOnline() {
+			return true
+		}
+		select {
+		case <-w.wake:
+		case <-timer.C:
+			logger.Warn("shutdown timeout, some slaves haven't acknowledged the latest writes")
+			return false
+		}
+	}
+}
+
+// countOnline returns the number of online slaves
+func (master *masterStatus) countOnline() int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	count := 0
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) == replicaStateOnline {
+			count++
+		}
+	}
+	return count
+}
+
+// countAcked returns the number of online slaves which have acknowledged offset
+func (master *masterStatus) countAcked(offset int64) int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	count := 0
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) == replicaStateOnline && atomic.LoadInt64(&r.ackOffset) >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// goodReplicas returns the number of online slaves whose latest ack is within maxLag
+func (master *masterStatus) goodReplicas(maxLag time.Duration) int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.goodReplicasWithMutex(maxLag)
+}
+
+// goodReplicasWithMutex is the same as goodReplicas, invoker should hold mu
+func (master *masterStatus) goodReplicasWithMutex(maxLag time.Duration) int {
+	minAckTime := time.Now().Add(-maxLag).UnixNano()
+	count := 0
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) == replicaStateOnline && atomic.LoadInt64(&r.ackTime) >= minAckTime {
+			count++
+		}
+	}
+	return count
+}
+
+// minReplicasMaxLag returns min-replicas-max-lag, it is 10 seconds if not set
+func minReplicasMaxLag() time.Duration {
+	if config.Properties().MinReplicasMaxLag > 0 {
+		return time.Duration(config.Properties().MinReplicasMaxLag) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// checkGoodReplicas returns NOREPLICAS error if there are fewer good slaves than min-replicas-to-write
+func (mdb *MultiDB) checkGoodReplicas() protocol.ErrorReply {
+	if config.Properties().MinReplicasToWrite <= 0 {
+		return nil
+	}
+	if mdb.master.goodReplicas(minReplicasMaxLag()) < config.Properties().MinReplicasToWrite {
+		return protocol.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+	}
+	return nil
+}
+
+// caughtUpReplica returns announced address of an online slave which has acknowledged the whole stream,
+// only the slave announced as targetHost:targetPort is considered if targetPort is not 0
+func (master *masterStatus) caughtUpReplica(targetHost string, targetPort int) (string, int, bool) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) != replicaStateOnline || atomic.LoadInt64(&r.ackOffset) < master.offset {
+			continue
+		}
+		ip, port := r.addr()
+		if targetPort == 0 || (ip == targetHost && port == targetPort) {
+			return ip, port, true
+		}
+	}
+	return "", 0, false
+}
+
+// hasReplica returns whether there is an online slave announced as host:port, or any online slave if port is 0
+func (master *masterStatus) hasReplica(host string, port int) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) != replicaStateOnline {
+			continue
+		}
+		ip, p := r.addr()
+		if port == 0 || (ip == host && p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAck sends REPLCONF GETACK to slaves, so they reply REPLCONF ACK immediately
+func (master *masterStatus) getAck() {
+	if atomic.LoadInt32(&master.syncing) == 0 {
+		return
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.feed(protocol.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes())
+}
+
+// execPSync continues replication stream from the offset requested by slave if it is still in backlog,
+// otherwise it sends rdb of all databases to slave, then starts sending write commands to it.
+// SYNC is the same as PSYNC without FULLRESYNC header, and it always does full sync.
+// PSYNC with FAILOVER is sent by master demoted by FAILOVER, this slave is promoted before syncing if replication id matches.
+// usage: PSYNC replicationid offset [FAILOVER]
+func (mdb *MultiDB) execPSync(c redis.Connection, psync bool, args [][]byte) redis.Reply {
+	r := mdb.master.getReplica(c)
+	if atomic.LoadInt32(&r.state) != replicaStateHandshake {
+		return protocol.MakeErrReply("ERR replica is already syncing")
+	}
+	if len(args) == 3 {
+		if strings.ToLower(string(args[2])) != "failover" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		if replId, _, _ := mdb.master.streamPosition(); string(args[0]) != replId {
+			return protocol.MakeErrReply("ERR PSYNC FAILOVER replid must match my replid.")
+		}
+		logger.Info("promoted by failover request from master")
+		mdb.promote(c)
+	}
+	if psync && string(args[0]) != "?" {
+		offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err == nil && mdb.master.partialSync(r, string(args[0]), offset) {
+			return &protocol.NoReply{}
+		}
+		atomic.AddInt64(&mdb.master.syncPartialErr, 1)
+	}
+	atomic.AddInt64(&mdb.master.syncFull, 1)
+	err := mdb.fullSync(r, psync)
+	if err != nil {
+		logger.Error("full sync failed: " + err.Error())
+		mdb.master.removeReplica(c)
+		return protocol.MakeErrReply("ERR full sync failed: " + err.Error())
+	}
+	return &protocol.NoReply{}
+}
+
+// partialSync sends +CONTINUE and commands in backlog since offset to slave, then starts sending write commands to it.
+// Like redis, offset is the offset of the next byte wanted by slave, which starts from 1.
+// It returns false if replication id mismatches or the offset isn't in backlog.
+func (master *masterStatus) partialSync(r *replica, replId string, offset int64) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.backlog == nil {
+		return false
+	}
+	if replId != master.replId && (replId != master.replId2 || offset > master.secondOffset) {
+		return false
+	}
+	start := offset - 1
+	if start < master.offset-int64(master.backlog.histLen) || start > master.offset {
+		return false
+	}
+	data := []byte("+CONTINUE " + master.replId + "\r\n")
+	data = append(data, master.backlog.tail(int(master.offset-start))...)
+	atomic.StoreInt64(&r.ackTime, time.Now().UnixNano())
+	atomic.StoreInt32(&r.state, replicaStateOnline)
+	atomic.AddInt32(&master.syncing, 1)
+	atomic.AddInt64(&master.syncPartialOk, 1)
+	r.append(data)
+	go r.send()
+	return true
+}
+
+// fullSync transfers point-in-time snapshot of databases to slave,
+// commands after the snapshot are buffered and sent after transferring finished
+func (mdb *MultiDB) fullSync(r *replica, psync bool) error {
+	var replId string
+	var offset int64
+	var streamDB int
+	holder, err := mdb.takeSyncSnapshot(func() {
+		mdb.master.mu.Lock()
+		defer mdb.master.mu.Unlock()
+		mdb.master.createBacklog()
+		replId, offset = mdb.master.replId, mdb.master.offset
+		if atomic.LoadInt32(&mdb.role) == slaveRole {
+			// stream forwarded from master can't be changed, the selected db is sent to slave by rdb
+			streamDB = mdb.replication.dbIndex
+		} else {
+			// slave starts from db 0 after loading rdb, it will be changed by the next command
+			mdb.master.dbIndex = -1
+		}
+		atomic.StoreInt32(&r.state, replicaStateSync)
+		atomic.AddInt32(&mdb.master.syncing, 1)
+	})
+	if err != nil {
+		return err
+	}
+	w := &connWriter{conn: r.conn}
+	if psync {
+		_, err = w.Write([]byte("+FULLRESYNC " + replId + " " + strconv.FormatInt(offset, 10) + "\r\n"))
+		if err != nil {
+			return err
+		}
+	}
+	diskless := config.Properties().ReplDisklessSync && r.capaEOF
+	aux := map[string]string{auxReplStreamDB: strconv.Itoa(streamDB)}
+	err = rdb.Transfer(w, holder, len(holder.dbSet), diskless, filepath.Dir(rdbFilename()), aux)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&r.ackTime, time.Now().UnixNano())
+	atomic.StoreInt32(&r.state, replicaStateOnline)
+	go r.send()
+	return nil
+}
+
+// takeSyncSnapshot copies a point-in-time view of all databases, cut is invoked at that point.
+// Snapshot only encodes original values of modified keys, so they are replayed into a new MultiDB to be
+// transferred as rdb, while the dataset is not blocked during copying.
+func (mdb *MultiDB) takeSyncSnapshot(cut func()) (*MultiDB, error) {
+	var snapshot database.Snapshot
+	var err error
+	for {
+		// commands from master are executed and forwarded under replication mutex,
+		// so no command is between being executed and forwarded at the cut
+		mdb.replication.mutex.Lock()
+		snapshot, err = mdb.TakeSnapshot(aof.EncodeEntity, func() error {
+			cut()
+			return nil
+		})
+		mdb.replication.mutex.Unlock()
+		if err != errSnapshotInProgress {
+			break
+		}
+		// wait for aof rewriting or another full sync
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	holder := MakeBasicMultiDB()
+	for i := range holder.dbSet {
+		db := holder.mustSelectDB(i)
+		snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			replayCommands(db, aof.EncodeEntity(key, entity, expiration))
+			return true
+		})
+	}
+	for i, data := range snapshot.Release() {
+		replayCommands(holder.mustSelectDB(i), data)
+	}
+	return holder, nil
+}
+
+// replayCommands executes encoded commands on db which isn't accessed by others
+func replayCommands(db *DB, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	replies, err := parser.ParseBytes(data)
+	if err != nil {
+		logger.Error("parse snapshot failed: " + err.Error())
+		return
+	}
+	for _, reply := range replies {
+		if cmdLine, ok := reply.(*protocol.MultiBulkReply); ok {
+			db.execWithLock(cmdLine.Args)
+		}
+	}
+}
+
+// connWriter writes rdb to slave through redis.Connection
+type connWriter struct {
+	conn redis.Connection
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	err := w.conn.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// masterCron pings slaves, so they won't time out while there is no write, and disconnects timed out slaves
+func (mdb *MultiDB) masterCron() {
+	master := mdb.master
+	if atomic.LoadInt32(&master.syncing) == 0 {
+		return
+	}
+	pingPeriod := 10 * time.Second
+	if config.Properties().ReplPingReplicaPeriod > 0 {
+		pingPeriod = time.Duration(config.Properties().ReplPingReplicaPeriod) * time.Second
+	}
+	replTimeout := 60 * time.Second
+	if config.Properties().ReplTimeout != 0 {
+		replTimeout = time.Duration(config.Properties().ReplTimeout) * time.Second
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	// slave forwards pings from its master instead
+	if atomic.LoadInt32(&mdb.role) == masterRole && time.Since(master.lastPing) >= pingPeriod {
+		master.feed(protocol.MakeMultiBulkReply(utils.ToCmdLine("PING")).ToBytes())
+		master.lastPing = time.Now()
+	}
+	minAckTime := time.Now().Add(-replTimeout).UnixNano()
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) == replicaStateOnline && atomic.LoadInt64(&r.ackTime) < minAckTime {
+			ip, port := r.addr()
+			logger.Warn("disconnect timed out slave " + ip + ":" + strconv.Itoa(port))
+			r.close()
+		}
+	}
+}
+
+// replicationInfo generates fields of INFO replication
+func replicationInfo(mdb *MultiDB) [][2]string {
+	var fields [][2]string
+	if atomic.LoadInt32(&mdb.role) == slaveRole {
+		repl := mdb.replication
+		repl.mutex.Lock()
+		linkStatus := "down"
+		if repl.linkState == replLinkConnected {
+			linkStatus = "up"
+		}
+		syncInProgress := "0"
+		if repl.linkState == replLinkSync {
+			syncInProgress = "1"
+		}
+		readOnly := "0"
+		if config.Properties().ReplicaReadOnly {
+			readOnly = "1"
+		}
+		lastIO := "-1"
+		if repl.masterConn != nil {
+			lastIO = strconv.FormatInt(int64(time.Since(repl.lastRecvTime)/time.Second), 10)
+		}
+		fields = append(fields,
+			[2]string{"role", "slave"},
+			[2]string{"master_host", repl.masterHost},
+			[2]string{"master_port", strconv.Itoa(repl.masterPort)},
+			[2]string{"master_link_status", linkStatus},
+			[2]string{"master_last_io_seconds_ago", lastIO},
+			[2]string{"master_sync_in_progress", syncInProgress},
+			[2]string{"slave_repl_offset", strconv.FormatInt(repl.replOffset, 10)},
+			[2]string{"slave_read_only", readOnly},
+		)
+		if repl.linkState != replLinkConnected {
+			fields = append(fields, [2]string{"master_link_down_since_seconds",
+				strconv.FormatInt(int64(time.Since(repl.linkDownTime)/time.Second), 10)})
+		}
+		repl.mutex.Unlock()
+	} else {
+		fields = append(fields, [2]string{"role", "master"})
+	}
+	fields = append(fields, [2]string{"master_failover_state", failoverStateNames[mdb.failover.getState()]})
+	master := mdb.master
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	var slaves [][2]string
+	for _, r := range master.replicas {
+		state := atomic.LoadInt32(&r.state)
+		if state == replicaStateHandshake {
+			continue
+		}
+		ip, port := r.addr()
+		lag := int64(time.Since(time.Unix(0, atomic.LoadInt64(&r.ackTime))) / time.Second)
+		slaves = append(slaves, [2]string{"slave" + strconv.Itoa(len(slaves)),
+			"ip=" + ip + ",port=" + strconv.Itoa(port) + ",state=" + replicaStateNames[state] +
+				",offset=" + strconv.FormatInt(atomic.LoadInt64(&r.ackOffset), 10) + ",lag=" + strconv.FormatInt(lag, 10)})
+	}
+	fields = append(fields, [2]string{"connected_slaves", strconv.Itoa(len(slaves))})
+	fields = append(fields, slaves...)
+	if config.Properties().MinReplicasToWrite > 0 {
+		good := master.goodReplicasWithMutex(minReplicasMaxLag())
+		fields = append(fields, [2]string{"min_slaves_good_slaves", strconv.Itoa(good)})
+	}
+	replId2 := master.replId2
+	if replId2 == "" {
+		replId2 = strings.Repeat("0", replIdLen)
+	}
+	fields = append(fields,
+		[2]string{"master_replid", master.replId},
+		[2]string{"master_replid2", replId2},
+		[2]string{"master_repl_offset", strconv.FormatInt(master.offset, 10)},
+		[2]string{"second_repl_offset", strconv.FormatInt(master.secondOffset, 10)},
+	)
+	if master.backlog == nil {
+		return append(fields, [2]string{"repl_backlog_active", "0"})
+	}
+	histLen := int64(master.backlog.histLen)
+	return append(fields,
+		[2]string{"repl_backlog_active", "1"},
+		[2]string{"repl_backlog_size", strconv.Itoa(len(master.backlog.buf))},
+		[2]string{"repl_backlog_first_byte_offset", strconv.FormatInt(master.offset-histLen+1, 10)},
+		[2]string{"repl_backlog_histlen", strconv.FormatInt(histLen, 10)},
+	)
+}
+
+// execRole returns role of this node and its replication state
+// reply of master: "master", replication offset, list of [ip, port, acknowledged offset] of online slaves
+// reply of slave: "slave", master host, master port, link state, replication offset
+func (mdb *MultiDB) execRole() redis.Reply {
+	if atomic.LoadInt32(&mdb.role) == slaveRole {
+		repl := mdb.replication
+		repl.mutex.Lock()
+		defer repl.mutex.Unlock()
+		offset := int64(-1)
+		if repl.linkState == replLinkConnected {
+			offset = repl.replOffset
+		}
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slave")),
+			protocol.MakeBulkReply([]byte(repl.masterHost)),
+			protocol.MakeIntReply(int64(repl.masterPort)),
+			protocol.MakeBulkReply([]byte(replLinkStateNames[repl.linkState])),
+			protocol.MakeIntReply(offset),
+		})
+	}
+	master := mdb.master
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	slaves := make([]redis.Reply, 0, len(master.replicas))
+	for _, r := range master.replicas {
+		if atomic.LoadInt32(&r.state) != replicaStateOnline {
+			continue
+		}
+		ip, port := r.addr()
+		slaves = append(slaves, protocol.MakeMultiBulkReply([][]byte{
+			[]byte(ip),
+			[]byte(strconv.Itoa(port)),
+			[]byte(strconv.FormatInt(atomic.LoadInt64(&r.ackOffset), 10)),
+		}))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeIntReply(master.offset),
+		protocol.MakeMultiRawReply(slaves),
+	})
+}
+
+// statsInfo generates fields of INFO stats
+func statsInfo(mdb *MultiDB) [][2]string {
+	return [][2]string{
+		{"sync_full", strconv.FormatInt(atomic.LoadInt64(&mdb.master.syncFull), 10)},
+		{"sync_partial_ok", strconv.FormatInt(atomic.LoadInt64(&mdb.master.syncPartialOk), 10)},
+		{"sync_partial_err", strconv.FormatInt(atomic.LoadInt64(&mdb.master.syncPartialErr), 10)},
+		{"client_idle_timeout_disconnections", strconv.FormatInt(connection.IdleDisconnections(), 10)},
+	}
+}
@@ -0,0 +1,560 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveForTest serves mdb on a random port like redis server, it returns address of listener.
+// Listener and connections are closed after test finished
+func serveForTest(t *testing.T, mdb *MultiDB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := connection.NewConn(conn)
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						break
+					}
+					r, ok := payload.Data.(*protocol.MultiBulkReply)
+					if !ok {
+						continue
+					}
+					_ = client.Write(mdb.Exec(client, r.Args).ToBytes())
+				}
+				_ = client.Close()
+				mdb.AfterClientClose(client)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// waitFor retries check until it returns true or times out
+func waitFor(check func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestMasterFullSync(t *testing.T) {
+	for _, diskless := range []bool{false, true} {
+		config.SetProperties(&config.ServerProperties{
+			RDBFilename:      t.TempDir() + "/dump.rdb",
+			ReplDisklessSync: diskless,
+			ReplicaReadOnly:  true,
+		})
+		master := NewStandaloneServer()
+		conn := &connection.FakeConn{}
+		for i := 0; i < 100; i++ {
+			master.Exec(conn, utils.ToCmdLine("set", strconv.Itoa(i), "v"))
+		}
+		master.Exec(conn, utils.ToCmdLine("rpush", "list", "a", "b"))
+		master.Exec(conn, utils.ToCmdLine("set", "ttl", "v", "ex", "1000"))
+		host, port, _ := net.SplitHostPort(serveForTest(t, master))
+
+		slave := NewStandaloneServer()
+		slaveConn := &connection.FakeConn{}
+		result := slave.Exec(slaveConn, utils.ToCmdLine("replicaof", host, port))
+		asserts.AssertStatusReply(t, result, "OK")
+		if !waitFor(func() bool {
+			reply, ok := slave.Exec(slaveConn, utils.ToCmdLine("get", "99")).(*protocol.BulkReply)
+			return ok && string(reply.Arg) == "v"
+		}) {
+			t.Errorf("full sync failed, diskless: %v", diskless)
+			return
+		}
+		result = slave.Exec(slaveConn, utils.ToCmdLine("lrange", "list", "0", "-1"))
+		asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+		result = slave.Exec(slaveConn, utils.ToCmdLine("ttl", "ttl"))
+		asserts.AssertIntReplyGreaterThan(t, result, 900)
+		result = slave.Exec(slaveConn, utils.ToCmdLine("set", "a", "b"))
+		asserts.AssertErrReply(t, result, "READONLY You can't write against a read only slave.")
+		result = slave.Exec(slaveConn, utils.ToCmdLine("readonly"))
+		asserts.AssertErrReply(t, result, "ERR This instance has cluster support disabled")
+		// writable replica accepts writes from clients
+		config.Update(func(p *config.ServerProperties) {
+			p.ReplicaReadOnly = false
+		})
+		result = slave.Exec(slaveConn, utils.ToCmdLine("set", "local", "v"))
+		asserts.AssertStatusReply(t, result, "OK")
+		config.Update(func(p *config.ServerProperties) {
+			p.ReplicaReadOnly = true
+		})
+
+		// write commands are propagated after full sync
+		master.Exec(conn, utils.ToCmdLine("rpush", "list", "c"))
+		master.Exec(conn, utils.ToCmdLine("del", "0"))
+		master.Exec(conn, utils.ToCmdLine("select", "1"))
+		master.Exec(conn, utils.ToCmdLine("set", "db1", "v"))
+		slaveConn.SelectDB(1)
+		if !waitFor(func() bool {
+			reply, ok := slave.Exec(slaveConn, utils.ToCmdLine("get", "db1")).(*protocol.BulkReply)
+			return ok && string(reply.Arg) == "v"
+		}) {
+			t.Error("propagation failed")
+			return
+		}
+		slaveConn.SelectDB(0)
+		result = slave.Exec(slaveConn, utils.ToCmdLine("lrange", "list", "0", "-1"))
+		asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c"})
+		result = slave.Exec(slaveConn, utils.ToCmdLine("exists", "0"))
+		asserts.AssertIntReply(t, result, 0)
+
+		info := string(master.Exec(conn, utils.ToCmdLine("info", "replication")).(*protocol.BulkReply).Arg)
+		for _, field := range []string{"role:master", "connected_slaves:1", "state=online"} {
+			if !strings.Contains(info, field) {
+				t.Errorf("info should contain %s, actually %s", field, info)
+			}
+		}
+		info = string(slave.Exec(slaveConn, utils.ToCmdLine("info", "replication")).(*protocol.BulkReply).Arg)
+		for _, field := range []string{"role:slave", "master_link_status:up", "master_port:" + port,
+			"master_sync_in_progress:0", "slave_read_only:1"} {
+			if !strings.Contains(info, field) {
+				t.Errorf("info should contain %s, actually %s", field, info)
+			}
+		}
+
+		role, ok := slave.Exec(slaveConn, utils.ToCmdLine("role")).(*protocol.MultiRawReply)
+		if !ok || len(role.Replies) != 5 {
+			t.Errorf("illegal role reply of slave")
+		} else {
+			asserts.AssertBulkReply(t, role.Replies[0], "slave")
+			asserts.AssertBulkReply(t, role.Replies[1], host)
+			asserts.AssertBulkReply(t, role.Replies[3], "connected")
+		}
+		role, ok = master.Exec(conn, utils.ToCmdLine("role")).(*protocol.MultiRawReply)
+		if !ok || len(role.Replies) != 3 {
+			t.Errorf("illegal role reply of master")
+		} else {
+			asserts.AssertBulkReply(t, role.Replies[0], "master")
+			if slaves, ok := role.Replies[2].(*protocol.MultiRawReply); !ok || len(slaves.Replies) != 1 {
+				t.Errorf("role of master should contain 1 slave")
+			}
+		}
+		result = master.Exec(conn, utils.ToCmdLine("role", "a"))
+		asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'role' command")
+		slave.Close()
+		master.Close()
+	}
+}
+
+func TestSyncSnapshot(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{})
+	mdb := NewStandaloneServer()
+	defer mdb.Close()
+	conn := &connection.FakeConn{}
+	mdb.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	mdb.Exec(conn, utils.ToCmdLine("hset", "h", "f", "1"))
+	var snapshot CmdLine
+	holder, err := mdb.takeSyncSnapshot(func() {
+		// commands after cut are not included in snapshot
+		snapshot = utils.ToCmdLine("cut")
+	})
+	if err != nil || snapshot == nil {
+		t.Errorf("take snapshot failed: %v", err)
+		return
+	}
+	// holder is a copy, modifying origin doesn't change it
+	mdb.Exec(conn, utils.ToCmdLine("hset", "h", "f", "2"))
+	result := holder.mustSelectDB(0).Exec(conn, utils.ToCmdLine("hget", "h", "f"))
+	asserts.AssertBulkReply(t, result, "1")
+	result = holder.mustSelectDB(0).Exec(conn, utils.ToCmdLine("get", "a"))
+	asserts.AssertBulkReply(t, result, "1")
+}
+
+func TestReplConf(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{})
+	mdb := NewStandaloneServer()
+	defer mdb.Close()
+	conn := &connection.FakeConn{}
+	result := mdb.Exec(conn, utils.ToCmdLine("replconf", "listening-port", "6380", "capa", "eof"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = mdb.Exec(conn, utils.ToCmdLine("replconf", "listening-port"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = mdb.Exec(conn, utils.ToCmdLine("replconf", "foo", "bar"))
+	asserts.AssertErrReply(t, result, "ERR Unrecognized REPLCONF option: foo")
+	result = mdb.Exec(conn, utils.ToCmdLine("psync", "?"))
+	asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'psync' command")
+	r := mdb.master.getReplica(conn)
+	if r.listeningPort != 6380 || !r.capaEOF {
+		t.Error("replconf not recorded")
+	}
+	mdb.AfterClientClose(conn)
+	if len(mdb.master.replicas) != 0 {
+		t.Error("replica should be removed after connection closed")
+	}
+}
+
+func TestPartialSync(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: t.TempDir() + "/dump.rdb",
+	})
+	master := NewStandaloneServer()
+	defer master.Close()
+	conn := &connection.FakeConn{}
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	host, port, _ := net.SplitHostPort(serveForTest(t, master))
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	slaveConn := &connection.FakeConn{}
+	slave.Exec(slaveConn, utils.ToCmdLine("replicaof", host, port))
+	master.Exec(conn, utils.ToCmdLine("select", "1"))
+	master.Exec(conn, utils.ToCmdLine("set", "b", "1"))
+	slaveConn.SelectDB(1)
+	if !waitFor(func() bool {
+		reply, ok := slave.Exec(slaveConn, utils.ToCmdLine("get", "b")).(*protocol.BulkReply)
+		return ok && string(reply.Arg) == "1"
+	}) {
+		t.Error("sync failed")
+		return
+	}
+
+	// disconnect slave, and write commands during disconnected are sent by partial resync
+	master.master.mu.Lock()
+	for _, r := range master.master.replicas {
+		r.close()
+	}
+	master.master.mu.Unlock()
+	master.Exec(conn, utils.ToCmdLine("set", "c", "1"))
+	if !waitFor(func() bool {
+		reply, ok := slave.Exec(slaveConn, utils.ToCmdLine("get", "c")).(*protocol.BulkReply)
+		return ok && string(reply.Arg) == "1"
+	}) {
+		t.Error("partial resync failed")
+		return
+	}
+	info := string(master.Exec(conn, utils.ToCmdLine("info")).(*protocol.BulkReply).Arg)
+	for _, field := range []string{"sync_full:1", "sync_partial_ok:1", "sync_partial_err:0", "repl_backlog_active:1"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("info should contain %s, actually %s", field, info)
+		}
+	}
+
+	// offset out of backlog
+	slave.master.mu.Lock()
+	slave.master.offset += 1 << 30
+	slave.master.mu.Unlock()
+	master.master.mu.Lock()
+	for _, r := range master.master.replicas {
+		r.close()
+	}
+	master.master.mu.Unlock()
+	if !waitFor(func() bool {
+		return atomic.LoadInt64(&master.master.syncFull) == 2
+	}) {
+		t.Error("expected full sync")
+	}
+	if atomic.LoadInt64(&master.master.syncPartialErr) != 1 {
+		t.Error("expected failed partial resync")
+	}
+}
+
+func TestWait(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename: t.TempDir() + "/dump.rdb",
+	})
+	master := NewStandaloneServer()
+	defer master.Close()
+	conn := &connection.FakeConn{}
+	result := master.Exec(conn, utils.ToCmdLine("wait", "0", "0"))
+	asserts.AssertIntReply(t, result, 0)
+	result = master.Exec(conn, utils.ToCmdLine("wait", "1", "-1"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+	result = master.Exec(conn, utils.ToCmdLine("wait", "a", "0"))
+	asserts.AssertErrReply(t, result, "ERR value is not an integer or out of range")
+	result = master.Exec(conn, utils.ToCmdLine("wait", "1"))
+	asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'wait' command")
+
+	host, port, _ := net.SplitHostPort(serveForTest(t, master))
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	slaveConn := &connection.FakeConn{}
+	slave.Exec(slaveConn, utils.ToCmdLine("replicaof", host, port))
+	if !waitFor(func() bool {
+		return master.master.countAcked(0) == 1
+	}) {
+		t.Error("sync failed")
+		return
+	}
+	result = slave.Exec(slaveConn, utils.ToCmdLine("wait", "1", "0"))
+	asserts.AssertErrReply(t, result, "ERR WAIT cannot be used with replica instances.")
+
+	// GETACK makes slave ack immediately rather than waiting for its cron
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	start := time.Now()
+	result = master.Exec(conn, utils.ToCmdLine("wait", "1", "0"))
+	asserts.AssertIntReply(t, result, 1)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("wait took too long: %v", time.Since(start))
+	}
+	result = slave.Exec(slaveConn, utils.ToCmdLine("get", "a"))
+	asserts.AssertBulkReply(t, result, "1")
+
+	// wait until timeout if there are not enough slaves
+	master.Exec(conn, utils.ToCmdLine("set", "a", "2"))
+	start = time.Now()
+	result = master.Exec(conn, utils.ToCmdLine("wait", "2", "200"))
+	asserts.AssertIntReply(t, result, 1)
+	if time.Since(start) < 200*time.Millisecond {
+		t.Errorf("wait returned before timeout: %v", time.Since(start))
+	}
+}
+
+func TestMinReplicas(t *testing.T) {
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename:        t.TempDir() + "/dump.rdb",
+		MinReplicasToWrite: 1,
+		MinReplicasMaxLag:  1,
+	})
+	master := NewStandaloneServer()
+	defer master.Close()
+	conn := &connection.FakeConn{}
+	result := master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	asserts.AssertErrReply(t, result, "NOREPLICAS Not enough good replicas to write.")
+	result = master.Exec(conn, utils.ToCmdLine("flushall"))
+	asserts.AssertErrReply(t, result, "NOREPLICAS Not enough good replicas to write.")
+	result = master.Exec(conn, utils.ToCmdLine("get", "a"))
+	asserts.AssertNullBulk(t, result)
+	// transaction with refused command is aborted
+	master.Exec(conn, utils.ToCmdLine("multi"))
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	result = master.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertErrReply(t, result, "EXECABORT Transaction discarded because of previous errors.")
+
+	host, port, _ := net.SplitHostPort(serveForTest(t, master))
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	slaveConn := &connection.FakeConn{}
+	slave.Exec(slaveConn, utils.ToCmdLine("replicaof", host, port))
+	if !waitFor(func() bool {
+		return protocol.IsOKReply(master.Exec(conn, utils.ToCmdLine("set", "a", "1")))
+	}) {
+		t.Error("write should be accepted after slave connected")
+		return
+	}
+	info := string(master.Exec(conn, utils.ToCmdLine("info", "replication")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "min_slaves_good_slaves:1") {
+		t.Errorf("info should contain good slaves, actually %s", info)
+	}
+
+	// slave lags behind since it doesn't ack
+	master.master.mu.Lock()
+	for _, r := range master.master.replicas {
+		atomic.StoreInt64(&r.ackTime, time.Now().Add(-time.Minute).UnixNano())
+	}
+	master.master.mu.Unlock()
+	slave.replication.mutex.Lock() // stop slave sending ack
+	result = master.Exec(conn, utils.ToCmdLine("set", "a", "2"))
+	slave.replication.mutex.Unlock()
+	asserts.AssertErrReply(t, result, "NOREPLICAS Not enough good replicas to write.")
+}
+
+func TestChainedReplication(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename:     t.TempDir() + "/dump.rdb",
+		ReplicaReadOnly: true,
+	})
+	conn := &connection.FakeConn{}
+	master := NewStandaloneServer()
+	defer master.Close()
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	host, port, _ := net.SplitHostPort(serveForTest(t, master))
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	slave.Exec(conn, utils.ToCmdLine("replicaof", host, port))
+	slaveHost, slavePort, _ := net.SplitHostPort(serveForTest(t, slave))
+	master.Exec(conn, utils.ToCmdLine("select", "1"))
+	master.Exec(conn, utils.ToCmdLine("set", "b", "1"))
+	subConn := &connection.FakeConn{}
+	subConn.SelectDB(1)
+	getFrom := func(db *MultiDB, key string) string {
+		reply, ok := db.Exec(subConn, utils.ToCmdLine("get", key)).(*protocol.BulkReply)
+		if !ok {
+			return ""
+		}
+		return string(reply.Arg)
+	}
+	if !waitFor(func() bool { return getFrom(slave, "b") == "1" }) {
+		t.Error("sync with master failed")
+		return
+	}
+
+	// sub-slave receives stream forwarded by slave, the selected db 1 is sent by rdb
+	subSlave := NewStandaloneServer()
+	defer subSlave.Close()
+	subSlave.Exec(conn, utils.ToCmdLine("replicaof", slaveHost, slavePort))
+	if !waitFor(func() bool { return getFrom(subSlave, "b") == "1" }) {
+		t.Error("sync with slave failed")
+		return
+	}
+	master.Exec(conn, utils.ToCmdLine("set", "c", "1"))
+	if !waitFor(func() bool { return getFrom(subSlave, "c") == "1" }) {
+		t.Error("stream is not forwarded")
+		return
+	}
+	if atomic.LoadInt64(&master.master.syncFull) != 1 {
+		t.Error("sub-slave should not sync with master")
+	}
+	streamOf := func(db *MultiDB) (string, int64) {
+		id, offset, _ := db.master.streamPosition()
+		return id, offset
+	}
+	masterId, masterOffset := streamOf(master)
+	if !waitFor(func() bool {
+		id, offset := streamOf(subSlave)
+		return id == masterId && offset == masterOffset
+	}) {
+		id, offset := streamOf(subSlave)
+		t.Errorf("stream of sub-slave %s %d differs from master %s %d", id, offset, masterId, masterOffset)
+	}
+
+	// sub-slave continues with promoted slave by partial resync
+	result := slave.Exec(conn, utils.ToCmdLine("replicaof", "no", "one"))
+	asserts.AssertStatusReply(t, result, "OK")
+	slave.Exec(subConn, utils.ToCmdLine("set", "d", "1"))
+	if !waitFor(func() bool { return getFrom(subSlave, "d") == "1" }) {
+		t.Error("sync with promoted slave failed")
+		return
+	}
+	if atomic.LoadInt64(&slave.master.syncPartialOk) != 1 || atomic.LoadInt64(&slave.master.syncFull) != 1 {
+		t.Errorf("expected partial resync")
+	}
+	info := string(slave.Exec(conn, utils.ToCmdLine("info", "replication")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "master_replid2:"+masterId) {
+		t.Errorf("info should contain former replication id, actually %s", info)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{
+		RDBFilename:     t.TempDir() + "/dump.rdb",
+		ReplicaReadOnly: true,
+	})
+	conn := &connection.FakeConn{}
+	master := NewStandaloneServer()
+	defer master.Close()
+	result := master.Exec(conn, utils.ToCmdLine("failover"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER requires connected replicas.")
+	result = master.Exec(conn, utils.ToCmdLine("failover", "abort"))
+	asserts.AssertErrReply(t, result, "ERR No failover in progress.")
+	result = master.Exec(conn, utils.ToCmdLine("failover", "timeout", "0"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER timeout must be greater than 0")
+	result = master.Exec(conn, utils.ToCmdLine("failover", "to", "127.0.0.1", "6399", "force"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	result = master.Exec(conn, utils.ToCmdLine("failover", "to", "127.0.0.1"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	host, port, _ := net.SplitHostPort(serveForTest(t, master))
+	slave := NewStandaloneServer()
+	defer slave.Close()
+	slaveHost, slavePort, _ := net.SplitHostPort(serveForTest(t, slave))
+	config.Properties().SlaveAnnouncePort, _ = strconv.Atoi(slavePort)
+	slave.Exec(conn, utils.ToCmdLine("replicaof", host, port))
+	if !waitFor(func() bool { return master.master.hasReplica(slaveHost, config.Properties().SlaveAnnouncePort) }) {
+		t.Error("sync with master failed")
+		return
+	}
+	result = slave.Exec(conn, utils.ToCmdLine("failover"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER is not valid when server is a replica.")
+	result = master.Exec(conn, utils.ToCmdLine("failover", "to", slaveHost, "1"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER target HOST and PORT is not a replica.")
+
+	master.Exec(conn, utils.ToCmdLine("set", "b", "1"))
+	result = master.Exec(conn, utils.ToCmdLine("failover", "to", slaveHost, slavePort))
+	asserts.AssertStatusReply(t, result, "OK")
+	// paused write is refused after master demoted
+	result = master.Exec(conn, utils.ToCmdLine("set", "c", "1"))
+	asserts.AssertErrReply(t, result, "READONLY You can't write against a read only slave.")
+	if atomic.LoadInt32(&master.role) != slaveRole || atomic.LoadInt32(&slave.role) != masterRole {
+		t.Error("roles should be swapped")
+		return
+	}
+	asserts.AssertBulkReply(t, slave.Exec(conn, utils.ToCmdLine("get", "b")), "1")
+	info := string(master.Exec(conn, utils.ToCmdLine("info", "replication")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "master_failover_state:no-failover") {
+		t.Errorf("failover should be finished, actually %s", info)
+	}
+
+	// former master continues with promoted slave by partial resync
+	slave.Exec(conn, utils.ToCmdLine("set", "d", "1"))
+	if !waitFor(func() bool {
+		reply, ok := master.Exec(conn, utils.ToCmdLine("get", "d")).(*protocol.BulkReply)
+		return ok && string(reply.Arg) == "1"
+	}) {
+		t.Error("sync with promoted slave failed")
+		return
+	}
+	if atomic.LoadInt64(&slave.master.syncPartialOk) != 1 || atomic.LoadInt64(&slave.master.syncFull) != 0 {
+		t.Error("expected partial resync")
+	}
+
+	// failover is aborted if target doesn't catch up before timeout, replica can't ack while holding its mutex
+	master.replication.mutex.Lock()
+	result = slave.Exec(conn, utils.ToCmdLine("failover", "timeout", "100"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = slave.Exec(conn, utils.ToCmdLine("failover"))
+	asserts.AssertErrReply(t, result, "ERR FAILOVER already in progress.")
+	if !waitFor(func() bool { return slave.failover.getState() == failoverNone }) {
+		t.Error("failover should time out")
+	}
+	result = slave.Exec(conn, utils.ToCmdLine("failover"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = slave.Exec(conn, utils.ToCmdLine("failover", "abort"))
+	asserts.AssertStatusReply(t, result, "OK")
+	if !waitFor(func() bool { return slave.failover.getState() == failoverNone }) {
+		t.Error("failover should be aborted")
+	}
+	master.replication.mutex.Unlock()
+	if atomic.LoadInt32(&slave.role) != masterRole {
+		t.Error("aborted failover should not demote master")
+	}
+	asserts.AssertStatusReply(t, slave.Exec(conn, utils.ToCmdLine("set", "e", "1")), "OK")
+}
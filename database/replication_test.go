@@ -24,6 +24,7 @@ func TestReplication(t *testing.T) {
 		mdb.dbSet[i] = holder
 	}
 	mdb.replication = initReplStatus()
+	mdb.master = initMasterStatus()
 	masterCli, err := client.MakeClient("127.0.0.1:6379")
 	if err != nil {
 		t.Error(err)
@@ -82,7 +83,9 @@ func TestReplication(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// test reconnect
-	config.Properties.ReplTimeout = 1
+	config.Update(func(p *config.ServerProperties) {
+		p.ReplTimeout = 1
+	})
 	_ = mdb.replication.masterConn.Close()
 	mdb.replication.lastRecvTime = time.Now().Add(-time.Hour) // mock timeout
 	mdb.slaveCron()
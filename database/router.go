@@ -17,6 +17,15 @@ type command struct {
 const (
 	flagWrite    = 0
 	flagReadOnly = 1
+	// flagBlocking means client may block until timeout if the command cannot be served immediately
+	flagBlocking = 2
+	// flagTimeoutFirst means the timeout of blocking command is the first argument instead of the last one, like BLMPOP
+	flagTimeoutFirst = 4
+	// flagNoScript means the command cannot be called by lua script, like EVAL itself
+	flagNoScript = 8
+	// flagBlockOption means the command blocks like flagBlocking only if it has BLOCK option
+	// whose timeout is in milliseconds, like XREAD
+	flagBlockOption = 16
 )
 
 // RegisterCommand registers a new command
@@ -33,7 +42,8 @@ func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback U
 	}
 }
 
-func isReadOnlyCommand(name string) bool {
+// IsReadOnlyCommand returns whether the command never modifies data
+func IsReadOnlyCommand(name string) bool {
 	name = strings.ToLower(name)
 	cmd := cmdTable[name]
 	if cmd == nil {
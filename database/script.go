@@ -0,0 +1,208 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/script"
+	lua "github.com/yuin/gopher-lua"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// luaTimeLimit returns the execution time after which a script is regarded as busy
+func luaTimeLimit() time.Duration {
+	return time.Duration(orDefault(config.Properties().LuaTimeLimit, 5000)) * time.Millisecond
+}
+
+// isAllowedWhenBusy returns whether the command can be executed while a script is busy
+func isAllowedWhenBusy(cmdLine [][]byte) bool {
+	if len(cmdLine) != 2 {
+		return false
+	}
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	arg := strings.ToLower(string(cmdLine[1]))
+	return (cmdName == "script" && arg == "kill") || (cmdName == "shutdown" && arg == "nosave")
+}
+
+// parseScriptKeys parses arguments begin with numkeys: numkeys key [key ...] arg [arg ...]
+func parseScriptKeys(args [][]byte) ([][]byte, [][]byte, protocol.ErrorReply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, protocol.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : numKeys+1], args[numKeys+1:], nil
+}
+
+// prepareScript returns all declared keys as write keys, so they are locked before script runs.
+// It skips the script or sha1 which is the first argument
+func prepareScript(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseScriptKeys(args[1:])
+	if errReply != nil {
+		return nil, nil
+	}
+	writeKeys := make([]string, len(keys))
+	for i, key := range keys {
+		writeKeys[i] = string(key)
+	}
+	return writeKeys, nil
+}
+
+// prepareReadOnlyScript returns all declared keys as read keys, it is used by EVAL_RO, EVALSHA_RO and FCALL_RO
+func prepareReadOnlyScript(args [][]byte) ([]string, []string) {
+	keys, _ := prepareScript(args)
+	return nil, keys
+}
+
+func undoScript(db *DB, args [][]byte) []CmdLine {
+	keys, _ := prepareScript(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// scriptCaller executes commands called by script, invoker should lock declared keys.
+// Commands accessing undeclared keys are rejected since these keys are not locked,
+// and readOnly means write commands are rejected
+func (db *DB) scriptCaller(execution *script.Execution, declared [][]byte, readOnly bool) script.Caller {
+	declaredSet := make(map[string]struct{}, len(declared))
+	for _, key := range declared {
+		declaredSet[string(key)] = struct{}{}
+	}
+	return func(cmdLine [][]byte) redis.Reply {
+		cmdName := strings.ToLower(string(cmdLine[0]))
+		cmd, ok := cmdTable[cmdName]
+		if !ok {
+			return protocol.MakeErrReply("ERR Unknown Redis command called from script")
+		}
+		if cmd.prepare == nil || cmd.flags&(flagBlocking|flagNoScript) > 0 {
+			return protocol.MakeErrReply("ERR This Redis command is not allowed from script")
+		}
+		if !validateArity(cmd.arity, cmdLine) {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		write, read := cmd.prepare(cmdLine[1:])
+		for _, key := range append(write, read...) {
+			if _, ok := declaredSet[key]; !ok {
+				return protocol.MakeErrReply("ERR Script attempted to access undeclared key '" + key + "'")
+			}
+		}
+		if cmd.flags&flagReadOnly == 0 {
+			if readOnly {
+				return protocol.MakeErrReply("ERR Write commands are not allowed from read-only scripts.")
+			}
+			execution.MarkWritten()
+		}
+		return db.execWithLock(cmdLine)
+	}
+}
+
+// runScript executes script, readOnly scripts are rejected once they call write commands
+func (db *DB) runScript(proto *lua.FunctionProto, args [][]byte, readOnly bool) redis.Reply {
+	keys, argv, errReply := parseScriptKeys(args)
+	if errReply != nil {
+		return errReply
+	}
+	execution := db.scriptMonitor.Start()
+	defer db.scriptMonitor.Finish(execution)
+	return script.Run(execution, proto, keys, argv, db.scriptCaller(execution, keys, readOnly))
+}
+
+func (db *DB) eval(args [][]byte, readOnly bool) redis.Reply {
+	_, proto, err := db.scripts.Load(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR Error compiling script: " + err.Error())
+	}
+	return db.runScript(proto, args[1:], readOnly)
+}
+
+func (db *DB) evalSha(args [][]byte, readOnly bool) redis.Reply {
+	proto, ok := db.scripts.Get(string(args[0]))
+	if !ok {
+		return protocol.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return db.runScript(proto, args[1:], readOnly)
+}
+
+// execEval runs lua script, the script is cached for EVALSHA
+// usage: EVAL script numkeys key [key ...] arg [arg ...]
+func execEval(db *DB, args [][]byte) redis.Reply {
+	return db.eval(args, false)
+}
+
+// execEvalRO runs lua script which cannot call write commands, so it can be executed by read only slave
+// usage: EVAL_RO script numkeys key [key ...] arg [arg ...]
+func execEvalRO(db *DB, args [][]byte) redis.Reply {
+	return db.eval(args, true)
+}
+
+// execEvalSha runs cached lua script by its sha1 digest
+// usage: EVALSHA sha1 numkeys key [key ...] arg [arg ...]
+func execEvalSha(db *DB, args [][]byte) redis.Reply {
+	return db.evalSha(args, false)
+}
+
+// execEvalShaRO runs cached lua script which cannot call write commands
+// usage: EVALSHA_RO sha1 numkeys key [key ...] arg [arg ...]
+func execEvalShaRO(db *DB, args [][]byte) redis.Reply {
+	return db.evalSha(args, true)
+}
+
+// execScript manages script cache
+// usage: SCRIPT LOAD script | SCRIPT EXISTS sha1 [sha1 ...] | SCRIPT FLUSH [ASYNC|SYNC] | SCRIPT KILL
+func execScript(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "load":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("script|load")
+		}
+		sha, _, err := db.scripts.Load(string(args[1]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Error compiling script: " + err.Error())
+		}
+		return protocol.MakeBulkReply([]byte(sha))
+	case "exists":
+		if len(args) < 2 {
+			return protocol.MakeArgNumErrReply("script|exists")
+		}
+		result := make([]int64, len(args)-1)
+		for i, sha := range args[1:] {
+			if db.scripts.Exists(string(sha)) {
+				result[i] = 1
+			}
+		}
+		return makeIntArrayReply(result)
+	case "flush":
+		if len(args) > 2 {
+			return protocol.MakeArgNumErrReply("script|flush")
+		}
+		if len(args) == 2 {
+			mode := strings.ToUpper(string(args[1]))
+			if mode != "ASYNC" && mode != "SYNC" {
+				return protocol.MakeSyntaxErrReply()
+			}
+		}
+		db.scripts.Flush()
+		return protocol.MakeOkReply()
+	case "kill":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("script|kill")
+		}
+		return db.scriptMonitor.Kill(luaTimeLimit())
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try SCRIPT HELP.")
+}
+
+func init() {
+	RegisterCommand("Eval", execEval, prepareScript, undoScript, -3, flagWrite|flagNoScript)
+	RegisterCommand("EvalSha", execEvalSha, prepareScript, undoScript, -3, flagWrite|flagNoScript)
+	RegisterCommand("Eval_RO", execEvalRO, prepareReadOnlyScript, nil, -3, flagReadOnly|flagNoScript)
+	RegisterCommand("EvalSha_RO", execEvalShaRO, prepareReadOnlyScript, nil, -3, flagReadOnly|flagNoScript)
+	RegisterCommand("Script", execScript, noPrepare, nil, -2, flagReadOnly|flagNoScript)
+}
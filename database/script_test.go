@@ -0,0 +1,239 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"github.com/hdt3213/godis/script"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertErrReplyPrefix(t *testing.T, actual redis.Reply, prefix string) {
+	t.Helper()
+	if !protocol.IsErrorReply(actual) || !strings.HasPrefix(string(actual.ToBytes()[1:]), prefix) {
+		t.Errorf("expected error with prefix %s, actually %q", prefix, actual.ToBytes())
+	}
+}
+
+func TestEval(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call('set', KEYS[1], ARGV[1])", "1", key, "a"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call('get', KEYS[1])", "1", key))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return {1, 'b', KEYS[1], ARGV[2], {2}}", "1", key, "x", "y"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(1),
+		protocol.MakeBulkReply([]byte("b")),
+		protocol.MakeBulkReply([]byte(key)),
+		protocol.MakeBulkReply([]byte("y")),
+		protocol.MakeMultiRawReply([]redis.Reply{protocol.MakeIntReply(2)}),
+	})
+	if string(result.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expected %q, actually %q", expected.ToBytes(), result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return 3.9", "0"))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call('get', 'nokey')", "0"))
+	asserts.AssertErrReply(t, result, "ERR Script attempted to access undeclared key 'nokey'")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call('get', KEYS[1]) == false", "1", utils.RandString(10)))
+	asserts.AssertIntReply(t, result, 1)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.status_reply('FINE')", "0"))
+	asserts.AssertStatusReply(t, result, "FINE")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.error_reply('ERR my error')", "0"))
+	asserts.AssertErrReply(t, result, "ERR my error")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.sha1hex('')", "0"))
+	asserts.AssertBulkReply(t, result, "da39a3ee5e6b4b0d3255bfef95601890afd80709")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return 1", "2", key))
+	asserts.AssertErrReply(t, result, "ERR Number of keys can't be greater than number of args")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return 1", "-1"))
+	asserts.AssertErrReply(t, result, "ERR Number of keys can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return", "0"))
+	asserts.AssertNotError(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return (", "0"))
+	assertErrReplyPrefix(t, result, "ERR Error compiling script")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call('eval', 'return 1', '0')", "0"))
+	asserts.AssertErrReply(t, result, "ERR This Redis command is not allowed from script")
+}
+
+func TestEvalError(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "a"))
+	// error of redis.call aborts script
+	result := testDB.Exec(nil, utils.ToCmdLine("eval", "redis.call('incr', KEYS[1]); return 1", "1", key))
+	asserts.AssertErrReply(t, result, "ERR value is not an integer or out of range")
+	// error of redis.pcall is returned as table
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "local r = redis.pcall('incr', KEYS[1]); return r['err']", "1", key))
+	asserts.AssertBulkReply(t, result, "ERR value is not an integer or out of range")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "error('oops')", "0"))
+	assertErrReplyPrefix(t, result, "ERR Error running script")
+	result = testDB.Exec(nil, utils.ToCmdLine("eval", "return redis.call({})", "0"))
+	assertErrReplyPrefix(t, result, "ERR Error running script")
+}
+
+func TestScriptCache(t *testing.T) {
+	c := new(connection.FakeConn)
+	src := "return redis.call('incrby', KEYS[1], ARGV[1])"
+	sha := script.Sha1Hex(src)
+	result := testServer.Exec(c, utils.ToCmdLine("script", "flush"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testServer.Exec(c, utils.ToCmdLine("evalsha", sha, "1", "a", "1"))
+	asserts.AssertErrReply(t, result, "NOSCRIPT No matching script. Please use EVAL.")
+	result = testServer.Exec(c, utils.ToCmdLine("script", "load", src))
+	asserts.AssertBulkReply(t, result, sha)
+	result = testServer.Exec(c, utils.ToCmdLine("script", "exists", sha, "ffff"))
+	assertIntArrayReply(t, result, 1, 0)
+
+	key := utils.RandString(10)
+	result = testServer.Exec(c, utils.ToCmdLine("evalsha", sha, "1", key, "2"))
+	asserts.AssertIntReply(t, result, 2)
+	// script cache is shared by all databases
+	testServer.Exec(c, utils.ToCmdLine("select", "1"))
+	result = testServer.Exec(c, utils.ToCmdLine("evalsha", sha, "1", key, "3"))
+	asserts.AssertIntReply(t, result, 3)
+
+	result = testServer.Exec(c, utils.ToCmdLine("script", "flush", "async"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testServer.Exec(c, utils.ToCmdLine("script", "exists", sha))
+	assertIntArrayReply(t, result, 0)
+	result = testServer.Exec(c, utils.ToCmdLine("script", "foo"))
+	asserts.AssertErrReply(t, result, "ERR unknown subcommand 'foo'. Try SCRIPT HELP.")
+}
+
+func TestEvalInMulti(t *testing.T) {
+	testDB.Flush()
+	conn := new(connection.FakeConn)
+	key := utils.RandString(10)
+	testDB.Exec(conn, utils.ToCmdLine("multi"))
+	testDB.Exec(conn, utils.ToCmdLine("eval", "return redis.call('rpush', KEYS[1], ARGV[1])", "1", key, "a"))
+	testDB.Exec(conn, utils.ToCmdLine("incr", key))
+	result := testDB.Exec(conn, utils.ToCmdLine("exec"))
+	assertErrReplyPrefix(t, result, "EXECABORT")
+	// effects of script are rolled back
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func waitScriptBusy(t *testing.T, server *MultiDB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !server.scriptMonitor.Busy(luaTimeLimit()) {
+		if time.Now().After(deadline) {
+			t.Fatal("script should be busy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	limit := config.Properties().LuaTimeLimit
+	config.Update(func(p *config.ServerProperties) {
+		p.LuaTimeLimit = 50
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.LuaTimeLimit = limit
+		})
+	}()
+	server := NewStandaloneServer()
+	c := new(connection.FakeConn)
+	result := server.Exec(c, utils.ToCmdLine("script", "kill"))
+	asserts.AssertErrReply(t, result, "NOTBUSY No scripts in execution right now.")
+
+	ch := make(chan redis.Reply, 1)
+	go func() {
+		ch <- server.Exec(new(connection.FakeConn), utils.ToCmdLine("eval", "local i = 0 while true do i = i + 1 end", "0"))
+	}()
+	waitScriptBusy(t, server)
+	result = server.Exec(c, utils.ToCmdLine("get", "a"))
+	asserts.AssertErrReply(t, result, "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+	// AUTH and HELLO are allowed while script is busy
+	result = server.Exec(c, utils.ToCmdLine("hello", "3"))
+	if string(result.ToBytes()[:4]) != "%6\r\n" {
+		t.Errorf("expect HELLO replied while script is busy, actually %q", result.ToBytes())
+	}
+	result = server.Exec(c, utils.ToCmdLine("auth", "foo"))
+	asserts.AssertErrReply(t, result, "ERR Client sent AUTH, but no password is set")
+	result = server.Exec(c, utils.ToCmdLine("script", "kill"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertErrReply(t, <-ch, "ERR Script killed by user with SCRIPT KILL...")
+	result = server.Exec(c, utils.ToCmdLine("get", "a"))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestShutdownBusyScript(t *testing.T) {
+	limit := config.Properties().LuaTimeLimit
+	config.Update(func(p *config.ServerProperties) {
+		p.LuaTimeLimit = 50
+	})
+	exited := false
+	exitProcess = func() {
+		exited = true
+	}
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.LuaTimeLimit = limit
+		})
+		exitProcess = func() {
+			os.Exit(0)
+		}
+	}()
+	server := NewStandaloneServer()
+	c := new(connection.FakeConn)
+	ch := make(chan redis.Reply, 1)
+	go func() {
+		src := "redis.call('set', KEYS[1], 'a') while true do end"
+		ch <- server.Exec(new(connection.FakeConn), utils.ToCmdLine("eval", src, "1", "key"))
+	}()
+	waitScriptBusy(t, server)
+	result := server.Exec(c, utils.ToCmdLine("script", "kill"))
+	assertErrReplyPrefix(t, result, "UNKILLABLE")
+	result = server.Exec(c, utils.ToCmdLine("shutdown"))
+	assertErrReplyPrefix(t, result, "BUSY")
+	server.Exec(c, utils.ToCmdLine("shutdown", "nosave"))
+	if !exited {
+		t.Error("server should exit")
+	}
+	assertErrReplyPrefix(t, <-ch, "ERR Script killed")
+}
+
+func TestEvalReadOnly(t *testing.T) {
+	c := new(connection.FakeConn)
+	key := utils.RandString(10)
+	testServer.Exec(c, utils.ToCmdLine("set", key, "a"))
+	result := testServer.Exec(c, utils.ToCmdLine("eval_ro", "return redis.call('get', KEYS[1])", "1", key))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testServer.Exec(c, utils.ToCmdLine("eval_ro", "return redis.call('set', KEYS[1], 'b')", "1", key))
+	asserts.AssertErrReply(t, result, "ERR Write commands are not allowed from read-only scripts.")
+	result = testServer.Exec(c, utils.ToCmdLine("get", key))
+	asserts.AssertBulkReply(t, result, "a")
+
+	src := "return redis.call('strlen', KEYS[1])"
+	testServer.Exec(c, utils.ToCmdLine("script", "load", src))
+	result = testServer.Exec(c, utils.ToCmdLine("evalsha_ro", script.Sha1Hex(src), "1", key))
+	asserts.AssertIntReply(t, result, 1)
+
+	// read only scripts can be executed by read only slave
+	config.Update(func(p *config.ServerProperties) {
+		p.ReplicaReadOnly = true
+	})
+	slave := MakeBasicMultiDB()
+	slave.role = slaveRole
+	slave.Exec(c, utils.ToCmdLine("set", key, "a"))
+	result = slave.Exec(c, utils.ToCmdLine("eval", "return redis.call('get', KEYS[1])", "1", key))
+	asserts.AssertErrReply(t, result, "READONLY You can't write against a read only slave.")
+	result = slave.Exec(c, utils.ToCmdLine("eval_ro", "return redis.call('get', KEYS[1])", "1", key))
+	asserts.AssertNullBulk(t, result)
+	result = slave.Exec(c, utils.ToCmdLine("eval_ro", "return redis.call('del', KEYS[1])", "1", key))
+	asserts.AssertErrReply(t, result, "ERR Write commands are not allowed from read-only scripts.")
+}
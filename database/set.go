@@ -6,7 +6,9 @@ import (
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsSet(key string) (*HashSet.Set, protocol.ErrorReply) {
@@ -76,6 +78,24 @@ func execSIsMember(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(0)
 }
 
+// execSMIsMember checks whether each member is a member of the set
+func execSMIsMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	set, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if set != nil && set.Has(string(member)) {
+			result[i] = protocol.MakeIntReply(1)
+		} else {
+			result[i] = protocol.MakeIntReply(0)
+		}
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
 // execSRem removes a member from set
 func execSRem(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -218,6 +238,75 @@ func execSInter(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(arr)
 }
 
+// parseSInterCard parses SINTERCARD numkeys key [key ...] [LIMIT limit], limit 0 means unlimited
+func parseSInterCard(args [][]byte) ([]string, int, protocol.ErrorReply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys <= 0 {
+		return nil, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > len(args)-1 {
+		return nil, 0, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	limit := 0
+	rest := args[numKeys+1:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "LIMIT" {
+			return nil, 0, protocol.MakeErrReply("ERR syntax error")
+		}
+		limit, err = strconv.Atoi(string(rest[1]))
+		if err != nil || limit < 0 {
+			return nil, 0, protocol.MakeErrReply("ERR LIMIT can't be negative")
+		}
+	}
+	return keys, limit, nil
+}
+
+// execSInterCard returns the cardinality of the intersection, it stops counting once reaching limit
+func execSInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, limit, errReply := parseSInterCard(args)
+	if errReply != nil {
+		return errReply
+	}
+	sets := make([]*HashSet.Set, 0, len(keys))
+	for _, key := range keys {
+		set, errReply := db.getAsSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if set == nil {
+			return protocol.MakeIntReply(0)
+		}
+		sets = append(sets, set)
+	}
+	// iterate the smallest set and check its members in others
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Len() < sets[j].Len()
+	})
+	count := 0
+	sets[0].ForEach(func(member string) bool {
+		for _, set := range sets[1:] {
+			if !set.Has(member) {
+				return true
+			}
+		}
+		count++
+		return limit == 0 || count < limit
+	})
+	return protocol.MakeIntReply(int64(count))
+}
+
+func prepareSInterCard(args [][]byte) ([]string, []string) {
+	keys, _, errReply := parseSInterCard(args)
+	if errReply != nil {
+		return nil, nil
+	}
+	return nil, keys
+}
+
 // execSInterStore intersects multiple sets and store the result in a key
 func execSInterStore(db *DB, args [][]byte) redis.Reply {
 	dest := string(args[0])
@@ -447,10 +536,10 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if errReply != nil {
 		return errReply
 	}
-	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
 	if len(args) == 1 {
+		if set == nil {
+			return &protocol.NullBulkReply{}
+		}
 		// get a random member
 		members := set.RandomMembers(1)
 		return protocol.MakeBulkReply([]byte(members[0]))
@@ -459,6 +548,9 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
+	if set == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
 	count := int(count64)
 	if count > 0 {
 		members := set.RandomDistinctMembers(count)
@@ -485,7 +577,9 @@ func init() {
 	RegisterCommand("SPop", execSPop, writeFirstKey, undoSetChange, -2, flagWrite)
 	RegisterCommand("SCard", execSCard, readFirstKey, nil, 2, flagReadOnly)
 	RegisterCommand("SMembers", execSMembers, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("SMIsMember", execSMIsMember, readFirstKey, nil, -3, flagReadOnly)
 	RegisterCommand("SInter", execSInter, prepareSetCalculate, nil, -2, flagReadOnly)
+	RegisterCommand("SInterCard", execSInterCard, prepareSInterCard, nil, -3, flagReadOnly)
 	RegisterCommand("SInterStore", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
 	RegisterCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2, flagReadOnly)
 	RegisterCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite)
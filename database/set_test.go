@@ -141,6 +141,51 @@ func TestSInter(t *testing.T) {
 	asserts.AssertIntReply(t, result, 0)
 }
 
+func TestSInterCard(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key1, "a", "b", "c", "d"))
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key2, "b", "c", "d", "e"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "2"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "0"))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "1", key1))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, utils.RandString(10)))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "0", key1))
+	asserts.AssertErrReply(t, result, "ERR numkeys should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "3", key1, key2))
+	asserts.AssertErrReply(t, result, "ERR Number of keys can't be greater than number of args")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "limit", "-1"))
+	asserts.AssertErrReply(t, result, "ERR LIMIT can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "1", key1, key2))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+}
+
+func TestSMIsMember(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "a", "b"))
+	result := testDB.Exec(nil, utils.ToCmdLine("smismember", key, "a", "c", "b"))
+	asserts.AssertMultiBulkReplySize(t, result, 3)
+	expected := "*3\r\n:1\r\n:0\r\n:1\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("smismember", utils.RandString(10), "a"))
+	expected = "*1\r\n:0\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, result.ToBytes())
+	}
+}
+
 func TestSUnion(t *testing.T) {
 	testDB.Flush()
 	size := 100
@@ -249,3 +294,14 @@ func TestSRandMember(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("SRandMember", key, "-110"))
 	asserts.AssertMultiBulkReplySize(t, result, 110)
 }
+
+func TestSRandMemberMissingKey(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("srandmember", key))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key, "-5"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key, "5"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+}
@@ -2,14 +2,19 @@
 package database
 
 import (
+	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/datastruct/dict"
 	"github.com/hdt3213/godis/datastruct/lock"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
-	"github.com/hdt3213/godis/lib/logger"
-	"github.com/hdt3213/godis/lib/timewheel"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/script"
+	"github.com/hdt3213/godis/tracking"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +22,8 @@ const (
 	dataDictSize = 1 << 16
 	ttlDictSize  = 1 << 10
 	lockerSize   = 1024
+	// commands from master lock a few keys at a time
+	masterKeysDictSize = 16
 )
 
 // DB stores data and execute user's commands
@@ -33,6 +40,29 @@ type DB struct {
 	// use this mutex for complicated command only, eg. rpush, incr ...
 	locker *lock.Locks
 	addAof func(CmdLine)
+	// isReplica reports whether MultiDB is a replica, expired keys of replica are kept until DEL from master
+	isReplica func() bool
+	// keys accessed by the command from master being executed, they are visible on replica even if expired
+	masterKeys dict.Dict
+	// clients blocked by BLPOP and other blocking commands
+	blocking *blockingRegistry
+	// WATCH of clients connected to other nodes in cluster mode
+	watchers *watchRegistry
+	// clients of client side caching, shared by all databases of MultiDB, nil if not supported
+	tracking *tracking.Table
+	// compiled lua scripts, shared by all databases of MultiDB, nil if not supported
+	scripts *script.Cache
+	// running lua scripts, shared by all databases of MultiDB, nil if not supported
+	scriptMonitor *script.Monitor
+	// function libraries, shared by all databases of MultiDB, nil if not supported
+	functions *script.Functions
+	// snapshot holds *dbSnapshot while aof is being rewritten, see MultiDB.TakeSnapshot
+	snapshot atomic.Value
+	// snapshotGate prevents commands from modifying keys while snapshot being taken,
+	// shared by all databases of MultiDB, nil if not supported
+	snapshotGate *sync.RWMutex
+	// keys of each hash slot, it is maintained in cluster slots mode only, otherwise nil
+	slots *slotIndex
 }
 
 // ExecFunc is interface for command executor
@@ -58,6 +88,13 @@ func makeDB() *DB {
 		versionMap: dict.MakeConcurrent(dataDictSize),
 		locker:     lock.Make(lockerSize),
 		addAof:     func(line CmdLine) {},
+		isReplica:  func() bool { return false },
+		masterKeys: dict.MakeConcurrent(masterKeysDictSize),
+		blocking:   makeBlockingRegistry(),
+		watchers:   makeWatchRegistry(),
+	}
+	if config.Properties().ClusterHashMode == "slots" {
+		db.slots = makeSlotIndex()
 	}
 	return db
 }
@@ -71,6 +108,10 @@ func makeBasicDB() *DB {
 		versionMap: dict.MakeSimple(),
 		locker:     lock.Make(1),
 		addAof:     func(line CmdLine) {},
+		isReplica:  func() bool { return false },
+		masterKeys: dict.MakeSimple(),
+		blocking:   makeBlockingRegistry(),
+		watchers:   makeWatchRegistry(),
 	}
 	return db
 }
@@ -105,10 +146,10 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		return EnqueueCmd(c, cmdLine)
 	}
 
-	return db.execNormalCommand(cmdLine)
+	return db.execNormalCommand(c, cmdLine)
 }
 
-func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
+func (db *DB) execNormalCommand(c redis.Connection, cmdLine [][]byte) redis.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	cmd, ok := cmdTable[cmdName]
 	if !ok {
@@ -117,16 +158,31 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	if !validateArity(cmd.arity, cmdLine) {
 		return protocol.MakeArgNumErrReply(cmdName)
 	}
+	if cmd.flags&flagBlocking > 0 || (cmd.flags&flagBlockOption > 0 && findBlockOption(cmdLine[1:]) != nil) {
+		return db.execBlockingCommand(c, cmd, cmdLine)
+	}
 
 	prepare := cmd.prepare
 	write, read := prepare(cmdLine[1:]) // return key, nil
 	db.addVersion(write...)
 	db.RWLocks(write, read)
 	defer db.RWUnLocks(write, read)
+	if isFromMaster(c) {
+		db.markMasterKeys(write, read)
+		defer db.unmarkMasterKeys(write, read)
+	}
 
 	// 上面都是key进行了处理，比如key的版本
 	fun := cmd.executor // executor才是把key与val对应起来的
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	db.updateEncodings(write...)
+	// tracking is updated before unlock, so a client can't read a key modified after its invalidation was sent
+	if len(write) > 0 {
+		db.tracking.Invalidate(c, write)
+	} else if cmd.flags&flagReadOnly > 0 {
+		db.tracking.Remember(c, read)
+	}
+	return result
 }
 
 // execWithLock executes normal commands, invoker should provide locks
@@ -140,7 +196,12 @@ func (db *DB) execWithLock(cmdLine [][]byte) redis.Reply {
 		return protocol.MakeArgNumErrReply(cmdName)
 	}
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	if cmd.prepare != nil {
+		write, _ := cmd.prepare(cmdLine[1:])
+		db.updateEncodings(write...)
+	}
+	return result
 }
 
 func validateArity(arity int, cmdArgs [][]byte) bool {
@@ -155,6 +216,7 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 
 // GetEntity returns DataEntity bind to given key
 func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
+	db.preserve(key)
 	raw, ok := db.data.Get(key)
 	if !ok {
 		return nil, false
@@ -163,30 +225,46 @@ func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
 		return nil, false
 	}
 	entity, _ := raw.(*database.DataEntity)
+	entity.Touch()
 	return entity, true
 }
 
 // PutEntity a DataEntity into DB
 func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
+	db.preserve(key)
+	entity.Touch()
+	if db.slots != nil {
+		db.slots.add(key)
+	}
 	return db.data.Put(key, entity)
 }
 
 // PutIfExists edit an existing DataEntity
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
+	db.preserve(key)
+	entity.Touch()
 	return db.data.PutIfExists(key, entity)
 }
 
 // PutIfAbsent insert an DataEntity only if the key not exists
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
-	return db.data.PutIfAbsent(key, entity)
+	db.preserve(key)
+	entity.Touch()
+	result := db.data.PutIfAbsent(key, entity)
+	if result > 0 && db.slots != nil {
+		db.slots.add(key)
+	}
+	return result
 }
 
 // Remove the given key from db
 func (db *DB) Remove(key string) {
+	db.preserve(key)
 	db.data.Remove(key)
 	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
-	timewheel.Cancel(taskKey)
+	if db.slots != nil {
+		db.slots.remove(key)
+	}
 }
 
 // Removes the given keys from db
@@ -206,70 +284,106 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 // deprecated
 // for test only
 func (db *DB) Flush() {
+	if s, _ := db.snapshot.Load().(*dbSnapshot); s != nil {
+		s.saveAll()
+	}
 	db.data.Clear()
 	db.ttlMap.Clear()
+	if db.slots != nil {
+		db.slots.clear()
+	}
 	db.locker = lock.Make(lockerSize)
+	db.watchers.touchAll()
 }
 
 /* ---- Lock Function ----- */
 
 // RWLocks lock keys for writing and reading
 func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	if db.snapshotGate != nil {
+		db.snapshotGate.RLock()
+	}
 	db.locker.RWLocks(writeKeys, readKeys)
 }
 
 // RWUnLocks unlock keys for writing and reading
 func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.locker.RWUnLocks(writeKeys, readKeys)
+	if db.snapshotGate != nil {
+		db.snapshotGate.RUnlock()
+	}
 }
 
 /* ---- TTL Functions ---- */
 
-func genExpireTask(key string) string {
-	return "expire:" + key
-}
-
-// Expire sets ttlCmd of key
+// Expire sets ttlCmd of key, expired key is removed when accessed or by active expire cycle
 func (db *DB) Expire(key string, expireTime time.Time) {
+	db.preserve(key)
 	db.ttlMap.Put(key, expireTime)
-	taskKey := genExpireTask(key)
-	timewheel.At(expireTime, taskKey, func() {
-		keys := []string{key}
-		db.RWLocks(keys, nil)
-		defer db.RWUnLocks(keys, nil)
-		// check-lock-check, ttl may be updated during waiting lock
-		logger.Info("expire " + key)
-		rawExpireTime, ok := db.ttlMap.Get(key)
-		if !ok {
-			return
-		}
-		expireTime, _ := rawExpireTime.(time.Time)
-		expired := time.Now().After(expireTime)
-		if expired {
-			db.Remove(key)
-		}
-	})
 }
 
 // Persist cancel ttlCmd of key
 func (db *DB) Persist(key string) {
+	db.preserve(key)
 	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
-	timewheel.Cancel(taskKey)
 }
 
-// IsExpired check whether a key is expired
+// GetExpiration returns the expiration time of key, the second return value is false if key has no ttl
+func (db *DB) GetExpiration(key string) (time.Time, bool) {
+	raw, ok := db.ttlMap.Get(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	expireTime, _ := raw.(time.Time)
+	return expireTime, true
+}
+
+// IsExpired check whether a key is expired, expired key is removed and DEL is written into aof so that slaves remove it too.
+// Replica never removes expired keys by itself, they are invisible to clients but visible to commands from master.
 func (db *DB) IsExpired(key string) bool {
 	rawExpireTime, ok := db.ttlMap.Get(key)
 	if !ok {
 		return false
 	}
 	expireTime, _ := rawExpireTime.(time.Time)
-	expired := time.Now().After(expireTime)
-	if expired {
-		db.Remove(key)
+	if !time.Now().After(expireTime) {
+		return false
+	}
+	if db.isReplica() {
+		_, fromMaster := db.masterKeys.Get(key)
+		return !fromMaster
+	}
+	db.Remove(key)
+	db.tracking.Invalidate(nil, []string{key})
+	db.addAof(utils.ToCmdLine("DEL", key))
+	return true
+}
+
+// isFromMaster returns whether the command is sent by master in replication stream
+func isFromMaster(c redis.Connection) bool {
+	return c != nil && c.GetRole() == connection.ReplicationRecvCli
+}
+
+// markMasterKeys makes keys of command from master visible even if expired, invoker should hold locks of keys
+func (db *DB) markMasterKeys(writeKeys []string, readKeys []string) {
+	if !db.isReplica() {
+		return
+	}
+	for _, key := range writeKeys {
+		db.masterKeys.Put(key, struct{}{})
+	}
+	for _, key := range readKeys {
+		db.masterKeys.Put(key, struct{}{})
+	}
+}
+
+func (db *DB) unmarkMasterKeys(writeKeys []string, readKeys []string) {
+	for _, key := range writeKeys {
+		db.masterKeys.Remove(key)
+	}
+	for _, key := range readKeys {
+		db.masterKeys.Remove(key)
 	}
-	return expired
 }
 
 /* --- add version --- */
@@ -279,6 +393,7 @@ func (db *DB) addVersion(keys ...string) {
 		versionCode := db.GetVersion(key)
 		db.versionMap.Put(key, versionCode+1)
 	}
+	db.watchers.touch(keys...)
 }
 
 // GetVersion returns version code for given key
@@ -303,3 +418,32 @@ func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration
 		return cb(key, entity, expiration)
 	})
 }
+
+// ForEachLocked traverses all the keys like ForEach, but each key is read locked while cb is accessing it,
+// so cb can read the entity safely while other commands are executing. Keys are listed before traversal,
+// since the lock of key can't be acquired while holding lock of the shard
+func (db *DB) ForEachLocked(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	for _, key := range db.data.Keys() {
+		if !db.readLocked(key, cb) {
+			return
+		}
+	}
+}
+
+func (db *DB) readLocked(key string, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) bool {
+	db.RWLocks(nil, []string{key})
+	defer db.RWUnLocks(nil, []string{key})
+	raw, ok := db.data.Get(key)
+	if !ok {
+		// removed after listed
+		return true
+	}
+	entity, _ := raw.(*database.DataEntity)
+	var expiration *time.Time
+	rawExpireTime, ok := db.ttlMap.Get(key)
+	if ok {
+		expireTime, _ := rawExpireTime.(time.Time)
+		expiration = &expireTime
+	}
+	return cb(key, entity, expiration)
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/slotmap"
+	"sync"
+)
+
+// slotIndex records keys of each hash slot in cluster slots mode,
+// so that keys of a slot are counted and listed without scanning the whole keyspace
+type slotIndex struct {
+	mu    sync.RWMutex
+	slots [slotmap.SlotCount]map[string]struct{}
+}
+
+func makeSlotIndex() *slotIndex {
+	return &slotIndex{}
+}
+
+func (index *slotIndex) add(key string) {
+	slot := slotmap.HashSlot(key)
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.slots[slot] == nil {
+		index.slots[slot] = make(map[string]struct{})
+	}
+	index.slots[slot][key] = struct{}{}
+}
+
+func (index *slotIndex) remove(key string) {
+	slot := slotmap.HashSlot(key)
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	keys := index.slots[slot]
+	delete(keys, key)
+	if len(keys) == 0 {
+		index.slots[slot] = nil
+	}
+}
+
+func (index *slotIndex) count(slot int) int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	return len(index.slots[slot])
+}
+
+// keys returns at most limit keys of the slot
+func (index *slotIndex) keys(slot int, limit int) []string {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	result := make([]string, 0, len(index.slots[slot]))
+	for key := range index.slots[slot] {
+		if len(result) >= limit {
+			break
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+func (index *slotIndex) clear() {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.slots = [slotmap.SlotCount]map[string]struct{}{}
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sync"
+	"time"
+)
+
+// snapshotScanCount is the number of keys collected at a time while traversing snapshot
+const snapshotScanCount = 1024
+
+// errSnapshotInProgress is returned by TakeSnapshot if the previous snapshot hasn't been released,
+// such as aof rewriting and full sync of replication at the same time
+var errSnapshotInProgress = errors.New("ERR another snapshot is in progress")
+
+// dbSnapshot is the point-in-time view of a DB, it is used to rewrite aof without copying the DB.
+// Before a key is accessed for the first time after snapshot taken, its original value is encoded and saved,
+// since the entity may be modified in place once it is got. Traversing skips saved keys,
+// so every key existed when snapshot taken is dumped with its original value.
+type dbSnapshot struct {
+	db     *DB
+	encode func(key string, data *database.DataEntity, expiration *time.Time) []byte
+	// mu protects saved and buffer, it also prevents keys from being accessed while they are dumped by traversing
+	mu sync.Mutex
+	// saved contains keys accessed after snapshot taken, including keys created after it
+	saved  map[string]struct{}
+	buffer bytes.Buffer
+	// released is set after the snapshot has been released, then no keys are saved
+	released bool
+}
+
+// save encodes the original value of key, if it hasn't been saved yet
+func (s *dbSnapshot) save(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	if _, ok := s.saved[key]; ok {
+		return
+	}
+	s.saved[key] = struct{}{}
+	entity, expiration, ok := s.db.getRawEntity(key)
+	if !ok {
+		return
+	}
+	// the key may have been dumped by traversing, so its value is restored from scratch
+	s.buffer.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("DEL", key)).ToBytes())
+	s.buffer.Write(s.encode(key, entity, expiration))
+}
+
+// saveAll encodes original values of all keys, it is invoked before the DB is cleared
+func (s *dbSnapshot) saveAll() {
+	for _, key := range s.db.data.Keys() {
+		s.save(key)
+	}
+}
+
+// forEach traverses keys which haven't been saved.
+// Keys are collected batch by batch, since saving a key needs the shard lock held by scanning
+func (s *dbSnapshot) forEach(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	cursor := 0
+	for {
+		var keys []string
+		cursor = s.db.data.Scan(cursor, snapshotScanCount, func(key string, raw interface{}) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			if !s.dump(key, cb) {
+				return
+			}
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+func (s *dbSnapshot) dump(key string, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.saved[key]; ok {
+		return true
+	}
+	entity, expiration, ok := s.db.getRawEntity(key)
+	if !ok {
+		return true
+	}
+	return cb(key, entity, expiration)
+}
+
+// release stops saving keys and returns encoded original values
+func (s *dbSnapshot) release() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return nil
+	}
+	s.released = true
+	s.db.snapshot.Store((*dbSnapshot)(nil))
+	data := s.buffer.Bytes()
+	s.saved = nil
+	s.buffer = bytes.Buffer{}
+	return data
+}
+
+// multiSnapshot is the point-in-time view of MultiDB, it implements database.Snapshot
+type multiSnapshot struct {
+	dbs       []*dbSnapshot
+	functions []string
+}
+
+// ForEach traverses keys of the given database which haven't been accessed since snapshot taken
+func (snapshot *multiSnapshot) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	snapshot.dbs[dbIndex].forEach(cb)
+}
+
+// GetDBSize returns the current key count and ttl key count of the database, which is only a hint for snapshot
+func (snapshot *multiSnapshot) GetDBSize(dbIndex int) (int, int) {
+	db := snapshot.dbs[dbIndex].db
+	return db.data.Len(), db.ttlMap.Len()
+}
+
+// GetFunctionLibraries returns code of function libraries loaded when snapshot taken
+func (snapshot *multiSnapshot) GetFunctionLibraries() []string {
+	return snapshot.functions
+}
+
+// Release stops saving original values, and returns them indexed by database
+func (snapshot *multiSnapshot) Release() [][]byte {
+	result := make([][]byte, len(snapshot.dbs))
+	for i, s := range snapshot.dbs {
+		result[i] = s.release()
+	}
+	return result
+}
+
+// TakeSnapshot takes a point-in-time view of all databases for aof rewriting, see database.EmbedDB
+func (mdb *MultiDB) TakeSnapshot(encode func(key string, data *database.DataEntity, expiration *time.Time) []byte,
+	cut func() error) (database.Snapshot, error) {
+	// wait for running commands, then no one is between modifying data and writing aof
+	mdb.snapshotGate.Lock()
+	defer mdb.snapshotGate.Unlock()
+	for i := range mdb.dbSet {
+		if s, _ := mdb.mustSelectDB(i).snapshot.Load().(*dbSnapshot); s != nil {
+			// a DB saves original values for only one snapshot
+			return nil, errSnapshotInProgress
+		}
+	}
+	err := cut()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &multiSnapshot{
+		dbs:       make([]*dbSnapshot, len(mdb.dbSet)),
+		functions: mdb.GetFunctionLibraries(),
+	}
+	for i := range mdb.dbSet {
+		db := mdb.mustSelectDB(i)
+		s := &dbSnapshot{
+			db:     db,
+			encode: encode,
+			saved:  make(map[string]struct{}),
+		}
+		db.snapshot.Store(s)
+		snapshot.dbs[i] = s
+	}
+	return snapshot, nil
+}
+
+// preserve saves the original value of key if a snapshot is taken.
+// It should be invoked before the key is accessed, since entity may be modified in place after got
+func (db *DB) preserve(key string) {
+	if s, _ := db.snapshot.Load().(*dbSnapshot); s != nil {
+		s.save(key)
+	}
+}
+
+// getRawEntity returns entity and expiration of key without checking expiration or touching it
+func (db *DB) getRawEntity(key string) (*database.DataEntity, *time.Time, bool) {
+	raw, ok := db.data.Get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	entity, _ := raw.(*database.DataEntity)
+	var expiration *time.Time
+	if rawExpireTime, ok := db.ttlMap.Get(key); ok {
+		expireTime, _ := rawExpireTime.(time.Time)
+		expiration = &expireTime
+	}
+	return entity, expiration, true
+}
@@ -0,0 +1,289 @@
+package database
+
+import (
+	"bytes"
+	Dict "github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/datastruct/list"
+	HashSet "github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type sortOption struct {
+	by         string
+	noSort     bool
+	getPattern []string
+	offset     int
+	count      int // -1 means no limit
+	desc       bool
+	alpha      bool
+	store      string
+}
+
+func parseSortOption(args [][]byte) (*sortOption, protocol.ErrorReply) {
+	option := &sortOption{
+		count: -1,
+	}
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "ASC":
+			option.desc = false
+		case arg == "DESC":
+			option.desc = true
+		case arg == "ALPHA":
+			option.alpha = true
+		case arg == "BY" && i+1 < len(args):
+			option.by = string(args[i+1])
+			// sorting by a pattern without '*' skips sorting, it is usually used with GET
+			option.noSort = !strings.Contains(option.by, "*")
+			i++
+		case arg == "GET" && i+1 < len(args):
+			option.getPattern = append(option.getPattern, string(args[i+1]))
+			i++
+		case arg == "STORE" && i+1 < len(args):
+			option.store = string(args[i+1])
+			i++
+		case arg == "LIMIT" && i+2 < len(args):
+			offset, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			count, err := strconv.Atoi(string(args[i+2]))
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			option.offset = offset
+			option.count = count
+			i += 2
+		default:
+			return nil, protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	return option, nil
+}
+
+// lookupByPattern replaces the first '*' in pattern with element then gets the string value or hash field it refers.
+// "#" refers to the element itself, "key_*->field" refers to field of hash.
+// Keys referred by pattern are not locked, they are read from concurrent dict directly.
+func (db *DB) lookupByPattern(pattern string, element []byte) []byte {
+	if pattern == "#" {
+		return element
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return nil
+	}
+	key := pattern[:star] + string(element) + pattern[star+1:]
+	field := ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		key = pattern[:star] + string(element) + pattern[star+1:star+1+arrow]
+		field = pattern[star+1+arrow+2:]
+	}
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil
+	}
+	if field == "" {
+		val, _ := entity.Data.([]byte)
+		return val
+	}
+	dict, ok := entity.Data.(Dict.Dict)
+	if !ok {
+		return nil
+	}
+	raw, ok := dict.Get(field)
+	if !ok {
+		return nil
+	}
+	val, _ := raw.([]byte)
+	return val
+}
+
+type sortElement struct {
+	value []byte
+	// weight is used in alpha mode
+	weight []byte
+	score  float64
+}
+
+// getSortElements returns elements of list, set or sorted set, sorted sets are in ascending order of score
+func (db *DB) getSortElements(key string) ([][]byte, bool, protocol.ErrorReply) {
+	entity, ok := db.GetEntity(key)
+	if !ok {
+		return nil, false, nil
+	}
+	var elements [][]byte
+	isSet := false
+	switch val := entity.Data.(type) {
+	case list.List:
+		elements = make([][]byte, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			element, _ := v.([]byte)
+			elements = append(elements, element)
+			return true
+		})
+	case *HashSet.Set:
+		isSet = true
+		elements = make([][]byte, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			elements = append(elements, []byte(member))
+			return true
+		})
+	case *SortedSet.SortedSet:
+		elements = make([][]byte, 0, val.Len())
+		if val.Len() > 0 {
+			val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+				elements = append(elements, []byte(element.Member))
+				return true
+			})
+		}
+	default:
+		return nil, false, &protocol.WrongTypeErrReply{}
+	}
+	return elements, isSet, nil
+}
+
+// execSort sorts elements of list, set or sorted set
+func execSort(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	option, errReply := parseSortOption(args)
+	if errReply != nil {
+		return errReply
+	}
+	elements, isSet, errReply := db.getSortElements(key)
+	if errReply != nil {
+		return errReply
+	}
+
+	sortElements := make([]*sortElement, len(elements))
+	for i, element := range elements {
+		sortElements[i] = &sortElement{value: element}
+	}
+	// the order of set members is undefined, sort them lexicographically to make the result deterministic
+	if option.noSort && isSet {
+		option.noSort = false
+		option.alpha = true
+		option.by = ""
+	}
+	if !option.noSort {
+		for _, element := range sortElements {
+			weight := element.value
+			if option.by != "" {
+				weight = db.lookupByPattern(option.by, element.value)
+			}
+			if option.alpha {
+				element.weight = weight
+				continue
+			}
+			if weight == nil {
+				continue // missing weight is regarded as 0
+			}
+			score, err := strconv.ParseFloat(string(weight), 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR One or more scores can't be converted into double")
+			}
+			element.score = score
+		}
+		sort.Slice(sortElements, func(i, j int) bool {
+			a, b := sortElements[i], sortElements[j]
+			var cmp int
+			if option.alpha {
+				cmp = bytes.Compare(a.weight, b.weight)
+			} else if a.score < b.score {
+				cmp = -1
+			} else if a.score > b.score {
+				cmp = 1
+			} else {
+				// elements with same score are compared lexicographically
+				cmp = bytes.Compare(a.value, b.value)
+			}
+			if option.desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	} else if option.desc {
+		for i, j := 0, len(sortElements)-1; i < j; i, j = i+1, j-1 {
+			sortElements[i], sortElements[j] = sortElements[j], sortElements[i]
+		}
+	}
+
+	// limit
+	start := option.offset
+	if start < 0 {
+		start = 0
+	}
+	if start > len(sortElements) {
+		start = len(sortElements)
+	}
+	end := len(sortElements)
+	if option.count >= 0 && start+option.count < end {
+		end = start + option.count
+	}
+	sortElements = sortElements[start:end]
+
+	getCount := len(option.getPattern)
+	if getCount == 0 {
+		getCount = 1
+	}
+	result := make([][]byte, 0, len(sortElements)*getCount)
+	for _, element := range sortElements {
+		if len(option.getPattern) == 0 {
+			result = append(result, element.value)
+			continue
+		}
+		for _, pattern := range option.getPattern {
+			result = append(result, db.lookupByPattern(pattern, element.value))
+		}
+	}
+
+	if option.store == "" {
+		return protocol.MakeMultiBulkReply(result)
+	}
+	db.Remove(option.store)
+	db.addAof(utils.ToCmdLine("del", option.store))
+	if len(result) == 0 {
+		return protocol.MakeIntReply(0)
+	}
+	storeList := list.NewQuickList()
+	for i, val := range result {
+		if val == nil {
+			result[i] = []byte{}
+		}
+		storeList.Add(result[i])
+	}
+	db.PutEntity(option.store, &database.DataEntity{
+		Data: storeList,
+	})
+	db.addAof(utils.ToCmdLine3("rpush", append([][]byte{[]byte(option.store)}, result...)...))
+	return protocol.MakeIntReply(int64(len(result)))
+}
+
+// prepareSort returns the STORE destination as write key.
+func prepareSort(args [][]byte) ([]string, []string) {
+	key := string(args[0])
+	option, errReply := parseSortOption(args)
+	if errReply != nil || option.store == "" {
+		return nil, []string{key}
+	}
+	return []string{option.store}, []string{key}
+}
+
+func undoSort(db *DB, args [][]byte) []CmdLine {
+	writeKeys, _ := prepareSort(args)
+	if len(writeKeys) == 0 {
+		return nil
+	}
+	return rollbackGivenKeys(db, writeKeys...)
+}
+
+func init() {
+	RegisterCommand("Sort", execSort, prepareSort, undoSort, -2, flagWrite)
+}
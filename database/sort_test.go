@@ -0,0 +1,95 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestSort(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "3", "1", "2", "10"))
+	result := testDB.Exec(nil, utils.ToCmdLine("sort", key))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "2", "3", "10"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "desc"))
+	asserts.AssertMultiBulkReply(t, result, []string{"10", "3", "2", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "alpha"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "10", "2", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "limit", "1", "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"2", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "limit", "3", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"10"})
+
+	// set and sorted set
+	setKey := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", setKey, "b", "c", "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey, "alpha", "desc"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "b", "a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey, "by", "nosort"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c"})
+	zsetKey := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", zsetKey, "1", "z", "2", "y", "3", "x"))
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", zsetKey, "by", "nosort", "desc"))
+	asserts.AssertMultiBulkReply(t, result, []string{"x", "y", "z"})
+
+	// BY and GET external keys
+	for _, member := range []string{"a", "b", "c"} {
+		testDB.Exec(nil, utils.ToCmdLine("hset", "info_"+member, "age", map[string]string{"a": "30", "b": "10", "c": "20"}[member]))
+		testDB.Exec(nil, utils.ToCmdLine("set", "name_"+member, "name-"+member))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("set", "weight_a", "3"))
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey, "by", "info_*->age"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey, "by", "weight_*", "get", "#", "get", "name_*", "get", "info_*->age"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "name-b", "10", "c", "name-c", "20", "a", "name-a", "30"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey, "alpha", "get", "missing_*"))
+	asserts.AssertMultiBulkReplySize(t, result, 3)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", setKey))
+	asserts.AssertErrReply(t, result, "ERR One or more scores can't be converted into double")
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "limit", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", "name_a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key+"a"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+}
+
+func TestSortStore(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "3", "1", "2"))
+	result := testDB.Exec(nil, utils.ToCmdLine("sort", key, "store", dest))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "2", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key, "get", "missing_*", "store", dest))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"", "", ""})
+	result = testDB.Exec(nil, utils.ToCmdLine("sort", key+"a", "store", dest))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestUndoSort(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "3", "1", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "a"))
+	cmdLine := utils.ToCmdLine("sort", key, "store", dest)
+	undoCmdLines := undoSort(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, result, "a")
+	if undoSort(testDB, utils.ToCmdLine("sort", key)[1:]) != nil {
+		t.Error("expect no undo log without store")
+	}
+}
@@ -1,11 +1,13 @@
 package database
 
 import (
+	HashSet "github.com/hdt3213/godis/datastruct/set"
 	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -38,51 +40,148 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 	return sortedSet, inited, nil
 }
 
-// execZAdd adds member into sorted set
-func execZAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args)%2 != 1 {
-		return protocol.MakeSyntaxErrReply()
+// zAddOption is the flags of ZADD
+type zAddOption struct {
+	nx   bool // only add new members
+	xx   bool // only update existing members
+	gt   bool // only update existing members if new score is greater
+	lt   bool // only update existing members if new score is less
+	ch   bool // reply number of changed members including added and updated
+	incr bool // increase score like ZINCRBY
+}
+
+// parseZAddArgs parses: key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func parseZAddArgs(args [][]byte) (*zAddOption, []*SortedSet.Element, protocol.ErrorReply) {
+	option := &zAddOption{}
+	i := 1
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			option.nx = true
+		case "XX":
+			option.xx = true
+		case "GT":
+			option.gt = true
+		case "LT":
+			option.lt = true
+		case "CH":
+			option.ch = true
+		case "INCR":
+			option.incr = true
+		default:
+			break loop
+		}
 	}
-	key := string(args[0])
-	size := (len(args) - 1) / 2
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	if option.nx && option.xx {
+		return nil, nil, protocol.MakeErrReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if (option.gt && option.lt) || (option.nx && (option.gt || option.lt)) {
+		return nil, nil, protocol.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if option.incr && len(pairs) > 2 {
+		return nil, nil, protocol.MakeErrReply("ERR INCR option supports a single increment-element pair")
+	}
+	size := len(pairs) / 2
 	elements := make([]*SortedSet.Element, size)
-	for i := 0; i < size; i++ {
-		scoreValue := args[2*i+1]
-		member := string(args[2*i+2])
-		score, err := strconv.ParseFloat(string(scoreValue), 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not a valid float")
+	for j := 0; j < size; j++ {
+		score, err := strconv.ParseFloat(string(pairs[2*j]), 64)
+		if err != nil || math.IsNaN(score) {
+			return nil, nil, protocol.MakeErrReply("ERR value is not a valid float")
 		}
-		elements[i] = &SortedSet.Element{
-			Member: member,
+		elements[j] = &SortedSet.Element{
+			Member: string(pairs[2*j+1]),
 			Score:  score,
 		}
 	}
+	return option, elements, nil
+}
 
-	// get or init entity
-	sortedSet, _, errReply := db.getOrInitSortedSet(key)
+// execZAdd adds member into sorted set
+func execZAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	option, elements, errReply := parseZAddArgs(args)
 	if errReply != nil {
 		return errReply
 	}
 
-	i := 0
-	for _, e := range elements {
-		if sortedSet.Add(e.Member, e.Score) {
-			i++
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		if option.xx {
+			// nothing to update
+			if option.incr {
+				return &protocol.NullBulkReply{}
+			}
+			return protocol.MakeIntReply(0)
+		}
+		sortedSet, _, errReply = db.getOrInitSortedSet(key)
+		if errReply != nil {
+			return errReply
 		}
 	}
 
-	db.addAof(utils.ToCmdLine3("zadd", args...))
+	added := 0
+	updated := 0
+	var incrScore float64
+	incrDone := false
+	for _, e := range elements {
+		score := e.Score
+		current, exists := sortedSet.Get(e.Member)
+		if exists && option.incr {
+			score += current.Score
+			if math.IsNaN(score) {
+				return protocol.MakeErrReply("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if exists {
+			if option.nx || (option.gt && score <= current.Score) || (option.lt && score >= current.Score) {
+				continue
+			}
+		} else if option.xx {
+			continue
+		}
+		if !exists {
+			added++
+		} else if score != current.Score {
+			updated++
+		}
+		sortedSet.Add(e.Member, score)
+		incrScore = score
+		incrDone = true
+	}
 
-	return protocol.MakeIntReply(int64(i))
+	if added > 0 || updated > 0 {
+		db.notifyWaiters(key)
+		db.addAof(utils.ToCmdLine3("zadd", args...))
+	}
+	if option.incr {
+		if !incrDone {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(strconv.FormatFloat(incrScore, 'f', -1, 64)))
+	}
+	if option.ch {
+		return protocol.MakeIntReply(int64(added + updated))
+	}
+	return protocol.MakeIntReply(int64(added))
 }
 
 func undoZAdd(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
-	size := (len(args) - 1) / 2
-	fields := make([]string, size)
-	for i := 0; i < size; i++ {
-		fields[i] = string(args[2*i+2])
+	_, elements, errReply := parseZAddArgs(args)
+	if errReply != nil {
+		return nil
+	}
+	fields := make([]string, len(elements))
+	for i, e := range elements {
+		fields[i] = e.Member
 	}
 	return rollbackZSetFields(db, key, fields...)
 }
@@ -170,29 +269,68 @@ func execZCard(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(sortedSet.Len())
 }
 
-// execZRange gets members in range, sort by score in ascending order
-func execZRange(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 && len(args) != 4 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'zrange' command")
+// execZRandMember returns random members from sorted set.
+// Positive count returns distinct members, negative count allows the same member to be returned multiple times.
+func execZRandMember(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 3 {
+		return protocol.MakeErrReply("ERR syntax error")
 	}
+	key := string(args[0])
 	withScores := false
-	if len(args) == 4 {
-		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
-			return protocol.MakeErrReply("syntax error")
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHSCORES" {
+			return protocol.MakeErrReply("ERR syntax error")
 		}
 		withScores = true
 	}
+	var count int64
+	if len(args) >= 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		// without count, returns a single member as bulk string
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(sortedSet.RandomMembers(1)[0].Member))
+	}
+	if sortedSet == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	var elements []*SortedSet.Element
+	if count > 0 {
+		elements = sortedSet.RandomDistinctMembers(int(count))
+	} else {
+		elements = sortedSet.RandomMembers(int(-count))
+	}
+	return zElementsReply(elements, withScores)
+}
+
+// execZRange gets members in range
+// usage: ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func execZRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	start, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	spec, errReply := parseZRangeSpec(args[1:], true)
+	if errReply != nil {
+		return errReply
 	}
-	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
 	}
-	return range0(db, key, start, stop, withScores, false)
+	return zElementsReply(spec.apply(sortedSet), spec.withScores)
 }
 
 // execZRevRange gets members in range, sort by score in descending order
@@ -229,15 +367,19 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 	if sortedSet == nil {
 		return &protocol.EmptyMultiBulkReply{}
 	}
+	return zElementsReply(rangeByRank(sortedSet, start, stop, desc), withScores)
+}
 
+// rangeByRank returns members within rank [start, stop], negative rank counts from the end
+func rangeByRank(sortedSet *SortedSet.SortedSet, start int64, stop int64, desc bool) []*SortedSet.Element {
 	// compute index
-	size := sortedSet.Len() // assert: size > 0
+	size := sortedSet.Len()
 	if start < -1*size {
 		start = 0
 	} else if start < 0 {
 		start = size + start
 	} else if start >= size {
-		return &protocol.EmptyMultiBulkReply{}
+		return nil
 	}
 	if stop < -1*size {
 		stop = 0
@@ -253,28 +395,143 @@ func range0(db *DB, key string, start int64, stop int64, withScores bool, desc b
 	}
 
 	// assert: start in [0, size - 1], stop in [start, size]
-	slice := sortedSet.Range(start, stop, desc)
+	return sortedSet.Range(start, stop, desc)
+}
+
+// zElementsReply converts elements into reply, scores follow their members if withScores is true
+func zElementsReply(elements []*SortedSet.Element, withScores bool) redis.Reply {
 	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
+		result := make([][]byte, 0, len(elements)*2)
+		for _, element := range elements {
 			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
+			result = append(result, []byte(element.Member), []byte(scoreStr))
 		}
 		return protocol.MakeMultiBulkReply(result)
 	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
+	result := make([][]byte, len(elements))
+	for i, element := range elements {
 		result[i] = []byte(element.Member)
-		i++
 	}
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// zRangeSpec is the parsed arguments of unified ZRANGE and ZRANGESTORE
+type zRangeSpec struct {
+	start      int64
+	stop       int64
+	min        SortedSet.Border
+	max        SortedSet.Border
+	byScore    bool
+	byLex      bool
+	rev        bool
+	offset     int64
+	limit      int64 // limit < 0 means no limit
+	withScores bool
+}
+
+// parseZRangeSpec parses: start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func parseZRangeSpec(args [][]byte, allowWithScores bool) (*zRangeSpec, protocol.ErrorReply) {
+	spec := &zRangeSpec{
+		limit: -1,
+	}
+	hasLimit := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BYSCORE":
+			spec.byScore = true
+		case "BYLEX":
+			spec.byLex = true
+		case "REV":
+			spec.rev = true
+		case "WITHSCORES":
+			if !allowWithScores {
+				return nil, protocol.MakeErrReply("ERR syntax error")
+			}
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return nil, protocol.MakeErrReply("ERR syntax error")
+			}
+			var err error
+			spec.offset, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			spec.limit, err = strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			hasLimit = true
+			i += 2
+		default:
+			return nil, protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	if spec.byScore && spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	if hasLimit && !spec.byScore && !spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.withScores && spec.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	if spec.byScore || spec.byLex {
+		// in reverse order, the first border is max
+		minArg, maxArg := args[0], args[1]
+		if spec.rev {
+			minArg, maxArg = maxArg, minArg
+		}
+		var errReply protocol.ErrorReply
+		spec.min, spec.max, errReply = parseBorders(string(minArg), string(maxArg), spec.byLex)
+		if errReply != nil {
+			return nil, errReply
+		}
+		return spec, nil
+	}
+	var err error
+	spec.start, err = strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	spec.stop, err = strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return spec, nil
+}
+
+// parseBorders parses min and max as lex borders if byLex is true, otherwise parses them as score borders
+func parseBorders(minArg string, maxArg string, byLex bool) (SortedSet.Border, SortedSet.Border, protocol.ErrorReply) {
+	if byLex {
+		min, err := SortedSet.ParseLexBorder(minArg)
+		if err != nil {
+			return nil, nil, protocol.MakeErrReply(err.Error())
+		}
+		max, err := SortedSet.ParseLexBorder(maxArg)
+		if err != nil {
+			return nil, nil, protocol.MakeErrReply(err.Error())
+		}
+		return min, max, nil
+	}
+	min, err := SortedSet.ParseScoreBorder(minArg)
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	max, err := SortedSet.ParseScoreBorder(maxArg)
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	return min, max, nil
+}
+
+func (spec *zRangeSpec) apply(sortedSet *SortedSet.SortedSet) []*SortedSet.Element {
+	if spec.byScore || spec.byLex {
+		return sortedSet.RangeByBorder(spec.min, spec.max, spec.offset, spec.limit, spec.rev)
+	}
+	return rangeByRank(sortedSet, spec.start, spec.stop, spec.rev)
+}
+
 // execZCount gets number of members which score within given range
 func execZCount(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -314,26 +571,8 @@ func rangeByScore0(db *DB, key string, min *SortedSet.ScoreBorder, max *SortedSe
 		return &protocol.EmptyMultiBulkReply{}
 	}
 
-	slice := sortedSet.RangeByScore(min, max, offset, limit, desc)
-	if withScores {
-		result := make([][]byte, len(slice)*2)
-		i := 0
-		for _, element := range slice {
-			result[i] = []byte(element.Member)
-			i++
-			scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
-			result[i] = []byte(scoreStr)
-			i++
-		}
-		return protocol.MakeMultiBulkReply(result)
-	}
-	result := make([][]byte, len(slice))
-	i := 0
-	for _, element := range slice {
-		result[i] = []byte(element.Member)
-		i++
-	}
-	return protocol.MakeMultiBulkReply(result)
+	slice := sortedSet.RangeByBorder(min, max, offset, limit, desc)
+	return zElementsReply(slice, withScores)
 }
 
 // execZRangeByScore gets members which score within given range, in ascending order
@@ -430,6 +669,90 @@ func execZRevRangeByScore(db *DB, args [][]byte) redis.Reply {
 	return rangeByScore0(db, key, min, max, offset, limit, withScores, true)
 }
 
+// execZRangeByLex usage: ZRANGEBYLEX key min max [LIMIT offset count]
+func execZRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, false)
+}
+
+// execZRevRangeByLex usage: ZREVRANGEBYLEX key max min [LIMIT offset count]
+func execZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, true)
+}
+
+func rangeByLex0(db *DB, args [][]byte, desc bool) redis.Reply {
+	key := string(args[0])
+	minArg, maxArg := string(args[1]), string(args[2])
+	if desc {
+		minArg, maxArg = maxArg, minArg
+	}
+	min, max, errReply := parseBorders(minArg, maxArg, true)
+	if errReply != nil {
+		return errReply
+	}
+	var offset int64 = 0
+	var limit int64 = -1
+	if len(args) > 3 {
+		if len(args) != 6 || strings.ToUpper(string(args[3])) != "LIMIT" {
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+		var err error
+		offset, err = strconv.ParseInt(string(args[4]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		limit, err = strconv.ParseInt(string(args[5]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return zElementsReply(sortedSet.RangeByBorder(min, max, offset, limit, desc), false)
+}
+
+// execZLexCount returns number of members between min and max, all members should have the same score
+func execZLexCount(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	min, max, errReply := parseBorders(string(args[1]), string(args[2]), true)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(sortedSet.Count(min, max))
+}
+
+// execZRemRangeByLex removes members between min and max, all members should have the same score
+func execZRemRangeByLex(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	min, max, errReply := parseBorders(string(args[1]), string(args[2]), true)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	removed := sortedSet.RemoveByBorder(min, max)
+	if removed > 0 {
+		db.addAof(utils.ToCmdLine3("zremrangebylex", args...))
+	}
+	return protocol.MakeIntReply(removed)
+}
+
 // execZRemRangeByScore removes members which score within given range
 func execZRemRangeByScore(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 3 {
@@ -456,7 +779,7 @@ func execZRemRangeByScore(db *DB, args [][]byte) redis.Reply {
 		return &protocol.EmptyMultiBulkReply{}
 	}
 
-	removed := sortedSet.RemoveByScore(min, max)
+	removed := sortedSet.RemoveByBorder(min, max)
 	if removed > 0 {
 		db.addAof(utils.ToCmdLine3("zremrangebyscore", args...))
 	}
@@ -605,6 +928,7 @@ func execZIncrBy(db *DB, args [][]byte) redis.Reply {
 	element, exists := sortedSet.Get(field)
 	if !exists {
 		sortedSet.Add(field, delta)
+		db.notifyWaiters(key)
 		db.addAof(utils.ToCmdLine3("zincrby", args...))
 		return protocol.MakeBulkReply(args[1])
 	}
@@ -621,6 +945,323 @@ func undoZIncr(db *DB, args [][]byte) []CmdLine {
 	return rollbackZSetFields(db, key, field)
 }
 
+// execBZPopMin pops the member with the lowest score from the first non-empty sorted set, blocks if all sets are empty
+func execBZPopMin(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[len(args)-1]); errReply != nil {
+		return errReply
+	}
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if sortedSet == nil || sortedSet.Len() == 0 {
+			continue
+		}
+		element := sortedSet.PopMin(1)[0]
+		if sortedSet.Len() == 0 {
+			db.Remove(key)
+		}
+		db.addAof(utils.ToCmdLine3("zpopmin", arg))
+		scoreStr := strconv.FormatFloat(element.Score, 'f', -1, 64)
+		return protocol.MakeMultiBulkReply([][]byte{arg, []byte(element.Member), []byte(scoreStr)})
+	}
+	return &protocol.NullMultiBulkReply{}
+}
+
+// execZRangeStore stores members in range into destination
+// usage: ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func execZRangeStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	src := string(args[1])
+	spec, errReply := parseZRangeSpec(args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	result := SortedSet.Make()
+	if sortedSet != nil {
+		for _, element := range spec.apply(sortedSet) {
+			result.Add(element.Member, element.Score)
+		}
+	}
+	return db.storeZSetResult(dest, result, utils.ToCmdLine3("zrangestore", args...))
+}
+
+// storeZSetResult overwrites dest with result, an empty result removes dest
+func (db *DB) storeZSetResult(dest string, result *SortedSet.SortedSet, cmdLine CmdLine) redis.Reply {
+	db.Remove(dest)
+	if result.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+		db.notifyWaiters(dest)
+	}
+	db.addAof(cmdLine)
+	return protocol.MakeIntReply(result.Len())
+}
+
+func prepareZRangeStore(args [][]byte) ([]string, []string) {
+	return []string{string(args[0])}, []string{string(args[1])}
+}
+
+const (
+	aggregateSum = iota
+	aggregateMin
+	aggregateMax
+)
+
+// zSetOpOption is the parsed arguments of ZUNION, ZINTER, ZDIFF and their STORE variants
+type zSetOpOption struct {
+	keys       []string
+	weights    []float64
+	aggregate  int
+	withScores bool
+}
+
+// parseZSetOpOption parses: numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+// ZDIFF doesn't support WEIGHTS and AGGREGATE, STORE variants don't support WITHSCORES
+func parseZSetOpOption(cmdName string, args [][]byte, allowWeights bool, allowWithScores bool) (*zSetOpOption, protocol.ErrorReply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 1 {
+		return nil, protocol.MakeErrReply("ERR at least 1 input key is needed for '" + cmdName + "' command")
+	}
+	if numKeys > len(args)-1 {
+		return nil, protocol.MakeErrReply("ERR syntax error")
+	}
+	option := &zSetOpOption{
+		keys:    make([]string, numKeys),
+		weights: make([]float64, numKeys),
+	}
+	for i := 0; i < numKeys; i++ {
+		option.keys[i] = string(args[i+1])
+		option.weights[i] = 1
+	}
+	for i := numKeys + 1; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "WEIGHTS" && allowWeights && i+numKeys < len(args):
+			for j := 0; j < numKeys; j++ {
+				weight, err := strconv.ParseFloat(string(args[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return nil, protocol.MakeErrReply("ERR weight value is not a float")
+				}
+				option.weights[j] = weight
+			}
+			i += numKeys
+		case arg == "AGGREGATE" && allowWeights && i+1 < len(args):
+			switch strings.ToUpper(string(args[i+1])) {
+			case "SUM":
+				option.aggregate = aggregateSum
+			case "MIN":
+				option.aggregate = aggregateMin
+			case "MAX":
+				option.aggregate = aggregateMax
+			default:
+				return nil, protocol.MakeErrReply("ERR syntax error")
+			}
+			i++
+		case arg == "WITHSCORES" && allowWithScores:
+			option.withScores = true
+		default:
+			return nil, protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	return option, nil
+}
+
+// getAsZSetOperand returns sorted set for set operations, members of a plain set are regarded as having score 1
+func (db *DB) getAsZSetOperand(key string) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return nil, nil
+	}
+	switch val := entity.Data.(type) {
+	case *SortedSet.SortedSet:
+		return val, nil
+	case *HashSet.Set:
+		sortedSet := SortedSet.Make()
+		val.ForEach(func(member string) bool {
+			sortedSet.Add(member, 1)
+			return true
+		})
+		return sortedSet, nil
+	}
+	return nil, &protocol.WrongTypeErrReply{}
+}
+
+func forEachZMember(sortedSet *SortedSet.SortedSet, consumer func(element *SortedSet.Element) bool) {
+	if sortedSet == nil || sortedSet.Len() == 0 {
+		return
+	}
+	sortedSet.ForEach(0, sortedSet.Len(), false, consumer)
+}
+
+func aggregateScore(aggregate int, a float64, b float64) float64 {
+	switch aggregate {
+	case aggregateMin:
+		return math.Min(a, b)
+	case aggregateMax:
+		return math.Max(a, b)
+	}
+	sum := a + b
+	if math.IsNaN(sum) {
+		// +inf plus -inf
+		return 0
+	}
+	return sum
+}
+
+func weightedScore(score float64, weight float64) float64 {
+	result := score * weight
+	if math.IsNaN(result) {
+		// inf multiplied by 0
+		return 0
+	}
+	return result
+}
+
+// computeZSetOp calculates union, intersection or difference of sorted sets according to cmd
+func (db *DB) computeZSetOp(cmd string, option *zSetOpOption) (*SortedSet.SortedSet, protocol.ErrorReply) {
+	sets := make([]*SortedSet.SortedSet, len(option.keys))
+	for i, key := range option.keys {
+		sortedSet, errReply := db.getAsZSetOperand(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	result := SortedSet.Make()
+	switch cmd {
+	case "union":
+		for i, sortedSet := range sets {
+			forEachZMember(sortedSet, func(element *SortedSet.Element) bool {
+				score := weightedScore(element.Score, option.weights[i])
+				if exists, ok := result.Get(element.Member); ok {
+					score = aggregateScore(option.aggregate, exists.Score, score)
+				}
+				result.Add(element.Member, score)
+				return true
+			})
+		}
+	case "inter":
+		forEachZMember(sets[0], func(element *SortedSet.Element) bool {
+			score := weightedScore(element.Score, option.weights[0])
+			for i, sortedSet := range sets[1:] {
+				if sortedSet == nil {
+					return false
+				}
+				another, ok := sortedSet.Get(element.Member)
+				if !ok {
+					return true
+				}
+				score = aggregateScore(option.aggregate, score, weightedScore(another.Score, option.weights[i+1]))
+			}
+			result.Add(element.Member, score)
+			return true
+		})
+	case "diff":
+		forEachZMember(sets[0], func(element *SortedSet.Element) bool {
+			for _, sortedSet := range sets[1:] {
+				if sortedSet == nil {
+					continue
+				}
+				if _, ok := sortedSet.Get(element.Member); ok {
+					return true
+				}
+			}
+			result.Add(element.Member, element.Score)
+			return true
+		})
+	}
+	return result, nil
+}
+
+func execZSetOp(db *DB, cmd string, args [][]byte) redis.Reply {
+	option, errReply := parseZSetOpOption("z"+cmd, args, cmd != "diff", true)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := db.computeZSetOp(cmd, option)
+	if errReply != nil {
+		return errReply
+	}
+	elements := make([]*SortedSet.Element, 0, result.Len())
+	forEachZMember(result, func(element *SortedSet.Element) bool {
+		elements = append(elements, element)
+		return true
+	})
+	return zElementsReply(elements, option.withScores)
+}
+
+func execZSetOpStore(db *DB, cmd string, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	option, errReply := parseZSetOpOption("z"+cmd+"store", args[1:], cmd != "diff", false)
+	if errReply != nil {
+		return errReply
+	}
+	result, errReply := db.computeZSetOp(cmd, option)
+	if errReply != nil {
+		return errReply
+	}
+	return db.storeZSetResult(dest, result, utils.ToCmdLine3("z"+cmd+"store", args...))
+}
+
+// execZUnion usage: ZUNION numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func execZUnion(db *DB, args [][]byte) redis.Reply {
+	return execZSetOp(db, "union", args)
+}
+
+// execZInter usage: ZINTER numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func execZInter(db *DB, args [][]byte) redis.Reply {
+	return execZSetOp(db, "inter", args)
+}
+
+// execZDiff usage: ZDIFF numkeys key [key ...] [WITHSCORES]
+func execZDiff(db *DB, args [][]byte) redis.Reply {
+	return execZSetOp(db, "diff", args)
+}
+
+// execZUnionStore usage: ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func execZUnionStore(db *DB, args [][]byte) redis.Reply {
+	return execZSetOpStore(db, "union", args)
+}
+
+// execZInterStore usage: ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func execZInterStore(db *DB, args [][]byte) redis.Reply {
+	return execZSetOpStore(db, "inter", args)
+}
+
+// execZDiffStore usage: ZDIFFSTORE destination numkeys key [key ...]
+func execZDiffStore(db *DB, args [][]byte) redis.Reply {
+	return execZSetOpStore(db, "diff", args)
+}
+
+// prepareZSetOp returns source keys following numkeys as read keys
+func prepareZSetOp(args [][]byte) ([]string, []string) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys < 1 || numKeys > len(args)-1 {
+		return nil, nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	return nil, keys
+}
+
+func prepareZSetOpStore(args [][]byte) ([]string, []string) {
+	_, keys := prepareZSetOp(args[1:])
+	return []string{string(args[0])}, keys
+}
+
 func init() {
 	RegisterCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4, flagWrite)
 	RegisterCommand("ZScore", execZScore, readFirstKey, nil, 3, flagReadOnly)
@@ -629,12 +1270,25 @@ func init() {
 	RegisterCommand("ZCount", execZCount, readFirstKey, nil, 4, flagReadOnly)
 	RegisterCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3, flagReadOnly)
 	RegisterCommand("ZCard", execZCard, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("ZRandMember", execZRandMember, readFirstKey, nil, -2, flagReadOnly)
 	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("ZRangeStore", execZRangeStore, prepareZRangeStore, rollbackFirstKey, -5, flagWrite)
 	RegisterCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4, flagReadOnly)
 	RegisterCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4, flagReadOnly)
 	RegisterCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("ZRangeByLex", execZRangeByLex, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("ZRevRangeByLex", execZRevRangeByLex, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("ZLexCount", execZLexCount, readFirstKey, nil, 4, flagReadOnly)
 	RegisterCommand("ZPopMin", execZPopMin, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand("BZPopMin", execBZPopMin, prepareBlockingPop, undoBlockingPop, -3, flagWrite|flagBlocking)
 	RegisterCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3, flagWrite)
 	RegisterCommand("ZRemRangeByScore", execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	RegisterCommand("ZRemRangeByRank", execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand("ZRemRangeByLex", execZRemRangeByLex, writeFirstKey, rollbackFirstKey, 4, flagWrite)
+	RegisterCommand("ZUnion", execZUnion, prepareZSetOp, nil, -3, flagReadOnly)
+	RegisterCommand("ZInter", execZInter, prepareZSetOp, nil, -3, flagReadOnly)
+	RegisterCommand("ZDiff", execZDiff, prepareZSetOp, nil, -3, flagReadOnly)
+	RegisterCommand("ZUnionStore", execZUnionStore, prepareZSetOpStore, rollbackFirstKey, -4, flagWrite)
+	RegisterCommand("ZInterStore", execZInterStore, prepareZSetOpStore, rollbackFirstKey, -4, flagWrite)
+	RegisterCommand("ZDiffStore", execZDiffStore, prepareZSetOpStore, rollbackFirstKey, -4, flagWrite)
 }
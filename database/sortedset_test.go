@@ -2,6 +2,7 @@ package database
 
 import (
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"math/rand"
 	"strconv"
@@ -53,6 +54,74 @@ func TestZAdd(t *testing.T) {
 	}
 }
 
+func TestZAddOptions(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zadd", key, "nx", "10", "a", "3", "c"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "a"))
+	asserts.AssertBulkReply(t, result, "1")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "xx", "ch", "10", "a", "4", "d"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "d"))
+	asserts.AssertNullBulk(t, result)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "gt", "ch", "5", "a", "5", "b", "5", "e"))
+	asserts.AssertIntReply(t, result, 2) // b updated, e added
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "a"))
+	asserts.AssertBulkReply(t, result, "10")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "lt", "ch", "1", "a", "20", "b"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "c", "3", "b", "5", "e", "5"})
+
+	// INCR
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "incr", "2.5", "a"))
+	asserts.AssertBulkReply(t, result, "3.5")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "incr", "lt", "1", "a"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "incr", "nx", "1", "a"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "incr", "xx", "1", "f"))
+	asserts.AssertNullBulk(t, result)
+
+	// XX on missing key doesn't create it
+	key2 := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "xx", "1", "a"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "nx", "xx", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR XX and NX options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "gt", "lt", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR GT, LT, and/or NX options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "incr", "1", "a", "2", "b"))
+	asserts.AssertErrReply(t, result, "ERR INCR option supports a single increment-element pair")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "ch", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "x", "a"))
+	asserts.AssertErrReply(t, result, "ERR value is not a valid float")
+}
+
+func TestUndoZAdd(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b"))
+	cmdLine := utils.ToCmdLine("zadd", key, "gt", "ch", "0", "a", "3", "b", "4", "c")
+	undoCmdLines := undoZAdd(testDB, cmdLine[1:])
+	result := testDB.Exec(nil, cmdLine)
+	asserts.AssertIntReply(t, result, 2)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "b", "2"})
+}
+
 func TestZRank(t *testing.T) {
 	testDB.Flush()
 	size := 100
@@ -321,3 +390,257 @@ func TestZPopMin(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("ZPopMin", key+"2", "2"))
 	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
 }
+
+func TestBZPopMin(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("ZAdd", key2, "2", "b", "1", "a"))
+	result := testDB.Exec(nil, utils.ToCmdLine("BZPopMin", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "a", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("BZPopMin", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "b", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+
+	ch := execAsync(t, key1, utils.ToCmdLine("BZPopMin", key1, key2, "0"))
+	testDB.Exec(nil, utils.ToCmdLine("ZAdd", key1, "3.5", "c"))
+	asserts.AssertMultiBulkReply(t, receiveReply(t, ch), []string{key1, "c", "3.5"})
+
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("BZPopMin", key2, "0"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestZRangeUnified(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b", "3", "c", "4", "d"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "rev"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "(1", "3", "byscore", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2", "c", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "+inf", "-inf", "byscore", "rev", "limit", "1", "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "limit", "1", "2"))
+	asserts.AssertErrReply(t, result, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "foo"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+}
+
+func TestZRangeStore(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", src, "1", "a", "2", "b", "3", "c"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, src, "0", "1"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "b", "2"})
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, src, "3", "2", "byscore", "rev"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c"})
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, src, "0", "1", "withscores"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+
+	// empty result removes dest
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, utils.RandString(10), "0", "-1"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestZSetOperations(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	setKey := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key1, "1", "a", "2", "b", "3", "c"))
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "10", "b", "20", "c", "30", "d"))
+	testDB.Exec(nil, utils.ToCmdLine("sadd", setKey, "a", "d"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "b", "12", "c", "23", "d", "30"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "weights", "2", "1", "aggregate", "max"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, key2, "aggregate", "min", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2", "c", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, setKey, "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, utils.RandString(10)))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiff", "3", key1, key2, utils.RandString(10), "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1"})
+
+	dest := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "2", key1, key2, "weights", "1", "0.5"))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", dest, "d"))
+	asserts.AssertBulkReply(t, result, "15")
+	result = testDB.Exec(nil, utils.ToCmdLine("zinterstore", dest, "2", key1, key2))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiffstore", dest, "2", key2, key1))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "30"})
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "0", key1))
+	asserts.AssertErrReply(t, result, "ERR at least 1 input key is needed for 'zunion' command")
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiff", "2", key1, key2, "weights", "1", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zinterstore", dest, "2", key1, key2, "withscores"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "weights", "1", "x"))
+	asserts.AssertErrReply(t, result, "ERR weight value is not a float")
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, dest))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestUndoZUnionStore(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a"))
+	testDB.Exec(nil, utils.ToCmdLine("zadd", dest, "1", "x", "2", "y"))
+	cmdLine := utils.ToCmdLine("zunionstore", dest, "1", key)
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"x", "y"})
+}
+
+func TestZRangeByLex(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "0", "a", "0", "b", "0", "c", "0", "d", "0", "e"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "[c"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "(a", "+", "limit", "1", "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrevrangebylex", key, "[d", "(a"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "c", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "[b", "(d", "bylex"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "+", "-", "bylex", "rev", "limit", "0", "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"e", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "-", "+"))
+	asserts.AssertIntReply(t, result, 5)
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "(b", "[d"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "(c", "(c"))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "a", "+"))
+	asserts.AssertErrReply(t, result, "ERR min or max not valid string range item")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "-", "+", "bylex", "withscores"))
+	asserts.AssertErrReply(t, result, "ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "-", "+", "bylex", "byscore"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zremrangebylex", key, "[b", "[c"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "d", "e"})
+}
+
+func TestZSetOpStore(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key1, "1", "a", "2", "b"))
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "3", "b", "4", "c"))
+
+	// write lock on destination, read locks on sources
+	writeKeys, readKeys := prepareZSetOpStore(utils.ToCmdLine(dest, "2", key1, key2, "weights", "1", "2"))
+	if len(writeKeys) != 1 || writeKeys[0] != dest {
+		t.Errorf("unexpected write keys: %v", writeKeys)
+	}
+	if len(readKeys) != 2 || readKeys[0] != key1 || readKeys[1] != key2 {
+		t.Errorf("unexpected read keys: %v", readKeys)
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "2", key1, key2, "weights", "2", "1", "aggregate", "min"))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "2", "b", "3", "c", "4"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinterstore", dest, "2", key1, key2, "weights", "2", "1", "aggregate", "max"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "4"})
+
+	// destination is also a source
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", key1, "2", key1, key2))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key1, "0", "-1", "withscores"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "c", "4", "b", "5"})
+
+	// empty result removes destination
+	result = testDB.Exec(nil, utils.ToCmdLine("zinterstore", dest, "2", key1, utils.RandString(10)))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "2", key1, key2, "aggregate", "avg"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "0", key1))
+	asserts.AssertErrReply(t, result, "ERR at least 1 input key is needed for 'zunionstore' command")
+}
+
+func TestZRandMember(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	size := 20
+	for i := 0; i < size; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("zadd", key, strconv.Itoa(i), "m"+strconv.Itoa(i)))
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("zrandmember", key))
+	if _, ok := result.(*protocol.BulkReply); !ok {
+		t.Errorf("expected bulk reply, actually %s", result.ToBytes())
+	}
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "5"))
+	asserts.AssertMultiBulkReplySize(t, result, 5)
+	distinct := make(map[string]struct{})
+	for _, arg := range result.(*protocol.MultiBulkReply).Args {
+		distinct[string(arg)] = struct{}{}
+	}
+	if len(distinct) != 5 {
+		t.Errorf("expected 5 distinct members, actually %d", len(distinct))
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "30"))
+	asserts.AssertMultiBulkReplySize(t, result, size)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "-30"))
+	asserts.AssertMultiBulkReplySize(t, result, 30)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "-3", "WITHSCORES"))
+	asserts.AssertMultiBulkReplySize(t, result, 6)
+	args := result.(*protocol.MultiBulkReply).Args
+	for i := 0; i < len(args); i += 2 {
+		if "m"+string(args[i+1]) != string(args[i]) {
+			t.Errorf("member %s has wrong score %s", args[i], args[i+1])
+		}
+	}
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "1", "foo"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "a"))
+	asserts.AssertErrReply(t, result, "ERR value is not an integer or out of range")
+
+	missing := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", missing))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", missing, "-3"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+}
@@ -0,0 +1,406 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/datastruct/stream"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (db *DB) getAsStream(key string) (*stream.Stream, protocol.ErrorReply) {
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return nil, nil
+	}
+	s, ok := entity.Data.(*stream.Stream)
+	if !ok {
+		return nil, &protocol.WrongTypeErrReply{}
+	}
+	return s, nil
+}
+
+func (db *DB) getOrInitStream(key string) (s *stream.Stream, inited bool, errReply protocol.ErrorReply) {
+	s, errReply = db.getAsStream(key)
+	if errReply != nil {
+		return nil, false, errReply
+	}
+	inited = false
+	if s == nil {
+		s = stream.Make()
+		db.PutEntity(key, &database.DataEntity{
+			Data: s,
+		})
+		inited = true
+	}
+	return s, inited, nil
+}
+
+func makeStreamEntryReply(entry *stream.Entry) redis.Reply {
+	if entry.Fields == nil {
+		// entry has been deleted but still in pending entries list
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(entry.ID.String())),
+			protocol.MakeNullBulkReply(),
+		})
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(entry.ID.String())),
+		protocol.MakeMultiBulkReply(entry.Fields),
+	})
+}
+
+func makeStreamEntriesReply(entries []*stream.Entry) redis.Reply {
+	replies := make([]redis.Reply, len(entries))
+	for i, entry := range entries {
+		replies[i] = makeStreamEntryReply(entry)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// parseXAddID parses id argument of XADD, supports "*", "<ms>-*" and "<ms>-<seq>"
+func parseXAddID(s *stream.Stream, arg string) (stream.ID, protocol.ErrorReply) {
+	if arg == "*" {
+		id, ok := s.NextID(uint64(time.Now().UnixMilli()))
+		if !ok {
+			return id, protocol.MakeErrReply("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+		return id, nil
+	}
+	if strings.HasSuffix(arg, "-*") {
+		ms, err := strconv.ParseUint(arg[:len(arg)-2], 10, 64)
+		if err != nil {
+			return stream.ID{}, protocol.MakeErrReply("ERR Invalid stream ID specified as stream command argument")
+		}
+		lastID := s.LastID()
+		if ms == lastID.Ms {
+			id, ok := lastID.Next()
+			if !ok || id.Ms != ms {
+				return id, protocol.MakeErrReply("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			return id, nil
+		}
+		id := stream.ID{Ms: ms}
+		if ms == 0 {
+			id.Seq = 1
+		}
+		return id, nil
+	}
+	id, err := stream.ParseID(arg, 0)
+	if err != nil {
+		return id, protocol.MakeErrReply(err.Error())
+	}
+	return id, nil
+}
+
+type streamTrimOption struct {
+	maxLen int
+	minID  *stream.ID
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] starting at args[i], returns index of next arg
+func parseStreamTrim(args [][]byte, i int, opt *streamTrimOption) (int, protocol.ErrorReply) {
+	strategy := strings.ToUpper(string(args[i]))
+	i++
+	if i < len(args) && (string(args[i]) == "=" || string(args[i]) == "~") {
+		// approximate trimming is treated as exact trimming
+		i++
+	}
+	if i >= len(args) {
+		return i, protocol.MakeSyntaxErrReply()
+	}
+	if strategy == "MAXLEN" {
+		maxLen, err := strconv.Atoi(string(args[i]))
+		if err != nil || maxLen < 0 {
+			return i, protocol.MakeErrReply("ERR The MAXLEN argument must be >= 0.")
+		}
+		opt.maxLen = maxLen
+	} else {
+		minID, err := stream.ParseID(string(args[i]), 0)
+		if err != nil {
+			return i, protocol.MakeErrReply(err.Error())
+		}
+		opt.minID = &minID
+	}
+	i++
+	if i < len(args) && strings.ToUpper(string(args[i])) == "LIMIT" {
+		if i+1 >= len(args) {
+			return i, protocol.MakeSyntaxErrReply()
+		}
+		if _, err := strconv.Atoi(string(args[i+1])); err != nil {
+			return i, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		i += 2
+	}
+	return i, nil
+}
+
+func (opt *streamTrimOption) trim(s *stream.Stream) int {
+	if opt.minID != nil {
+		return s.TrimByMinID(*opt.minID)
+	}
+	return s.TrimByLen(opt.maxLen)
+}
+
+// execXAdd appends a new entry to stream
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func execXAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	noMkStream := false
+	trimOpt := &streamTrimOption{maxLen: -1}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "NOMKSTREAM" {
+			noMkStream = true
+		} else if arg == "MAXLEN" || arg == "MINID" {
+			next, errReply := parseStreamTrim(args, i, trimOpt)
+			if errReply != nil {
+				return errReply
+			}
+			i = next - 1
+		} else {
+			break
+		}
+	}
+	if i >= len(args) {
+		return protocol.MakeArgNumErrReply("xadd")
+	}
+	idIndex := i
+	fields := args[idIndex+1:]
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return protocol.MakeArgNumErrReply("xadd")
+	}
+
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		if noMkStream {
+			return protocol.MakeNullBulkReply()
+		}
+		s = stream.Make()
+	}
+	id, errReply := parseXAddID(s, string(args[idIndex]))
+	if errReply != nil {
+		return errReply
+	}
+	if id.IsZero() {
+		return protocol.MakeErrReply("ERR The ID specified in XADD must be greater than 0-0")
+	}
+	values := make([][]byte, len(fields))
+	copy(values, fields)
+	if !s.Add(id, values) {
+		return protocol.MakeErrReply("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	trimOpt.trim(s)
+	db.PutEntity(key, &database.DataEntity{
+		Data: s,
+	})
+
+	// record generated id, so that replaying aof produces the same entry
+	aofArgs := make([][]byte, len(args))
+	copy(aofArgs, args)
+	aofArgs[idIndex] = []byte(id.String())
+	db.addAof(utils.ToCmdLine3("xadd", aofArgs...))
+	db.notifyWaiters(key)
+	return protocol.MakeBulkReply([]byte(id.String()))
+}
+
+// execXLen returns number of entries in stream
+func execXLen(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(int64(s.Len()))
+}
+
+func streamRange(db *DB, args [][]byte, desc bool) redis.Reply {
+	key := string(args[0])
+	startArg, endArg := string(args[1]), string(args[2])
+	if desc {
+		startArg, endArg = endArg, startArg
+	}
+	start, startOk, err := stream.ParseRangeStart(startArg)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	end, endOk, err := stream.ParseRangeEnd(endArg)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	count := 0
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(string(args[3])) != "COUNT" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		count, err = strconv.Atoi(string(args[4]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if count <= 0 {
+			return protocol.MakeEmptyMultiBulkReply()
+		}
+	}
+
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil || !startOk || !endOk {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return makeStreamEntriesReply(s.Range(start, end, count, desc))
+}
+
+// execXRange returns entries within given id range
+// XRANGE key start end [COUNT count]
+func execXRange(db *DB, args [][]byte) redis.Reply {
+	return streamRange(db, args, false)
+}
+
+// execXRevRange returns entries within given id range in reverse order
+// XREVRANGE key end start [COUNT count]
+func execXRevRange(db *DB, args [][]byte) redis.Reply {
+	return streamRange(db, args, true)
+}
+
+// parseXReadKeys returns keys and ids after STREAMS option, searching STREAMS starts at args[from]
+func parseXReadKeys(args [][]byte, from int) (keys []string, ids []string, index int) {
+	for i := from; i < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "STREAMS" {
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, nil, i
+			}
+			n := len(rest) / 2
+			keys = make([]string, n)
+			ids = make([]string, n)
+			for j := 0; j < n; j++ {
+				keys[j] = string(rest[j])
+				ids[j] = string(rest[n+j])
+			}
+			return keys, ids, i
+		}
+	}
+	return nil, nil, -1
+}
+
+func prepareXRead(args [][]byte) ([]string, []string) {
+	keys, _, _ := parseXReadKeys(args, 0)
+	return nil, keys
+}
+
+// execXRead reads entries from one or more streams
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func execXRead(db *DB, args [][]byte) redis.Reply {
+	keys, ids, streamsIndex := parseXReadKeys(args, 0)
+	if streamsIndex < 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	if keys == nil {
+		return protocol.MakeErrReply("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	count := 0
+	blocking := false
+	for i := 0; i < streamsIndex; i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if i+1 >= streamsIndex {
+			return protocol.MakeSyntaxErrReply()
+		}
+		switch arg {
+		case "COUNT":
+			var err error
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+		case "BLOCK":
+			if _, errReply := parseBlockOptionTimeout(args[i+1]); errReply != nil {
+				return errReply
+			}
+			blocking = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		i++
+	}
+
+	var result []redis.Reply
+	for i, key := range keys {
+		s, errReply := db.getAsStream(key)
+		if errReply != nil {
+			return errReply
+		}
+		if ids[i] == "$" {
+			if blocking {
+				// "$" is replaced by current last id, so retries of blocking XREAD return entries added after it
+				lastID := stream.MinID
+				if s != nil {
+					lastID = s.LastID()
+				}
+				args[streamsIndex+1+len(keys)+i] = []byte(lastID.String())
+			}
+			continue
+		}
+		if s == nil {
+			continue
+		}
+		id, err := stream.ParseID(ids[i], 0)
+		if err != nil {
+			return protocol.MakeErrReply(err.Error())
+		}
+		entries := s.After(id, count)
+		if len(entries) == 0 {
+			continue
+		}
+		result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			makeStreamEntriesReply(entries),
+		}))
+	}
+	if len(result) == 0 {
+		return protocol.MakeNullMultiBulkReply()
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// execXSetID sets the last id of stream, it is also used to restore stream from aof
+// XSETID key last-id
+func execXSetID(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return protocol.MakeErrReply("ERR no such key")
+	}
+	id, errReply := parseStreamIDArg(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if !s.SetLastID(id) {
+		return protocol.MakeErrReply("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	db.addAof(utils.ToCmdLine("xsetid", key, id.String()))
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("XAdd", execXAdd, writeFirstKey, rollbackFirstKey, -5, flagWrite)
+	RegisterCommand("XLen", execXLen, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("XRange", execXRange, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("XRevRange", execXRevRange, readFirstKey, nil, -4, flagReadOnly)
+	RegisterCommand("XRead", execXRead, prepareXRead, nil, -4, flagReadOnly|flagBlockOption)
+	RegisterCommand("XSetID", execXSetID, writeFirstKey, rollbackFirstKey, 3, flagWrite)
+}
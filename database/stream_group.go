@@ -0,0 +1,615 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/datastruct/stream"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func makeNoGroupErrReply(key string, group string) protocol.ErrorReply {
+	return protocol.MakeErrReply("NOGROUP No such key '" + key + "' or consumer group '" + group + "'")
+}
+
+func (db *DB) getStreamGroup(key string, groupName string) (*stream.Stream, *stream.Group, protocol.ErrorReply) {
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return nil, nil, errReply
+	}
+	if s == nil {
+		return nil, nil, makeNoGroupErrReply(key, groupName)
+	}
+	group, ok := s.GetGroup(groupName)
+	if !ok {
+		return nil, nil, makeNoGroupErrReply(key, groupName)
+	}
+	return s, group, nil
+}
+
+func parseStreamIDArg(arg []byte) (stream.ID, protocol.ErrorReply) {
+	id, err := stream.ParseID(string(arg), 0)
+	if err != nil {
+		return id, protocol.MakeErrReply(err.Error())
+	}
+	return id, nil
+}
+
+// makeClaimAofCmd generates command line to reproduce the state of pending entry
+func makeClaimAofCmd(key string, group string, pending *stream.PendingEntry) CmdLine {
+	return aof.MakeStreamClaimCmd(key, group, pending).Args
+}
+
+func prepareXGroup(args [][]byte) ([]string, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	return []string{string(args[1])}, nil
+}
+
+func undoXGroup(db *DB, args [][]byte) []CmdLine {
+	if len(args) < 2 {
+		return nil
+	}
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+// execXGroup manages consumer groups
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n]
+// XGROUP SETID key group id|$ [ENTRIESREAD n]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func execXGroup(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	if len(args) < 3 {
+		return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for '" + subCmd + "'")
+	}
+	key := string(args[1])
+	groupName := string(args[2])
+	switch subCmd {
+	case "create":
+		return execXGroupCreate(db, key, groupName, args[3:])
+	case "setid":
+		if len(args) != 4 && len(args) != 6 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		s, group, errReply := db.getStreamGroup(key, groupName)
+		if errReply != nil {
+			return errReply
+		}
+		id, errReply := parseGroupStartID(s, args[3])
+		if errReply != nil {
+			return errReply
+		}
+		group.LastDeliveredID = id
+		db.addAof(utils.ToCmdLine("xgroup", "setid", key, groupName, id.String()))
+		return protocol.MakeOkReply()
+	case "destroy":
+		if len(args) != 3 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		s, errReply := db.getAsStream(key)
+		if errReply != nil {
+			return errReply
+		}
+		if s == nil {
+			return protocol.MakeErrReply("ERR The XGROUP subcommand requires the key to exist.")
+		}
+		if !s.DestroyGroup(groupName) {
+			return protocol.MakeIntReply(0)
+		}
+		db.addAof(utils.ToCmdLine3("xgroup", args...))
+		return protocol.MakeIntReply(1)
+	case "createconsumer":
+		if len(args) != 4 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		_, group, errReply := db.getStreamGroup(key, groupName)
+		if errReply != nil {
+			return errReply
+		}
+		if !group.CreateConsumer(string(args[3]), time.Now().UnixMilli()) {
+			return protocol.MakeIntReply(0)
+		}
+		db.addAof(utils.ToCmdLine3("xgroup", args...))
+		return protocol.MakeIntReply(1)
+	case "delconsumer":
+		if len(args) != 4 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		_, group, errReply := db.getStreamGroup(key, groupName)
+		if errReply != nil {
+			return errReply
+		}
+		if _, ok := group.GetConsumer(string(args[3])); !ok {
+			return protocol.MakeIntReply(0)
+		}
+		removed := group.DeleteConsumer(string(args[3]))
+		db.addAof(utils.ToCmdLine3("xgroup", args...))
+		return protocol.MakeIntReply(int64(removed))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'")
+}
+
+// parseGroupStartID parses id of XGROUP CREATE and XGROUP SETID, "$" means last id of stream
+func parseGroupStartID(s *stream.Stream, arg []byte) (stream.ID, protocol.ErrorReply) {
+	if string(arg) == "$" {
+		return s.LastID(), nil
+	}
+	return parseStreamIDArg(arg)
+}
+
+func execXGroupCreate(db *DB, key string, groupName string, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	mkStream := false
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "MKSTREAM" {
+			mkStream = true
+		} else if arg == "ENTRIESREAD" && i+1 < len(args) {
+			i++
+		} else {
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil && !mkStream {
+		return protocol.MakeErrReply("ERR The XGROUP subcommand requires the key to exist. " +
+			"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	var id stream.ID
+	if s == nil {
+		id, errReply = parseGroupStartID(stream.Make(), args[0])
+	} else {
+		id, errReply = parseGroupStartID(s, args[0])
+	}
+	if errReply != nil {
+		return errReply
+	}
+	if s != nil {
+		if _, ok := s.GetGroup(groupName); ok {
+			return protocol.MakeErrReply("BUSYGROUP Consumer Group name already exists")
+		}
+	}
+	s, _, errReply = db.getOrInitStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	s.CreateGroup(groupName, id)
+	aofArgs := utils.ToCmdLine("xgroup", "create", key, groupName, id.String())
+	if mkStream {
+		aofArgs = append(aofArgs, []byte("MKSTREAM"))
+	}
+	db.addAof(aofArgs)
+	return protocol.MakeOkReply()
+}
+
+func prepareXReadGroup(args [][]byte) ([]string, []string) {
+	keys, _, _ := parseXReadKeys(args, 3)
+	return keys, nil
+}
+
+func undoXReadGroup(db *DB, args [][]byte) []CmdLine {
+	keys, _, _ := parseXReadKeys(args, 3)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execXReadGroup reads entries from streams as a member of consumer group
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func execXReadGroup(db *DB, args [][]byte) redis.Reply {
+	if strings.ToUpper(string(args[0])) != "GROUP" {
+		return protocol.MakeSyntaxErrReply()
+	}
+	groupName := string(args[1])
+	consumerName := string(args[2])
+	keys, ids, streamsIndex := parseXReadKeys(args, 3)
+	if streamsIndex < 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	if keys == nil {
+		return protocol.MakeErrReply("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+	}
+	count := 0
+	noAck := false
+	for i := 3; i < streamsIndex; i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "NOACK":
+			noAck = true
+		case "COUNT":
+			if i+1 >= streamsIndex {
+				return protocol.MakeSyntaxErrReply()
+			}
+			var err error
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			i++
+		case "BLOCK":
+			if i+1 >= streamsIndex {
+				return protocol.MakeSyntaxErrReply()
+			}
+			if _, errReply := parseBlockOptionTimeout(args[i+1]); errReply != nil {
+				return errReply
+			}
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	// check all groups before modifying anything
+	groups := make([]*stream.Group, len(keys))
+	streams := make([]*stream.Stream, len(keys))
+	for i, key := range keys {
+		s, group, errReply := db.getStreamGroup(key, groupName)
+		if errReply != nil {
+			return protocol.MakeErrReply(errReply.Error() + " in XREADGROUP with GROUP option")
+		}
+		if ids[i] != ">" {
+			if _, errReply = parseStreamIDArg([]byte(ids[i])); errReply != nil {
+				return errReply
+			}
+		}
+		streams[i], groups[i] = s, group
+	}
+
+	now := time.Now().UnixMilli()
+	var result []redis.Reply
+	for i, key := range keys {
+		s, group := streams[i], groups[i]
+		_, consumerExists := group.GetConsumer(consumerName)
+		if !consumerExists {
+			db.addAof(utils.ToCmdLine("xgroup", "createconsumer", key, groupName, consumerName))
+		}
+		var entries []*stream.Entry
+		if ids[i] == ">" {
+			entries = group.ReadNew(s, consumerName, count, noAck, now)
+			if len(entries) == 0 {
+				continue
+			}
+			if !noAck {
+				for _, entry := range entries {
+					pending, _ := group.GetPending(entry.ID)
+					db.addAof(makeClaimAofCmd(key, groupName, pending))
+				}
+			}
+			db.addAof(utils.ToCmdLine("xgroup", "setid", key, groupName, group.LastDeliveredID.String()))
+		} else {
+			start, _ := parseStreamIDArg([]byte(ids[i]))
+			entries = group.ReadHistory(s, consumerName, start, count, now)
+			for _, entry := range entries {
+				if pending, ok := group.GetPending(entry.ID); ok && entry.Fields != nil {
+					db.addAof(makeClaimAofCmd(key, groupName, pending))
+				}
+			}
+		}
+		result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			makeStreamEntriesReply(entries),
+		}))
+	}
+	if len(result) == 0 {
+		return protocol.MakeNullMultiBulkReply()
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// execXAck removes entries from pending entries list of consumer group
+// XACK key group id [id ...]
+func execXAck(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	groupName := string(args[1])
+	ids := make([]stream.ID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, errReply := parseStreamIDArg(arg)
+		if errReply != nil {
+			return errReply
+		}
+		ids = append(ids, id)
+	}
+	s, errReply := db.getAsStream(key)
+	if errReply != nil {
+		return errReply
+	}
+	if s == nil {
+		return protocol.MakeIntReply(0)
+	}
+	group, ok := s.GetGroup(groupName)
+	if !ok {
+		return protocol.MakeIntReply(0)
+	}
+	acked := group.Ack(ids...)
+	if acked > 0 {
+		db.addAof(utils.ToCmdLine3("xack", args...))
+	}
+	return protocol.MakeIntReply(int64(acked))
+}
+
+func parseMinIdle(arg []byte) (int64, protocol.ErrorReply) {
+	minIdle, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	if minIdle < 0 {
+		minIdle = 0
+	}
+	return minIdle, nil
+}
+
+// execXClaim changes ownership of pending entries
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds] [RETRYCOUNT count]
+// [FORCE] [JUSTID] [LASTID lastid]
+func execXClaim(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	groupName := string(args[1])
+	consumerName := string(args[2])
+	minIdle, errReply := parseMinIdle(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	now := time.Now().UnixMilli()
+	opt := &stream.ClaimOption{
+		MinIdle:      minIdle,
+		DeliveryTime: now,
+		RetryCount:   -1,
+	}
+	var ids []stream.ID
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := stream.ParseID(string(args[i]), 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return protocol.MakeErrReply("ERR Invalid stream ID specified as stream command argument")
+	}
+	var lastID *stream.ID
+	for ; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "FORCE":
+			opt.Force = true
+			continue
+		case "JUSTID":
+			opt.JustID = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return protocol.MakeSyntaxErrReply()
+		}
+		i++
+		switch arg {
+		case "IDLE":
+			idle, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			opt.DeliveryTime = now - idle
+		case "TIME":
+			deliveryTime, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR Invalid TIME option argument for XCLAIM")
+			}
+			opt.DeliveryTime = deliveryTime
+		case "RETRYCOUNT":
+			retryCount, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || retryCount < 0 {
+				return protocol.MakeErrReply("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			opt.RetryCount = retryCount
+		case "LASTID":
+			id, errReply := parseStreamIDArg(args[i])
+			if errReply != nil {
+				return errReply
+			}
+			lastID = &id
+		default:
+			return protocol.MakeErrReply("ERR Unrecognized XCLAIM option '" + string(args[i-1]) + "'")
+		}
+	}
+
+	s, group, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if lastID != nil && group.LastDeliveredID.Less(*lastID) {
+		group.LastDeliveredID = *lastID
+		db.addAof(utils.ToCmdLine("xgroup", "setid", key, groupName, lastID.String()))
+	}
+	if _, ok := group.GetConsumer(consumerName); !ok {
+		db.addAof(utils.ToCmdLine("xgroup", "createconsumer", key, groupName, consumerName))
+	}
+	claimed := group.Claim(s, consumerName, ids, opt, now)
+	for _, pending := range claimed {
+		db.addAof(makeClaimAofCmd(key, groupName, pending))
+	}
+	return makeClaimedReply(s, claimed, opt.JustID)
+}
+
+func makeClaimedReply(s *stream.Stream, claimed []*stream.PendingEntry, justID bool) redis.Reply {
+	if justID {
+		ids := make([][]byte, len(claimed))
+		for i, pending := range claimed {
+			ids[i] = []byte(pending.ID.String())
+		}
+		return protocol.MakeMultiBulkReply(ids)
+	}
+	entries := make([]*stream.Entry, len(claimed))
+	for i, pending := range claimed {
+		entries[i], _ = s.Get(pending.ID)
+	}
+	return makeStreamEntriesReply(entries)
+}
+
+// execXAutoClaim claims pending entries idle longer than min-idle-time
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func execXAutoClaim(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	groupName := string(args[1])
+	consumerName := string(args[2])
+	minIdle, errReply := parseMinIdle(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	start, _, err := stream.ParseRangeStart(string(args[4]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "JUSTID" {
+			justID = true
+		} else if arg == "COUNT" && i+1 < len(args) {
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return protocol.MakeErrReply("ERR COUNT must be > 0")
+			}
+			i++
+		} else {
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	s, group, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if _, ok := group.GetConsumer(consumerName); !ok {
+		db.addAof(utils.ToCmdLine("xgroup", "createconsumer", key, groupName, consumerName))
+	}
+	claimed, deleted, next := group.AutoClaim(s, consumerName, minIdle, start, count, justID, time.Now().UnixMilli())
+	for _, pending := range claimed {
+		db.addAof(makeClaimAofCmd(key, groupName, pending))
+	}
+	deletedIDs := make([][]byte, len(deleted))
+	for i, id := range deleted {
+		deletedIDs[i] = []byte(id.String())
+	}
+	if len(deleted) > 0 {
+		db.addAof(utils.ToCmdLine3("xack", append([][]byte{args[0], args[1]}, deletedIDs...)...))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(next.String())),
+		makeClaimedReply(s, claimed, justID),
+		protocol.MakeMultiBulkReply(deletedIDs),
+	})
+}
+
+// execXPending inspects pending entries list of consumer group
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func execXPending(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	groupName := string(args[1])
+	_, group, errReply := db.getStreamGroup(key, groupName)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 2 {
+		// summary form
+		pendingList := group.PendingRange(stream.MinID, stream.MaxID, "", 0)
+		if len(pendingList) == 0 {
+			return protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeIntReply(0),
+				protocol.MakeNullBulkReply(),
+				protocol.MakeNullBulkReply(),
+				protocol.MakeNullBulkReply(),
+			})
+		}
+		var consumerReplies []redis.Reply
+		for _, consumer := range group.Consumers() {
+			n := group.PendingLen(consumer.Name)
+			if n == 0 {
+				continue
+			}
+			consumerReplies = append(consumerReplies, protocol.MakeMultiBulkReply([][]byte{
+				[]byte(consumer.Name),
+				[]byte(strconv.Itoa(n)),
+			}))
+		}
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeIntReply(int64(len(pendingList))),
+			protocol.MakeBulkReply([]byte(pendingList[0].ID.String())),
+			protocol.MakeBulkReply([]byte(pendingList[len(pendingList)-1].ID.String())),
+			protocol.MakeMultiRawReply(consumerReplies),
+		})
+	}
+
+	// extended form
+	rest := args[2:]
+	var minIdle int64
+	if strings.ToUpper(string(rest[0])) == "IDLE" {
+		if len(rest) < 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		var err error
+		minIdle, err = strconv.ParseInt(string(rest[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	start, startOk, err := stream.ParseRangeStart(string(rest[0]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	end, endOk, err := stream.ParseRangeEnd(string(rest[1]))
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	count, err := strconv.Atoi(string(rest[2]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	consumer := ""
+	if len(rest) == 4 {
+		consumer = string(rest[3])
+	}
+	if !startOk || !endOk || count <= 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	now := time.Now().UnixMilli()
+	var replies []redis.Reply
+	for _, pending := range group.PendingRange(start, end, consumer, 0) {
+		idle := now - pending.DeliveryTime
+		if idle < minIdle {
+			continue
+		}
+		replies = append(replies, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(pending.ID.String())),
+			protocol.MakeBulkReply([]byte(pending.Consumer)),
+			protocol.MakeIntReply(idle),
+			protocol.MakeIntReply(pending.DeliveryCount),
+		}))
+		if len(replies) >= count {
+			break
+		}
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func init() {
+	RegisterCommand("XGroup", execXGroup, prepareXGroup, undoXGroup, -4, flagWrite)
+	RegisterCommand("XReadGroup", execXReadGroup, prepareXReadGroup, undoXReadGroup, -7, flagWrite|flagBlockOption)
+	RegisterCommand("XAck", execXAck, writeFirstKey, rollbackFirstKey, -4, flagWrite)
+	RegisterCommand("XClaim", execXClaim, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("XAutoClaim", execXAutoClaim, writeFirstKey, rollbackFirstKey, -6, flagWrite)
+	RegisterCommand("XPending", execXPending, readFirstKey, nil, -3, flagReadOnly)
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+)
+
+func TestXGroup(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "$"))
+	asserts.AssertErrReply(t, result, "ERR The XGROUP subcommand requires the key to exist. "+
+		"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "$", "MKSTREAM"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "$"))
+	asserts.AssertErrReply(t, result, "BUSYGROUP Consumer Group name already exists")
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "createconsumer", key, "g", "c1"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "createconsumer", key, "g", "c1"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "delconsumer", key, "g", "c1"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "setid", key, "g", "0"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "setid", key, "g2", "0"))
+	asserts.AssertErrReply(t, result, "NOGROUP No such key '"+key+"' or consumer group 'g2'")
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "destroy", key, "g"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("XGroup", "destroy", key, "g"))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestXReadGroup(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "0"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "COUNT", "2", "STREAMS", key, ">"))
+	raw, ok := result.(*protocol.MultiRawReply)
+	if !ok || len(raw.Replies) != 1 {
+		t.Fatalf("wrong xreadgroup result: %s", result.ToBytes())
+	}
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[0].(*protocol.MultiRawReply).Replies[1], 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c2", "STREAMS", key, ">"))
+	raw = result.(*protocol.MultiRawReply)
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[0].(*protocol.MultiRawReply).Replies[1], 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c2", "STREAMS", key, ">"))
+	asserts.AssertNullMultiBulk(t, result)
+
+	// history of c1
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "STREAMS", key, "0"))
+	raw = result.(*protocol.MultiRawReply)
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[0].(*protocol.MultiRawReply).Replies[1], 2)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g"))
+	raw = result.(*protocol.MultiRawReply)
+	asserts.AssertIntReply(t, raw.Replies[0], 5)
+	asserts.AssertBulkReply(t, raw.Replies[1], "1-0")
+	asserts.AssertBulkReply(t, raw.Replies[2], "5-0")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XAck", key, "g", "1", "2", "9"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10", "c1"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10"))
+	asserts.AssertMultiBulkReplySize(t, result, 3)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g2", "c1", "STREAMS", key, ">"))
+	asserts.AssertErrReply(t, result, "NOGROUP No such key '"+key+"' or consumer group 'g2' in XREADGROUP with GROUP option")
+}
+
+func TestXClaim(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "STREAMS", key, ">"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("XClaim", key, "g", "c2", "3600000", "1-0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XClaim", key, "g", "c2", "0", "1-0", "2-0", "JUSTID"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1-0", "2-0"})
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10", "c2"))
+	asserts.AssertMultiBulkReplySize(t, result, 2)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XAutoClaim", key, "g", "c3", "0", "0", "COUNT", "2"))
+	raw := result.(*protocol.MultiRawReply)
+	asserts.AssertBulkReply(t, raw.Replies[0], "3-0")
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[1], 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XAutoClaim", key, "g", "c3", "0", "3-0", "JUSTID"))
+	raw = result.(*protocol.MultiRawReply)
+	asserts.AssertBulkReply(t, raw.Replies[0], "0-0")
+	asserts.AssertMultiBulkReply(t, raw.Replies[1], []string{"3-0", "4-0", "5-0"})
+	result = testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10", "c3"))
+	asserts.AssertMultiBulkReplySize(t, result, 5)
+}
+
+func TestStreamGroupMarshal(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "0"))
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g2", "$"))
+	testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "COUNT", "3", "STREAMS", key, ">"))
+	testDB.Exec(nil, utils.ToCmdLine("XAck", key, "g", "1"))
+
+	entity, _ := testDB.GetEntity(key)
+	cmds := aof.EntityToCmds(key, entity)
+	testDB.Remove(key)
+	for _, cmd := range cmds {
+		asserts.AssertNotError(t, testDB.Exec(nil, cmd.Args))
+	}
+
+	result := testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10", "c1"))
+	asserts.AssertMultiBulkReplySize(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "STREAMS", key, ">"))
+	raw := result.(*protocol.MultiRawReply)
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[0].(*protocol.MultiRawReply).Replies[1], 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g2", "c1", "STREAMS", key, ">"))
+	asserts.AssertNullMultiBulk(t, result)
+}
+
+func TestXReadGroupBlock(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key, "g", "$", "MKSTREAM"))
+	ch := execAsync(t, key, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "BLOCK", "0", "STREAMS", key, ">"))
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1", "f", "1"))
+	raw := receiveReply(t, ch).(*protocol.MultiRawReply)
+	asserts.AssertMultiBulkReplySize(t, raw.Replies[0].(*protocol.MultiRawReply).Replies[1], 1)
+	result := testDB.Exec(nil, utils.ToCmdLine("XPending", key, "g", "-", "+", "10", "c1"))
+	asserts.AssertMultiBulkReplySize(t, result, 1)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "BLOCK", "10", "STREAMS", key, ">"))
+	asserts.AssertNullMultiBulk(t, result)
+
+	// empty stream keeps its groups after marshalled
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("XGroup", "create", key2, "g", "$", "MKSTREAM"))
+	entity, _ := testDB.GetEntity(key2)
+	cmds := aof.EntityToCmds(key2, entity)
+	testDB.Remove(key2)
+	for _, cmd := range cmds {
+		asserts.AssertNotError(t, testDB.Exec(nil, cmd.Args))
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("XLen", key2))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XReadGroup", "GROUP", "g", "c1", "STREAMS", key2, ">"))
+	asserts.AssertNullMultiBulk(t, result)
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/datastruct/stream"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"strconv"
+	"testing"
+)
+
+func TestXAdd(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1-1", "a", "1"))
+	asserts.AssertBulkReply(t, result, "1-1")
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1-*", "a", "2"))
+	asserts.AssertBulkReply(t, result, "1-2")
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1-1", "a", "3"))
+	asserts.AssertErrReply(t, result, "ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "*", "a", "3"))
+	asserts.AssertNotError(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("XLen", key))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("type", key))
+	asserts.AssertStatusReply(t, result, "stream")
+
+	// trim
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "MAXLEN", "~", "2", "*", "a", "4"))
+	asserts.AssertNotError(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("XLen", key))
+	asserts.AssertIntReply(t, result, 2)
+
+	// nomkstream
+	key2 := utils.RandString(10)
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key2, "NOMKSTREAM", "*", "a", "1"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key2, "0-0", "a", "1"))
+	asserts.AssertErrReply(t, result, "ERR The ID specified in XADD must be greater than 0-0")
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key2, "*", "a"))
+	asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'xadd' command")
+
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key2, "*", "a", "1"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestXRange(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	for i := 1; i <= 10; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("XRange", key, "-", "+"))
+	asserts.AssertMultiBulkReplySize(t, result, 10)
+	result = testDB.Exec(nil, utils.ToCmdLine("XRange", key, "3", "5"))
+	asserts.AssertMultiBulkReplySize(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("XRange", key, "(3-0", "5", "COUNT", "1"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		makeStreamEntryReply(&stream.Entry{
+			ID:     stream.ID{Ms: 4},
+			Fields: [][]byte{[]byte("f"), []byte("4")},
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong xrange result: %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("XRevRange", key, "+", "-", "COUNT", "2"))
+	expected = protocol.MakeMultiRawReply([]redis.Reply{
+		makeStreamEntryReply(&stream.Entry{
+			ID:     stream.ID{Ms: 10},
+			Fields: [][]byte{[]byte("f"), []byte("10")},
+		}),
+		makeStreamEntryReply(&stream.Entry{
+			ID:     stream.ID{Ms: 9},
+			Fields: [][]byte{[]byte("f"), []byte("9")},
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong xrevrange result: %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("XRange", utils.RandString(10), "-", "+"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("XRange", key, "a", "+"))
+	asserts.AssertErrReply(t, result, "ERR Invalid stream ID specified as stream command argument")
+}
+
+func TestXRead(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key1, strconv.Itoa(i), "f", strconv.Itoa(i)))
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key2, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("XRead", "COUNT", "2", "STREAMS", key1, key2, "0", "4"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key1)),
+			makeStreamEntriesReply([]*stream.Entry{
+				{ID: stream.ID{Ms: 1}, Fields: [][]byte{[]byte("f"), []byte("1")}},
+				{ID: stream.ID{Ms: 2}, Fields: [][]byte{[]byte("f"), []byte("2")}},
+			}),
+		}),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key2)),
+			makeStreamEntriesReply([]*stream.Entry{
+				{ID: stream.ID{Ms: 5}, Fields: [][]byte{[]byte("f"), []byte("5")}},
+			}),
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong xread result: %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("XRead", "STREAMS", key1, "$"))
+	asserts.AssertNullMultiBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("XRead", "STREAMS", key1, key2, "0"))
+	asserts.AssertErrReply(t, result, "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+}
+
+func TestStreamMarshal(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	for i := 1; i <= 5; i++ {
+		testDB.Exec(nil, utils.ToCmdLine("XAdd", key, strconv.Itoa(i), "f", strconv.Itoa(i)))
+	}
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "MAXLEN", "0", "10", "f", "10"))
+	entity, _ := testDB.GetEntity(key)
+	cmds := aof.EntityToCmds(key, entity)
+	testDB.Remove(key)
+	for _, cmd := range cmds {
+		asserts.AssertNotError(t, testDB.Exec(nil, cmd.Args))
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("XLen", key))
+	asserts.AssertIntReply(t, result, 0)
+	// last id survives even if the stream is empty
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "9", "f", "9"))
+	asserts.AssertErrReply(t, result, "ERR The ID specified in XADD is equal or smaller than the target stream top item")
+}
+
+func TestUndoXAdd(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1", "f", "1"))
+	cmdLine := utils.ToCmdLine("XAdd", key, "2", "f", "2")
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("XLen", key))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "2", "f", "2"))
+	asserts.AssertBulkReply(t, result, "2-0")
+}
+
+func TestXReadBlock(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "1", "f", "1"))
+
+	// "$" only returns entries added after blocking
+	ch := execAsync(t, key, utils.ToCmdLine("XRead", "BLOCK", "0", "STREAMS", key, "$"))
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "2", "f", "2"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			makeStreamEntriesReply([]*stream.Entry{
+				{ID: stream.ID{Ms: 2}, Fields: [][]byte{[]byte("f"), []byte("2")}},
+			}),
+		}),
+	})
+	result := receiveReply(t, ch)
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong xread result: %s", result.ToBytes())
+	}
+	if testDB.blocking.waitingCount(key) != 0 {
+		t.Error("waiter should be removed")
+	}
+
+	// available entries are returned without blocking
+	result = testDB.Exec(nil, utils.ToCmdLine("XRead", "BLOCK", "0", "STREAMS", key, "1"))
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("wrong xread result: %s", result.ToBytes())
+	}
+
+	result = testDB.Exec(nil, utils.ToCmdLine("XRead", "BLOCK", "10", "STREAMS", key, "$"))
+	asserts.AssertNullMultiBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("XRead", "BLOCK", "-1", "STREAMS", key, "$"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+}
+
+func TestXSetID(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("XSetID", key, "1"))
+	asserts.AssertErrReply(t, result, "ERR no such key")
+	testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "5", "f", "5"))
+	result = testDB.Exec(nil, utils.ToCmdLine("XSetID", key, "4"))
+	asserts.AssertErrReply(t, result, "ERR The ID specified in XSETID is smaller than the target stream top item")
+	result = testDB.Exec(nil, utils.ToCmdLine("XSetID", key, "10"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("XAdd", key, "9", "f", "9"))
+	asserts.AssertErrReply(t, result, "ERR The ID specified in XADD is equal or smaller than the target stream top item")
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/shopspring/decimal"
+	"math"
+	"math/big"
 	"math/bits"
 	"strconv"
 	"strings"
@@ -48,26 +50,17 @@ const (
 const unlimitedTTL int64 = 0
 
 // execGetEX Get the value of key and optionally set its expiration
+// usage: GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
 func execGetEX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
-	bytes, err := db.getAsString(key)
-	ttl := unlimitedTTL
-
-	if err != nil {
-		return err
-	}
-	if bytes == nil {
-		return &protocol.NullBulkReply{}
-	}
-
+	var expireTime time.Time
+	hasExpire := false
+	persist := false
 	for i := 1; i < len(args); i++ {
 		arg := strings.ToUpper(string(args[i]))
-		if arg == "EX" { // ttl in seconds
-			if ttl != unlimitedTTL {
-				// ttl has been set
-				return &protocol.SyntaxErrReply{}
-			}
-			if i+1 >= len(args) {
+		switch arg {
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || persist || i+1 >= len(args) {
 				return &protocol.SyntaxErrReply{}
 			}
 			ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
@@ -77,45 +70,43 @@ func execGetEX(db *DB, args [][]byte) redis.Reply {
 			if ttlArg <= 0 {
 				return protocol.MakeErrReply("ERR invalid expire time in getex")
 			}
-			ttl = ttlArg * 1000
-			i++ // skip next arg
-		} else if arg == "PX" { // ttl in milliseconds
-			if ttl != unlimitedTTL {
-				return &protocol.SyntaxErrReply{}
+			switch arg {
+			case "EX":
+				expireTime = time.Now().Add(time.Duration(ttlArg) * time.Second)
+			case "PX":
+				expireTime = time.Now().Add(time.Duration(ttlArg) * time.Millisecond)
+			case "EXAT":
+				expireTime = time.Unix(ttlArg, 0)
+			case "PXAT":
+				expireTime = time.Unix(0, ttlArg*int64(time.Millisecond))
 			}
-			if i+1 >= len(args) {
-				return &protocol.SyntaxErrReply{}
-			}
-			ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-			if err != nil {
-				return &protocol.SyntaxErrReply{}
-			}
-			if ttlArg <= 0 {
-				return protocol.MakeErrReply("ERR invalid expire time in getex")
-			}
-			ttl = ttlArg
+			hasExpire = true
 			i++ // skip next arg
-		} else if arg == "PERSIST" {
-			if ttl != unlimitedTTL { // PERSIST Cannot be used with EX | PX
-				return &protocol.SyntaxErrReply{}
-			}
-			if i+1 > len(args) {
+		case "PERSIST":
+			if hasExpire { // PERSIST Cannot be used with EX | PX | EXAT | PXAT
 				return &protocol.SyntaxErrReply{}
 			}
-			db.Persist(key)
+			persist = true
+		default:
+			return &protocol.SyntaxErrReply{}
 		}
 	}
 
-	if len(args) > 1 {
-		if ttl != unlimitedTTL { // EX | PX
-			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
-			db.Expire(key, expireTime)
-			db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
-		} else { // PERSIST
-			db.Persist(key) // override ttl
-			// we convert to persist command to write aof
-			db.addAof(utils.ToCmdLine3("persist", args[0]))
-		}
+	bytes, err := db.getAsString(key)
+	if err != nil {
+		return err
+	}
+	if bytes == nil {
+		return &protocol.NullBulkReply{}
+	}
+
+	if hasExpire {
+		db.Expire(key, expireTime)
+		db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+	} else if persist {
+		db.Persist(key) // override ttl
+		// we convert to persist command to write aof
+		db.addAof(utils.ToCmdLine3("persist", args[0]))
 	}
 	return protocol.MakeBulkReply(bytes)
 }
@@ -599,34 +590,57 @@ func execAppend(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(len(bytes)))
 }
 
+// maxStringSize is the max length of string value, same as proto-max-bulk-len of redis
+const maxStringSize = 512 * 1024 * 1024
+
+// growBytes extends bs to size n with zero padding. If capacity is not enough, it reallocates with at least
+// doubled capacity so that repeatedly extending a string doesn't copy the whole buffer every time.
+func growBytes(bs []byte, n int) []byte {
+	if n <= cap(bs) {
+		oldLen := len(bs)
+		bs = bs[:n]
+		for i := oldLen; i < n; i++ {
+			bs[i] = 0
+		}
+		return bs
+	}
+	newCap := 2 * cap(bs)
+	if newCap < n {
+		newCap = n
+	}
+	grown := make([]byte, n, newCap)
+	copy(grown, bs)
+	return grown
+}
+
 // execSetRange overwrites part of the string stored at key, starting at the specified offset.
 // If the offset is larger than the current length of the string at key, the string is padded with zero-bytes.
 func execSetRange(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	offset, errNative := strconv.ParseInt(string(args[1]), 10, 64)
 	if errNative != nil {
-		return protocol.MakeErrReply(errNative.Error())
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if offset < 0 {
+		return protocol.MakeErrReply("ERR offset is out of range")
 	}
 	value := args[2]
 	bytes, err := db.getAsString(key)
 	if err != nil {
 		return err
 	}
-	bytesLen := int64(len(bytes))
-	if bytesLen < offset {
-		diff := offset - bytesLen
-		diffArray := make([]byte, diff)
-		bytes = append(bytes, diffArray...)
-		bytesLen = int64(len(bytes))
-	}
-	for i := 0; i < len(value); i++ {
-		idx := offset + int64(i)
-		if idx >= bytesLen {
-			bytes = append(bytes, value[i])
-		} else {
-			bytes[idx] = value[i]
-		}
+	if len(value) == 0 {
+		// nothing to write, and an empty value never creates key
+		return protocol.MakeIntReply(int64(len(bytes)))
 	}
+	end := offset + int64(len(value))
+	if end > maxStringSize {
+		return protocol.MakeErrReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	if end > int64(len(bytes)) {
+		bytes = growBytes(bytes, int(end))
+	}
+	copy(bytes[offset:], value)
 	db.PutEntity(key, &database.DataEntity{
 		Data: bytes,
 	})
@@ -703,37 +717,36 @@ func execGetBit(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(bm.GetBit(offset)))
 }
 
+// parseBitRangeMode parses the optional BYTE|BIT modifier of BITCOUNT and BITPOS
+func parseBitRangeMode(arg []byte) (bool, protocol.ErrorReply) {
+	mode := strings.ToLower(string(arg))
+	if mode == "bit" {
+		return false, nil
+	} else if mode == "byte" {
+		return true, nil
+	}
+	return false, protocol.MakeErrReply("ERR syntax error")
+}
+
 func execBitCount(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
+	if len(args) == 2 || len(args) > 4 {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
 	bs, err := db.getAsString(key)
 	if err != nil {
 		return err
 	}
-	if bs == nil {
-		return protocol.MakeIntReply(0)
-	}
 	byteMode := true
 	if len(args) > 3 {
-		mode := strings.ToLower(string(args[3]))
-		if mode == "bit" {
-			byteMode = false
-		} else if mode == "byte" {
-			byteMode = true
-		} else {
-			return protocol.MakeErrReply("ERR syntax error")
+		byteMode, err = parseBitRangeMode(args[3])
+		if err != nil {
+			return err
 		}
 	}
-	var size int64
-	bm := bitmap.FromBytes(bs)
-	if byteMode {
-		size = int64(len(*bm))
-	} else {
-		size = int64(bm.BitSize())
-	}
-	var beg, end int
+	var startIdx, endIdx int64
 	if len(args) > 1 {
 		var err2 error
-		var startIdx, endIdx int64
 		startIdx, err2 = strconv.ParseInt(string(args[1]), 10, 64)
 		if err2 != nil {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
@@ -742,6 +755,19 @@ func execBitCount(db *DB, args [][]byte) redis.Reply {
 		if err2 != nil {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
+	}
+	if bs == nil {
+		return protocol.MakeIntReply(0)
+	}
+	var size int64
+	bm := bitmap.FromBytes(bs)
+	if byteMode {
+		size = int64(len(*bm))
+	} else {
+		size = int64(bm.BitSize())
+	}
+	beg, end := 0, int(size)
+	if len(args) > 1 {
 		beg, end = utils.ConvertRange(startIdx, endIdx, size)
 		if beg < 0 {
 			return protocol.MakeIntReply(0)
@@ -766,13 +792,13 @@ func execBitCount(db *DB, args [][]byte) redis.Reply {
 
 func execBitPos(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
+	if len(args) > 5 {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
 	bs, err := db.getAsString(key)
 	if err != nil {
 		return err
 	}
-	if bs == nil {
-		return protocol.MakeIntReply(-1)
-	}
 	valStr := string(args[1])
 	var v byte
 	if valStr == "1" {
@@ -784,38 +810,43 @@ func execBitPos(db *DB, args [][]byte) redis.Reply {
 	}
 	byteMode := true
 	if len(args) > 4 {
-		mode := strings.ToLower(string(args[4]))
-		if mode == "bit" {
-			byteMode = false
-		} else if mode == "byte" {
-			byteMode = true
-		} else {
-			return protocol.MakeErrReply("ERR syntax error")
+		byteMode, err = parseBitRangeMode(args[4])
+		if err != nil {
+			return err
 		}
 	}
-	var size int64
-	bm := bitmap.FromBytes(bs)
-	if byteMode {
-		size = int64(len(*bm))
-	} else {
-		size = int64(bm.BitSize())
-	}
-	var beg, end int
+	startIdx, endIdx := int64(0), int64(-1)
+	endGiven := len(args) > 3
 	if len(args) > 2 {
 		var err2 error
-		var startIdx, endIdx int64
 		startIdx, err2 = strconv.ParseInt(string(args[2]), 10, 64)
 		if err2 != nil {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
-		endIdx, err2 = strconv.ParseInt(string(args[3]), 10, 64)
-		if err2 != nil {
-			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		if endGiven {
+			endIdx, err2 = strconv.ParseInt(string(args[3]), 10, 64)
+			if err2 != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
 		}
-		beg, end = utils.ConvertRange(startIdx, endIdx, size)
-		if beg < 0 {
+	}
+	if bs == nil {
+		// a missing key is treated as an infinite string of zero bits
+		if v == 0 {
 			return protocol.MakeIntReply(0)
 		}
+		return protocol.MakeIntReply(-1)
+	}
+	var size int64
+	bm := bitmap.FromBytes(bs)
+	if byteMode {
+		size = int64(len(*bm))
+	} else {
+		size = int64(bm.BitSize())
+	}
+	beg, end := utils.ConvertRange(startIdx, endIdx, size)
+	if beg < 0 {
+		return protocol.MakeIntReply(-1)
 	}
 	if byteMode {
 		beg *= 8
@@ -829,9 +860,451 @@ func execBitPos(db *DB, args [][]byte) redis.Reply {
 		}
 		return true
 	})
+	if offset < 0 && v == 0 && !endGiven {
+		// looking for clear bits without an explicit end, the string is considered padded with zeros on the right
+		return protocol.MakeIntReply(int64(bm.BitSize()))
+	}
 	return protocol.MakeIntReply(offset)
 }
 
+// execBitOp performs a bitwise operation between source strings and stores the result in dest
+func execBitOp(db *DB, args [][]byte) redis.Reply {
+	op := strings.ToLower(string(args[0]))
+	dest := string(args[1])
+	srcKeys := args[2:]
+	switch op {
+	case "and", "or", "xor":
+	case "not":
+		if len(srcKeys) != 1 {
+			return protocol.MakeErrReply("ERR BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	srcs := make([][]byte, len(srcKeys))
+	maxLen := 0
+	for i, srcKey := range srcKeys {
+		bs, err := db.getAsString(string(srcKey))
+		if err != nil {
+			return err
+		}
+		srcs[i] = bs
+		if len(bs) > maxLen {
+			maxLen = len(bs)
+		}
+	}
+	// shorter strings are treated as padded with zero bytes
+	result := make([]byte, maxLen)
+	if op == "not" {
+		for i, b := range srcs[0] {
+			result[i] = ^b
+		}
+	} else {
+		copy(result, srcs[0])
+		for _, src := range srcs[1:] {
+			for i := range result {
+				var b byte
+				if i < len(src) {
+					b = src[i]
+				}
+				switch op {
+				case "and":
+					result[i] &= b
+				case "or":
+					result[i] |= b
+				case "xor":
+					result[i] ^= b
+				}
+			}
+		}
+	}
+	if maxLen == 0 {
+		db.Remove(dest)
+	} else {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+	}
+	db.addAof(utils.ToCmdLine3("bitop", args...))
+	return protocol.MakeIntReply(int64(maxLen))
+}
+
+func prepareBitOp(args [][]byte) ([]string, []string) {
+	dest := string(args[1])
+	keys := make([]string, len(args)-2)
+	for i, arg := range args[2:] {
+		keys[i] = string(arg)
+	}
+	return []string{dest}, keys
+}
+
+func undoBitOp(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+const (
+	bitFieldOverflowWrap = iota
+	bitFieldOverflowSat
+	bitFieldOverflowFail
+)
+
+// bitFieldOp is a sub-command of BITFIELD
+type bitFieldOp struct {
+	op       string // get, set or incrby
+	signed   bool
+	width    int
+	offset   int64
+	value    int64
+	overflow int
+}
+
+// parseBitFieldType parses type such as i8 or u16
+func parseBitFieldType(arg string) (signed bool, width int, ok bool) {
+	if len(arg) < 2 {
+		return false, 0, false
+	}
+	switch arg[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+		signed = false
+	default:
+		return false, 0, false
+	}
+	width, err := strconv.Atoi(arg[1:])
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, false
+	}
+	return signed, width, true
+}
+
+// parseBitFieldOffset parses offset, "#n" means n*width
+func parseBitFieldOffset(arg string, width int) (int64, bool) {
+	multiply := strings.HasPrefix(arg, "#")
+	if multiply {
+		arg = arg[1:]
+	}
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+	if multiply {
+		offset *= int64(width)
+	}
+	if offset+int64(width) > 512*1024*1024*8 {
+		return 0, false
+	}
+	return offset, true
+}
+
+func parseBitFieldOps(args [][]byte, readOnly bool) ([]*bitFieldOp, protocol.ErrorReply) {
+	var ops []*bitFieldOp
+	overflow := bitFieldOverflowWrap
+	for i := 0; i < len(args); i++ {
+		subCmd := strings.ToLower(string(args[i]))
+		if subCmd == "overflow" {
+			if readOnly {
+				return nil, protocol.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+			if i+1 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			switch strings.ToLower(string(args[i+1])) {
+			case "wrap":
+				overflow = bitFieldOverflowWrap
+			case "sat":
+				overflow = bitFieldOverflowSat
+			case "fail":
+				overflow = bitFieldOverflowFail
+			default:
+				return nil, protocol.MakeErrReply("ERR Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		}
+		var argNum int
+		switch subCmd {
+		case "get":
+			argNum = 2
+		case "set", "incrby":
+			if readOnly {
+				return nil, protocol.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+			argNum = 3
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+		if i+argNum >= len(args) {
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+		signed, width, ok := parseBitFieldType(string(args[i+1]))
+		if !ok {
+			return nil, protocol.MakeErrReply("ERR Invalid bitfield type. Use something like i16 u8. " +
+				"Note that u64 is not supported but i64 is.")
+		}
+		offset, ok := parseBitFieldOffset(string(args[i+2]), width)
+		if !ok {
+			return nil, protocol.MakeErrReply("ERR bit offset is not an integer or out of range")
+		}
+		op := &bitFieldOp{
+			op:       subCmd,
+			signed:   signed,
+			width:    width,
+			offset:   offset,
+			overflow: overflow,
+		}
+		if argNum == 3 {
+			value, err := strconv.ParseInt(string(args[i+3]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			op.value = value
+		}
+		ops = append(ops, op)
+		i += argNum
+	}
+	return ops, nil
+}
+
+// bitFieldRange returns the min and max value of bit field
+func bitFieldRange(signed bool, width int) (*big.Int, *big.Int) {
+	if signed {
+		max := new(big.Int).Lsh(big.NewInt(1), uint(width-1))
+		min := new(big.Int).Neg(max)
+		return min, max.Sub(max, big.NewInt(1))
+	}
+	max := new(big.Int).Lsh(big.NewInt(1), uint(width))
+	return big.NewInt(0), max.Sub(max, big.NewInt(1))
+}
+
+// fitBitField handles overflow of val according to policy, returns false if FAIL policy rejects val
+func fitBitField(val *big.Int, signed bool, width int, overflow int) (int64, bool) {
+	min, max := bitFieldRange(signed, width)
+	if val.Cmp(min) >= 0 && val.Cmp(max) <= 0 {
+		return val.Int64(), true
+	}
+	switch overflow {
+	case bitFieldOverflowSat:
+		if val.Cmp(max) > 0 {
+			return max.Int64(), true
+		}
+		return min.Int64(), true
+	case bitFieldOverflowFail:
+		return 0, false
+	}
+	// wrap
+	mod := new(big.Int).Lsh(big.NewInt(1), uint(width))
+	wrapped := new(big.Int).Mod(val, mod)
+	if signed && wrapped.Cmp(max) > 0 {
+		wrapped.Sub(wrapped, mod)
+	}
+	return wrapped.Int64(), true
+}
+
+// readBitField reads a bit field and converts it to int64
+func readBitField(bm *bitmap.BitMap, signed bool, width int, offset int64) int64 {
+	raw := bm.GetBits(offset, width)
+	if signed && width < 64 && raw&(1<<uint(width-1)) != 0 {
+		// sign extend
+		raw |= ^uint64(0) << uint(width)
+	}
+	return int64(raw)
+}
+
+func execBitField0(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	key := string(args[0])
+	ops, errReply := parseBitFieldOps(args[1:], readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	bs, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	// copy value, so that undo logs generated before execution will not be modified
+	bm := bitmap.FromBytes(append([]byte(nil), bs...))
+	replies := make([]redis.Reply, 0, len(ops))
+	changed := false
+	for _, op := range ops {
+		old := readBitField(bm, op.signed, op.width, op.offset)
+		switch op.op {
+		case "get":
+			replies = append(replies, protocol.MakeIntReply(old))
+		case "set":
+			val, ok := fitBitField(big.NewInt(op.value), op.signed, op.width, op.overflow)
+			if !ok {
+				replies = append(replies, protocol.MakeNullBulkReply())
+				continue
+			}
+			bm.SetBits(op.offset, op.width, uint64(val))
+			changed = true
+			replies = append(replies, protocol.MakeIntReply(old))
+		case "incrby":
+			sum := new(big.Int).Add(big.NewInt(old), big.NewInt(op.value))
+			val, ok := fitBitField(sum, op.signed, op.width, op.overflow)
+			if !ok {
+				replies = append(replies, protocol.MakeNullBulkReply())
+				continue
+			}
+			bm.SetBits(op.offset, op.width, uint64(val))
+			changed = true
+			replies = append(replies, protocol.MakeIntReply(val))
+		}
+	}
+	if changed {
+		db.PutEntity(key, &database.DataEntity{Data: bm.ToBytes()})
+		db.addAof(utils.ToCmdLine3("bitfield", args...))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// execBitField treats string as an array of bits and reads or writes integers of arbitrary bit width
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]
+func execBitField(db *DB, args [][]byte) redis.Reply {
+	return execBitField0(db, args, false)
+}
+
+// execBitFieldRO is read-only variant of BITFIELD, only GET is allowed
+func execBitFieldRO(db *DB, args [][]byte) redis.Reply {
+	return execBitField0(db, args, true)
+}
+
+func prepareLCS(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[0]), string(args[1])}
+}
+
+// execLCS finds the longest common subsequence of two strings
+func execLCS(db *DB, args [][]byte) redis.Reply {
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 2; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "LEN":
+			getLen = true
+		case arg == "IDX":
+			getIdx = true
+		case arg == "WITHMATCHLEN":
+			withMatchLen = true
+		case arg == "MINMATCHLEN" && i+1 < len(args):
+			var err error
+			minMatchLen, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if minMatchLen < 0 {
+				minMatchLen = 0
+			}
+			i++
+		default:
+			return protocol.MakeErrReply("ERR syntax error")
+		}
+	}
+	if getLen && getIdx {
+		return protocol.MakeErrReply("ERR If you want both the length and indexes, please just use IDX.")
+	}
+	a, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	b, errReply := db.getAsString(string(args[1]))
+	if errReply != nil {
+		return errReply
+	}
+	if uint64(len(a)+1)*uint64(len(b)+1) >= math.MaxUint32/4 {
+		return protocol.MakeErrReply("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// table[i][j] is the length of LCS of a[:i] and b[:j]
+	width := len(b) + 1
+	table := make([]uint32, (len(a)+1)*width)
+	lcs := func(i, j int) uint32 {
+		return table[i*width+j]
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				table[i*width+j] = lcs(i-1, j-1) + 1
+			} else if lcs(i-1, j) > lcs(i, j-1) {
+				table[i*width+j] = lcs(i-1, j)
+			} else {
+				table[i*width+j] = lcs(i, j-1)
+			}
+		}
+	}
+	lcsLen := int(lcs(len(a), len(b)))
+	if getLen {
+		return protocol.MakeIntReply(int64(lcsLen))
+	}
+
+	// walk back from the end of both strings to collect the subsequence and matched ranges
+	result := make([]byte, lcsLen)
+	matches := make([]redis.Reply, 0)
+	idx := lcsLen
+	i, j := len(a), len(b)
+	aStart, aEnd, bStart, bEnd := -1, -1, -1, -1
+	for i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart < 0 {
+				aStart, aEnd = i-1, i-1
+				bStart, bEnd = j-1, j-1
+			} else if aStart == i && bStart == j {
+				// extend the range backward since it is contiguous
+				aStart--
+				bStart--
+			} else {
+				emitRange = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs(i-1, j) > lcs(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if aStart >= 0 {
+				emitRange = true
+			}
+		}
+		if emitRange {
+			matchLen := aEnd - aStart + 1
+			if getIdx && int64(matchLen) >= minMatchLen {
+				match := []redis.Reply{
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(aStart)),
+						protocol.MakeIntReply(int64(aEnd)),
+					}),
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(bStart)),
+						protocol.MakeIntReply(int64(bEnd)),
+					}),
+				}
+				if withMatchLen {
+					match = append(match, protocol.MakeIntReply(int64(matchLen)))
+				}
+				matches = append(matches, protocol.MakeMultiRawReply(match))
+			}
+			aStart = -1
+		}
+	}
+	if getIdx {
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("matches")),
+			protocol.MakeMultiRawReply(matches),
+			protocol.MakeBulkReply([]byte("len")),
+			protocol.MakeIntReply(int64(lcsLen)),
+		})
+	}
+	return protocol.MakeBulkReply(result)
+}
+
 func init() {
 	RegisterCommand("Set", execSet, writeFirstKey, rollbackFirstKey, -3, flagWrite)
 	RegisterCommand("SetNx", execSetNX, writeFirstKey, rollbackFirstKey, 3, flagWrite)
@@ -841,7 +1314,7 @@ func init() {
 	RegisterCommand("MGet", execMGet, prepareMGet, nil, -2, flagReadOnly)
 	RegisterCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3, flagWrite)
 	RegisterCommand("Get", execGet, readFirstKey, nil, 2, flagReadOnly)
-	RegisterCommand("GetEX", execGetEX, writeFirstKey, rollbackFirstKey, -2, flagReadOnly)
+	RegisterCommand("GetEX", execGetEX, writeFirstKey, undoExpire, -2, flagWrite)
 	RegisterCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3, flagWrite)
 	RegisterCommand("GetDel", execGetDel, writeFirstKey, rollbackFirstKey, 2, flagWrite)
 	RegisterCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2, flagWrite)
@@ -853,9 +1326,13 @@ func init() {
 	RegisterCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3, flagWrite)
 	RegisterCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	RegisterCommand("GetRange", execGetRange, readFirstKey, nil, 4, flagReadOnly)
+	RegisterCommand("LCS", execLCS, prepareLCS, nil, -3, flagReadOnly)
 	RegisterCommand("SetBit", execSetBit, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	RegisterCommand("GetBit", execGetBit, readFirstKey, nil, 3, flagReadOnly)
 	RegisterCommand("BitCount", execBitCount, readFirstKey, nil, -2, flagReadOnly)
 	RegisterCommand("BitPos", execBitPos, readFirstKey, nil, -3, flagReadOnly)
+	RegisterCommand("BitOp", execBitOp, prepareBitOp, undoBitOp, -4, flagWrite)
+	RegisterCommand("BitField", execBitField, writeFirstKey, rollbackFirstKey, -2, flagWrite)
+	RegisterCommand("BitField_RO", execBitFieldRO, readFirstKey, nil, -2, flagReadOnly)
 
 }
@@ -2,11 +2,13 @@ package database
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"strconv"
 	"testing"
+	"time"
 )
 
 var testDB = makeTestDB()
@@ -351,6 +353,65 @@ func TestGetEX(t *testing.T) {
 		t.Error(fmt.Sprintf("expected int between [0, 1000000], actually %d", intResult.Code))
 		return
 	}
+
+	// Test GetEX Key EXAT/PXAT timestamp
+	expireAt := time.Now().Add(time.Minute).Unix()
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EXAT", strconv.FormatInt(expireAt, 10)))
+	asserts.AssertBulkReply(t, actual, value)
+	actual = testDB.Exec(nil, utils.ToCmdLine("EXPIRETIME", key))
+	asserts.AssertIntReply(t, actual, int(expireAt))
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "PXAT", strconv.FormatInt(expireAt*1000+500, 10)))
+	asserts.AssertBulkReply(t, actual, value)
+	actual = testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key))
+	asserts.AssertIntReply(t, actual, int(expireAt*1000+500))
+
+	// invalid options don't change ttl
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "FOO"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "PERSIST", "EX", "10"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EX", "0"))
+	asserts.AssertErrReply(t, actual, "ERR invalid expire time in getex")
+	actual = testDB.Exec(nil, utils.ToCmdLine("PEXPIRETIME", key))
+	asserts.AssertIntReply(t, actual, int(expireAt*1000+500))
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", utils.RandString(10), "PERSIST"))
+	asserts.AssertNullBulk(t, actual)
+}
+
+func TestUndoGetEX(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EX", "100"))
+	cmdLine := utils.ToCmdLine("GETEX", key, "PERSIST")
+	undoCmdLines := undoExpire(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	actual := testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReplyGreaterThan(t, actual, 0)
+}
+
+func TestGetDel(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a"))
+	cmdLine := utils.ToCmdLine("GETDEL", key)
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	actual := testDB.Exec(nil, cmdLine)
+	asserts.AssertBulkReply(t, actual, "a")
+	actual = testDB.Exec(nil, utils.ToCmdLine("EXISTS", key))
+	asserts.AssertIntReply(t, actual, 0)
+	actual = testDB.Exec(nil, cmdLine)
+	asserts.AssertNullBulk(t, actual)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	asserts.AssertBulkReply(t, actual, "a")
 }
 
 func TestGetSet(t *testing.T) {
@@ -502,6 +563,57 @@ func TestSetRange_StringNotExist(t *testing.T) {
 	asserts.AssertIntReply(t, val, len(key))
 }
 
+func TestSetRange_Errors(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "-1", "a"))
+	asserts.AssertErrReply(t, actual, "ERR offset is out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "a", "a"))
+	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "536870911", "ab"))
+	asserts.AssertErrReply(t, actual, "ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+
+	// empty value doesn't create key
+	actual = testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "10", ""))
+	asserts.AssertIntReply(t, actual, 0)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Exists", key))
+	asserts.AssertIntReply(t, actual, 0)
+	testDB.Exec(nil, utils.ToCmdLine("Set", key, "abc"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "10", ""))
+	asserts.AssertIntReply(t, actual, 3)
+}
+
+func TestSetRange_Grow(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	expected := make([]byte, 0)
+	for i := 0; i < 100; i++ {
+		offset := i * 7
+		value := utils.RandString(5)
+		for len(expected) < offset+len(value) {
+			expected = append(expected, 0)
+		}
+		copy(expected[offset:], value)
+		actual := testDB.Exec(nil, utils.ToCmdLine("SetRange", key, strconv.Itoa(offset), value))
+		asserts.AssertIntReply(t, actual, len(expected))
+	}
+	// shrink by set, then grow inside the remaining capacity must pad zero
+	testDB.Exec(nil, utils.ToCmdLine("Set", key, "abc"))
+	testDB.Exec(nil, utils.ToCmdLine("Append", key, "def"))
+	testDB.Exec(nil, utils.ToCmdLine("SetRange", key, "8", "x"))
+	actual := testDB.Exec(nil, utils.ToCmdLine("Get", key))
+	asserts.AssertBulkReply(t, actual, "abcdef\x00\x00x")
+
+	bs := growBytes([]byte("ab"), 10)
+	if len(bs) != 10 || cap(bs) != 10 || string(bs) != "ab\x00\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("unexpected result of growBytes: %q", bs)
+	}
+	bs = growBytes(bs, 12)
+	if len(bs) != 12 || cap(bs) != 20 {
+		t.Errorf("expect capacity doubled, actually %d", cap(bs))
+	}
+}
+
 func TestGetRange_StringExist(t *testing.T) {
 	testDB.Flush()
 	key := utils.RandString(10)
@@ -770,6 +882,18 @@ func TestBitCount(t *testing.T) {
 	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
 	actual = testDB.Exec(nil, utils.ToCmdLine("BitCount", key, "A", "-1"))
 	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitCount", key, "1"))
+	asserts.AssertErrReply(t, actual, "ERR syntax error")
+
+	// bit range not aligned to bytes
+	key3 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key3, "\xff\xff"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitCount", key3, "5", "9", "BIT"))
+	asserts.AssertIntReply(t, actual, 5)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitCount", key3, "-3", "-1", "bit"))
+	asserts.AssertIntReply(t, actual, 3)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitCount", key3, "0", "0", "BIT"))
+	asserts.AssertIntReply(t, actual, 1)
 }
 
 func TestBitPos(t *testing.T) {
@@ -801,4 +925,177 @@ func TestBitPos(t *testing.T) {
 	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
 	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key, "-1"))
 	asserts.AssertErrReply(t, actual, "ERR bit is not an integer or out of range")
+
+	// start without end
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key, "1", "1"))
+	asserts.AssertIntReply(t, actual, 15)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key, "1", "2"))
+	asserts.AssertIntReply(t, actual, -1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key, "1", "0", "14", "BIT"))
+	asserts.AssertIntReply(t, actual, -1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key+"a", "0"))
+	asserts.AssertIntReply(t, actual, 0)
+
+	// clear bits beyond the string are only considered without an explicit end
+	key3 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key3, "\xff"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key3, "0"))
+	asserts.AssertIntReply(t, actual, 8)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key3, "0", "0", "-1"))
+	asserts.AssertIntReply(t, actual, -1)
+}
+
+func TestBitOp(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key1, "foobar"))
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "abc"))
+
+	actual := testDB.Exec(nil, utils.ToCmdLine("BitOp", "AND", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 6)
+	actual = testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, actual, "`bc\x00\x00\x00")
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "OR", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 6)
+	actual = testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, actual, "goobar")
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "XOR", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 6)
+	actual = testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, actual, "\x07\r\x0cbar")
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NOT", dest, key2))
+	asserts.AssertIntReply(t, actual, 3)
+	actual = testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, actual, "\x9e\x9d\x9c")
+
+	// all sources missing removes dest
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "OR", dest, key1+"a", key2+"a"))
+	asserts.AssertIntReply(t, actual, 0)
+	actual = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, actual, 0)
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NOT", dest, key1, key2))
+	asserts.AssertErrReply(t, actual, "ERR BITOP NOT must be called with a single source key.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NAND", dest, key1, key2))
+	asserts.AssertErrReply(t, actual, "ERR syntax error")
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2+"l", "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "AND", dest, key1, key2+"l"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestUndoBitOp(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key, "abc"))
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "xyz"))
+	cmdLine := utils.ToCmdLine("BitOp", "NOT", dest, key)
+	undoCmdLines := undoBitOp(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	actual := testDB.Exec(nil, utils.ToCmdLine("get", dest))
+	asserts.AssertBulkReply(t, actual, "xyz")
+}
+
+func assertBitFieldReply(t *testing.T, actual redis.Reply, expected ...interface{}) {
+	replies := make([]redis.Reply, len(expected))
+	for i, v := range expected {
+		if v == nil {
+			replies[i] = protocol.MakeNullBulkReply()
+		} else {
+			replies[i] = protocol.MakeIntReply(int64(v.(int)))
+		}
+	}
+	expectedReply := protocol.MakeMultiRawReply(replies)
+	if !utils.BytesEquals(actual.ToBytes(), expectedReply.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expectedReply.ToBytes(), actual.ToBytes())
+	}
+}
+
+func TestBitField(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("BitField", key, "SET", "i8", "0", "-100", "GET", "i8", "0", "GET", "u8", "0"))
+	assertBitFieldReply(t, actual, 0, -100, 156)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key, "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"))
+	assertBitFieldReply(t, actual, 1, 1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key, "INCRBY", "u2", "100", "3", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "5"))
+	assertBitFieldReply(t, actual, 0, 3)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key, "OVERFLOW", "FAIL", "INCRBY", "i8", "0", "-100"))
+	assertBitFieldReply(t, actual, nil)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key, "OVERFLOW", "WRAP", "INCRBY", "i8", "0", "-100"))
+	assertBitFieldReply(t, actual, 56)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key, "SET", "u4", "#1", "15", "GET", "u4", "4", "GET", "i64", "8"))
+	assertBitFieldReply(t, actual, 8, 15, 0)
+
+	// bitfield shares bit order with setbit
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("SetBit", key2, "1", "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField_RO", key2, "GET", "u2", "0"))
+	assertBitFieldReply(t, actual, 1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField_RO", key2, "SET", "u2", "0", "1"))
+	asserts.AssertErrReply(t, actual, "ERR BITFIELD_RO only supports the GET subcommand")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key2, "GET", "u64", "0"))
+	asserts.AssertErrReply(t, actual, "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitField", key2, "GET", "u8", "-1"))
+	asserts.AssertErrReply(t, actual, "ERR bit offset is not an integer or out of range")
+}
+
+func TestUndoBitField(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("Set", key, "a"))
+	cmdLine := utils.ToCmdLine("BitField", key, "SET", "u8", "0", "255")
+	undoCmdLines := rollbackFirstKey(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	actual := testDB.Exec(nil, utils.ToCmdLine("Get", key))
+	asserts.AssertBulkReply(t, actual, "a")
+}
+
+func TestLCS(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key1, "ohmytext"))
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "mynewtext"))
+	actual := testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2))
+	asserts.AssertBulkReply(t, actual, "mytext")
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2, "len"))
+	asserts.AssertIntReply(t, actual, 6)
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2, "idx"))
+	expected := "*4\r\n$7\r\nmatches\r\n*2\r\n" +
+		"*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n" +
+		"*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n" +
+		"$3\r\nlen\r\n:6\r\n"
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("wrong idx reply: %q", string(actual.ToBytes()))
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2, "idx", "minmatchlen", "4", "withmatchlen"))
+	expected = "*4\r\n$7\r\nmatches\r\n*1\r\n" +
+		"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+		"$3\r\nlen\r\n:6\r\n"
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("wrong idx reply: %q", string(actual.ToBytes()))
+	}
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2+"a"))
+	asserts.AssertBulkReply(t, actual, "")
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2, "len", "idx"))
+	asserts.AssertErrReply(t, actual, "ERR If you want both the length and indexes, please just use IDX.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2, "foo"))
+	asserts.AssertErrReply(t, actual, "ERR syntax error")
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2+"l", "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("lcs", key1, key2+"l"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
 }
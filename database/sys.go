@@ -18,26 +18,34 @@ func Ping(db *DB, args [][]byte) redis.Reply {
 }
 
 // Auth validate client's password
+// usage: AUTH [username] password, username could only be default since there is no other user
 func Auth(c redis.Connection, args [][]byte) redis.Reply {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'auth' command")
 	}
-	if config.Properties.RequirePass == "" {
+	if config.Properties().RequirePass == "" {
 		return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
 	}
-	passwd := string(args[0])
-	c.SetPassword(passwd)
-	if config.Properties.RequirePass != passwd {
+	passwd := string(args[len(args)-1])
+	if len(args) == 2 && (string(args[0]) != defaultUser || config.Properties().RequirePass != passwd) {
+		return protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	if config.Properties().RequirePass != passwd {
 		return protocol.MakeErrReply("ERR invalid password")
 	}
+	c.SetPassword(passwd)
 	return &protocol.OkReply{}
 }
 
-func isAuthenticated(c redis.Connection) bool {
-	if config.Properties.RequirePass == "" {
+// defaultUser is the only user, which is authenticated by requirepass
+const defaultUser = "default"
+
+// IsAuthenticated tells whether the client has sent requirepass by AUTH or HELLO
+func IsAuthenticated(c redis.Connection) bool {
+	if config.Properties().RequirePass == "" {
 		return true
 	}
-	return c.GetPassword() == config.Properties.RequirePass
+	return c.GetPassword() == config.Properties().RequirePass
 }
 
 func init() {
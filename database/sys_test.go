@@ -26,9 +26,13 @@ func TestAuth(t *testing.T) {
 	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", passwd))
 	asserts.AssertErrReply(t, ret, "ERR Client sent AUTH, but no password is set")
 
-	config.Properties.RequirePass = passwd
+	config.Update(func(p *config.ServerProperties) {
+		p.RequirePass = passwd
+	})
 	defer func() {
-		config.Properties.RequirePass = ""
+		config.Update(func(p *config.ServerProperties) {
+			p.RequirePass = ""
+		})
 	}()
 	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", passwd+"wrong"))
 	asserts.AssertErrReply(t, ret, "ERR invalid password")
@@ -37,4 +41,35 @@ func TestAuth(t *testing.T) {
 	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", passwd))
 	asserts.AssertStatusReply(t, ret, "OK")
 
+	// username could only be default
+	c = &connection.FakeConn{}
+	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", "admin", passwd))
+	asserts.AssertErrReply(t, ret, "WRONGPASS invalid username-password pair or user is disabled.")
+	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", "default", passwd+"wrong"))
+	asserts.AssertErrReply(t, ret, "WRONGPASS invalid username-password pair or user is disabled.")
+	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", "default", passwd))
+	asserts.AssertStatusReply(t, ret, "OK")
+	// failed AUTH keeps the client authenticated
+	ret = testServer.Exec(c, utils.ToCmdLine("AUTH", passwd+"wrong"))
+	asserts.AssertErrReply(t, ret, "ERR invalid password")
+	ret = testServer.Exec(c, utils.ToCmdLine("PING"))
+	asserts.AssertStatusReply(t, ret, "PONG")
+
+	// HELLO authenticates by AUTH option, and it is refused without authentication
+	c = &connection.FakeConn{}
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3"))
+	asserts.AssertErrReply(t, ret, "NOAUTH HELLO must be called with the client already authenticated, "+
+		"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client "+
+		"and select the RESP protocol version at the same time")
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3", "AUTH", "default", passwd+"wrong"))
+	asserts.AssertErrReply(t, ret, "WRONGPASS invalid username-password pair or user is disabled.")
+	if c.GetProtocol() == 3 {
+		t.Error("protocol should not be switched before authenticated")
+	}
+	ret = testServer.Exec(c, utils.ToCmdLine("HELLO", "3", "AUTH", "default", passwd))
+	if string(ret.ToBytes()[:4]) != "%6\r\n" {
+		t.Errorf("expect map reply in RESP3, actual %q", ret.ToBytes())
+	}
+	ret = testServer.Exec(c, utils.ToCmdLine("PING"))
+	asserts.AssertStatusReply(t, ret, "PONG")
 }
@@ -102,6 +102,10 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 	readKeys = append(readKeys, watchingKeys...)
 	db.RWLocks(writeKeys, readKeys)
 	defer db.RWUnLocks(writeKeys, readKeys)
+	if isFromMaster(conn) {
+		db.markMasterKeys(writeKeys, readKeys)
+		defer db.unmarkMasterKeys(writeKeys, readKeys)
+	}
 
 	if isWatchingChanged(db, watching) { // watching keys changed, abort
 		return protocol.MakeEmptyMultiBulkReply()
@@ -123,6 +127,7 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 	}
 	if !aborted { //success
 		db.addVersion(writeKeys...)
+		db.tracking.Invalidate(conn, writeKeys)
 		return protocol.MakeMultiRawReply(results)
 	}
 	// undo if aborted
@@ -51,11 +51,14 @@ func rollbackGivenKeys(db *DB, keys ...string) []CmdLine {
 				utils.ToCmdLine("DEL", key),
 			)
 		} else {
-			undoCmdLines = append(undoCmdLines,
-				utils.ToCmdLine("DEL", key), // clean existed first
-				aof.EntityToCmd(key, entity).Args,
-				toTTLCmd(db, key).Args,
-			)
+			undoCmdLines = append(undoCmdLines, utils.ToCmdLine("DEL", key)) // clean existed first
+			for _, cmd := range aof.EntityToCmds(key, entity) {
+				undoCmdLines = append(undoCmdLines, cmd.Args)
+			}
+			undoCmdLines = append(undoCmdLines, toTTLCmd(db, key).Args)
+			for _, cmd := range aof.MakeHashFieldExpireCmds(key, entity) {
+				undoCmdLines = append(undoCmdLines, cmd.Args)
+			}
 		}
 	}
 	return undoCmdLines
@@ -84,6 +87,9 @@ func rollbackHashFields(db *DB, key string, fields ...string) []CmdLine {
 			undoCmdLines = append(undoCmdLines,
 				utils.ToCmdLine("HSET", key, field, string(value)),
 			)
+			if expireAt, ok := getHashFieldExpireTime(dict, field); ok {
+				undoCmdLines = append(undoCmdLines, makeHashFieldExpireCmd(key, expireAt, field))
+			}
 		}
 	}
 	return undoCmdLines
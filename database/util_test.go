@@ -12,5 +12,9 @@ func makeTestDB() *DB {
 		ttlMap:     dict.MakeConcurrent(ttlDictSize),
 		locker:     lock.Make(lockerSize),
 		addAof:     func(line CmdLine) {},
+		isReplica:  func() bool { return false },
+		masterKeys: dict.MakeConcurrent(masterKeysDictSize),
+		blocking:   makeBlockingRegistry(),
+		watchers:   makeWatchRegistry(),
 	}
 }
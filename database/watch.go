@@ -0,0 +1,128 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sync"
+)
+
+// remoteWatcher is a WATCH registered by a client connected to another node of cluster
+type remoteWatcher struct {
+	keys  []string
+	dirty bool
+}
+
+// watchRegistry records remote watchers of each key, it is used to implement WATCH across cluster nodes.
+// Watchers are marked dirty once any of their keys is modified
+type watchRegistry struct {
+	mu sync.Mutex
+	// key -> set of watcher id
+	keys map[string]map[string]struct{}
+	// watcher id -> watcher
+	watchers map[string]*remoteWatcher
+}
+
+func makeWatchRegistry() *watchRegistry {
+	return &watchRegistry{
+		keys:     make(map[string]map[string]struct{}),
+		watchers: make(map[string]*remoteWatcher),
+	}
+}
+
+func (r *watchRegistry) add(id string, keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.watchers[id]
+	if !ok {
+		w = &remoteWatcher{}
+		r.watchers[id] = w
+	}
+	for _, key := range keys {
+		set, ok := r.keys[key]
+		if !ok {
+			set = make(map[string]struct{})
+			r.keys[key] = set
+		}
+		if _, ok := set[id]; !ok {
+			set[id] = struct{}{}
+			w.keys = append(w.keys, key)
+		}
+	}
+}
+
+// remove unregisters the watcher and returns whether its keys have been modified.
+// Unknown watcher is regarded as dirty, since its registration may be dropped by FLUSHDB
+func (r *watchRegistry) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.watchers[id]
+	if !ok {
+		return true
+	}
+	delete(r.watchers, id)
+	for _, key := range w.keys {
+		set := r.keys[key]
+		delete(set, id)
+		if len(set) == 0 {
+			delete(r.keys, key)
+		}
+	}
+	return w.dirty
+}
+
+// touch marks watchers of the given keys as dirty
+func (r *watchRegistry) touch(keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.watchers) == 0 {
+		return
+	}
+	for _, key := range keys {
+		for id := range r.keys[key] {
+			r.watchers[id].dirty = true
+		}
+	}
+}
+
+// touchAll marks all watchers as dirty
+func (r *watchRegistry) touchAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, w := range r.watchers {
+		w.dirty = true
+	}
+}
+
+// execWatchKeys registers a remote watcher on the given keys
+// example: WatchKeys watcher-id key1 key2...
+// custom command for WATCH in cluster mode
+func execWatchKeys(db *DB, args [][]byte) redis.Reply {
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		keys[i] = string(arg)
+	}
+	db.watchers.add(string(args[0]), keys)
+	return protocol.MakeOkReply()
+}
+
+// execCheckWatch unregisters the remote watcher, returns 1 if any of its keys has been modified otherwise 0
+// example: CheckWatch watcher-id
+func execCheckWatch(db *DB, args [][]byte) redis.Reply {
+	if db.watchers.remove(string(args[0])) {
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeIntReply(0)
+}
+
+// execUnWatchKeys unregisters the remote watcher, it is used when client discards transaction or disconnects
+// example: UnWatchKeys watcher-id
+func execUnWatchKeys(db *DB, args [][]byte) redis.Reply {
+	db.watchers.remove(string(args[0]))
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("WatchKeys", execWatchKeys, noPrepare, nil, -3, flagReadOnly)
+	RegisterCommand("CheckWatch", execCheckWatch, noPrepare, nil, 2, flagReadOnly)
+	RegisterCommand("UnWatchKeys", execUnWatchKeys, noPrepare, nil, 2, flagReadOnly)
+}
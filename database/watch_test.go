@@ -0,0 +1,41 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestWatchKeys(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	watcher := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("WatchKeys", watcher, key1, key2))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("CheckWatch", watcher))
+	asserts.AssertIntReply(t, result, 0)
+	// watcher is removed after checking
+	result = testDB.Exec(nil, utils.ToCmdLine("CheckWatch", watcher))
+	asserts.AssertIntReply(t, result, 1)
+
+	testDB.Exec(nil, utils.ToCmdLine("WatchKeys", watcher, key1, key2))
+	testDB.Exec(nil, utils.ToCmdLine("set", key2, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("CheckWatch", watcher))
+	asserts.AssertIntReply(t, result, 1)
+	if len(testDB.watchers.keys) != 0 {
+		t.Error("watched keys should be removed")
+	}
+
+	testDB.Exec(nil, utils.ToCmdLine("WatchKeys", watcher, key1))
+	testDB.Flush()
+	result = testDB.Exec(nil, utils.ToCmdLine("CheckWatch", watcher))
+	asserts.AssertIntReply(t, result, 1)
+
+	testDB.Exec(nil, utils.ToCmdLine("WatchKeys", watcher, key1))
+	result = testDB.Exec(nil, utils.ToCmdLine("UnWatchKeys", watcher))
+	asserts.AssertStatusReply(t, result, "OK")
+	if len(testDB.watchers.watchers) != 0 {
+		t.Error("watcher should be removed")
+	}
+}
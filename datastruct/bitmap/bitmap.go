@@ -68,6 +68,9 @@ func (b *BitMap) ForEachBit(begin int64, end int64, cb Callback) {
 	for byteIndex < int64(len(*b)) {
 		b := (*b)[byteIndex]
 		for bitOffset < 8 {
+			if end > 0 && offset >= end {
+				return
+			}
 			bit := byte(b >> bitOffset & 0x01)
 			if !cb(offset, bit) {
 				return
@@ -77,9 +80,6 @@ func (b *BitMap) ForEachBit(begin int64, end int64, cb Callback) {
 		}
 		byteIndex++
 		bitOffset = 0
-		if end > 0 && offset == end {
-			break
-		}
 	}
 }
 
@@ -95,3 +95,20 @@ func (b *BitMap) ForEachByte(begin int, end int, cb Callback) {
 		}
 	}
 }
+
+// GetBits reads an integer of width bits starting at offset, the bit at offset is the most significant bit
+func (b *BitMap) GetBits(offset int64, width int) uint64 {
+	var val uint64
+	for i := 0; i < width; i++ {
+		val = val<<1 | uint64(b.GetBit(offset+int64(i)))
+	}
+	return val
+}
+
+// SetBits writes the lowest width bits of val starting at offset, the bit at offset is the most significant bit
+func (b *BitMap) SetBits(offset int64, width int, val uint64) {
+	for i := 0; i < width; i++ {
+		bit := byte(val>>uint(width-1-i)) & 0x01
+		b.SetBit(offset+int64(i), bit)
+	}
+}
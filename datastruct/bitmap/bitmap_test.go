@@ -81,6 +81,14 @@ func TestForEachBit(t *testing.T) {
 	if count != 100 {
 		t.Error("wrong count")
 	}
+	count = 0
+	bm.ForEachBit(3, 13, func(offset int64, val byte) bool {
+		count++
+		return true
+	})
+	if count != 10 {
+		t.Error("wrong count of unaligned range")
+	}
 	bm = New()
 	size := 1000
 	offsets := make([]int64, size)
@@ -166,3 +174,21 @@ func TestBitMap_ForEachByte(t *testing.T) {
 		t.Error("break failed")
 	}
 }
+
+func TestBits(t *testing.T) {
+	bm := New()
+	bm.SetBits(3, 10, 0x2a5)
+	if v := bm.GetBits(3, 10); v != 0x2a5 {
+		t.Errorf("expected 0x2a5, actual %x", v)
+	}
+	if bm.GetBit(3) != 1 || bm.GetBit(4) != 0 {
+		t.Error("the first bit should be the most significant bit")
+	}
+	bm.SetBits(0, 64, 1<<63|1)
+	if v := bm.GetBits(0, 64); v != 1<<63|1 {
+		t.Errorf("wrong value %x", v)
+	}
+	if v := bm.GetBits(100, 8); v != 0 {
+		t.Errorf("bits out of range should be 0, actual %d", v)
+	}
+}
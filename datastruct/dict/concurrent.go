@@ -13,6 +13,8 @@ type ConcurrentDict struct {
 	table      []*shard
 	count      int32
 	shardCount int
+	// maxShardSize is an upper bound of the number of keys in a shard, used by uniform random sampling
+	maxShardSize int32
 }
 
 type shard struct {
@@ -118,6 +120,7 @@ func (dict *ConcurrentDict) Put(key string, val interface{}) (result int) {
 	}
 	dict.addCount()
 	s.m[key] = val
+	dict.growMaxShardSize(len(s.m))
 	return 1
 }
 
@@ -137,6 +140,7 @@ func (dict *ConcurrentDict) PutIfAbsent(key string, val interface{}) (result int
 	}
 	s.m[key] = val
 	dict.addCount()
+	dict.growMaxShardSize(len(s.m))
 	return 1
 }
 
@@ -185,6 +189,29 @@ func (dict *ConcurrentDict) decreaseCount() int32 {
 	return atomic.AddInt32(&dict.count, -1)
 }
 
+// growMaxShardSize raises maxShardSize if the given shard size exceeds it
+func (dict *ConcurrentDict) growMaxShardSize(size int) {
+	for {
+		current := atomic.LoadInt32(&dict.maxShardSize)
+		if int32(size) <= current || atomic.CompareAndSwapInt32(&dict.maxShardSize, current, int32(size)) {
+			return
+		}
+	}
+}
+
+// refreshMaxShardSize recomputes maxShardSize, since removing keys may leave it much larger than the real maximum
+func (dict *ConcurrentDict) refreshMaxShardSize() {
+	maxSize := 0
+	for _, s := range dict.table {
+		s.mutex.RLock()
+		if len(s.m) > maxSize {
+			maxSize = len(s.m)
+		}
+		s.mutex.RUnlock()
+	}
+	atomic.StoreInt32(&dict.maxShardSize, int32(maxSize))
+}
+
 // ForEach traversal the dict
 // it may not visits new entry inserted during traversal
 func (dict *ConcurrentDict) ForEach(consumer Consumer) {
@@ -222,40 +249,89 @@ func (dict *ConcurrentDict) Keys() []string {
 	return keys
 }
 
-// RandomKey returns a key randomly
-func (shard *shard) RandomKey() string {
+// Scan visits shards beginning at the given cursor until at least count keys have been visited,
+// returns the cursor to continue with, 0 means the traversal is complete.
+// Every shard is visited as a whole, so keys existing during the whole traversal are visited exactly once.
+func (dict *ConcurrentDict) Scan(cursor int, count int, consumer Consumer) int {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	if cursor < 0 || cursor >= len(dict.table) {
+		return 0
+	}
+	visited := 0
+	for i := cursor; i < len(dict.table); i++ {
+		s := dict.table[i]
+		continues := true
+		s.mutex.RLock()
+		for key, value := range s.m {
+			visited++
+			if continues = consumer(key, value); !continues {
+				break
+			}
+		}
+		s.mutex.RUnlock()
+		if (!continues || visited >= count) && i+1 < len(dict.table) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// keyAt returns the key at the given position of shard iteration
+func (shard *shard) keyAt(index int) (string, bool) {
 	if shard == nil {
 		panic("shard is nil")
 	}
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
 
+	if index >= len(shard.m) {
+		return "", false
+	}
 	for key := range shard.m {
-		return key
+		if index == 0 {
+			return key, true
+		}
+		index--
+	}
+	return "", false
+}
+
+// randomKey returns a key uniformly by rejection sampling without visiting all shards:
+// it picks a random shard and a random slot under maxShardSize, and accepts the slot only if the shard has a key there.
+// So every key is returned with the same probability no matter how many keys its shard holds.
+func (dict *ConcurrentDict) randomKey(nR *rand.Rand) (string, bool) {
+	shardCount := len(dict.table)
+	for attempts := 1; dict.Len() > 0; attempts++ {
+		if attempts%shardCount == 0 {
+			dict.refreshMaxShardSize()
+		}
+		bound := int(atomic.LoadInt32(&dict.maxShardSize))
+		if bound <= 0 {
+			bound = 1
+		}
+		s := dict.getShard(uint32(nR.Intn(shardCount)))
+		if key, ok := s.keyAt(nR.Intn(bound)); ok {
+			return key, true
+		}
 	}
-	return ""
+	return "", false
 }
 
 // RandomKeys randomly returns keys of the given number, may contain duplicated key
 func (dict *ConcurrentDict) RandomKeys(limit int) []string {
-	size := dict.Len()
-	if limit >= size {
-		return dict.Keys()
+	if limit <= 0 || dict.Len() == 0 {
+		return []string{}
 	}
-	shardCount := len(dict.table)
-
-	result := make([]string, limit)
+	result := make([]string, 0, limit)
 	nR := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := 0; i < limit; {
-		s := dict.getShard(uint32(nR.Intn(shardCount)))
-		if s == nil {
-			continue
-		}
-		key := s.RandomKey()
-		if key != "" {
-			result[i] = key
-			i++
+	for len(result) < limit {
+		key, ok := dict.randomKey(nR)
+		if !ok {
+			break
 		}
+		result = append(result, key)
 	}
 	return result
 }
@@ -267,27 +343,18 @@ func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
 		return dict.Keys()
 	}
 
-	shardCount := len(dict.table)
 	result := make(map[string]struct{})
 	nR := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for len(result) < limit {
-		shardIndex := uint32(nR.Intn(shardCount))
-		s := dict.getShard(shardIndex)
-		if s == nil {
-			continue
-		}
-		key := s.RandomKey()
-		if key != "" {
-			if _, exists := result[key]; !exists {
-				result[key] = struct{}{}
-			}
+		key, ok := dict.randomKey(nR)
+		if !ok {
+			break
 		}
+		result[key] = struct{}{}
 	}
-	arr := make([]string, limit)
-	i := 0
+	arr := make([]string, 0, len(result))
 	for k := range result {
-		arr[i] = k
-		i++
+		arr = append(arr, k)
 	}
 	return arr
 }
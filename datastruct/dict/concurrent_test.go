@@ -288,3 +288,53 @@ func TestConcurrentDict_Keys(t *testing.T) {
 		t.Errorf("expect %d keys, actual: %d", size, len(d.Keys()))
 	}
 }
+
+func TestConcurrentRandomKeyUniform(t *testing.T) {
+	d := MakeConcurrent(16)
+	for i := 0; i < 1000; i++ {
+		d.Put("k"+strconv.Itoa(i), i)
+	}
+	// removing most keys leaves shards of different sizes and a loose maxShardSize
+	for i := 20; i < 1000; i++ {
+		d.Remove("k" + strconv.Itoa(i))
+	}
+	sampleCount := 20000
+	counter := make(map[string]int)
+	for _, key := range d.RandomKeys(sampleCount) {
+		counter[key]++
+	}
+	expected := sampleCount / d.Len()
+	for i := 0; i < d.Len(); i++ {
+		key := "k" + strconv.Itoa(i)
+		if counter[key] < expected*7/10 || counter[key] > expected*13/10 {
+			t.Errorf("key %s is sampled %d times, expected about %d", key, counter[key], expected)
+		}
+	}
+}
+
+func TestConcurrentScan(t *testing.T) {
+	d := MakeConcurrent(64)
+	size := 100
+	for i := 0; i < size; i++ {
+		d.Put("k"+strconv.Itoa(i), i)
+	}
+	visited := make(map[string]int)
+	cursor := 0
+	for {
+		cursor = d.Scan(cursor, 3, func(key string, val interface{}) bool {
+			visited[key]++
+			return true
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	if len(visited) != size {
+		t.Errorf("expect %d keys, actual: %d", size, len(visited))
+	}
+	for key, times := range visited {
+		if times != 1 {
+			t.Errorf("key %s is visited %d times", key, times)
+		}
+	}
+}
@@ -14,6 +14,7 @@ type Dict interface {
 	Remove(key string) (result int)
 	ForEach(consumer Consumer)
 	Keys() []string
+	Scan(cursor int, count int, consumer Consumer) (next int)
 	RandomKeys(limit int) []string
 	RandomDistinctKeys(limit int) []string
 	Clear()
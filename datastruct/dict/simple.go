@@ -1,5 +1,10 @@
 package dict
 
+import (
+	"math/rand"
+	"sort"
+)
+
 // SimpleDict wraps a map, it is not thread safe
 type SimpleDict struct {
 	m map[string]interface{}
@@ -86,31 +91,59 @@ func (dict *SimpleDict) ForEach(consumer Consumer) {
 	}
 }
 
-// RandomKeys randomly returns keys of the given number, may contain duplicated key
+// Scan visits all keys in one call since map of go has no stable iteration order, the returned cursor is always 0
+func (dict *SimpleDict) Scan(cursor int, count int, consumer Consumer) int {
+	dict.ForEach(consumer)
+	return 0
+}
+
+// RandomKeys randomly returns keys of the given number, may contain duplicated key.
+// It draws random positions then collects them in a single pass over the map, so it only allocates O(limit) memory.
 func (dict *SimpleDict) RandomKeys(limit int) []string {
-	result := make([]string, limit)
-	for i := 0; i < limit; i++ {
-		for k := range dict.m {
-			result[i] = k
+	size := len(dict.m)
+	if limit <= 0 || size == 0 {
+		return []string{}
+	}
+	positions := make([]int, limit)
+	for i := range positions {
+		positions[i] = rand.Intn(size)
+	}
+	sort.Ints(positions)
+	result := make([]string, 0, limit)
+	i := 0
+	for k := range dict.m {
+		for len(result) < limit && positions[len(result)] == i {
+			result = append(result, k)
+		}
+		if len(result) == limit {
 			break
 		}
+		i++
 	}
+	// keys were collected in the order of iteration, shuffle them to make the order random too
+	rand.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
 	return result
 }
 
-// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key.
+// It uses reservoir sampling, so that every key has the same chance to be selected.
 func (dict *SimpleDict) RandomDistinctKeys(limit int) []string {
-	size := limit
-	if size > len(dict.m) {
-		size = len(dict.m)
+	if limit <= 0 {
+		return []string{}
 	}
-	result := make([]string, size)
+	if limit >= len(dict.m) {
+		return dict.Keys()
+	}
+	result := make([]string, 0, limit)
 	i := 0
 	for k := range dict.m {
-		if i == size {
-			break
+		if i < limit {
+			result = append(result, k)
+		} else if j := rand.Intn(i + 1); j < limit {
+			result[j] = k
 		}
-		result[i] = k
 		i++
 	}
 	return result
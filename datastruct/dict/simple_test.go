@@ -3,6 +3,7 @@ package dict
 import (
 	"github.com/hdt3213/godis/lib/utils"
 	"sort"
+	"strconv"
 	"testing"
 )
 
@@ -53,3 +54,43 @@ func TestSimpleDict_PutIfExists(t *testing.T) {
 		return
 	}
 }
+
+func TestSimpleDict_RandomKeys(t *testing.T) {
+	d := MakeSimple()
+	count := 100
+	for i := 0; i < count; i++ {
+		d.Put("k"+strconv.Itoa(i), i)
+	}
+	result := d.RandomKeys(count * 2)
+	if len(result) != count*2 {
+		t.Errorf("expect %d random keys actually %d", count*2, len(result))
+	}
+	for _, key := range result {
+		if _, ok := d.Get(key); !ok {
+			t.Errorf("unexpected key %s", key)
+		}
+	}
+	// every key has the same chance, so a small sample should not always start from the same key
+	first := d.RandomDistinctKeys(1)[0]
+	different := false
+	for i := 0; i < 100 && !different; i++ {
+		different = d.RandomDistinctKeys(1)[0] != first
+	}
+	if !different {
+		t.Error("random distinct keys always return the same key")
+	}
+	result = d.RandomDistinctKeys(10)
+	distinct := make(map[string]struct{})
+	for _, key := range result {
+		distinct[key] = struct{}{}
+	}
+	if len(result) != 10 || len(distinct) != 10 {
+		t.Errorf("expect 10 distinct keys actually %d", len(distinct))
+	}
+	if result = d.RandomDistinctKeys(count + 10); len(result) != count {
+		t.Errorf("expect %d keys actually %d", count, len(result))
+	}
+	if result = MakeSimple().RandomKeys(10); len(result) != 0 {
+		t.Errorf("expect no keys from empty dict, actually %d", len(result))
+	}
+}
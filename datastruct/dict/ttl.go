@@ -0,0 +1,210 @@
+package dict
+
+import (
+	"sort"
+	"time"
+)
+
+// TTLDict wraps a Dict and records expiration time of its keys, it is used to implement ttl of hash fields.
+// Expired keys are invisible to read methods, they are physically removed by RemoveExpired or writing methods.
+// It is not thread safe
+type TTLDict struct {
+	Dict
+	expireAt map[string]time.Time
+}
+
+// MakeTTL wraps the given dict
+func MakeTTL(dict Dict) *TTLDict {
+	return &TTLDict{
+		Dict:     dict,
+		expireAt: make(map[string]time.Time),
+	}
+}
+
+func (dict *TTLDict) isExpired(key string) bool {
+	expireAt, ok := dict.expireAt[key]
+	return ok && time.Now().After(expireAt)
+}
+
+// removeIfExpired physically removes the key if it has expired
+func (dict *TTLDict) removeIfExpired(key string) {
+	if dict.isExpired(key) {
+		dict.Dict.Remove(key)
+		delete(dict.expireAt, key)
+	}
+}
+
+func (dict *TTLDict) expiredCount() int {
+	count := 0
+	now := time.Now()
+	for _, expireAt := range dict.expireAt {
+		if now.After(expireAt) {
+			count++
+		}
+	}
+	return count
+}
+
+// Expire sets expiration time of an existing key
+func (dict *TTLDict) Expire(key string, expireAt time.Time) {
+	dict.expireAt[key] = expireAt
+}
+
+// Persist removes expiration time of key, returns whether the key had ttl
+func (dict *TTLDict) Persist(key string) bool {
+	_, ok := dict.expireAt[key]
+	delete(dict.expireAt, key)
+	return ok
+}
+
+// ExpireTime returns expiration time of key, the second return value is false if key has no ttl
+func (dict *TTLDict) ExpireTime(key string) (time.Time, bool) {
+	expireAt, ok := dict.expireAt[key]
+	return expireAt, ok
+}
+
+// NextExpiration returns the nearest expiration time of all keys, the second return value is false if no key has ttl
+func (dict *TTLDict) NextExpiration() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, expireAt := range dict.expireAt {
+		if !found || expireAt.Before(next) {
+			next = expireAt
+			found = true
+		}
+	}
+	return next, found
+}
+
+// ForEachTTL visits keys having ttl in ascending order of expiration time
+func (dict *TTLDict) ForEachTTL(consumer func(key string, expireAt time.Time) bool) {
+	keys := make([]string, 0, len(dict.expireAt))
+	for key := range dict.expireAt {
+		if !dict.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := dict.expireAt[keys[i]], dict.expireAt[keys[j]]
+		if a.Equal(b) {
+			return keys[i] < keys[j]
+		}
+		return a.Before(b)
+	})
+	for _, key := range keys {
+		if !consumer(key, dict.expireAt[key]) {
+			break
+		}
+	}
+}
+
+// RemoveExpired physically removes all expired keys, returns the number of removed keys
+func (dict *TTLDict) RemoveExpired() int {
+	removed := 0
+	now := time.Now()
+	for key, expireAt := range dict.expireAt {
+		if now.After(expireAt) {
+			dict.Dict.Remove(key)
+			delete(dict.expireAt, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Get returns the binding value and whether the key is exist, expired key is regarded as not exist
+func (dict *TTLDict) Get(key string) (val interface{}, exists bool) {
+	if dict.isExpired(key) {
+		return nil, false
+	}
+	return dict.Dict.Get(key)
+}
+
+// Len returns the number of keys which have not expired
+func (dict *TTLDict) Len() int {
+	return dict.Dict.Len() - dict.expiredCount()
+}
+
+// Put puts key value into dict and returns the number of new inserted key-value, ttl of existing key is kept
+func (dict *TTLDict) Put(key string, val interface{}) (result int) {
+	dict.removeIfExpired(key)
+	return dict.Dict.Put(key, val)
+}
+
+// PutIfAbsent puts value if the key is not exists and returns the number of updated key-value
+func (dict *TTLDict) PutIfAbsent(key string, val interface{}) (result int) {
+	dict.removeIfExpired(key)
+	return dict.Dict.PutIfAbsent(key, val)
+}
+
+// PutIfExists puts value if the key is exist and returns the number of inserted key-value
+func (dict *TTLDict) PutIfExists(key string, val interface{}) (result int) {
+	dict.removeIfExpired(key)
+	return dict.Dict.PutIfExists(key, val)
+}
+
+// Remove removes the key and its ttl, returns the number of deleted key-value
+func (dict *TTLDict) Remove(key string) (result int) {
+	dict.removeIfExpired(key)
+	delete(dict.expireAt, key)
+	return dict.Dict.Remove(key)
+}
+
+// ForEach traversal keys which have not expired
+func (dict *TTLDict) ForEach(consumer Consumer) {
+	dict.Dict.ForEach(func(key string, val interface{}) bool {
+		if dict.isExpired(key) {
+			return true
+		}
+		return consumer(key, val)
+	})
+}
+
+// Scan visits keys which have not expired, see Dict.Scan
+func (dict *TTLDict) Scan(cursor int, count int, consumer Consumer) int {
+	return dict.Dict.Scan(cursor, count, func(key string, val interface{}) bool {
+		if dict.isExpired(key) {
+			return true
+		}
+		return consumer(key, val)
+	})
+}
+
+// Keys returns all keys which have not expired
+func (dict *TTLDict) Keys() []string {
+	keys := make([]string, 0, dict.Len())
+	dict.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// alive returns a dict without expired keys, it returns the underlying dict if there is no expired key
+func (dict *TTLDict) alive() Dict {
+	if dict.expiredCount() == 0 {
+		return dict.Dict
+	}
+	result := MakeSimple()
+	dict.ForEach(func(key string, val interface{}) bool {
+		result.Put(key, val)
+		return true
+	})
+	return result
+}
+
+// RandomKeys randomly returns keys of the given number, may contain duplicated key
+func (dict *TTLDict) RandomKeys(limit int) []string {
+	return dict.alive().RandomKeys(limit)
+}
+
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+func (dict *TTLDict) RandomDistinctKeys(limit int) []string {
+	return dict.alive().RandomDistinctKeys(limit)
+}
+
+// Clear removes all keys and their ttl
+func (dict *TTLDict) Clear() {
+	dict.Dict.Clear()
+	dict.expireAt = make(map[string]time.Time)
+}
@@ -0,0 +1,69 @@
+package dict
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLDict(t *testing.T) {
+	d := MakeTTL(MakeSimple())
+	d.Put("a", 1)
+	d.Put("b", 2)
+	d.Put("c", 3)
+	d.Expire("a", time.Now().Add(-time.Second))
+	d.Expire("b", time.Now().Add(time.Hour))
+
+	if _, ok := d.Get("a"); ok {
+		t.Error("expired key should be invisible")
+	}
+	if d.Len() != 2 || len(d.Keys()) != 2 {
+		t.Errorf("expect 2 keys, actual %d", d.Len())
+	}
+	d.ForEach(func(key string, val interface{}) bool {
+		if key == "a" {
+			t.Error("expired key should be skipped")
+		}
+		return true
+	})
+	for _, key := range d.RandomKeys(10) {
+		if key == "a" {
+			t.Error("expired key should not be returned")
+		}
+	}
+	var ttlKeys []string
+	d.ForEachTTL(func(key string, expireAt time.Time) bool {
+		ttlKeys = append(ttlKeys, key)
+		return true
+	})
+	if len(ttlKeys) != 1 || ttlKeys[0] != "b" {
+		t.Errorf("unexpected keys with ttl: %v", ttlKeys)
+	}
+
+	// expired key is regarded as new key
+	if result := d.Put("a", 4); result != 1 {
+		t.Errorf("expect inserting new key, actual %d", result)
+	}
+	if _, ok := d.ExpireTime("a"); ok {
+		t.Error("ttl of expired key should be removed")
+	}
+	// ttl is kept when updating value
+	d.Put("b", 5)
+	if _, ok := d.ExpireTime("b"); !ok {
+		t.Error("ttl should be kept")
+	}
+	if !d.Persist("b") || d.Persist("b") {
+		t.Error("persist failed")
+	}
+
+	d.Expire("c", time.Now().Add(-time.Second))
+	next, ok := d.NextExpiration()
+	if !ok || time.Now().Before(next) {
+		t.Errorf("unexpected next expiration %v", next)
+	}
+	if removed := d.RemoveExpired(); removed != 1 || d.Dict.Len() != 2 {
+		t.Errorf("expect 1 removed, actual %d", removed)
+	}
+	if _, ok = d.NextExpiration(); ok {
+		t.Error("no key should have ttl")
+	}
+}
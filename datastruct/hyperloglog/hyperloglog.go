@@ -0,0 +1,341 @@
+package hyperloglog
+
+import (
+	"errors"
+	"math"
+)
+
+/*
+ * The serialized format is compatible with redis:
+ * +------+---+-----+----------+
+ * | HYLL | E | N/U | Cardin.  |
+ * +------+---+-----+----------+
+ * 4 bytes magic, 1 byte encoding (0 dense, 1 sparse), 3 bytes unused, 8 bytes cached cardinality.
+ * Dense representation stores 16384 registers in 6 bits each.
+ * Sparse representation uses run-length opcodes:
+ *   ZERO  00xxxxxx: 1-64 zero registers
+ *   XZERO 01xxxxxx yyyyyyyy: 1-16384 zero registers
+ *   VAL   1vvvvvxx: 1-4 registers set to value 1-32
+ */
+
+const (
+	precision    = 14
+	registerNum  = 1 << precision // 16384
+	registerMask = registerNum - 1
+	registerBits = 6
+	registerMax  = (1 << registerBits) - 1
+	hashBits     = 64 - precision // 50
+
+	headerSize = 16
+	denseSize  = headerSize + (registerNum*registerBits+7)/8
+
+	encodingDense  = 0
+	encodingSparse = 1
+
+	sparseValMax   = 32
+	sparseValLen   = 4
+	sparseZeroLen  = 64
+	sparseXZeroLen = 16384
+	// SparseMaxBytes is the size limit of sparse representation, exceed it will convert to dense representation
+	SparseMaxBytes = 3000
+)
+
+var magic = []byte("HYLL")
+
+// ErrInvalid means bytes is not a valid HyperLogLog
+var ErrInvalid = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+
+// HyperLogLog estimates cardinality of a set
+type HyperLogLog struct {
+	registers [registerNum]uint8
+	dense     bool
+}
+
+// New creates an empty HyperLogLog using sparse representation
+func New() *HyperLogLog {
+	return &HyperLogLog{}
+}
+
+// FromBytes decodes HyperLogLog from its serialized form
+func FromBytes(b []byte) (*HyperLogLog, error) {
+	if len(b) < headerSize || string(b[:4]) != string(magic) {
+		return nil, ErrInvalid
+	}
+	hll := &HyperLogLog{}
+	switch b[4] {
+	case encodingDense:
+		if len(b) != denseSize {
+			return nil, ErrInvalid
+		}
+		hll.dense = true
+		for i := 0; i < registerNum; i++ {
+			hll.registers[i] = getDenseRegister(b[headerSize:], i)
+		}
+	case encodingSparse:
+		idx := 0
+		data := b[headerSize:]
+		for i := 0; i < len(data); i++ {
+			op := data[i]
+			switch {
+			case op&0xc0 == 0x00: // ZERO
+				idx += int(op&0x3f) + 1
+			case op&0xc0 == 0x40: // XZERO
+				if i+1 >= len(data) {
+					return nil, ErrInvalid
+				}
+				idx += (int(op&0x3f)<<8 | int(data[i+1])) + 1
+				i++
+			default: // VAL
+				val := ((op >> 2) & 0x1f) + 1
+				runLen := int(op&0x3) + 1
+				if idx+runLen > registerNum {
+					return nil, ErrInvalid
+				}
+				for j := 0; j < runLen; j++ {
+					hll.registers[idx+j] = val
+				}
+				idx += runLen
+			}
+			if idx > registerNum {
+				return nil, ErrInvalid
+			}
+		}
+		if idx != registerNum {
+			return nil, ErrInvalid
+		}
+	default:
+		return nil, ErrInvalid
+	}
+	return hll, nil
+}
+
+func getDenseRegister(data []byte, i int) uint8 {
+	bytePos := i * registerBits / 8
+	shift := uint(i*registerBits) & 7
+	b0 := uint(data[bytePos])
+	var b1 uint
+	if bytePos+1 < len(data) {
+		b1 = uint(data[bytePos+1])
+	}
+	return uint8(((b0 >> shift) | (b1 << (8 - shift))) & registerMax)
+}
+
+func setDenseRegister(data []byte, i int, val uint8) {
+	bytePos := i * registerBits / 8
+	shift := uint(i*registerBits) & 7
+	v := uint(val)
+	data[bytePos] &= ^byte(registerMax << shift)
+	data[bytePos] |= byte(v << shift)
+	if bytePos+1 < len(data) {
+		data[bytePos+1] &= ^byte(registerMax >> (8 - shift))
+		data[bytePos+1] |= byte(v >> (8 - shift))
+	}
+}
+
+// ToBytes encodes HyperLogLog, sparse representation is used until it becomes too large
+func (hll *HyperLogLog) ToBytes() []byte {
+	if !hll.dense {
+		if sparse, ok := hll.encodeSparse(); ok {
+			return sparse
+		}
+		hll.dense = true
+	}
+	b := make([]byte, denseSize)
+	copy(b, magic)
+	b[4] = encodingDense
+	invalidateCache(b)
+	for i := 0; i < registerNum; i++ {
+		setDenseRegister(b[headerSize:], i, hll.registers[i])
+	}
+	return b
+}
+
+// invalidateCache marks cached cardinality as invalid, cardinality is always computed on count
+func invalidateCache(b []byte) {
+	b[15] |= 1 << 7
+}
+
+func (hll *HyperLogLog) encodeSparse() ([]byte, bool) {
+	b := make([]byte, headerSize, headerSize+64)
+	copy(b, magic)
+	b[4] = encodingSparse
+	invalidateCache(b)
+	for i := 0; i < registerNum; {
+		val := hll.registers[i]
+		runLen := 1
+		for i+runLen < registerNum && hll.registers[i+runLen] == val {
+			runLen++
+		}
+		i += runLen
+		if val == 0 {
+			for runLen > 0 {
+				if runLen <= sparseZeroLen {
+					b = append(b, byte(runLen-1))
+					runLen = 0
+				} else {
+					n := runLen
+					if n > sparseXZeroLen {
+						n = sparseXZeroLen
+					}
+					b = append(b, 0x40|byte((n-1)>>8), byte((n-1)&0xff))
+					runLen -= n
+				}
+			}
+		} else {
+			if val > sparseValMax {
+				return nil, false
+			}
+			for runLen > 0 {
+				n := runLen
+				if n > sparseValLen {
+					n = sparseValLen
+				}
+				b = append(b, 0x80|(val-1)<<2|byte(n-1))
+				runLen -= n
+			}
+		}
+		if len(b)-headerSize > SparseMaxBytes {
+			return nil, false
+		}
+	}
+	return b, true
+}
+
+// IsDense returns true if HyperLogLog uses dense representation
+func (hll *HyperLogLog) IsDense() bool {
+	return hll.dense
+}
+
+// Add adds element into HyperLogLog, returns true if any register changed
+func (hll *HyperLogLog) Add(element []byte) bool {
+	index, count := patLen(element)
+	if hll.registers[index] < count {
+		hll.registers[index] = count
+		return true
+	}
+	return false
+}
+
+// patLen returns register index and the length of pattern 000..1 of element's hash
+func patLen(element []byte) (int, uint8) {
+	hash := murmurHash64A(element, 0xadc83b19)
+	index := int(hash & registerMask)
+	hash >>= precision
+	hash |= uint64(1) << hashBits // make sure the loop terminates
+	count := uint8(1)
+	for hash&1 == 0 {
+		count++
+		hash >>= 1
+	}
+	return index, count
+}
+
+// Merge merges other into hll, uses the max value of each register
+func (hll *HyperLogLog) Merge(other *HyperLogLog) {
+	for i := 0; i < registerNum; i++ {
+		if other.registers[i] > hll.registers[i] {
+			hll.registers[i] = other.registers[i]
+		}
+	}
+	if other.dense {
+		hll.dense = true
+	}
+}
+
+// Count returns estimated cardinality
+// using the algorithm from "New cardinality estimation algorithms for HyperLogLog sketches" by Otmar Ertl
+func (hll *HyperLogLog) Count() uint64 {
+	var histogram [hashBits + 2]int
+	for _, val := range hll.registers {
+		histogram[val]++
+	}
+	m := float64(registerNum)
+	z := m * tau((m-float64(histogram[hashBits+1]))/m)
+	for j := hashBits; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(histogram[0])/m)
+	alpha := 0.5 / math.Log(2)
+	return uint64(math.Round(alpha * m * m / z))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrev := z
+		z += x * y
+		y += y
+		if zPrev == z {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrev == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64 bit version of MurmurHash2 by Austin Appleby, same as redis
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	length := len(key)
+	h := seed ^ (uint64(length) * m)
+	i := 0
+	for ; i+8 <= length; i += 8 {
+		k := uint64(key[i]) | uint64(key[i+1])<<8 | uint64(key[i+2])<<16 | uint64(key[i+3])<<24 |
+			uint64(key[i+4])<<32 | uint64(key[i+5])<<40 | uint64(key[i+6])<<48 | uint64(key[i+7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	rest := key[i:]
+	switch len(rest) {
+	case 7:
+		h ^= uint64(rest[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(rest[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(rest[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(rest[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(rest[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(rest[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(rest[0])
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
@@ -0,0 +1,68 @@
+package hyperloglog
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, size := range []int{10, 1000, 100000} {
+		hll := New()
+		for i := 0; i < size; i++ {
+			hll.Add([]byte(strconv.Itoa(i)))
+		}
+		count := hll.Count()
+		if math.Abs(float64(count)-float64(size))/float64(size) > 0.02 {
+			t.Errorf("expected about %d, actual %d", size, count)
+		}
+
+		// round trip
+		decoded, err := FromBytes(hll.ToBytes())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if decoded.Count() != count {
+			t.Errorf("expected %d after decoding, actual %d", count, decoded.Count())
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	hll := New()
+	for i := 0; i < 10; i++ {
+		hll.Add([]byte(strconv.Itoa(i)))
+	}
+	bytes := hll.ToBytes()
+	if bytes[4] != encodingSparse || hll.IsDense() {
+		t.Error("expected sparse encoding")
+	}
+	for i := 0; i < 10000; i++ {
+		hll.Add([]byte(strconv.Itoa(i)))
+	}
+	bytes = hll.ToBytes()
+	if len(bytes) != denseSize || bytes[4] != encodingDense || !hll.IsDense() {
+		t.Error("expected dense encoding")
+	}
+	if _, err := FromBytes([]byte("HYLLabc")); err != ErrInvalid {
+		t.Error("expected invalid error")
+	}
+	if _, err := FromBytes(bytes[:len(bytes)-1]); err != ErrInvalid {
+		t.Error("expected invalid error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	hll1 := New()
+	hll2 := New()
+	for i := 0; i < 1000; i++ {
+		hll1.Add([]byte(strconv.Itoa(i)))
+		hll2.Add([]byte(strconv.Itoa(i + 500)))
+	}
+	hll1.Merge(hll2)
+	count := hll1.Count()
+	if math.Abs(float64(count)-1500)/1500 > 0.02 {
+		t.Errorf("expected about 1500, actual %d", count)
+	}
+}
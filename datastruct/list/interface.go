@@ -19,6 +19,7 @@ type List interface {
 	ReverseRemoveByVal(expected Expected, count int) int
 	Len() int
 	ForEach(consumer Consumer)
+	ReverseForEach(consumer Consumer)
 	Contains(expected Expected) bool
 	Range(start int, stop int) []interface{}
 }
@@ -255,3 +255,22 @@ func TestRange(t *testing.T) {
 		}
 	}
 }
+
+func TestLinkedList_ReverseForEach(t *testing.T) {
+	list := Make()
+	size := 10
+	for i := 0; i < size; i++ {
+		list.Add(i)
+	}
+	expected := size - 1
+	list.ReverseForEach(func(i int, v interface{}) bool {
+		if v != i || i != expected {
+			t.Errorf("wrong value at: %d", i)
+		}
+		expected--
+		return i > 5
+	})
+	if expected != 4 {
+		t.Errorf("expected stopping at 5, actually %d", expected+1)
+	}
+}
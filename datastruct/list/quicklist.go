@@ -352,6 +352,29 @@ func (ql *QuickList) ForEach(consumer Consumer) {
 	}
 }
 
+// ReverseForEach visits each element in the list from tail to head, index of element is still counted from head
+// if the consumer returns false, the loop will be break
+func (ql *QuickList) ReverseForEach(consumer Consumer) {
+	if ql == nil {
+		panic("list is nil")
+	}
+	if ql.Len() == 0 {
+		return
+	}
+	iter := ql.find(ql.size - 1)
+	i := ql.size - 1
+	for {
+		goNext := consumer(i, iter.get())
+		if !goNext {
+			break
+		}
+		i--
+		if !iter.prev() {
+			break
+		}
+	}
+}
+
 func (ql *QuickList) Contains(expected Expected) bool {
 	contains := false
 	ql.ForEach(func(i int, actual interface{}) bool {
@@ -259,3 +259,22 @@ func TestQuickList_Prev(t *testing.T) {
 		i--
 	}
 }
+
+func TestQuickList_ReverseForEach(t *testing.T) {
+	list := NewQuickList()
+	size := pageSize*3 + 1
+	for i := 0; i < size; i++ {
+		list.Add(i)
+	}
+	expected := size - 1
+	list.ReverseForEach(func(i int, v interface{}) bool {
+		if v != i || i != expected {
+			t.Errorf("wrong value at: %d", i)
+		}
+		expected--
+		return true
+	})
+	if expected != -1 {
+		t.Errorf("expected visiting %d elements, actually %d", size, size-expected-1)
+	}
+}
@@ -2,10 +2,13 @@ package sortedset
 
 import (
 	"errors"
+	"math"
 	"strconv"
 )
 
 /*
+ * Border represents `min` `max` parameter of range commands, ScoreBorder for `ZRANGEBYSCORE` and LexBorder for `ZRANGEBYLEX`
+ *
  * ScoreBorder is a struct represents `min` `max` parameter of redis command `ZRANGEBYSCORE`
  * can accept:
  *   int or float value, such as 2.718, 2, -2.718, -2 ...
@@ -18,6 +21,16 @@ const (
 	positiveInf int8 = 1
 )
 
+// Border is the min or max border of a range query on sorted set
+type Border interface {
+	// greater returns true if element is within the upper border, do not use min.greater()
+	greater(element *Element) bool
+	// less returns true if element is within the lower border
+	less(element *Element) bool
+	// isIntersected returns true if there may be elements between min(the receiver) and max
+	isIntersected(max Border) bool
+}
+
 // ScoreBorder represents range of a float value, including: <, <=, >, >=, +inf, -inf
 type ScoreBorder struct {
 	Inf     int8
@@ -25,9 +38,10 @@ type ScoreBorder struct {
 	Exclude bool
 }
 
-// if max.greater(score) then the score is within the upper border
+// if max.greater(element) then the score is within the upper border
 // do not use min.greater()
-func (border *ScoreBorder) greater(value float64) bool {
+func (border *ScoreBorder) greater(element *Element) bool {
+	value := element.Score
 	if border.Inf == negativeInf {
 		return false
 	} else if border.Inf == positiveInf {
@@ -39,7 +53,8 @@ func (border *ScoreBorder) greater(value float64) bool {
 	return border.Value >= value
 }
 
-func (border *ScoreBorder) less(value float64) bool {
+func (border *ScoreBorder) less(element *Element) bool {
+	value := element.Score
 	if border.Inf == negativeInf {
 		return true
 	} else if border.Inf == positiveInf {
@@ -51,6 +66,24 @@ func (border *ScoreBorder) less(value float64) bool {
 	return border.Value <= value
 }
 
+func (border *ScoreBorder) value() float64 {
+	if border.Inf == negativeInf {
+		return math.Inf(-1)
+	} else if border.Inf == positiveInf {
+		return math.Inf(1)
+	}
+	return border.Value
+}
+
+func (border *ScoreBorder) isIntersected(max Border) bool {
+	maxBorder, ok := max.(*ScoreBorder)
+	if !ok {
+		return false
+	}
+	minValue, maxValue := border.value(), maxBorder.value()
+	return minValue < maxValue || (minValue == maxValue && !border.Exclude && !maxBorder.Exclude)
+}
+
 var positiveInfBorder = &ScoreBorder{
 	Inf: positiveInf,
 }
@@ -88,3 +121,81 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		Exclude: false,
 	}, nil
 }
+
+// LexBorder represents range of a member string, including: (a, [a, +, -
+type LexBorder struct {
+	Inf     int8
+	Value   string
+	Exclude bool
+}
+
+// if max.greater(element) then the member is within the upper border
+// do not use min.greater()
+func (border *LexBorder) greater(element *Element) bool {
+	if border.Inf == negativeInf {
+		return false
+	} else if border.Inf == positiveInf {
+		return true
+	}
+	if border.Exclude {
+		return element.Member < border.Value
+	}
+	return element.Member <= border.Value
+}
+
+func (border *LexBorder) less(element *Element) bool {
+	if border.Inf == negativeInf {
+		return true
+	} else if border.Inf == positiveInf {
+		return false
+	}
+	if border.Exclude {
+		return border.Value < element.Member
+	}
+	return border.Value <= element.Member
+}
+
+func (border *LexBorder) isIntersected(max Border) bool {
+	maxBorder, ok := max.(*LexBorder)
+	if !ok {
+		return false
+	}
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return false
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return true
+	}
+	return border.Value < maxBorder.Value ||
+		(border.Value == maxBorder.Value && !border.Exclude && !maxBorder.Exclude)
+}
+
+var positiveInfLexBorder = &LexBorder{
+	Inf: positiveInf,
+}
+
+var negativeInfLexBorder = &LexBorder{
+	Inf: negativeInf,
+}
+
+// ParseLexBorder creates LexBorder from redis arguments, valid arguments start with '(' or '[', or equal to '+' or '-'
+func ParseLexBorder(s string) (*LexBorder, error) {
+	if s == "+" {
+		return positiveInfLexBorder, nil
+	}
+	if s == "-" {
+		return negativeInfLexBorder, nil
+	}
+	if len(s) > 0 && s[0] == '(' {
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: true,
+		}, nil
+	}
+	if len(s) > 0 && s[0] == '[' {
+		return &LexBorder{
+			Value: s[1:],
+		}, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
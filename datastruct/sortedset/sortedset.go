@@ -1,6 +1,7 @@
 package sortedset
 
 import (
+	"math/rand"
 	"strconv"
 )
 
@@ -126,17 +127,17 @@ func (sortedSet *SortedSet) Range(start int64, stop int64, desc bool) []*Element
 	return slice
 }
 
-// Count returns the number of  members which score within the given border
-func (sortedSet *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
+// Count returns the number of members within the given border
+func (sortedSet *SortedSet) Count(min Border, max Border) int64 {
 	var i int64 = 0
 	// ascending order
 	sortedSet.ForEach(0, sortedSet.Len(), false, func(element *Element) bool {
-		gtMin := min.less(element.Score) // greater than min
+		gtMin := min.less(element) // greater than min
 		if !gtMin {
 			// has not into range, continue foreach
 			return true
 		}
-		ltMax := max.greater(element.Score) // less than max
+		ltMax := max.greater(element) // less than max
 		if !ltMax {
 			// break through score border, break foreach
 			return false
@@ -148,14 +149,14 @@ func (sortedSet *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
 	return i
 }
 
-// ForEachByScore visits members which score within the given border
-func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+// ForEachByBorder visits members within the given border, border can be ScoreBorder or LexBorder
+func (sortedSet *SortedSet) ForEachByBorder(min Border, max Border, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
 	// find start node
 	var node *node
 	if desc {
-		node = sortedSet.skiplist.getLastInScoreRange(min, max)
+		node = sortedSet.skiplist.getLastInRange(min, max)
 	} else {
-		node = sortedSet.skiplist.getFirstInScoreRange(min, max)
+		node = sortedSet.skiplist.getFirstInRange(min, max)
 	}
 
 	for node != nil && offset > 0 {
@@ -180,31 +181,31 @@ func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, o
 		if node == nil {
 			break
 		}
-		gtMin := min.less(node.Element.Score) // greater than min
-		ltMax := max.greater(node.Element.Score)
+		gtMin := min.less(&node.Element) // greater than min
+		ltMax := max.greater(&node.Element)
 		if !gtMin || !ltMax {
 			break // break through score border
 		}
 	}
 }
 
-// RangeByScore returns members which score within the given border
+// RangeByBorder returns members within the given border
 // param limit: <0 means no limit
-func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool) []*Element {
+func (sortedSet *SortedSet) RangeByBorder(min Border, max Border, offset int64, limit int64, desc bool) []*Element {
 	if limit == 0 || offset < 0 {
 		return make([]*Element, 0)
 	}
 	slice := make([]*Element, 0)
-	sortedSet.ForEachByScore(min, max, offset, limit, desc, func(element *Element) bool {
+	sortedSet.ForEachByBorder(min, max, offset, limit, desc, func(element *Element) bool {
 		slice = append(slice, element)
 		return true
 	})
 	return slice
 }
 
-// RemoveByScore removes members which score within the given border
-func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
-	removed := sortedSet.skiplist.RemoveRangeByScore(min, max, 0)
+// RemoveByBorder removes members within the given border
+func (sortedSet *SortedSet) RemoveByBorder(min Border, max Border) int64 {
+	removed := sortedSet.skiplist.RemoveRange(min, max, 0)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
 	}
@@ -212,7 +213,7 @@ func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) in
 }
 
 func (sortedSet *SortedSet) PopMin(count int) []*Element {
-	first := sortedSet.skiplist.getFirstInScoreRange(negativeInfBorder, positiveInfBorder)
+	first := sortedSet.skiplist.getFirstInRange(negativeInfBorder, positiveInfBorder)
 	if first == nil {
 		return nil
 	}
@@ -220,7 +221,27 @@ func (sortedSet *SortedSet) PopMin(count int) []*Element {
 		Value:   first.Score,
 		Exclude: false,
 	}
-	removed := sortedSet.skiplist.RemoveRangeByScore(border, positiveInfBorder, count)
+	removed := sortedSet.skiplist.RemoveRange(border, positiveInfBorder, count)
+	for _, element := range removed {
+		delete(sortedSet.dict, element.Member)
+	}
+	return removed
+}
+
+// PopMax removes and returns members with the highest scores, in descending order of score
+func (sortedSet *SortedSet) PopMax(count int) []*Element {
+	size := sortedSet.skiplist.length
+	if count <= 0 || size == 0 {
+		return nil
+	}
+	start := size - int64(count) + 1
+	if start < 1 {
+		start = 1
+	}
+	removed := sortedSet.skiplist.RemoveRangeByRank(start, size+1)
+	for i, j := 0, len(removed)-1; i < j; i, j = i+1, j-1 {
+		removed[i], removed[j] = removed[j], removed[i]
+	}
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
 	}
@@ -236,3 +257,48 @@ func (sortedSet *SortedSet) RemoveByRank(start int64, stop int64) int64 {
 	}
 	return int64(len(removed))
 }
+
+// RandomMembers randomly returns members of the given number, may contain duplicated member.
+// Each member is located by a random rank in skiplist which costs O(log(N)).
+func (sortedSet *SortedSet) RandomMembers(limit int) []*Element {
+	size := sortedSet.skiplist.length
+	if limit <= 0 || size == 0 {
+		return []*Element{}
+	}
+	result := make([]*Element, limit)
+	for i := range result {
+		result[i] = &sortedSet.skiplist.getByRank(rand.Int63n(size) + 1).Element
+	}
+	return result
+}
+
+// RandomDistinctMembers randomly returns members of the given number, won't contain duplicated member.
+// It samples distinct ranks by Floyd's algorithm, so the cost is independent of the size of set.
+func (sortedSet *SortedSet) RandomDistinctMembers(limit int) []*Element {
+	size := sortedSet.skiplist.length
+	if limit <= 0 {
+		return []*Element{}
+	}
+	if int64(limit) >= size {
+		return sortedSet.Range(0, size, false)
+	}
+	picked := make(map[int64]struct{}, limit)
+	ranks := make([]int64, 0, limit)
+	for j := size - int64(limit) + 1; j <= size; j++ {
+		rank := rand.Int63n(j) + 1
+		if _, ok := picked[rank]; ok {
+			rank = j
+		}
+		picked[rank] = struct{}{}
+		ranks = append(ranks, rank)
+	}
+	// the last sampled ranks are biased to be large, shuffle them to make the order random
+	rand.Shuffle(len(ranks), func(i, j int) {
+		ranks[i], ranks[j] = ranks[j], ranks[i]
+	})
+	result := make([]*Element, limit)
+	for i, rank := range ranks {
+		result[i] = &sortedSet.skiplist.getByRank(rank).Element
+	}
+	return result
+}
@@ -1,6 +1,9 @@
 package sortedset
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 func TestSortedSet_PopMin(t *testing.T) {
 	var set = Make()
@@ -14,3 +17,78 @@ func TestSortedSet_PopMin(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSortedSet_PopMax(t *testing.T) {
+	var set = Make()
+	set.Add("s1", 1)
+	set.Add("s2", 2)
+	set.Add("s3", 3)
+
+	var results = set.PopMax(2)
+	if len(results) != 2 || results[0].Member != "s3" || results[1].Member != "s2" {
+		t.Errorf("unexpected result: %v", results)
+	}
+	results = set.PopMax(5)
+	if len(results) != 1 || results[0].Member != "s1" || set.Len() != 0 {
+		t.Errorf("unexpected result: %v", results)
+	}
+}
+
+func TestSortedSet_RangeByLex(t *testing.T) {
+	var set = Make()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		set.Add(member, 0)
+	}
+	min, _ := ParseLexBorder("(a")
+	max, _ := ParseLexBorder("[d")
+	results := set.RangeByBorder(min, max, 0, -1, false)
+	if len(results) != 3 || results[0].Member != "b" || results[2].Member != "d" {
+		t.Errorf("unexpected result: %v", results)
+	}
+	results = set.RangeByBorder(min, max, 1, 1, true)
+	if len(results) != 1 || results[0].Member != "c" {
+		t.Errorf("unexpected result: %v", results)
+	}
+	if count := set.Count(negativeInfLexBorder, positiveInfLexBorder); count != 5 {
+		t.Errorf("expect 5, actual %d", count)
+	}
+	empty, _ := ParseLexBorder("(d")
+	if count := set.Count(empty, max); count != 0 {
+		t.Errorf("expect 0, actual %d", count)
+	}
+	if removed := set.RemoveByBorder(min, max); removed != 3 || set.Len() != 2 {
+		t.Errorf("expect 3 removed, actual %d", removed)
+	}
+	if _, err := ParseLexBorder("a"); err == nil {
+		t.Error("expect error for invalid lex border")
+	}
+}
+
+func TestSortedSet_RandomMembers(t *testing.T) {
+	var set = Make()
+	size := 100
+	for i := 0; i < size; i++ {
+		set.Add(strconv.Itoa(i), float64(i))
+	}
+	results := set.RandomMembers(size * 2)
+	if len(results) != size*2 {
+		t.Errorf("expect %d members, actual %d", size*2, len(results))
+	}
+	results = set.RandomDistinctMembers(10)
+	distinct := make(map[string]struct{})
+	for _, element := range results {
+		if e, ok := set.Get(element.Member); !ok || e.Score != element.Score {
+			t.Errorf("unexpected member %s", element.Member)
+		}
+		distinct[element.Member] = struct{}{}
+	}
+	if len(results) != 10 || len(distinct) != 10 {
+		t.Errorf("expect 10 distinct members, actual %d", len(distinct))
+	}
+	if results = set.RandomDistinctMembers(size + 10); len(results) != size {
+		t.Errorf("expect %d members, actual %d", size, len(results))
+	}
+	if results = Make().RandomMembers(10); len(results) != 0 {
+		t.Errorf("expect no members, actual %d", len(results))
+	}
+}
@@ -0,0 +1,315 @@
+package stream
+
+import (
+	"sort"
+)
+
+// PendingEntry records an entry which has been delivered to a consumer but not acknowledged yet
+type PendingEntry struct {
+	ID       ID
+	Consumer string
+	// DeliveryTime is the last delivery time in unix milliseconds
+	DeliveryTime  int64
+	DeliveryCount int64
+}
+
+// Consumer is a member of consumer group
+type Consumer struct {
+	Name string
+	// SeenTime is the last time the consumer attempted an interaction, in unix milliseconds
+	SeenTime int64
+}
+
+// Group is a consumer group of stream
+type Group struct {
+	Name            string
+	LastDeliveredID ID
+	consumers       map[string]*Consumer
+	pel             map[ID]*PendingEntry
+}
+
+func makeGroup(name string, lastDeliveredID ID) *Group {
+	return &Group{
+		Name:            name,
+		LastDeliveredID: lastDeliveredID,
+		consumers:       make(map[string]*Consumer),
+		pel:             make(map[ID]*PendingEntry),
+	}
+}
+
+// CreateGroup creates a consumer group, returns false if group already exists
+func (s *Stream) CreateGroup(name string, lastDeliveredID ID) bool {
+	if s.groups == nil {
+		s.groups = make(map[string]*Group)
+	}
+	if _, ok := s.groups[name]; ok {
+		return false
+	}
+	s.groups[name] = makeGroup(name, lastDeliveredID)
+	return true
+}
+
+// GetGroup returns consumer group of given name
+func (s *Stream) GetGroup(name string) (*Group, bool) {
+	group, ok := s.groups[name]
+	return group, ok
+}
+
+// DestroyGroup removes consumer group, returns false if group not exists
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.groups[name]; !ok {
+		return false
+	}
+	delete(s.groups, name)
+	return true
+}
+
+// Groups returns all consumer groups ordered by name
+func (s *Stream) Groups() []*Group {
+	groups := make([]*Group, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// GetConsumer returns consumer of given name
+func (group *Group) GetConsumer(name string) (*Consumer, bool) {
+	consumer, ok := group.consumers[name]
+	return consumer, ok
+}
+
+// CreateConsumer creates consumer if not exists, returns true if a new consumer is created
+func (group *Group) CreateConsumer(name string, now int64) bool {
+	if _, ok := group.consumers[name]; ok {
+		return false
+	}
+	group.consumers[name] = &Consumer{
+		Name:     name,
+		SeenTime: now,
+	}
+	return true
+}
+
+// touchConsumer returns consumer of given name and updates its seen time, it creates consumer if not exists
+func (group *Group) touchConsumer(name string, now int64) *Consumer {
+	group.CreateConsumer(name, now)
+	consumer := group.consumers[name]
+	consumer.SeenTime = now
+	return consumer
+}
+
+// DeleteConsumer removes consumer and its pending entries, returns number of removed pending entries
+func (group *Group) DeleteConsumer(name string) int {
+	if _, ok := group.consumers[name]; !ok {
+		return 0
+	}
+	removed := 0
+	for id, pending := range group.pel {
+		if pending.Consumer == name {
+			delete(group.pel, id)
+			removed++
+		}
+	}
+	delete(group.consumers, name)
+	return removed
+}
+
+// Consumers returns all consumers ordered by name
+func (group *Group) Consumers() []*Consumer {
+	consumers := make([]*Consumer, 0, len(group.consumers))
+	for _, consumer := range group.consumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers
+}
+
+// PendingLen returns number of pending entries, consumer == "" means all consumers
+func (group *Group) PendingLen(consumer string) int {
+	if consumer == "" {
+		return len(group.pel)
+	}
+	count := 0
+	for _, pending := range group.pel {
+		if pending.Consumer == consumer {
+			count++
+		}
+	}
+	return count
+}
+
+// GetPending returns pending entry of given id
+func (group *Group) GetPending(id ID) (*PendingEntry, bool) {
+	pending, ok := group.pel[id]
+	return pending, ok
+}
+
+// PendingRange returns pending entries whose id is within [start, end] ordered by id,
+// consumer == "" means all consumers, count <= 0 means no limit
+func (group *Group) PendingRange(start ID, end ID, consumer string, count int) []*PendingEntry {
+	result := make([]*PendingEntry, 0)
+	for id, pending := range group.pel {
+		if id.Less(start) || end.Less(id) {
+			continue
+		}
+		if consumer != "" && pending.Consumer != consumer {
+			continue
+		}
+		result = append(result, pending)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID.Less(result[j].ID)
+	})
+	if count > 0 && len(result) > count {
+		result = result[:count]
+	}
+	return result
+}
+
+// SetPending adds or replaces pending entry, it creates owner consumer if not exists
+func (group *Group) SetPending(pending *PendingEntry) {
+	group.CreateConsumer(pending.Consumer, pending.DeliveryTime)
+	group.pel[pending.ID] = pending
+}
+
+// ReadNew delivers entries never delivered to other consumers of the group, and moves last delivered id forward.
+// Delivered entries are added into PEL unless noAck is true.
+func (group *Group) ReadNew(s *Stream, consumer string, count int, noAck bool, now int64) []*Entry {
+	group.touchConsumer(consumer, now)
+	entries := s.After(group.LastDeliveredID, count)
+	for _, entry := range entries {
+		group.LastDeliveredID = entry.ID
+		if noAck {
+			continue
+		}
+		group.pel[entry.ID] = &PendingEntry{
+			ID:            entry.ID,
+			Consumer:      consumer,
+			DeliveryTime:  now,
+			DeliveryCount: 1,
+		}
+	}
+	return entries
+}
+
+// ReadHistory returns entries pending for given consumer whose id is greater than start.
+// Entry has been removed from stream is returned with nil Fields.
+func (group *Group) ReadHistory(s *Stream, consumer string, start ID, count int, now int64) []*Entry {
+	group.touchConsumer(consumer, now)
+	from, ok := start.Next()
+	if !ok {
+		return nil
+	}
+	pendingList := group.PendingRange(from, MaxID, consumer, count)
+	entries := make([]*Entry, len(pendingList))
+	for i, pending := range pendingList {
+		pending.DeliveryTime = now
+		pending.DeliveryCount++
+		entry, ok := s.Get(pending.ID)
+		if !ok {
+			entry = &Entry{ID: pending.ID}
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// Ack removes given ids from PEL, returns number of acknowledged entries
+func (group *Group) Ack(ids ...ID) int {
+	acked := 0
+	for _, id := range ids {
+		if _, ok := group.pel[id]; ok {
+			delete(group.pel, id)
+			acked++
+		}
+	}
+	return acked
+}
+
+// ClaimOption controls behavior of Claim
+type ClaimOption struct {
+	// MinIdle is the minimum idle time in milliseconds of pending entry to claim
+	MinIdle int64
+	// DeliveryTime is the new delivery time of claimed entries, in unix milliseconds
+	DeliveryTime int64
+	// RetryCount overrides delivery count if it is not negative
+	RetryCount int64
+	// Force creates pending entry if it not exists but the entry exists in stream
+	Force bool
+	// JustID does not increase delivery count
+	JustID bool
+}
+
+// Claim changes owner of pending entry to consumer, returns claimed pending entries.
+// Pending entry whose entry has been removed from stream will be removed from PEL.
+func (group *Group) Claim(s *Stream, consumer string, ids []ID, opt *ClaimOption, now int64) []*PendingEntry {
+	group.touchConsumer(consumer, now)
+	claimed := make([]*PendingEntry, 0, len(ids))
+	for _, id := range ids {
+		pending, ok := group.pel[id]
+		if !ok {
+			if !opt.Force {
+				continue
+			}
+			if _, exists := s.Get(id); !exists {
+				continue
+			}
+			pending = &PendingEntry{
+				ID:       id,
+				Consumer: consumer,
+			}
+			group.pel[id] = pending
+		} else if now-pending.DeliveryTime < opt.MinIdle {
+			continue
+		}
+		if _, exists := s.Get(id); !exists {
+			delete(group.pel, id)
+			continue
+		}
+		pending.Consumer = consumer
+		pending.DeliveryTime = opt.DeliveryTime
+		if opt.RetryCount >= 0 {
+			pending.DeliveryCount = opt.RetryCount
+		} else if !opt.JustID {
+			pending.DeliveryCount++
+		}
+		claimed = append(claimed, pending)
+	}
+	return claimed
+}
+
+// AutoClaim scans PEL from start and claims at most count entries idle longer than minIdle,
+// returns claimed entries, ids of deleted entries and the id to use as start of next call (0-0 means scan finished)
+func (group *Group) AutoClaim(s *Stream, consumer string, minIdle int64, start ID, count int, justID bool, now int64) (claimed []*PendingEntry, deleted []ID, next ID) {
+	group.touchConsumer(consumer, now)
+	// like redis, at most count*10 pending entries will be scanned
+	attempts := count * 10
+	candidates := group.PendingRange(start, MaxID, "", 0)
+	for i, pending := range candidates {
+		if len(claimed) >= count || attempts <= 0 {
+			return claimed, deleted, candidates[i].ID
+		}
+		attempts--
+		if _, exists := s.Get(pending.ID); !exists {
+			delete(group.pel, pending.ID)
+			deleted = append(deleted, pending.ID)
+			continue
+		}
+		if now-pending.DeliveryTime < minIdle {
+			continue
+		}
+		pending.Consumer = consumer
+		pending.DeliveryTime = now
+		if !justID {
+			pending.DeliveryCount++
+		}
+		claimed = append(claimed, pending)
+	}
+	return claimed, deleted, ID{}
+}
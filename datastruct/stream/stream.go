@@ -0,0 +1,275 @@
+package stream
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ID identifies an entry in stream, it consists of a millisecond timestamp and a sequence number
+type ID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+var (
+	// MinID is the smallest id, equals to "-"
+	MinID = ID{}
+	// MaxID is the greatest id, equals to "+"
+	MaxID = ID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+)
+
+var errInvalidID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// String returns id in format of "<ms>-<seq>"
+func (id ID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less returns true if id is smaller than other
+func (id ID) Less(other ID) bool {
+	if id.Ms != other.Ms {
+		return id.Ms < other.Ms
+	}
+	return id.Seq < other.Seq
+}
+
+// IsZero returns true if id is 0-0
+func (id ID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Next returns the smallest id greater than id
+func (id ID) Next() (ID, bool) {
+	if id.Seq < math.MaxUint64 {
+		return ID{Ms: id.Ms, Seq: id.Seq + 1}, true
+	}
+	if id.Ms < math.MaxUint64 {
+		return ID{Ms: id.Ms + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the greatest id smaller than id
+func (id ID) Prev() (ID, bool) {
+	if id.Seq > 0 {
+		return ID{Ms: id.Ms, Seq: id.Seq - 1}, true
+	}
+	if id.Ms > 0 {
+		return ID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// ParseID parses id in format of "<ms>-<seq>" or "<ms>", missing seq will be replaced by defaultSeq
+func ParseID(s string, defaultSeq uint64) (ID, error) {
+	var msStr, seqStr string
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		msStr, seqStr = s[:i], s[i+1:]
+	} else {
+		msStr = s
+	}
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return ID{}, errInvalidID
+	}
+	if seqStr == "" {
+		if strings.IndexByte(s, '-') >= 0 {
+			return ID{}, errInvalidID
+		}
+		return ID{Ms: ms, Seq: defaultSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return ID{}, errInvalidID
+	}
+	return ID{Ms: ms, Seq: seq}, nil
+}
+
+// ParseRangeStart parses start of XRANGE, supports "-", "<ms>", "<ms>-<seq>" and exclusive "(<id>"
+func ParseRangeStart(s string) (ID, bool, error) {
+	if s == "-" {
+		return MinID, true, nil
+	}
+	if s == "+" {
+		return MaxID, true, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	id, err := ParseID(s, 0)
+	if err != nil {
+		return ID{}, false, err
+	}
+	if exclusive {
+		next, ok := id.Next()
+		return next, ok, nil
+	}
+	return id, true, nil
+}
+
+// ParseRangeEnd parses end of XRANGE, supports "+", "<ms>", "<ms>-<seq>" and exclusive "(<id>"
+func ParseRangeEnd(s string) (ID, bool, error) {
+	if s == "+" {
+		return MaxID, true, nil
+	}
+	if s == "-" {
+		return MinID, true, nil
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	id, err := ParseID(s, math.MaxUint64)
+	if err != nil {
+		return ID{}, false, err
+	}
+	if exclusive {
+		prev, ok := id.Prev()
+		return prev, ok, nil
+	}
+	return id, true, nil
+}
+
+// Entry is an item of stream
+type Entry struct {
+	ID ID
+	// Fields stores field-value pairs in order: field1, value1, field2, value2, ...
+	Fields [][]byte
+}
+
+// Stream is an append-only log of entries ordered by ID
+type Stream struct {
+	entries []*Entry
+	lastID  ID
+	groups  map[string]*Group
+}
+
+// Make creates a new stream
+func Make() *Stream {
+	return &Stream{}
+}
+
+// Len returns number of entries in stream
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// LastID returns the greatest id ever added into stream
+func (s *Stream) LastID() ID {
+	return s.lastID
+}
+
+// SetLastID sets last id of stream, it must not be smaller than the id of last entry
+func (s *Stream) SetLastID(id ID) bool {
+	if len(s.entries) > 0 && id.Less(s.entries[len(s.entries)-1].ID) {
+		return false
+	}
+	s.lastID = id
+	return true
+}
+
+// NextID generates an id greater than last id using given timestamp
+func (s *Stream) NextID(ms uint64) (ID, bool) {
+	if ms > s.lastID.Ms {
+		return ID{Ms: ms}, true
+	}
+	return s.lastID.Next()
+}
+
+// Add appends an entry into stream, returns false if id is not greater than last id
+func (s *Stream) Add(id ID, fields [][]byte) bool {
+	if !s.lastID.Less(id) {
+		return false
+	}
+	s.entries = append(s.entries, &Entry{
+		ID:     id,
+		Fields: fields,
+	})
+	s.lastID = id
+	return true
+}
+
+// search returns index of the first entry whose id is not less than id
+func (s *Stream) search(id ID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+}
+
+// Get returns entry of given id
+func (s *Stream) Get(id ID) (*Entry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return nil, false
+}
+
+// Range returns entries whose id is within [start, end], count <= 0 means no limit
+func (s *Stream) Range(start ID, end ID, count int, desc bool) []*Entry {
+	if end.Less(start) {
+		return nil
+	}
+	from := s.search(start)
+	to := s.search(end)
+	if to < len(s.entries) && s.entries[to].ID == end {
+		to++
+	}
+	size := to - from
+	if count > 0 && count < size {
+		size = count
+	}
+	result := make([]*Entry, 0, size)
+	if desc {
+		for i := to - 1; i >= from && len(result) < size; i-- {
+			result = append(result, s.entries[i])
+		}
+	} else {
+		for i := from; i < to && len(result) < size; i++ {
+			result = append(result, s.entries[i])
+		}
+	}
+	return result
+}
+
+// After returns entries whose id is greater than given id, count <= 0 means no limit
+func (s *Stream) After(id ID, count int) []*Entry {
+	start, ok := id.Next()
+	if !ok {
+		return nil
+	}
+	return s.Range(start, MaxID, count, false)
+}
+
+// TrimByLen removes oldest entries until stream has no more than maxLen entries, returns number of removed entries
+func (s *Stream) TrimByLen(maxLen int) int {
+	if maxLen < 0 || len(s.entries) <= maxLen {
+		return 0
+	}
+	removed := len(s.entries) - maxLen
+	s.entries = append(s.entries[:0:0], s.entries[removed:]...)
+	return removed
+}
+
+// TrimByMinID removes entries whose id is less than minID, returns number of removed entries
+func (s *Stream) TrimByMinID(minID ID) int {
+	removed := s.search(minID)
+	if removed == 0 {
+		return 0
+	}
+	s.entries = append(s.entries[:0:0], s.entries[removed:]...)
+	return removed
+}
+
+// ForEach visits each entry in order until consumer returns false
+func (s *Stream) ForEach(consumer func(entry *Entry) bool) {
+	for _, entry := range s.entries {
+		if !consumer(entry) {
+			break
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package stream
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	s := Make()
+	size := 10
+	for i := 1; i <= size; i++ {
+		if !s.Add(ID{Ms: uint64(i)}, [][]byte{[]byte("k"), []byte(strconv.Itoa(i))}) {
+			t.Errorf("add %d failed", i)
+		}
+	}
+	if s.Add(ID{Ms: 3}, nil) {
+		t.Error("expected reject smaller id")
+	}
+	if s.Len() != size {
+		t.Errorf("expected len %d, actual %d", size, s.Len())
+	}
+	if s.LastID() != (ID{Ms: uint64(size)}) {
+		t.Errorf("wrong last id: %s", s.LastID())
+	}
+
+	entries := s.Range(ID{Ms: 3}, ID{Ms: 6}, 0, false)
+	if len(entries) != 4 || entries[0].ID.Ms != 3 || entries[3].ID.Ms != 6 {
+		t.Error("wrong range result")
+	}
+	entries = s.Range(MinID, MaxID, 3, true)
+	if len(entries) != 3 || entries[0].ID.Ms != 10 || entries[2].ID.Ms != 8 {
+		t.Error("wrong reversed range result")
+	}
+	entries = s.After(ID{Ms: 8}, 0)
+	if len(entries) != 2 || entries[0].ID.Ms != 9 {
+		t.Error("wrong after result")
+	}
+
+	if removed := s.TrimByLen(5); removed != 5 || s.Len() != 5 {
+		t.Error("wrong trim by len")
+	}
+	if removed := s.TrimByMinID(ID{Ms: 8}); removed != 2 || s.Len() != 3 {
+		t.Error("wrong trim by min id")
+	}
+	if _, ok := s.Get(ID{Ms: 9}); !ok {
+		t.Error("expected entry 9-0")
+	}
+}
+
+func TestParseID(t *testing.T) {
+	id, err := ParseID("12-3", 0)
+	if err != nil || id != (ID{Ms: 12, Seq: 3}) {
+		t.Error("parse 12-3 failed")
+	}
+	start, _, err := ParseRangeStart("5")
+	if err != nil || start != (ID{Ms: 5}) {
+		t.Error("parse range start failed")
+	}
+	end, _, err := ParseRangeEnd("5")
+	if err != nil || end.Ms != 5 || end.Seq == 0 {
+		t.Error("parse range end failed")
+	}
+	start, _, err = ParseRangeStart("(5-1")
+	if err != nil || start != (ID{Ms: 5, Seq: 2}) {
+		t.Error("parse exclusive range start failed")
+	}
+	if _, err = ParseID("a-1", 0); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	s := Make()
+	for i := 1; i <= 5; i++ {
+		s.Add(ID{Ms: uint64(i)}, [][]byte{[]byte("k"), []byte(strconv.Itoa(i))})
+	}
+	if !s.CreateGroup("g", MinID) || s.CreateGroup("g", MinID) {
+		t.Error("wrong create group result")
+	}
+	group, _ := s.GetGroup("g")
+	entries := group.ReadNew(s, "c1", 3, false, 100)
+	if len(entries) != 3 || group.LastDeliveredID != (ID{Ms: 3}) || group.PendingLen("c1") != 3 {
+		t.Error("wrong read new result")
+	}
+	entries = group.ReadNew(s, "c2", 0, true, 100)
+	if len(entries) != 2 || group.PendingLen("c2") != 0 {
+		t.Error("wrong read new with no ack result")
+	}
+	entries = group.ReadHistory(s, "c1", MinID, 0, 200)
+	if len(entries) != 3 {
+		t.Error("wrong read history result")
+	}
+	if pending, _ := group.GetPending(ID{Ms: 1}); pending.DeliveryCount != 2 || pending.DeliveryTime != 200 {
+		t.Error("wrong pending entry")
+	}
+	if group.Ack(ID{Ms: 1}, ID{Ms: 9}) != 1 {
+		t.Error("wrong ack result")
+	}
+	claimed := group.Claim(s, "c2", []ID{{Ms: 2}, {Ms: 3}}, &ClaimOption{MinIdle: 50, DeliveryTime: 300, RetryCount: -1}, 300)
+	if len(claimed) != 2 || group.PendingLen("c2") != 2 || group.PendingLen("c1") != 0 {
+		t.Error("wrong claim result")
+	}
+	s.TrimByLen(2)
+	claimed, deleted, next := group.AutoClaim(s, "c3", 0, MinID, 10, false, 400)
+	if len(claimed) != 0 || len(deleted) != 2 || !next.IsZero() || group.PendingLen("") != 0 {
+		t.Error("wrong auto claim result")
+	}
+	if group.DeleteConsumer("c3") != 0 || len(group.Consumers()) != 2 {
+		t.Error("wrong delete consumer result")
+	}
+}
@@ -5,4 +5,5 @@ go 1.18
 require (
 	github.com/hdt3213/rdb v1.0.5
 	github.com/shopspring/decimal v1.2.0
+	github.com/yuin/gopher-lua v1.1.0
 )
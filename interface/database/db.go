@@ -2,6 +2,7 @@ package database
 
 import (
 	"github.com/hdt3213/godis/interface/redis"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,14 +22,64 @@ type EmbedDB interface {
 	ExecWithLock(conn redis.Connection, cmdLine [][]byte) redis.Reply
 	ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply
 	GetUndoLogs(dbIndex int, cmdLine [][]byte) []CmdLine
+	// GetRelatedKeys returns keys written and read by cmdLine, both are empty if it is not a normal command
+	GetRelatedKeys(cmdLine [][]byte) ([]string, []string)
 	// ForEach 两个参数, 一个db的序号，一个处理方法(返回值为bool)
 	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
 	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
 	GetDBSize(dbIndex int) (int, int)
+	// GetFunctionLibraries returns code of all function libraries loaded by FUNCTION LOAD
+	GetFunctionLibraries() []string
+	// LoadEntity puts entity parsed from rdb into database
+	LoadEntity(dbIndex int, key string, entity *DataEntity, expiration *time.Time)
+	// TakeSnapshot takes a point-in-time view of all databases without copying them.
+	// cut is invoked while no command is modifying data, so commands could be divided into those before and after it.
+	// Original value of a key is encoded by encode before the key is accessed for the first time after snapshot taken
+	TakeSnapshot(encode func(key string, data *DataEntity, expiration *time.Time) []byte, cut func() error) (Snapshot, error)
+	// MasterAddr returns address of master if it is a replica, otherwise empty string
+	MasterAddr() string
+}
+
+// Snapshot is a point-in-time view of databases, see EmbedDB.TakeSnapshot
+type Snapshot interface {
+	// ForEach traverses keys of the given database which haven't been accessed since snapshot taken
+	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
+	GetDBSize(dbIndex int) (int, int)
+	// GetFunctionLibraries returns code of function libraries loaded when snapshot taken
+	GetFunctionLibraries() []string
+	// Release stops saving original values, and returns encoded original values of keys accessed since snapshot taken,
+	// indexed by database. Keys which have been traversed may be included again, their values are preceded by DEL
+	Release() [][]byte
+}
+
+// WriteSink receives write commands applied to database, such as change data capture connectors
+type WriteSink interface {
+	Send(dbIndex int, cmdLine [][]byte)
+	Close()
 }
 
 // DataEntity stores data bound to a key, including a string, list, hash, set and so on
 type DataEntity struct {
 	Data interface{}
+	// Encoding is the largest internal encoding the value has been converted to, it never converts back
+	Encoding string
+	// lastAccess is the unix timestamp in seconds when the entity was accessed last time
+	lastAccess int64
+}
+
+// Touch updates the access time of entity
+func (entity *DataEntity) Touch() {
+	atomic.StoreInt64(&entity.lastAccess, time.Now().Unix())
+}
+
+// IdleTime returns the time elapsed since the entity was accessed last time
+func (entity *DataEntity) IdleTime() time.Duration {
+	lastAccess := atomic.LoadInt64(&entity.lastAccess)
+	return time.Since(time.Unix(lastAccess, 0))
+}
+
+// SetIdleTime pretends the entity was accessed the given duration ago
+func (entity *DataEntity) SetIdleTime(idle time.Duration) {
+	atomic.StoreInt64(&entity.lastAccess, time.Now().Add(-idle).Unix())
 }
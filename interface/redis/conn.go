@@ -9,8 +9,16 @@ type Connection interface {
 	// client should keep its subscribing channels
 	Subscribe(channel string)
 	UnSubscribe(channel string)
+	PSubscribe(pattern string)
+	PUnSubscribe(pattern string)
+	// SubsCount returns the number of subscribing channels and patterns
 	SubsCount() int
 	GetChannels() []string
+	GetPatterns() []string
+	// shard channels are counted separately from channels and patterns
+	SSubscribe(channel string)
+	SUnSubscribe(channel string)
+	GetShardChannels() []string
 
 	// used for `Multi` command
 	InMultiState() bool
@@ -22,10 +30,24 @@ type Connection interface {
 	AddTxError(err error)
 	GetTxErrors() []error
 
+	// GetID returns unique id of connection, it is used by CLIENT command
+	GetID() uint64
+	// protocol version negotiated by HELLO command, 2 or 3
+	GetProtocol() int
+	SetProtocol(int)
+
 	// used for multi database
 	GetDBIndex() int
 	SelectDB(int)
 	// returns role of conn, such as connection with client, connection with master node
 	GetRole() int32
 	SetRole(int32)
+	// read only connection set by READONLY accepts stale reads from replica in cluster mode
+	IsReadOnly() bool
+	SetReadOnly(bool)
+	// asking flag is set by ASKING, it allows the next command to access slot being imported in cluster mode
+	IsAsking() bool
+	SetAsking(bool)
+	// Done returns a channel closed once the connection is closed or the client disconnected
+	Done() <-chan struct{}
 }
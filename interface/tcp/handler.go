@@ -13,3 +13,13 @@ type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 }
+
+// ShutdownNotifier is implemented by handler which could ask server to stop, such as by SHUTDOWN command
+type ShutdownNotifier interface {
+	ShutdownRequested() <-chan struct{}
+}
+
+// Reloader is implemented by handler which reloads config on SIGHUP
+type Reloader interface {
+	Reload()
+}
@@ -2,20 +2,29 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // HashFunc defines function to generate hash code
 type HashFunc func(data []byte) uint32
 
-// Map stores nodes and you can pick node from Map
+// Map stores nodes and you can pick node from Map.
+// Map is safe for concurrent use, since nodes discovered by gossip are added while serving
 type Map struct {
+	mu       sync.RWMutex
 	hashFunc HashFunc
 	replicas int            // 虚拟节点个数
 	keys     []int          // sorted，存放排序的 hash值
 	hashMap  map[int]string // 虚拟节点 hash 值到物理节点地址的映射
+	// loads is node -> count of its requests in flight, counted by Acquire and Release for PickNodeBounded
+	loads map[string]*int64
+	// weights is node -> weight, node has replicas*weight virtual nodes
+	weights map[string]int
 }
 
 // New creates a new Map
@@ -25,6 +34,8 @@ func New(replicas int, fn HashFunc) *Map {
 		replicas: replicas,
 		hashFunc: fn,
 		hashMap:  make(map[int]string), // 虚拟节点 hash 值到物理节点地址的映射
+		loads:    make(map[string]*int64),
+		weights:  make(map[string]int),
 	}
 	if m.hashFunc == nil {
 		// 哈希函数
@@ -35,46 +46,202 @@ func New(replicas int, fn HashFunc) *Map {
 
 // IsEmpty returns if there is no node in Map
 func (m *Map) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.keys) == 0
 }
 
 // AddNode add the given nodes into consistent hash circle
 func (m *Map) AddNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, key := range keys {
-		if key == "" {
+		m.addNode(key, 1)
+	}
+	sort.Ints(m.keys)
+}
+
+// AddNodeWithWeight adds node with replicas*weight virtual nodes, so node with more weight owns proportionally more
+// keys, weight less than 1 is taken as 1. Virtual nodes of weight 1 are the same as AddNode
+func (m *Map) AddNodeWithWeight(key string, weight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addNode(key, weight)
+	sort.Ints(m.keys)
+}
+
+// addNode adds virtual nodes of node without sorting, invoker should hold m.mu
+func (m *Map) addNode(key string, weight int) {
+	if key == "" {
+		return
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	if _, ok := m.weights[key]; ok {
+		// virtual nodes of previous weight are replaced
+		m.removeNodes(map[string]struct{}{key: {}})
+	}
+	m.weights[key] = weight
+	if _, ok := m.loads[key]; !ok {
+		m.loads[key] = new(int64)
+	}
+	// 添加虚拟节点
+	for i := 0; i < m.replicas*weight; i++ {
+		hash := int(m.hashFunc([]byte(strconv.Itoa(i) + key)))
+		// 将虚拟节点添加到环上
+		m.keys = append(m.keys, hash)
+		m.hashMap[hash] = key
+	}
+}
+
+// RemoveNode removes the given nodes and their virtual nodes from consistent hash circle
+func (m *Map) RemoveNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		removed[key] = struct{}{}
+		delete(m.loads, key)
+	}
+	m.removeNodes(removed)
+}
+
+// removeNodes removes virtual nodes of removed nodes, invoker should hold m.mu
+func (m *Map) removeNodes(removed map[string]struct{}) {
+	for key := range removed {
+		delete(m.weights, key)
+	}
+	hashes := m.keys[:0]
+	for _, hash := range m.keys {
+		if _, ok := removed[m.hashMap[hash]]; ok {
+			delete(m.hashMap, hash)
 			continue
 		}
-		// 添加虚拟节点
-		for i := 0; i < m.replicas; i++ {
-			hash := int(m.hashFunc([]byte(strconv.Itoa(i) + key)))
-			// 将虚拟节点添加到环上
-			m.keys = append(m.keys, hash)
-			m.hashMap[hash] = key
+		hashes = append(hashes, hash)
+	}
+	m.keys = hashes
+}
+
+// Change is a range of hash values [Begin, End] whose owner changes from From to To, keys in it should be migrated.
+// From or To is empty if there is no node before or after the change
+type Change struct {
+	Begin uint32
+	End   uint32
+	From  string
+	To    string
+}
+
+// Clone returns a copy of Map, so that changes of nodes could be found by Diff with the copy taken before
+func (m *Map) Clone() *Map {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c := New(m.replicas, m.hashFunc)
+	c.keys = make([]int, len(m.keys))
+	copy(c.keys, m.keys)
+	for hash, node := range m.hashMap {
+		c.hashMap[hash] = node
+	}
+	for node := range m.loads {
+		c.loads[node] = new(int64)
+	}
+	for node, weight := range m.weights {
+		c.weights[node] = weight
+	}
+	return c
+}
+
+// owner returns node owning hash, invoker should hold m.mu
+func (m *Map) owner(hash int) string {
+	if len(m.keys) == 0 {
+		return ""
+	}
+	idx := sort.SearchInts(m.keys, hash)
+	if idx == len(m.keys) {
+		idx = 0
+	}
+	return m.hashMap[m.keys[idx]]
+}
+
+// Diff returns hash ranges whose owner in m is different from that in after, in ascending order.
+// Ranges are split by virtual nodes of both maps, so the owner is the same in each of them
+func (m *Map) Diff(after *Map) []Change {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	after.mu.RLock()
+	defer after.mu.RUnlock()
+	points := make([]int, 0, len(m.keys)+len(after.keys))
+	points = append(points, m.keys...)
+	points = append(points, after.keys...)
+	sort.Ints(points)
+	var changes []Change
+	add := func(begin uint32, end uint32, point int) {
+		from, to := m.owner(point), after.owner(point)
+		if from == to {
+			return
 		}
+		if n := len(changes); n > 0 && changes[n-1].End+1 == begin && changes[n-1].From == from && changes[n-1].To == to {
+			changes[n-1].End = end
+			return
+		}
+		changes = append(changes, Change{Begin: begin, End: end, From: from, To: to})
 	}
-	sort.Ints(m.keys)
+	if len(points) == 0 {
+		return nil
+	}
+	// hashes before the first point and after the last one belong to the first virtual node
+	add(0, uint32(points[0]), points[0])
+	for i := 1; i < len(points); i++ {
+		if points[i] == points[i-1] {
+			continue
+		}
+		add(uint32(points[i-1])+1, uint32(points[i]), points[i])
+	}
+	if last := points[len(points)-1]; last < math.MaxUint32 {
+		add(uint32(last)+1, math.MaxUint32, points[0])
+	}
+	return changes
+}
+
+// MovedKeys returns keys in changed ranges grouped by their new owner, it is used to find keys to migrate
+func (m *Map) MovedKeys(changes []Change, keys []string) map[string][]string {
+	result := make(map[string][]string)
+	for _, key := range keys {
+		hash := m.hashFunc([]byte(PartitionKey(key)))
+		// changes are sorted, find the first one ending at or after hash
+		i := sort.Search(len(changes), func(i int) bool {
+			return changes[i].End >= hash
+		})
+		if i < len(changes) && changes[i].Begin <= hash {
+			result[changes[i].To] = append(result[changes[i].To], key)
+		}
+	}
+	return result
 }
 
-// support hash tag
-func getPartitionKey(key string) string {
+// PartitionKey returns the part of key deciding its node, it is the hash tag if the key has a non-empty one between
+// the first '{' and the first '}' after it like redis cluster, otherwise the whole key
+func PartitionKey(key string) string {
 	beg := strings.Index(key, "{")
 	if beg == -1 {
 		return key
 	}
-	end := strings.Index(key, "}")
-	if end == -1 || end == beg+1 {
+	end := strings.Index(key[beg+1:], "}")
+	if end <= 0 {
 		return key
 	}
-	return key[beg+1 : end]
+	return key[beg+1 : beg+1+end]
 }
 
 // PickNode gets the closest item in the hash to the provided key.
 func (m *Map) PickNode(key string) string {
-	if m.IsEmpty() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
 		return ""
 	}
 	// 支持根据 key 的 hashtag 来确定分布
-	partitionKey := getPartitionKey(key)
+	partitionKey := PartitionKey(key)
 
 	// 计算出该 key 的 hash 值
 	hash := int(m.hashFunc([]byte(partitionKey)))
@@ -94,3 +261,90 @@ func (m *Map) PickNode(key string) string {
 	// 将虚拟节点映射为实际地址
 	return m.hashMap[m.keys[idx]]
 }
+
+// PickNodes returns the first n distinct nodes clockwise from hash of key, the first one is the same as PickNode.
+// It is used to place replicas of key or to spread reads, fewer nodes are returned if there are less than n nodes
+func (m *Map) PickNodes(key string, n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(m.weights) {
+		n = len(m.weights)
+	}
+	hash := int(m.hashFunc([]byte(PartitionKey(key))))
+	idx := sort.SearchInts(m.keys, hash)
+	nodes := make([]string, 0, n)
+	picked := make(map[string]struct{}, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if _, ok := picked[node]; ok {
+			continue
+		}
+		picked[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// PickNodeBounded picks node like PickNode, but nodes whose load would exceed loadFactor times of average load
+// weighted by their weights are skipped, so requests of hot keys spill to the next nodes clockwise instead of overloading one node.
+// Load is count of requests in flight, caller should Acquire the picked node and Release it once request finished.
+// loadFactor less than 1 is taken as 1. Keys picked by it may be on other nodes than PickNode, so it suits requests
+// which could be served by any node, such as reading a cache
+func (m *Map) PickNodeBounded(key string, loadFactor float64) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return ""
+	}
+	if loadFactor < 1 {
+		loadFactor = 1
+	}
+	total, totalWeight := int64(0), 0
+	for node, load := range m.loads {
+		total += atomic.LoadInt64(load)
+		totalWeight += m.weights[node]
+	}
+	// capacity counts the request being picked, so there is always a node under it
+	average := loadFactor * float64(total+1) / float64(totalWeight)
+	hash := int(m.hashFunc([]byte(PartitionKey(key))))
+	idx := sort.SearchInts(m.keys, hash)
+	for i := 0; i < len(m.keys); i++ {
+		node := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		capacity := int64(math.Ceil(average * float64(m.weights[node])))
+		if atomic.LoadInt64(m.loads[node])+1 <= capacity {
+			return node
+		}
+	}
+	return m.owner(hash)
+}
+
+// Acquire counts a request in flight to node
+func (m *Map) Acquire(node string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if load, ok := m.loads[node]; ok {
+		atomic.AddInt64(load, 1)
+	}
+}
+
+// Release counts a request to node finished
+func (m *Map) Release(node string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if load, ok := m.loads[node]; ok {
+		atomic.AddInt64(load, -1)
+	}
+}
+
+// Load returns count of requests in flight to node
+func (m *Map) Load(node string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if load, ok := m.loads[node]; ok {
+		return atomic.LoadInt64(load)
+	}
+	return 0
+}
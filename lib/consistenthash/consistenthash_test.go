@@ -1,6 +1,9 @@
 package consistenthash
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+)
 
 func TestHash(t *testing.T) {
 	m := New(3, nil)
@@ -15,3 +18,171 @@ func TestHash(t *testing.T) {
 		t.Error("wrong answer")
 	}
 }
+
+func TestRemoveNode(t *testing.T) {
+	m := New(3, nil)
+	m.AddNode("a", "b", "c", "d")
+	m.RemoveNode("b")
+	for _, key := range []string{"zxc", "123{abc}", "abc", "foo", "bar"} {
+		if m.PickNode(key) == "b" {
+			t.Errorf("%s should not be picked after removed", key)
+		}
+	}
+	if m.PickNode("zxc") != "a" {
+		t.Error("keys of other nodes should not move")
+	}
+	m.RemoveNode("a", "c", "d")
+	if !m.IsEmpty() || m.PickNode("zxc") != "" {
+		t.Error("expect empty map")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m := New(3, nil)
+	m.AddNode("a", "b", "c")
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+	check := func(before *Map, after *Map) {
+		changes := before.Diff(after)
+		moved := after.MovedKeys(changes, keys)
+		count := 0
+		for to, movedKeys := range moved {
+			for _, key := range movedKeys {
+				if after.PickNode(key) != to || before.PickNode(key) == to {
+					t.Errorf("%s should not be moved to %s", key, to)
+				}
+			}
+			count += len(movedKeys)
+		}
+		expected := 0
+		for _, key := range keys {
+			if before.PickNode(key) != after.PickNode(key) {
+				expected++
+			}
+		}
+		if count != expected {
+			t.Errorf("expect %d moved keys, actually %d", expected, count)
+		}
+	}
+
+	before := m.Clone()
+	m.RemoveNode("b")
+	for _, change := range before.Diff(m) {
+		if change.From != "b" || change.To == "b" {
+			t.Errorf("only ranges of b should be moved, actually %+v", change)
+		}
+	}
+	check(before, m)
+
+	before = m.Clone()
+	m.AddNode("d")
+	for _, change := range before.Diff(m) {
+		if change.To != "d" {
+			t.Errorf("only ranges of d should be moved, actually %+v", change)
+		}
+	}
+	check(before, m)
+	if changes := m.Diff(m.Clone()); len(changes) != 0 {
+		t.Errorf("expect no change, actually %+v", changes)
+	}
+}
+
+func TestPickNodeBounded(t *testing.T) {
+	m := New(3, nil)
+	m.AddNode("a", "b", "c", "d")
+	owner := m.PickNode("zxc")
+	if node := m.PickNodeBounded("zxc", 1.25); node != owner {
+		t.Errorf("expect owner %s without load, actually %s", owner, node)
+	}
+	// requests of a hot key spill to other nodes
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		node := m.PickNodeBounded("zxc", 1.25)
+		m.Acquire(node)
+		picked[node]++
+	}
+	for node, n := range picked {
+		// capacity of the last pick is ceil(1.25 * 100 / 4)
+		if n > 32 {
+			t.Errorf("load of %s exceeds capacity: %d", node, n)
+		}
+		if m.Load(node) != int64(n) {
+			t.Errorf("expect load %d of %s, actually %d", n, node, m.Load(node))
+		}
+	}
+	if picked[owner] != 32 {
+		t.Errorf("owner should be filled up to capacity, actually %d", picked[owner])
+	}
+	for node, n := range picked {
+		for i := 0; i < n; i++ {
+			m.Release(node)
+		}
+	}
+	if node := m.PickNodeBounded("zxc", 1.25); node != owner {
+		t.Errorf("expect owner %s after released, actually %s", owner, node)
+	}
+}
+
+func TestAddNodeWithWeight(t *testing.T) {
+	m := New(50, nil)
+	m.AddNode("a")
+	m.AddNodeWithWeight("b", 1)
+	m2 := New(50, nil)
+	m2.AddNode("a", "b")
+	if len(m.Diff(m2)) != 0 {
+		t.Error("weight 1 should be the same as AddNode")
+	}
+
+	m.AddNodeWithWeight("b", 3)
+	count := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		count[m.PickNode("key"+strconv.Itoa(i))]++
+	}
+	if count["b"] < 2*count["a"] {
+		t.Errorf("b should own about 3 times keys of a, actually %v", count)
+	}
+	// virtual nodes of previous weight are replaced
+	m.AddNodeWithWeight("b", 1)
+	if len(m.Diff(m2)) != 0 {
+		t.Error("virtual nodes of weight 3 should be removed")
+	}
+}
+
+func TestPickNodes(t *testing.T) {
+	m := New(3, nil)
+	m.AddNode("a", "b", "c", "d")
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes := m.PickNodes(key, 3)
+		if len(nodes) != 3 || nodes[0] != m.PickNode(key) {
+			t.Fatalf("expect 3 nodes starting with %s, actually %v", m.PickNode(key), nodes)
+		}
+		if nodes[0] == nodes[1] || nodes[0] == nodes[2] || nodes[1] == nodes[2] {
+			t.Fatalf("expect distinct nodes, actually %v", nodes)
+		}
+	}
+	if nodes := m.PickNodes("zxc", 10); len(nodes) != 4 {
+		t.Errorf("expect all 4 nodes, actually %v", nodes)
+	}
+	if nodes := New(3, nil).PickNodes("zxc", 2); len(nodes) != 0 {
+		t.Errorf("expect no node, actually %v", nodes)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	cases := map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+		"a}b{c}":               "c",
+		"abc":                  "abc",
+	}
+	for key, expected := range cases {
+		if actual := PartitionKey(key); actual != expected {
+			t.Errorf("partition key of %s: expected %s, actually %s", key, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Package lazyfree releases memory of dropped data in a background goroutine,
+// so flushing databases and evicting keys reply without waiting for the release
+package lazyfree
+
+import (
+	"github.com/hdt3213/godis/lib/logger"
+	"sync/atomic"
+)
+
+// queueSize is the max number of jobs waiting for background goroutine
+const queueSize = 1024
+
+var (
+	jobs    = make(chan func(), queueSize)
+	pending int64
+)
+
+func init() {
+	go func() {
+		for job := range jobs {
+			release(job)
+		}
+	}()
+}
+
+func release(job func()) {
+	defer func() {
+		atomic.AddInt64(&pending, -1)
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	job()
+}
+
+// Free executes job releasing memory in background goroutine, job is executed by caller if too many jobs are waiting
+func Free(job func()) {
+	atomic.AddInt64(&pending, 1)
+	select {
+	case jobs <- job:
+	default:
+		release(job)
+	}
+}
+
+// Pending returns number of jobs which haven't been finished
+func Pending() int64 {
+	return atomic.LoadInt64(&pending)
+}
@@ -1,13 +1,16 @@
 package logger
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,6 +45,31 @@ const (
 
 const flags = log.LstdFlags
 
+// minLevel is the lowest level printed, logs below it are discarded
+var minLevel = int32(DEBUG)
+
+// SetLevel discards logs below the level, which is named like loglevel of redis: debug, verbose, notice or warning.
+// Verbose and notice both print info logs
+func SetLevel(name string) error {
+	var level logLevel
+	switch strings.ToLower(name) {
+	case "debug":
+		level = DEBUG
+	case "verbose", "notice":
+		level = INFO
+	case "warning":
+		level = WARNING
+	default:
+		return errors.New("unknown log level: " + name)
+	}
+	atomic.StoreInt32(&minLevel, int32(level))
+	return nil
+}
+
+func enabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLevel)
+}
+
 func init() {
 	logger = log.New(os.Stdout, defaultPrefix, flags)
 }
@@ -77,6 +105,9 @@ func setPrefix(level logLevel) {
 
 // Debug prints debug log
 func Debug(v ...interface{}) {
+	if !enabled(DEBUG) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(DEBUG)
@@ -85,6 +116,9 @@ func Debug(v ...interface{}) {
 
 // Info prints normal log
 func Info(v ...interface{}) {
+	if !enabled(INFO) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(INFO)
@@ -93,6 +127,9 @@ func Info(v ...interface{}) {
 
 // Warn prints warning log
 func Warn(v ...interface{}) {
+	if !enabled(WARNING) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(WARNING)
@@ -101,6 +138,9 @@ func Warn(v ...interface{}) {
 
 // Error prints error log
 func Error(v ...interface{}) {
+	if !enabled(ERROR) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(ERROR)
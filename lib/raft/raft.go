@@ -0,0 +1,653 @@
+// Package raft replicates a log among a fixed group of nodes by raft consensus algorithm,
+// entries are applied in the same order on every node once a majority of nodes have stored them.
+// Log is never compacted, so it suits small and rarely changed state such as cluster metadata.
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a record of log, Data is empty for the no-op entry appended by a new leader
+type Entry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// VoteRequest is sent by candidate to ask for vote
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+// VoteResponse is reply of VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest is sent by leader to replicate entries, it is also the heartbeat if Entries is empty
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+// AppendResponse is reply of AppendRequest
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is the last index matching leader if succeeded, otherwise leader retries from LastIndex+1
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+// Transport delivers requests to peers, it is implemented by the application
+type Transport interface {
+	RequestVote(peer string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error)
+}
+
+// Config is settings of a raft node
+type Config struct {
+	ID string
+	// Peers are ids of other nodes in group
+	Peers []string
+	// File stores term, vote and log, so they survive restart. Changes are appended to it as records,
+	// so persisting costs an append and a fsync rather than rewriting the whole log. Nothing is persisted if it is empty
+	File      string
+	Transport Transport
+	// Apply is invoked with committed entries carrying data one by one in order, from a single goroutine
+	Apply func(entry *Entry)
+	// ElectionTimeout is the min time without leader before starting election, use 1s if not set
+	ElectionTimeout time.Duration
+}
+
+// ErrNotLeader is returned by Propose on followers, entries should be proposed to Leader()
+var ErrNotLeader = errors.New("not leader")
+
+// ErrTimeout is returned if entry isn't applied in time, it may be applied later
+var ErrTimeout = errors.New("timeout")
+
+// ErrLostLeadership is returned if entry is discarded since another node became leader before it was committed
+var ErrLostLeadership = errors.New("lost leadership before entry committed")
+
+const (
+	defaultElectionTimeout = time.Second
+	// maxAppendEntries limits entries sent by an AppendRequest
+	maxAppendEntries = 64
+	// tickPeriod is the interval of checking election timeout and sending heartbeats
+	tickPeriod = 10 * time.Millisecond
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+// Node is a member of raft group
+type Node struct {
+	mu        sync.Mutex
+	id        string
+	peers     []string
+	file      string
+	writer    *os.File
+	transport Transport
+	apply     func(entry *Entry)
+
+	electionTimeout time.Duration
+	heartbeatPeriod time.Duration
+
+	// persistent state
+	currentTerm uint64
+	votedFor    string
+	// log[0] is a placeholder of index 0, so entry of index i is log[i]
+	log []Entry
+
+	commitIndex uint64
+	lastApplied uint64
+	// applied is signaled when commitIndex advances or node is closed
+	applied *sync.Cond
+
+	role   int
+	leader string
+	// electionDeadline is when follower starts election if it hears nothing from leader
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	// replicating means an AppendRequest is being sent to peer
+	replicating map[string]bool
+
+	closed bool
+	done   chan struct{}
+}
+
+// record is appended to Config.File once state changes, it carries term and vote, and entries appended to log.
+// Entries conflicting with Entries[0] and entries after it are removed before appending
+type record struct {
+	Term     uint64  `json:"term"`
+	VotedFor string  `json:"votedFor"`
+	Entries  []Entry `json:"entries,omitempty"`
+}
+
+// Make creates node and restores its state from file
+func Make(cfg *Config) (*Node, error) {
+	n := &Node{
+		id:              cfg.ID,
+		peers:           cfg.Peers,
+		file:            cfg.File,
+		transport:       cfg.Transport,
+		apply:           cfg.Apply,
+		electionTimeout: cfg.ElectionTimeout,
+		log:             []Entry{{}},
+		nextIndex:       make(map[string]uint64),
+		matchIndex:      make(map[string]uint64),
+		replicating:     make(map[string]bool),
+		done:            make(chan struct{}),
+	}
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = defaultElectionTimeout
+	}
+	n.heartbeatPeriod = n.electionTimeout / 5
+	n.applied = sync.NewCond(&n.mu)
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	return n, nil
+}
+
+// Start starts election timer and applying committed entries
+func (n *Node) Start() {
+	go n.tickLoop()
+	go n.applyLoop()
+}
+
+// Close stops node, state is persisted already
+func (n *Node) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = true
+	close(n.done)
+	n.applied.Broadcast()
+	if n.writer != nil {
+		_ = n.writer.Close()
+	}
+}
+
+// Leader returns id of the known leader, it is empty if no leader is known
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader returns whether this node is leader
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Term returns current term of node
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.currentTerm
+}
+
+// Propose appends data to log on leader, and returns index of the entry once it is applied on this node
+func (n *Node) Propose(data []byte, timeout time.Duration) (uint64, error) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	term := n.currentTerm
+	index := n.lastIndex() + 1
+	n.log = append(n.log, Entry{Term: term, Index: index, Data: data})
+	if err := n.persist(index); err != nil {
+		n.log = n.log[:index]
+		n.mu.Unlock()
+		return 0, err
+	}
+	n.broadcastAppend()
+	n.advanceCommitIndex()
+	n.mu.Unlock()
+
+	if err := n.WaitApplied(index, timeout); err != nil {
+		return index, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index >= uint64(len(n.log)) || n.log[index].Term != term {
+		return index, ErrLostLeadership
+	}
+	return index, nil
+}
+
+// WaitApplied waits until entry of index is applied on this node
+func (n *Node) WaitApplied(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	// sync.Cond can't wait with timeout, so waiter is woken up at deadline
+	timer := time.AfterFunc(timeout, func() {
+		n.mu.Lock()
+		n.applied.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.lastApplied < index {
+		if n.closed {
+			return errors.New("closed")
+		}
+		if !time.Now().Before(deadline) {
+			return ErrTimeout
+		}
+		n.applied.Wait()
+	}
+	return nil
+}
+
+// HandleRequestVote handles VoteRequest from candidate
+func (n *Node) HandleRequestVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.currentTerm {
+		n.stepDown(req.Term)
+	}
+	resp := &VoteResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp
+	}
+	// candidate's log must be at least as up-to-date as this node's log, so a leader always has committed entries
+	lastTerm := n.log[n.lastIndex()].Term
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.lastIndex()) {
+		return resp
+	}
+	n.votedFor = req.Candidate
+	if err := n.persistState(); err != nil {
+		n.votedFor = ""
+		return resp
+	}
+	n.resetElectionDeadline()
+	resp.Granted = true
+	return resp
+}
+
+// HandleAppendEntries handles AppendRequest from leader
+func (n *Node) HandleAppendEntries(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.currentTerm {
+		return &AppendResponse{Term: n.currentTerm, LastIndex: n.lastIndex()}
+	}
+	if req.Term > n.currentTerm || n.role != follower {
+		n.stepDown(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetElectionDeadline()
+	resp := &AppendResponse{Term: n.currentTerm}
+	if req.PrevLogIndex > n.lastIndex() {
+		resp.LastIndex = n.lastIndex()
+		return resp
+	}
+	if n.log[req.PrevLogIndex].Term != req.PrevLogTerm {
+		// entries since PrevLogIndex conflict with leader, leader retries from an earlier index
+		resp.LastIndex = req.PrevLogIndex - 1
+		return resp
+	}
+	for i, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() {
+			if n.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			n.log = n.log[:entry.Index]
+		}
+		n.log = append(n.log, req.Entries[i:]...)
+		if err := n.persist(entry.Index); err != nil {
+			resp.LastIndex = req.PrevLogIndex
+			return resp
+		}
+		break
+	}
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit > n.commitIndex {
+		commit := req.LeaderCommit
+		if lastNew < commit {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.applied.Broadcast()
+		}
+	}
+	resp.Success = true
+	resp.LastIndex = lastNew
+	return resp
+}
+
+func (n *Node) tickLoop() {
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if n.role == leader {
+		if now.Sub(n.lastHeartbeat) >= n.heartbeatPeriod {
+			n.broadcastAppend()
+		}
+		return
+	}
+	if now.After(n.electionDeadline) {
+		n.startElection()
+	}
+}
+
+// applyLoop applies committed entries in order
+func (n *Node) applyLoop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.applied.Wait()
+		}
+		if n.closed {
+			return
+		}
+		entries := make([]Entry, n.commitIndex-n.lastApplied)
+		copy(entries, n.log[n.lastApplied+1:n.commitIndex+1])
+		n.mu.Unlock()
+		for i := range entries {
+			if len(entries[i].Data) > 0 && n.apply != nil {
+				n.apply(&entries[i])
+			}
+		}
+		n.mu.Lock()
+		n.lastApplied = entries[len(entries)-1].Index
+		n.applied.Broadcast()
+	}
+}
+
+// startElection votes for self in a new term and asks peers for votes, invoker should hold n.mu
+func (n *Node) startElection() {
+	n.role = candidate
+	n.leader = ""
+	n.currentTerm++
+	n.votedFor = n.id
+	n.resetElectionDeadline()
+	if err := n.persistState(); err != nil {
+		return
+	}
+	term := n.currentTerm
+	votes := 1
+	if n.isMajority(votes) {
+		n.becomeLeader()
+		return
+	}
+	req := &VoteRequest{
+		Term:         term,
+		Candidate:    n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[n.lastIndex()].Term,
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			resp, err := n.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.currentTerm {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != candidate || n.currentTerm != term || !resp.Granted {
+				return
+			}
+			votes++
+			if n.isMajority(votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader appends a no-op entry, so entries of former terms are committed with it, invoker should hold n.mu
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	n.log = append(n.log, Entry{Term: n.currentTerm, Index: n.lastIndex() + 1})
+	if err := n.persist(n.lastIndex()); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.stepDown(n.currentTerm)
+		return
+	}
+	n.broadcastAppend()
+	n.advanceCommitIndex()
+}
+
+// stepDown turns node into follower of term, invoker should hold n.mu
+func (n *Node) stepDown(term uint64) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.leader = ""
+		_ = n.persistState()
+	}
+	n.role = follower
+	n.resetElectionDeadline()
+}
+
+// broadcastAppend sends entries or heartbeat to all peers, invoker should hold n.mu
+func (n *Node) broadcastAppend() {
+	n.lastHeartbeat = time.Now()
+	for _, peer := range n.peers {
+		n.replicate(peer)
+	}
+}
+
+// replicate sends entries since nextIndex of peer unless a request is being sent, invoker should hold n.mu
+func (n *Node) replicate(peer string) {
+	if n.replicating[peer] || n.role != leader {
+		return
+	}
+	n.replicating[peer] = true
+	prev := n.nextIndex[peer] - 1
+	end := n.lastIndex() + 1
+	if end-prev-1 > maxAppendEntries {
+		end = prev + 1 + maxAppendEntries
+	}
+	entries := make([]Entry, end-prev-1)
+	copy(entries, n.log[prev+1:end])
+	req := &AppendRequest{
+		Term:         n.currentTerm,
+		Leader:       n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log[prev].Term,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	go func() {
+		resp, err := n.transport.AppendEntries(peer, req)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.replicating[peer] = false
+		if err != nil || n.closed {
+			return
+		}
+		if resp.Term > n.currentTerm {
+			n.stepDown(resp.Term)
+			return
+		}
+		if n.role != leader || n.currentTerm != req.Term {
+			return
+		}
+		if !resp.Success {
+			next := resp.LastIndex + 1
+			if next >= n.nextIndex[peer] {
+				next = n.nextIndex[peer] - 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.nextIndex[peer] = next
+			n.replicate(peer)
+			return
+		}
+		if resp.LastIndex > n.matchIndex[peer] {
+			n.matchIndex[peer] = resp.LastIndex
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommitIndex()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.replicate(peer)
+		}
+	}()
+}
+
+// advanceCommitIndex commits the latest entry of current term stored by a majority, invoker should hold n.mu
+func (n *Node) advanceCommitIndex() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.log[index].Term != n.currentTerm {
+			// entries of former terms are committed only along with an entry of current term
+			return
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.isMajority(count) {
+			n.commitIndex = index
+			n.applied.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) isMajority(count int) bool {
+	return count*2 > len(n.peers)+1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return uint64(len(n.log) - 1)
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// persist appends a record of term, vote and entries since index from into file before replying requests or
+// appending entries, invoker should hold n.mu
+func (n *Node) persist(from uint64) error {
+	if n.writer == nil {
+		return nil
+	}
+	data, err := json.Marshal(&record{
+		Term:     n.currentTerm,
+		VotedFor: n.votedFor,
+		Entries:  n.log[from:],
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.writer.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return n.writer.Sync()
+}
+
+// persistState appends a record of term and vote without entries, invoker should hold n.mu
+func (n *Node) persistState() error {
+	return n.persist(n.lastIndex() + 1)
+}
+
+// restore replays records in file and opens it for appending. A partial record at the end is left by a crash
+// while appending, it is discarded since its change has never been replied or acknowledged
+func (n *Node) restore() error {
+	if n.file == "" {
+		return nil
+	}
+	file, err := os.OpenFile(n.file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(file)
+	var offset int64
+	for {
+		rec := &record{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			if err := file.Truncate(offset); err != nil {
+				_ = file.Close()
+				return err
+			}
+			break
+		} else if err != nil {
+			_ = file.Close()
+			return err
+		}
+		offset = dec.InputOffset()
+		n.currentTerm = rec.Term
+		n.votedFor = rec.VotedFor
+		if len(rec.Entries) == 0 {
+			continue
+		}
+		from := rec.Entries[0].Index
+		if from == 0 || from > n.lastIndex()+1 {
+			_ = file.Close()
+			return errors.New("corrupted raft log")
+		}
+		n.log = append(n.log[:from], rec.Entries...)
+	}
+	for i, entry := range n.log {
+		if entry.Index != uint64(i) {
+			_ = file.Close()
+			return errors.New("corrupted raft log")
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	n.writer = file
+	return nil
+}
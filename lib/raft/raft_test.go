@@ -0,0 +1,299 @@
+package raft
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTransport delivers requests to nodes in the same process, isolated nodes can't send or receive requests
+type memTransport struct {
+	mu       sync.Mutex
+	nodes    map[string]*Node
+	isolated map[string]bool
+}
+
+func (t *memTransport) target(from string, to string) (*Node, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node, ok := t.nodes[to]
+	if !ok || t.isolated[from] || t.isolated[to] {
+		return nil, errors.New("unreachable")
+	}
+	return node, nil
+}
+
+func (t *memTransport) isolate(id string, isolated bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.isolated[id] = isolated
+}
+
+type endpoint struct {
+	id string
+	*memTransport
+}
+
+func (e *endpoint) RequestVote(peer string, req *VoteRequest) (*VoteResponse, error) {
+	node, err := e.target(e.id, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleRequestVote(req), nil
+}
+
+func (e *endpoint) AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error) {
+	node, err := e.target(e.id, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppendEntries(req), nil
+}
+
+type testGroup struct {
+	transport *memTransport
+	ids       []string
+	dir       string
+	mu        sync.Mutex
+	applied   map[string][]string
+}
+
+func makeTestGroup(t *testing.T, size int) *testGroup {
+	g := &testGroup{
+		transport: &memTransport{nodes: make(map[string]*Node), isolated: make(map[string]bool)},
+		dir:       t.TempDir(),
+		applied:   make(map[string][]string),
+	}
+	for i := 0; i < size; i++ {
+		g.ids = append(g.ids, "node"+strconv.Itoa(i))
+	}
+	for _, id := range g.ids {
+		g.start(t, id)
+	}
+	return g
+}
+
+func (g *testGroup) start(t *testing.T, id string) *Node {
+	var peers []string
+	for _, peer := range g.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	g.mu.Lock()
+	g.applied[id] = nil
+	g.mu.Unlock()
+	node, err := Make(&Config{
+		ID:        id,
+		Peers:     peers,
+		File:      filepath.Join(g.dir, id+".json"),
+		Transport: &endpoint{id: id, memTransport: g.transport},
+		Apply: func(entry *Entry) {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.applied[id] = append(g.applied[id], string(entry.Data))
+		},
+		ElectionTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.transport.mu.Lock()
+	g.transport.nodes[id] = node
+	g.transport.mu.Unlock()
+	node.Start()
+	return node
+}
+
+func (g *testGroup) node(id string) *Node {
+	g.transport.mu.Lock()
+	defer g.transport.mu.Unlock()
+	return g.transport.nodes[id]
+}
+
+func (g *testGroup) close() {
+	for _, id := range g.ids {
+		g.node(id).Close()
+	}
+}
+
+// waitLeader returns the leader agreed by nodes not isolated. Leader is returned only after all of them have
+// followed it in the same term for several checks, so it won't be replaced by a concurrent election
+func (g *testGroup) waitLeader(t *testing.T, except string) *Node {
+	var last *Node
+	stable := 0
+	for i := 0; i < 500; i++ {
+		leader := g.agreedLeader(except)
+		if leader != nil && leader == last {
+			stable++
+			if stable >= 5 {
+				return leader
+			}
+		} else {
+			stable = 0
+		}
+		last = leader
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// agreedLeader returns the leader followed by all nodes except the given one in the same term, or nil
+func (g *testGroup) agreedLeader(except string) *Node {
+	var leader *Node
+	for _, id := range g.ids {
+		if id != except && g.node(id).IsLeader() {
+			leader = g.node(id)
+		}
+	}
+	if leader == nil {
+		return nil
+	}
+	term := leader.Term()
+	for _, id := range g.ids {
+		node := g.node(id)
+		if id != except && (node.Leader() != leader.id || node.Term() != term) {
+			return nil
+		}
+	}
+	return leader
+}
+
+func (g *testGroup) waitApplied(t *testing.T, id string, expected []string) {
+	var applied []string
+	for i := 0; i < 200; i++ {
+		g.mu.Lock()
+		applied = append([]string(nil), g.applied[id]...)
+		g.mu.Unlock()
+		if len(applied) >= len(expected) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(applied) != len(expected) {
+		t.Fatalf("%s should apply %v, actually %v", id, expected, applied)
+	}
+	for i := range expected {
+		if applied[i] != expected[i] {
+			t.Fatalf("%s should apply %v, actually %v", id, expected, applied)
+		}
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	g := makeTestGroup(t, 3)
+	defer g.close()
+	leader := g.waitLeader(t, "")
+	for _, data := range []string{"a", "b"} {
+		if _, err := leader.Propose([]byte(data), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range g.ids {
+		g.waitApplied(t, id, []string{"a", "b"})
+		if id != leader.id {
+			if _, err := g.node(id).Propose([]byte("c"), time.Second); err != ErrNotLeader {
+				t.Errorf("expect ErrNotLeader, actually %v", err)
+			}
+			if l := g.node(id).Leader(); l != leader.id {
+				t.Errorf("leader should be %s, actually %s", leader.id, l)
+			}
+		}
+	}
+
+	// a new leader is elected by the majority, and the former leader catches up once it is reachable
+	former := leader.id
+	g.transport.isolate(former, true)
+	leader = g.waitLeader(t, former)
+	if _, err := leader.Propose([]byte("c"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	g.transport.isolate(former, false)
+	for _, id := range g.ids {
+		g.waitApplied(t, id, []string{"a", "b", "c"})
+	}
+}
+
+func TestRestart(t *testing.T) {
+	g := makeTestGroup(t, 3)
+	defer g.close()
+	leader := g.waitLeader(t, "")
+	if _, err := leader.Propose([]byte("a"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// restarted node restores its log from file and applies it again
+	var restarted string
+	for _, id := range g.ids {
+		if id != leader.id {
+			restarted = id
+			break
+		}
+	}
+	g.waitApplied(t, restarted, []string{"a"})
+	g.node(restarted).Close()
+	node := g.start(t, restarted)
+	if node.Term() == 0 {
+		t.Error("term should be restored")
+	}
+	if _, err := leader.Propose([]byte("b"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	g.waitApplied(t, restarted, []string{"a", "b"})
+
+	if err := os.WriteFile(filepath.Join(g.dir, "broken.json"), []byte(`{"entries":[{"index":2}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Make(&Config{ID: "broken", File: filepath.Join(g.dir, "broken.json")}); err == nil {
+		t.Error("expect error restoring corrupted log")
+	}
+
+	// partial record left by crash is discarded
+	partial := filepath.Join(g.dir, "partial.json")
+	content := `{"term":2,"votedFor":"a","entries":[{"term":2,"index":1}]}` + "\n" + `{"term":3,"entr`
+	if err := os.WriteFile(partial, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node, err := Make(&Config{ID: "partial", File: partial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Term() != 2 || node.lastIndex() != 1 {
+		t.Errorf("expect term 2 and 1 entry restored, actually term %d and %d entries", node.Term(), node.lastIndex())
+	}
+	node.Close()
+}
+
+func TestSingleNode(t *testing.T) {
+	var applied []string
+	var mu sync.Mutex
+	node, err := Make(&Config{
+		ID: "single",
+		Apply: func(entry *Entry) {
+			mu.Lock()
+			applied = append(applied, string(entry.Data))
+			mu.Unlock()
+		},
+		ElectionTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Start()
+	defer node.Close()
+	for i := 0; i < 100 && !node.IsLeader(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := node.Propose([]byte("a"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(applied) != 1 || applied[0] != "a" {
+		t.Errorf("expect [a] applied, actually %v", applied)
+	}
+}
@@ -0,0 +1,285 @@
+// Package slotmap maps keys to 16384 hash slots by CRC16 like redis cluster, and slots to nodes owning them
+package slotmap
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SlotCount is the number of hash slots
+const SlotCount = 16384
+
+// Map stores owner node of each slot, it is compatible with slot assignment of redis cluster.
+// Map is safe for concurrent use, since slots are reassigned while serving during migration
+type Map struct {
+	mu    sync.RWMutex
+	nodes []string
+	slots [SlotCount]string // slot -> node, empty if slot is not assigned
+	// assigned means slots are assigned explicitly, so that AddNode doesn't reassign them
+	assigned bool
+	// migrating is slot -> node which keys of the slot are being migrated to
+	migrating map[int]string
+	// importing is slot -> node which keys of the slot are being imported from
+	importing map[int]string
+}
+
+// New creates an empty Map
+func New() *Map {
+	return &Map{}
+}
+
+// IsEmpty returns if there is no node in Map
+func (m *Map) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.nodes) == 0
+}
+
+// AddNode adds nodes, and slots are divided into contiguous ranges evenly among nodes sorted by address
+// unless slots have been assigned explicitly.
+// Nodes are sorted so that every node in cluster gets the same assignment whatever order its peers are given.
+func (m *Map) AddNode(nodes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, node := range nodes {
+		if node == "" || m.contains(node) {
+			continue
+		}
+		m.nodes = append(m.nodes, node)
+	}
+	sort.Strings(m.nodes)
+	m.divide()
+}
+
+// RemoveNode removes nodes, slots are divided again among the other nodes unless slots have been assigned explicitly,
+// in which case slots of removed nodes become unassigned
+func (m *Map) RemoveNode(nodes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		removed[node] = struct{}{}
+	}
+	remained := m.nodes[:0]
+	for _, node := range m.nodes {
+		if _, ok := removed[node]; !ok {
+			remained = append(remained, node)
+		}
+	}
+	m.nodes = remained
+	for slot, node := range m.slots {
+		if _, ok := removed[node]; ok {
+			m.slots[slot] = ""
+		}
+	}
+	for slot, node := range m.migrating {
+		if _, ok := removed[node]; ok {
+			delete(m.migrating, slot)
+		}
+	}
+	for slot, node := range m.importing {
+		if _, ok := removed[node]; ok {
+			delete(m.importing, slot)
+		}
+	}
+	m.divide()
+}
+
+// divide divides slots into contiguous ranges evenly among nodes, invoker should hold m.mu
+func (m *Map) divide() {
+	if m.assigned || len(m.nodes) == 0 {
+		return
+	}
+	for i, node := range m.nodes {
+		begin := i * SlotCount / len(m.nodes)
+		end := (i+1)*SlotCount/len(m.nodes) - 1
+		for slot := begin; slot <= end; slot++ {
+			m.slots[slot] = node
+		}
+	}
+}
+
+// Nodes returns nodes sorted by address
+func (m *Map) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]string, len(m.nodes))
+	copy(nodes, m.nodes)
+	return nodes
+}
+
+func (m *Map) contains(node string) bool {
+	for _, n := range m.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Assign assigns slots in [begin, end] to node, the node is added if it isn't in Map.
+// Once slots are assigned explicitly, AddNode doesn't divide slots among nodes, and unassigned slots are not served.
+func (m *Map) Assign(node string, begin int, end int) error {
+	if begin < 0 || end >= SlotCount || begin > end {
+		return errors.New("invalid slot range " + strconv.Itoa(begin) + "-" + strconv.Itoa(end))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assigned = true
+	if !m.contains(node) {
+		m.nodes = append(m.nodes, node)
+		sort.Strings(m.nodes)
+	}
+	for slot := begin; slot <= end; slot++ {
+		m.slots[slot] = node
+		delete(m.migrating, slot)
+		delete(m.importing, slot)
+	}
+	return nil
+}
+
+// SetMigrating marks slot as being migrated to node, empty node means migration is finished or canceled
+func (m *Map) SetMigrating(slot int, node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.migrating = setState(m.migrating, slot, node)
+}
+
+// GetMigrating returns the node which keys of slot are being migrated to, it is empty if slot is not migrating
+func (m *Map) GetMigrating(slot int) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.migrating[slot]
+}
+
+// SetImporting marks slot as being imported from node, empty node means migration is finished or canceled
+func (m *Map) SetImporting(slot int, node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.importing = setState(m.importing, slot, node)
+}
+
+// GetImporting returns the node which keys of slot are being imported from, it is empty if slot is not importing
+func (m *Map) GetImporting(slot int) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.importing[slot]
+}
+
+func setState(states map[int]string, slot int, node string) map[int]string {
+	if node == "" {
+		delete(states, slot)
+		return states
+	}
+	if states == nil {
+		states = make(map[int]string)
+	}
+	states[slot] = node
+	return states
+}
+
+// ParseAssignment assigns slots by config entry like "127.0.0.1:6379 0-5460 16000", which is the node
+// followed by slot ranges or single slots
+func (m *Map) ParseAssignment(entry string) error {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 {
+		return errors.New("slots of node are required")
+	}
+	for _, field := range fields[1:] {
+		begin, end := field, field
+		if i := strings.Index(field, "-"); i >= 0 {
+			begin, end = field[:i], field[i+1:]
+		}
+		b, err1 := strconv.Atoi(begin)
+		e, err2 := strconv.Atoi(end)
+		if err1 != nil || err2 != nil {
+			return errors.New("invalid slot range " + field)
+		}
+		if err := m.Assign(fields[0], b, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Assigned returns whether slots have been assigned explicitly instead of being divided among nodes
+func (m *Map) Assigned() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.assigned
+}
+
+// Unassigned returns the number of slots not served by any node
+func (m *Map) Unassigned() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	count := 0
+	for _, node := range m.slots {
+		if node == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// PickNode returns the node owning slot of the key, it returns empty string if the slot is not assigned
+func (m *Map) PickNode(key string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.slots[HashSlot(key)]
+}
+
+// GetSlotNode returns the node owning the slot
+func (m *Map) GetSlotNode(slot int) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.slots[slot]
+}
+
+// GetNodeSlots returns slot ranges owned by node, each range is [begin, end]
+func (m *Map) GetNodeSlots(node string) [][2]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ranges [][2]int
+	for slot := 0; slot < SlotCount; slot++ {
+		if m.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// HashSlot returns slot of key, only the hash tag is hashed if the key has a non-empty one between the first '{'
+// and the first '}' after it, so keys with the same tag are in the same slot
+func HashSlot(key string) int {
+	if beg := strings.IndexByte(key, '{'); beg >= 0 {
+		if end := strings.IndexByte(key[beg+1:], '}'); end > 0 {
+			key = key[beg+1 : beg+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % SlotCount)
+}
+
+// crc16 is the CCITT XMODEM variant used by redis cluster
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
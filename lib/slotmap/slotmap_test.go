@@ -0,0 +1,114 @@
+package slotmap
+
+import "testing"
+
+func TestHashSlot(t *testing.T) {
+	// slots of keys without hash tag are given by CLUSTER KEYSLOT of redis
+	cases := map[string]int{
+		"123456789":       12739,
+		"foo":             12182,
+		"{user1000}.a":    HashSlot("user1000"),
+		"{user1000}.b":    HashSlot("user1000"),
+		"foo{{bar}}zap":   HashSlot("{bar"),
+		"foo{bar}{zap}":   HashSlot("bar"),
+		"":                0,
+		"somekey{a}x{b}y": HashSlot("a"),
+	}
+	for key, expected := range cases {
+		if actual := HashSlot(key); actual != expected {
+			t.Errorf("slot of %s: expected %d, actually %d", key, expected, actual)
+		}
+	}
+	if HashSlot("foo{}{bar}") == HashSlot("bar") {
+		t.Error("empty hash tag should be ignored")
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	m := New()
+	m.AddNode("c", "a", "b", "a")
+	// the same assignment whatever order nodes are added
+	m2 := New()
+	m2.AddNode("a")
+	m2.AddNode("b", "c")
+	for slot := 0; slot < SlotCount; slot++ {
+		if m.GetSlotNode(slot) != m2.GetSlotNode(slot) {
+			t.Fatalf("slot %d is assigned differently", slot)
+		}
+	}
+	expected := map[string][2]int{"a": {0, 5460}, "b": {5461, 10921}, "c": {10922, 16383}}
+	for node, r := range expected {
+		ranges := m.GetNodeSlots(node)
+		if len(ranges) != 1 || ranges[0] != r {
+			t.Errorf("slots of %s: expected %v, actually %v", node, r, ranges)
+		}
+	}
+	if m.PickNode("foo") != "c" {
+		t.Errorf("foo should be on c")
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	m := New()
+	m.AddNode("a", "b", "c")
+	m.RemoveNode("b")
+	expected := map[string][2]int{"a": {0, 8191}, "c": {8192, 16383}}
+	for node, r := range expected {
+		ranges := m.GetNodeSlots(node)
+		if len(ranges) != 1 || ranges[0] != r {
+			t.Errorf("slots of %s: expected %v, actually %v", node, r, ranges)
+		}
+	}
+	// slots of removed node become unassigned if slots are assigned explicitly
+	m = New()
+	_ = m.Assign("a", 0, 99)
+	_ = m.Assign("b", 100, 199)
+	m.SetMigrating(0, "b")
+	m.RemoveNode("b")
+	if n := m.Unassigned(); n != SlotCount-100 {
+		t.Errorf("expect %d unassigned slots, actually %d", SlotCount-100, n)
+	}
+	if nodes := m.Nodes(); len(nodes) != 1 || nodes[0] != "a" {
+		t.Errorf("expect nodes [a], actually %v", nodes)
+	}
+	if m.GetMigrating(0) != "" {
+		t.Error("migration to removed node should be canceled")
+	}
+}
+
+func TestParseAssignment(t *testing.T) {
+	m := New()
+	if err := m.ParseAssignment("a 0-100 200"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ParseAssignment("b 101-199 201-16383"); err != nil {
+		t.Fatal(err)
+	}
+	m.AddNode("a", "b")
+	if m.Unassigned() != 0 {
+		t.Errorf("all slots should be assigned")
+	}
+	ranges := m.GetNodeSlots("a")
+	if len(ranges) != 2 || ranges[0] != [2]int{0, 100} || ranges[1] != [2]int{200, 200} {
+		t.Errorf("wrong slots of a: %v", ranges)
+	}
+	for _, entry := range []string{"c", "c 1-x", "c 100-50", "c 0-16384"} {
+		if err := m.ParseAssignment(entry); err == nil {
+			t.Errorf("%s should be illegal", entry)
+		}
+	}
+	m.SetMigrating(100, "b")
+	if m.GetMigrating(100) != "b" {
+		t.Errorf("slot 100 should be migrating to b")
+	}
+	_ = m.Assign("b", 100, 100)
+	if m.GetMigrating(100) != "" || m.GetSlotNode(100) != "b" {
+		t.Errorf("slot 100 should be owned by b after migration")
+	}
+
+	m = New()
+	_ = m.ParseAssignment("a 0-100")
+	if m.Unassigned() != SlotCount-101 || m.GetSlotNode(101) != "" {
+		t.Errorf("slots not assigned should be served by no node")
+	}
+}
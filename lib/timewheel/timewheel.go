@@ -109,7 +109,9 @@ func (tw *TimeWheel) tickHandler() {
 	} else {
 		tw.currentPos++
 	}
-	go tw.scanAndRunTask(l)
+	// scan in the same goroutine as adding and removing tasks since they share slots and timer,
+	// jobs are still run in their own goroutines
+	tw.scanAndRunTask(l)
 }
 
 func (tw *TimeWheel) scanAndRunTask(l *list.List) {
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/logger"
 	RedisServer "github.com/hdt3213/godis/redis/server"
 	"github.com/hdt3213/godis/tcp"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 var banner = `
@@ -17,12 +23,16 @@ var banner = `
 \____/\____/\__,_/_/____/
 `
 
+// defaultProperties listens on all interfaces, clients from outside are refused by protected mode until
+// password is set
 var defaultProperties = &config.ServerProperties{
-	Bind:           "0.0.0.0",
-	Port:           6399,
-	AppendOnly:     false,
-	AppendFilename: "",
-	MaxClients:     1000,
+	Port:             6399,
+	AppendOnly:       false,
+	AppendFilename:   "",
+	MaxClients:       1000,
+	AofLoadTruncated: true,
+	ProtectedMode:    true,
+	RDBChecksum:      true,
 }
 
 func fileExists(filename string) bool {
@@ -31,6 +41,17 @@ func fileExists(filename string) bool {
 }
 
 func main() {
+	if filepath.Base(os.Args[0]) == "gedis-check-aof" {
+		os.Exit(aof.RunCheckCommand(os.Args[1:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		os.Exit(aof.RunCheckCommand(os.Args[2:], os.Stdout))
+	}
+	truncateTo := flag.Int("aof-truncate-to-timestamp", 0,
+		"stop loading aof at the unix timestamp for point-in-time recovery, requires aof-timestamp-enabled")
+	sentinelMode := flag.Bool("sentinel", filepath.Base(os.Args[0]) == "gedis-sentinel",
+		"run as sentinel monitoring masters given by sentinel-monitor")
+	flag.Parse()
 	print(banner)
 	logger.Setup(&logger.Settings{
 		Path:       "logs",
@@ -43,16 +64,67 @@ func main() {
 		if fileExists("redis.conf") {
 			config.SetupConfig("redis.conf")
 		} else {
-			config.Properties = defaultProperties
+			config.SetProperties(defaultProperties)
 		}
 	} else {
 		config.SetupConfig(configFilename)
 	}
+	if *truncateTo > 0 {
+		config.Update(func(p *config.ServerProperties) {
+			p.AofTruncateToTimestamp = *truncateTo
+		})
+	}
+	if *sentinelMode {
+		config.Update(func(p *config.ServerProperties) {
+			p.Sentinel = true
+		})
+	}
 
-	err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-	}, RedisServer.MakeHandler())
+	tcpConfig := &tcp.Config{
+		Addresses: bindAddresses(config.Properties().Port),
+	}
+	if config.Properties().TLSPort > 0 {
+		tlsConfig, err := tcp.MakeTLSConfig(&tcp.TLSSettings{
+			CertFile:    config.Properties().TLSCertFile,
+			KeyFile:     config.Properties().TLSKeyFile,
+			CACertFile:  config.Properties().TLSCACertFile,
+			AuthClients: config.Properties().TLSAuthClients,
+		})
+		if err != nil {
+			logger.Error("load tls certificates failed: " + err.Error())
+			return
+		}
+		tcpConfig.TLSAddresses = bindAddresses(config.Properties().TLSPort)
+		tcpConfig.TLSConfig = tlsConfig
+		if config.Properties().Port == 0 {
+			tcpConfig.Addresses = nil
+		}
+	}
+	server, err := tcp.Listen(tcpConfig)
 	if err != nil {
 		logger.Error(err)
+		return
+	}
+	if config.Properties().Port == 0 && len(tcpConfig.Addresses) > 0 {
+		// port chosen by system is announced to master and other nodes
+		config.Update(func(p *config.ServerProperties) {
+			p.Port = server.Port()
+		})
+		logger.Info(fmt.Sprintf("port 0 is configured, listening on port %d", server.Port()))
+	}
+	server.ServeWithSignal(RedisServer.MakeHandler())
+}
+
+// bindAddresses returns addresses of all hosts in bind with port, hosts are separated by spaces.
+// It listens on all interfaces if bind is not set
+func bindAddresses(port int) []string {
+	hosts := strings.Fields(config.Properties().Bind)
+	if len(hosts) == 0 {
+		return []string{net.JoinHostPort("", strconv.Itoa(port))}
+	}
+	var addresses []string
+	for _, host := range hosts {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(port)))
 	}
+	return addresses
 }
@@ -2,21 +2,35 @@ package pubsub
 
 import (
 	"github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/datastruct/lock"
+	"github.com/hdt3213/godis/lib/wildcard"
 )
 
 // Hub stores all subscribe relations
 type Hub struct {
 	// channel -> list(*Client)
 	subs dict.Dict
-	// lock channel
+	// pattern -> *patternSubscribers
+	psubs dict.Dict
+	// shard channel -> list(*Client)
+	ssubs dict.Dict
+	// lock channel and pattern
 	subsLocker *lock.Locks
 }
 
+// patternSubscribers stores the compiled pattern along with its subscribers
+type patternSubscribers struct {
+	pattern     *wildcard.Pattern
+	subscribers *list.LinkedList
+}
+
 // MakeHub creates new hub
 func MakeHub() *Hub {
 	return &Hub{
 		subs:       dict.MakeConcurrent(4),
+		psubs:      dict.MakeConcurrent(4),
+		ssubs:      dict.MakeConcurrent(4),
 		subsLocker: lock.Make(16),
 	}
 }
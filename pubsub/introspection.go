@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/wildcard"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+)
+
+var pubSubHelp = []string{
+	"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions(default: no channels).",
+	"SHARDCHANNELS [<pattern>]",
+	"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+	"SHARDNUMSUB [<shardchannel> ...]",
+	"    Return the number of subscribers for the specified shard level channel(s)",
+	"HELP",
+	"    Print this help.",
+}
+
+// PubSub inspects the state of subscriptions
+// usage: PUBSUB CHANNELS [pattern] | NUMSUB [channel [channel ...]] | NUMPAT |
+// SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel [shardchannel ...]]
+func PubSub(hub *Hub, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("pubsub")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "help":
+		lines := make([][]byte, len(pubSubHelp))
+		for i, line := range pubSubHelp {
+			lines[i] = []byte(line)
+		}
+		return protocol.MakeMultiBulkReply(lines)
+	case "channels":
+		if len(args) > 2 {
+			return protocol.MakeArgNumErrReply("pubsub|channels")
+		}
+		return pubSubChannels(hub.subs, args[1:])
+	case "numsub":
+		return pubSubNumSub(hub, hub.subs, args[1:])
+	case "shardchannels":
+		if len(args) > 2 {
+			return protocol.MakeArgNumErrReply("pubsub|shardchannels")
+		}
+		return pubSubChannels(hub.ssubs, args[1:])
+	case "shardnumsub":
+		return pubSubNumSub(hub, hub.ssubs, args[1:])
+	case "numpat":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("pubsub|numpat")
+		}
+		return protocol.MakeIntReply(int64(hub.psubs.Len()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try PUBSUB HELP.")
+}
+
+// pubSubChannels returns channels having at least one subscriber, pattern subscriptions are not counted
+func pubSubChannels(subs dict.Dict, args [][]byte) redis.Reply {
+	var pattern *wildcard.Pattern
+	if len(args) == 1 {
+		var err error
+		pattern, err = wildcard.CompilePattern(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal wildcard")
+		}
+	}
+	channels := make([][]byte, 0)
+	subs.ForEach(func(channel string, val interface{}) bool {
+		if pattern == nil || pattern.IsMatch(channel) {
+			channels = append(channels, []byte(channel))
+		}
+		return true
+	})
+	return protocol.MakeMultiBulkReply(channels)
+}
+
+// pubSubNumSub returns channels and their number of subscribers in pairs
+func pubSubNumSub(hub *Hub, subs dict.Dict, args [][]byte) redis.Reply {
+	channels := make([]string, len(args))
+	for i, b := range args {
+		channels[i] = string(b)
+	}
+	hub.subsLocker.RLocks(channels...)
+	defer hub.subsLocker.RUnLocks(channels...)
+
+	replies := make([]redis.Reply, 0, len(channels)*2)
+	for _, channel := range channels {
+		var count int64
+		if raw, ok := subs.Get(channel); ok {
+			subscribers, _ := raw.(*list.LinkedList)
+			count = int64(subscribers.Len())
+		}
+		replies = append(replies, protocol.MakeBulkReply([]byte(channel)), protocol.MakeIntReply(count))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
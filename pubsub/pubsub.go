@@ -1,41 +1,75 @@
 package pubsub
 
 import (
+	"github.com/hdt3213/godis/datastruct/dict"
 	"github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/lib/wildcard"
 	"github.com/hdt3213/godis/redis/protocol"
-	"strconv"
 )
 
 var (
-	_subscribe         = "subscribe"
-	_unsubscribe       = "unsubscribe"
-	messageBytes       = []byte("message")
-	unSubscribeNothing = []byte("*3\r\n$11\r\nunsubscribe\r\n$-1\n:0\r\n")
+	_subscribe    = "subscribe"
+	_unsubscribe  = "unsubscribe"
+	_psubscribe   = "psubscribe"
+	_punsubscribe = "punsubscribe"
+	messageBytes  = []byte("message")
+	pmessageBytes = []byte("pmessage")
 )
 
-func makeMsg(t string, channel string, code int64) []byte {
-	return []byte("*3\r\n$" + strconv.FormatInt(int64(len(t)), 10) + protocol.CRLF + t + protocol.CRLF +
-		"$" + strconv.FormatInt(int64(len(channel)), 10) + protocol.CRLF + channel + protocol.CRLF +
-		":" + strconv.FormatInt(code, 10) + protocol.CRLF)
+// makeMsg makes confirmation of subscribing or unsubscribing, it is a push frame for RESP3 client.
+// Channel is nil if client unsubscribes while subscribing nothing
+func makeMsg(c redis.Connection, t string, channel []byte, code int64) []byte {
+	return protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(t)),
+		protocol.MakeBulkReply(channel),
+		protocol.MakeIntReply(code),
+	}, c.GetProtocol() == 3).ToBytes()
+}
+
+// pushMessage is pushed to many subscribers, it is encoded once for each protocol
+type pushMessage struct {
+	args  [][]byte
+	resp2 []byte
+	resp3 []byte
+}
+
+// bytes returns message encoded for the protocol of c, RESP3 client receives it as a push frame
+// so that it won't be taken as reply of a command
+func (m *pushMessage) bytes(c redis.Connection) []byte {
+	if c.GetProtocol() == 3 {
+		if m.resp3 == nil {
+			m.resp3 = protocol.MakePushReply(bulks(m.args), true).ToBytes()
+		}
+		return m.resp3
+	}
+	if m.resp2 == nil {
+		m.resp2 = protocol.MakeMultiBulkReply(m.args).ToBytes()
+	}
+	return m.resp2
+}
+
+func bulks(args [][]byte) []redis.Reply {
+	replies := make([]redis.Reply, len(args))
+	for i, arg := range args {
+		replies[i] = protocol.MakeBulkReply(arg)
+	}
+	return replies
 }
 
 /*
  * invoker should lock channel
  * return: is new subscribed
  */
-func subscribe0(hub *Hub, channel string, client redis.Connection) bool {
-	client.Subscribe(channel)
-
-	// add into hub.subs
-	raw, ok := hub.subs.Get(channel)
+func addSubscriber(subs dict.Dict, channel string, client redis.Connection) bool {
+	raw, ok := subs.Get(channel)
 	var subscribers *list.LinkedList
 	if ok {
 		subscribers, _ = raw.(*list.LinkedList)
 	} else {
 		subscribers = list.Make()
-		hub.subs.Put(channel, subscribers)
+		subs.Put(channel, subscribers)
 	}
 	if subscribers.Contains(func(a interface{}) bool {
 		return a == client
@@ -50,11 +84,8 @@ func subscribe0(hub *Hub, channel string, client redis.Connection) bool {
  * invoker should lock channel
  * return: is actually un-subscribe
  */
-func unsubscribe0(hub *Hub, channel string, client redis.Connection) bool {
-	client.UnSubscribe(channel)
-
-	// remove from hub.subs
-	raw, ok := hub.subs.Get(channel)
+func removeSubscriber(subs dict.Dict, channel string, client redis.Connection) bool {
+	raw, ok := subs.Get(channel)
 	if ok {
 		subscribers, _ := raw.(*list.LinkedList)
 		subscribers.RemoveAllByVal(func(a interface{}) bool {
@@ -63,7 +94,81 @@ func unsubscribe0(hub *Hub, channel string, client redis.Connection) bool {
 
 		if subscribers.Len() == 0 {
 			// clean
-			hub.subs.Remove(channel)
+			subs.Remove(channel)
+		}
+		return true
+	}
+	return false
+}
+
+// sendToSubscribers writes msg to all subscribers of the given channel, returns the number of receivers
+func sendToSubscribers(subs dict.Dict, channel string, msg *pushMessage) int64 {
+	raw, ok := subs.Get(channel)
+	if !ok {
+		return 0
+	}
+	subscribers, _ := raw.(*list.LinkedList)
+	subscribers.ForEach(func(i int, c interface{}) bool {
+		client, _ := c.(redis.Connection)
+		_ = client.Write(msg.bytes(client))
+		return true
+	})
+	return int64(subscribers.Len())
+}
+
+func subscribe0(hub *Hub, channel string, client redis.Connection) bool {
+	client.Subscribe(channel)
+	return addSubscriber(hub.subs, channel, client)
+}
+
+func unsubscribe0(hub *Hub, channel string, client redis.Connection) bool {
+	client.UnSubscribe(channel)
+	return removeSubscriber(hub.subs, channel, client)
+}
+
+/*
+ * invoker should lock pattern
+ * return: is new subscribed
+ */
+func psubscribe0(hub *Hub, pattern *wildcard.Pattern, src string, client redis.Connection) bool {
+	client.PSubscribe(src)
+
+	raw, ok := hub.psubs.Get(src)
+	var entry *patternSubscribers
+	if ok {
+		entry, _ = raw.(*patternSubscribers)
+	} else {
+		entry = &patternSubscribers{
+			pattern:     pattern,
+			subscribers: list.Make(),
+		}
+		hub.psubs.Put(src, entry)
+	}
+	if entry.subscribers.Contains(func(a interface{}) bool {
+		return a == client
+	}) {
+		return false
+	}
+	entry.subscribers.Add(client)
+	return true
+}
+
+/*
+ * invoker should lock pattern
+ * return: is actually un-subscribe
+ */
+func punsubscribe0(hub *Hub, pattern string, client redis.Connection) bool {
+	client.PUnSubscribe(pattern)
+
+	raw, ok := hub.psubs.Get(pattern)
+	if ok {
+		entry, _ := raw.(*patternSubscribers)
+		entry.subscribers.RemoveAllByVal(func(a interface{}) bool {
+			return utils.Equals(a, client)
+		})
+
+		if entry.subscribers.Len() == 0 {
+			hub.psubs.Remove(pattern)
 		}
 		return true
 	}
@@ -82,23 +187,58 @@ func Subscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
 
 	for _, channel := range channels {
 		if subscribe0(hub, channel, c) {
-			_ = c.Write(makeMsg(_subscribe, channel, int64(c.SubsCount())))
+			_ = c.Write(makeMsg(c, _subscribe, []byte(channel), int64(c.SubsCount())))
 		}
 	}
 	return &protocol.NoReply{}
 }
 
-// UnsubscribeAll removes the given connection from all subscribing channel
+// PSubscribe puts the given connection into subscribers of the given glob-style patterns
+func PSubscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
+	patterns := make([]string, len(args))
+	compiled := make([]*wildcard.Pattern, len(args))
+	for i, b := range args {
+		patterns[i] = string(b)
+		p, err := wildcard.CompilePattern(patterns[i])
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal wildcard")
+		}
+		compiled[i] = p
+	}
+
+	hub.subsLocker.Locks(patterns...)
+	defer hub.subsLocker.UnLocks(patterns...)
+
+	for i, pattern := range patterns {
+		if psubscribe0(hub, compiled[i], pattern, c) {
+			_ = c.Write(makeMsg(c, _psubscribe, []byte(pattern), int64(c.SubsCount())))
+		}
+	}
+	return &protocol.NoReply{}
+}
+
+// UnsubscribeAll removes the given connection from all subscribing channel, pattern and shard channel
 func UnsubscribeAll(hub *Hub, c redis.Connection) {
 	channels := c.GetChannels()
+	patterns := c.GetPatterns()
+	shardChannels := c.GetShardChannels()
+	keys := make([]string, 0, len(channels)+len(patterns)+len(shardChannels))
+	keys = append(keys, channels...)
+	keys = append(keys, patterns...)
+	keys = append(keys, shardChannels...)
 
-	hub.subsLocker.Locks(channels...)
-	defer hub.subsLocker.UnLocks(channels...)
+	hub.subsLocker.Locks(keys...)
+	defer hub.subsLocker.UnLocks(keys...)
 
 	for _, channel := range channels {
 		unsubscribe0(hub, channel, c)
 	}
-
+	for _, pattern := range patterns {
+		punsubscribe0(hub, pattern, c)
+	}
+	for _, channel := range shardChannels {
+		sunsubscribe0(hub, channel, c)
+	}
 }
 
 // UnSubscribe removes the given connection from the given channel
@@ -117,19 +257,47 @@ func UnSubscribe(db *Hub, c redis.Connection, args [][]byte) redis.Reply {
 	defer db.subsLocker.UnLocks(channels...)
 
 	if len(channels) == 0 {
-		_ = c.Write(unSubscribeNothing)
+		_ = c.Write(makeMsg(c, _unsubscribe, nil, 0))
 		return &protocol.NoReply{}
 	}
 
 	for _, channel := range channels {
 		if unsubscribe0(db, channel, c) {
-			_ = c.Write(makeMsg(_unsubscribe, channel, int64(c.SubsCount())))
+			_ = c.Write(makeMsg(c, _unsubscribe, []byte(channel), int64(c.SubsCount())))
 		}
 	}
 	return &protocol.NoReply{}
 }
 
-// Publish send msg to all subscribing client
+// PUnSubscribe removes the given connection from subscribers of the given patterns, or all patterns if no one is given
+func PUnSubscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
+	var patterns []string
+	if len(args) > 0 {
+		patterns = make([]string, len(args))
+		for i, b := range args {
+			patterns[i] = string(b)
+		}
+	} else {
+		patterns = c.GetPatterns()
+	}
+
+	hub.subsLocker.Locks(patterns...)
+	defer hub.subsLocker.UnLocks(patterns...)
+
+	if len(patterns) == 0 {
+		_ = c.Write(makeMsg(c, _punsubscribe, nil, 0))
+		return &protocol.NoReply{}
+	}
+
+	for _, pattern := range patterns {
+		if punsubscribe0(hub, pattern, c) {
+			_ = c.Write(makeMsg(c, _punsubscribe, []byte(pattern), int64(c.SubsCount())))
+		}
+	}
+	return &protocol.NoReply{}
+}
+
+// Publish send msg to all clients subscribing the channel or a matching pattern
 func Publish(hub *Hub, args [][]byte) redis.Reply {
 	if len(args) != 2 {
 		return &protocol.ArgNumErrReply{Cmd: "publish"}
@@ -137,22 +305,29 @@ func Publish(hub *Hub, args [][]byte) redis.Reply {
 	channel := string(args[0])
 	message := args[1]
 
-	hub.subsLocker.Lock(channel)
-	defer hub.subsLocker.UnLock(channel)
+	patterns := hub.psubs.Keys()
+	keys := append([]string{channel}, patterns...)
+	hub.subsLocker.Locks(keys...)
+	defer hub.subsLocker.UnLocks(keys...)
 
-	raw, ok := hub.subs.Get(channel)
-	if !ok {
-		return protocol.MakeIntReply(0)
+	msg := &pushMessage{args: [][]byte{messageBytes, []byte(channel), message}}
+	count := sendToSubscribers(hub.subs, channel, msg)
+	for _, pattern := range patterns {
+		raw, ok := hub.psubs.Get(pattern)
+		if !ok {
+			continue // unsubscribed before locked
+		}
+		entry, _ := raw.(*patternSubscribers)
+		if !entry.pattern.IsMatch(channel) {
+			continue
+		}
+		pmsg := &pushMessage{args: [][]byte{pmessageBytes, []byte(pattern), []byte(channel), message}}
+		entry.subscribers.ForEach(func(i int, c interface{}) bool {
+			client, _ := c.(redis.Connection)
+			_ = client.Write(pmsg.bytes(client))
+			return true
+		})
+		count += int64(entry.subscribers.Len())
 	}
-	subscribers, _ := raw.(*list.LinkedList)
-	subscribers.ForEach(func(i int, c interface{}) bool {
-		client, _ := c.(redis.Connection)
-		replyArgs := make([][]byte, 3)
-		replyArgs[0] = messageBytes
-		replyArgs[1] = []byte(channel)
-		replyArgs[2] = message
-		_ = client.Write(protocol.MakeMultiBulkReply(replyArgs).ToBytes())
-		return true
-	})
-	return protocol.MakeIntReply(int64(subscribers.Len()))
+	return protocol.MakeIntReply(count)
 }
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+)
+
+// Shard channels are independent of normal channels: a message published by SPUBLISH is only delivered to
+// SSUBSCRIBE clients of the same node. In cluster mode the node owning a shard channel handles all of its
+// subscriptions and messages, so publishing needn't be broadcast to every node.
+
+var (
+	_ssubscribe   = "ssubscribe"
+	_sunsubscribe = "sunsubscribe"
+	smessageBytes = []byte("smessage")
+)
+
+func ssubscribe0(hub *Hub, channel string, client redis.Connection) bool {
+	client.SSubscribe(channel)
+	return addSubscriber(hub.ssubs, channel, client)
+}
+
+func sunsubscribe0(hub *Hub, channel string, client redis.Connection) bool {
+	client.SUnSubscribe(channel)
+	return removeSubscriber(hub.ssubs, channel, client)
+}
+
+// SSubscribe puts the given connection into subscribers of the given shard channels
+func SSubscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
+	channels := make([]string, len(args))
+	for i, b := range args {
+		channels[i] = string(b)
+	}
+
+	hub.subsLocker.Locks(channels...)
+	defer hub.subsLocker.UnLocks(channels...)
+
+	for _, channel := range channels {
+		if ssubscribe0(hub, channel, c) {
+			_ = c.Write(makeMsg(c, _ssubscribe, []byte(channel), int64(len(c.GetShardChannels()))))
+		}
+	}
+	return &protocol.NoReply{}
+}
+
+// SUnSubscribe removes the given connection from subscribers of the given shard channels, or all shard channels if no one is given
+func SUnSubscribe(hub *Hub, c redis.Connection, args [][]byte) redis.Reply {
+	var channels []string
+	if len(args) > 0 {
+		channels = make([]string, len(args))
+		for i, b := range args {
+			channels[i] = string(b)
+		}
+	} else {
+		channels = c.GetShardChannels()
+	}
+
+	hub.subsLocker.Locks(channels...)
+	defer hub.subsLocker.UnLocks(channels...)
+
+	if len(channels) == 0 {
+		_ = c.Write(makeMsg(c, _sunsubscribe, nil, 0))
+		return &protocol.NoReply{}
+	}
+
+	for _, channel := range channels {
+		if sunsubscribe0(hub, channel, c) {
+			_ = c.Write(makeMsg(c, _sunsubscribe, []byte(channel), int64(len(c.GetShardChannels()))))
+		}
+	}
+	return &protocol.NoReply{}
+}
+
+// SPublish sends msg to all clients subscribing the shard channel, pattern subscriptions are not matched
+func SPublish(hub *Hub, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return &protocol.ArgNumErrReply{Cmd: "spublish"}
+	}
+	channel := string(args[0])
+
+	hub.subsLocker.Lock(channel)
+	defer hub.subsLocker.UnLock(channel)
+
+	msg := &pushMessage{args: [][]byte{smessageBytes, []byte(channel), args[1]}}
+	return protocol.MakeIntReply(sendToSubscribers(hub.ssubs, channel, msg))
+}
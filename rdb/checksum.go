@@ -0,0 +1,134 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strconv"
+)
+
+const (
+	// header is the magic header with rdb version. Encoder writes an older version, though objects are encoded
+	// in newer formats like ziplist and quicklist, so it is replaced to be accepted by tools checking version
+	header = "REDIS0009"
+	// legacyHeader is written by older versions of godis, which append a line feed after checksum
+	legacyHeader = "REDIS0003"
+	opCodeEOF    = 0xff
+	footerSize   = 1 + 8 // EOF opcode and checksum
+)
+
+// jonesTable is the table of crc64 with Jones polynomial used by redis, in reversed form like crc64.ISO
+var jonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// checksum computes crc64 of redis, which neither inverts initial value nor final value unlike crc64 package
+type checksum struct {
+	crc uint64
+}
+
+func (c *checksum) Write(p []byte) (int, error) {
+	c.crc = ^crc64.Update(^c.crc, jonesTable, p)
+	return len(p), nil
+}
+
+// checksumWriter computes checksum of bytes written into w, the first discard bytes are dropped
+type checksumWriter struct {
+	w       io.Writer
+	sum     checksum
+	discard int
+	// zero checksum is written if disabled, like redis with rdbchecksum no
+	disabled bool
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if cw.discard > 0 {
+		skipped := cw.discard
+		if skipped > len(p) {
+			skipped = len(p)
+		}
+		cw.discard -= skipped
+		p = p[skipped:]
+	}
+	_, _ = cw.sum.Write(p)
+	if _, err := cw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeFooter writes EOF opcode and checksum of all bytes before it in little endian, like redis
+func (cw *checksumWriter) writeFooter() error {
+	if _, err := cw.Write([]byte{opCodeEOF}); err != nil {
+		return err
+	}
+	footer := make([]byte, 8)
+	if !cw.disabled {
+		binary.LittleEndian.PutUint64(footer, cw.sum.crc)
+	}
+	_, err := cw.w.Write(footer)
+	return err
+}
+
+// VerifyChecksum checks the checksum at the end of rdb of the given size, it is skipped if not enabled.
+// Rdb before version 5 has no checksum. Zero checksum means it was not computed, which is accepted only in
+// version 5, since later versions of redis write it only if rdbchecksum is disabled.
+// Rdb saved by older versions of godis is not verified, since its checksum is another crc64 followed by a line feed
+func VerifyChecksum(r io.ReaderAt, size int64, enabled bool) error {
+	if size < int64(len(header)+1) {
+		return errors.New("rdb is too short")
+	}
+	head := make([]byte, len(header))
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return err
+	}
+	if string(head[:5]) != "REDIS" {
+		return errors.New("wrong signature of rdb")
+	}
+	version, err := strconv.Atoi(string(head[5:]))
+	if err != nil {
+		return errors.New("wrong version of rdb: " + string(head[5:]))
+	}
+	if version < 5 {
+		last := make([]byte, 1)
+		if _, err := r.ReadAt(last, size-1); err != nil {
+			return err
+		}
+		if string(head) == legacyHeader && last[0] == '\n' {
+			return nil
+		}
+		if last[0] != opCodeEOF {
+			return errors.New("rdb is truncated, EOF opcode not found at the end")
+		}
+		return nil
+	}
+	if size < int64(len(header)+footerSize) {
+		return errors.New("rdb is too short")
+	}
+	footer := make([]byte, footerSize)
+	if _, err := r.ReadAt(footer, size-int64(len(footer))); err != nil {
+		return err
+	}
+	if footer[0] != opCodeEOF {
+		return errors.New("rdb is truncated, EOF opcode not found before checksum")
+	}
+	expected := binary.LittleEndian.Uint64(footer[1:])
+	if !enabled {
+		return nil
+	}
+	if expected == 0 {
+		if version == 5 {
+			return nil
+		}
+		return errors.New("rdb checksum is zero, it was saved with rdbchecksum disabled")
+	}
+	sum := &checksum{}
+	if _, err := io.Copy(sum, io.NewSectionReader(r, 0, size-8)); err != nil {
+		return err
+	}
+	if sum.crc != expected {
+		return fmt.Errorf("wrong rdb checksum, expected %016x, actually %016x", expected, sum.crc)
+	}
+	return nil
+}
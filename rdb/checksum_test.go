@@ -0,0 +1,111 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hdt3213/godis/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	// check value of crc64 used by redis, see crc64.c of redis
+	sum := &checksum{}
+	_, _ = sum.Write([]byte("123456789"))
+	if sum.crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expect crc64 e9c6d914c4b8d9ca, actually %016x", sum.crc)
+	}
+	// test.rdb is saved by redis
+	file, err := os.Open(filepath.Join("..", "test.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyChecksum(file, info.Size(), true); err != nil {
+		t.Errorf("expect checksum of rdb saved by redis verified, actually %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf, makeMockSource(), 3); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if string(data[:len(header)]) != header {
+		t.Errorf("expect header %s, actually %s", header, data[:len(header)])
+	}
+	if data[len(data)-footerSize] != opCodeEOF {
+		t.Error("expect rdb ends with EOF opcode and checksum")
+	}
+	sum = &checksum{}
+	_, _ = sum.Write(data[:len(data)-8])
+	if binary.LittleEndian.Uint64(data[len(data)-8:]) != sum.crc {
+		t.Error("expect checksum of all bytes before it")
+	}
+	if err := VerifyChecksum(bytes.NewReader(data), int64(len(data)), true); err != nil {
+		t.Error(err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(header)+1] ^= 0xff
+	if err := VerifyChecksum(bytes.NewReader(corrupted), int64(len(corrupted)), true); err == nil {
+		t.Error("expect error for corrupted rdb")
+	}
+	truncated := data[:len(data)-1]
+	if err := VerifyChecksum(bytes.NewReader(truncated), int64(len(truncated)), true); err == nil {
+		t.Error("expect error for truncated rdb")
+	}
+
+	// zero checksum is accepted only if checksum is disabled or rdb version is 5
+	zero := append([]byte{}, corrupted...)
+	copy(zero[len(zero)-8:], make([]byte, 8))
+	if err := VerifyChecksum(bytes.NewReader(zero), int64(len(zero)), true); err == nil {
+		t.Error("expect error for zero checksum")
+	}
+	if err := VerifyChecksum(bytes.NewReader(zero), int64(len(zero)), false); err != nil {
+		t.Errorf("expect zero checksum accepted if checksum disabled, actually %v", err)
+	}
+	copy(zero, "REDIS0005")
+	if err := VerifyChecksum(bytes.NewReader(zero), int64(len(zero)), true); err != nil {
+		t.Errorf("expect zero checksum of version 5 accepted, actually %v", err)
+	}
+	// rdb before version 5 has no checksum
+	old := append([]byte("REDIS0004"), data[len(header):len(data)-8]...)
+	if err := VerifyChecksum(bytes.NewReader(old), int64(len(old)), true); err != nil {
+		t.Errorf("expect rdb without checksum accepted, actually %v", err)
+	}
+	// rdb saved by older versions ends with a line feed
+	legacy := append(append([]byte{}, corrupted...), '\n')
+	copy(legacy, legacyHeader)
+	if err := VerifyChecksum(bytes.NewReader(legacy), int64(len(legacy)), true); err != nil {
+		t.Errorf("expect rdb of older versions accepted, actually %v", err)
+	}
+}
+
+func TestChecksumDisabled(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.RDBChecksum = false
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.RDBChecksum = true
+		})
+	}()
+	buf := &bytes.Buffer{}
+	if err := Write(buf, makeMockSource(), 3); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if binary.LittleEndian.Uint64(data[len(data)-8:]) != 0 {
+		t.Error("expect zero checksum if rdbchecksum disabled")
+	}
+	if err := VerifyChecksum(bytes.NewReader(data), int64(len(data)), true); err == nil {
+		t.Error("expect zero checksum rejected if checksum enabled")
+	}
+}
@@ -0,0 +1,115 @@
+package rdb
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/datastruct/dict"
+	List "github.com/hdt3213/godis/datastruct/list"
+	HashSet "github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+)
+
+// ErrUnsupportedType means the data type of entity cannot be encoded into rdb
+var ErrUnsupportedType = errors.New("unsupported data type")
+
+// WriteEntity writes entity as a rdb object, it returns ErrUnsupportedType if entity cannot be encoded into rdb
+func WriteEntity(enc *encoder.Encoder, key string, entity *database.DataEntity, opts ...interface{}) error {
+	switch obj := entity.Data.(type) {
+	case []byte:
+		return enc.WriteStringObject(key, obj, opts...)
+	case List.List:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			vals = append(vals, bytes)
+			return true
+		})
+		return enc.WriteListObject(key, vals, opts...)
+	case *HashSet.Set:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(m string) bool {
+			vals = append(vals, []byte(m))
+			return true
+		})
+		return enc.WriteSetObject(key, vals, opts...)
+	case dict.Dict:
+		hash := make(map[string][]byte)
+		obj.ForEach(func(key string, val interface{}) bool {
+			bytes, _ := val.([]byte)
+			hash[key] = bytes
+			return true
+		})
+		return enc.WriteHashMapObject(key, hash, opts...)
+	case *SortedSet.SortedSet:
+		var entries []*model.ZSetEntry
+		obj.ForEach(int64(0), obj.Len(), true, func(element *SortedSet.Element) bool {
+			entries = append(entries, &model.ZSetEntry{
+				Member: element.Member,
+				Score:  element.Score,
+			})
+			return true
+		})
+		return enc.WriteZSetObject(key, entries, opts...)
+	default:
+		return ErrUnsupportedType
+	}
+}
+
+// Supports returns whether entity can be encoded into rdb
+func Supports(entity *database.DataEntity) bool {
+	switch entity.Data.(type) {
+	case []byte, List.List, *HashSet.Set, dict.Dict, *SortedSet.SortedSet:
+		return true
+	}
+	return false
+}
+
+// ToEntity converts object parsed from rdb into DataEntity, returns nil if the type is not supported
+func ToEntity(o model.RedisObject) *database.DataEntity {
+	switch o.GetType() {
+	case model.StringType:
+		str := o.(*model.StringObject)
+		return &database.DataEntity{
+			Data: str.Value,
+		}
+	case model.ListType:
+		listObj := o.(*model.ListObject)
+		list := List.NewQuickList()
+		for _, v := range listObj.Values {
+			list.Add(v)
+		}
+		return &database.DataEntity{
+			Data: list,
+		}
+	case model.SetType:
+		setObj := o.(*model.SetObject)
+		set := HashSet.Make()
+		for _, m := range setObj.Members {
+			set.Add(string(m))
+		}
+		return &database.DataEntity{
+			Data: set,
+		}
+	case model.HashType:
+		hashObj := o.(*model.HashObject)
+		hash := dict.MakeSimple()
+		for k, v := range hashObj.Hash {
+			hash.Put(k, v)
+		}
+		return &database.DataEntity{
+			Data: hash,
+		}
+	case model.ZSetType:
+		zsetObj := o.(*model.ZSetObject)
+		zSet := SortedSet.Make()
+		for _, e := range zsetObj.Entries {
+			zSet.Add(e.Member, e.Score)
+		}
+		return &database.DataEntity{
+			Data: zSet,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Package rdb saves snapshot of databases into rdb file and loads it
+package rdb
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/rdb/encoder"
+	"github.com/hdt3213/rdb/model"
+	"github.com/hdt3213/rdb/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Source is the databases to be saved
+type Source interface {
+	ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool)
+	GetDBSize(dbIndex int) (int, int)
+}
+
+// Write writes the first dbNum databases of src into w in rdb format.
+// Keys are dumped one by one through ForEach, so the snapshot may include modifications made during writing.
+// Writing fails if a key of type unsupported by rdb is found, such as stream, rather than losing it silently
+func Write(w io.Writer, src Source, dbNum int) error {
+	return write(w, src, dbNum, false, nil)
+}
+
+// WritePreamble writes databases as the rdb preamble of aof file, see Write
+func WritePreamble(w io.Writer, src Source, dbNum int) error {
+	return write(w, src, dbNum, true, nil)
+}
+
+// WriteWithAux writes databases with extra aux fields, such as repl-stream-db of full sync, see Write
+func WriteWithAux(w io.Writer, src Source, dbNum int, aux map[string]string) error {
+	return write(w, src, dbNum, false, aux)
+}
+
+func write(w io.Writer, src Source, dbNum int, preamble bool, aux map[string]string) error {
+	out := &checksumWriter{w: w, disabled: !config.Properties().RDBChecksum}
+	if _, err := out.Write([]byte(header)); err != nil {
+		return err
+	}
+	// checksum and header written by encoder are not compatible with redis, they are replaced by out
+	out.discard = len(header)
+	enc := encoder.NewEncoder(out).EnableCompress()
+	err := enc.WriteHeader()
+	if err != nil {
+		return err
+	}
+	auxMap := map[string]string{
+		"redis-ver":    "6.0.0",
+		"redis-bits":   "64",
+		"aof-preamble": "0",
+		"ctime":        strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if preamble {
+		auxMap["aof-preamble"] = "1"
+	}
+	for k, v := range aux {
+		auxMap[k] = v
+	}
+	for k, v := range auxMap {
+		err := enc.WriteAux(k, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < dbNum; i++ {
+		keyCount, ttlCount := src.GetDBSize(i)
+		if keyCount == 0 {
+			continue
+		}
+		// db header is written before the first supported key, encoder rejects a db without any key
+		headerWritten := false
+		src.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			if !Supports(entity) {
+				if preamble {
+					// aof rewriting writes it as commands after preamble
+					return true
+				}
+				err = fmt.Errorf("cannot save key %s of db %d: %v", key, i, ErrUnsupportedType)
+				return false
+			}
+			if !headerWritten {
+				err = enc.WriteDBHeader(uint(i), uint64(keyCount), uint64(ttlCount))
+				if err != nil {
+					return false
+				}
+				headerWritten = true
+			}
+			var opts []interface{}
+			if expiration != nil {
+				opts = append(opts, encoder.WithTTL(uint64(expiration.UnixNano()/1e6)))
+			}
+			err = WriteEntity(enc, key, entity, opts...)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return out.writeFooter()
+}
+
+// SaveFile writes databases into a temporary file and renames it to filename once finished,
+// so filename always holds a complete snapshot
+func SaveFile(filename string, src Source, dbNum int) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name()) // no effect after renamed
+	}()
+	err = Write(tmpFile, src, dbNum)
+	if err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// Load reads rdb from r and calls cb for each key, objects of unsupported types are skipped
+func Load(r io.Reader, cb func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool) error {
+	return LoadWithAux(r, cb, nil)
+}
+
+// LoadWithAux reads rdb like Load, and calls onAux for each aux field
+func LoadWithAux(r io.Reader, cb func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool,
+	onAux func(key, value string)) error {
+	dec := parser.NewDecoder(r)
+	if onAux != nil {
+		dec.WithSpecialOpCode()
+	}
+	return dec.Parse(func(o model.RedisObject) bool {
+		if aux, ok := o.(*model.AuxObject); ok {
+			if onAux != nil {
+				onAux(aux.Key, aux.Value)
+			}
+			return true
+		}
+		entity := ToEntity(o)
+		if entity == nil {
+			return true
+		}
+		return cb(o.GetDBIndex(), o.GetKey(), entity, o.GetExpiration())
+	})
+}
+
+// LoadFile reads rdb file after its checksum verified, see Load
+func LoadFile(filename string, cb func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = VerifyChecksum(file, info.Size(), config.Properties().RDBChecksum); err != nil {
+		return err
+	}
+	return Load(file, cb)
+}
@@ -0,0 +1,174 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/datastruct/dict"
+	List "github.com/hdt3213/godis/datastruct/list"
+	HashSet "github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type entry struct {
+	key        string
+	entity     *database.DataEntity
+	expiration *time.Time
+}
+
+// mockSource stores entries of each database in slice
+type mockSource [][]*entry
+
+func (src mockSource) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	for _, e := range src[dbIndex] {
+		if !cb(e.key, e.entity, e.expiration) {
+			return
+		}
+	}
+}
+
+func (src mockSource) GetDBSize(dbIndex int) (int, int) {
+	ttlCount := 0
+	for _, e := range src[dbIndex] {
+		if e.expiration != nil {
+			ttlCount++
+		}
+	}
+	return len(src[dbIndex]), ttlCount
+}
+
+func makeMockSource() mockSource {
+	list := List.NewQuickList()
+	list.Add([]byte("a"))
+	list.Add([]byte("b"))
+	set := HashSet.Make("a", "b")
+	hash := dict.MakeSimple()
+	hash.Put("f", []byte("v"))
+	zset := SortedSet.Make()
+	zset.Add("m", 1.5)
+	expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	return mockSource{
+		{
+			{key: "str", entity: &database.DataEntity{Data: []byte("v")}, expiration: &expiration},
+			{key: "list", entity: &database.DataEntity{Data: list}},
+		},
+		{},
+		{
+			{key: "set", entity: &database.DataEntity{Data: set}},
+			{key: "hash", entity: &database.DataEntity{Data: hash}},
+			{key: "zset", entity: &database.DataEntity{Data: zset}},
+		},
+	}
+}
+
+func TestWriteAndLoad(t *testing.T) {
+	src := makeMockSource()
+	buf := &bytes.Buffer{}
+	err := Write(buf, src, len(src))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	loaded := make(map[string]int)
+	err = Load(buf, func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+		loaded[key] = dbIndex
+		switch key {
+		case "str":
+			if string(entity.Data.([]byte)) != "v" || expiration == nil || !expiration.Equal(*src[0][0].expiration) {
+				t.Errorf("wrong string or expiration")
+			}
+		case "list":
+			if entity.Data.(List.List).Len() != 2 {
+				t.Errorf("wrong list")
+			}
+		case "set":
+			if !entity.Data.(*HashSet.Set).Has("b") {
+				t.Errorf("wrong set")
+			}
+		case "hash":
+			if v, _ := entity.Data.(dict.Dict).Get("f"); string(v.([]byte)) != "v" {
+				t.Errorf("wrong hash")
+			}
+		case "zset":
+			if e, _ := entity.Data.(*SortedSet.SortedSet).Get("m"); e.Score != 1.5 {
+				t.Errorf("wrong zset")
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[string]int{"str": 0, "list": 0, "set": 2, "hash": 2, "zset": 2}
+	if len(loaded) != len(expected) {
+		t.Errorf("expected %v, actually %v", expected, loaded)
+	}
+	for key, dbIndex := range expected {
+		if index, ok := loaded[key]; !ok || index != dbIndex {
+			t.Errorf("expected %s in db %d", key, dbIndex)
+		}
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "dump.rdb")
+	src := makeMockSource()
+	err := SaveFile(filename, src, len(src))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary file should be removed")
+	}
+	count := 0
+	err = LoadFile(filename, func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 5 {
+		t.Errorf("expected 5 keys, actually %d, err: %v", count, err)
+	}
+	err = LoadFile(filepath.Join(dir, "none.rdb"), nil)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, actually %v", err)
+	}
+}
+
+func TestWriteUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "dump.rdb")
+	src := makeMockSource()
+	src[1] = append(src[1], &entry{key: "unsupported", entity: &database.DataEntity{Data: 1}})
+	err := SaveFile(filename, src, len(src))
+	if err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected error of unsupported key, actually %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("no file should be left after failed saving")
+	}
+
+	// unsupported keys are written as commands after preamble
+	buf := &bytes.Buffer{}
+	err = WritePreamble(buf, src, len(src))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 0
+	err = Load(buf, func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+		count++
+		return true
+	})
+	if err != nil || count != 5 {
+		t.Errorf("expected 5 keys, actually %d, err: %v", count, err)
+	}
+}
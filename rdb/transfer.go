@@ -0,0 +1,93 @@
+package rdb
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// EOFMarkLen is the length of mark delimiting rdb streamed without length, the same as redis
+const EOFMarkLen = 40
+
+// Transfer writes rdb of databases into w as payload of full sync, w is usually the connection to slave.
+// If diskless, encoder writes rdb into a pipe which is copied to w directly. Length of rdb is unknown before
+// encoded, so it is delimited by a random mark: "$EOF:<mark>\r\n<rdb><mark>".
+// Otherwise, rdb is saved into a temp file in dir before sent with its length: "$<length>\r\n<rdb>".
+// aux fields are written into rdb, such as repl-stream-db
+func Transfer(w io.Writer, src Source, dbNum int, diskless bool, dir string, aux map[string]string) error {
+	if diskless {
+		return transferDiskless(w, src, dbNum, aux)
+	}
+	return transferFile(w, src, dbNum, dir, aux)
+}
+
+func transferDiskless(w io.Writer, src Source, dbNum int, aux map[string]string) error {
+	raw := make([]byte, EOFMarkLen/2)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	mark := []byte(hex.EncodeToString(raw))
+
+	reader, writer := io.Pipe()
+	go func() {
+		// encoding stops once copying failed and reader closed
+		buffered := bufio.NewWriter(writer)
+		err := WriteWithAux(buffered, src, dbNum, aux)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	defer func() {
+		_ = reader.Close()
+	}()
+	_, err = w.Write([]byte("$EOF:" + string(mark) + "\r\n"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(mark)
+	return err
+}
+
+func transferFile(w io.Writer, src Source, dbNum int, dir string, aux map[string]string) error {
+	tmpFile, err := ioutil.TempFile(dir, "temp-sync-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+	}()
+	buffered := bufio.NewWriter(tmpFile)
+	err = WriteWithAux(buffered, src, dbNum, aux)
+	if err != nil {
+		return err
+	}
+	err = buffered.Flush()
+	if err != nil {
+		return err
+	}
+	size, err := tmpFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("$" + strconv.FormatInt(size, 10) + "\r\n"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tmpFile)
+	return err
+}
@@ -0,0 +1,62 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	src := makeMockSource()
+	for _, diskless := range []bool{true, false} {
+		dir := t.TempDir()
+		buf := &bytes.Buffer{}
+		buf.WriteString("+FULLRESYNC 0123456789abcdef 0\r\n")
+		err := Transfer(buf, src, len(src), diskless, dir, map[string]string{"repl-stream-db": "1"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 0 {
+			t.Errorf("temporary file should be removed")
+		}
+		// commands follow rdb without CRLF
+		buf.WriteString("*1\r\n$4\r\nPING\r\n")
+		replies, err := parser.ParseBytes(buf.Bytes())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(replies) != 3 {
+			t.Errorf("expected 3 replies, actually %d", len(replies))
+			return
+		}
+		bulk, ok := replies[1].(*protocol.BulkReply)
+		if !ok {
+			t.Errorf("expected bulk reply, actually %s", replies[1].ToBytes())
+			return
+		}
+		count := 0
+		aux := make(map[string]string)
+		err = LoadWithAux(bytes.NewReader(bulk.Arg), func(dbIndex int, key string, entity *database.DataEntity, expiration *time.Time) bool {
+			count++
+			return true
+		}, func(key, value string) {
+			aux[key] = value
+		})
+		if err != nil || count != 5 {
+			t.Errorf("expected 5 keys, actually %d, err: %v", count, err)
+		}
+		if aux["repl-stream-db"] != "1" || aux["redis-bits"] != "64" {
+			t.Errorf("wrong aux fields: %v", aux)
+		}
+		if string(replies[2].ToBytes()) != "*1\r\n$4\r\nPING\r\n" {
+			t.Errorf("wrong command after rdb: %s", replies[2].ToBytes())
+		}
+	}
+}
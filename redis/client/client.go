@@ -31,26 +31,49 @@ type Client struct {
 
 	status  int32
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
+	// closing is locked by Close, so that requests passed status check are counted in working before Close waits
+	closing sync.RWMutex
+	// reading is the request whose replies are being read, it is only accessed by handleRead
+	reading *request
 }
 
-// request is a message sends to redis server
+// request is a message sends to redis server, it contains commands pipelined by a caller which are written together
+// so that commands of other callers won't be interleaved, replies are matched to requests by their order
 type request struct {
 	id        uint64
-	args      [][]byte
-	reply     redis.Reply
+	cmdLines  [][][]byte
+	replies   []redis.Reply
 	heartbeat bool
 	waiting   *wait.Wait
 	err       error
 }
 
 const (
-	chanSize = 256
-	maxWait  = 3 * time.Second
+	chanSize    = 256
+	maxWait     = 3 * time.Second
+	dialTimeout = 3 * time.Second
 )
 
+// errors replied by client itself instead of server, see IsClientErr
+const (
+	ErrClosed        = "client closed"
+	ErrTimeout       = "server time out"
+	ErrRequestFailed = "request failed"
+)
+
+// IsClientErr returns whether reply is an error of client itself, which means server is unreachable
+func IsClientErr(reply redis.Reply) bool {
+	errReply, ok := reply.(protocol.ErrorReply)
+	if !ok {
+		return false
+	}
+	msg := errReply.Error()
+	return msg == ErrClosed || msg == ErrTimeout || msg == ErrRequestFailed
+}
+
 // MakeClient creates a new client
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -74,13 +97,16 @@ func (client *Client) Start() {
 
 // Close stops asynchronous goroutines and close connection
 func (client *Client) Close() {
-	atomic.StoreInt32(&client.status, closed)
+	if atomic.SwapInt32(&client.status, closed) == closed {
+		// client has been closed after failed to reconnect
+		return
+	}
 	client.ticker.Stop()
-	// stop new request
-	close(client.pendingReqs)
-
-	// wait stop process
+	// wait for requests in flight, new requests are rejected by status
+	client.closing.Lock()
+	client.closing.Unlock()
 	client.working.Wait()
+	close(client.pendingReqs)
 
 	// clean
 	_ = client.conn.Close()
@@ -94,7 +120,7 @@ func (client *Client) reconnect() {
 	var conn net.Conn
 	for i := 0; i < 3; i++ {
 		var err error
-		conn, err = net.Dial("tcp", client.addr)
+		conn, err = net.DialTimeout("tcp", client.addr, dialTimeout)
 		if err != nil {
 			logger.Error("reconnect error: " + err.Error())
 			time.Sleep(time.Second)
@@ -109,6 +135,11 @@ func (client *Client) reconnect() {
 	}
 	client.conn = conn
 
+	if client.reading != nil {
+		client.reading.err = errors.New("connection closed")
+		client.reading.waiting.Done()
+		client.reading = nil
+	}
 	close(client.waitingReqs)
 	for req := range client.waitingReqs {
 		req.err = errors.New("connection closed")
@@ -133,47 +164,81 @@ func (client *Client) handleWrite() {
 
 // Send sends a request to redis server
 func (client *Client) Send(args [][]byte) redis.Reply {
-	if atomic.LoadInt32(&client.status) != running {
-		return protocol.MakeErrReply("client closed")
+	return client.Pipeline([][][]byte{args})[0]
+}
+
+// Pipeline sends commands to redis server together and returns their replies, commands sent by other goroutines
+// are not inserted among them, so they could depend on connection state set by previous ones such as SELECT
+func (client *Client) Pipeline(cmdLines [][][]byte) []redis.Reply {
+	if !client.begin() {
+		return makeErrReplies(len(cmdLines), ErrClosed)
 	}
+	defer client.working.Done()
 	request := &request{
-		args:      args,
+		cmdLines:  cmdLines,
 		heartbeat: false,
 		waiting:   &wait.Wait{},
 	}
 	request.waiting.Add(1)
-	client.working.Add(1)
-	defer client.working.Done()
 	client.pendingReqs <- request
 	timeout := request.waiting.WaitWithTimeout(maxWait)
 	if timeout {
-		return protocol.MakeErrReply("server time out")
+		return makeErrReplies(len(cmdLines), ErrTimeout)
 	}
 	if request.err != nil {
-		return protocol.MakeErrReply("request failed")
+		return makeErrReplies(len(cmdLines), ErrRequestFailed)
 	}
-	return request.reply
+	return request.replies
+}
+
+// begin counts a request in working, it returns false if client is closed, so that requests are never sent after
+// pendingReqs is closed
+func (client *Client) begin() bool {
+	client.closing.RLock()
+	defer client.closing.RUnlock()
+	if atomic.LoadInt32(&client.status) != running {
+		return false
+	}
+	client.working.Add(1)
+	return true
+}
+
+// Closed returns whether client is closed, client is closed once it failed to reconnect
+func (client *Client) Closed() bool {
+	return atomic.LoadInt32(&client.status) == closed
+}
+
+func makeErrReplies(n int, msg string) []redis.Reply {
+	replies := make([]redis.Reply, n)
+	for i := range replies {
+		replies[i] = protocol.MakeErrReply(msg)
+	}
+	return replies
 }
 
 func (client *Client) doHeartbeat() {
 	request := &request{
-		args:      [][]byte{[]byte("PING")},
+		cmdLines:  [][][]byte{{[]byte("PING")}},
 		heartbeat: true,
 		waiting:   &wait.Wait{},
 	}
-	request.waiting.Add(1)
-	client.working.Add(1)
+	if !client.begin() {
+		return
+	}
 	defer client.working.Done()
+	request.waiting.Add(1)
 	client.pendingReqs <- request
 	request.waiting.WaitWithTimeout(maxWait)
 }
 
 func (client *Client) doRequest(req *request) {
-	if req == nil || len(req.args) == 0 {
+	if req == nil || len(req.cmdLines) == 0 {
 		return
 	}
-	re := protocol.MakeMultiBulkReply(req.args)
-	bytes := re.ToBytes()
+	var bytes []byte
+	for _, args := range req.cmdLines {
+		bytes = append(bytes, protocol.MakeMultiBulkReply(args).ToBytes()...)
+	}
 	var err error
 	for i := 0; i < 3; i++ { // only retry, waiting for handleRead
 		_, err = client.conn.Write(bytes)
@@ -198,11 +263,18 @@ func (client *Client) finishRequest(reply redis.Reply) {
 			logger.Error(err)
 		}
 	}()
-	request := <-client.waitingReqs
+	if client.reading == nil {
+		client.reading = <-client.waitingReqs
+	}
+	request := client.reading
 	if request == nil {
 		return
 	}
-	request.reply = reply
+	request.replies = append(request.replies, reply)
+	if len(request.replies) < len(request.cmdLines) {
+		return
+	}
+	client.reading = nil
 	if request.waiting != nil {
 		request.waiting.Done()
 	}
@@ -3,8 +3,10 @@ package connection
 import (
 	"bytes"
 	"github.com/hdt3213/godis/lib/sync/wait"
+	"github.com/hdt3213/godis/lib/timewheel"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,9 +26,16 @@ type Connection struct {
 
 	// lock while server sending response
 	mu sync.Mutex
+	// writeMu serializes writes, so out-of-band messages written by other goroutines, such as published messages
+	// and invalidation messages, are never interleaved within a reply
+	writeMu sync.Mutex
 
 	// subscribing channels
 	subs map[string]bool
+	// subscribing patterns
+	psubs map[string]bool
+	// subscribing shard channels
+	ssubs map[string]bool
 
 	// password may be changed by CONFIG command during runtime, so store the password
 	password string
@@ -40,15 +49,69 @@ type Connection struct {
 	// selected db
 	selectedDB int
 	role       int32
+	// readOnly is set by READONLY and cleared by READWRITE
+	readOnly bool
+	// asking is set by ASKING and cleared by the next command
+	asking bool
+
+	// id is assigned lazily by GetID
+	id uint64
+	// protocol version, 0 means the default RESP2
+	protocol int
+
+	// lastInteraction is unix nano time of the latest command, and executing is 1 while executing a command
+	lastInteraction int64
+	executing       int32
+	closed          int32
+
+	// done is closed once the connection is closed or the client disconnected, it is made lazily by doneChan
+	done      chan struct{}
+	doneOnce  sync.Once
+	closeOnce sync.Once
 }
 
+// connection ids start from 1
+var idCounter uint64
+
 // RemoteAddr returns the remote network address
 func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Read reads requests of client, once reading fails the client is regarded as disconnected, see Done
+func (c *Connection) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if err != nil {
+		c.markDone()
+	}
+	return n, err
+}
+
+func (c *Connection) doneChan() chan struct{} {
+	c.doneOnce.Do(func() {
+		c.done = make(chan struct{})
+	})
+	return c.done
+}
+
+func (c *Connection) markDone() {
+	c.closeOnce.Do(func() {
+		close(c.doneChan())
+	})
+}
+
+// Done returns a channel closed once the connection is closed or the client disconnected,
+// so commands blocked on behalf of the client can stop waiting
+func (c *Connection) Done() <-chan struct{} {
+	return c.doneChan()
+}
+
 // Close disconnect with the client
 func (c *Connection) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		timewheel.Cancel(c.idleTaskKey())
+	}
+	c.markDone()
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
 	return nil
@@ -71,6 +134,8 @@ func (c *Connection) Write(b []byte) error {
 		c.waitingReply.Done()
 	}()
 
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	_, err := c.conn.Write(b)
 	return err
 }
@@ -97,13 +162,39 @@ func (c *Connection) UnSubscribe(channel string) {
 	delete(c.subs, channel)
 }
 
-// SubsCount returns the number of subscribing channels
+// PSubscribe add current connection into subscribers of the given pattern
+func (c *Connection) PSubscribe(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.psubs == nil {
+		c.psubs = make(map[string]bool)
+	}
+	c.psubs[pattern] = true
+}
+
+// PUnSubscribe removes current connection from subscribers of the given pattern
+func (c *Connection) PUnSubscribe(pattern string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.psubs) == 0 {
+		return
+	}
+	delete(c.psubs, pattern)
+}
+
+// SubsCount returns the number of subscribing channels and patterns
 func (c *Connection) SubsCount() int {
-	return len(c.subs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.subs) + len(c.psubs)
 }
 
 // GetChannels returns all subscribing channels
 func (c *Connection) GetChannels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.subs == nil {
 		return make([]string, 0)
 	}
@@ -116,6 +207,50 @@ func (c *Connection) GetChannels() []string {
 	return channels
 }
 
+// GetPatterns returns all subscribing patterns
+func (c *Connection) GetPatterns() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	patterns := make([]string, 0, len(c.psubs))
+	for pattern := range c.psubs {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// SSubscribe add current connection into subscribers of the given shard channel
+func (c *Connection) SSubscribe(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ssubs == nil {
+		c.ssubs = make(map[string]bool)
+	}
+	c.ssubs[channel] = true
+}
+
+// SUnSubscribe removes current connection from subscribers of the given shard channel
+func (c *Connection) SUnSubscribe(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.ssubs) == 0 {
+		return
+	}
+	delete(c.ssubs, channel)
+}
+
+// GetShardChannels returns all subscribing shard channels
+func (c *Connection) GetShardChannels() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	channels := make([]string, 0, len(c.ssubs))
+	for channel := range c.ssubs {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
 // SetPassword stores password for authentication
 func (c *Connection) SetPassword(password string) {
 	c.password = password
@@ -177,6 +312,32 @@ func (c *Connection) SetRole(r int32) {
 	c.role = r
 }
 
+// IsReadOnly returns whether the client accepts stale reads from replica
+func (c *Connection) IsReadOnly() bool {
+	if c == nil {
+		return false
+	}
+	return c.readOnly
+}
+
+// SetReadOnly is invoked by READONLY and READWRITE
+func (c *Connection) SetReadOnly(readOnly bool) {
+	c.readOnly = readOnly
+}
+
+// IsAsking returns whether the client has sent ASKING before the current command
+func (c *Connection) IsAsking() bool {
+	if c == nil {
+		return false
+	}
+	return c.asking
+}
+
+// SetAsking is invoked by ASKING, and the flag is cleared before executing the next command
+func (c *Connection) SetAsking(asking bool) {
+	c.asking = asking
+}
+
 // GetWatching returns watching keys and their version code when started watching
 func (c *Connection) GetWatching() map[string]uint32 {
 	if c.watching == nil {
@@ -185,6 +346,29 @@ func (c *Connection) GetWatching() map[string]uint32 {
 	return c.watching
 }
 
+// GetID returns unique id of connection
+func (c *Connection) GetID() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == 0 {
+		c.id = atomic.AddUint64(&idCounter, 1)
+	}
+	return c.id
+}
+
+// GetProtocol returns protocol version used by client
+func (c *Connection) GetProtocol() int {
+	if c.protocol == 0 {
+		return 2
+	}
+	return c.protocol
+}
+
+// SetProtocol changes protocol version used by client
+func (c *Connection) SetProtocol(protocol int) {
+	c.protocol = protocol
+}
+
 // GetDBIndex returns selected db
 func (c *Connection) GetDBIndex() int {
 	return c.selectedDB
@@ -216,3 +400,9 @@ func (c *FakeConn) Clean() {
 func (c *FakeConn) Bytes() []byte {
 	return c.buf.Bytes()
 }
+
+// Close marks the connection closed, there is no underlying connection
+func (c *FakeConn) Close() error {
+	c.markDone()
+	return nil
+}
@@ -0,0 +1,36 @@
+package connection
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSubscriptionsConcurrently(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := NewConn(conn)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			c.Subscribe("ch" + strconv.Itoa(i))
+			c.PSubscribe("p" + strconv.Itoa(i) + "*")
+			c.SSubscribe("s" + strconv.Itoa(i))
+		}(i)
+		go func() {
+			defer wg.Done()
+			_ = c.GetChannels()
+			_ = c.GetPatterns()
+			_ = c.GetShardChannels()
+			_ = c.SubsCount()
+		}()
+	}
+	wg.Wait()
+	if len(c.GetChannels()) != 100 || len(c.GetPatterns()) != 100 || len(c.GetShardChannels()) != 100 {
+		t.Errorf("expect 100 subscriptions of each kind, actually %d channels, %d patterns and %d shard channels",
+			len(c.GetChannels()), len(c.GetPatterns()), len(c.GetShardChannels()))
+	}
+}
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/timewheel"
+	"sync/atomic"
+	"time"
+)
+
+// idleCheckInterval is interval of checking again whether idle timeout is enabled while it is disabled,
+// so that timeout changed during runtime takes effect on existing connections
+const idleCheckInterval = 10 * time.Second
+
+// idleDisconnections counts connections closed for being idle longer than timeout
+var idleDisconnections int64
+
+// IdleDisconnections returns count of connections closed for being idle longer than timeout
+func IdleDisconnections() int64 {
+	return atomic.LoadInt64(&idleDisconnections)
+}
+
+// BeginCommand marks the connection executing a command, it is not idle until EndCommand
+func (c *Connection) BeginCommand() {
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixNano())
+	atomic.StoreInt32(&c.executing, 1)
+}
+
+// EndCommand marks the command finished
+func (c *Connection) EndCommand() {
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixNano())
+	atomic.StoreInt32(&c.executing, 0)
+}
+
+// IdleTime returns duration since the latest command, it is 0 while executing a command,
+// including blocking commands like BLPOP waiting for elements
+func (c *Connection) IdleTime() time.Duration {
+	if atomic.LoadInt32(&c.executing) == 1 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastInteraction)))
+}
+
+func (c *Connection) idleTaskKey() string {
+	return fmt.Sprintf("idle:%p", c)
+}
+
+// WatchIdle closes the connection once it has been idle longer than the duration returned by timeout,
+// 0 means no limit. Subscribers are never closed since they are waiting for messages
+func (c *Connection) WatchIdle(timeout func() time.Duration) {
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixNano())
+	c.checkIdle(timeout)
+}
+
+func (c *Connection) checkIdle(timeout func() time.Duration) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return
+	}
+	next := idleCheckInterval
+	if limit := timeout(); limit > 0 {
+		idle := c.IdleTime()
+		if idle < limit {
+			next = limit - idle
+		} else if c.SubsCount() > 0 || len(c.GetShardChannels()) > 0 {
+			next = limit
+		} else {
+			atomic.AddInt64(&idleDisconnections, 1)
+			logger.Info(fmt.Sprintf("closing idle client %s, idle for %s", c.RemoteAddr(), idle))
+			// server stops serving the client once reading from closed connection fails.
+			// Close waits for replies being written, so it is called in another goroutine to not block timewheel
+			go func() {
+				_ = c.Close()
+			}()
+			return
+		}
+	}
+	timewheel.Delay(next, c.idleTaskKey(), func() {
+		c.checkIdle(timeout)
+	})
+}
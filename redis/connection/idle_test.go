@@ -0,0 +1,51 @@
+package connection
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchIdle(t *testing.T) {
+	timeout := func() time.Duration {
+		return time.Second
+	}
+	idle, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	subscriber, subscriberPeer := net.Pipe()
+	defer subscriberPeer.Close()
+	blocked, blockedPeer := net.Pipe()
+	defer blockedPeer.Close()
+
+	idleConn := NewConn(idle)
+	subscriberConn := NewConn(subscriber)
+	subscriberConn.Subscribe("ch")
+	blockedConn := NewConn(blocked)
+	before := IdleDisconnections()
+	for _, c := range []*Connection{idleConn, subscriberConn, blockedConn} {
+		c.WatchIdle(timeout)
+	}
+	blockedConn.BeginCommand()
+	time.Sleep(3 * time.Second)
+
+	if atomic.LoadInt32(&idleConn.closed) != 1 {
+		t.Error("expect idle connection closed")
+	}
+	if atomic.LoadInt32(&subscriberConn.closed) == 1 {
+		t.Error("expect subscriber kept")
+	}
+	if atomic.LoadInt32(&blockedConn.closed) == 1 {
+		t.Error("expect connection executing command kept")
+	}
+	if IdleDisconnections()-before != 1 {
+		t.Errorf("expect 1 idle disconnection, actually %d", IdleDisconnections()-before)
+	}
+
+	blockedConn.EndCommand()
+	time.Sleep(3 * time.Second)
+	if atomic.LoadInt32(&blockedConn.closed) != 1 {
+		t.Error("expect connection closed once idle after command")
+	}
+	_ = subscriberConn.Close()
+}
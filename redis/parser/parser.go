@@ -19,10 +19,45 @@ type Payload struct {
 	Err  error
 }
 
+// Limits bounds size of requests, so abusive clients can't make server allocate unbounded memory.
+// Zero means no limit
+type Limits struct {
+	// MaxBulkLen is max length in bytes of a bulk string
+	MaxBulkLen int64
+	// MaxMultiBulkLen is max count of elements in an array
+	MaxMultiBulkLen int64
+	// MaxInlineLen is max length in bytes of a line, such as inline command and header of bulk string
+	MaxInlineLen int
+}
+
+// LimitError means request exceeds Limits, connection should be closed after replying it
+// since the rest of stream can't be parsed any more
+type LimitError struct {
+	Msg string
+}
+
+func (e *LimitError) Error() string {
+	return "ERR Protocol error: " + e.Msg
+}
+
+var (
+	errBulkLen      = &LimitError{Msg: "invalid bulk length"}
+	errMultiBulkLen = &LimitError{Msg: "invalid multibulk length"}
+	errInlineLen    = &LimitError{Msg: "too big inline request"}
+)
+
 // ParseStream reads data from io.Reader and send payloads through channel
 func ParseStream(reader io.Reader) <-chan *Payload {
+	return ParseStreamWithLimits(reader, nil)
+}
+
+// ParseStreamWithLimits is like ParseStream, but sends LimitError and stops once data exceeds limits
+func ParseStreamWithLimits(reader io.Reader, limits *Limits) <-chan *Payload {
+	if limits == nil {
+		limits = &Limits{}
+	}
 	ch := make(chan *Payload)
-	go parse0(reader, ch)
+	go parse0(reader, ch, limits)
 	return ch
 }
 
@@ -30,7 +65,7 @@ func ParseStream(reader io.Reader) <-chan *Payload {
 func ParseBytes(data []byte) ([]redis.Reply, error) {
 	ch := make(chan *Payload)
 	reader := bytes.NewReader(data)
-	go parse0(reader, ch)
+	go parse0(reader, ch, &Limits{})
 	var results []redis.Reply
 	for payload := range ch {
 		if payload == nil {
@@ -51,7 +86,7 @@ func ParseBytes(data []byte) ([]redis.Reply, error) {
 func ParseOne(data []byte) (redis.Reply, error) {
 	ch := make(chan *Payload)
 	reader := bytes.NewReader(data)
-	go parse0(reader, ch)
+	go parse0(reader, ch, &Limits{})
 	payload := <-ch // parse0 will close the channel
 	if payload == nil {
 		return nil, errors.New("no protocol")
@@ -59,7 +94,7 @@ func ParseOne(data []byte) (redis.Reply, error) {
 	return payload.Data, payload.Err
 }
 
-func parse0(rawReader io.Reader, ch chan<- *Payload) {
+func parse0(rawReader io.Reader, ch chan<- *Payload, limits *Limits) {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(err, string(debug.Stack()))
@@ -67,7 +102,7 @@ func parse0(rawReader io.Reader, ch chan<- *Payload) {
 	}()
 	reader := bufio.NewReader(rawReader)
 	for {
-		line, err := reader.ReadBytes('\n')
+		line, err := readLine(reader, limits)
 		if err != nil {
 			ch <- &Payload{Err: err}
 			close(ch)
@@ -108,14 +143,14 @@ func parse0(rawReader io.Reader, ch chan<- *Payload) {
 				Data: protocol.MakeIntReply(value),
 			}
 		case '$':
-			err = parseBulkString(line, reader, ch)
+			err = parseBulkString(line, reader, ch, limits)
 			if err != nil {
 				ch <- &Payload{Err: err}
 				close(ch)
 				return
 			}
 		case '*':
-			err = parseArray(line, reader, ch)
+			err = parseArray(line, reader, ch, limits)
 			if err != nil {
 				ch <- &Payload{Err: err}
 				close(ch)
@@ -130,32 +165,94 @@ func parse0(rawReader io.Reader, ch chan<- *Payload) {
 	}
 }
 
-func parseBulkString(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
+// readLine reads a line ending with '\n', it returns errInlineLen once the line is longer than MaxInlineLen
+func readLine(reader *bufio.Reader, limits *Limits) ([]byte, error) {
+	if limits.MaxInlineLen <= 0 {
+		return reader.ReadBytes('\n')
+	}
+	var line []byte
+	for {
+		frag, err := reader.ReadSlice('\n')
+		if len(line)+len(frag) > limits.MaxInlineLen {
+			return nil, errInlineLen
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func parseBulkString(header []byte, reader *bufio.Reader, ch chan<- *Payload, limits *Limits) error {
 	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
 	if err != nil || strLen < -1 {
 		protocolError(ch, "illegal bulk string header: "+string(header))
 		return nil
+	} else if limits.MaxBulkLen > 0 && strLen > limits.MaxBulkLen {
+		return errBulkLen
 	} else if strLen == -1 {
 		ch <- &Payload{
 			Data: protocol.MakeNullBulkReply(),
 		}
 		return nil
 	}
-	body := make([]byte, strLen+2)
-	_, err = io.ReadFull(reader, body)
+	body, err := readBulk(reader, strLen)
 	if err != nil {
 		return err
 	}
 	ch <- &Payload{
-		Data: protocol.MakeBulkReply(body[:len(body)-2]),
+		Data: protocol.MakeBulkReply(body),
 	}
 	return nil
 }
 
+const (
+	// bulkChunkSize is the most bytes allocated for a bulk string before its data arrives
+	bulkChunkSize = 64 * 1024
+	// arrayChunkSize is the most elements allocated for an array before its elements arrive
+	arrayChunkSize = 1024
+)
+
+// readBulk reads a bulk string of strLen bytes and the CRLF following it. Buffer grows as data is read,
+// so clients can't make server allocate memory by sending headers of huge bulk strings only
+func readBulk(reader io.Reader, strLen int64) ([]byte, error) {
+	total := strLen + 2
+	body := make([]byte, 0, capacity(total, bulkChunkSize))
+	for int64(len(body)) < total {
+		if len(body) == cap(body) {
+			body = append(body, 0)[:len(body)]
+		}
+		end := int64(cap(body))
+		if end > total {
+			end = total
+		}
+		n, err := io.ReadFull(reader, body[len(body):end])
+		body = body[:len(body)+n]
+		if err == io.EOF && len(body) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body[:strLen], nil
+}
+
+// capacity returns n if it is not greater than limit, so buffers allocated by length in header are bounded
+func capacity(n int64, limit int64) int64 {
+	if n > limit {
+		return limit
+	}
+	return n
+}
+
 // there is no CRLF between RDB and following AOF, therefore it needs to be treated differently
 func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
 	header, err := reader.ReadBytes('\n')
 	header = bytes.TrimSuffix(header, []byte{'\r', '\n'})
+	if bytes.HasPrefix(header, []byte("$EOF:")) {
+		return parseRDBWithMark(header[len("$EOF:"):], reader, ch)
+	}
 	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
 	if err != nil || strLen <= 0 {
 		return errors.New("illegal bulk header: " + string(header))
@@ -171,25 +268,66 @@ func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
 	return nil
 }
 
-func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
+// parseRDBWithMark reads RDB streamed by diskless sync, which is terminated by the mark in its header
+func parseRDBWithMark(mark []byte, reader *bufio.Reader, ch chan<- *Payload) error {
+	if len(mark) == 0 {
+		return errors.New("illegal rdb eof mark")
+	}
+	last := mark[len(mark)-1]
+	var body []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		body = append(body, b)
+		if b == last && bytes.HasSuffix(body, mark) {
+			break
+		}
+	}
+	ch <- &Payload{
+		Data: protocol.MakeBulkReply(body[:len(body)-len(mark)]),
+	}
+	return nil
+}
+
+func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload, limits *Limits) error {
 	nStrs, err := strconv.ParseInt(string(header[1:]), 10, 64)
 	if err != nil || nStrs < 0 {
 		protocolError(ch, "illegal array header "+string(header[1:]))
 		return nil
+	} else if limits.MaxMultiBulkLen > 0 && nStrs > limits.MaxMultiBulkLen {
+		return errMultiBulkLen
 	} else if nStrs == 0 {
 		ch <- &Payload{
 			Data: protocol.MakeEmptyMultiBulkReply(),
 		}
 		return nil
 	}
-	lines := make([][]byte, 0, nStrs)
+	lines := make([][]byte, 0, capacity(nStrs, arrayChunkSize))
+	// replies is used instead of lines once there is an element other than bulk string in reply of server
+	var replies []redis.Reply
 	for i := int64(0); i < nStrs; i++ {
 		var line []byte
-		line, err = reader.ReadBytes('\n')
+		line, err = readLine(reader, limits)
 		if err != nil {
 			return err
 		}
 		length := len(line)
+		if length >= 3 && line[length-2] == '\r' && (replies != nil || line[0] != '$') && isElementHeader(line[0]) {
+			if replies == nil {
+				replies = make([]redis.Reply, 0, capacity(nStrs, arrayChunkSize))
+				for _, l := range lines {
+					replies = append(replies, protocol.MakeBulkReply(l))
+				}
+			}
+			element, err := parseElement(line, reader, limits)
+			if err != nil {
+				return err
+			}
+			replies = append(replies, element)
+			continue
+		}
 		if length < 4 || line[length-2] != '\r' || line[0] != '$' {
 			protocolError(ch, "illegal bulk string header "+string(line))
 			break
@@ -199,24 +337,90 @@ func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 		if err != nil || strLen < -1 {
 			protocolError(ch, "illegal bulk string length "+string(line))
 			break
+		} else if limits.MaxBulkLen > 0 && strLen > limits.MaxBulkLen {
+			return errBulkLen
 		} else if strLen == -1 {
 			lines = append(lines, []byte{})
 		} else {
-			// +2 是指的\r\n
-			body := make([]byte, strLen+2)
-			_, err := io.ReadFull(reader, body)
+			body, err := readBulk(reader, strLen)
 			if err != nil {
 				return err
 			}
-			lines = append(lines, body[:len(body)-2])
+			lines = append(lines, body)
 		}
 	}
+	if replies != nil {
+		if int64(len(replies)) == nStrs {
+			ch <- &Payload{
+				Data: protocol.MakeMultiRawReply(replies),
+			}
+		}
+		return nil
+	}
 	ch <- &Payload{
 		Data: protocol.MakeMultiBulkReply(lines),
 	}
 	return nil
 }
 
+func isElementHeader(b byte) bool {
+	return b == '+' || b == '-' || b == ':' || b == '$' || b == '*'
+}
+
+// parseElement parses an element of array in reply of server, such as integer and nested array
+func parseElement(line []byte, reader *bufio.Reader, limits *Limits) (redis.Reply, error) {
+	line = bytes.TrimSuffix(line, []byte{'\r', '\n'})
+	switch line[0] {
+	case '+':
+		return protocol.MakeStatusReply(string(line[1:])), nil
+	case '-':
+		return protocol.MakeErrReply(string(line[1:])), nil
+	case ':':
+		value, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, errors.New("protocol error: illegal number " + string(line[1:]))
+		}
+		return protocol.MakeIntReply(value), nil
+	case '$':
+		strLen, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || strLen < -1 {
+			return nil, errors.New("protocol error: illegal bulk string header " + string(line))
+		} else if limits.MaxBulkLen > 0 && strLen > limits.MaxBulkLen {
+			return nil, errBulkLen
+		} else if strLen == -1 {
+			return protocol.MakeNullBulkReply(), nil
+		}
+		body, err := readBulk(reader, strLen)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.MakeBulkReply(body), nil
+	}
+	// nested array
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < 0 {
+		return nil, errors.New("protocol error: illegal array header " + string(line[1:]))
+	} else if limits.MaxMultiBulkLen > 0 && n > limits.MaxMultiBulkLen {
+		return nil, errMultiBulkLen
+	}
+	elements := make([]redis.Reply, 0, capacity(n, arrayChunkSize))
+	for i := int64(0); i < n; i++ {
+		elementLine, err := readLine(reader, limits)
+		if err != nil {
+			return nil, err
+		}
+		if len(elementLine) < 3 || elementLine[len(elementLine)-2] != '\r' || !isElementHeader(elementLine[0]) {
+			return nil, errors.New("protocol error: illegal array element " + string(elementLine))
+		}
+		element, err := parseElement(elementLine, reader, limits)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return protocol.MakeMultiRawReply(elements), nil
+}
+
 func protocolError(ch chan<- *Payload, msg string) {
 	err := errors.New("protocol error: " + msg)
 	ch <- &Payload{Err: err}
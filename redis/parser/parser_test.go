@@ -6,6 +6,8 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -21,6 +23,15 @@ func TestParseStream(t *testing.T) {
 			[]byte("\r\n"),
 		}),
 		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("subscribe")),
+			protocol.MakeIntReply(1),
+			protocol.MakeNullBulkReply(),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeStatusReply("OK"),
+				protocol.MakeErrReply("ERR unknown"),
+			}),
+		}),
 	}
 	reqs := bytes.Buffer{}
 	for _, re := range replies {
@@ -79,3 +90,60 @@ func TestParseOne(t *testing.T) {
 		}
 	}
 }
+
+func TestParseStreamWithLimits(t *testing.T) {
+	limits := &Limits{
+		MaxBulkLen:      8,
+		MaxMultiBulkLen: 4,
+		MaxInlineLen:    32,
+	}
+	ok := protocol.MakeMultiBulkReply([][]byte{[]byte("set"), []byte("a"), []byte("12345678")}).ToBytes()
+	cases := map[string]error{
+		"*2\r\n$3\r\nget\r\n$9\r\n123456789\r\n": errBulkLen,
+		"*5\r\n":                                 errMultiBulkLen,
+		"*1\r\n*5\r\n":                           errMultiBulkLen,
+		"set " + strings.Repeat("a", 32) + "\r\n": errInlineLen,
+		strings.Repeat("a", 8192):                 errInlineLen, // no line ending
+	}
+	for req, expected := range cases {
+		ch := ParseStreamWithLimits(bytes.NewReader(append(ok, req...)), limits)
+		payload := <-ch
+		if payload.Err != nil || !utils.BytesEquals(payload.Data.ToBytes(), ok) {
+			t.Errorf("expect %q to be parsed", string(ok))
+			continue
+		}
+		payload = <-ch
+		if payload.Err != expected {
+			t.Errorf("expect %v for %q, actually %v", expected, req, payload.Err)
+			continue
+		}
+		if _, open := <-ch; open {
+			t.Error("expect parser to stop")
+		}
+	}
+}
+
+func TestParseHugeBulkHeader(t *testing.T) {
+	limits := &Limits{MaxBulkLen: 512 * 1024 * 1024}
+	for _, req := range []string{"$536870912\r\n", "*2\r\n$3\r\nset\r\n$536870912\r\n"} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		payload := <-ParseStreamWithLimits(strings.NewReader(req), limits)
+		runtime.ReadMemStats(&after)
+		if payload.Err != io.ErrUnexpectedEOF && payload.Err != io.EOF {
+			t.Errorf("expect EOF for %q, actually %v", req, payload.Err)
+		}
+		// memory is allocated as data arrives instead of by length in header
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+			t.Errorf("expect header of %q not to allocate its length, actually %d bytes allocated", req, allocated)
+		}
+	}
+
+	// bulk strings longer than a chunk are still read completely
+	value := []byte(utils.RandString(3*bulkChunkSize + 5))
+	req := protocol.MakeMultiBulkReply([][]byte{[]byte("set"), []byte("a"), value}).ToBytes()
+	payload := <-ParseStreamWithLimits(bytes.NewReader(req), limits)
+	if payload.Err != nil || !utils.BytesEquals(payload.Data.ToBytes(), req) {
+		t.Errorf("expect %d bytes long value to be parsed, actually %v", len(value), payload.Err)
+	}
+}
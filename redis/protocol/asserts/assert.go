@@ -110,6 +110,18 @@ func AssertNullBulk(t *testing.T, result redis.Reply) {
 	}
 }
 
+// AssertNullMultiBulk checks if the given redis.Reply is protocol.NullMultiBulkReply
+func AssertNullMultiBulk(t *testing.T, result redis.Reply) {
+	if result == nil {
+		t.Errorf("result is nil %s", printStack())
+		return
+	}
+	expect := (&protocol.NullMultiBulkReply{}).ToBytes()
+	if !utils.BytesEquals(expect, result.ToBytes()) {
+		t.Errorf("result is not null-multi-bulk-protocol %s", printStack())
+	}
+}
+
 // AssertMultiBulkReply checks if the given redis.Reply has the expected content
 func AssertMultiBulkReply(t *testing.T, actual redis.Reply, expected []string) {
 	multiBulk, ok := actual.(*protocol.MultiBulkReply)
@@ -132,6 +144,12 @@ func AssertMultiBulkReply(t *testing.T, actual redis.Reply, expected []string) {
 
 // AssertMultiBulkReplySize check if redis.Reply has expected length
 func AssertMultiBulkReplySize(t *testing.T, actual redis.Reply, expected int) {
+	if multiRaw, ok := actual.(*protocol.MultiRawReply); ok {
+		if len(multiRaw.Replies) != expected {
+			t.Errorf("expected %d elements, actually %d, %s", expected, len(multiRaw.Replies), printStack())
+		}
+		return
+	}
 	multiBulk, ok := actual.(*protocol.MultiBulkReply)
 	if !ok {
 		if expected == 0 &&
@@ -42,6 +42,36 @@ func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+// NullMultiBulkReply is null array, replied by commands like XREAD when nothing is available
+type NullMultiBulkReply struct{}
+
+// ToBytes marshal redis.Reply
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
+// MakeNullMultiBulkReply creates a new NullMultiBulkReply
+func MakeNullMultiBulkReply() *NullMultiBulkReply {
+	return &NullMultiBulkReply{}
+}
+
+var nullBytes = []byte("_\r\n")
+
+// NullReply is the null type of RESP3
+type NullReply struct{}
+
+// ToBytes marshal redis.Reply
+func (r *NullReply) ToBytes() []byte {
+	return nullBytes
+}
+
+// MakeNullReply creates a new NullReply
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
 var emptyMultiBulkBytes = []byte("*0\r\n")
 
 // EmptyMultiBulkReply is a empty list
@@ -88,6 +88,68 @@ func (r *MultiRawReply) ToBytes() []byte {
 	return buf.Bytes()
 }
 
+/* ---- Push Reply ---- */
+
+// PushReply is an out-of-band message of RESP3, such as invalidation message of client side caching and messages of
+// pub/sub, so client could tell it from replies of commands. It is encoded as array in RESP2
+type PushReply struct {
+	Replies []redis.Reply
+	RESP3   bool
+}
+
+// MakePushReply creates PushReply
+func MakePushReply(replies []redis.Reply, resp3 bool) *PushReply {
+	return &PushReply{
+		Replies: replies,
+		RESP3:   resp3,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *PushReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	if r.RESP3 {
+		buf.WriteString(">" + strconv.Itoa(len(r.Replies)) + CRLF)
+	} else {
+		buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	}
+	for _, arg := range r.Replies {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply stores key-value pairs of RESP3, it is encoded as flat array in RESP2
+type MapReply struct {
+	// Pairs contains keys and values alternately
+	Pairs []redis.Reply
+	RESP3 bool
+}
+
+// MakeMapReply creates MapReply, pairs contains keys and values alternately
+func MakeMapReply(pairs []redis.Reply, resp3 bool) *MapReply {
+	return &MapReply{
+		Pairs: pairs,
+		RESP3: resp3,
+	}
+}
+
+// ToBytes marshal redis.Reply
+func (r *MapReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	if r.RESP3 {
+		buf.WriteString("%" + strconv.Itoa(len(r.Pairs)/2) + CRLF)
+	} else {
+		buf.WriteString("*" + strconv.Itoa(len(r.Pairs)) + CRLF)
+	}
+	for _, arg := range r.Pairs {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
+
 /* ---- Status Reply ---- */
 
 // StatusReply stores a simple status string
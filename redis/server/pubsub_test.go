@@ -48,3 +48,122 @@ func TestPublish(t *testing.T) {
 		t.Error("expect no msg")
 	}
 }
+
+func TestPSubscribe(t *testing.T) {
+	hub := pubsub.MakeHub()
+	conn := &connection.FakeConn{}
+	pubsub.PSubscribe(hub, conn, utils.ToCmdLine("news.*", "h?llo"))
+	expected := "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n*3\r\n$10\r\npsubscribe\r\n$5\r\nh?llo\r\n:2\r\n"
+	if string(conn.Bytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, conn.Bytes())
+	}
+
+	conn.Clean()
+	reply := pubsub.Publish(hub, utils.ToCmdLine("news.tech", "msg"))
+	asserts.AssertIntReply(t, reply, 1)
+	ret, err := parser.ParseOne(conn.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	asserts.AssertMultiBulkReply(t, ret, []string{"pmessage", "news.*", "news.tech", "msg"})
+
+	// a client receives both message and pmessage if it subscribes the channel and a matching pattern
+	pubsub.Subscribe(hub, conn, utils.ToCmdLine("hello"))
+	conn.Clean()
+	reply = pubsub.Publish(hub, utils.ToCmdLine("hello", "msg"))
+	asserts.AssertIntReply(t, reply, 2)
+	reply = pubsub.Publish(hub, utils.ToCmdLine("other", "msg"))
+	asserts.AssertIntReply(t, reply, 0)
+
+	pubsub.PUnSubscribe(hub, conn, utils.ToCmdLine("news.*"))
+	reply = pubsub.Publish(hub, utils.ToCmdLine("news.tech", "msg"))
+	asserts.AssertIntReply(t, reply, 0)
+	pubsub.PUnSubscribe(hub, conn, utils.ToCmdLine())
+	conn.Clean()
+	reply = pubsub.Publish(hub, utils.ToCmdLine("hallo", "msg"))
+	asserts.AssertIntReply(t, reply, 0)
+	if len(conn.Bytes()) > 0 {
+		t.Error("expect no msg")
+	}
+	if len(conn.GetPatterns()) != 0 || conn.SubsCount() != 1 {
+		t.Errorf("expect only 1 channel subscribed, actual %d", conn.SubsCount())
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	hub := pubsub.MakeHub()
+	conn1 := &connection.FakeConn{}
+	conn2 := &connection.FakeConn{}
+	pubsub.Subscribe(hub, conn1, utils.ToCmdLine("a1", "b1"))
+	pubsub.Subscribe(hub, conn2, utils.ToCmdLine("a1"))
+	pubsub.PSubscribe(hub, conn1, utils.ToCmdLine("a*"))
+	pubsub.PSubscribe(hub, conn2, utils.ToCmdLine("a*", "b*"))
+
+	reply := pubsub.PubSub(hub, utils.ToCmdLine("channels"))
+	asserts.AssertMultiBulkReplySize(t, reply, 2)
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("channels", "a*"))
+	asserts.AssertMultiBulkReply(t, reply, []string{"a1"})
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("numsub", "a1", "b1", "c1"))
+	expected := "*6\r\n$2\r\na1\r\n:2\r\n$2\r\nb1\r\n:1\r\n$2\r\nc1\r\n:0\r\n"
+	if string(reply.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, reply.ToBytes())
+	}
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("numpat"))
+	asserts.AssertIntReply(t, reply, 2)
+
+	pubsub.UnsubscribeAll(hub, conn2)
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("numsub", "a1"))
+	expected = "*2\r\n$2\r\na1\r\n:1\r\n"
+	if string(reply.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, reply.ToBytes())
+	}
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("numpat"))
+	asserts.AssertIntReply(t, reply, 1)
+
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("foo"))
+	asserts.AssertErrReply(t, reply, "ERR unknown subcommand 'foo'. Try PUBSUB HELP.")
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("numpat", "x"))
+	asserts.AssertErrReply(t, reply, "ERR wrong number of arguments for 'pubsub|numpat' command")
+}
+
+func TestSPublish(t *testing.T) {
+	hub := pubsub.MakeHub()
+	conn := &connection.FakeConn{}
+	pubsub.SSubscribe(hub, conn, utils.ToCmdLine("a", "b"))
+	pubsub.Subscribe(hub, conn, utils.ToCmdLine("a"))
+	expected := "*3\r\n$10\r\nssubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$1\r\nb\r\n:2\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"
+	if string(conn.Bytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, conn.Bytes())
+	}
+
+	// shard channels and channels are separated
+	conn.Clean()
+	reply := pubsub.SPublish(hub, utils.ToCmdLine("a", "msg"))
+	asserts.AssertIntReply(t, reply, 1)
+	ret, err := parser.ParseOne(conn.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	asserts.AssertMultiBulkReply(t, ret, []string{"smessage", "a", "msg"})
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("shardchannels"))
+	asserts.AssertMultiBulkReplySize(t, reply, 2)
+	reply = pubsub.PubSub(hub, utils.ToCmdLine("shardnumsub", "b"))
+	expected = "*2\r\n$1\r\nb\r\n:1\r\n"
+	if string(reply.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, reply.ToBytes())
+	}
+
+	pubsub.SUnSubscribe(hub, conn, utils.ToCmdLine("a"))
+	conn.Clean()
+	reply = pubsub.SPublish(hub, utils.ToCmdLine("a", "msg"))
+	asserts.AssertIntReply(t, reply, 0)
+	reply = pubsub.Publish(hub, utils.ToCmdLine("a", "msg"))
+	asserts.AssertIntReply(t, reply, 1)
+
+	pubsub.UnsubscribeAll(hub, conn)
+	reply = pubsub.SPublish(hub, utils.ToCmdLine("b", "msg"))
+	asserts.AssertIntReply(t, reply, 0)
+}
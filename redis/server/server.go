@@ -15,14 +15,29 @@ import (
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/sentinel"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	atomic2 "sync/atomic"
+	"time"
 )
 
 var (
-	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	unknownErrReplyBytes    = []byte("-ERR unknown\r\n")
+	maxClientsErrReplyBytes = []byte("-ERR max number of clients reached\r\n")
+	protectedErrReplyBytes  = []byte("-DENIED Redis is running in protected mode because protected mode is enabled " +
+		"and no password is set for the default user. In this mode connections are only accepted from the loopback " +
+		"interface. To accept connections from outside, set a password by requirepass, bind the interfaces to " +
+		"listen on explicitly, or disable protected mode by 'protected-mode no'\r\n")
+)
+
+const (
+	defaultProtoMaxBulkLen      = 512 * 1024 * 1024
+	defaultProtoMaxMultiBulkLen = 1024 * 1024
+	defaultProtoMaxInlineLen    = 64 * 1024
+	defaultMaxClients           = 10000
 )
 
 // Handler implements tcp.Handler and serves as a redis server
@@ -34,21 +49,63 @@ type Handler struct {
 	db database.DB
 	// 标记该Server是否关闭
 	closing atomic.Boolean // refusing new client and new request
+	// count of connected clients, including rejected clients before they are closed
+	clients int32
+	// count of commands being executed, Close waits for them
+	inflight int32
+	// shutdown is closed once SHUTDOWN is executed
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	closeOnce    sync.Once
 }
 
 // MakeHandler creates a Handler instance
 func MakeHandler() *Handler {
 	var db database.DB
-	if config.Properties.Self != "" &&
-		len(config.Properties.Peers) > 0 {
+	if config.Properties().Sentinel {
+		db = sentinel.MakeSentinel()
+	} else if config.Properties().Self != "" &&
+		len(config.Properties().Peers) > 0 {
 		// Cluster实现了DB接口
 		db = cluster.MakeCluster()
 	} else {
 		// MultiDB也实现了DB接口
 		db = database2.NewStandaloneServer()
 	}
-	return &Handler{
-		db: db,
+	h := &Handler{
+		db:       db,
+		shutdown: make(chan struct{}),
+	}
+	if mdb, ok := db.(*database2.MultiDB); ok {
+		mdb.SetShutdownFunc(h.requestShutdown)
+	}
+	return h
+}
+
+// requestShutdown asks tcp server to stop, which closes handler the same way as SIGTERM
+func (h *Handler) requestShutdown() {
+	h.shutdownOnce.Do(func() {
+		close(h.shutdown)
+	})
+}
+
+// ShutdownRequested implements tcp.ShutdownNotifier
+func (h *Handler) ShutdownRequested() <-chan struct{} {
+	return h.shutdown
+}
+
+// Reload implements tcp.Reloader, it reloads config file on SIGHUP
+func (h *Handler) Reload() {
+	var err error
+	if reloader, ok := h.db.(interface {
+		ReloadConfig() (*config.ReloadResult, error)
+	}); ok {
+		_, err = reloader.ReloadConfig()
+	} else {
+		_, err = config.Reload()
+	}
+	if err != nil {
+		logger.Error("reload config failed: " + err.Error())
 	}
 }
 
@@ -66,12 +123,29 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		_ = conn.Close()
 		return
 	}
+	if isProtected(conn.RemoteAddr()) {
+		_, _ = conn.Write(protectedErrReplyBytes)
+		_ = conn.Close()
+		logger.Warn("protected mode is enabled, refused " + conn.RemoteAddr().String())
+		return
+	}
+	clients := atomic2.AddInt32(&h.clients, 1)
+	defer atomic2.AddInt32(&h.clients, -1)
+	if clients > int32(maxClients()) {
+		// reply error instead of closing silently, so client knows why it's refused
+		_, _ = conn.Write(maxClientsErrReplyBytes)
+		_ = conn.Close()
+		logger.Warn("max number of clients reached, refused " + conn.RemoteAddr().String())
+		return
+	}
 
 	client := connection.NewConn(conn)
 	h.activeConn.Store(client, struct{}{})
+	client.WatchIdle(idleTimeout)
 
 	// 解析该连接的所有（客户端传来的）命令，并都传到ch管道中
-	ch := parser.ParseStream(conn)
+	// requests are read through client, so it knows the disconnection even while executing a blocking command
+	ch := parser.ParseStreamWithLimits(client, protoLimits())
 
 	// 一直循环该链接的命令 ch
 	for payload := range ch {
@@ -87,6 +161,12 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			// protocol err
 			errReply := protocol.MakeErrReply(payload.Err.Error())
 			err := client.Write(errReply.ToBytes())
+			if _, ok := payload.Err.(*parser.LimitError); ok {
+				// parser has stopped, the rest of stream is not readable
+				h.closeClient(client)
+				logger.Warn("connection closed for " + payload.Err.Error() + ": " + client.RemoteAddr().String())
+				return
+			}
 			if err != nil {
 				h.closeClient(client)
 				logger.Info("connection closed: " + client.RemoteAddr().String())
@@ -108,8 +188,19 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		// 处理命令
 		logger.Info(string(r.ToBytes()))
 
+		// increase inflight before checking closing, so Close either waits for the command or it is refused
+		atomic2.AddInt32(&h.inflight, 1)
+		if h.closing.Get() && !isReplConf(r.Args) {
+			// slaves still acknowledge offset while shutting down, other requests are not executed
+			atomic2.AddInt32(&h.inflight, -1)
+			h.closeClient(client)
+			return
+		}
 		// r.Args :  [set] [key] [value]
+		client.BeginCommand()
 		result := h.db.Exec(client, r.Args)
+		client.EndCommand()
+		atomic2.AddInt32(&h.inflight, -1)
 		// result : +OK -Err syntax error or empty et
 		if result != nil {
 			_ = client.Write(result.ToBytes())
@@ -119,16 +210,75 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
-// Close stops handler
+func protoLimits() *parser.Limits {
+	limits := &parser.Limits{
+		MaxBulkLen:      int64(config.Properties().ProtoMaxBulkLen),
+		MaxMultiBulkLen: int64(config.Properties().ProtoMaxMultiBulkLen),
+		MaxInlineLen:    config.Properties().ProtoMaxInlineLen,
+	}
+	if limits.MaxBulkLen <= 0 {
+		limits.MaxBulkLen = defaultProtoMaxBulkLen
+	}
+	if limits.MaxMultiBulkLen <= 0 {
+		limits.MaxMultiBulkLen = defaultProtoMaxMultiBulkLen
+	}
+	if limits.MaxInlineLen <= 0 {
+		limits.MaxInlineLen = defaultProtoMaxInlineLen
+	}
+	return limits
+}
+
+func maxClients() int {
+	if config.Properties().MaxClients > 0 {
+		return config.Properties().MaxClients
+	}
+	return defaultMaxClients
+}
+
+// isProtected tells whether the client should be refused by protected mode, which accepts only clients from
+// loopback interface while server listens on all interfaces without password
+func isProtected(addr net.Addr) bool {
+	if !config.Properties().ProtectedMode || config.Properties().RequirePass != "" || config.Properties().Bind != "" {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && !tcpAddr.IP.IsLoopback()
+}
+
+func isReplConf(args [][]byte) bool {
+	return len(args) > 0 && strings.ToLower(string(args[0])) == "replconf"
+}
+
+// waitInflight waits until no command is being executed or timeout, blocking commands like BLPOP may never finish
+func (h *Handler) waitInflight(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic2.LoadInt32(&h.inflight) > 0 {
+		if time.Now().After(deadline) {
+			logger.Warn("shutdown timeout, close with commands in flight")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// idleTimeout returns timeout of idle clients, it is read on every check so changes during runtime take effect
+func idleTimeout() time.Duration {
+	return time.Duration(config.Properties().Timeout) * time.Second
+}
+
+// Close stops handler gracefully: it refuses new clients and requests, waits for in-flight commands,
+// then closes database and all clients. Clients are closed after database, so slaves could acknowledge the latest writes
 func (h *Handler) Close() error {
-	logger.Info("handler shutting down...")
-	h.closing.Set(true)
-	// TODO: concurrent wait
-	h.activeConn.Range(func(key interface{}, val interface{}) bool {
-		client := key.(*connection.Connection)
-		_ = client.Close()
-		return true
+	h.closeOnce.Do(func() {
+		logger.Info("handler shutting down...")
+		h.closing.Set(true)
+		h.waitInflight(config.ShutdownTimeout())
+		h.db.Close()
+		h.activeConn.Range(func(key interface{}, val interface{}) bool {
+			client := key.(*connection.Connection)
+			_ = client.Close()
+			return true
+		})
 	})
-	h.db.Close()
 	return nil
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/tcp"
@@ -72,3 +73,170 @@ func TestListenAndServe(t *testing.T) {
 	closeChan <- struct{}{}
 	time.Sleep(time.Second)
 }
+
+func TestMaxClients(t *testing.T) {
+	config.Update(func(p *config.ServerProperties) {
+		p.MaxClients = 1
+	})
+	defer func() {
+		config.Update(func(p *config.ServerProperties) {
+			p.MaxClients = 0
+		})
+	}()
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("PING\r\n"))
+	line, _, err := bufio.NewReader(conn).ReadLine()
+	if err != nil || string(line) != "+PONG" {
+		t.Fatalf("expect PONG, actually %s %v", string(line), err)
+	}
+
+	// the second client is refused
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = refused.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, _, err = bufio.NewReader(refused).ReadLine()
+	if err != nil || string(line) != "-ERR max number of clients reached" {
+		t.Errorf("expect max clients error, actually %s %v", string(line), err)
+	}
+
+	// slot is released once the first client disconnects
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _ = conn.Write([]byte("PING\r\n"))
+	line, _, err = bufio.NewReader(conn).ReadLine()
+	if err != nil || string(line) != "+PONG" {
+		t.Errorf("expect PONG, actually %s %v", string(line), err)
+	}
+	_ = conn.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	done := make(chan struct{})
+	go func() {
+		tcp.ListenAndServe(listener, MakeHandler(), make(chan struct{}))
+		close(done)
+	}()
+
+	blocked, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = blocked.Write([]byte("BLPOP " + utils.RandString(10) + " 1\r\n"))
+	time.Sleep(500 * time.Millisecond) // wait until BLPOP is blocked
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("SHUTDOWN NOSAVE\r\n"))
+
+	// in-flight command finishes before clients are closed
+	_ = blocked.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, _, err := bufio.NewReader(blocked).ReadLine()
+	if err != nil || string(line) != "*-1" {
+		t.Errorf("expect reply of in-flight BLPOP, actually %s %v", string(line), err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect server stopped")
+	}
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Error("expect new connection refused")
+	}
+}
+
+func TestBlockedClientDisconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	closeChan := make(chan struct{})
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	key := utils.RandString(10)
+	blocked, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = blocked.Write([]byte("BLPOP " + key + " 0\r\n"))
+	time.Sleep(200 * time.Millisecond) // wait until BLPOP is blocked
+	_ = blocked.Close()
+	time.Sleep(200 * time.Millisecond) // wait until server notices the disconnection
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("RPUSH " + key + " a\r\n"))
+	_, _, _ = reader.ReadLine()
+	time.Sleep(200 * time.Millisecond) // a blocked client would have taken the element
+	_, _ = conn.Write([]byte("LLEN " + key + "\r\n"))
+	line, _, err := reader.ReadLine()
+	if err != nil || string(line) != ":1" {
+		t.Errorf("expect element kept for other clients, actually %s %v", string(line), err)
+	}
+}
+
+func TestProtectedMode(t *testing.T) {
+	properties := config.Properties()
+	defer func() {
+		config.SetProperties(properties)
+	}()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 50000}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}
+	config.SetProperties(&config.ServerProperties{ProtectedMode: true})
+	if !isProtected(remote) {
+		t.Error("expect remote client refused without bind and password")
+	}
+	if isProtected(local) || isProtected(&net.TCPAddr{IP: net.IPv6loopback}) {
+		t.Error("expect loopback client accepted")
+	}
+	config.SetProperties(&config.ServerProperties{ProtectedMode: true, RequirePass: "secret"})
+	if isProtected(remote) {
+		t.Error("expect remote client accepted with password")
+	}
+	config.SetProperties(&config.ServerProperties{ProtectedMode: true, Bind: "0.0.0.0"})
+	if isProtected(remote) {
+		t.Error("expect remote client accepted with explicit bind")
+	}
+	config.SetProperties(&config.ServerProperties{})
+	if isProtected(remote) {
+		t.Error("expect remote client accepted without protected mode")
+	}
+}
@@ -0,0 +1,86 @@
+// Package script implements lua scripting of EVAL and EVALSHA commands
+package script
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"strings"
+	"sync"
+)
+
+// Cache stores compiled scripts by their sha1 digest, it is shared by all databases of a server
+type Cache struct {
+	mu sync.RWMutex
+	// sha1 -> compiled script
+	scripts map[string]*lua.FunctionProto
+}
+
+// MakeCache creates an empty Cache
+func MakeCache() *Cache {
+	return &Cache{
+		scripts: make(map[string]*lua.FunctionProto),
+	}
+}
+
+// Sha1Hex returns the lower case hex sha1 digest of script, which is the name of script in cache
+func Sha1Hex(src string) string {
+	digest := sha1.Sum([]byte(src))
+	return hex.EncodeToString(digest[:])
+}
+
+// Compile compiles script into a lua function body
+func Compile(src string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), "@user_script")
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, "@user_script")
+}
+
+// Load compiles script and stores it in cache, returns its sha1 digest.
+// Nil cache compiles script without storing it
+func (c *Cache) Load(src string) (string, *lua.FunctionProto, error) {
+	sha := Sha1Hex(src)
+	if proto, ok := c.Get(sha); ok {
+		return sha, proto, nil
+	}
+	proto, err := Compile(src)
+	if err != nil {
+		return "", nil, err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.scripts[sha] = proto
+		c.mu.Unlock()
+	}
+	return sha, proto, nil
+}
+
+// Get returns the compiled script of the given sha1 digest
+func (c *Cache) Get(sha string) (*lua.FunctionProto, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	proto, ok := c.scripts[strings.ToLower(sha)]
+	return proto, ok
+}
+
+// Exists returns whether the script of the given sha1 digest is in cache
+func (c *Cache) Exists(sha string) bool {
+	_, ok := c.Get(sha)
+	return ok
+}
+
+// Flush removes all scripts in cache
+func (c *Cache) Flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts = make(map[string]*lua.FunctionProto)
+}
@@ -0,0 +1,303 @@
+package script
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	lua "github.com/yuin/gopher-lua"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FlagNoWrites is the function flag which means the function doesn't modify dataset, it can be called by FCALL_RO
+const FlagNoWrites = "no-writes"
+
+// flags accepted by redis.register_function, flags other than no-writes are recorded only
+var functionFlags = map[string]struct{}{
+	FlagNoWrites:            {},
+	"allow-oom":             {},
+	"allow-stale":           {},
+	"no-cluster":            {},
+	"allow-cross-slot-keys": {},
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// Library is a set of lua functions loaded by FUNCTION LOAD
+type Library struct {
+	Name string
+	// Code is the source code including metadata line, it is used to persist library
+	Code      string
+	proto     *lua.FunctionProto
+	Functions []*Function
+}
+
+// Function is a lua function registered by library
+type Function struct {
+	Name    string
+	Flags   []string
+	Library *Library
+}
+
+// NoWrites returns whether the function is declared with no-writes flag
+func (fn *Function) NoWrites() bool {
+	for _, flag := range fn.Flags {
+		if flag == FlagNoWrites {
+			return true
+		}
+	}
+	return false
+}
+
+// registered is a function collected by redis.register_function
+type registered struct {
+	callback *lua.LFunction
+	flags    []string
+}
+
+// parseLibraryName parses metadata line of library code, like: #!lua name=mylib
+// returns library name and code without metadata line
+func parseLibraryName(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	lineEnd := strings.IndexByte(code, '\n')
+	if lineEnd < 0 {
+		lineEnd = len(code)
+	}
+	fields := strings.Fields(code[2:lineEnd])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		return "", "", errors.New("ERR Engine not found")
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "name=") {
+			return "", "", errors.New("ERR Invalid metadata value given: " + field)
+		}
+		name = strings.TrimPrefix(field, "name=")
+	}
+	if !namePattern.MatchString(name) {
+		return "", "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	// keep the empty line, so line numbers in error message are correct
+	return name, code[lineEnd:], nil
+}
+
+// registerFunctions runs library code and returns functions registered by it.
+// Commands cannot be called while loading library
+func registerFunctions(L *lua.LState, execution *Execution, proto *lua.FunctionProto, caller Caller) (map[string]*registered, error) {
+	loading := true
+	lib := makeRedisLib(L, func(cmdLine [][]byte) redis.Reply {
+		if loading {
+			return protocol.MakeErrReply("ERR redis.call and redis.pcall are not allowed while loading library")
+		}
+		return caller(cmdLine)
+	})
+	functions := make(map[string]*registered)
+	L.SetField(lib, "register_function", L.NewFunction(func(L *lua.LState) int {
+		if !loading {
+			L.RaiseError("redis.register_function can only be called while loading library")
+			return 0
+		}
+		var name lua.LValue
+		var callback lua.LValue
+		var flags lua.LValue = lua.LNil
+		if table, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+			name = table.RawGetString("function_name")
+			callback = table.RawGetString("callback")
+			flags = table.RawGetString("flags")
+		} else {
+			name = L.Get(1)
+			callback = L.Get(2)
+		}
+		nameStr, ok := name.(lua.LString)
+		if !ok || !namePattern.MatchString(string(nameStr)) {
+			L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+			return 0
+		}
+		fn, ok := callback.(*lua.LFunction)
+		if !ok {
+			L.RaiseError("callback argument given to redis.register_function must be a function")
+			return 0
+		}
+		if _, ok := functions[string(nameStr)]; ok {
+			L.RaiseError("Function already exists in the library")
+			return 0
+		}
+		r := &registered{callback: fn}
+		if flagTable, ok := flags.(*lua.LTable); ok {
+			for i := 1; i <= flagTable.Len(); i++ {
+				flag := flagTable.RawGetInt(i).String()
+				if _, ok := functionFlags[flag]; !ok {
+					L.RaiseError("unknown flag given")
+					return 0
+				}
+				r.flags = append(r.flags, flag)
+			}
+		} else if flags != lua.LNil {
+			L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+			return 0
+		}
+		functions[string(nameStr)] = r
+		return 0
+	}))
+	L.SetGlobal("redis", lib)
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		if execution.isKilled() {
+			return nil, errors.New("ERR Script killed by user with SCRIPT KILL...")
+		}
+		return nil, errors.New("ERR Error registering functions: " + errorMessage(err))
+	}
+	loading = false
+	return functions, nil
+}
+
+// RunFunction calls the function with keys and args as its parameters
+func RunFunction(execution *Execution, fn *Function, keys [][]byte, args [][]byte, caller Caller) redis.Reply {
+	L := newState(execution)
+	defer L.Close()
+	functions, err := registerFunctions(L, execution, fn.Library.proto, caller)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	r, ok := functions[fn.Name]
+	if !ok {
+		return protocol.MakeErrReply("ERR Function not found")
+	}
+	L.Push(r.callback)
+	L.Push(toLuaArray(L, keys))
+	L.Push(toLuaArray(L, args))
+	return callScript(L, execution, 2)
+}
+
+// Functions stores libraries loaded by FUNCTION LOAD, it is shared by all databases of a server
+type Functions struct {
+	mu sync.RWMutex
+	// library name -> library
+	libraries map[string]*Library
+	// function name -> function
+	functions map[string]*Function
+}
+
+// MakeFunctions creates an empty Functions
+func MakeFunctions() *Functions {
+	return &Functions{
+		libraries: make(map[string]*Library),
+		functions: make(map[string]*Function),
+	}
+}
+
+// Load compiles library and registers its functions, returns the library name.
+// replace means replacing the existing library with the same name
+func (f *Functions) Load(code string, replace bool) (string, error) {
+	name, body, err := parseLibraryName(code)
+	if err != nil {
+		return "", err
+	}
+	proto, err := Compile(body)
+	if err != nil {
+		return "", errors.New("ERR Error compiling function: " + err.Error())
+	}
+	execution := makeExecution()
+	defer execution.cancel()
+	L := newState(execution)
+	defer L.Close()
+	registeredMap, err := registerFunctions(L, execution, proto, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(registeredMap) == 0 {
+		return "", errors.New("ERR No functions registered")
+	}
+	lib := &Library{
+		Name:  name,
+		Code:  code,
+		proto: proto,
+	}
+	for fnName, r := range registeredMap {
+		lib.Functions = append(lib.Functions, &Function{
+			Name:    fnName,
+			Flags:   r.flags,
+			Library: lib,
+		})
+	}
+	sort.Slice(lib.Functions, func(i, j int) bool {
+		return lib.Functions[i].Name < lib.Functions[j].Name
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.libraries[name]; ok && !replace {
+		return "", errors.New("ERR Library '" + name + "' already exists")
+	}
+	for _, fn := range lib.Functions {
+		if existed, ok := f.functions[fn.Name]; ok && existed.Library.Name != name {
+			return "", errors.New("ERR Function " + fn.Name + " already exists")
+		}
+	}
+	f.removeLibrary(name)
+	f.libraries[name] = lib
+	for _, fn := range lib.Functions {
+		f.functions[fn.Name] = fn
+	}
+	return name, nil
+}
+
+// removeLibrary removes library and its functions, invoker should hold the lock
+func (f *Functions) removeLibrary(name string) bool {
+	lib, ok := f.libraries[name]
+	if !ok {
+		return false
+	}
+	delete(f.libraries, name)
+	for _, fn := range lib.Functions {
+		delete(f.functions, fn.Name)
+	}
+	return true
+}
+
+// Delete removes library and its functions, returns false if library not found
+func (f *Functions) Delete(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.removeLibrary(name)
+}
+
+// Flush removes all libraries
+func (f *Functions) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.libraries = make(map[string]*Library)
+	f.functions = make(map[string]*Function)
+}
+
+// Get returns function of the given name
+func (f *Functions) Get(name string) (*Function, bool) {
+	if f == nil {
+		return nil, false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fn, ok := f.functions[name]
+	return fn, ok
+}
+
+// Libraries returns all libraries in ascending order of name
+func (f *Functions) Libraries() []*Library {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	result := make([]*Library, 0, len(f.libraries))
+	for _, lib := range f.libraries {
+		result = append(result, lib)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,253 @@
+package script
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	lua "github.com/yuin/gopher-lua"
+	"strconv"
+	"strings"
+)
+
+// Caller executes redis command called by script through redis.call or redis.pcall
+type Caller func(cmdLine [][]byte) redis.Reply
+
+// Run executes compiled script with the given KEYS and ARGV, returns the result of script as reply.
+// The script stops once execution is killed
+func Run(execution *Execution, proto *lua.FunctionProto, keys [][]byte, args [][]byte, caller Caller) redis.Reply {
+	L := newState(execution)
+	defer L.Close()
+	L.SetGlobal("KEYS", toLuaArray(L, keys))
+	L.SetGlobal("ARGV", toLuaArray(L, args))
+	L.SetGlobal("redis", makeRedisLib(L, caller))
+
+	L.Push(L.NewFunctionFromProto(proto))
+	return callScript(L, execution, 0)
+}
+
+func newState(execution *Execution) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	openLibs(L)
+	L.SetContext(execution.ctx)
+	return L
+}
+
+// callScript calls the function on stack with nargs arguments, and converts its result to reply
+func callScript(L *lua.LState, execution *Execution, nargs int) redis.Reply {
+	if err := L.PCall(nargs, 1, nil); err != nil {
+		if execution.isKilled() {
+			return protocol.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+		}
+		return toErrReply(err)
+	}
+	return toReply(L.Get(-1))
+}
+
+// openLibs opens libraries which don't access file system or operating system
+func openLibs(L *lua.LState) {
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "print"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+}
+
+func makeRedisLib(L *lua.LState, caller Caller) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return callRedis(L, caller, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return callRedis(L, caller, false)
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(makeStatusTable(L, L.CheckString(1)))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(makeErrTable(L, L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(Sha1Hex(L.CheckString(1))))
+			return 1
+		},
+	})
+}
+
+// callRedis executes the command in arguments, raise means raising error reply as lua error like redis.call
+// otherwise returning it as table like redis.pcall
+func callRedis(L *lua.LState, caller Caller, raise bool) int {
+	top := L.GetTop()
+	if top == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+		return 0
+	}
+	cmdLine := make([][]byte, top)
+	for i := 1; i <= top; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			cmdLine[i-1] = []byte(arg)
+		case lua.LNumber:
+			cmdLine[i-1] = []byte(arg.String())
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+			return 0
+		}
+	}
+	result := caller(cmdLine)
+	if raise && protocol.IsErrorReply(result) {
+		L.Error(makeErrTable(L, lineContent(result)), 1)
+		return 0
+	}
+	L.Push(toLua(L, result))
+	return 1
+}
+
+func makeStatusTable(L *lua.LState, status string) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("ok", lua.LString(status))
+	return table
+}
+
+func makeErrTable(L *lua.LState, msg string) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("err", lua.LString(msg))
+	return table
+}
+
+func toLuaArray(L *lua.LState, args [][]byte) *lua.LTable {
+	table := L.CreateTable(len(args), 0)
+	for _, arg := range args {
+		table.Append(lua.LString(arg))
+	}
+	return table
+}
+
+// lineContent returns content of single line reply without type prefix and CRLF
+func lineContent(reply redis.Reply) string {
+	return strings.TrimSuffix(string(reply.ToBytes()[1:]), protocol.CRLF)
+}
+
+// toLua converts redis reply to lua value, nil bulk is converted to false
+func toLua(L *lua.LState, reply redis.Reply) lua.LValue {
+	switch r := reply.(type) {
+	case *protocol.IntReply:
+		return lua.LNumber(r.Code)
+	case *protocol.BulkReply:
+		if r.Arg == nil {
+			return lua.LFalse
+		}
+		return lua.LString(r.Arg)
+	case *protocol.NullBulkReply, *protocol.NullReply:
+		return lua.LFalse
+	case *protocol.EmptyMultiBulkReply:
+		return L.NewTable()
+	case *protocol.MultiBulkReply:
+		table := L.CreateTable(len(r.Args), 0)
+		for _, arg := range r.Args {
+			if arg == nil {
+				table.Append(lua.LFalse)
+			} else {
+				table.Append(lua.LString(arg))
+			}
+		}
+		return table
+	case *protocol.MultiRawReply:
+		return toLuaTable(L, r.Replies)
+	case *protocol.MapReply:
+		return toLuaTable(L, r.Pairs)
+	case *protocol.StatusReply:
+		return makeStatusTable(L, r.Status)
+	}
+	// replies with fixed content, such as OK and PONG
+	raw := reply.ToBytes()
+	switch raw[0] {
+	case '+':
+		return makeStatusTable(L, lineContent(reply))
+	case '-':
+		return makeErrTable(L, lineContent(reply))
+	case ':':
+		code, _ := strconv.ParseInt(lineContent(reply), 10, 64)
+		return lua.LNumber(code)
+	}
+	return lua.LFalse
+}
+
+func toLuaTable(L *lua.LState, replies []redis.Reply) *lua.LTable {
+	table := L.CreateTable(len(replies), 0)
+	for _, reply := range replies {
+		table.Append(toLua(L, reply))
+	}
+	return table
+}
+
+// toReply converts lua value to redis reply, number is truncated to integer and array stops at the first nil
+func toReply(value lua.LValue) redis.Reply {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return protocol.MakeIntReply(int64(v))
+	case lua.LString:
+		return protocol.MakeBulkReply([]byte(v))
+	case lua.LBool:
+		if v {
+			return protocol.MakeIntReply(1)
+		}
+		return protocol.MakeNullBulkReply()
+	case *lua.LTable:
+		if ok, isStr := v.RawGetString("ok").(lua.LString); isStr {
+			return protocol.MakeStatusReply(string(ok))
+		}
+		if err, isStr := v.RawGetString("err").(lua.LString); isStr {
+			return protocol.MakeErrReply(string(err))
+		}
+		replies := make([]redis.Reply, 0, v.Len())
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			replies = append(replies, toReply(item))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+// errorMessage returns message of error raised by script
+func errorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			if errMsg, isStr := table.RawGetString("err").(lua.LString); isStr {
+				return string(errMsg)
+			}
+		}
+		return apiErr.Object.String()
+	}
+	return err.Error()
+}
+
+// toErrReply converts error raised by script, error table raised by redis.call is returned as is
+func toErrReply(err error) redis.Reply {
+	msg := err.Error()
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			if errMsg, isStr := table.RawGetString("err").(lua.LString); isStr {
+				return protocol.MakeErrReply(string(errMsg))
+			}
+		}
+		msg = apiErr.Object.String()
+	}
+	return protocol.MakeErrReply("ERR Error running script: " + msg)
+}
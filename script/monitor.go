@@ -0,0 +1,140 @@
+package script
+
+import (
+	"context"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Execution is a running script
+type Execution struct {
+	start  time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+	// written is set once script called a write command, such script cannot be killed by SCRIPT KILL
+	written int32
+	killed  int32
+}
+
+func makeExecution() *Execution {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Execution{
+		start:  time.Now(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// MarkWritten records that script has modified dataset
+func (e *Execution) MarkWritten() {
+	atomic.StoreInt32(&e.written, 1)
+}
+
+func (e *Execution) hasWritten() bool {
+	return atomic.LoadInt32(&e.written) == 1
+}
+
+func (e *Execution) kill() {
+	atomic.StoreInt32(&e.killed, 1)
+	e.cancel()
+}
+
+func (e *Execution) isKilled() bool {
+	return atomic.LoadInt32(&e.killed) == 1
+}
+
+// Monitor records running scripts, scripts running longer than time limit are regarded as busy
+// and read-only ones can be killed by SCRIPT KILL
+type Monitor struct {
+	mu         sync.Mutex
+	executions map[*Execution]struct{}
+}
+
+// MakeMonitor creates an empty Monitor
+func MakeMonitor() *Monitor {
+	return &Monitor{
+		executions: make(map[*Execution]struct{}),
+	}
+}
+
+// Start creates an Execution for a new script, nil monitor returns an execution which is not recorded
+func (m *Monitor) Start() *Execution {
+	e := makeExecution()
+	if m == nil {
+		return e
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.executions[e] = struct{}{}
+	return e
+}
+
+// Finish removes finished script
+func (m *Monitor) Finish(e *Execution) {
+	e.cancel()
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.executions, e)
+}
+
+// busyExecutions returns scripts running longer than limit, invoker should hold the lock
+func (m *Monitor) busyExecutions(limit time.Duration) []*Execution {
+	var result []*Execution
+	for e := range m.executions {
+		if time.Since(e.start) >= limit {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Busy returns whether any script has been running longer than limit
+func (m *Monitor) Busy(limit time.Duration) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.busyExecutions(limit)) > 0
+}
+
+// Kill kills busy scripts which have not modified dataset, it fails if any busy script has written
+func (m *Monitor) Kill(limit time.Duration) redis.Reply {
+	if m == nil {
+		return protocol.MakeErrReply("NOTBUSY No scripts in execution right now.")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	busy := m.busyExecutions(limit)
+	if len(busy) == 0 {
+		return protocol.MakeErrReply("NOTBUSY No scripts in execution right now.")
+	}
+	for _, e := range busy {
+		if e.hasWritten() {
+			return protocol.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+		}
+	}
+	for _, e := range busy {
+		e.kill()
+	}
+	return protocol.MakeOkReply()
+}
+
+// KillAll kills all running scripts including those have written, it is used by SHUTDOWN
+func (m *Monitor) KillAll() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for e := range m.executions {
+		e.kill()
+	}
+}
@@ -0,0 +1,442 @@
+package sentinel
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/wildcard"
+	"github.com/hdt3213/godis/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execSentinel executes subcommands of SENTINEL
+func (s *Sentinel) execSentinel(args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "myid":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("sentinel|myid")
+		}
+		return protocol.MakeBulkReply([]byte(s.myId))
+	case "masters":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("sentinel|masters")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		names := make([]string, 0, len(s.masters))
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		replies := make([]redis.Reply, 0, len(names))
+		for _, name := range names {
+			replies = append(replies, s.masterReply(s.masters[name]))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "master", "replicas", "slaves", "sentinels", "get-master-addr-by-name", "failover", "ckquorum", "remove":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("sentinel|" + subCmd)
+		}
+		return s.execMasterCommand(subCmd, string(args[0]))
+	case "is-master-down-by-addr":
+		if len(args) != 4 {
+			return protocol.MakeArgNumErrReply("sentinel|" + subCmd)
+		}
+		return s.execIsMasterDownByAddr(args)
+	case "monitor":
+		if len(args) != 4 {
+			return protocol.MakeArgNumErrReply("sentinel|" + subCmd)
+		}
+		port, err := strconv.Atoi(string(args[2]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Invalid port number")
+		}
+		quorum, err := strconv.Atoi(string(args[3]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Invalid quorum")
+		}
+		if err := s.monitor(string(args[0]), string(args[1]), port, quorum); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "set":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return protocol.MakeArgNumErrReply("sentinel|" + subCmd)
+		}
+		return s.execSet(args)
+	case "reset":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("sentinel|" + subCmd)
+		}
+		pattern, err := wildcard.CompilePattern(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal wildcard")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		count := 0
+		for name, m := range s.masters {
+			if pattern.IsMatch(name) {
+				s.reset(m)
+				count++
+			}
+		}
+		return protocol.MakeIntReply(int64(count))
+	}
+	return protocol.MakeErrReply("ERR Unknown sentinel subcommand '" + subCmd + "'")
+}
+
+// execMasterCommand executes subcommands of SENTINEL whose only argument is name of master
+func (s *Sentinel) execMasterCommand(subCmd string, name string) redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.masters[name]
+	if !ok {
+		if subCmd == "get-master-addr-by-name" {
+			return protocol.MakeNullBulkReply()
+		}
+		return protocol.MakeErrReply("ERR No such master with that name")
+	}
+	switch subCmd {
+	case "master":
+		return s.masterReply(m)
+	case "replicas", "slaves":
+		replies := make([]redis.Reply, 0, len(m.replicas))
+		for _, r := range m.replicaList() {
+			replies = append(replies, replicaReply(r))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "sentinels":
+		replies := make([]redis.Reply, 0, len(m.sentinels))
+		for _, peer := range m.sentinelList() {
+			replies = append(replies, sentinelReply(peer))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "get-master-addr-by-name":
+		ip, port := m.currentAddr()
+		return protocol.MakeMultiBulkReply([][]byte{[]byte(ip), []byte(strconv.Itoa(port))})
+	case "failover":
+		if m.failoverState != failoverNone {
+			return protocol.MakeErrReply("INPROG Failover already in progress")
+		}
+		if s.selectReplica(m) == nil {
+			return protocol.MakeErrReply("NOGOODSLAVE No suitable replica to promote")
+		}
+		s.startFailover(m, true)
+		return protocol.MakeOkReply()
+	case "ckquorum":
+		usable := 1
+		for _, peer := range m.sentinels {
+			if peer.sdownSince.IsZero() {
+				usable++
+			}
+		}
+		voters := len(m.sentinels) + 1
+		if usable < m.quorum {
+			return protocol.MakeErrReply("NOQUORUM " + strconv.Itoa(usable) +
+				" usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master")
+		}
+		if usable < voters/2+1 {
+			return protocol.MakeErrReply("NOQUORUM " + strconv.Itoa(usable) +
+				" usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover")
+		}
+		return protocol.MakeStatusReply("OK " + strconv.Itoa(usable) +
+			" usable Sentinels. Quorum and failover authorization can be reached")
+	case "remove":
+		for _, inst := range m.instances() {
+			inst.close()
+		}
+		delete(s.masters, name)
+		s.event("-monitor", m, m.inst, "")
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR Unknown sentinel subcommand '" + subCmd + "'")
+}
+
+// execIsMasterDownByAddr replies whether the master is subjectively down, and votes for the sentinel requesting to
+// be leader in the epoch if run id is not *. It replies down state, voted leader and its epoch.
+// usage: SENTINEL is-master-down-by-addr ip port current-epoch run-id
+func (s *Sentinel) execIsMasterDownByAddr(args [][]byte) redis.Reply {
+	ip := string(args[0])
+	port, err1 := strconv.Atoi(string(args[1]))
+	epoch, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	runId := string(args[3])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.inst.ip == ip && candidate.inst.port == port {
+			m = candidate
+			break
+		}
+	}
+	down := int64(0)
+	leader, leaderEpoch := "*", int64(0)
+	if m != nil {
+		if !m.inst.sdownSince.IsZero() {
+			down = 1
+		}
+		if runId != "*" {
+			leader, leaderEpoch = s.voteLeader(m, epoch, runId)
+		}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(down),
+		protocol.MakeBulkReply([]byte(leader)),
+		protocol.MakeIntReply(leaderEpoch),
+	})
+}
+
+// execSet changes options of master
+// usage: SENTINEL SET name option value [option value ...]
+func (s *Sentinel) execSet(args [][]byte) redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.masters[string(args[0])]
+	if !ok {
+		return protocol.MakeErrReply("ERR No such master with that name")
+	}
+	for i := 1; i < len(args); i += 2 {
+		option := strings.ToLower(string(args[i]))
+		value, err := strconv.Atoi(string(args[i+1]))
+		if err != nil || value <= 0 {
+			return protocol.MakeErrReply("ERR Invalid argument '" + string(args[i+1]) + "' for SENTINEL SET '" +
+				option + "'")
+		}
+		switch option {
+		case "down-after-milliseconds":
+			m.downAfter = time.Duration(value) * time.Millisecond
+		case "failover-timeout":
+			m.failoverTimeout = time.Duration(value) * time.Millisecond
+		case "quorum":
+			m.quorum = value
+		default:
+			return protocol.MakeErrReply("ERR Invalid argument '" + option + "' for SENTINEL SET")
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+func msSince(t time.Time) string {
+	if t.IsZero() {
+		return "-1"
+	}
+	return strconv.FormatInt(int64(time.Since(t)/time.Millisecond), 10)
+}
+
+func flags(inst *instance, m *master) string {
+	f := kindNames[inst.kind]
+	if !inst.sdownSince.IsZero() {
+		f += ",s_down"
+	}
+	if m != nil && !m.odownSince.IsZero() {
+		f += ",o_down"
+	}
+	if m != nil && m.failoverState != failoverNone {
+		f += ",failover_in_progress"
+	}
+	if m == nil && inst.kind == kindReplica {
+		if inst.reconfDone {
+			f += ",reconf_done"
+		} else if inst.reconfInprog {
+			f += ",reconf_inprog"
+		} else if inst.reconfSent {
+			f += ",reconf_sent"
+		}
+	}
+	return f
+}
+
+// masterReply returns fields of master, invoker should hold s.mu
+func (s *Sentinel) masterReply(m *master) redis.Reply {
+	inst := m.inst
+	return protocol.MakeMultiBulkReply(toBytes(
+		"name", m.name,
+		"ip", inst.ip,
+		"port", strconv.Itoa(inst.port),
+		"flags", flags(inst, m),
+		"last-ok-ping-reply", msSince(inst.lastOk),
+		"last-ping-sent", msSince(inst.lastPing),
+		"info-refresh", msSince(inst.lastInfo),
+		"role-reported", inst.role,
+		"role-reported-time", msSince(inst.roleReported),
+		"s-down-time", msSince(inst.sdownSince),
+		"o-down-time", msSince(m.odownSince),
+		"down-after-milliseconds", strconv.FormatInt(int64(m.downAfter/time.Millisecond), 10),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(int64(m.failoverTimeout/time.Millisecond), 10),
+		"failover-state", failoverStateNames[m.failoverState],
+	))
+}
+
+func replicaReply(r *instance) redis.Reply {
+	linkStatus := "err"
+	if r.masterLinkUp {
+		linkStatus = "ok"
+	}
+	return protocol.MakeMultiBulkReply(toBytes(
+		"name", r.addr(),
+		"ip", r.ip,
+		"port", strconv.Itoa(r.port),
+		"flags", flags(r, nil),
+		"last-ok-ping-reply", msSince(r.lastOk),
+		"last-ping-sent", msSince(r.lastPing),
+		"info-refresh", msSince(r.lastInfo),
+		"role-reported", r.role,
+		"role-reported-time", msSince(r.roleReported),
+		"s-down-time", msSince(r.sdownSince),
+		"master-link-status", linkStatus,
+		"master-host", r.masterHost,
+		"master-port", strconv.Itoa(r.masterPort),
+		"slave-repl-offset", strconv.FormatInt(r.replOffset, 10),
+	))
+}
+
+func sentinelReply(peer *instance) redis.Reply {
+	return protocol.MakeMultiBulkReply(toBytes(
+		"name", peer.addr(),
+		"ip", peer.ip,
+		"port", strconv.Itoa(peer.port),
+		"runid", peer.runId,
+		"flags", flags(peer, nil),
+		"last-ok-ping-reply", msSince(peer.lastOk),
+		"last-ping-sent", msSince(peer.lastPing),
+		"last-hello-message", msSince(peer.lastHello),
+		"s-down-time", msSince(peer.sdownSince),
+		"voted-leader", peer.leader,
+		"voted-leader-epoch", strconv.FormatInt(peer.leaderEpoch, 10),
+	))
+}
+
+func toBytes(values ...string) [][]byte {
+	result := make([][]byte, len(values))
+	for i, v := range values {
+		result[i] = []byte(v)
+	}
+	return result
+}
+
+// execInfo returns state of sentinel and monitored masters
+func (s *Sentinel) execInfo() redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var builder strings.Builder
+	builder.WriteString("# Sentinel\r\n")
+	builder.WriteString("sentinel_masters:" + strconv.Itoa(len(names)) + "\r\n")
+	builder.WriteString("sentinel_tilt:0\r\n")
+	builder.WriteString("sentinel_current_epoch:" + strconv.FormatInt(s.currentEpoch, 10) + "\r\n")
+	for i, name := range names {
+		m := s.masters[name]
+		status := "ok"
+		if !m.odownSince.IsZero() {
+			status = "odown"
+		} else if !m.inst.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		ip, port := m.currentAddr()
+		builder.WriteString("master" + strconv.Itoa(i) + ":name=" + name + ",status=" + status +
+			",address=" + ip + ":" + strconv.Itoa(port) + ",slaves=" + strconv.Itoa(len(m.replicas)) +
+			",sentinels=" + strconv.Itoa(len(m.sentinels)+1) + "\r\n")
+	}
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+// execRole returns role sentinel and names of monitored masters
+func (s *Sentinel) execRole() redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([][]byte, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, []byte(name))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("sentinel")),
+		protocol.MakeMultiBulkReply(names),
+	})
+}
+
+// execHello switches protocol version and returns information of sentinel, clients send it on connecting
+// usage: HELLO [protover]
+func execHello(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	if len(args) == 1 {
+		version, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		c.SetProtocol(version)
+	}
+	return protocol.MakeMapReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("server")), protocol.MakeBulkReply([]byte("godis")),
+		protocol.MakeBulkReply([]byte("proto")), protocol.MakeIntReply(int64(c.GetProtocol())),
+		protocol.MakeBulkReply([]byte("id")), protocol.MakeIntReply(int64(c.GetID())),
+		protocol.MakeBulkReply([]byte("mode")), protocol.MakeBulkReply([]byte("sentinel")),
+		protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte("sentinel")),
+		protocol.MakeBulkReply([]byte("modules")), protocol.MakeEmptyMultiBulkReply(),
+	}, c.GetProtocol() == 3)
+}
+
+// execClient handles CLIENT subcommands which clients send on connecting
+func (s *Sentinel) execClient(c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "id":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|id")
+		}
+		return protocol.MakeIntReply(int64(c.GetID()))
+	case "setname":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|setname")
+		}
+		name := string(args[1])
+		if strings.ContainsAny(name, " \n") {
+			return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		if name == "" {
+			s.clientNames.Delete(c.GetID())
+		} else {
+			s.clientNames.Store(c.GetID(), name)
+		}
+		return protocol.MakeOkReply()
+	case "getname":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|getname")
+		}
+		name, ok := s.clientNames.Load(c.GetID())
+		if !ok {
+			return protocol.MakeNullBulkReply()
+		}
+		return protocol.MakeBulkReply([]byte(name.(string)))
+	case "setinfo":
+		// library name and version are accepted but not kept
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("client|setinfo")
+		}
+		attr := strings.ToLower(string(args[1]))
+		if attr != "lib-name" && attr != "lib-ver" {
+			return protocol.MakeErrReply("ERR Unrecognized option '" + string(args[1]) + "'")
+		}
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CLIENT HELP.")
+}
@@ -0,0 +1,252 @@
+package sentinel
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// states of failover
+const (
+	failoverNone = iota
+	// failoverWaitStart means sentinel is waiting to be elected as leader by other sentinels
+	failoverWaitStart
+	failoverSelectSlave
+	failoverSendSlaveOfNoOne
+	// failoverWaitPromotion means SLAVEOF NO ONE has been sent, and sentinel waits for INFO reporting promotion
+	failoverWaitPromotion
+	// failoverReconfSlaves means other replicas are asked to replicate the promoted one
+	failoverReconfSlaves
+)
+
+var failoverStateNames = []string{"none", "wait_start", "select_slave", "send_slaveof_noone",
+	"wait_promotion", "reconf_slaves"}
+
+// setFailoverState changes failover state and publishes it, invoker should hold s.mu
+func (s *Sentinel) setFailoverState(m *master, state int) {
+	m.failoverState = state
+	m.failoverStateTime = time.Now()
+	if state != failoverNone {
+		s.event("+failover-state-"+failoverStateNames[state], m, m.inst, "")
+	}
+}
+
+func (m *master) resetFailover() {
+	m.failoverState = failoverNone
+	m.failoverStateTime = time.Now()
+	m.forced = false
+	m.promoted = nil
+}
+
+// startFailover starts failover in a new epoch, invoker should hold s.mu
+func (s *Sentinel) startFailover(m *master, forced bool) {
+	s.currentEpoch++
+	s.publish("+new-epoch", strconv.FormatInt(s.currentEpoch, 10))
+	m.failoverEpoch = s.currentEpoch
+	m.forced = forced
+	m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(maxDesync))))
+	s.event("+try-failover", m, m.inst, "")
+	s.setFailoverState(m, failoverWaitStart)
+}
+
+// abortFailover stops failover before replicas are reconfigured, invoker should hold s.mu
+func (s *Sentinel) abortFailover(m *master, reason string) {
+	s.event("-failover-abort-"+reason, m, m.inst, "")
+	m.resetFailover()
+}
+
+// handleFailover starts failover once master is objectively down, and drives failover in progress,
+// invoker should hold s.mu
+func (s *Sentinel) handleFailover(m *master) {
+	now := time.Now()
+	switch m.failoverState {
+	case failoverNone:
+		// failover of the same master is not retried within twice failover timeout
+		if !m.odownSince.IsZero() && now.Sub(m.odownSince) >= m.failoverDelay &&
+			now.Sub(m.failoverStart) >= 2*m.failoverTimeout {
+			s.startFailover(m, false)
+		}
+	case failoverWaitStart:
+		leader := s.getLeader(m, m.failoverEpoch)
+		if leader != s.myId && !m.forced {
+			timeout := electionTimeout
+			if m.failoverTimeout < timeout {
+				timeout = m.failoverTimeout
+			}
+			if now.Sub(m.failoverStateTime) > timeout {
+				s.abortFailover(m, "not-elected")
+			}
+			return
+		}
+		s.event("+elected-leader", m, m.inst, "")
+		s.setFailoverState(m, failoverSelectSlave)
+		s.handleFailover(m)
+	case failoverSelectSlave:
+		r := s.selectReplica(m)
+		if r == nil {
+			s.abortFailover(m, "no-good-slave")
+			return
+		}
+		m.promoted = r
+		s.event("+selected-slave", m, r, "")
+		s.setFailoverState(m, failoverSendSlaveOfNoOne)
+		s.handleFailover(m)
+	case failoverSendSlaveOfNoOne:
+		r := m.promoted
+		if !r.sdownSince.IsZero() {
+			if now.Sub(m.failoverStateTime) > m.failoverTimeout {
+				s.abortFailover(m, "slave-timeout")
+			}
+			return
+		}
+		// promotion is found by INFO, failure of SLAVEOF is handled by timeout of waiting promotion
+		go s.sendSlaveOf(r, "", 0)
+		s.setFailoverState(m, failoverWaitPromotion)
+	case failoverWaitPromotion:
+		if now.Sub(m.failoverStateTime) > m.failoverTimeout {
+			s.abortFailover(m, "slave-timeout")
+		}
+	case failoverReconfSlaves:
+		s.reconfReplicas(m)
+	}
+}
+
+// selectReplica chooses the replica to be promoted, it is the available replica with the largest offset,
+// invoker should hold s.mu
+func (s *Sentinel) selectReplica(m *master) *instance {
+	now := time.Now()
+	var best *instance
+	for _, r := range m.replicaList() {
+		if !r.sdownSince.IsZero() || r.role != "slave" ||
+			now.Sub(r.lastOk) > 5*pingPeriod || now.Sub(r.lastInfo) > 5*s.infoPeriod(m, r) {
+			continue
+		}
+		if best == nil || r.replOffset > best.replOffset {
+			best = r
+		}
+	}
+	return best
+}
+
+// reconfReplicas asks other replicas to replicate the promoted one, failover ends once all available replicas
+// are replicating it or failover times out. Invoker should hold s.mu
+func (s *Sentinel) reconfReplicas(m *master) {
+	promoted := m.promoted
+	done := true
+	for _, r := range m.replicaList() {
+		if r == promoted || !r.sdownSince.IsZero() {
+			continue
+		}
+		if !r.reconfSent {
+			r.reconfSent = true
+			s.event("+slave-reconf-sent", m, r, "")
+			go s.sendSlaveOf(r, promoted.ip, promoted.port)
+		}
+		if r.role != "slave" || r.masterHost != promoted.ip || r.masterPort != promoted.port {
+			done = false
+			continue
+		}
+		if !r.reconfInprog {
+			r.reconfInprog = true
+			s.event("+slave-reconf-inprog", m, r, "")
+		}
+		if !r.masterLinkUp {
+			done = false
+			continue
+		}
+		if !r.reconfDone {
+			r.reconfDone = true
+			// clients routing reads to replicas refresh their replica list on this event
+			s.event("+slave-reconf-done", m, r, "")
+		}
+	}
+	if !done && time.Since(m.failoverStateTime) <= m.failoverTimeout {
+		return
+	}
+	s.event("+failover-end", m, m.inst, "")
+	s.switchMaster(m, promoted.ip, promoted.port)
+}
+
+// voteLeader votes for the sentinel requesting to be leader in the epoch, it returns the leader voted and its epoch.
+// Each sentinel votes for one leader in an epoch. Invoker should hold s.mu
+func (s *Sentinel) voteLeader(m *master, epoch int64, runId string) (string, int64) {
+	s.updateEpoch(epoch)
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = runId
+		m.leaderEpoch = s.currentEpoch
+		s.event("+vote-for-leader", m, m.inst, runId+" "+strconv.FormatInt(m.leaderEpoch, 10))
+		if runId != s.myId {
+			// don't start a failover competing with the voted leader
+			m.failoverStart = time.Now().Add(time.Duration(rand.Int63n(int64(maxDesync))))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// getLeader returns the leader of the epoch if it has been voted by majority of sentinels and no less than quorum,
+// otherwise it returns empty string. Invoker should hold s.mu
+func (s *Sentinel) getLeader(m *master, epoch int64) string {
+	votes := make(map[string]int)
+	for _, peer := range m.sentinels {
+		if peer.leader != "" && peer.leaderEpoch == epoch {
+			votes[peer.leader]++
+		}
+	}
+	winner, maxVotes := mostVoted(votes)
+	// this sentinel votes for the winner, or itself if no one has been voted
+	myVote := s.myId
+	if winner != "" {
+		myVote = winner
+	}
+	leader, leaderEpoch := s.voteLeader(m, epoch, myVote)
+	if leaderEpoch == epoch {
+		votes[leader]++
+	}
+	winner, maxVotes = mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if maxVotes < voters/2+1 || maxVotes < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) (string, int) {
+	winner, maxVotes := "", 0
+	for runId, n := range votes {
+		// tie is broken by run id, so that all sentinels find the same winner
+		if n > maxVotes || n == maxVotes && runId < winner {
+			winner, maxVotes = runId, n
+		}
+	}
+	return winner, maxVotes
+}
+
+// processAskReply records reply of sentinel to is-master-down-by-addr, which is down state, leader and its epoch
+func (s *Sentinel) processAskReply(m *master, peer *instance, reply redis.Reply) {
+	raw, ok := reply.(*protocol.MultiRawReply)
+	if !ok || len(raw.Replies) != 3 {
+		return
+	}
+	down, ok1 := raw.Replies[0].(*protocol.IntReply)
+	leader, ok2 := raw.Replies[1].(*protocol.BulkReply)
+	leaderEpoch, ok3 := raw.Replies[2].(*protocol.IntReply)
+	if !ok1 || !ok2 || !ok3 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer.removed {
+		return
+	}
+	peer.masterDown = down.Code == 1
+	peer.masterDownReplyTime = time.Now()
+	if string(leader.Arg) != "*" {
+		if peer.leaderEpoch != leaderEpoch.Code {
+			s.event("+vote-for-leader", m, peer, string(leader.Arg)+" "+strconv.FormatInt(leaderEpoch.Code, 10))
+		}
+		peer.leader = string(leader.Arg)
+		peer.leaderEpoch = leaderEpoch.Code
+	}
+}
@@ -0,0 +1,486 @@
+package sentinel
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of instance
+const (
+	kindMaster = iota
+	kindReplica
+	kindSentinel
+)
+
+var kindNames = []string{"master", "slave", "sentinel"}
+
+// instance is a master, replica or sentinel watched by sentinel, its fields except running are guarded by Sentinel.mu
+type instance struct {
+	kind int
+	ip   string
+	port int
+	// runId is id of sentinel
+	runId string
+	link  *link
+	// sub is the connection subscribing hello messages of master or replica, it is nil if not connected
+	sub net.Conn
+	// running is 1 while instance is being refreshed by a goroutine
+	running int32
+	// removed means instance is no longer monitored, such as the former master after failover
+	removed bool
+
+	// lastOk is when instance replied PING successfully, it is the creation time before the first reply
+	lastOk   time.Time
+	lastPing time.Time
+	lastInfo time.Time
+	// lastHello is when hello was published to master or replica, or received from sentinel
+	lastHello time.Time
+	// sdownSince is when instance became subjectively down, it is zero if instance is available
+	sdownSince time.Time
+
+	// role is reported by INFO, roleReported is when it was changed
+	role         string
+	roleReported time.Time
+	// masterHost, masterPort, masterLinkUp and replOffset are reported by INFO of replica
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	replOffset   int64
+	// reconfTime is when SLAVEOF was sent to fix replica
+	reconfTime time.Time
+	// reconfSent, reconfInprog and reconfDone are progress of replicating the promoted replica during failover,
+	// they mean SLAVEOF has been sent, replica has switched its master, and it has synced with the new master
+	reconfSent   bool
+	reconfInprog bool
+	reconfDone   bool
+
+	// masterDown is the latest reply of sentinel to is-master-down-by-addr, it is valid for a while since reply time
+	masterDown          bool
+	masterDownReplyTime time.Time
+	lastAsk             time.Time
+	// leader and leaderEpoch are the latest vote of sentinel
+	leader      string
+	leaderEpoch int64
+}
+
+func makeInstance(kind int, ip string, port int) *instance {
+	now := time.Now()
+	return &instance{
+		kind:         kind,
+		ip:           ip,
+		port:         port,
+		link:         makeLink(net.JoinHostPort(ip, strconv.Itoa(port))),
+		lastOk:       now,
+		roleReported: now,
+	}
+}
+
+func (inst *instance) addr() string {
+	return net.JoinHostPort(inst.ip, strconv.Itoa(inst.port))
+}
+
+// close closes links of instance, invoker should hold Sentinel.mu
+func (inst *instance) close() {
+	inst.removed = true
+	inst.link.close()
+	if inst.sub != nil {
+		_ = inst.sub.Close()
+		inst.sub = nil
+	}
+}
+
+// master is a monitored master with its replicas and other sentinels monitoring it
+type master struct {
+	name            string
+	inst            *instance
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	// configEpoch is the epoch of failover which promoted current master
+	configEpoch int64
+	replicas    map[string]*instance // addr -> replica
+	sentinels   map[string]*instance // run id -> sentinel
+	odownSince  time.Time
+	// failoverDelay is a random delay since objectively down before starting failover,
+	// so that sentinels are unlikely to ask for votes at the same time
+	failoverDelay time.Duration
+
+	// leader and leaderEpoch are the latest vote of this sentinel
+	leader      string
+	leaderEpoch int64
+
+	failoverState     int
+	failoverEpoch     int64
+	failoverStart     time.Time
+	failoverStateTime time.Time
+	// forced means failover is started by SENTINEL FAILOVER, which doesn't need agreement of other sentinels
+	forced   bool
+	promoted *instance
+}
+
+func (m *master) replicaList() []*instance {
+	replicas := make([]*instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].addr() < replicas[j].addr()
+	})
+	return replicas
+}
+
+func (m *master) sentinelList() []*instance {
+	sentinels := make([]*instance, 0, len(m.sentinels))
+	for _, peer := range m.sentinels {
+		sentinels = append(sentinels, peer)
+	}
+	sort.Slice(sentinels, func(i, j int) bool {
+		return sentinels[i].addr() < sentinels[j].addr()
+	})
+	return sentinels
+}
+
+func (m *master) instances() []*instance {
+	return append(append([]*instance{m.inst}, m.replicaList()...), m.sentinelList()...)
+}
+
+// currentAddr returns address of master, it is the promoted replica once it has been promoted in failover
+func (m *master) currentAddr() (string, int) {
+	if m.failoverState == failoverReconfSlaves && m.promoted != nil {
+		return m.promoted.ip, m.promoted.port
+	}
+	return m.inst.ip, m.inst.port
+}
+
+// refresh pings instance, and refreshes INFO and exchanges hello messages with other sentinels through masters and
+// replicas, or asks sentinel whether master is down. Commands are sent if their periods have passed.
+func (s *Sentinel) refresh(m *master, inst *instance) {
+	s.mu.Lock()
+	now := time.Now()
+	ping := now.Sub(inst.lastPing) >= pingPeriod
+	if ping {
+		inst.lastPing = now
+	}
+	info, hello, subscribe := false, false, false
+	var askCmd [][]byte
+	if inst.kind == kindSentinel {
+		if !m.inst.sdownSince.IsZero() && now.Sub(inst.lastAsk) >= askPeriod {
+			inst.lastAsk = now
+			// ask for vote once failover started
+			runId := "*"
+			if m.failoverState != failoverNone {
+				runId = s.myId
+			}
+			askCmd = utils.ToCmdLine("SENTINEL", "is-master-down-by-addr", m.inst.ip, strconv.Itoa(m.inst.port),
+				strconv.FormatInt(s.currentEpoch, 10), runId)
+		}
+	} else {
+		info = now.Sub(inst.lastInfo) >= s.infoPeriod(m, inst)
+		hello = now.Sub(inst.lastHello) >= helloPeriod
+		if hello {
+			inst.lastHello = now
+		}
+		subscribe = inst.sub == nil
+	}
+	s.mu.Unlock()
+
+	if ping {
+		reply, err := inst.link.send(utils.ToCmdLine("PING"))
+		if err == nil && isValidPong(reply) {
+			s.mu.Lock()
+			inst.lastOk = time.Now()
+			s.mu.Unlock()
+		}
+	}
+	if askCmd != nil {
+		reply, err := inst.link.send(askCmd)
+		if err == nil {
+			s.processAskReply(m, inst, reply)
+		}
+	}
+	if info {
+		reply, err := inst.link.send(utils.ToCmdLine("INFO", "replication"))
+		if bulk, ok := reply.(*protocol.BulkReply); err == nil && ok {
+			s.processInfo(m, inst, string(bulk.Arg))
+		}
+	}
+	if subscribe {
+		s.subscribeHello(m, inst)
+	}
+	if hello {
+		s.sendHello(m, inst)
+	}
+}
+
+func isValidPong(reply interface{}) bool {
+	switch r := reply.(type) {
+	case *protocol.StatusReply:
+		return r.Status == "PONG"
+	case *protocol.PongReply:
+		return true
+	case *protocol.StandardErrReply:
+		// instance is alive even if it is loading data or its link with master is down
+		return strings.HasPrefix(r.Status, "LOADING") || strings.HasPrefix(r.Status, "MASTERDOWN")
+	}
+	return false
+}
+
+// infoPeriod returns interval of refreshing INFO, replicas are refreshed more often while master is down
+// so that promotion is found soon, invoker should hold s.mu
+func (s *Sentinel) infoPeriod(m *master, inst *instance) time.Duration {
+	if inst.kind == kindReplica && (!m.inst.sdownSince.IsZero() || m.failoverState != failoverNone) {
+		return infoPeriod / 10
+	}
+	return infoPeriod
+}
+
+// processInfo discovers replicas from INFO of master, and finds out promotion and misconfigured replicas
+func (s *Sentinel) processInfo(m *master, inst *instance, info string) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inst.removed {
+		return
+	}
+	now := time.Now()
+	inst.lastInfo = now
+	role := fields["role"]
+	if role != inst.role {
+		inst.role = role
+		inst.roleReported = now
+	}
+	if role == "slave" {
+		port, _ := strconv.Atoi(fields["master_port"])
+		if fields["master_host"] != inst.masterHost || port != inst.masterPort {
+			inst.masterHost = fields["master_host"]
+			inst.masterPort = port
+		}
+		inst.masterLinkUp = fields["master_link_status"] == "up"
+		inst.replOffset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	}
+
+	if inst == m.inst && role == "master" {
+		for key, value := range fields {
+			if !strings.HasPrefix(key, "slave") || strings.Contains(key, "_") {
+				continue
+			}
+			ip, port := parseReplicaInfo(value)
+			if ip == "" {
+				continue
+			}
+			addr := net.JoinHostPort(ip, strconv.Itoa(port))
+			if _, ok := m.replicas[addr]; !ok && addr != inst.addr() {
+				r := makeInstance(kindReplica, ip, port)
+				m.replicas[addr] = r
+				s.event("+slave", m, r, "")
+			}
+		}
+		return
+	}
+	if inst.kind != kindReplica {
+		return
+	}
+	if m.failoverState == failoverWaitPromotion && inst == m.promoted && role == "master" {
+		m.configEpoch = m.failoverEpoch
+		s.event("+promoted-slave", m, inst, "")
+		s.setFailoverState(m, failoverReconfSlaves)
+		return
+	}
+	s.fixReplica(m, inst)
+}
+
+// parseReplicaInfo parses address of a slave line in INFO, such as ip=127.0.0.1,port=6380,state=online
+func parseReplicaInfo(value string) (string, int) {
+	var ip string
+	var port int
+	for _, kv := range strings.Split(value, ",") {
+		if strings.HasPrefix(kv, "ip=") {
+			ip = kv[len("ip="):]
+		} else if strings.HasPrefix(kv, "port=") {
+			port, _ = strconv.Atoi(kv[len("port="):])
+		}
+	}
+	if port <= 0 {
+		return "", 0
+	}
+	return ip, port
+}
+
+// fixReplica asks replica to replicate master if it reports to be a master or replicating another one for a while,
+// such as the former master coming back after failover. Invoker should hold s.mu
+func (s *Sentinel) fixReplica(m *master, r *instance) {
+	if m.failoverState != failoverNone || !m.inst.sdownSince.IsZero() || m.inst.role != "master" {
+		return
+	}
+	if r.role == "slave" && r.masterHost == m.inst.ip && r.masterPort == m.inst.port {
+		return
+	}
+	now := time.Now()
+	// wait for the role to be stable, and don't flood replica with SLAVEOF
+	if now.Sub(r.roleReported) < 2*infoPeriod || now.Sub(r.reconfTime) < 2*infoPeriod {
+		return
+	}
+	r.reconfTime = now
+	if r.role == "master" {
+		s.event("+convert-to-slave", m, r, "")
+	} else {
+		s.event("+fix-slave-config", m, r, "")
+	}
+	go s.sendSlaveOf(r, m.inst.ip, m.inst.port)
+}
+
+// sendSlaveOf asks instance to replicate the given master, it is promoted to master if ip is empty
+func (s *Sentinel) sendSlaveOf(inst *instance, ip string, port int) bool {
+	cmdLine := utils.ToCmdLine("SLAVEOF", "NO", "ONE")
+	if ip != "" {
+		cmdLine = utils.ToCmdLine("SLAVEOF", ip, strconv.Itoa(port))
+	}
+	reply, err := inst.link.send(cmdLine)
+	if err != nil {
+		logger.Warn("send SLAVEOF to " + inst.addr() + " failed: " + err.Error())
+		return false
+	}
+	if protocol.IsErrorReply(reply) {
+		logger.Warn("send SLAVEOF to " + inst.addr() + " failed: " + string(reply.ToBytes()))
+		return false
+	}
+	return true
+}
+
+// sendHello publishes address of this sentinel and configuration of master through master or replica,
+// the format is ip,port,run id,current epoch,master name,master ip,master port,master config epoch
+func (s *Sentinel) sendHello(m *master, inst *instance) {
+	ip := s.announceIP
+	if ip == "" {
+		ip = inst.link.localIP()
+		if ip == "" {
+			return
+		}
+	}
+	s.mu.Lock()
+	masterIP, masterPort := m.currentAddr()
+	msg := fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ip, s.announcePort, s.myId, s.currentEpoch,
+		m.name, masterIP, masterPort, m.configEpoch)
+	s.mu.Unlock()
+	_, _ = inst.link.send(utils.ToCmdLine("PUBLISH", helloChannel, msg))
+}
+
+// subscribeHello connects instance to receive hello messages of other sentinels
+func (s *Sentinel) subscribeHello(m *master, inst *instance) {
+	conn, err := net.DialTimeout("tcp", inst.addr(), linkTimeout)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SUBSCRIBE", helloChannel)).ToBytes())
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	s.mu.Lock()
+	if inst.sub != nil || inst.removed {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	inst.sub = conn
+	s.mu.Unlock()
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		ch := parser.ParseStream(conn)
+		for payload := range ch {
+			if payload.Err != nil {
+				if strings.HasPrefix(payload.Err.Error(), "protocol error") {
+					continue
+				}
+				break
+			}
+			msg, ok := payload.Data.(*protocol.MultiBulkReply)
+			if ok && len(msg.Args) == 3 && string(msg.Args[0]) == "message" {
+				s.processHello(string(msg.Args[2]))
+			}
+		}
+		go drain(ch)
+		_ = conn.Close()
+		s.mu.Lock()
+		if inst.sub == conn {
+			inst.sub = nil
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// processHello discovers other sentinels and updates configuration of master if the hello has a newer one
+func (s *Sentinel) processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	port, err1 := strconv.Atoi(fields[1])
+	epoch, err2 := strconv.ParseInt(fields[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(fields[6])
+	configEpoch, err4 := strconv.ParseInt(fields[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+	ip, runId, masterName, masterIP := fields[0], fields[2], fields[4], fields[5]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if runId == s.myId {
+		return
+	}
+	m, ok := s.masters[masterName]
+	if !ok {
+		return
+	}
+	s.updateEpoch(epoch)
+	peer, ok := m.sentinels[runId]
+	if !ok || peer.ip != ip || peer.port != port {
+		if ok {
+			peer.close()
+		}
+		// sentinel restarted with a new run id or moved to another address
+		for id, other := range m.sentinels {
+			if other.ip == ip && other.port == port {
+				other.close()
+				delete(m.sentinels, id)
+			}
+		}
+		peer = makeInstance(kindSentinel, ip, port)
+		peer.runId = runId
+		m.sentinels[runId] = peer
+		s.event("+sentinel", m, peer, runId)
+	}
+	peer.lastHello = time.Now()
+
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if masterIP != m.inst.ip || masterPort != m.inst.port {
+			s.switchMaster(m, masterIP, masterPort)
+		}
+	}
+}
+
+// updateEpoch updates current epoch if epoch is newer, invoker should hold s.mu
+func (s *Sentinel) updateEpoch(epoch int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.publish("+new-epoch", strconv.FormatInt(epoch, 10))
+	}
+}
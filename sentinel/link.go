@@ -0,0 +1,98 @@
+package sentinel
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+// linkTimeout is the max time to connect an instance or to wait for a reply
+var linkTimeout = time.Second
+
+// link is a connection from sentinel to an instance, commands are sent one by one
+// and it reconnects on the next command once connection is broken
+type link struct {
+	mu   sync.Mutex
+	addr string
+	conn net.Conn
+	ch   <-chan *parser.Payload
+}
+
+func makeLink(addr string) *link {
+	return &link{addr: addr}
+}
+
+// send sends command and waits for its reply
+func (l *link) send(cmdLine [][]byte) (redis.Reply, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.addr, linkTimeout)
+		if err != nil {
+			return nil, err
+		}
+		l.conn = conn
+		l.ch = parser.ParseStream(conn)
+	}
+	_ = l.conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	_, err := l.conn.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+	if err != nil {
+		l.closeWithMutex()
+		return nil, err
+	}
+	timer := time.NewTimer(linkTimeout)
+	defer timer.Stop()
+	select {
+	case payload, ok := <-l.ch:
+		if !ok {
+			l.closeWithMutex()
+			return nil, errors.New("connection closed")
+		}
+		if payload.Err != nil {
+			l.closeWithMutex()
+			return nil, payload.Err
+		}
+		return payload.Data, nil
+	case <-timer.C:
+		// late reply would be taken as reply of the next command, so the connection is dropped
+		l.closeWithMutex()
+		return nil, errors.New("timeout")
+	}
+}
+
+// localIP returns ip of local side of the connection, it is empty if not connected
+func (l *link) localIP() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+	return host
+}
+
+func (l *link) closeWithMutex() {
+	if l.conn == nil {
+		return
+	}
+	_ = l.conn.Close()
+	// parser sends the error of closed connection before it exits
+	go drain(l.ch)
+	l.conn = nil
+	l.ch = nil
+}
+
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeWithMutex()
+}
+
+func drain(ch <-chan *parser.Payload) {
+	for range ch {
+	}
+}
@@ -0,0 +1,379 @@
+// Package sentinel monitors masters and their replicas, agrees with other sentinels that a master is down,
+// and promotes one of its replicas to be the new master.
+// Sentinel runs in the same binary as godis server, it serves SENTINEL commands instead of data commands.
+package sentinel
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/pubsub"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	helloChannel = "__sentinel__:hello"
+	runIdLen     = 40
+)
+
+// periods of sentinel, they are variables so that tests could shorten them
+var (
+	cronPeriod  = 100 * time.Millisecond
+	pingPeriod  = time.Second
+	infoPeriod  = 10 * time.Second
+	helloPeriod = 2 * time.Second
+	// askPeriod is the interval of asking other sentinels whether master is down while it is subjectively down
+	askPeriod = time.Second
+	// maxDesync is the max random delay of starting failover, so that sentinels are unlikely to start together
+	maxDesync = time.Second
+	// electionTimeout is the max time waiting for being elected as leader of failover
+	electionTimeout = 10 * time.Second
+)
+
+const (
+	defaultDownAfter       = 30 * time.Second
+	defaultFailoverTimeout = 3 * time.Minute
+)
+
+// Sentinel implements database.DB, it monitors masters by a cron
+type Sentinel struct {
+	mu   sync.Mutex
+	myId string
+	// announceIP is the ip announced to other sentinels by hello messages, use ip of local side of link if not set
+	announceIP   string
+	announcePort int
+	// currentEpoch is the latest epoch known by this sentinel, epoch increases when a failover starts
+	currentEpoch int64
+	masters      map[string]*master
+	// hub delivers events like +switch-master to clients
+	hub *pubsub.Hub
+	// clientNames is connection id -> name set by CLIENT SETNAME
+	clientNames sync.Map
+	closed      chan struct{}
+}
+
+// MakeSentinel creates a sentinel monitoring masters in config and starts its cron
+func MakeSentinel() *Sentinel {
+	s := makeSentinel(config.Properties().SentinelAnnounceIP, config.Properties().Port)
+	for _, monitor := range config.Properties().SentinelMonitor {
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			logger.Error("illegal sentinel-monitor: " + monitor)
+			continue
+		}
+		port, err1 := strconv.Atoi(fields[2])
+		quorum, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			logger.Error("illegal sentinel-monitor: " + monitor)
+			continue
+		}
+		if err := s.monitor(fields[0], fields[1], port, quorum); err != nil {
+			logger.Error("monitor " + fields[0] + " failed: " + err.Error())
+		}
+	}
+	s.start()
+	return s
+}
+
+func makeSentinel(announceIP string, announcePort int) *Sentinel {
+	return &Sentinel{
+		myId:         genRunId(),
+		announceIP:   announceIP,
+		announcePort: announcePort,
+		masters:      make(map[string]*master),
+		hub:          pubsub.MakeHub(),
+		closed:       make(chan struct{}),
+	}
+}
+
+func genRunId() string {
+	raw := make([]byte, runIdLen/2)
+	_, _ = cryptorand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// monitor starts monitoring master at ip:port with the given quorum
+func (s *Sentinel) monitor(name string, ip string, port int, quorum int) error {
+	if quorum <= 0 {
+		return errors.New("Quorum must be 1 or greater.")
+	}
+	if port <= 0 || port > 65535 {
+		return errors.New("Invalid port number")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.masters[name]; ok {
+		return errors.New("Duplicated master name")
+	}
+	downAfter := defaultDownAfter
+	if config.Properties().SentinelDownAfterMilliseconds > 0 {
+		downAfter = time.Duration(config.Properties().SentinelDownAfterMilliseconds) * time.Millisecond
+	}
+	failoverTimeout := defaultFailoverTimeout
+	if config.Properties().SentinelFailoverTimeout > 0 {
+		failoverTimeout = time.Duration(config.Properties().SentinelFailoverTimeout) * time.Millisecond
+	}
+	m := &master{
+		name:            name,
+		quorum:          quorum,
+		downAfter:       downAfter,
+		failoverTimeout: failoverTimeout,
+		replicas:        make(map[string]*instance),
+		sentinels:       make(map[string]*instance),
+	}
+	m.inst = makeInstance(kindMaster, ip, port)
+	s.masters[name] = m
+	s.event("+monitor", m, m.inst, "quorum "+strconv.Itoa(quorum))
+	return nil
+}
+
+func (s *Sentinel) start() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("panic", err)
+			}
+		}()
+		ticker := time.NewTicker(cronPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.cron()
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Sentinel) cron() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.masters {
+		s.schedule(m, m.inst)
+		for _, r := range m.replicas {
+			s.schedule(m, r)
+		}
+		for _, peer := range m.sentinels {
+			s.schedule(m, peer)
+		}
+		s.checkDown(m)
+		s.handleFailover(m)
+	}
+}
+
+// schedule starts refreshing instance if it isn't being refreshed
+func (s *Sentinel) schedule(m *master, inst *instance) {
+	if !atomic.CompareAndSwapInt32(&inst.running, 0, 1) {
+		return
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(fmt.Sprintf("refresh %s failed: %v\n%s", inst.addr(), err, string(debug.Stack())))
+			}
+			atomic.StoreInt32(&inst.running, 0)
+		}()
+		s.refresh(m, inst)
+	}()
+}
+
+// checkDown updates subjectively down state of instances and objectively down state of master,
+// invoker should hold s.mu
+func (s *Sentinel) checkDown(m *master) {
+	now := time.Now()
+	for _, inst := range m.instances() {
+		if now.Sub(inst.lastOk) > m.downAfter {
+			if inst.sdownSince.IsZero() {
+				inst.sdownSince = now
+				s.event("+sdown", m, inst, "")
+			}
+		} else if !inst.sdownSince.IsZero() {
+			inst.sdownSince = time.Time{}
+			s.event("-sdown", m, inst, "")
+		}
+	}
+
+	votes := 0
+	if !m.inst.sdownSince.IsZero() {
+		votes = 1
+		for _, peer := range m.sentinels {
+			// replies of other sentinels are valid for a while
+			if peer.masterDown && now.Sub(peer.masterDownReplyTime) < 5*askPeriod {
+				votes++
+			}
+		}
+	}
+	if votes >= m.quorum {
+		if m.odownSince.IsZero() {
+			m.odownSince = now
+			m.failoverDelay = time.Duration(rand.Int63n(int64(maxDesync)))
+			s.event("+odown", m, m.inst, "#quorum "+strconv.Itoa(votes)+"/"+strconv.Itoa(m.quorum))
+		}
+	} else if !m.odownSince.IsZero() {
+		m.odownSince = time.Time{}
+		s.event("-odown", m, m.inst, "")
+	}
+}
+
+// event logs what happened to instance and publishes it to clients subscribing channel named by type,
+// invoker should hold s.mu
+func (s *Sentinel) event(typ string, m *master, inst *instance, extra string) {
+	var msg string
+	if inst == m.inst {
+		msg = "master " + m.name + " " + inst.ip + " " + strconv.Itoa(inst.port)
+	} else {
+		msg = kindNames[inst.kind] + " " + inst.addr() + " " + inst.ip + " " + strconv.Itoa(inst.port) +
+			" @ " + m.name + " " + m.inst.ip + " " + strconv.Itoa(m.inst.port)
+	}
+	if extra != "" {
+		msg += " " + extra
+	}
+	s.publish(typ, msg)
+}
+
+func (s *Sentinel) publish(channel string, msg string) {
+	logger.Info(channel + " " + msg)
+	pubsub.Publish(s.hub, [][]byte{[]byte(channel), []byte(msg)})
+}
+
+// switchMaster starts monitoring the master at new address, other instances become its replicas,
+// invoker should hold s.mu
+func (s *Sentinel) switchMaster(m *master, ip string, port int) {
+	oldIP, oldPort := m.inst.ip, m.inst.port
+	newAddr := net.JoinHostPort(ip, strconv.Itoa(port))
+	replicas := make(map[string]*instance)
+	for _, inst := range append(m.replicaList(), m.inst) {
+		inst.close()
+		if inst.addr() == newAddr {
+			continue
+		}
+		replicas[inst.addr()] = makeInstance(kindReplica, inst.ip, inst.port)
+	}
+	m.inst = makeInstance(kindMaster, ip, port)
+	m.replicas = replicas
+	m.odownSince = time.Time{}
+	m.resetFailover()
+	s.publish("+switch-master", m.name+" "+oldIP+" "+strconv.Itoa(oldPort)+" "+ip+" "+strconv.Itoa(port))
+}
+
+// reset forgets replicas and sentinels of master and stops its failover, invoker should hold s.mu
+func (s *Sentinel) reset(m *master) {
+	for _, inst := range m.instances() {
+		inst.close()
+	}
+	m.inst = makeInstance(kindMaster, m.inst.ip, m.inst.port)
+	m.replicas = make(map[string]*instance)
+	m.sentinels = make(map[string]*instance)
+	m.odownSince = time.Time{}
+	m.leader = ""
+	m.leaderEpoch = 0
+	m.resetFailover()
+	s.event("+reset-master", m, m.inst, "")
+}
+
+// Exec executes commands of sentinel
+func (s *Sentinel) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "auth" {
+		return database.Auth(c, cmdLine[1:])
+	}
+	if !database.IsAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+	switch cmdName {
+	case "ping":
+		if len(cmdLine) > 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		// clients check health of subscribing connection by PING, which is replied in the form of pub/sub message
+		if c != nil && c.SubsCount() > 0 {
+			payload := []byte{}
+			if len(cmdLine) == 2 {
+				payload = cmdLine[1]
+			}
+			return protocol.MakeMultiBulkReply([][]byte{[]byte("pong"), payload})
+		}
+		if len(cmdLine) == 2 {
+			return protocol.MakeStatusReply(string(cmdLine[1]))
+		}
+		return &protocol.PongReply{}
+	case "hello":
+		return execHello(c, cmdLine[1:])
+	case "client":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return s.execClient(c, cmdLine[1:])
+	case "sentinel":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return s.execSentinel(cmdLine[1:])
+	case "info":
+		return s.execInfo()
+	case "role":
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return s.execRole()
+	case "subscribe":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return pubsub.Subscribe(s.hub, c, cmdLine[1:])
+	case "psubscribe":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		return pubsub.PSubscribe(s.hub, c, cmdLine[1:])
+	case "unsubscribe":
+		return pubsub.UnSubscribe(s.hub, c, cmdLine[1:])
+	case "punsubscribe":
+		return pubsub.PUnSubscribe(s.hub, c, cmdLine[1:])
+	}
+	return protocol.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in sentinel mode")
+}
+
+// AfterClientClose does some clean after client close connection
+func (s *Sentinel) AfterClientClose(c redis.Connection) {
+	pubsub.UnsubscribeAll(s.hub, c)
+	s.clientNames.Delete(c.GetID())
+}
+
+// Close stops cron and closes links with instances
+func (s *Sentinel) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	close(s.closed)
+	for _, m := range s.masters {
+		for _, inst := range m.instances() {
+			inst.close()
+		}
+	}
+}
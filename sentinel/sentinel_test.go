@@ -0,0 +1,359 @@
+package sentinel
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/database"
+	idatabase "github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveForTest serves db on a random port until stop is called or test ends
+func serveForTest(t *testing.T, listener net.Listener, db idatabase.DB) (stop func()) {
+	var mu sync.Mutex
+	var conns []net.Conn
+	var wg sync.WaitGroup
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			_ = listener.Close()
+			mu.Lock()
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			mu.Unlock()
+			wg.Wait()
+		})
+	}
+	t.Cleanup(stop)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client := connection.NewConn(conn)
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						break
+					}
+					r, ok := payload.Data.(*protocol.MultiBulkReply)
+					if !ok {
+						continue
+					}
+					reply := db.Exec(client, r.Args)
+					if _, ok := reply.(*protocol.NoReply); ok {
+						continue
+					}
+					_ = client.Write(reply.ToBytes())
+				}
+				_ = client.Close()
+				db.AfterClientClose(client)
+			}()
+		}
+	}()
+	return stop
+}
+
+func listenForTest(t *testing.T) (net.Listener, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener, listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor retries check until it returns true or times out
+func waitFor(timeout time.Duration, check func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if check() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func masterAddr(s *Sentinel, name string) string {
+	reply, ok := s.execSentinel(utils.ToCmdLine("get-master-addr-by-name", name)).(*protocol.MultiBulkReply)
+	if !ok || len(reply.Args) != 2 {
+		return ""
+	}
+	return string(reply.Args[0]) + ":" + string(reply.Args[1])
+}
+
+// assertVote checks reply of is-master-down-by-addr for master which is not down
+func assertVote(t *testing.T, actual redis.Reply, leader string, leaderEpoch int64) {
+	t.Helper()
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(0),
+		protocol.MakeBulkReply([]byte(leader)),
+		protocol.MakeIntReply(leaderEpoch),
+	})
+	if string(actual.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expected %q, actually %q", string(expected.ToBytes()), string(actual.ToBytes()))
+	}
+}
+
+func TestVoteLeader(t *testing.T) {
+	s := makeSentinel("127.0.0.1", 26379)
+	conn := &connection.FakeConn{}
+	result := s.Exec(conn, utils.ToCmdLine("sentinel", "monitor", "mymaster", "127.0.0.1", "6379", "0"))
+	asserts.AssertErrReply(t, result, "ERR Quorum must be 1 or greater.")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "monitor", "mymaster", "127.0.0.1", "6379", "2"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "monitor", "mymaster", "127.0.0.1", "6380", "2"))
+	asserts.AssertErrReply(t, result, "ERR Duplicated master name")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "get-master-addr-by-name", "mymaster"))
+	asserts.AssertMultiBulkReply(t, result, []string{"127.0.0.1", "6379"})
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "get-master-addr-by-name", "unknown"))
+	asserts.AssertNullBulk(t, result)
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "master", "unknown"))
+	asserts.AssertErrReply(t, result, "ERR No such master with that name")
+
+	// only the first sentinel asking in an epoch is voted
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "is-master-down-by-addr", "127.0.0.1", "6379", "1", "a"))
+	assertVote(t, result, "a", 1)
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "is-master-down-by-addr", "127.0.0.1", "6379", "1", "b"))
+	assertVote(t, result, "a", 1)
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "is-master-down-by-addr", "127.0.0.1", "6379", "2", "b"))
+	assertVote(t, result, "b", 2)
+	// old epoch doesn't change vote
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "is-master-down-by-addr", "127.0.0.1", "6379", "1", "c"))
+	assertVote(t, result, "b", 2)
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "is-master-down-by-addr", "127.0.0.1", "6399", "3", "c"))
+	assertVote(t, result, "*", 0)
+
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "ckquorum", "mymaster"))
+	asserts.AssertErrReply(t, result, "NOQUORUM 1 usable Sentinels. "+
+		"Not enough available Sentinels to reach the specified quorum for this master")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "set", "mymaster", "quorum", "1"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "ckquorum", "mymaster"))
+	asserts.AssertStatusReply(t, result, "OK 1 usable Sentinels. Quorum and failover authorization can be reached")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "failover", "mymaster"))
+	asserts.AssertErrReply(t, result, "NOGOODSLAVE No suitable replica to promote")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "remove", "mymaster"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = s.Exec(conn, utils.ToCmdLine("sentinel", "masters"))
+	if masters, ok := result.(*protocol.MultiRawReply); !ok || len(masters.Replies) != 0 {
+		t.Errorf("master should be removed")
+	}
+	result = s.Exec(conn, utils.ToCmdLine("get", "a"))
+	asserts.AssertErrReply(t, result, "ERR unknown command 'get', or not supported in sentinel mode")
+	s.Close()
+}
+
+func TestSentinelFailover(t *testing.T) {
+	savedPeriods := []time.Duration{pingPeriod, infoPeriod, helloPeriod, askPeriod, maxDesync}
+	pingPeriod = 100 * time.Millisecond
+	infoPeriod = 500 * time.Millisecond
+	helloPeriod = 200 * time.Millisecond
+	askPeriod = 100 * time.Millisecond
+	maxDesync = 500 * time.Millisecond
+	defer func() {
+		pingPeriod, infoPeriod, helloPeriod, askPeriod, maxDesync =
+			savedPeriods[0], savedPeriods[1], savedPeriods[2], savedPeriods[3], savedPeriods[4]
+	}()
+
+	replicaListener, replicaPort := listenForTest(t)
+	config.SetProperties(&config.ServerProperties{
+		ReplicaReadOnly:               true,
+		SlaveAnnouncePort:             replicaPort,
+		SentinelDownAfterMilliseconds: 500,
+		SentinelFailoverTimeout:       5000,
+	})
+	masterListener, masterPort := listenForTest(t)
+	master := database.NewStandaloneServer()
+	stopMaster := serveForTest(t, masterListener, master)
+	defer master.Close()
+	replica := database.NewStandaloneServer()
+	serveForTest(t, replicaListener, replica)
+	defer replica.Close()
+	conn := &connection.FakeConn{}
+	master.Exec(conn, utils.ToCmdLine("set", "a", "1"))
+	replica.Exec(conn, utils.ToCmdLine("slaveof", "127.0.0.1", strconv.Itoa(masterPort)))
+	if !waitFor(5*time.Second, func() bool {
+		reply, ok := replica.Exec(conn, utils.ToCmdLine("get", "a")).(*protocol.BulkReply)
+		return ok && string(reply.Arg) == "1"
+	}) {
+		t.Fatal("replica didn't sync with master")
+	}
+
+	sentinels := make([]*Sentinel, 3)
+	sentinelPorts := make([]int, 3)
+	for i := range sentinels {
+		listener, port := listenForTest(t)
+		sentinelPorts[i] = port
+		s := makeSentinel("127.0.0.1", port)
+		if err := s.monitor("mymaster", "127.0.0.1", masterPort, 2); err != nil {
+			t.Fatal(err)
+		}
+		s.start()
+		serveForTest(t, listener, s)
+		defer s.Close()
+		sentinels[i] = s
+	}
+	// clients find new master by subscribing +switch-master
+	subConn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(sentinelPorts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subConn.Close()
+	_, _ = subConn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("subscribe", "+switch-master")).ToBytes())
+	events := make(chan string, 1)
+	go func() {
+		for payload := range parser.ParseStream(subConn) {
+			if msg, ok := payload.Data.(*protocol.MultiBulkReply); ok && len(msg.Args) == 3 {
+				events <- string(msg.Args[2])
+			}
+		}
+	}()
+
+	// sentinels discover replica from master and each other by hello messages
+	if !waitFor(10*time.Second, func() bool {
+		for _, s := range sentinels {
+			replicas := s.Exec(conn, utils.ToCmdLine("sentinel", "replicas", "mymaster")).(*protocol.MultiRawReply)
+			peers := s.Exec(conn, utils.ToCmdLine("sentinel", "sentinels", "mymaster")).(*protocol.MultiRawReply)
+			if len(replicas.Replies) != 1 || len(peers.Replies) != 2 {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("sentinels didn't discover replica and each other")
+	}
+	result := sentinels[0].Exec(conn, utils.ToCmdLine("sentinel", "ckquorum", "mymaster"))
+	asserts.AssertStatusReply(t, result, "OK 3 usable Sentinels. Quorum and failover authorization can be reached")
+	info := string(sentinels[0].Exec(conn, utils.ToCmdLine("info")).(*protocol.BulkReply).Arg)
+	if !strings.Contains(info, "master0:name=mymaster,status=ok,address=127.0.0.1:"+strconv.Itoa(masterPort)+
+		",slaves=1,sentinels=3") {
+		t.Errorf("illegal info: %s", info)
+	}
+
+	stopMaster()
+	replicaAddr := "127.0.0.1:" + strconv.Itoa(replicaPort)
+	if !waitFor(20*time.Second, func() bool {
+		for _, s := range sentinels {
+			if masterAddr(s, "mymaster") != replicaAddr {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("failover failed")
+	}
+	role := replica.Exec(conn, utils.ToCmdLine("role")).(*protocol.MultiRawReply)
+	asserts.AssertBulkReply(t, role.Replies[0], "master")
+	result = replica.Exec(conn, utils.ToCmdLine("set", "b", "2"))
+	asserts.AssertStatusReply(t, result, "OK")
+	select {
+	case event := <-events:
+		expected := "mymaster 127.0.0.1 " + strconv.Itoa(masterPort) + " 127.0.0.1 " + strconv.Itoa(replicaPort)
+		if event != expected {
+			t.Errorf("expected +switch-master %s, actually %s", expected, event)
+		}
+	case <-time.After(time.Second):
+		t.Error("+switch-master should be published")
+	}
+	// former master is kept as replica, so it could be fixed after coming back
+	replicas := sentinels[0].Exec(conn, utils.ToCmdLine("sentinel", "replicas", "mymaster")).(*protocol.MultiRawReply)
+	if len(replicas.Replies) != 1 ||
+		string(replicas.Replies[0].(*protocol.MultiBulkReply).Args[1]) != "127.0.0.1:"+strconv.Itoa(masterPort) {
+		t.Errorf("former master should be replica")
+	}
+}
+
+func TestClientProtocol(t *testing.T) {
+	config.SetProperties(&config.ServerProperties{RequirePass: "secret"})
+	defer func() {
+		config.SetProperties(&config.ServerProperties{})
+	}()
+	s := makeSentinel("127.0.0.1", 26379)
+	defer s.Close()
+	if err := s.monitor("mymaster", "127.0.0.1", 6379, 2); err != nil {
+		t.Fatal(err)
+	}
+	listener, port := listenForTest(t)
+	serveForTest(t, listener, s)
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch := parser.ParseStream(conn)
+	send := func(args ...string) redis.Reply {
+		_, _ = conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+		return receiveForTest(t, ch)
+	}
+
+	asserts.AssertErrReply(t, send("sentinel", "get-master-addr-by-name", "mymaster"), "NOAUTH Authentication required")
+	asserts.AssertStatusReply(t, send("auth", "secret"), "OK")
+	asserts.AssertErrReply(t, send("hello", "4"), "NOPROTO unsupported protocol version")
+	asserts.AssertStatusReply(t, send("client", "setinfo", "lib-name", "go-redis"), "OK")
+	asserts.AssertStatusReply(t, send("client", "setname", "app"), "OK")
+	asserts.AssertBulkReply(t, send("client", "getname"), "app")
+	asserts.AssertMultiBulkReply(t, send("sentinel", "get-master-addr-by-name", "mymaster"),
+		[]string{"127.0.0.1", "6379"})
+
+	// replies are confirmations of subscribing both channels
+	send("subscribe", "+switch-master", "+slave-reconf-done")
+	receiveForTest(t, ch)
+	asserts.AssertMultiBulkReply(t, send("ping"), []string{"pong", ""})
+
+	// promoted replica is reported before failover ends, and other replicas are reported once synced with it
+	s.mu.Lock()
+	m := s.masters["mymaster"]
+	promoted := makeInstance(kindReplica, "127.0.0.1", 6380)
+	other := makeInstance(kindReplica, "127.0.0.1", 6381)
+	other.reconfSent = true
+	other.role, other.masterHost, other.masterPort, other.masterLinkUp = "slave", "127.0.0.1", 6380, true
+	m.replicas[promoted.addr()] = promoted
+	m.replicas[other.addr()] = other
+	m.promoted = promoted
+	s.setFailoverState(m, failoverReconfSlaves)
+	s.mu.Unlock()
+	if addr := masterAddr(s, "mymaster"); addr != "127.0.0.1:6380" {
+		t.Errorf("expected promoted replica 127.0.0.1:6380, actually %s", addr)
+	}
+	s.mu.Lock()
+	s.handleFailover(m)
+	s.mu.Unlock()
+	asserts.AssertMultiBulkReply(t, receiveForTest(t, ch), []string{"message", "+slave-reconf-done",
+		"slave 127.0.0.1:6381 127.0.0.1 6381 @ mymaster 127.0.0.1 6379"})
+	asserts.AssertMultiBulkReply(t, receiveForTest(t, ch), []string{"message", "+switch-master",
+		"mymaster 127.0.0.1 6379 127.0.0.1 6380"})
+}
+
+func receiveForTest(t *testing.T, ch <-chan *parser.Payload) redis.Reply {
+	t.Helper()
+	select {
+	case payload := <-ch:
+		if payload.Err != nil {
+			t.Fatal(payload.Err)
+		}
+		return payload.Data
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+// multiListener accepts connections from all listeners, so they are served by one handler
+type multiListener struct {
+	listeners []net.Listener
+	connCh    chan net.Conn
+	errCh     chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners ...net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners: listeners,
+		connCh:    make(chan net.Conn),
+		errCh:     make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.accept(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			ml.errCh <- err
+			return
+		}
+		select {
+		case ml.connCh <- conn:
+		case <-ml.done:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// Accept returns a connection accepted by any listener, it returns error once a listener fails
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.connCh:
+		return conn, nil
+	case err := <-ml.errCh:
+		return nil, err
+	}
+}
+
+// Close closes all listeners
+func (ml *multiListener) Close() error {
+	var err error
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, l := range ml.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns address of the first listener
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
@@ -6,12 +6,15 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/hdt3213/godis/interface/tcp"
 	"github.com/hdt3213/godis/lib/logger"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -19,38 +22,150 @@ import (
 
 // Config stores tcp server properties
 type Config struct {
-	Address    string        `yaml:"address"`
+	// Addresses are listened by plain tcp. If port of an address is 0, a free port is chosen by system
+	// and the following addresses with port 0 listen on the same port
+	Addresses  []string      `yaml:"addresses"`
 	MaxConnect uint32        `yaml:"max-connect"`
 	Timeout    time.Duration `yaml:"timeout"`
+	// TLSAddresses are listened by tls with TLSConfig
+	TLSAddresses []string    `yaml:"tls-addresses"`
+	TLSConfig    *tls.Config `yaml:"-"`
 }
 
-// ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal
-func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
+// Server holds listeners bound by Listen
+type Server struct {
+	listeners []net.Listener
+	port      int
+	tlsPort   int
+}
+
+// Listen binds all addresses of cfg, nothing is bound if any of them fails
+func Listen(cfg *Config) (*Server, error) {
+	server := &Server{}
+	var err error
+	server.port, err = server.listen(cfg.Addresses, func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	server.tlsPort, err = server.listen(cfg.TLSAddresses, func(addr string) (net.Listener, error) {
+		return tls.Listen("tcp", addr, cfg.TLSConfig)
+	})
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	if len(server.listeners) == 0 {
+		return nil, errors.New("no address to listen")
+	}
+	return server, nil
+}
+
+// listen binds addresses and returns the port listened, port 0 is replaced by the port chosen for the first of them
+func (server *Server) listen(addresses []string, listen func(addr string) (net.Listener, error)) (int, error) {
+	chosen := 0
+	for _, addr := range addresses {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return 0, err
+		}
+		if port == "0" && chosen > 0 {
+			addr = net.JoinHostPort(host, strconv.Itoa(chosen))
+		}
+		listener, err := listen(addr)
+		if err != nil {
+			return 0, err
+		}
+		server.listeners = append(server.listeners, listener)
+		if chosen == 0 {
+			chosen = listener.Addr().(*net.TCPAddr).Port
+		}
+		logger.Info(fmt.Sprintf("bind: %s, start listening...", listener.Addr().String()))
+	}
+	return chosen, nil
+}
+
+// Port returns port listened by plain tcp, it is chosen by system if configured port is 0
+func (server *Server) Port() int {
+	return server.port
+}
+
+// TLSPort returns port listened by tls
+func (server *Server) TLSPort() int {
+	return server.tlsPort
+}
+
+// Addrs returns all listened addresses
+func (server *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(server.listeners))
+	for _, l := range server.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Close closes all listeners, it is unnecessary after Serve which closes them before returning
+func (server *Server) Close() {
+	for _, l := range server.listeners {
+		_ = l.Close()
+	}
+}
+
+// Serve handles connections of all listeners, blocking until close
+func (server *Server) Serve(handler tcp.Handler, closeChan <-chan struct{}) {
+	if len(server.listeners) == 1 {
+		ListenAndServe(server.listeners[0], handler, closeChan)
+	} else {
+		ListenAndServe(newMultiListener(server.listeners...), handler, closeChan)
+	}
+}
+
+// ServeWithSignal handles connections of all listeners, blocking until receive stop signal.
+// SIGHUP asks handler to reload config if it implements tcp.Reloader
+func (server *Server) ServeWithSignal(handler tcp.Handler) {
 	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	reloader, _ := handler.(tcp.Reloader)
 	go func() {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+		for sig := range sigCh {
+			// SIGHUP reloads config if handler supports it, otherwise it stops server as before
+			if sig == syscall.SIGHUP && reloader != nil {
+				logger.Info("received SIGHUP, reloading config")
+				reloader.Reload()
+				continue
+			}
 			closeChan <- struct{}{}
+			return
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
+	server.Serve(handler, closeChan)
+}
+
+// ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal
+func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
+	server, err := Listen(cfg)
 	if err != nil {
 		return err
 	}
-	//cfg.Address = listener.Addr().String()
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
-	ListenAndServe(listener, handler, closeChan)
+	server.ServeWithSignal(handler)
 	return nil
 }
 
-// ListenAndServe binds port and handle requests, blocking until close
+// ListenAndServe binds port and handle requests, blocking until close or shutdown requested by handler
 func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+	var shutdownRequested <-chan struct{}
+	if notifier, ok := handler.(tcp.ShutdownNotifier); ok {
+		shutdownRequested = notifier.ShutdownRequested()
+	}
 	// listen signal
 	go func() {
-		<-closeChan
+		select {
+		case <-closeChan:
+		case <-shutdownRequested:
+		}
 		logger.Info("shutting down...")
 		_ = listener.Close() // listener.Accept() will return err immediately
 		_ = handler.Close()  // close connections
@@ -0,0 +1,60 @@
+package tcp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestListenPortZero(t *testing.T) {
+	server, err := Listen(&Config{
+		Addresses: []string{"127.0.0.1:0", "127.0.0.2:0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Port() == 0 {
+		t.Fatal("expect port chosen by system")
+	}
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("expect 2 addresses, actually %d", len(addrs))
+	}
+	for _, addr := range addrs {
+		if addr.(*net.TCPAddr).Port != server.Port() {
+			t.Errorf("expect %s listening on port %d", addr, server.Port())
+		}
+	}
+	closeChan := make(chan struct{})
+	go server.Serve(MakeEchoHandler(), closeChan)
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(server.Port())))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if reply, err := echo(conn, "hello"); err != nil || reply != "hello" {
+			t.Errorf("expect hello from %s, actually %s %v", host, reply, err)
+		}
+		_ = conn.Close()
+	}
+	closeChan <- struct{}{}
+
+	// Listen fails if any address is in use
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = occupied.Close()
+	}()
+	_, err = Listen(&Config{
+		Addresses: []string{"127.0.0.2:0", occupied.Addr().String()},
+	})
+	if err == nil {
+		t.Error("expect error when address is in use")
+	}
+	if _, err = Listen(&Config{}); err == nil {
+		t.Error("expect error when there is no address")
+	}
+}
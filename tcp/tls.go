@@ -0,0 +1,54 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// TLSSettings gives files of certificate and how client certificates are verified
+type TLSSettings struct {
+	CertFile string
+	KeyFile  string
+	// CACertFile contains certificates of CA signing client certificates, client certificates are not verified if empty
+	CACertFile string
+	// AuthClients is "yes" (default) requiring clients to present certificates signed by CA,
+	// "optional" verifying certificates only if clients present them, or "no" ignoring them
+	AuthClients string
+}
+
+// MakeTLSConfig loads certificates and makes tls.Config for listener
+func MakeTLSConfig(settings *TLSSettings) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if settings.CACertFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(settings.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + settings.CACertFile)
+	}
+	cfg.ClientCAs = pool
+	switch settings.AuthClients {
+	case "", "yes":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+	default:
+		return nil, errors.New("illegal tls-auth-clients: " + settings.AuthClients)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,143 @@
+package tcp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeCert signs a certificate by parent, it is self-signed if parent is nil
+func makeCert(t *testing.T, serial int64, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "gedis"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	parentCert, parentKey := template, interface{}(key)
+	if parent != nil {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, filename string, blockType string, data []byte) {
+	err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func echo(conn net.Conn, line string) (string, error) {
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err := conn.Write([]byte(line + "\n"))
+	if err != nil {
+		return "", err
+	}
+	reply, _, err := bufio.NewReader(conn).ReadLine()
+	return string(reply), err
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, 1, nil, true)
+	serverCert := makeCert(t, 2, &ca, false)
+	clientCert := makeCert(t, 3, &ca, false)
+	settings := &TLSSettings{
+		CertFile:   filepath.Join(dir, "server.crt"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+		CACertFile: filepath.Join(dir, "ca.crt"),
+	}
+	writePEM(t, settings.CACertFile, "CERTIFICATE", ca.Certificate[0])
+	writePEM(t, settings.CertFile, "CERTIFICATE", serverCert.Certificate[0])
+	keyDER, err := x509.MarshalECPrivateKey(serverCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, settings.KeyFile, "EC PRIVATE KEY", keyDER)
+
+	tlsConfig, err := MakeTLSConfig(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	go ListenAndServe(newMultiListener(plainListener, tlsListener), MakeEchoHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	conn, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := echo(conn, "hello"); err != nil || reply != "hello" {
+		t.Errorf("expect hello over tls, actually %s %v", reply, err)
+	}
+	_ = conn.Close()
+
+	// client without certificate is refused
+	conn, err = tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		if _, err = echo(conn, "hello"); err == nil {
+			t.Error("expect client without certificate to be refused")
+		}
+		_ = conn.Close()
+	}
+
+	// plain listener is served by the same handler
+	plainConn, err := net.Dial("tcp", plainListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := echo(plainConn, "hello"); err != nil || reply != "hello" {
+		t.Errorf("expect hello over plain tcp, actually %s %v", reply, err)
+	}
+	_ = plainConn.Close()
+
+	settings.AuthClients = "maybe"
+	if _, err := MakeTLSConfig(settings); err == nil {
+		t.Error("expect error for illegal tls-auth-clients")
+	}
+}
@@ -0,0 +1,209 @@
+// Package tracking implements the server side of client side caching, see CLIENT TRACKING command
+package tracking
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+	"sync"
+)
+
+var invalidateBytes = []byte("invalidate")
+
+// Options is the options of CLIENT TRACKING ON
+type Options struct {
+	// BCast means the client is notified of all modified keys matching its prefixes, instead of keys it has read
+	BCast bool
+	// Prefixes filters keys in BCAST mode, empty prefixes means all keys
+	Prefixes []string
+	// NoLoop means the client won't be notified of keys modified by itself
+	NoLoop bool
+}
+
+type client struct {
+	conn redis.Connection
+	Options
+	// keys read by client in default mode
+	keys map[string]struct{}
+}
+
+func (c *client) matchPrefix(key string) bool {
+	if len(c.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Table records which clients are interested in which keys, and pushes invalidation messages when keys are modified.
+// A key read by a client in default mode is remembered until it is modified, so every read is notified at most once.
+type Table struct {
+	mu sync.Mutex
+	// key -> ids of clients who have read it
+	keys map[string]map[uint64]struct{}
+	// client id -> *client
+	clients map[uint64]*client
+}
+
+// MakeTable creates an empty tracking table
+func MakeTable() *Table {
+	return &Table{
+		keys:    make(map[string]map[uint64]struct{}),
+		clients: make(map[uint64]*client),
+	}
+}
+
+// Enable turns on tracking of the given connection, options of BCAST mode can't be switched without disabling first
+func (t *Table) Enable(conn redis.Connection, opts Options) protocol.ErrorReply {
+	if t == nil {
+		return protocol.MakeErrReply("ERR client tracking is not supported")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := conn.GetID()
+	if c, ok := t.clients[id]; ok {
+		if c.BCast != opts.BCast {
+			return protocol.MakeErrReply("ERR You can't switch BCAST mode on/off before disabling tracking " +
+				"for this client, and then re-enabling it with a different mode.")
+		}
+		c.Prefixes = append(c.Prefixes, opts.Prefixes...)
+		c.NoLoop = opts.NoLoop
+		return nil
+	}
+	t.clients[id] = &client{
+		conn:    conn,
+		Options: opts,
+		keys:    make(map[string]struct{}),
+	}
+	return nil
+}
+
+// Disable turns off tracking of the given connection and forgets keys it has read
+func (t *Table) Disable(conn redis.Connection) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := conn.GetID()
+	c, ok := t.clients[id]
+	if !ok {
+		return
+	}
+	for key := range c.keys {
+		t.forget(key, id)
+	}
+	delete(t.clients, id)
+}
+
+// IsTracking returns whether tracking of the given connection is on
+func (t *Table) IsTracking(conn redis.Connection) bool {
+	if t == nil || conn == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.clients[conn.GetID()]
+	return ok
+}
+
+func (t *Table) forget(key string, id uint64) {
+	ids := t.keys[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+// Remember records keys read by a client in default mode, it does nothing if tracking of the client is off or in BCAST mode
+func (t *Table) Remember(conn redis.Connection, keys []string) {
+	if t == nil || conn == nil || len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := conn.GetID()
+	c, ok := t.clients[id]
+	if !ok || c.BCast {
+		return
+	}
+	for _, key := range keys {
+		ids, ok := t.keys[key]
+		if !ok {
+			ids = make(map[uint64]struct{})
+			t.keys[key] = ids
+		}
+		ids[id] = struct{}{}
+		c.keys[key] = struct{}{}
+	}
+}
+
+// Invalidate notifies clients interested in the given keys, source is the connection modified keys and may be nil
+func (t *Table) Invalidate(source redis.Connection, keys []string) {
+	if t == nil || len(keys) == 0 {
+		return
+	}
+	var sourceID uint64
+	if source != nil {
+		sourceID = source.GetID()
+	}
+	t.mu.Lock()
+	if len(t.clients) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	messages := make(map[*client][][]byte)
+	for _, key := range keys {
+		for id := range t.keys[key] {
+			c := t.clients[id]
+			delete(c.keys, key)
+			if c.NoLoop && id == sourceID {
+				continue
+			}
+			messages[c] = append(messages[c], []byte(key))
+		}
+		delete(t.keys, key)
+		for id, c := range t.clients {
+			if !c.BCast || !c.matchPrefix(key) || (c.NoLoop && id == sourceID) {
+				continue
+			}
+			messages[c] = append(messages[c], []byte(key))
+		}
+	}
+	t.mu.Unlock()
+
+	for c, invalidated := range messages {
+		msg := protocol.MakePushReply([]redis.Reply{
+			protocol.MakeBulkReply(invalidateBytes),
+			protocol.MakeMultiBulkReply(invalidated),
+		}, true)
+		_ = c.conn.Write(msg.ToBytes())
+	}
+}
+
+// InvalidateAll notifies all tracking clients that the whole database has been flushed
+func (t *Table) InvalidateAll() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	clients := make([]*client, 0, len(t.clients))
+	for _, c := range t.clients {
+		clients = append(clients, c)
+		c.keys = make(map[string]struct{})
+	}
+	t.keys = make(map[string]map[uint64]struct{})
+	t.mu.Unlock()
+
+	msg := protocol.MakePushReply([]redis.Reply{
+		protocol.MakeBulkReply(invalidateBytes),
+		protocol.MakeNullReply(),
+	}, true).ToBytes()
+	for _, c := range clients {
+		_ = c.conn.Write(msg)
+	}
+}